@@ -0,0 +1,241 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package broker exchanges PK Tokens from CI and workload providers, such
+// as Github Actions and Gitlab CI, for the credentials workloads use
+// downstream: cloud STS tokens, registry credentials, database passwords.
+// Which workloads get which credentials is decided by rules on the claims
+// of their ID Tokens, and the credentials themselves are issued by
+// pluggable backends.
+//
+// A workload asks for a credential by sending its PK Token along with a
+// scoped assertion, see client.OpkClient.Scope, whose audience is the
+// broker and whose action names the backend and role, see Action. This
+// keeps a PK Token sent to the broker from being replayed elsewhere. Use
+// verifier.WithUseCounter on the broker's verifier to also limit how often
+// a PK Token can be exchanged.
+//
+// For example, a broker which lets the main branch of one repository
+// deploy with a cloud role:
+//
+//	b, err := broker.New("https://broker.example.com", pktVerifier,
+//		map[string]broker.Backend{"sts": jwtBackend},
+//		broker.Rule{
+//			Backend: "sts",
+//			Role:    "deploy",
+//			Claims: map[string][]string{
+//				"repository": {"my-org/my-repo"},
+//				"ref":        {"refs/heads/main"},
+//			},
+//		})
+//	http.Handle("/", broker.NewHandler(b))
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// DefaultTTL is how long credentials are valid for when a rule doesn't set
+// a TTL
+const DefaultTTL = 15 * time.Minute
+
+// ErrDenied is returned when no rule allows the PK Token the credential it
+// asked for
+var ErrDenied = errors.New("no rule allows the requested credential")
+
+// ErrBackend is wrapped by the errors of backends failing to issue a
+// credential
+var ErrBackend = errors.New("backend failed to issue credential")
+
+// Request is what a backend is asked to issue a credential for. The PK
+// Token has been verified and matched by a rule by the time a backend sees
+// it.
+type Request struct {
+	PKT *pktoken.PKToken
+	// Claims are the claims of the PK Token's ID Token
+	Claims  map[string]any
+	Backend string
+	Role    string
+	TTL     time.Duration
+}
+
+// Credential is a credential issued by a backend. Which fields are set
+// depends on Type, e.g. Token for a "bearer" credential or Username and
+// Password for a "password" credential.
+type Credential struct {
+	Type      string `json:"type"`
+	Token     string `json:"token,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// Backend issues credentials of one kind, e.g. tokens for a cloud's STS or
+// passwords for a database
+type Backend interface {
+	IssueCredential(ctx context.Context, req Request) (*Credential, error)
+}
+
+// BackendFunc adapts a function to a Backend
+type BackendFunc func(ctx context.Context, req Request) (*Credential, error)
+
+func (f BackendFunc) IssueCredential(ctx context.Context, req Request) (*Credential, error) {
+	return f(ctx, req)
+}
+
+// Rule allows PK Tokens whose ID Token claims match to get credentials for
+// Role from Backend
+type Rule struct {
+	Backend string
+	// Role is passed to the backend, what it means is up to the backend,
+	// e.g. the cloud role or database user
+	Role string
+	// Claims maps ID Token claims to the patterns, see path.Match, one of
+	// which the claim must match. Every claim listed must match. For a
+	// claim which is a list, one of its values must match.
+	Claims map[string][]string
+	// TTL is how long the credential is valid for, defaults to DefaultTTL
+	TTL time.Duration
+}
+
+func (r Rule) matches(claims map[string]any) bool {
+	for name, patterns := range r.Claims {
+		if !matchesAny(patterns, claimValues(claims[name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Broker exchanges PK Tokens for credentials
+type Broker struct {
+	// Audience is the audience scoped assertions must be for, typically the
+	// broker's URL
+	Audience string
+	Verifier *verifier.Verifier
+	Backends map[string]Backend
+	Rules    []Rule
+}
+
+// New creates a broker, checking that every rule names a configured backend
+// and has valid claim patterns
+func New(audience string, v *verifier.Verifier, backends map[string]Backend, rules ...Rule) (*Broker, error) {
+	if audience == "" {
+		return nil, fmt.Errorf("broker requires an audience")
+	}
+	for i, rule := range rules {
+		if _, ok := backends[rule.Backend]; !ok {
+			return nil, fmt.Errorf("rule %d: unknown backend: %s", i, rule.Backend)
+		}
+		if len(rule.Claims) == 0 {
+			return nil, fmt.Errorf("rule %d: at least one claim must be matched", i)
+		}
+		for name, patterns := range rule.Claims {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("rule %d: claim %s: invalid pattern %q: %w", i, name, pattern, err)
+				}
+			}
+		}
+	}
+	return &Broker{
+		Audience: audience,
+		Verifier: v,
+		Backends: backends,
+		Rules:    rules,
+	}, nil
+}
+
+// Action is the action of the scoped assertion a PK Token is sent to the
+// broker with to exchange it for a credential for role from backend
+func Action(backend string, role string) string {
+	return backend + ":" + role
+}
+
+// Exchange verifies the PK Token and its scoped assertion and issues the
+// credential for role from backend if a rule allows it. It returns an error
+// wrapping ErrDenied if no rule does and ErrBackend if the backend fails.
+func (b *Broker) Exchange(ctx context.Context, pkt *pktoken.PKToken, assertion []byte, backend string, role string) (*Credential, error) {
+	if err := b.Verifier.VerifyPKToken(ctx, pkt, verifier.RequireScope(assertion, b.Audience, Action(backend, role))); err != nil {
+		return nil, fmt.Errorf("failed to verify PK Token: %w", err)
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal PK Token: %w", err)
+	}
+	for _, rule := range b.Rules {
+		if rule.Backend != backend || rule.Role != role || !rule.matches(claims) {
+			continue
+		}
+		ttl := rule.TTL
+		if ttl == 0 {
+			ttl = DefaultTTL
+		}
+		cred, err := b.Backends[backend].IssueCredential(ctx, Request{
+			PKT:     pkt,
+			Claims:  claims,
+			Backend: backend,
+			Role:    role,
+			TTL:     ttl,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrBackend, backend, err)
+		}
+		return cred, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDenied, Action(backend, role))
+}
+
+// claimValues returns the string values of a claim. Lists, like aud, have
+// each of their values returned and non-string values are formatted, e.g.
+// Gitlab's boolean ref_protected as "true".
+func claimValues(claim any) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []any:
+		values := []string{}
+		for _, e := range v {
+			values = append(values, claimValues(e)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func matchesAny(patterns []string, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			// Patterns were checked in New
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
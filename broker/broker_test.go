@@ -0,0 +1,187 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package broker_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/broker"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+// newWorkload returns a client logged in to a mock CI provider issuing ID
+// Tokens with the claims, and a verifier for that provider
+func newWorkload(t *testing.T, claims map[string]any) (*client.OpkClient, *verifier.Verifier) {
+	clientID := "broker"
+	op, backend, _, err := providers.NewMockProvider(providers.MockProviderOpts{
+		Issuer:     "https://ci.example.com",
+		ClientID:   clientID,
+		NumKeys:    1,
+		CommitType: providers.CommitTypesEnum.NONCE_CLAIM,
+		VerifierOpts: providers.ProviderVerifierOpts{
+			CommitType: providers.CommitTypesEnum.NONCE_CLAIM,
+			ClientID:   clientID,
+		},
+	})
+	require.NoError(t, err)
+	signingKey, keyID, record := backend.RandomSigningKey()
+	backend.SetIDTokenTemplate(&mocks.IDTokenTemplate{
+		CommitFunc:  mocks.AddNonceCommit,
+		Issuer:      op.Issuer(),
+		Subject:     "repo:my-org/my-repo:ref:refs/heads/main",
+		Aud:         clientID,
+		KeyID:       keyID,
+		Alg:         record.Alg,
+		ExtraClaims: claims,
+		SigningKey:  signingKey,
+	})
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	_, err = opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	pktVerifier, err := verifier.New(op)
+	require.NoError(t, err)
+	return opkClient, pktVerifier
+}
+
+func TestExchange(t *testing.T) {
+	opkClient, pktVerifier := newWorkload(t, map[string]any{
+		"repository":    "my-org/my-repo",
+		"ref":           "refs/heads/main",
+		"ref_protected": true,
+	})
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	key, err := cosigner.NewSigningKey(jwa.ES256)
+	require.NoError(t, err)
+	jwtBackend := &broker.JWTBackend{
+		Issuer:     srv.URL,
+		Audience:   "sts.example.com",
+		Keys:       cosigner.NewKeyring(key),
+		CopyClaims: []string{"repository"},
+	}
+	b, err := broker.New(srv.URL, pktVerifier,
+		map[string]broker.Backend{
+			"sts": jwtBackend,
+			"db": broker.BackendFunc(func(context.Context, broker.Request) (*broker.Credential, error) {
+				return nil, fmt.Errorf("database is down")
+			}),
+		},
+		broker.Rule{
+			Backend: "sts",
+			Role:    "deploy",
+			Claims: map[string][]string{
+				"repository":    {"my-org/*"},
+				"ref":           {"refs/heads/main"},
+				"ref_protected": {"true"},
+			},
+			TTL: 5 * time.Minute,
+		},
+		broker.Rule{
+			Backend: "sts",
+			Role:    "admin",
+			Claims:  map[string][]string{"repository": {"my-org/admin"}},
+		},
+		broker.Rule{
+			Backend: "db",
+			Role:    "readonly",
+			Claims:  map[string][]string{"repository": {"my-org/my-repo"}},
+		},
+	)
+	require.NoError(t, err)
+	mux.Handle(broker.TokenPath, broker.NewHandler(b))
+	mux.Handle("/.well-known/", jwtBackend.DiscoveryHandler())
+
+	brokerClient := broker.Client{URL: srv.URL}
+	pkt, err := opkClient.GetPKToken()
+	require.NoError(t, err)
+	exchange := func(backend string, role string) (*broker.Credential, error) {
+		assertion, err := opkClient.Scope(srv.URL, client.WithScopeAction(broker.Action(backend, role)))
+		require.NoError(t, err)
+		return brokerClient.Exchange(ctx, pkt, assertion, backend, role)
+	}
+
+	cred, err := exchange("sts", "deploy")
+	require.NoError(t, err)
+	require.Equal(t, "bearer", cred.Type)
+	require.InDelta(t, time.Now().Add(5*time.Minute).Unix(), cred.ExpiresAt, 5)
+
+	// The cloud verifies the JWT with the keys the broker publishes
+	record, err := discover.DefaultPubkeyFinder().ByToken(ctx, srv.URL, []byte(cred.Token))
+	require.NoError(t, err)
+	payload, err := jws.Verify([]byte(cred.Token), jws.WithKey(jwa.SignatureAlgorithm(record.Alg), record.PublicKey))
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{
+		"iss": %q, "sub": "repo:my-org/my-repo:ref:refs/heads/main", "aud": "sts.example.com",
+		"iat": %d, "exp": %d, "role": "deploy", "repository": "my-org/my-repo"
+	}`, srv.URL, cred.ExpiresAt-int64(5*time.Minute/time.Second), cred.ExpiresAt), string(payload))
+
+	_, err = exchange("sts", "admin")
+	require.ErrorContains(t, err, "403 Forbidden")
+
+	_, err = exchange("db", "readonly")
+	require.ErrorContains(t, err, "502 Bad Gateway")
+	require.NotContains(t, err.Error(), "database is down")
+
+	// The assertion must be for the credential asked for
+	assertion, err := opkClient.Scope(srv.URL, client.WithScopeAction(broker.Action("sts", "admin")))
+	require.NoError(t, err)
+	_, err = brokerClient.Exchange(ctx, pkt, assertion, "sts", "deploy")
+	require.ErrorContains(t, err, "401 Unauthorized")
+
+	// and for the broker
+	assertion, err = opkClient.Scope("https://other.example.com", client.WithScopeAction(broker.Action("sts", "deploy")))
+	require.NoError(t, err)
+	_, err = brokerClient.Exchange(ctx, pkt, assertion, "sts", "deploy")
+	require.ErrorContains(t, err, "401 Unauthorized")
+}
+
+func TestNewRejectsBadRules(t *testing.T) {
+	backends := map[string]broker.Backend{"sts": &broker.JWTBackend{}}
+
+	_, err := broker.New("", nil, backends)
+	require.ErrorContains(t, err, "requires an audience")
+
+	_, err = broker.New("https://broker.example.com", nil, backends,
+		broker.Rule{Backend: "registry", Claims: map[string][]string{"sub": {"*"}}})
+	require.ErrorContains(t, err, "rule 0: unknown backend: registry")
+
+	_, err = broker.New("https://broker.example.com", nil, backends, broker.Rule{Backend: "sts"})
+	require.ErrorContains(t, err, "rule 0: at least one claim must be matched")
+
+	_, err = broker.New("https://broker.example.com", nil, backends,
+		broker.Rule{Backend: "sts", Claims: map[string][]string{"repository": {"my-org/["}}})
+	require.ErrorContains(t, err, "rule 0: claim repository: invalid pattern")
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// Client exchanges PK Tokens for credentials at a broker served by
+// NewHandler
+type Client struct {
+	// URL is the broker's URL, which scoped assertions sent to it must have
+	// as their audience
+	URL string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Exchange sends the PK Token and the scoped assertion, which must be for
+// the broker's URL and Action(backend, role), and returns the credential
+func (c *Client) Exchange(ctx context.Context, pkt *pktoken.PKToken, assertion []byte, backend string, role string) (*Credential, error) {
+	pktCom, err := pkt.Compact()
+	if err != nil {
+		return nil, err
+	}
+	tokenURI, err := url.JoinPath(c.URL, TokenPath)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"pkt":       {string(pktCom)},
+		"assertion": {string(assertion)},
+		"backend":   {backend},
+		"role":      {role},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting credential from broker: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("broker returned error status: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var cred Credential
+	if err := json.NewDecoder(res.Body).Decode(&cred); err != nil {
+		return nil, fmt.Errorf("malformed credential from broker: %w", err)
+	}
+	return &cred, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// TokenPath is where the handler exchanges PK Tokens for credentials
+const TokenPath = "/token"
+
+// NewHandler serves the broker at TokenPath. Clients send
+//
+//	POST /token
+//	Content-Type: application/x-www-form-urlencoded
+//
+//	pkt=<compact PK Token>&assertion=<scoped assertion>&backend=<backend>&role=<role>
+//
+// and get back 200 OK with the JSON Credential, 401 Unauthorized if the PK
+// Token or assertion doesn't verify, 403 Forbidden if no rule allows the
+// credential or 502 Bad Gateway if the backend fails. Client sends these
+// requests.
+func NewHandler(b *Broker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(TokenPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pkt, err := pktoken.NewFromCompact([]byte(r.PostFormValue("pkt")))
+		if err != nil {
+			http.Error(w, "malformed PK Token", http.StatusBadRequest)
+			return
+		}
+		backend := r.PostFormValue("backend")
+		if backend == "" {
+			http.Error(w, "missing backend", http.StatusBadRequest)
+			return
+		}
+
+		cred, err := b.Exchange(r.Context(), pkt, []byte(r.PostFormValue("assertion")), backend, r.PostFormValue("role"))
+		if errors.Is(err, ErrDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if errors.Is(err, ErrBackend) {
+			// Don't tell the client why the backend failed, it may leak
+			// details of the downstream system
+			http.Error(w, "failed to issue credential", http.StatusBadGateway)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, err := json.Marshal(cred)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})
+	return mux
+}
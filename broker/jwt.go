@@ -0,0 +1,121 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// JWTBackend issues JWTs for workload identity federation, e.g. AWS
+// AssumeRoleWithWebIdentity or GCP workload identity federation, which
+// exchange a JWT from a trusted OpenID issuer for cloud credentials. The
+// broker is that issuer, so the cloud only has to trust the broker rather
+// than every CI provider, and the broker's rules decide which workloads
+// get which roles. Serve DiscoveryHandler at Issuer so the cloud can find
+// the keys.
+type JWTBackend struct {
+	Issuer string
+	// Audience is the aud of the JWTs, as configured at the cloud
+	Audience string
+	// Keys sign the JWTs. Set Keys.Retention to at least the longest rule
+	// TTL so that JWTs stay verifiable across key rotations.
+	Keys *cosigner.Keyring
+	// CopyClaims are the ID Token claims copied into the JWTs, e.g.
+	// repository, for the cloud's policies to match on
+	CopyClaims []string
+}
+
+// IssueCredential issues a bearer JWT for the workload with the role in
+// the role claim
+func (j *JWTBackend) IssueCredential(_ context.Context, req Request) (*Credential, error) {
+	sub, ok := req.Claims["sub"].(string)
+	if !ok || sub == "" {
+		return nil, fmt.Errorf("ID Token has no sub claim")
+	}
+	now := time.Now()
+	exp := now.Add(req.TTL)
+	claims := map[string]any{}
+	for _, name := range j.CopyClaims {
+		if v, ok := req.Claims[name]; ok {
+			claims[name] = v
+		}
+	}
+	claims["iss"] = j.Issuer
+	claims["sub"] = sub
+	claims["aud"] = j.Audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = exp.Unix()
+	claims["role"] = req.Role
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	key := j.Keys.Current()
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.KeyIDKey, key.KeyID); err != nil {
+		return nil, err
+	}
+	if err := headers.Set(jws.TypeKey, "JWT"); err != nil {
+		return nil, err
+	}
+	token, err := jws.Sign(payload, jws.WithKey(key.Alg, key.Signer, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{
+		Type:      "bearer",
+		Token:     string(token),
+		ExpiresAt: exp.Unix(),
+	}, nil
+}
+
+// DiscoveryHandler serves the OpenID configuration and JWKS the cloud
+// verifies the JWTs with, it must be served at Issuer
+func (j *JWTBackend) DiscoveryHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		jwksURI, err := url.JoinPath(j.Issuer, "/.well-known/jwks.json")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(map[string]any{
+			"issuer":                                j.Issuer,
+			"jwks_uri":                              jwksURI,
+			"response_types_supported":              []string{"id_token"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{j.Keys.Current().Alg.String()},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	mux.HandleFunc("/.well-known/jwks.json", j.Keys.JWKSHandler())
+	return mux
+}
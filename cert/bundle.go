@@ -0,0 +1,83 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PEMBundle returns the private key of signer, PKCS#8 encoded, followed by
+// the certificate chain issued for it, e.g. by Issuer.Issue, as a single
+// PEM file. Most TLS servers and clients, e.g. tls.X509KeyPair, nginx and
+// curl, accept it as both the key and the certificate. signer must be the
+// key in the PK Token the certificate was issued for, e.g. the
+// OpkClient's signer, and be exportable.
+func PEMBundle(signer crypto.Signer, chainPEM []byte) ([]byte, error) {
+	certs, err := chainForSigner(signer, chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %w", err)
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	for _, cert := range certs {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return bundle, nil
+}
+
+// PKCS12Bundle returns the private key of signer and the certificate
+// chain issued for it as a PKCS#12 file encrypted with passphrase, for
+// consumers such as Java key stores and Windows that don't read PEM. The
+// file is encrypted with AES-256 and PBKDF2, as in OpenSSL 3, which older
+// readers may not support. signer must be exportable, as for PEMBundle.
+func PKCS12Bundle(signer crypto.Signer, chainPEM []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required to protect the private key")
+	}
+	certs, err := chainForSigner(signer, chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	pfx, err := pkcs12.Modern.Encode(signer, certs[0], certs[1:], passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding PKCS#12 file: %w", err)
+	}
+	return pfx, nil
+}
+
+// chainForSigner parses the chain and checks its first certificate is for
+// signer's key, so a bundle can't pair a key with another key's
+// certificate
+func chainForSigner(signer crypto.Signer, chainPEM []byte) ([]*x509.Certificate, error) {
+	certs, err := parseChain(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	leafKey, ok := certs[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(signer.Public()) {
+		return nil, fmt.Errorf("certificate is not for the signer's public key")
+	}
+	return certs, nil
+}
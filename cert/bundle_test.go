@@ -0,0 +1,93 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestBundles(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root, err := CreateCACert(pkix.Name{CommonName: "root"}, &rootKey.PublicKey, nil, rootKey, time.Hour)
+	require.NoError(t, err)
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	intermediate, err := CreateCACert(pkix.Name{CommonName: "intermediate"}, &intermediateKey.PublicKey, root, rootKey, time.Hour)
+	require.NoError(t, err)
+	issuer := &Issuer{Verifier: v, CACert: intermediate, Signer: intermediateKey}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	require.NoError(t, err)
+	chainPEM, err := issuer.Issue(ctx, csrDER, pkt)
+	require.NoError(t, err)
+
+	bundle, err := PEMBundle(signer, chainPEM)
+	require.NoError(t, err)
+	keyPair, err := tls.X509KeyPair(bundle, bundle)
+	require.NoError(t, err)
+	require.Len(t, keyPair.Certificate, 2)
+	require.Equal(t, intermediate.Raw, keyPair.Certificate[1])
+
+	pfx, err := PKCS12Bundle(signer, chainPEM, "passphrase")
+	require.NoError(t, err)
+	key, leaf, caCerts, err := pkcs12.DecodeChain(pfx, "passphrase")
+	require.NoError(t, err)
+	require.True(t, key.(*ecdsa.PrivateKey).Equal(signer))
+	require.Equal(t, keyPair.Certificate[0], leaf.Raw)
+	require.Len(t, caCerts, 1)
+	require.True(t, caCerts[0].Equal(intermediate))
+	_, _, _, err = pkcs12.DecodeChain(pfx, "wrong")
+	require.Error(t, err)
+
+	_, err = PKCS12Bundle(signer, chainPEM, "")
+	require.ErrorContains(t, err, "passphrase")
+	otherSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	_, err = PEMBundle(otherSigner, chainPEM)
+	require.ErrorContains(t, err, "not for the signer's public key")
+	_, err = PKCS12Bundle(otherSigner, chainPEM, "passphrase")
+	require.ErrorContains(t, err, "not for the signer's public key")
+}
@@ -32,12 +32,22 @@ import (
 	"github.com/openpubkey/openpubkey/pktoken"
 )
 
+var (
+	// OIDIssuer is the extension with the OIDC issuer of the ID Token
+	OIDIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	// OIDCosigner is the extension with the Cosigner that cosigned the PK
+	// Token, added by an Issuer that verified the cosigner signature
+	OIDCosigner = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1, 1}
+)
+
 // CreateX509Cert generates a self-signed x509 cert from a PK token
 //   - OP 'sub' claim is mapped to the CN and SANs fields
 //   - User public key is mapped to the RawSubjectPublicKeyInfo field
 //   - Raw PK token is mapped to the SubjectKeyId field
-func CreateX509Cert(pkToken *pktoken.PKToken, signer crypto.Signer) ([]byte, error) {
-	template, err := PktToX509Template(pkToken)
+//
+// opts customize the certificate as for PktToX509Template.
+func CreateX509Cert(pkToken *pktoken.PKToken, signer crypto.Signer, opts ...TemplateOpts) ([]byte, error) {
+	template, err := PktToX509Template(pkToken, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating X.509 template: %w", err)
 	}
@@ -52,8 +62,19 @@ func CreateX509Cert(pkToken *pktoken.PKToken, signer crypto.Signer) ([]byte, err
 }
 
 // PktToX509Template takes a PK Token and returns a X.509 certificate template
-// with the fields of the template set to the values in the X509
-func PktToX509Template(pkt *pktoken.PKToken) (*x509.Certificate, error) {
+// with the fields of the template set to the values in the X509. By default
+// the certificate is valid for a year for code signing and has the sub
+// claim as a DNS SAN, opts change this.
+func PktToX509Template(pkt *pktoken.PKToken, opts ...TemplateOpts) (*x509.Certificate, error) {
+	options := &templateOptions{validity: 365 * 24 * time.Hour}
+	for _, applyOpt := range opts {
+		applyOpt(options)
+	}
+	extKeyUsage := options.extKeyUsage
+	if len(extKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	}
+
 	pktJson, err := json.Marshal(pkt)
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling PK token to JSON: %w", err)
@@ -80,25 +101,38 @@ func PktToX509Template(pkt *pktoken.PKToken) (*x509.Certificate, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling public key: %w", err)
 	}
+	now := time.Now()
 	template := &x509.Certificate{
 		SerialNumber:            big.NewInt(1),
 		Subject:                 pkix.Name{CommonName: idtClaims.Subject},
 		RawSubjectPublicKeyInfo: ecPub,
-		NotBefore:               time.Now(),
-		NotAfter:                time.Now().Add(365 * 24 * time.Hour), // valid for 1 year
+		NotBefore:               now,
+		NotAfter:                now.Add(options.validity),
 		KeyUsage:                x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:             []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtKeyUsage:             extKeyUsage,
 		BasicConstraintsValid:   true,
-		DNSNames:                []string{idtClaims.Subject},
 		IsCA:                    false,
-		ExtraExtensions: []pkix.Extension{{
-			// OID for OIDC Issuer extension
-			Id:       asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1},
+		ExtraExtensions: append([]pkix.Extension{{
+			Id:       OIDIssuer,
 			Critical: false,
 			Value:    []byte(idtClaims.Issuer),
-		}},
+		}}, options.extensions...),
 		SubjectKeyId: pktJson,
 	}
 
+	if len(options.sans) == 0 {
+		template.DNSNames = []string{idtClaims.Subject}
+	} else {
+		var claims map[string]any
+		if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+			return nil, err
+		}
+		for _, addSANs := range options.sans {
+			if err := addSANs(claims, template); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return template, nil
 }
@@ -19,9 +19,12 @@ package cert
 import (
 	"context"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
 	"encoding/pem"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
@@ -78,3 +81,56 @@ func TestCreateX509Cert(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, payload.Subject, result.Subject.CommonName, "cert common name does not equal pk token sub claim")
 }
+
+func TestX509TemplateOpts(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{
+		"email":            "arthur.aardvark@example.com",
+		"email_verified":   true,
+		"job_workflow_ref": "octo-org/octo-repo/.github/workflows/release.yml@refs/heads/main",
+	}
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkToken, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	// Defaults are unchanged
+	template, err := PktToX509Template(pkToken)
+	require.NoError(t, err)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, template.ExtKeyUsage)
+	require.Equal(t, []string{"me"}, template.DNSNames)
+	require.WithinDuration(t, template.NotBefore.Add(365*24*time.Hour), template.NotAfter, time.Second)
+	require.Len(t, template.ExtraExtensions, 1)
+
+	extension := pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte("value")}
+	template, err = PktToX509Template(pkToken,
+		WithValidity(time.Hour),
+		WithExtKeyUsages(x509.ExtKeyUsageClientAuth),
+		WithSANs(EmailSAN(), URISAN("https://github.com/%s", "job_workflow_ref")),
+		WithExtensions(extension),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, template.ExtKeyUsage)
+	require.Empty(t, template.DNSNames)
+	require.Equal(t, []string{"arthur.aardvark@example.com"}, template.EmailAddresses)
+	require.Len(t, template.URIs, 1)
+	require.Equal(t, "https://github.com/octo-org/octo-repo/.github/workflows/release.yml@refs/heads/main", template.URIs[0].String())
+	require.Equal(t, template.NotBefore.Add(time.Hour), template.NotAfter)
+	require.Equal(t, extension, template.ExtraExtensions[1])
+
+	// The certificate can be created from the template
+	certPEM, err := CreateX509Cert(pkToken, signer, WithSANs(EmailSAN(), DNSSAN("sub")))
+	require.NoError(t, err)
+	p, _ := pem.Decode(certPEM)
+	result, err := x509.ParseCertificate(p.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, []string{"arthur.aardvark@example.com"}, result.EmailAddresses)
+	require.Equal(t, []string{"me"}, result.DNSNames)
+
+	_, err = PktToX509Template(pkToken, WithSANs(URISAN("https://github.com/%s", "repository")))
+	require.ErrorContains(t, err, "no repository claim")
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// CreateCACert creates a certificate for a CA with the public key pub. If
+// parent is nil it is a self-signed root signed by signer, which must hold
+// pub. Otherwise it is an intermediate CA signed by the parent CA's signer
+// and can only sign leaf certificates, e.g. as the CACert of an Issuer, so
+// that the root key can be kept offline.
+func CreateCACert(subject pkix.Name, pub crypto.PublicKey, parent *x509.Certificate, signer crypto.Signer, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent = template
+	} else {
+		template.MaxPathLenZero = true
+		// An intermediate can't outlive its issuer
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CA certificate: %w", err)
+	}
+	return x509.ParseCertificate(certDER)
+}
+
+// VerifyChain verifies a PEM encoded certificate chain, as returned by
+// Issuer.Issue, up to one of roots and checks that the PK Token in the leaf
+// certificate is for the leaf's public key. The chain is the leaf followed
+// by the intermediate CAs that issued it. The PK Token itself isn't
+// verified, it is returned for the caller to verify.
+func VerifyChain(chainPEM []byte, roots *x509.CertPool) (*x509.Certificate, *pktoken.PKToken, error) {
+	certs, err := parseChain(chainPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, nil, fmt.Errorf("failed to verify certificate chain: %w", err)
+	}
+
+	pkt, err := PKTokenFromCert(leaf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf, pkt, nil
+}
+
+// PKTokenFromCert returns the PK Token in a certificate made by
+// CreateX509Cert or an Issuer and checks that it is for the certificate's
+// public key. The PK Token itself isn't verified.
+func PKTokenFromCert(leaf *x509.Certificate) (*pktoken.PKToken, error) {
+	pkt := new(pktoken.PKToken)
+	if err := json.Unmarshal(leaf.SubjectKeyId, pkt); err != nil {
+		return nil, fmt.Errorf("certificate has no PK Token: %w", err)
+	}
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return nil, err
+	}
+	var upk crypto.PublicKey
+	if err := cic.PublicKey().Raw(&upk); err != nil {
+		return nil, err
+	}
+	upkBytes, err := x509.MarshalPKIXPublicKey(upk)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(upkBytes, leaf.RawSubjectPublicKeyInfo) {
+		return nil, fmt.Errorf("public key in certificate does not match PK Token's public key")
+	}
+	return pkt, nil
+}
+
+// parseChain parses the certificates in a PEM encoded chain, skipping
+// other PEM blocks
+func parseChain(chainPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in chain")
+	}
+	return certs, nil
+}
+
+// randomSerial returns a serial number for a certificate, RFC 5280 allows
+// up to 20 octets
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 159))
+}
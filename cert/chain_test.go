@@ -0,0 +1,111 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntermediateCA(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	require.NoError(t, err)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root, err := CreateCACert(pkix.Name{CommonName: "root"}, &rootKey.PublicKey, nil, rootKey, 24*time.Hour)
+	require.NoError(t, err)
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	intermediate, err := CreateCACert(pkix.Name{CommonName: "intermediate"}, &intermediateKey.PublicKey, root, rootKey, 48*time.Hour)
+	require.NoError(t, err)
+	require.True(t, intermediate.MaxPathLenZero)
+	require.Equal(t, root.NotAfter, intermediate.NotAfter)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	issuer := &Issuer{Verifier: v, CACert: intermediate, Signer: intermediateKey}
+	chainPEM, err := issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	leaf, verifiedPKT, err := VerifyChain(chainPEM, roots)
+	require.NoError(t, err)
+	require.Equal(t, pkt.OpToken, verifiedPKT.OpToken)
+	require.False(t, leaf.NotAfter.After(intermediate.NotAfter))
+
+	// The intermediate is needed to reach the root
+	block, _ := pem.Decode(chainPEM)
+	_, _, err = VerifyChain(pem.EncodeToMemory(block), roots)
+	require.ErrorContains(t, err, "failed to verify certificate chain")
+
+	otherRootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherRoot, err := CreateCACert(pkix.Name{CommonName: "other root"}, &otherRootKey.PublicKey, nil, otherRootKey, time.Hour)
+	require.NoError(t, err)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherRoot)
+	_, _, err = VerifyChain(chainPEM, otherRoots)
+	require.ErrorContains(t, err, "failed to verify certificate chain")
+
+	// Leaves issued by the root directly have no intermediates
+	issuer = &Issuer{Verifier: v, CACert: root, Signer: rootKey}
+	chainPEM, err = issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	_, rest := pem.Decode(chainPEM)
+	require.Empty(t, rest)
+	_, _, err = VerifyChain(chainPEM, roots)
+	require.NoError(t, err)
+
+	// An intermediate can't create further CAs
+	subKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sub, err := CreateCACert(pkix.Name{CommonName: "sub"}, &subKey.PublicKey, intermediate, intermediateKey, time.Hour)
+	require.NoError(t, err)
+	issuer = &Issuer{Verifier: v, CACert: sub, Signer: subKey, Intermediates: []*x509.Certificate{intermediate}}
+	chainPEM, err = issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	_, _, err = VerifyChain(chainPEM, roots)
+	require.ErrorContains(t, err, "failed to verify certificate chain")
+
+	_, _, err = VerifyChain([]byte("not PEM"), roots)
+	require.ErrorContains(t, err, "no certificate")
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// Issuer is a CA that issues X.509 certificates to the holders of PK Tokens
+// from PKCS#10 certificate signing requests, so that it can be run as a
+// network service: clients send a CSR signed by the key in their PK Token
+// along with the PK Token.
+type Issuer struct {
+	// Verifier fully verifies the PK Token, configure it with the OpenID
+	// Providers whose users may get certificates
+	Verifier *verifier.Verifier
+	// CACert and Signer are the certificate and key of the CA, a root or an
+	// intermediate CA created by CreateCACert
+	CACert *x509.Certificate
+	Signer crypto.Signer
+	// Intermediates are the CAs between CACert and the root, CACert's
+	// issuer first. They are appended to the chain Issue returns.
+	Intermediates []*x509.Certificate
+	// Validity is how long issued certificates are valid for, if set it
+	// overrides WithValidity in TemplateOpts
+	Validity time.Duration
+	// TemplateOpts customize the issued certificates, e.g. WithSANs
+	TemplateOpts []TemplateOpts
+	// Policy, if set, must allow the verified PK Token
+	Policy *IssuancePolicy
+	// Store, if set, records the issued certificates so they can be
+	// revoked, see CreateCRL and NewRevocationHandler
+	Store CertStore
+	// CRLURL and OCSPURL, if set, are added to the issued certificates so
+	// relying parties can check if they are revoked. When serving the
+	// Issuer with NewHandler they are its CRLPath and OCSPPath.
+	CRLURL  string
+	OCSPURL string
+}
+
+// Cosigner identifies the cosigner of the PK Token a certificate was
+// issued for, it is the JSON value of the OIDCosigner extension
+type Cosigner struct {
+	Issuer string `json:"iss"`
+	KeyID  string `json:"kid"`
+	// AuthID identifies the authentication, e.g. MFA, the cosigner performed
+	AuthID string `json:"eid,omitempty"`
+}
+
+// CertCosigner returns the cosigner recorded in a certificate issued by an
+// Issuer, nil if it has none
+func CertCosigner(cert *x509.Certificate) (*Cosigner, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OIDCosigner) {
+			cosigner := new(Cosigner)
+			if err := json.Unmarshal(ext.Value, cosigner); err != nil {
+				return nil, fmt.Errorf("malformed cosigner extension: %w", err)
+			}
+			return cosigner, nil
+		}
+	}
+	return nil, nil
+}
+
+// ErrInvalidCSR is wrapped by the errors Issue returns for malformed
+// certificate signing requests
+var ErrInvalidCSR = errors.New("invalid certificate signing request")
+
+// Issue verifies the PK Token and that the CSR is signed by the key in the
+// PK Token, then returns a PEM encoded certificate for the key signed by
+// the CA. If CACert is an intermediate CA it is followed by CACert and
+// Intermediates, so the chain can be checked with VerifyChain. The fields
+// of the certificate are set from the PK Token as by PktToX509Template
+// with TemplateOpts, the subject and extensions requested in the CSR are
+// ignored.
+func (i *Issuer) Issue(ctx context.Context, csrDER []byte, pkt *pktoken.PKToken) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error parsing CSR: %w", ErrInvalidCSR, err)
+	}
+	// Proves the requester holds the private key
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: invalid CSR signature: %w", ErrInvalidCSR, err)
+	}
+
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return nil, err
+	}
+	var upk crypto.PublicKey
+	if err := cic.PublicKey().Raw(&upk); err != nil {
+		return nil, err
+	}
+	csrKey, ok := csr.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !csrKey.Equal(upk) {
+		return nil, fmt.Errorf("CSR public key does not match the PK Token's public key")
+	}
+
+	report := i.Verifier.VerifyPKTokenReport(ctx, pkt)
+	if !report.Valid {
+		return nil, fmt.Errorf("failed to verify PK token: %w", report.Err)
+	}
+	// Only vouch for a cosigner whose signature was verified
+	check, _ := report.Check(verifier.CheckCosigner)
+	cosignerVerified := check.Status == verifier.CheckPassed && pkt.Cos != nil
+	if i.Policy != nil {
+		if err := i.Policy.Check(pkt); err != nil {
+			return nil, fmt.Errorf("PK token not allowed by issuance policy: %w", err)
+		}
+		if i.Policy.requiresCosigner() && !cosignerVerified {
+			return nil, fmt.Errorf("the issuance policy requires a cosigner but the verifier doesn't verify cosigner signatures")
+		}
+	}
+
+	templateOpts := i.TemplateOpts
+	if i.Validity > 0 {
+		templateOpts = append(slices.Clip(templateOpts), WithValidity(i.Validity))
+	}
+	template, err := PktToX509Template(pkt, templateOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating X.509 template: %w", err)
+	}
+	template.RawSubjectPublicKeyInfo = csr.RawSubjectPublicKeyInfo
+	// Serials must be unique per CA
+	if template.SerialNumber, err = randomSerial(); err != nil {
+		return nil, err
+	}
+	if template.NotAfter.After(i.CACert.NotAfter) {
+		template.NotAfter = i.CACert.NotAfter
+	}
+	if i.CRLURL != "" {
+		template.CRLDistributionPoints = []string{i.CRLURL}
+	}
+	if i.OCSPURL != "" {
+		template.OCSPServer = []string{i.OCSPURL}
+	}
+	if cosignerVerified {
+		cosClaims, err := pkt.ParseCosignerClaims()
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(Cosigner{Issuer: cosClaims.Issuer, KeyID: cosClaims.KeyID, AuthID: cosClaims.AuthID})
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: OIDCosigner, Value: value})
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, i.CACert, csr.PublicKey, i.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating X.509 certificate: %w", err)
+	}
+	if i.Store != nil {
+		// Certificates that can't be revoked must not be handed out
+		var idtClaims oidc.OidcClaims
+		if err := json.Unmarshal(pkt.Payload, &idtClaims); err != nil {
+			return nil, err
+		}
+		if err := i.Store.Add(ctx, CertRecord{
+			Serial:   template.SerialNumber,
+			Issuer:   idtClaims.Issuer,
+			Subject:  idtClaims.Subject,
+			NotAfter: template.NotAfter,
+		}); err != nil {
+			return nil, fmt.Errorf("error recording certificate: %w", err)
+		}
+	}
+	chainPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	// A root is left out, verifiers must already trust it
+	if !bytes.Equal(i.CACert.RawIssuer, i.CACert.RawSubject) || i.CACert.CheckSignatureFrom(i.CACert) != nil {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.CACert.Raw})...)
+	}
+	for _, intermediate := range i.Intermediates {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+	}
+	return chainPEM, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/testkit"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuer(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caCert, err := CreateCACert(pkix.Name{CommonName: "test CA"}, &caKey.PublicKey, nil, caKey, 24*time.Hour)
+	require.NoError(t, err)
+
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+	issuer := &Issuer{Verifier: v, CACert: caCert, Signer: caKey, Validity: time.Hour}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "ignored"}}, signer)
+	require.NoError(t, err)
+	certPEM, err := issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, leaf.CheckSignatureFrom(caCert))
+	require.True(t, leaf.PublicKey.(*ecdsa.PublicKey).Equal(signer.Public()))
+	require.Equal(t, "me", leaf.Subject.CommonName)
+	require.WithinDuration(t, leaf.NotBefore.Add(time.Hour), leaf.NotAfter, time.Second)
+
+	// The CSR must be for the key in the PK Token
+	otherKey, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	otherCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, otherKey)
+	require.NoError(t, err)
+	_, err = issuer.Issue(ctx, otherCSR, pkt)
+	require.ErrorContains(t, err, "does not match")
+
+	_, err = issuer.Issue(ctx, []byte("not a CSR"), pkt)
+	require.ErrorContains(t, err, "error parsing CSR")
+
+	// The PK Token must verify, not only its CIC signature
+	otherOp, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	issuer.Verifier, err = verifier.New(otherOp)
+	require.NoError(t, err)
+	_, err = issuer.Issue(ctx, csr, pkt)
+	require.ErrorContains(t, err, "failed to verify PK token")
+}
+
+func TestIssuerCosigner(t *testing.T) {
+	ctx := context.Background()
+	kit, err := testkit.New()
+	require.NoError(t, err)
+	pkt, signer, err := kit.Valid(ctx)
+	require.NoError(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	require.NoError(t, err)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caCert, err := CreateCACert(pkix.Name{CommonName: "test CA"}, &caKey.PublicKey, nil, caKey, time.Hour)
+	require.NoError(t, err)
+	v, err := verifier.New(kit.Provider(), verifier.WithCosignerVerifiers(kit.CosignerVerifier()))
+	require.NoError(t, err)
+	issuer := &Issuer{
+		Verifier: v,
+		CACert:   caCert,
+		Signer:   caKey,
+		Policy:   &IssuancePolicy{CosignerIssuers: []string{testkit.CosignerIssuer}},
+	}
+
+	certPEM, err := issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	cosigner, err := CertCosigner(leaf)
+	require.NoError(t, err)
+	require.Equal(t, &Cosigner{Issuer: testkit.CosignerIssuer, KeyID: "testkit-cosigner", AuthID: "testkit"}, cosigner)
+
+	issuer.Policy.CosignerKeyIDs = []string{"other-key"}
+	_, err = issuer.Issue(ctx, csr, pkt)
+	require.ErrorContains(t, err, "cosigner key testkit-cosigner is not allowed")
+
+	issuer.Policy = &IssuancePolicy{CosignerIssuers: []string{"https://other-cosigner.example.com"}}
+	_, err = issuer.Issue(ctx, csr, pkt)
+	require.ErrorContains(t, err, "not allowed")
+
+	// Without verifying the cosigner signature the policy can't be met and
+	// the certificate doesn't vouch for the cosigner
+	issuer.Verifier, err = verifier.New(kit.Provider())
+	require.NoError(t, err)
+	issuer.Policy = &IssuancePolicy{RequireCosigner: true}
+	_, err = issuer.Issue(ctx, csr, pkt)
+	require.ErrorContains(t, err, "doesn't verify cosigner signatures")
+	issuer.Policy = nil
+	certPEM, err = issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	block, _ = pem.Decode(certPEM)
+	leaf, err = x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	cosigner, err = CertCosigner(leaf)
+	require.NoError(t, err)
+	require.Nil(t, cosigner)
+
+	// A PK Token that isn't cosigned
+	pkt.Cos = nil
+	issuer.Policy = &IssuancePolicy{RequireCosigner: true}
+	_, err = issuer.Issue(ctx, csr, pkt)
+	require.ErrorContains(t, err, "not cosigned")
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// IssuancePolicy restricts which verified PK Tokens an Issuer issues
+// certificates to. Empty fields don't restrict anything.
+type IssuancePolicy struct {
+	// Issuers are the OpenID Providers whose ID Tokens are accepted
+	Issuers []string `json:"issuers,omitempty"`
+	// Audiences are the client IDs the ID Token must be issued to, one is
+	// enough if it has several audiences
+	Audiences []string `json:"audiences,omitempty"`
+	// Claims maps claim names to their allowed values, e.g.
+	// {"repository_owner": ["octo-org"]}. Every claim must be a string
+	// equal to one of its values.
+	Claims map[string][]string `json:"claims,omitempty"`
+	// RequireCosigner only allows PK Tokens cosigned, e.g. after MFA, by
+	// one of CosignerIssuers with one of CosignerKeyIDs. An Issuer also
+	// requires its Verifier to have verified the cosigner signature.
+	RequireCosigner bool     `json:"requireCosigner,omitempty"`
+	CosignerIssuers []string `json:"cosignerIssuers,omitempty"`
+	CosignerKeyIDs  []string `json:"cosignerKeyIDs,omitempty"`
+}
+
+// requiresCosigner returns true if the policy only allows cosigned PK
+// Tokens
+func (p *IssuancePolicy) requiresCosigner() bool {
+	return p.RequireCosigner || len(p.CosignerIssuers) > 0 || len(p.CosignerKeyIDs) > 0
+}
+
+// Check returns an error if the policy doesn't allow the PK Token. It
+// only checks the claims, the PK Token must already be verified.
+func (p *IssuancePolicy) Check(pkt *pktoken.PKToken) error {
+	var idtClaims oidc.OidcClaims
+	if err := json.Unmarshal(pkt.Payload, &idtClaims); err != nil {
+		return err
+	}
+	if len(p.Issuers) > 0 && !slices.Contains(p.Issuers, idtClaims.Issuer) {
+		return fmt.Errorf("issuer %s is not allowed", idtClaims.Issuer)
+	}
+	if len(p.Audiences) > 0 && !slices.ContainsFunc(strings.Split(idtClaims.Audience, ","), func(aud string) bool {
+		return slices.Contains(p.Audiences, aud)
+	}) {
+		return fmt.Errorf("audience %s is not allowed", idtClaims.Audience)
+	}
+	if len(p.Claims) > 0 {
+		var claims map[string]any
+		if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+			return err
+		}
+		for name, allowed := range p.Claims {
+			value, ok := claims[name].(string)
+			if !ok {
+				return fmt.Errorf("ID Token has no %s claim", name)
+			}
+			if !slices.Contains(allowed, value) {
+				return fmt.Errorf("%s claim %q is not allowed", name, value)
+			}
+		}
+	}
+	if p.requiresCosigner() {
+		if pkt.Cos == nil {
+			return fmt.Errorf("PK token is not cosigned")
+		}
+		cosClaims, err := pkt.ParseCosignerClaims()
+		if err != nil {
+			return err
+		}
+		if len(p.CosignerIssuers) > 0 && !slices.Contains(p.CosignerIssuers, cosClaims.Issuer) {
+			return fmt.Errorf("cosigner %s is not allowed", cosClaims.Issuer)
+		}
+		if len(p.CosignerKeyIDs) > 0 && !slices.Contains(p.CosignerKeyIDs, cosClaims.KeyID) {
+			return fmt.Errorf("cosigner key %s is not allowed", cosClaims.KeyID)
+		}
+	}
+	return nil
+}
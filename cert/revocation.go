@@ -0,0 +1,430 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// CRLPath and OCSPPath are where the handler returned by NewHandler
+// serves the CRL and the OCSP responder of an Issuer with a Store
+const (
+	CRLPath  = "/crl"
+	OCSPPath = "/ocsp"
+)
+
+// RevocationPath is where the handler returned by NewRevocationHandler
+// revokes certificates
+const RevocationPath = "/revoke"
+
+// DefaultCRLValidity is how long CRLs and OCSP responses served by
+// NewHandler are valid for, clients fetch a new one after it
+const DefaultCRLValidity = time.Hour
+
+// ErrUnknownCert is returned when revoking a serial the CertStore has no
+// record of
+var ErrUnknownCert = errors.New("unknown certificate")
+
+// CertRecord is what a CertStore keeps about an issued certificate
+type CertRecord struct {
+	Serial *big.Int
+	// Issuer and Subject are the iss and sub claims of the PK Token the
+	// certificate was issued for
+	Issuer   string
+	Subject  string
+	NotAfter time.Time
+	// RevokedAt is zero unless the certificate is revoked
+	RevokedAt time.Time
+}
+
+func (r *CertRecord) Revoked() bool {
+	return !r.RevokedAt.IsZero()
+}
+
+// CertStore tracks the certificates an Issuer issues so they can be
+// revoked and their status published with CreateCRL and the OCSP
+// responder. Issuers sharing a CA must share a CertStore.
+type CertStore interface {
+	// Add records an issued certificate
+	Add(ctx context.Context, record CertRecord) error
+	// Lookup returns the record of the certificate with the serial, nil if
+	// there is none
+	Lookup(ctx context.Context, serial *big.Int) (*CertRecord, error)
+	// RevokeSerial revokes the certificate with the serial at the time
+	// and returns its record. It returns ErrUnknownCert if there is no
+	// such certificate. Revoking a revoked certificate keeps the time it
+	// was first revoked.
+	RevokeSerial(ctx context.Context, serial *big.Int, at time.Time) (*CertRecord, error)
+	// RevokeSubject revokes the unexpired certificates issued for the OIDC
+	// issuer and subject at the time and returns the records of those it
+	// revoked
+	RevokeSubject(ctx context.Context, issuer string, subject string, at time.Time) ([]CertRecord, error)
+	// Revoked returns the revoked certificates that haven't expired at the
+	// time
+	Revoked(ctx context.Context, now time.Time) ([]CertRecord, error)
+}
+
+// MemoryCertStore is a CertStore kept in process memory, the records are
+// lost when the process exits
+type MemoryCertStore struct {
+	records map[string]*CertRecord
+	lock    sync.Mutex
+}
+
+var _ CertStore = (*MemoryCertStore)(nil)
+
+func NewMemoryCertStore() *MemoryCertStore {
+	return &MemoryCertStore{
+		records: map[string]*CertRecord{},
+	}
+}
+
+func (s *MemoryCertStore) Add(_ context.Context, record CertRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := record.Serial.String()
+	if _, ok := s.records[key]; ok {
+		return errors.New("duplicate certificate serial")
+	}
+	s.records[key] = &record
+	return nil
+}
+
+func (s *MemoryCertStore) Lookup(_ context.Context, serial *big.Int) (*CertRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, ok := s.records[serial.String()]
+	if !ok {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *MemoryCertStore) RevokeSerial(_ context.Context, serial *big.Int, at time.Time) (*CertRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, ok := s.records[serial.String()]
+	if !ok {
+		return nil, ErrUnknownCert
+	}
+	if !record.Revoked() {
+		record.RevokedAt = at
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *MemoryCertStore) RevokeSubject(_ context.Context, issuer string, subject string, at time.Time) ([]CertRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var revoked []CertRecord
+	for _, record := range s.records {
+		if record.Issuer == issuer && record.Subject == subject && !record.Revoked() && at.Before(record.NotAfter) {
+			record.RevokedAt = at
+			revoked = append(revoked, *record)
+		}
+	}
+	sortRecords(revoked)
+	return revoked, nil
+}
+
+func (s *MemoryCertStore) Revoked(_ context.Context, now time.Time) ([]CertRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var revoked []CertRecord
+	for key, record := range s.records {
+		if now.After(record.NotAfter) {
+			// Expired certificates are invalid anyway, forget them
+			delete(s.records, key)
+			continue
+		}
+		if record.Revoked() {
+			revoked = append(revoked, *record)
+		}
+	}
+	sortRecords(revoked)
+	return revoked, nil
+}
+
+func sortRecords(records []CertRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Serial.Cmp(records[j].Serial) < 0
+	})
+}
+
+// CreateCRL returns a DER encoded CRL listing the revoked certificates in
+// Store that haven't expired, signed by the CA and valid for validity.
+// CACert must have the CRL signing key usage, as CAs created by
+// CreateCACert do.
+func (i *Issuer) CreateCRL(ctx context.Context, validity time.Duration) ([]byte, error) {
+	if i.Store == nil {
+		return nil, fmt.Errorf("issuer doesn't track certificates, set Store")
+	}
+	now := time.Now()
+	revoked, err := i.Store.Revoked(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, record := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   record.Serial,
+			RevocationTime: record.RevokedAt,
+		})
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		// CRL numbers must increase with each CRL the CA issues
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: entries,
+	}, i.CACert, i.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CRL: %w", err)
+	}
+	return crlDER, nil
+}
+
+// ocspResponse returns the signed OCSP response to the DER encoded OCSP
+// request
+func (i *Issuer) ocspResponse(ctx context.Context, reqDER []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(reqDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse, nil
+	}
+	// We only answer for certificates issued by our CA
+	if !req.HashAlgorithm.Available() {
+		return ocsp.MalformedRequestErrorResponse, nil
+	}
+	nameHash, keyHash, err := issuerHashes(i.CACert, req.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(req.IssuerNameHash, nameHash) || !bytes.Equal(req.IssuerKeyHash, keyHash) {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		Status:       ocsp.Unknown,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(DefaultCRLValidity),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	record, err := i.Store.Lookup(ctx, req.SerialNumber)
+	if err != nil {
+		return ocsp.InternalErrorErrorResponse, nil
+	}
+	if record != nil {
+		if record.Revoked() {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = record.RevokedAt
+			template.RevocationReason = ocsp.Unspecified
+		} else {
+			template.Status = ocsp.Good
+		}
+	}
+	// The CA signs the responses itself
+	return ocsp.CreateResponse(i.CACert, i.CACert, template, i.Signer)
+}
+
+// issuerHashes returns the hashes of the name and key of the CA that
+// identify it in OCSP requests
+func issuerHashes(caCert *x509.Certificate, hash crypto.Hash) ([]byte, []byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(caCert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+	h := hash.New()
+	h.Write(caCert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return nameHash, h.Sum(nil), nil
+}
+
+// serveCRL and serveOCSP are registered by NewHandler if the issuer has a
+// Store
+func serveCRL(issuer *Issuer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeProblem(w, http.StatusMethodNotAllowed, "malformed", "method not allowed")
+		return
+	}
+	crlDER, err := issuer.CreateCRL(r.Context(), DefaultCRLValidity)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, "serverInternal", "error creating CRL")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crlDER)
+}
+
+// serveOCSP accepts requests as the body of a POST or base64 encoded in
+// the path of a GET, as in RFC 6960 appendix A.1
+func serveOCSP(issuer *Issuer, w http.ResponseWriter, r *http.Request) {
+	var reqDER []byte
+	switch r.Method {
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(w, "content type must be application/ocsp-request", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if reqDER, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize)); err != nil {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	case http.MethodGet:
+		var err error
+		if reqDER, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, OCSPPath+"/")); err != nil {
+			http.Error(w, "malformed OCSP request", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := issuer.ocspResponse(r.Context(), reqDER)
+	if err != nil {
+		resp = ocsp.InternalErrorErrorResponse
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// RevocationRequest is the body of a request to the handler returned by
+// NewRevocationHandler. It either has a Serial or an Issuer and Subject.
+type RevocationRequest struct {
+	// Serial is the serial of the certificate in decimal or 0x prefixed
+	// hex
+	Serial string `json:"serial,omitempty"`
+	// Issuer and Subject revoke all certificates issued for the OIDC
+	// identity
+	Issuer  string `json:"iss,omitempty"`
+	Subject string `json:"sub,omitempty"`
+}
+
+// RevocationResponse lists the serials, in hex, of the certificates a
+// revocation request revoked
+type RevocationResponse struct {
+	Revoked []string `json:"revoked"`
+}
+
+// NewRevocationHandler serves an admin API at RevocationPath to revoke
+// the certificates issued by issuer:
+//
+//	POST /revoke
+//	Content-Type: application/json
+//
+//	{"serial": "0x1234"} or {"iss": "https://accounts.google.com", "sub": "1234"}
+//
+// authorize is called on every request and must return an error unless
+// the request comes from an admin, the handler then responds 403
+// Forbidden. Revoking a subject only revokes the certificates already
+// issued, to keep it from getting new ones also remove it from the
+// Issuer's Policy.
+func NewRevocationHandler(issuer *Issuer, authorize func(r *http.Request) error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(RevocationPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeProblem(w, http.StatusMethodNotAllowed, "malformed", "method not allowed")
+			return
+		}
+		if err := authorize(r); err != nil {
+			writeProblem(w, http.StatusForbidden, "unauthorized", err.Error())
+			return
+		}
+		if issuer.Store == nil {
+			writeProblem(w, http.StatusInternalServerError, "serverInternal", "issuer doesn't track certificates")
+			return
+		}
+		var req RevocationRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "malformed revocation request")
+			return
+		}
+
+		now := time.Now()
+		var revoked []CertRecord
+		switch {
+		case req.Serial != "" && req.Issuer == "" && req.Subject == "":
+			serial, ok := new(big.Int).SetString(req.Serial, 0)
+			if !ok {
+				writeProblem(w, http.StatusBadRequest, "malformed", "malformed serial")
+				return
+			}
+			record, err := issuer.Store.RevokeSerial(r.Context(), serial, now)
+			if errors.Is(err, ErrUnknownCert) {
+				writeProblem(w, http.StatusNotFound, "malformed", err.Error())
+				return
+			} else if err != nil {
+				writeProblem(w, http.StatusInternalServerError, "serverInternal", "error revoking certificate")
+				return
+			}
+			revoked = append(revoked, *record)
+		case req.Serial == "" && req.Issuer != "" && req.Subject != "":
+			var err error
+			if revoked, err = issuer.Store.RevokeSubject(r.Context(), req.Issuer, req.Subject, now); err != nil {
+				writeProblem(w, http.StatusInternalServerError, "serverInternal", "error revoking certificates")
+				return
+			}
+		default:
+			writeProblem(w, http.StatusBadRequest, "malformed", "revocation request must have either a serial or an iss and sub")
+			return
+		}
+
+		resp := RevocationResponse{Revoked: []string{}}
+		for _, record := range revoked {
+			resp.Revoked = append(resp.Revoked, fmt.Sprintf("%#x", record.Serial))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
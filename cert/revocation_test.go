@@ -0,0 +1,170 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRevocation(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root, err := CreateCACert(pkix.Name{CommonName: "root"}, &rootKey.PublicKey, nil, rootKey, time.Hour)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	issuer := &Issuer{
+		Verifier: v,
+		CACert:   root,
+		Signer:   rootKey,
+		Store:    NewMemoryCertStore(),
+	}
+	server := httptest.NewServer(NewHandler(issuer))
+	defer server.Close()
+	issuer.CRLURL = server.URL + CRLPath
+	issuer.OCSPURL = server.URL + OCSPPath
+
+	var leaves []*x509.Certificate
+	for range 3 {
+		chainPEM, err := RequestCertificate(ctx, server.Client(), server.URL, pkt, signer)
+		require.NoError(t, err)
+		leaf, _, err := VerifyChain(chainPEM, roots)
+		require.NoError(t, err)
+		require.Equal(t, []string{issuer.CRLURL}, leaf.CRLDistributionPoints)
+		require.Equal(t, []string{issuer.OCSPURL}, leaf.OCSPServer)
+		leaves = append(leaves, leaf)
+	}
+
+	ocspStatus := func(leaf *x509.Certificate) int {
+		reqDER, err := ocsp.CreateRequest(leaf, root, nil)
+		require.NoError(t, err)
+		resp, err := server.Client().Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(reqDER))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respDER, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		ocspResp, err := ocsp.ParseResponseForCert(respDER, leaf, root)
+		require.NoError(t, err)
+		return ocspResp.Status
+	}
+	revoke := func(authorized bool, req RevocationRequest) (int, []string) {
+		admin := httptest.NewServer(NewRevocationHandler(issuer, func(r *http.Request) error {
+			if !authorized {
+				return errors.New("not an admin")
+			}
+			return nil
+		}))
+		defer admin.Close()
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		resp, err := admin.Client().Post(admin.URL+RevocationPath, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var revocationResp RevocationResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&revocationResp))
+		}
+		return resp.StatusCode, revocationResp.Revoked
+	}
+	crlSerials := func() []string {
+		resp, err := server.Client().Get(leaves[0].CRLDistributionPoints[0])
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		crlDER, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		crl, err := x509.ParseRevocationList(crlDER)
+		require.NoError(t, err)
+		require.NoError(t, crl.CheckSignatureFrom(root))
+		serials := []string{}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials = append(serials, fmt.Sprintf("%#x", entry.SerialNumber))
+		}
+		return serials
+	}
+
+	require.Equal(t, ocsp.Good, ocspStatus(leaves[0]))
+	require.Empty(t, crlSerials())
+
+	status, _ := revoke(false, RevocationRequest{Serial: fmt.Sprintf("%#x", leaves[0].SerialNumber)})
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = revoke(true, RevocationRequest{Serial: "0x1234"})
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = revoke(true, RevocationRequest{Serial: "0x1234", Issuer: op.Issuer(), Subject: "me"})
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, ocsp.Good, ocspStatus(leaves[0]))
+
+	status, revoked := revoke(true, RevocationRequest{Serial: leaves[0].SerialNumber.String()})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{fmt.Sprintf("%#x", leaves[0].SerialNumber)}, revoked)
+	require.Equal(t, ocsp.Revoked, ocspStatus(leaves[0]))
+	require.Equal(t, ocsp.Good, ocspStatus(leaves[1]))
+	require.Equal(t, revoked, crlSerials())
+
+	status, revoked = revoke(true, RevocationRequest{Issuer: op.Issuer(), Subject: "me"})
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, revoked, 2)
+	for _, leaf := range leaves {
+		require.Equal(t, ocsp.Revoked, ocspStatus(leaf))
+	}
+	require.Len(t, crlSerials(), 3)
+
+	// Certificates of other CAs are unknown
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := CreateCACert(pkix.Name{CommonName: "other"}, &otherKey.PublicKey, nil, otherKey, time.Hour)
+	require.NoError(t, err)
+	reqDER, err := ocsp.CreateRequest(leaves[0], other, nil)
+	require.NoError(t, err)
+	respDER, err := issuer.ocspResponse(ctx, reqDER)
+	require.NoError(t, err)
+	require.Equal(t, ocsp.UnauthorizedErrorResponse, respDER)
+}
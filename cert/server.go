@@ -0,0 +1,195 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// CertificatePath is where the handler returned by NewHandler issues
+// certificates
+const CertificatePath = "/certificate"
+
+// ChainContentType is the media type of certificate chains, as used by
+// ACME (RFC 8555)
+const ChainContentType = "application/pem-certificate-chain"
+
+// maxRequestSize bounds the requests the handler reads, PK Tokens with
+// cosigner signatures are well within it
+const maxRequestSize = 1 << 20
+
+// CertificateRequest is the body of a request to the handler returned by
+// NewHandler
+type CertificateRequest struct {
+	PKToken *pktoken.PKToken `json:"pkToken"`
+	// CSR is a PEM encoded PKCS#10 certificate signing request signed by the
+	// key in the PK Token
+	CSR string `json:"csr"`
+}
+
+// problem is an RFC 7807 problem document, the error format of ACME
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// NewHandler serves issuer at CertificatePath, so it can be run as an
+// internal CA trusting OpenPubkey identities. Clients send
+//
+//	POST /certificate
+//	Content-Type: application/json
+//
+//	{"pkToken": <PK Token>, "csr": "<PEM encoded CSR>"}
+//
+// and get back 201 Created with the certificate chain as
+// ChainContentType, or an application/problem+json error: 400 Bad Request
+// for a malformed request or CSR and 403 Forbidden if the PK Token doesn't
+// verify or isn't allowed by the issuer's Policy. RequestCertificate sends
+// these requests.
+//
+// If the issuer has a Store it also serves its CRL at CRLPath and an OCSP
+// responder at OCSPPath.
+func NewHandler(issuer *Issuer) http.Handler {
+	mux := http.NewServeMux()
+	if issuer.Store != nil {
+		mux.HandleFunc(CRLPath, func(w http.ResponseWriter, r *http.Request) {
+			serveCRL(issuer, w, r)
+		})
+		mux.HandleFunc(OCSPPath, func(w http.ResponseWriter, r *http.Request) {
+			serveOCSP(issuer, w, r)
+		})
+		mux.HandleFunc(OCSPPath+"/", func(w http.ResponseWriter, r *http.Request) {
+			serveOCSP(issuer, w, r)
+		})
+	}
+	mux.HandleFunc(CertificatePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeProblem(w, http.StatusMethodNotAllowed, "malformed", "method not allowed")
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeProblem(w, http.StatusUnsupportedMediaType, "malformed", "content type must be application/json")
+			return
+		}
+		var req CertificateRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil || req.PKToken == nil {
+			writeProblem(w, http.StatusBadRequest, "malformed", "malformed certificate request")
+			return
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			writeProblem(w, http.StatusBadRequest, "badCSR", "malformed CSR")
+			return
+		}
+		chainPEM, err := issuer.Issue(r.Context(), block.Bytes, req.PKToken)
+		if errors.Is(err, ErrInvalidCSR) {
+			writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		} else if err != nil {
+			writeProblem(w, http.StatusForbidden, "unauthorized", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", ChainContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(chainPEM)
+	})
+	return mux
+}
+
+func writeProblem(w http.ResponseWriter, status int, acmeType string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "urn:ietf:params:acme:error:" + acmeType,
+		Detail: detail,
+		Status: status,
+	})
+}
+
+// RequestCertificate requests a certificate for the key in the PK Token
+// from the CA served by NewHandler at caURL and returns the PEM encoded
+// chain. signer must hold the key in the PK Token, e.g. the OpkClient's
+// signer, it signs the CSR.
+func RequestCertificate(ctx context.Context, httpClient *http.Client, caURL string, pkt *pktoken.PKToken, signer crypto.Signer) ([]byte, error) {
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CSR: %w", err)
+	}
+	body, err := json.Marshal(CertificateRequest{
+		PKToken: pkt,
+		CSR:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+	})
+	if err != nil {
+		return nil, err
+	}
+	certificateURL, err := url.JoinPath(caURL, CertificatePath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, certificateURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", ChainContentType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		var p problem
+		if json.Unmarshal(respBody, &p) == nil && p.Detail != "" {
+			return nil, fmt.Errorf("CA returned error status %s: %s", resp.Status, p.Detail)
+		}
+		return nil, fmt.Errorf("CA returned error status %s", resp.Status)
+	}
+
+	block, _ := pem.Decode(respBody)
+	if block == nil {
+		return nil, fmt.Errorf("malformed certificate chain from CA")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("malformed certificate from CA: %w", err)
+	}
+	if signerKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !signerKey.Equal(leaf.PublicKey) {
+		return nil, fmt.Errorf("CA issued a certificate for another key")
+	}
+	return respBody, nil
+}
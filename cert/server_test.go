@@ -0,0 +1,127 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateServer(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"repository_owner": "octo-org"}
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root, err := CreateCACert(pkix.Name{CommonName: "root"}, &rootKey.PublicKey, nil, rootKey, time.Hour)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	issuer := &Issuer{
+		Verifier: v,
+		CACert:   root,
+		Signer:   rootKey,
+		Policy: &IssuancePolicy{
+			Issuers: []string{op.Issuer()},
+			Claims:  map[string][]string{"repository_owner": {"octo-org", "other-org"}},
+		},
+	}
+	server := httptest.NewServer(NewHandler(issuer))
+	defer server.Close()
+
+	chainPEM, err := RequestCertificate(ctx, server.Client(), server.URL, pkt, signer)
+	require.NoError(t, err)
+	leaf, _, err := VerifyChain(chainPEM, roots)
+	require.NoError(t, err)
+	require.True(t, leaf.PublicKey.(*ecdsa.PublicKey).Equal(signer.Public()))
+
+	issuer.Policy.Claims = map[string][]string{"repository_owner": {"other-org"}}
+	_, err = RequestCertificate(ctx, server.Client(), server.URL, pkt, signer)
+	require.ErrorContains(t, err, "403 Forbidden")
+	require.ErrorContains(t, err, `repository_owner claim "octo-org" is not allowed`)
+
+	// The CSR must be signed by the key in the PK Token
+	otherSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	issuer.Policy = nil
+	_, err = RequestCertificate(ctx, server.Client(), server.URL, pkt, otherSigner)
+	require.ErrorContains(t, err, "403 Forbidden")
+
+	resp, err := server.Client().Post(server.URL+CertificatePath, "application/json", strings.NewReader(`{"csr": "not a CSR"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	resp, err = server.Client().Post(server.URL+CertificatePath, "text/plain", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, err = server.Client().Get(server.URL + CertificatePath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestIssuancePolicy(t *testing.T) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"repository_owner": "octo-org", "run_number": 7}
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, (&IssuancePolicy{}).Check(pkt))
+	require.NoError(t, (&IssuancePolicy{Issuers: []string{"https://example.com", op.Issuer()}}).Check(pkt))
+	require.ErrorContains(t, (&IssuancePolicy{Issuers: []string{"https://example.com"}}).Check(pkt), "issuer")
+	require.NoError(t, (&IssuancePolicy{Audiences: []string{idtTemplate.Aud}}).Check(pkt))
+	require.ErrorContains(t, (&IssuancePolicy{Audiences: []string{"other-client"}}).Check(pkt), "audience")
+	require.ErrorContains(t, (&IssuancePolicy{Claims: map[string][]string{"repository": {"octo-org/repo"}}}).Check(pkt), "no repository claim")
+	// Only string claims can be matched
+	require.ErrorContains(t, (&IssuancePolicy{Claims: map[string][]string{"run_number": {"7"}}}).Check(pkt), "no run_number claim")
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TemplateOpts customizes the certificate template PktToX509Template
+// creates
+type TemplateOpts func(*templateOptions)
+
+type templateOptions struct {
+	validity    time.Duration
+	extKeyUsage []x509.ExtKeyUsage
+	sans        []SANFunc
+	extensions  []pkix.Extension
+}
+
+// SANFunc adds subject alternative names derived from the ID Token claims
+// to the template
+type SANFunc func(claims map[string]any, template *x509.Certificate) error
+
+// WithValidity sets how long the certificate is valid for, a year by
+// default
+func WithValidity(validity time.Duration) TemplateOpts {
+	return func(o *templateOptions) {
+		o.validity = validity
+	}
+}
+
+// WithExtKeyUsages replaces the default code signing extended key usage,
+// e.g. with x509.ExtKeyUsageClientAuth for mTLS
+func WithExtKeyUsages(extKeyUsage ...x509.ExtKeyUsage) TemplateOpts {
+	return func(o *templateOptions) {
+		o.extKeyUsage = append(o.extKeyUsage, extKeyUsage...)
+	}
+}
+
+// WithSANs replaces the default DNS SAN of the sub claim with the subject
+// alternative names added by sans
+func WithSANs(sans ...SANFunc) TemplateOpts {
+	return func(o *templateOptions) {
+		o.sans = append(o.sans, sans...)
+	}
+}
+
+// WithExtensions adds extensions to the certificate along with the OIDC
+// issuer extension
+func WithExtensions(extensions ...pkix.Extension) TemplateOpts {
+	return func(o *templateOptions) {
+		o.extensions = append(o.extensions, extensions...)
+	}
+}
+
+// DNSSAN adds the claim as a DNS SAN
+func DNSSAN(claim string) SANFunc {
+	return func(claims map[string]any, template *x509.Certificate) error {
+		value, err := stringClaim(claims, claim)
+		if err != nil {
+			return err
+		}
+		template.DNSNames = append(template.DNSNames, value)
+		return nil
+	}
+}
+
+// EmailSAN adds the email claim as an email SAN. ID Tokens whose
+// email_verified claim is false are rejected.
+func EmailSAN() SANFunc {
+	return func(claims map[string]any, template *x509.Certificate) error {
+		email, err := stringClaim(claims, "email")
+		if err != nil {
+			return err
+		}
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return fmt.Errorf("email %s is not verified", email)
+		}
+		template.EmailAddresses = append(template.EmailAddresses, email)
+		return nil
+	}
+}
+
+// URISAN adds a URI SAN formatted from claims, e.g. for the workflow of a
+// GitHub Actions ID Token
+//
+//	URISAN("https://github.com/%s", "job_workflow_ref")
+func URISAN(format string, claimNames ...string) SANFunc {
+	return func(claims map[string]any, template *x509.Certificate) error {
+		args := make([]any, len(claimNames))
+		for i, claim := range claimNames {
+			value, err := stringClaim(claims, claim)
+			if err != nil {
+				return err
+			}
+			args[i] = value
+		}
+		uri, err := url.Parse(fmt.Sprintf(format, args...))
+		if err != nil {
+			return fmt.Errorf("invalid URI SAN: %w", err)
+		}
+		template.URIs = append(template.URIs, uri)
+		return nil
+	}
+}
+
+func stringClaim(claims map[string]any, claim string) (string, error) {
+	value, ok := claims[claim].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("ID Token has no %s claim", claim)
+	}
+	return value, nil
+}
@@ -27,6 +27,7 @@ import (
 	"net/http/httptest"
 	"strings"
 
+	"github.com/openpubkey/openpubkey/i18n"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/sirupsen/logrus"
@@ -47,10 +48,20 @@ var chooserTemplateFile string
 
 // TODO: This should be an enum that can also autogenerate what gets passed to the template
 
+// ChooserPage is the name of the page listing the OPs to choose from. It is
+// executed with an i18n.Page whose Data has the CSS display value, "block"
+// or "none", of each OP's sign in button, e.g. {{.Data.Google}}.
+const ChooserPage = "chooser"
+
 type WebChooser struct {
-	OpList        []providers.BrowserOpenIdProvider
-	opSelected    providers.BrowserOpenIdProvider
-	OpenBrowser   bool
+	OpList      []providers.BrowserOpenIdProvider
+	opSelected  providers.BrowserOpenIdProvider
+	OpenBrowser bool
+	// BrowserOpener, if set, opens the browser instead of util.OpenUrl
+	BrowserOpener providers.BrowserOpener
+	// Localizer localizes and rebrands the chooser page, if nil the default
+	// English page is shown
+	Localizer     *i18n.Localizer
 	useMockServer bool
 	mockServer    *httptest.Server
 	server        *http.Server
@@ -90,7 +101,7 @@ func (wc *WebChooser) ChooseOp(ctx context.Context) (providers.OpenIdProvider, e
 		return nil, err
 	}
 
-	chooserTemplate, err := template.New("chooser-page").Parse(chooserTemplateFile)
+	chooserTemplate, err := template.New(ChooserPage).Parse(chooserTemplateFile)
 	if err != nil {
 		return nil, err
 	}
@@ -109,45 +120,39 @@ func (wc *WebChooser) ChooseOp(ctx context.Context) (providers.OpenIdProvider, e
 		if _, ok := providerMap["azure"]; ok {
 			data.Azure = "block"
 		}
-		w.Header().Set("Content-Type", "text/html")
-		if err := chooserTemplate.Execute(w, data); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		wc.Localizer.Render(w, r, ChooserPage, chooserTemplate, data)
 	})
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticContent))))
 	mux.HandleFunc("/select/", func(w http.ResponseWriter, r *http.Request) {
 		// Once we redirect to the OP localhost webserver, we can shutdown the web chooser localhost server
-		shutdownServer := func() {
-			go func() { // Put this in a go func so that it will not block the redirect
-				if wc.server != nil {
-					if err := wc.server.Shutdown(context.Background()); err != nil {
-						logrus.Errorf("Failed to shutdown http server: %v", err)
-					}
-				}
-			}()
-		}
-		defer shutdownServer()
+		defer func() {
+			go wc.shutdownServer() // Put this in a go func so that it will not block the redirect
+		}()
 
 		opName := r.URL.Query().Get("op")
 		if opName == "" {
 			errorString := "missing op parameter"
 			http.Error(w, errorString, http.StatusBadRequest)
-			errCh <- fmt.Errorf(errorString)
+			sendOrDrop(errCh, fmt.Errorf(errorString))
 			return
 		}
 		if op, ok := providerMap[opName]; !ok {
 			errorString := fmt.Sprintf("unknown OpenID Provider: %s", opName)
 			http.Error(w, errorString, http.StatusBadRequest)
-			errCh <- fmt.Errorf(errorString)
+			sendOrDrop(errCh, fmt.Errorf(errorString))
 			return
 		} else {
-			opCh <- op
-
 			redirectUriCh := make(chan string, 1)
 			op.ReuseBrowserWindowHook(redirectUriCh)
-
-			redirectUri := <-redirectUriCh
-			http.Redirect(w, r, redirectUri, http.StatusFound)
+			sendOrDrop(opCh, op)
+
+			select {
+			case redirectUri := <-redirectUriCh:
+				http.Redirect(w, r, redirectUri, http.StatusFound)
+			case <-ctx.Done():
+				http.Error(w, ctx.Err().Error(), http.StatusServiceUnavailable)
+			case <-r.Context().Done():
+			}
 		}
 	})
 
@@ -170,13 +175,20 @@ func (wc *WebChooser) ChooseOp(ctx context.Context) (providers.OpenIdProvider, e
 		if wc.OpenBrowser {
 			loginURI := fmt.Sprintf("http://%s/chooser", listener.Addr().String())
 			logrus.Infof("Opening browser to %s", loginURI)
-			if err := util.OpenUrl(loginURI); err != nil {
+			var opener providers.BrowserOpener = providers.BrowserOpenerFunc(util.OpenUrl)
+			if wc.BrowserOpener != nil {
+				opener = wc.BrowserOpener
+			}
+			if err := opener.OpenURL(loginURI); err != nil {
 				logrus.Errorf("Failed to open url: %v", err)
 			}
 		}
 	}
 
 	select {
+	case <-ctx.Done():
+		wc.shutdownServer()
+		return nil, ctx.Err()
 	case err := <-errCh:
 		return nil, err
 	case wc.opSelected = <-opCh:
@@ -184,6 +196,23 @@ func (wc *WebChooser) ChooseOp(ctx context.Context) (providers.OpenIdProvider, e
 	}
 }
 
+func (wc *WebChooser) shutdownServer() {
+	if wc.server != nil {
+		if err := util.ShutdownServer(wc.server); err != nil {
+			logrus.Errorf("Failed to shutdown http server: %v", err)
+		}
+	}
+}
+
+// sendOrDrop sends v on the buffered channel ch unless it is full. Only the
+// first selection is used, so a second request must not block its handler.
+func sendOrDrop[T any](ch chan T, v T) {
+	select {
+	case ch <- v:
+	default:
+	}
+}
+
 func IssuerToName(issuer string) (string, error) {
 	switch {
 	case strings.HasPrefix(issuer, "https://accounts.google.com"):
@@ -19,6 +19,7 @@ package choosers
 import (
 	"context"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -167,3 +168,84 @@ func TestIssuerToName(t *testing.T) {
 	require.ErrorContains(t, err, "unknown OpenID Provider")
 	require.Equal(t, "", name)
 }
+
+func TestWebChooserCancel(t *testing.T) {
+	newChooser := func() (*WebChooser, providers.BrowserOpenIdProvider) {
+		googleOp := providers.NewGoogleOpWithOptions(providers.GetDefaultGoogleOpOptions())
+		return &WebChooser{
+			OpList:        []providers.BrowserOpenIdProvider{googleOp},
+			OpenBrowser:   false,
+			useMockServer: true,
+		}, googleOp
+	}
+
+	t.Run("cancelled waiting for selection", func(t *testing.T) {
+		webChooser, _ := newChooser()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		op, err := webChooser.ChooseOp(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Nil(t, op)
+	})
+
+	t.Run("cancelled waiting for redirect", func(t *testing.T) {
+		webChooser, _ := newChooser()
+		// Learn the chooser's URL from the browser opener rather than
+		// reading the chooser's fields while it runs
+		urlCh := make(chan string, 1)
+		webChooser.useMockServer = false
+		webChooser.OpenBrowser = true
+		webChooser.BrowserOpener = providers.BrowserOpenerFunc(func(uri string) error {
+			urlCh <- strings.TrimSuffix(uri, "/chooser")
+			return nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		type chosen struct {
+			op  providers.OpenIdProvider
+			err error
+		}
+		chosenCh := make(chan chosen, 1)
+		go func() {
+			op, err := webChooser.ChooseOp(ctx)
+			chosenCh <- chosen{op: op, err: err}
+		}()
+		var chooserURL string
+		select {
+		case chooserURL = <-urlCh:
+		case <-time.After(3 * time.Second):
+			t.Fatal("chooser did not open the browser")
+		}
+
+		// The OP is chosen but never redirects the browser, cancelling must
+		// release the select handler
+		type response struct {
+			status int
+			err    error
+		}
+		respCh := make(chan response, 1)
+		go func() {
+			resp, err := http.Get(chooserURL + "/select?op=google")
+			if err != nil {
+				respCh <- response{err: err}
+				return
+			}
+			resp.Body.Close()
+			respCh <- response{status: resp.StatusCode}
+		}()
+		c := <-chosenCh
+		require.NoError(t, c.err)
+		require.NotNil(t, c.op)
+		cancel()
+
+		select {
+		case resp := <-respCh:
+			require.NoError(t, resp.err)
+			require.Equal(t, http.StatusServiceUnavailable, resp.status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("select handler did not return after the context was cancelled")
+		}
+	})
+}
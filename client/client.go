@@ -25,9 +25,12 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/telemetry"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/openpubkey/openpubkey/verifier"
 )
@@ -48,6 +51,9 @@ type OpkClient struct {
 	pkToken      *pktoken.PKToken
 	refreshToken []byte
 	accessToken  []byte
+	gqPolicy     GQPolicy
+	keyStore     KeyStore
+	telemetry    *telemetry.Telemetry
 }
 
 // ClientOpts contains options for constructing an OpkClient
@@ -68,6 +74,30 @@ func WithSigner(signer crypto.Signer, alg jwa.KeyAlgorithm) ClientOpts {
 	}
 }
 
+// KeyStore generates the client's key pair in a key store, such as the OS
+// keychain or a TPM, that never exposes the private key. The key is only
+// used through the returned crypto.Signer. The keystores package has
+// implementations for the common platforms.
+type KeyStore interface {
+	// GenerateKey generates a new key pair for alg, returning an error if
+	// the store doesn't support alg. Signers that hold resources, e.g. an
+	// open TPM, also implement io.Closer.
+	GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error)
+}
+
+// WithKeyStore generates the client's key pair in keyStore rather than in
+// process memory. It can't be combined with WithSigner. If alg is nil it
+// defaults to ES256.
+// Example use:
+//
+//	WithKeyStore(keystores.NewTPM(), jwa.ES256)
+func WithKeyStore(keyStore KeyStore, alg jwa.KeyAlgorithm) ClientOpts {
+	return func(o *OpkClient) {
+		o.keyStore = keyStore
+		o.alg = alg
+	}
+}
+
 // WithCosignerProvider specifies what cosigner provider should be used to
 // cosign the PK Token. If this is not specified then the cosigning setup
 // is skipped.
@@ -77,6 +107,15 @@ func WithCosignerProvider(cosP *CosignerProvider) ClientOpts {
 	}
 }
 
+// WithTelemetry records spans and failure counts for authentication and
+// refreshes, including the token requests, GQ signing and JWKS fetches they
+// involve, with t
+func WithTelemetry(t *telemetry.Telemetry) ClientOpts {
+	return func(o *OpkClient) {
+		o.telemetry = t
+	}
+}
+
 // New returns a new client.OpkClient. The op argument should be the
 // OpenID Provider you want to authenticate against.
 func New(op OpenIdProvider, opts ...ClientOpts) (*OpkClient, error) {
@@ -94,13 +133,23 @@ func New(op OpenIdProvider, opts ...ClientOpts) (*OpkClient, error) {
 		return nil, fmt.Errorf("signer specified but alg is nil, must specify alg of signer")
 	}
 
+	if client.keyStore != nil && client.signer != nil {
+		return nil, fmt.Errorf("signer and key store both specified, only one may be used")
+	}
+
 	if client.signer == nil {
 		// Generate signer for specified alg. If no alg specified, defaults to ES256
 		if client.alg == nil {
 			client.alg = jwa.ES256
 		}
 
-		signer, err := util.GenKeyPair(client.alg)
+		var signer crypto.Signer
+		var err error
+		if client.keyStore != nil {
+			signer, err = client.keyStore.GenerateKey(client.alg)
+		} else {
+			signer, err = util.GenKeyPair(client.alg)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to create key pair for client: %w ", err)
 		}
@@ -131,11 +180,43 @@ func WithExtraClaim(k string, v string) AuthOpts {
 	}
 }
 
+// WithExtraClaimValue is WithExtraClaim for claims whose value isn't a
+// string. Verifiers recompute the commitment from the claims as parsed from
+// JSON, so the value must be made of the types encoding/json unmarshals
+// into, e.g. a map[string]any rather than a struct whose fields would be
+// marshalled in a different order.
+func WithExtraClaimValue(k string, v any) AuthOpts {
+	return func(a *AuthOptsStruct) {
+		if a.extraClaims == nil {
+			a.extraClaims = map[string]any{}
+		}
+		a.extraClaims[k] = v
+	}
+}
+
+// WithMaxUses marks the PK Token as limited-use by setting the max_uses
+// claim in the CIC. Verifiers configured with a use counter reject it after
+// it has been verified maxUses times.
+func WithMaxUses(maxUses int) AuthOpts {
+	return func(a *AuthOptsStruct) {
+		if a.extraClaims == nil {
+			a.extraClaims = map[string]any{}
+		}
+		a.extraClaims[clientinstance.MaxUsesClaim] = maxUses
+	}
+}
+
+// OneShot marks the PK Token as one-shot, e.g. for signing a single release
+// artifact, so it is useless once verified. See WithMaxUses.
+func OneShot() AuthOpts {
+	return WithMaxUses(1)
+}
+
 // Auth returns a PK Token by running the OpenPubkey protocol. It will first
 // authenticate to the configured OpenID Provider (OP) and receive an ID Token.
 // Using this ID Token it will generate a PK Token. If a Cosigner has been
 // configured it will also attempt to get the PK Token cosigned.
-func (o *OpkClient) Auth(ctx context.Context, opts ...AuthOpts) (*pktoken.PKToken, error) {
+func (o *OpkClient) Auth(ctx context.Context, opts ...AuthOpts) (_ *pktoken.PKToken, err error) {
 	authOpts := &AuthOptsStruct{
 		extraClaims: map[string]any{},
 	}
@@ -143,38 +224,53 @@ func (o *OpkClient) Auth(ctx context.Context, opts ...AuthOpts) (*pktoken.PKToke
 		applyOpt(authOpts)
 	}
 
+	ctx, end := telemetry.Start(telemetry.NewContext(ctx, o.telemetry), telemetry.OpAuth,
+		telemetry.IssuerKey.String(o.Op.Issuer()))
+	defer end(&err)
+
+	// If the caller's deadline expires at any step, e.g. because the user
+	// never completes the login in the browser, the error matches
+	// providers.ErrTimeout
+	pkt, err := o.auth(ctx, authOpts)
+	if err != nil {
+		return nil, providers.MarkTimeout(ctx, err)
+	}
+	o.pkToken = pkt
+	return o.pkToken.DeepCopy()
+}
+
+func (o *OpkClient) auth(ctx context.Context, authOpts *AuthOptsStruct) (*pktoken.PKToken, error) {
 	// If no Cosigner is set then do standard OIDC authentication
 	if o.cosP == nil {
-		pkt, err := o.oidcAuth(ctx, o.signer, o.alg, authOpts.extraClaims)
-		if err != nil {
-			return nil, err
-		}
-		o.pkToken = pkt
-		return o.pkToken.DeepCopy()
+		return o.oidcAuth(ctx, o.signer, o.alg, authOpts.extraClaims)
 	}
 
 	// If a Cosigner is set then check that will support doing Cosigner auth
-	if browserOp, ok := o.Op.(BrowserOpenIdProvider); !ok {
+	browserOp, ok := o.Op.(BrowserOpenIdProvider)
+	if !ok {
 		return nil, fmt.Errorf("OP supplied does not have support for MFA Cosigner")
-	} else {
-		redirCh := make(chan string, 1)
+	}
 
-		browserOp.HookHTTPSession(func(w http.ResponseWriter, r *http.Request) {
-			redirectUri := <-redirCh
-			http.Redirect(w, r, redirectUri, http.StatusFound)
-		})
+	// Cancelled when Auth returns, so the OP's callback server isn't kept
+	// waiting for a redirect that never comes if the cosigner step fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	redirCh := make(chan string, 1)
 
-		pkt, err := o.oidcAuth(ctx, o.signer, o.alg, authOpts.extraClaims)
-		if err != nil {
-			return nil, err
-		}
-		pktCos, err := o.cosP.RequestToken(ctx, o.signer, pkt, redirCh)
-		if err != nil {
-			return nil, err
+	browserOp.HookHTTPSession(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case redirectUri := <-redirCh:
+			http.Redirect(w, r, redirectUri, http.StatusFound)
+		case <-ctx.Done():
+			http.Error(w, "authentication was cancelled", http.StatusServiceUnavailable)
 		}
-		o.pkToken = pktCos
-		return o.pkToken.DeepCopy()
+	})
+
+	pkt, err := o.oidcAuth(ctx, o.signer, o.alg, authOpts.extraClaims)
+	if err != nil {
+		return nil, err
 	}
+	return o.cosP.RequestToken(ctx, o.signer, pkt, redirCh)
 }
 
 // oidcAuth performs the OpenIdConnect part of the protocol.
@@ -188,8 +284,10 @@ func (o *OpkClient) oidcAuth(
 	// keep track of any additional verifierChecks for the verifier
 	verifierChecks := []verifier.Check{}
 
-	// Use our signing key to generate a JWK key and set the "alg" header
-	jwkKey, err := jwk.PublicKeyOf(signer)
+	// Use our signing key to generate a JWK key and set the "alg" header.
+	// Only the public key is used, so signers that don't expose their
+	// private key, e.g. from a KeyStore, work too.
+	jwkKey, err := jwk.PublicKeyOf(signer.Public())
 	if err != nil {
 		return nil, err
 	}
@@ -204,11 +302,14 @@ func (o *OpkClient) oidcAuth(
 		return nil, fmt.Errorf("failed to instantiate client instance claims: %w", err)
 	}
 
-	tokens, err := o.Op.RequestTokens(ctx, cic)
+	tokens, err := o.requestTokens(ctx, cic)
 	if err != nil {
 		return nil, fmt.Errorf("error requesting OIDC tokens from OpenID Provider: %w", err)
 	}
-	idToken := tokens.IDToken
+	idToken, err := o.applyGQPolicy(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
 	o.refreshToken = tokens.RefreshToken
 	o.accessToken = tokens.AccessToken
 
@@ -224,7 +325,9 @@ func (o *OpkClient) oidcAuth(
 		return nil, fmt.Errorf("error creating PK Token: %w", err)
 	}
 
-	pktVerifier, err := verifier.New(o.Op)
+	// The use counter is private to this check, so checking a limited-use
+	// PK Token here doesn't use it up at the verifiers it is sent to
+	pktVerifier, err := verifier.New(o.Op, verifier.WithUseCounter(verifier.NewMemoryUseCounter()))
 	if err != nil {
 		return nil, err
 	}
@@ -235,10 +338,20 @@ func (o *OpkClient) oidcAuth(
 	return pkt, nil
 }
 
+func (o *OpkClient) requestTokens(ctx context.Context, cic *clientinstance.Claims) (_ *oidc.Tokens, err error) {
+	ctx, end := telemetry.Start(ctx, telemetry.OpRequestTokens, telemetry.IssuerKey.String(o.Op.Issuer()))
+	defer end(&err)
+	return o.Op.RequestTokens(ctx, cic)
+}
+
 // Refresh uses a Refresh Token to request a fresh ID Token and Access Token from an OpenID Provider.
 // It provides a way to refresh the Access and ID Tokens for an OpenID Provider that supports refresh requests,
 // allowing the client to continue making authenticated requests without requiring the user to re-authenticate.
-func (o *OpkClient) Refresh(ctx context.Context) (*pktoken.PKToken, error) {
+func (o *OpkClient) Refresh(ctx context.Context) (_ *pktoken.PKToken, err error) {
+	ctx, end := telemetry.Start(telemetry.NewContext(ctx, o.telemetry), telemetry.OpRefresh,
+		telemetry.IssuerKey.String(o.Op.Issuer()))
+	defer end(&err)
+
 	if tokensOp, ok := o.Op.(providers.RefreshableOpenIdProvider); ok {
 		if o.refreshToken == nil {
 			return nil, fmt.Errorf("no refresh token set")
@@ -246,9 +359,12 @@ func (o *OpkClient) Refresh(ctx context.Context) (*pktoken.PKToken, error) {
 		if o.pkToken == nil {
 			return nil, fmt.Errorf("no PK Token set, run Auth() to create a PK Token first")
 		}
+		if alg, _ := o.pkToken.ProviderAlgorithm(); alg == gq.GQ256 && (o.gqPolicy == GQAlways || o.gqPolicy == GQAuto) {
+			return nil, fmt.Errorf("refusing to add a refreshed ID Token to a GQ signed PK Token, it would reveal the OP's signature")
+		}
 		tokens, err := tokensOp.RefreshTokens(ctx, o.refreshToken)
 		if err != nil {
-			return nil, fmt.Errorf("error requesting ID token: %w", err)
+			return nil, providers.MarkTimeout(ctx, fmt.Errorf("error requesting ID token: %w", err))
 		}
 		o.pkToken.FreshIDToken = tokens.IDToken
 		o.refreshToken = tokens.RefreshToken
@@ -270,6 +386,13 @@ func (o *OpkClient) GetCosP() *CosignerProvider {
 	return o.cosP
 }
 
+// GetRefreshToken returns the refresh token the OP issued with the client's
+// current ID Token, if any, so that it can be stored to refresh the PK
+// Token from another process
+func (o *OpkClient) GetRefreshToken() []byte {
+	return o.refreshToken
+}
+
 // GetSigner returns the client's key pair (Public Key, Signing Key)
 func (o *OpkClient) GetSigner() crypto.Signer {
 	return o.signer
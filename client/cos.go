@@ -19,19 +19,14 @@ package client
 import (
 	"context"
 	"crypto"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
+	"os"
 	"strings"
-	"time"
 
-	"github.com/lestrrat-go/jwx/v2/jws"
-	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/i18n"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/sirupsen/logrus"
@@ -40,9 +35,28 @@ import (
 type CosignerProvider struct {
 	Issuer       string
 	CallbackPath string
+	// PktMediaType is the representation the PK Token is sent to the
+	// cosigner in, defaults to pktoken.MediaTypeJSON which every cosigner
+	// supports
+	PktMediaType string
+	// Localizer localizes the page shown in the browser once cosigning is
+	// done. If nil, English is used.
+	Localizer *i18n.Localizer
+	// DeviceFlow has the user authenticate by entering a code at the
+	// cosigner while the client polls for the cosigner signature, instead
+	// of the cosigner redirecting the browser to a local callback server.
+	// CallbackPath is then unused.
+	DeviceFlow bool
+	// DevicePrompt is where the code and URI the user authenticates at are
+	// written in the device flow, defaults to os.Stderr
+	DevicePrompt io.Writer
 }
 
 func (c *CosignerProvider) RequestToken(ctx context.Context, signer crypto.Signer, pkt *pktoken.PKToken, redirCh chan string) (*pktoken.PKToken, error) {
+	if c.DeviceFlow {
+		return c.requestTokenDevice(ctx, signer, pkt, redirCh)
+	}
+
 	// Find an unused port
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -74,53 +88,25 @@ func (c *CosignerProvider) RequestToken(ctx context.Context, signer crypto.Signe
 				}
 				authcode := params["authcode"][0] // This is the authcode issued by the cosigner not the OP
 
-				// Sign authcode from cosigner under PK Token and send signed authcode to Cosigner
-				sig2, err := pkt.NewSignedMessage([]byte(authcode), signer)
-				if err != nil {
-					return nil, fmt.Errorf("cosigner client hit error when building authcode URI: %w", err)
-				}
-				authcodeSigUri, err := c.authcodeURI(sig2)
-				if err != nil {
-					return nil, fmt.Errorf("cosigner client hit error when building authcode URI: %w", err)
-				}
-				res, err := http.Get(authcodeSigUri)
-				if err != nil {
-					return nil, fmt.Errorf("error requesting MFA cosigner signature: %w", err)
-				}
-
-				// Receive response from Cosigner that has cosigner signature on PK Token
-				resBody, err := io.ReadAll(res.Body)
-				if err != nil {
-					return nil, fmt.Errorf("error reading MFA cosigner signature response: %w", err)
-				}
-				cosSig, err := util.Base64DecodeForJWT(resBody)
-				if err != nil {
-					return nil, fmt.Errorf("error reading MFA cosigner signature response: %w", err)
-				}
-				// Success
-				return cosSig, nil
+				return c.mfaClient().Redeem(ctx, pkt, signer, authcode)
 			}()
 
 			if err != nil {
 				// Write the error message to the user
-				if _, err := w.Write([]byte(err.Error())); err != nil {
-					logrus.Error(err)
-				}
+				c.Localizer.RenderStatus(w, r, i18n.CosignFailed, err.Error())
 
 				select {
 				case errCh <- err:
 				case <-ctx.Done():
-					return
+				case <-r.Context().Done():
 				}
 			} else {
-				if _, err := w.Write([]byte("You may now close this window")); err != nil {
-					logrus.Error(err)
-				}
+				c.Localizer.RenderStatus(w, r, i18n.CosignComplete, "")
 
 				select {
 				case sigCh <- cosSig:
 				case <-ctx.Done():
-					return
+				case <-r.Context().Done():
 				}
 			}
 
@@ -140,28 +126,17 @@ func (c *CosignerProvider) RequestToken(ctx context.Context, signer crypto.Signe
 		}
 	}()
 	defer func() {
-		if err := server.Shutdown(ctx); err != nil {
+		if err := util.ShutdownServer(server); err != nil {
 			logrus.Error(err)
 		}
 	}()
 
-	pktJson, err := json.Marshal(pkt)
-	if err != nil {
-		return nil, fmt.Errorf("cosigner client hit error serializing PK Token: %w", err)
-	}
-
-	initAuthMsgJson, nonce, err := c.CreateInitAuthSig(redirectURI)
-	if err != nil {
-		return nil, fmt.Errorf("hit error creating init auth signed message: %w", err)
+	if !strings.HasSuffix(redirectURI, c.CallbackPath) {
+		return nil, fmt.Errorf("redirectURI (%s) does not end in expected callbackPath (%s)", redirectURI, c.CallbackPath)
 	}
-	sig1, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	redirUri, nonce, err := c.mfaClient().InitAuthURI(pkt, signer, redirectURI)
 	if err != nil {
-		return nil, fmt.Errorf("cosigner client hit error init auth signed message: %w", err)
-	}
-
-	redirUri, err := c.initAuthURI(pktJson, sig1)
-	if err != nil {
-		return nil, fmt.Errorf("cosigner client hit error when building init auth URI: %w", err)
+		return nil, err
 	}
 
 	select {
@@ -188,101 +163,66 @@ func (c *CosignerProvider) RequestToken(ctx context.Context, signer crypto.Signe
 	}
 }
 
-func (c *CosignerProvider) initAuthURI(pktJson []byte, sig1 []byte) (string, error) {
-	pktB63 := util.Base64EncodeForJWT(pktJson)
-	if uri, err := url.Parse(c.Issuer); err != nil {
-		return "", err
-	} else {
-		uri := uri.JoinPath("mfa-auth-init")
-		v := uri.Query()
-		v.Add("pkt", string(pktB63))
-		v.Add("sig1", string(sig1))
-		uri.RawQuery = v.Encode()
-
-		// URI Should be: https://<issuer>/mfa-auth-init?pkt=<pktJsonB64>&sig1=<sig1>
-		return uri.String(), nil
+// requestTokenDevice gets the cosigner signature with the device flow. The
+// browser is still sent to the verification URI in case it is on the same
+// machine, but the user can open it anywhere.
+func (c *CosignerProvider) requestTokenDevice(ctx context.Context, signer crypto.Signer, pkt *pktoken.PKToken, redirCh chan string) (*pktoken.PKToken, error) {
+	mfaClient := c.mfaClient()
+	auth, err := mfaClient.DeviceAuth(ctx, pkt, signer)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (c *CosignerProvider) authcodeURI(sig2 []byte) (string, error) {
-	if uri, err := url.Parse(c.Issuer); err != nil {
-		return "", err
-	} else {
-		uri := uri.JoinPath("sign")
-		v := uri.Query()
-		v.Add("sig2", string(sig2))
-		uri.RawQuery = v.Encode()
-
-		// URI Should be: https://<issuer>/sign?&sig2=<sig2>
-		return uri.String(), nil
+	prompt := c.DevicePrompt
+	if prompt == nil {
+		prompt = os.Stderr
 	}
+	fmt.Fprintf(prompt, "To finish logging in, open %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
 
-}
-
-func (c *CosignerProvider) ValidateCos(cosSig []byte, expectedNonce string, expectedRedirectURI string) error {
-	cosSigParsed, err := jws.Parse(cosSig)
-	if err != nil {
-		return fmt.Errorf("failed to parse Cosigner signature: %w", err)
+	select {
+	case redirCh <- auth.VerificationURIComplete:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
-	if len(cosSigParsed.Signatures()) != 1 {
-		return fmt.Errorf("the Cosigner signature does not have the correct number of signatures: %w", err)
+	cosSig, err := mfaClient.PollDevice(ctx, pkt, signer, auth)
+	if err != nil {
+		return nil, err
 	}
-
-	ph := cosSigParsed.Signatures()[0].ProtectedHeaders()
-	nonceRet, ok := ph.Get("nonce")
-	if !ok {
-		return fmt.Errorf("nonce not set in Cosigner signature protected header")
+	if err := mfaClient.ValidateCos(cosSig, auth.Nonce, auth.RedirectURI); err != nil {
+		return nil, err
 	}
-
-	if expectedNonce != nonceRet {
-		return fmt.Errorf("incorrect nonce set in Cosigner signature")
+	if err := pkt.AddSignature(cosSig, pktoken.COS); err != nil {
+		return nil, fmt.Errorf("error in adding cosigner signature to PK Token: %w", err)
 	}
+	return pkt, nil
+}
 
-	ruriRet, ok := ph.Get("ruri")
-	if !ok {
-		return fmt.Errorf("ruri (redirect URI) not set in Cosigner signature protected header")
+func (c *CosignerProvider) mfaClient() *MFACosignerClient {
+	return &MFACosignerClient{
+		Issuer:       c.Issuer,
+		PktMediaType: c.PktMediaType,
 	}
+}
 
-	if expectedRedirectURI != ruriRet {
-		return fmt.Errorf("unexpected ruri (redirect URI) set in Cosigner signature, got %s expected %s", ruriRet, expectedRedirectURI)
-	}
+func (c *CosignerProvider) initAuthURI(pktBytes []byte, mediaType string, sig1 []byte) (string, error) {
+	return initAuthURI(c.Issuer, pktBytes, mediaType, sig1)
+}
 
-	issRet, ok := ph.Get("iss")
-	if !ok {
-		return fmt.Errorf("iss (Cosigner Issuer) not set in Cosigner signature protected header")
-	}
+func (c *CosignerProvider) authcodeURI(sig2 []byte) (string, error) {
+	return authcodeURI(c.Issuer, sig2)
+}
 
-	if c.Issuer != issRet {
-		return fmt.Errorf("unexpected iss (Cosigner Issuer) set in Cosigner signature, expected %s", c.Issuer)
-	}
-	return nil
+func (c *CosignerProvider) ValidateCos(cosSig []byte, expectedNonce string, expectedRedirectURI string) error {
+	return c.mfaClient().ValidateCos(cosSig, expectedNonce, expectedRedirectURI)
 }
 
 // CreateInitAuthSig generates a random nonce, validates the redirectURI,
 // creates an InitMFAAuth message, marshals it to JSON,
 // and returns the JSON message along with the nonce.
 func (c *CosignerProvider) CreateInitAuthSig(redirectURI string) ([]byte, string, error) {
-	bits := 256
-	rBytes := make([]byte, bits/8)
-	if _, err := rand.Read(rBytes); err != nil {
-		return nil, "", err
-	}
 	if !strings.HasSuffix(redirectURI, c.CallbackPath) {
 		return nil, "", fmt.Errorf("redirectURI (%s) does not end in expected callbackPath (%s)", redirectURI, c.CallbackPath)
 	}
-
-	nonce := hex.EncodeToString(rBytes)
-
-	msg := msgs.InitMFAAuth{
-		Issuer:      c.Issuer,
-		RedirectUri: redirectURI,
-		TimeSigned:  time.Now().Unix(),
-		Nonce:       nonce,
-	}
-	msgJson, err := json.Marshal(msg)
-	if err != nil {
-		return nil, "", err
-	}
-	return msgJson, nonce, nil
+	return newInitAuthMsg(c.Issuer, redirectURI)
 }
@@ -0,0 +1,138 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCosignerRequestTokenCancel(t *testing.T) {
+	testCases := []struct {
+		name string
+		// stage at which the context is cancelled
+		stage string
+	}{
+		{name: "cancelled before browser redirect", stage: "redirect"},
+		{name: "cancelled waiting for cosigner callback", stage: "callback"},
+		{name: "cancelled waiting for cosigner signature", stage: "sign"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			alg := jwa.ES256
+			signer, err := util.GenKeyPair(alg)
+			require.NoError(t, err)
+			pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+			require.NoError(t, err)
+
+			// A cosigner which never responds to signing requests until the
+			// request is cancelled
+			signCancelled := make(chan struct{})
+			cosServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The server only notices the client going away once the
+				// request body has been read
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+				close(signCancelled)
+			}))
+			defer cosServer.Close()
+
+			cosP := client.CosignerProvider{
+				Issuer:       cosServer.URL,
+				CallbackPath: "/mfaredirect",
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redirCh := make(chan string)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := cosP.RequestToken(ctx, signer, pkt, redirCh)
+				done <- err
+			}()
+
+			var callbackURI string
+			if tc.stage == "redirect" {
+				cancel()
+			} else {
+				callbackURI = redirectURIFromInitAuth(t, <-redirCh)
+				switch tc.stage {
+				case "callback":
+					cancel()
+				case "sign":
+					// The user's browser is redirected back by the cosigner
+					go func() {
+						res, err := http.Get(callbackURI + "?authcode=1234")
+						if err == nil {
+							res.Body.Close()
+						}
+					}()
+					time.AfterFunc(200*time.Millisecond, cancel)
+				}
+			}
+
+			select {
+			case err := <-done:
+				require.ErrorIs(t, err, context.Canceled)
+			case <-time.After(10 * time.Second):
+				t.Fatal("RequestToken did not return after the context was cancelled")
+			}
+
+			if tc.stage == "sign" {
+				select {
+				case <-signCancelled:
+				case <-time.After(10 * time.Second):
+					t.Fatal("request to cosigner was not cancelled")
+				}
+			}
+
+			if callbackURI != "" {
+				// The callback listener must have been closed
+				_, err := http.Get(callbackURI)
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+// redirectURIFromInitAuth extracts the callback redirect URI the client
+// sent to the cosigner in the signed init auth message
+func redirectURIFromInitAuth(t *testing.T, initAuthURI string) string {
+	uri, err := url.Parse(initAuthURI)
+	require.NoError(t, err)
+	sig1, err := jws.Parse([]byte(uri.Query().Get("sig1")))
+	require.NoError(t, err)
+	var initAuth msgs.InitMFAAuth
+	require.NoError(t, json.Unmarshal(sig1.Payload(), &initAuth))
+	return initAuth.RedirectUri
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/stretchr/testify/require"
 )
 
@@ -37,11 +38,15 @@ func TestCosSimple(t *testing.T) {
 
 	pktJson := []byte("fake pkt bytes")
 	sig1 := []byte("fake signature one bytes")
-	authUri, err := cosP.initAuthURI(pktJson, sig1)
+	authUri, err := cosP.initAuthURI(pktJson, pktoken.MediaTypeJSON, sig1)
 	require.NotNil(t, authUri)
 	require.Equal(t, "https://example.com/mfa-auth-init?pkt=ZmFrZSBwa3QgYnl0ZXM&sig1=fake+signature+one+bytes", authUri)
 	require.NoError(t, err)
 
+	authUri, err = cosP.initAuthURI(pktJson, pktoken.MediaTypeCompact, sig1)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/mfa-auth-init?pkt=ZmFrZSBwa3QgYnl0ZXM&pkt_type=application%2Fpkt%2Bcompact&sig1=fake+signature+one+bytes", authUri)
+
 	sig2 := []byte("fake signature two bytes")
 	authCodeUri, err := cosP.authcodeURI(sig2)
 	require.NotNil(t, authCodeUri)
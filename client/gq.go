@@ -0,0 +1,124 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// GQPolicy decides whether the client GQ signs the ID Token in the PK
+// Tokens it creates. A GQ signature proves the OP signed the ID Token
+// without revealing the OP's RSA signature, so the ID Token in a PK Token
+// which is made public can't be replayed as a bearer token. In exchange
+// verifiers can't check refreshed ID Tokens against it, since those carry
+// the OP's signature again.
+type GQPolicy int
+
+const (
+	// GQProvider leaves GQ signing to the provider, e.g.
+	// providers.GoogleOptions.GQSign. This is the default.
+	GQProvider GQPolicy = iota
+	// GQAlways GQ signs every ID Token the provider hasn't already, failing
+	// if the OP doesn't sign with RS256 or PS256. Use it for PK Tokens which
+	// are published, e.g. alongside signed artifacts.
+	GQAlways
+	// GQNever keeps the OP's signature, failing if the provider GQ signs.
+	// Use it where verifiers check refreshed ID Tokens, e.g. for SSH.
+	GQNever
+	// GQAuto GQ signs ID Tokens when the OP signs with RS256 or PS256, the
+	// algorithms GQ signatures support, and keeps the OP's signature
+	// otherwise.
+	GQAuto
+)
+
+// WithGQPolicy sets whether the client GQ signs ID Tokens, see GQPolicy.
+// Whenever the client GQ signs an ID Token it checks the OP's RSA signature
+// is not in the PK Token, and with GQAlways or GQAuto Refresh refuses to
+// add refreshed ID Tokens, which would put it back. ID Tokens the provider
+// GQ signed under GQProvider are used as is, keeping the OP's signature
+// out of them is up to the provider, and Refresh adds refreshed ID Tokens.
+func WithGQPolicy(policy GQPolicy) ClientOpts {
+	return func(o *OpkClient) {
+		o.gqPolicy = policy
+	}
+}
+
+// applyGQPolicy returns the ID Token to put in the PK Token
+func (o *OpkClient) applyGQPolicy(ctx context.Context, idToken []byte) ([]byte, error) {
+	alg, err := idTokenAlg(idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case o.gqPolicy == GQNever && alg == gq.GQ256:
+		return nil, fmt.Errorf("GQ policy is never but OP (issuer=%s) returned a GQ signed ID Token", o.Op.Issuer())
+	case o.gqPolicy == GQProvider || o.gqPolicy == GQNever || alg == gq.GQ256:
+		return idToken, nil
+	case alg != jwa.RS256 && alg != jwa.PS256 && o.gqPolicy == GQAuto:
+		return idToken, nil
+	case alg != jwa.RS256 && alg != jwa.PS256:
+		return nil, fmt.Errorf("GQ policy is always but OP (issuer=%s) signs ID Tokens with %s, GQ signatures require RS256 or PS256", o.Op.Issuer(), alg)
+	}
+
+	gqToken, err := providers.CreateGQToken(ctx, idToken, o.Op)
+	if err != nil {
+		return nil, fmt.Errorf("error GQ signing ID Token: %w", err)
+	}
+	if err := checkRSASignatureStripped(idToken, gqToken); err != nil {
+		return nil, err
+	}
+	return gqToken, nil
+}
+
+// checkRSASignatureStripped checks that the GQ signed ID Token doesn't
+// contain the signature of the OP's ID Token
+func checkRSASignatureStripped(idToken []byte, gqToken []byte) error {
+	_, _, rsaSig, err := jws.SplitCompact(idToken)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(gqToken, rsaSig) {
+		return fmt.Errorf("GQ signed ID Token still contains the OP's RSA signature")
+	}
+	gqAlg, err := idTokenAlg(gqToken)
+	if err != nil {
+		return err
+	}
+	if gqAlg != gq.GQ256 {
+		return fmt.Errorf("expected GQ signed ID Token to have alg %s, got %s", gq.GQ256, gqAlg)
+	}
+	return nil
+}
+
+func idTokenAlg(idToken []byte) (jwa.SignatureAlgorithm, error) {
+	msg, err := jws.Parse(idToken)
+	if err != nil {
+		return "", fmt.Errorf("error parsing ID Token: %w", err)
+	}
+	if len(msg.Signatures()) != 1 {
+		return "", fmt.Errorf("expected ID Token to have one signature, got %d", len(msg.Signatures()))
+	}
+	return msg.Signatures()[0].ProtectedHeaders().Algorithm(), nil
+}
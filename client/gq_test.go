@@ -0,0 +1,126 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGQPolicy(t *testing.T) {
+	testCases := []struct {
+		name       string
+		providerGQ bool
+		policy     client.GQPolicy
+		expAlg     jwa.SignatureAlgorithm
+		expError   string
+		alg        string // the OP signs ID Tokens with, RS256 if empty
+	}{
+		{name: "provider default", providerGQ: false, policy: client.GQProvider, expAlg: jwa.RS256},
+		{name: "provider GQ signs", providerGQ: true, policy: client.GQProvider, expAlg: gq.GQ256},
+		{name: "always", providerGQ: false, policy: client.GQAlways, expAlg: gq.GQ256},
+		{name: "always, provider GQ signs", providerGQ: true, policy: client.GQAlways, expAlg: gq.GQ256},
+		{name: "auto", providerGQ: false, policy: client.GQAuto, expAlg: gq.GQ256},
+		{name: "always, PS256", alg: "PS256", policy: client.GQAlways, expAlg: gq.GQ256},
+		{name: "auto, PS256", alg: "PS256", policy: client.GQAuto, expAlg: gq.GQ256},
+		{name: "never", providerGQ: false, policy: client.GQNever, expAlg: jwa.RS256},
+		{name: "never, provider GQ signs", providerGQ: true, policy: client.GQNever,
+			expError: "GQ policy is never but OP (issuer=https://accounts.example.com) returned a GQ signed ID Token"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerOpts := providers.DefaultMockProviderOpts()
+			providerOpts.GQSign = tc.providerGQ
+			op, _, idtTemplate, err := providers.NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			if tc.alg != "" {
+				idtTemplate.Alg = tc.alg
+			}
+
+			c, err := client.New(op, client.WithGQPolicy(tc.policy))
+			require.NoError(t, err)
+			pkt, err := c.Auth(context.Background())
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+				return
+			}
+			require.NoError(t, err)
+
+			alg, ok := pkt.ProviderAlgorithm()
+			require.True(t, ok)
+			require.Equal(t, tc.expAlg, alg)
+
+			_, err = c.Refresh(context.Background())
+			if alg == gq.GQ256 && tc.policy != client.GQProvider {
+				require.ErrorContains(t, err, "refusing to add a refreshed ID Token to a GQ signed PK Token")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGQPolicyStripsRSASignature(t *testing.T) {
+	providerOpts := providers.DefaultMockProviderOpts()
+	op, _, _, err := providers.NewMockProvider(providerOpts)
+	require.NoError(t, err)
+
+	// Capture the ID Token the OP issues to check its RSA signature doesn't
+	// end up in the PK Token
+	var rsaSig []byte
+	recordingOp := &recordingProvider{MockProvider: op, onIDToken: func(idToken []byte) {
+		_, _, rsaSig, err = jws.SplitCompact(idToken)
+		require.NoError(t, err)
+	}}
+
+	c, err := client.New(recordingOp, client.WithGQPolicy(client.GQAlways))
+	require.NoError(t, err)
+	pkt, err := c.Auth(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, rsaSig)
+
+	pktJson, err := pkt.MarshalJSON()
+	require.NoError(t, err)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	require.False(t, strings.Contains(string(pktJson), string(rsaSig)))
+	require.False(t, strings.Contains(string(pktCom), string(rsaSig)))
+}
+
+// recordingProvider passes the ID Tokens the provider issues to onIDToken
+type recordingProvider struct {
+	*providers.MockProvider
+	onIDToken func(idToken []byte)
+}
+
+func (r *recordingProvider) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	tokens, err := r.MockProvider.RequestTokens(ctx, cic)
+	if err == nil {
+		r.onIDToken(tokens.IDToken)
+	}
+	return tokens, err
+}
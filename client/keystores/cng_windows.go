@@ -0,0 +1,183 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"unsafe"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"golang.org/x/sys/windows"
+)
+
+// Key storage providers built into Windows
+const (
+	// SoftwareKeyStorageProvider keeps keys in the CNG key isolation
+	// service, outside the process
+	SoftwareKeyStorageProvider = "Microsoft Software Key Storage Provider"
+	// PlatformKeyStorageProvider keeps keys in the TPM
+	PlatformKeyStorageProvider = "Microsoft Platform Crypto Provider"
+)
+
+// bcryptECDSAPublicP256Magic is BCRYPT_ECDSA_PUBLIC_P256_MAGIC, the magic
+// of P-256 ECCPUBLICBLOBs
+const bcryptECDSAPublicP256Magic = 0x31534345
+
+var (
+	ncrypt                        = windows.NewLazySystemDLL("ncrypt.dll")
+	procNCryptOpenStorageProvider = ncrypt.NewProc("NCryptOpenStorageProvider")
+	procNCryptCreatePersistedKey  = ncrypt.NewProc("NCryptCreatePersistedKey")
+	procNCryptFinalizeKey         = ncrypt.NewProc("NCryptFinalizeKey")
+	procNCryptExportKey           = ncrypt.NewProc("NCryptExportKey")
+	procNCryptSignHash            = ncrypt.NewProc("NCryptSignHash")
+	procNCryptFreeObject          = ncrypt.NewProc("NCryptFreeObject")
+)
+
+// CNG generates keys with a Windows CNG key storage provider. The keys
+// are ephemeral and not exportable, they are destroyed when the signer is
+// closed or the process exits.
+type CNG struct {
+	// Provider is the name of the key storage provider, by default
+	// SoftwareKeyStorageProvider
+	Provider string
+}
+
+var _ client.KeyStore = (*CNG)(nil)
+
+func NewCNG() *CNG {
+	return &CNG{Provider: SoftwareKeyStorageProvider}
+}
+
+// GenerateKey generates a P-256 key for ES256, the only algorithm
+// supported
+func (c *CNG) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	if alg != jwa.ES256 {
+		return nil, fmt.Errorf("unsupported algorithm for CNG keys: %s", alg)
+	}
+	providerName, err := windows.UTF16PtrFromString(c.Provider)
+	if err != nil {
+		return nil, err
+	}
+	var provider uintptr
+	if err := ncryptError(procNCryptOpenStorageProvider.Call(uintptr(unsafe.Pointer(&provider)), uintptr(unsafe.Pointer(providerName)), 0)); err != nil {
+		return nil, fmt.Errorf("failed to open key storage provider %s: %w", c.Provider, err)
+	}
+	defer procNCryptFreeObject.Call(provider)
+
+	algID, err := windows.UTF16PtrFromString("ECDSA_P256")
+	if err != nil {
+		return nil, err
+	}
+	var key uintptr
+	// Without a name the key isn't persisted, and keys are created
+	// non-exportable unless an export policy is set
+	if err := ncryptError(procNCryptCreatePersistedKey.Call(provider, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(algID)), 0, 0, 0)); err != nil {
+		return nil, fmt.Errorf("failed to create CNG key: %w", err)
+	}
+	if err := ncryptError(procNCryptFinalizeKey.Call(key, 0)); err != nil {
+		procNCryptFreeObject.Call(key)
+		return nil, fmt.Errorf("failed to finalize CNG key: %w", err)
+	}
+	public, err := cngPublicKey(key)
+	if err != nil {
+		procNCryptFreeObject.Call(key)
+		return nil, err
+	}
+	return &cngSigner{key: key, public: public}, nil
+}
+
+// cngPublicKey exports the public key of a P-256 key
+func cngPublicKey(key uintptr) (*ecdsa.PublicKey, error) {
+	blobType, err := windows.UTF16PtrFromString("ECCPUBLICBLOB")
+	if err != nil {
+		return nil, err
+	}
+	var size uint32
+	if err := ncryptError(procNCryptExportKey.Call(key, 0, uintptr(unsafe.Pointer(blobType)), 0, 0, 0, uintptr(unsafe.Pointer(&size)), 0)); err != nil {
+		return nil, fmt.Errorf("failed to export CNG public key: %w", err)
+	}
+	blob := make([]byte, size)
+	if err := ncryptError(procNCryptExportKey.Call(key, 0, uintptr(unsafe.Pointer(blobType)), 0, uintptr(unsafe.Pointer(&blob[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), 0)); err != nil {
+		return nil, fmt.Errorf("failed to export CNG public key: %w", err)
+	}
+	// BCRYPT_ECCKEY_BLOB, a magic and the size of the coordinates, followed
+	// by X and Y
+	if len(blob) < 8 || binary.LittleEndian.Uint32(blob) != bcryptECDSAPublicP256Magic {
+		return nil, fmt.Errorf("unexpected CNG public key blob")
+	}
+	coordSize := int(binary.LittleEndian.Uint32(blob[4:]))
+	if coordSize != 32 || len(blob) < 8+2*coordSize {
+		return nil, fmt.Errorf("unexpected CNG public key blob")
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(blob[8 : 8+coordSize]),
+		Y:     new(big.Int).SetBytes(blob[8+coordSize : 8+2*coordSize]),
+	}, nil
+}
+
+// ncryptError returns the error of an NCrypt function call, they return a
+// SECURITY_STATUS. The functions are called with LazyProc.Call directly so
+// the pointers passed stay valid.
+func ncryptError(status, _ uintptr, _ error) error {
+	if status != 0 {
+		return windows.Errno(status)
+	}
+	return nil
+}
+
+// cngSigner is a crypto.Signer for a CNG key
+type cngSigner struct {
+	key    uintptr
+	public *ecdsa.PublicKey
+}
+
+func (s *cngSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *cngSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigest(digest, opts); err != nil {
+		return nil, err
+	}
+	// ECDSA signatures are r || s
+	sig := make([]byte, 64)
+	var size uint32
+	err := ncryptError(procNCryptSignHash.Call(s.key, 0,
+		uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&sig[0])), uintptr(len(sig)),
+		uintptr(unsafe.Pointer(&size)), 0))
+	if err != nil {
+		return nil, fmt.Errorf("CNG failed to sign: %w", err)
+	}
+	if size != 64 {
+		return nil, fmt.Errorf("unexpected CNG signature length: %d", size)
+	}
+	return ecdsaASN1(new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+// Close destroys the key
+func (s *cngSigner) Close() error {
+	return ncryptError(procNCryptFreeObject.Call(s.key))
+}
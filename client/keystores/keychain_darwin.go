@@ -0,0 +1,237 @@
+//go:build darwin && cgo
+
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+#include <stdlib.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+// The functions only take and return CFTypeRefs, which cgo always maps to
+// uintptr, and set *error to a CFErrorRef on failure
+
+// opk_generate_key generates a non-permanent, non-extractable P-256 key,
+// in the Secure Enclave if secure_enclave is set
+static CFTypeRef opk_generate_key(int secure_enclave, CFTypeRef *error) {
+	CFErrorRef err = NULL;
+	SecKeyRef key = NULL;
+	SecAccessControlRef access = NULL;
+	CFMutableDictionaryRef attrs = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFMutableDictionaryRef private_attrs = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	int bits = 256;
+	CFNumberRef size = CFNumberCreate(NULL, kCFNumberIntType, &bits);
+
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeySizeInBits, size);
+	CFDictionarySetValue(private_attrs, kSecAttrIsPermanent, kCFBooleanFalse);
+	CFDictionarySetValue(private_attrs, kSecAttrIsExtractable, kCFBooleanFalse);
+	if (secure_enclave) {
+		access = SecAccessControlCreateWithFlags(NULL, kSecAttrAccessibleWhenUnlockedThisDeviceOnly, kSecAccessControlPrivateKeyUsage, &err);
+		if (access == NULL) {
+			goto done;
+		}
+		CFDictionarySetValue(private_attrs, kSecAttrAccessControl, access);
+		CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	}
+	CFDictionarySetValue(attrs, kSecPrivateKeyAttrs, private_attrs);
+	key = SecKeyCreateRandomKey(attrs, &err);
+
+done:
+	if (access != NULL) {
+		CFRelease(access);
+	}
+	CFRelease(size);
+	CFRelease(private_attrs);
+	CFRelease(attrs);
+	*error = err;
+	return key;
+}
+
+// opk_public_key returns the public key of key as an uncompressed point in
+// a CFData
+static CFTypeRef opk_public_key(CFTypeRef key, CFTypeRef *error) {
+	CFErrorRef err = NULL;
+	SecKeyRef public = SecKeyCopyPublicKey((SecKeyRef)key);
+	if (public == NULL) {
+		*error = NULL;
+		return NULL;
+	}
+	CFDataRef data = SecKeyCopyExternalRepresentation(public, &err);
+	CFRelease(public);
+	*error = err;
+	return data;
+}
+
+// opk_sign returns the ASN.1 DER ECDSA signature of a SHA-256 digest in a
+// CFData
+static CFTypeRef opk_sign(CFTypeRef key, const UInt8 *digest, CFIndex digest_len, CFTypeRef *error) {
+	CFErrorRef err = NULL;
+	CFDataRef digest_data = CFDataCreate(NULL, digest, digest_len);
+	CFDataRef sig = SecKeyCreateSignature((SecKeyRef)key, kSecKeyAlgorithmECDSASignatureDigestX962SHA256, digest_data, &err);
+	CFRelease(digest_data);
+	*error = err;
+	return sig;
+}
+
+// opk_data_bytes and opk_data_len return the contents of a CFData
+static const UInt8 *opk_data_bytes(CFTypeRef data) {
+	return CFDataGetBytePtr((CFDataRef)data);
+}
+
+static CFIndex opk_data_len(CFTypeRef data) {
+	return CFDataGetLength((CFDataRef)data);
+}
+
+// opk_error_string returns the description of a CFError, to be freed
+// with free
+static char *opk_error_string(CFTypeRef error) {
+	CFStringRef desc = CFErrorCopyDescription((CFErrorRef)error);
+	CFIndex len = CFStringGetMaximumSizeForEncoding(CFStringGetLength(desc), kCFStringEncodingUTF8) + 1;
+	char *buf = malloc(len);
+	if (!CFStringGetCString(desc, buf, len, kCFStringEncodingUTF8)) {
+		buf[0] = '\0';
+	}
+	CFRelease(desc);
+	return buf;
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"unsafe"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+)
+
+// Keychain generates keys with the macOS Security framework, in the
+// Secure Enclave if SecureEnclave is set. The keys aren't exportable and
+// aren't added to the keychain, they are destroyed when the signer is
+// closed or the process exits.
+type Keychain struct {
+	// SecureEnclave generates keys in the Secure Enclave, it requires a
+	// Mac with Apple silicon or a T2 chip and a signed binary
+	SecureEnclave bool
+}
+
+var _ client.KeyStore = (*Keychain)(nil)
+
+func NewKeychain() *Keychain {
+	return &Keychain{}
+}
+
+// GenerateKey generates a P-256 key for ES256, the only algorithm the
+// Secure Enclave supports
+func (k *Keychain) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	if alg != jwa.ES256 {
+		return nil, fmt.Errorf("unsupported algorithm for keychain keys: %s", alg)
+	}
+	secureEnclave := C.int(0)
+	if k.SecureEnclave {
+		secureEnclave = 1
+	}
+	var cfErr C.CFTypeRef
+	key := C.opk_generate_key(secureEnclave, &cfErr)
+	if key == 0 {
+		return nil, fmt.Errorf("failed to generate keychain key: %w", keychainError(cfErr))
+	}
+	publicData := C.opk_public_key(key, &cfErr)
+	if publicData == 0 {
+		C.CFRelease(key)
+		return nil, fmt.Errorf("failed to get keychain public key: %w", keychainError(cfErr))
+	}
+	point := cfDataBytes(publicData)
+	C.CFRelease(publicData)
+	// Checks the point is on the curve
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		C.CFRelease(key)
+		return nil, fmt.Errorf("invalid keychain public key: %w", err)
+	}
+	public := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(point[1:33]),
+		Y:     new(big.Int).SetBytes(point[33:]),
+	}
+	return &keychainSigner{key: key, public: public}, nil
+}
+
+func cfDataBytes(data C.CFTypeRef) []byte {
+	return C.GoBytes(unsafe.Pointer(C.opk_data_bytes(data)), C.int(C.opk_data_len(data)))
+}
+
+// keychainError converts a CFError to an error and releases it
+func keychainError(cfErr C.CFTypeRef) error {
+	if cfErr == 0 {
+		return errors.New("unknown error")
+	}
+	defer C.CFRelease(cfErr)
+	desc := C.opk_error_string(cfErr)
+	defer C.free(unsafe.Pointer(desc))
+	return errors.New(C.GoString(desc))
+}
+
+// keychainSigner is a crypto.Signer for a Security framework key
+type keychainSigner struct {
+	key    C.CFTypeRef
+	public *ecdsa.PublicKey
+	lock   sync.Mutex
+}
+
+func (s *keychainSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *keychainSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigest(digest, opts); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.key == 0 {
+		return nil, errors.New("keychain key is closed")
+	}
+	var cfErr C.CFTypeRef
+	sig := C.opk_sign(s.key, (*C.UInt8)(unsafe.Pointer(&digest[0])), C.CFIndex(len(digest)), &cfErr)
+	if sig == 0 {
+		return nil, fmt.Errorf("keychain failed to sign: %w", keychainError(cfErr))
+	}
+	defer C.CFRelease(sig)
+	return cfDataBytes(sig), nil
+}
+
+// Close destroys the key
+func (s *keychainSigner) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.key != 0 {
+		C.CFRelease(s.key)
+		s.key = 0
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"golang.org/x/sys/unix"
+)
+
+// KernelKeyring generates keys in the Linux kernel keyring as asymmetric
+// keys, which can sign but can't be read back. The kernel can't generate
+// keys, so the key is generated in process memory, loaded into the
+// keyring and then erased, and the kernel only signs with RSA keys. It
+// needs a kernel with the PKCS #8 key parser, the pkcs8_key_parser module.
+type KernelKeyring struct {
+	// Keyring the keys are added to, by default the process keyring so
+	// they are destroyed when the process exits
+	Keyring int
+}
+
+var _ client.KeyStore = (*KernelKeyring)(nil)
+
+func NewKernelKeyring() *KernelKeyring {
+	return &KernelKeyring{Keyring: unix.KEY_SPEC_PROCESS_KEYRING}
+}
+
+// GenerateKey generates a 2048 bit RSA key for RS256, the only algorithm
+// supported. The signer it returns removes the key from the keyring when
+// it is closed.
+func (k *KernelKeyring) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	if alg != jwa.RS256 {
+		return nil, fmt.Errorf("unsupported algorithm for kernel keyring keys: %s", alg)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		return nil, err
+	}
+	public := rsaKey.Public()
+	// Leave as little of the key in memory as we can, the garbage collector
+	// may already have copied parts of it
+	defer func() {
+		clear(pkcs8)
+		rsaKey.D.SetInt64(0)
+		for _, prime := range rsaKey.Primes {
+			prime.SetInt64(0)
+		}
+		rsaKey.Precomputed = rsa.PrecomputedValues{}
+	}()
+
+	description := make([]byte, 16)
+	if _, err := rand.Read(description); err != nil {
+		return nil, err
+	}
+	id, err := unix.AddKey("asymmetric", "openpubkey:"+hex.EncodeToString(description), pkcs8, k.Keyring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add key to kernel keyring: %w", err)
+	}
+	return &keyringSigner{id: id, public: public}, nil
+}
+
+// keyctlPKeyParams is struct keyctl_pkey_params from linux/keyctl.h
+type keyctlPKeyParams struct {
+	KeyID  int32
+	InLen  uint32
+	OutLen uint32
+	_      [7]uint32
+}
+
+// keyringSigner is a crypto.Signer for an RSA key in the kernel keyring
+type keyringSigner struct {
+	id     int
+	public crypto.PublicKey
+}
+
+func (s *keyringSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *keyringSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigest(digest, opts); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, s.public.(*rsa.PublicKey).Size())
+	params := keyctlPKeyParams{
+		KeyID:  int32(s.id),
+		InLen:  uint32(len(digest)),
+		OutLen: uint32(len(sig)),
+	}
+	info, err := unix.BytePtrFromString("enc=pkcs1 hash=sha256")
+	if err != nil {
+		return nil, err
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_KEYCTL, unix.KEYCTL_PKEY_SIGN,
+		uintptr(unsafe.Pointer(&params)),
+		uintptr(unsafe.Pointer(info)),
+		uintptr(unsafe.Pointer(&digest[0])),
+		uintptr(unsafe.Pointer(&sig[0])),
+		0)
+	if errno != 0 {
+		return nil, fmt.Errorf("kernel keyring failed to sign: %w", errno)
+	}
+	return sig[:n], nil
+}
+
+// Close removes the key from the kernel keyring
+func (s *keyringSigner) Close() error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, s.id, 0, 0, 0)
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package keystores provides client.KeyStores that generate the key pair
+// of an OpkClient in a platform key store, so the private key never
+// enters process memory and can't be exported:
+//
+//   - TPM uses a TPM 2.0, on Linux and Windows
+//   - Keychain uses the macOS keychain, optionally in the Secure Enclave
+//   - CNG uses a Windows CNG key storage provider, the software provider
+//     keeps keys in the key isolation service and the platform provider
+//     in the TPM
+//   - KernelKeyring uses the Linux kernel keyring
+//   - PKCS11 uses a PKCS #11 token, e.g. a YubiKey or an HSM, and can also
+//     use keys already on the token
+//
+// Keychain, CNG and KernelKeyring are only built on their platform, and
+// Keychain and PKCS11 need cgo. The signers the key stores return implement
+// io.Closer to destroy the key once it is no longer needed.
+//
+//	opkClient, err := client.New(op, client.WithKeyStore(keystores.NewTPM(), jwa.ES256))
+package keystores
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// checkDigest checks that a signer is asked to sign a SHA-256 digest with
+// PKCS #1 v1.5 or ECDSA, the only signatures the key stores make
+func checkDigest(digest []byte, opts crypto.SignerOpts) error {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return fmt.Errorf("RSA-PSS signatures are not supported")
+	}
+	if opts.HashFunc() != crypto.SHA256 {
+		return fmt.Errorf("unsupported hash function: %v, expected SHA-256", opts.HashFunc())
+	}
+	if len(digest) != crypto.SHA256.Size() {
+		return fmt.Errorf("digest is %d bytes, expected %d", len(digest), crypto.SHA256.Size())
+	}
+	return nil
+}
+
+// ecdsaASN1 encodes an ECDSA signature in the ASN.1 DER form crypto.Signer
+// returns
+func ecdsaASN1(r, s *big.Int) ([]byte, error) {
+	return asn1.Marshal(struct {
+		R *big.Int
+		S *big.Int
+	}{R: r, S: s})
+}
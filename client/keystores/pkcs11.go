@@ -0,0 +1,415 @@
+//go:build cgo
+
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/miekg/pkcs11"
+	"github.com/openpubkey/openpubkey/client"
+)
+
+// DefaultPKCS11KeyLabel is the label of the keys PKCS11 generates
+const DefaultPKCS11KeyLabel = "openpubkey"
+
+var (
+	// oidP256 is the DER encoded OID of P-256, the CKA_EC_PARAMS of P-256
+	// keys
+	oidP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	// sha256DigestInfoPrefix prefixes a SHA-256 digest to make the
+	// DigestInfo CKM_RSA_PKCS signs
+	sha256DigestInfoPrefix = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+)
+
+// PKCS11 generates and uses keys on a PKCS #11 token, such as a YubiKey
+// through ykcs11, SoftHSM or a network HSM. The private keys are
+// generated sensitive and non-extractable, so they never leave the token.
+// A PKCS11 holds a logged in session, close it when done.
+//
+//	store, err := keystores.NewPKCS11("/usr/lib/softhsm/libsofthsm2.so", "opk", pin)
+//	alg, err := store.Algorithm(jwa.ES256, jwa.RS256)
+//	opkClient, err := client.New(op, client.WithKeyStore(store, alg))
+type PKCS11 struct {
+	// KeyLabel is the CKA_LABEL of generated keys
+	KeyLabel string
+	// Persistent generates token objects that outlive the session, tokens
+	// such as YubiKeys don't support session objects. By default keys are
+	// session objects destroyed when the signer or PKCS11 is closed.
+	Persistent bool
+
+	ctx     *pkcs11.Ctx
+	slot    uint
+	session pkcs11.SessionHandle
+	// lock serializes the operations on the session, PKCS #11 sessions
+	// can only run one operation at a time
+	lock sync.Mutex
+}
+
+var _ client.KeyStore = (*PKCS11)(nil)
+
+// NewPKCS11 loads the PKCS #11 module, opens a session on the token with
+// the label, or the first token if tokenLabel is empty, and logs in with
+// pin
+func NewPKCS11(module string, tokenLabel string, pin string) (*PKCS11, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS #11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS #11 module: %w", err)
+	}
+	p := &PKCS11{KeyLabel: DefaultPKCS11KeyLabel, ctx: ctx}
+	if err := p.open(tokenLabel, pin); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PKCS11) open(tokenLabel string, pin string) error {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("failed to list PKCS #11 slots: %w", err)
+	}
+	found := false
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return fmt.Errorf("failed to get PKCS #11 token info: %w", err)
+		}
+		if tokenLabel == "" || strings.TrimSpace(info.Label) == tokenLabel {
+			p.slot = slot
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("PKCS #11 token %q not found", tokenLabel)
+	}
+
+	if p.session, err = p.ctx.OpenSession(p.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION); err != nil {
+		return fmt.Errorf("failed to open PKCS #11 session: %w", err)
+	}
+	if err := p.ctx.Login(p.session, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		p.ctx.CloseSession(p.session)
+		return fmt.Errorf("failed to log in to PKCS #11 token: %w", err)
+	}
+	return nil
+}
+
+// Algorithm returns the first of the preferred algorithms the token can
+// generate keys for and sign with, ES256 or RS256
+func (p *PKCS11) Algorithm(preferred ...jwa.KeyAlgorithm) (jwa.KeyAlgorithm, error) {
+	mechanisms, err := p.ctx.GetMechanismList(p.slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PKCS #11 mechanisms: %w", err)
+	}
+	supports := func(want ...uint) bool {
+		for _, w := range want {
+			if !slices.ContainsFunc(mechanisms, func(m *pkcs11.Mechanism) bool { return m.Mechanism == w }) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, alg := range preferred {
+		switch alg {
+		case jwa.ES256:
+			if supports(pkcs11.CKM_EC_KEY_PAIR_GEN, pkcs11.CKM_ECDSA) {
+				return alg, nil
+			}
+		case jwa.RS256:
+			if supports(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, pkcs11.CKM_RSA_PKCS) {
+				return alg, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("PKCS #11 token supports none of %v", preferred)
+}
+
+// GenerateKey generates a P-256 key for ES256 or a 2048 bit RSA key for
+// RS256 on the token. Closing the signer destroys the key.
+func (p *PKCS11) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	publicTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, p.Persistent),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.KeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, p.Persistent),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.KeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	var mechanism *pkcs11.Mechanism
+	switch alg {
+	case jwa.ES256:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)
+		publicTemplate = append(publicTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256))
+		privateTemplate = append(privateTemplate, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC))
+	case jwa.RS256:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)
+		publicTemplate = append(publicTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{0x01, 0x00, 0x01}))
+		privateTemplate = append(privateTemplate, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA))
+	default:
+		return nil, fmt.Errorf("unsupported algorithm for PKCS #11 keys: %s", alg)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	publicKey, privateKey, err := p.ctx.GenerateKeyPair(p.session, []*pkcs11.Mechanism{mechanism}, publicTemplate, privateTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PKCS #11 key: %w", err)
+	}
+	public, err := p.publicKey(publicKey, alg)
+	if err != nil {
+		p.ctx.DestroyObject(p.session, privateKey)
+		p.ctx.DestroyObject(p.session, publicKey)
+		return nil, err
+	}
+	return &pkcs11Signer{store: p, private: privateKey, destroy: []pkcs11.ObjectHandle{privateKey, publicKey}, public: public, alg: alg}, nil
+}
+
+// Signer returns a signer for the existing private key with the label,
+// e.g. a key in a YubiKey PIV slot, and the algorithm to use it with. The
+// token must also hold the public key with the same CKA_ID.
+func (p *PKCS11) Signer(keyLabel string) (crypto.Signer, jwa.KeyAlgorithm, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	privateKey, err := p.findObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel))
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, err := p.ctx.GetAttributeValue(p.session, privateKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get PKCS #11 key attributes: %w", err)
+	}
+	var alg jwa.KeyAlgorithm
+	switch keyType := ulongValue(attrs[0].Value); keyType {
+	case pkcs11.CKK_EC:
+		alg = jwa.ES256
+	case pkcs11.CKK_RSA:
+		alg = jwa.RS256
+	default:
+		return nil, nil, fmt.Errorf("unsupported PKCS #11 key type: %#x", keyType)
+	}
+	publicKey, err := p.findObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[1].Value))
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := p.publicKey(publicKey, alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &pkcs11Signer{store: p, private: privateKey, public: public, alg: alg}, alg, nil
+}
+
+// findObject returns the only object matching the template
+func (p *PKCS11) findObject(template ...*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return 0, fmt.Errorf("failed to find PKCS #11 key: %w", err)
+	}
+	objects, _, err := p.ctx.FindObjects(p.session, 2)
+	if finalErr := p.ctx.FindObjectsFinal(p.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find PKCS #11 key: %w", err)
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("PKCS #11 key not found")
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, fmt.Errorf("several PKCS #11 keys match")
+	}
+}
+
+// publicKey reads a P-256 or RSA public key object
+func (p *PKCS11) publicKey(object pkcs11.ObjectHandle, alg jwa.KeyAlgorithm) (crypto.PublicKey, error) {
+	if alg == jwa.RS256 {
+		attrs, err := p.ctx.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PKCS #11 public key: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(attrs[1].Value)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("unsupported RSA public exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(exponent.Int64())}, nil
+	}
+
+	attrs, err := p.ctx.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PKCS #11 public key: %w", err)
+	}
+	if !bytes.Equal(attrs[0].Value, oidP256) {
+		return nil, fmt.Errorf("unsupported PKCS #11 EC key, only P-256 is supported")
+	}
+	return parseECPoint(attrs[1].Value)
+}
+
+// parseECPoint parses a P-256 CKA_EC_POINT, a DER encoded OCTET STRING
+// holding the uncompressed point. Some tokens leave out the OCTET STRING.
+func parseECPoint(ecPoint []byte) (*ecdsa.PublicKey, error) {
+	point := ecPoint
+	var octets []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &octets); err == nil && len(rest) == 0 {
+		point = octets
+	}
+	// Checks the point is on the curve
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("invalid PKCS #11 EC point: %w", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(point[1:33]),
+		Y:     new(big.Int).SetBytes(point[33:]),
+	}, nil
+}
+
+// ulongValue decodes a CK_ULONG attribute, which the module returns in
+// native byte order
+func ulongValue(value []byte) uint {
+	switch len(value) {
+	case 4:
+		return uint(binary.NativeEndian.Uint32(value))
+	case 8:
+		return uint(binary.NativeEndian.Uint64(value))
+	default:
+		return 0
+	}
+}
+
+// Close logs out, closes the session, which destroys the keys that
+// aren't Persistent, and unloads the module
+func (p *PKCS11) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ctx.Logout(p.session)
+	err := p.ctx.CloseSession(p.session)
+	if finalErr := p.ctx.Finalize(); err == nil {
+		err = finalErr
+	}
+	p.ctx.Destroy()
+	return err
+}
+
+// pkcs11Signer is a crypto.Signer for a private key on a PKCS #11 token
+type pkcs11Signer struct {
+	store   *PKCS11
+	private pkcs11.ObjectHandle
+	// destroy are the objects Close destroys, those of generated keys
+	destroy []pkcs11.ObjectHandle
+	public  crypto.PublicKey
+	alg     jwa.KeyAlgorithm
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigest(digest, opts); err != nil {
+		return nil, err
+	}
+	mechanism := pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	input := digest
+	if s.alg == jwa.RS256 {
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		input = append(slices.Clip(sha256DigestInfoPrefix), digest...)
+	}
+
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	if err := s.store.ctx.SignInit(s.store.session, []*pkcs11.Mechanism{mechanism}, s.private); err != nil {
+		return nil, fmt.Errorf("PKCS #11 token failed to sign: %w", err)
+	}
+	sig, err := s.store.ctx.Sign(s.store.session, input)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS #11 token failed to sign: %w", err)
+	}
+	if s.alg == jwa.RS256 {
+		return sig, nil
+	}
+	// CKM_ECDSA signatures are r || s
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("unexpected PKCS #11 ECDSA signature length: %d", len(sig))
+	}
+	return ecdsaASN1(new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+// Close destroys the key if it was generated by PKCS11
+func (s *pkcs11Signer) Close() error {
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	var errs []error
+	for _, object := range s.destroy {
+		errs = append(errs, s.store.ctx.DestroyObject(s.store.session, object))
+	}
+	s.destroy = nil
+	return errors.Join(errs...)
+}
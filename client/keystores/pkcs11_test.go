@@ -0,0 +1,91 @@
+//go:build cgo
+
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseECPoint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecdhKey, err := key.PublicKey.ECDH()
+	require.NoError(t, err)
+	point := ecdhKey.Bytes()
+	wrapped, err := asn1.Marshal(point)
+	require.NoError(t, err)
+
+	for _, ecPoint := range [][]byte{wrapped, point} {
+		public, err := parseECPoint(ecPoint)
+		require.NoError(t, err)
+		require.True(t, public.Equal(&key.PublicKey))
+	}
+	point[len(point)-1] ^= 1
+	_, err = parseECPoint(point)
+	require.Error(t, err)
+}
+
+// TestPKCS11 runs against a real token, e.g. a SoftHSM token:
+//
+//	softhsm2-util --init-token --free --label opk --pin 1234 --so-pin 1234
+//	OPK_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so OPK_PKCS11_TOKEN=opk OPK_PKCS11_PIN=1234 go test
+func TestPKCS11(t *testing.T) {
+	module := os.Getenv("OPK_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("OPK_PKCS11_MODULE not set")
+	}
+	store, err := NewPKCS11(module, os.Getenv("OPK_PKCS11_TOKEN"), os.Getenv("OPK_PKCS11_PIN"))
+	require.NoError(t, err)
+	defer store.Close()
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	for _, preferred := range []jwa.KeyAlgorithm{jwa.ES256, jwa.RS256} {
+		alg, err := store.Algorithm(preferred)
+		require.NoError(t, err)
+		require.Equal(t, preferred, alg)
+
+		opkClient, err := client.New(op, client.WithKeyStore(store, alg))
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, v.VerifyPKToken(context.Background(), pkt))
+
+		signer, signerAlg, err := store.Signer(DefaultPKCS11KeyLabel)
+		require.NoError(t, err)
+		require.Equal(t, alg, signerAlg)
+		require.Equal(t, opkClient.GetSigner().Public(), signer.Public())
+		require.NoError(t, opkClient.GetSigner().(io.Closer).Close())
+	}
+}
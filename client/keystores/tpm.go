@@ -0,0 +1,181 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keystores
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+)
+
+// srkTemplate is the template of the storage root key the signing keys are
+// created under, the ECC SRK of the TCG provisioning guidance. It is
+// derived from the owner hierarchy's seed, so it is the same every time.
+var srkTemplate = tpm2.Public{
+	Type:    tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagNoDA | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		CurveID:   tpm2.CurveNISTP256,
+	},
+}
+
+// signingKeyAttributes keep the key in the TPM, it can't be duplicated to
+// another TPM or exported
+const signingKeyAttributes = tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent |
+	tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagNoDA
+
+// TPM generates keys in a TPM 2.0. The keys are transient, they are
+// flushed when the signer is closed or the process exits.
+type TPM struct {
+	// Open opens the TPM, by default the TPM resource manager, /dev/tpmrm0
+	// on Linux and TBS on Windows
+	Open func() (io.ReadWriteCloser, error)
+}
+
+var _ client.KeyStore = (*TPM)(nil)
+
+func NewTPM() *TPM {
+	return &TPM{
+		Open: func() (io.ReadWriteCloser, error) {
+			return tpm2.OpenTPM()
+		},
+	}
+}
+
+// GenerateKey generates a P-256 key for ES256 or a 2048 bit RSA key for
+// RS256. The signer it returns holds the TPM open until it is closed.
+func (t *TPM) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	template := tpm2.Public{
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: signingKeyAttributes,
+	}
+	switch alg {
+	case jwa.ES256:
+		template.Type = tpm2.AlgECC
+		template.ECCParameters = &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		}
+	case jwa.RS256:
+		template.Type = tpm2.AlgRSA
+		template.RSAParameters = &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm for TPM keys: %s", alg)
+	}
+
+	rw, err := t.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TPM: %w", err)
+	}
+	key, public, err := createKey(rw, template)
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	return &tpmSigner{rw: rw, key: key, public: public, alg: alg}, nil
+}
+
+// createKey creates a key from the template under the SRK and loads it
+func createKey(rw io.ReadWriter, template tpm2.Public) (tpmutil.Handle, crypto.PublicKey, error) {
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create TPM storage root key: %w", err)
+	}
+	// The loaded key doesn't need its parent to stay loaded
+	defer tpm2.FlushContext(rw, srk)
+
+	private, publicBlob, _, _, _, err := tpm2.CreateKey(rw, srk, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create TPM key: %w", err)
+	}
+	key, _, err := tpm2.Load(rw, srk, "", publicBlob, private)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load TPM key: %w", err)
+	}
+	pub, err := tpm2.DecodePublic(publicBlob)
+	if err != nil {
+		tpm2.FlushContext(rw, key)
+		return 0, nil, err
+	}
+	public, err := pub.Key()
+	if err != nil {
+		tpm2.FlushContext(rw, key)
+		return 0, nil, err
+	}
+	return key, public, nil
+}
+
+// tpmSigner is a crypto.Signer for a key loaded in the TPM
+type tpmSigner struct {
+	rw     io.ReadWriteCloser
+	key    tpmutil.Handle
+	public crypto.PublicKey
+	alg    jwa.KeyAlgorithm
+	lock   sync.Mutex
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkDigest(digest, opts); err != nil {
+		return nil, err
+	}
+	scheme := &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256}
+	if s.alg == jwa.RS256 {
+		scheme.Alg = tpm2.AlgRSASSA
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sig, err := tpm2.Sign(s.rw, s.key, "", digest, nil, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("TPM failed to sign: %w", err)
+	}
+	switch {
+	case sig.ECC != nil:
+		return ecdsaASN1(sig.ECC.R, sig.ECC.S)
+	case sig.RSA != nil:
+		return sig.RSA.Signature, nil
+	default:
+		return nil, fmt.Errorf("unexpected TPM signature algorithm: %v", sig.Alg)
+	}
+}
+
+// Close flushes the key from the TPM and closes the TPM
+func (s *tpmSigner) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	flushErr := tpm2.FlushContext(s.rw, s.key)
+	if err := s.rw.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
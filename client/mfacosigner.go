@@ -0,0 +1,360 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// MFACosignerClient speaks the wire protocol of a cosigner served by the
+// cosigner/server package. It leaves opening the init auth URI in the
+// user's browser and receiving the authcode to the caller, which
+// CosignerProvider does with a local callback server, or with DeviceAuth
+// and PollDevice has the user authenticate without any redirect to the
+// client.
+type MFACosignerClient struct {
+	Issuer string
+	// PktMediaType is the representation the PK Token is sent to the
+	// cosigner in, defaults to pktoken.MediaTypeJSON which every cosigner
+	// supports
+	PktMediaType string
+	// HTTPClient redeems authcodes, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// InitAuthURI returns the URI to open in the user's browser to start an
+// auth session, after which the cosigner redirects the browser to
+// redirectURI with an authcode. The nonce is for checking the cosigner
+// signature with ValidateCos.
+func (c *MFACosignerClient) InitAuthURI(pkt *pktoken.PKToken, signer crypto.Signer, redirectURI string) (string, string, error) {
+	mediaType := c.PktMediaType
+	if mediaType == "" {
+		mediaType = pktoken.MediaTypeJSON
+	}
+	pktBytes, err := pkt.MarshalMediaType(mediaType)
+	if err != nil {
+		return "", "", fmt.Errorf("cosigner client hit error serializing PK Token: %w", err)
+	}
+
+	initAuthMsgJson, nonce, err := newInitAuthMsg(c.Issuer, redirectURI)
+	if err != nil {
+		return "", "", fmt.Errorf("hit error creating init auth signed message: %w", err)
+	}
+	sig1, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	if err != nil {
+		return "", "", fmt.Errorf("cosigner client hit error init auth signed message: %w", err)
+	}
+
+	uri, err := initAuthURI(c.Issuer, pktBytes, mediaType, sig1)
+	if err != nil {
+		return "", "", fmt.Errorf("cosigner client hit error when building init auth URI: %w", err)
+	}
+	return uri, nonce, nil
+}
+
+// Redeem signs the authcode under the PK Token and exchanges it for the
+// cosigner signature. Cosigners predating the redeem endpoint are sent the
+// authcode at the sign endpoint instead.
+func (c *MFACosignerClient) Redeem(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Signer, authcode string) ([]byte, error) {
+	sig2, err := pkt.NewSignedMessage([]byte(authcode), signer)
+	if err != nil {
+		return nil, fmt.Errorf("cosigner client hit error when signing authcode: %w", err)
+	}
+
+	res, err := c.postForm(ctx, "redeem", url.Values{"sig2": {string(sig2)}})
+	if err != nil {
+		return nil, fmt.Errorf("error requesting MFA cosigner signature: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		signURI, err := authcodeURI(c.Issuer, sig2)
+		if err != nil {
+			return nil, fmt.Errorf("cosigner client hit error when building authcode URI: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, signURI, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error requesting MFA cosigner signature: %w", err)
+		}
+		if res, err = c.httpClient().Do(req); err != nil {
+			return nil, fmt.Errorf("error requesting MFA cosigner signature: %w", err)
+		}
+		defer res.Body.Close()
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("MFA cosigner returned error status: %s", res.Status)
+	}
+
+	// Receive response from Cosigner that has cosigner signature on PK Token
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MFA cosigner signature response: %w", err)
+	}
+	cosSig, err := util.Base64DecodeForJWT(resBody)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MFA cosigner signature response: %w", err)
+	}
+	return cosSig, nil
+}
+
+// DeviceAuthorization is a device authorization registered with the
+// cosigner, see DeviceAuth
+type DeviceAuthorization struct {
+	msgs.DeviceAuthorization
+	// Nonce and RedirectURI are for checking the cosigner signature with
+	// ValidateCos
+	Nonce       string
+	RedirectURI string
+}
+
+// DeviceAuth starts an auth session without a redirect to the client. The
+// user authenticates by opening the verification URI and entering the
+// user code, meanwhile the client waits with PollDevice. This works where
+// the cosigner can't redirect the browser to the client, e.g. when the
+// client runs in a container or on another machine.
+func (c *MFACosignerClient) DeviceAuth(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Signer) (*DeviceAuthorization, error) {
+	mediaType := c.PktMediaType
+	if mediaType == "" {
+		mediaType = pktoken.MediaTypeJSON
+	}
+	pktBytes, err := pkt.MarshalMediaType(mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("cosigner client hit error serializing PK Token: %w", err)
+	}
+
+	// The cosigner receives the authcode itself and holds it for polling
+	redirectURI, err := url.JoinPath(c.Issuer, "device", "complete")
+	if err != nil {
+		return nil, err
+	}
+	initAuthMsgJson, nonce, err := newInitAuthMsg(c.Issuer, redirectURI)
+	if err != nil {
+		return nil, fmt.Errorf("hit error creating init auth signed message: %w", err)
+	}
+	sig1, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	if err != nil {
+		return nil, fmt.Errorf("cosigner client hit error init auth signed message: %w", err)
+	}
+
+	form := url.Values{
+		"pkt":  {string(util.Base64EncodeForJWT(pktBytes))},
+		"sig1": {string(sig1)},
+	}
+	if mediaType != pktoken.MediaTypeJSON {
+		form.Set("pkt_type", mediaType)
+	}
+	res, err := c.postForm(ctx, "device_authorization", form)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting device authorization: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MFA cosigner returned error status: %s", res.Status)
+	}
+
+	auth := &DeviceAuthorization{Nonce: nonce, RedirectURI: redirectURI}
+	if err := json.NewDecoder(res.Body).Decode(&auth.DeviceAuthorization); err != nil {
+		return nil, fmt.Errorf("error reading device authorization response: %w", err)
+	}
+	return auth, nil
+}
+
+// PollDevice polls the cosigner until the user has authenticated for the
+// device authorization, then redeems the authcode for the cosigner
+// signature. It gives up when ctx is done or the device code expires.
+func (c *MFACosignerClient) PollDevice(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Signer, auth *DeviceAuthorization) ([]byte, error) {
+	// RFC 8628 has clients wait 5 seconds if the interval is missing
+	interval := 5 * time.Second
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * time.Second
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		token, err := c.pollDeviceToken(ctx, auth.DeviceCode)
+		if err != nil {
+			return nil, err
+		}
+		switch token.Error {
+		case "":
+			return c.Redeem(ctx, pkt, signer, token.Authcode)
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("MFA cosigner device authorization failed: %s", token.Error)
+		}
+	}
+}
+
+func (c *MFACosignerClient) pollDeviceToken(ctx context.Context, deviceCode string) (*msgs.DeviceToken, error) {
+	res, err := c.postForm(ctx, "device/token", url.Values{"device_code": {deviceCode}})
+	if err != nil {
+		return nil, fmt.Errorf("error polling MFA cosigner: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return nil, fmt.Errorf("MFA cosigner returned error status: %s", res.Status)
+	}
+	var token msgs.DeviceToken
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("error reading MFA cosigner poll response: %w", err)
+	}
+	if token.Error == "" && token.Authcode == "" {
+		return nil, fmt.Errorf("MFA cosigner poll response has neither an authcode nor an error")
+	}
+	return &token, nil
+}
+
+func (c *MFACosignerClient) postForm(ctx context.Context, path string, form url.Values) (*http.Response, error) {
+	uri, err := url.JoinPath(c.Issuer, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.httpClient().Do(req)
+}
+
+// ValidateCos checks the cosigner signature is from the cosigner and for
+// the auth session started with the nonce and redirect URI
+func (c *MFACosignerClient) ValidateCos(cosSig []byte, expectedNonce string, expectedRedirectURI string) error {
+	cosSigParsed, err := jws.Parse(cosSig)
+	if err != nil {
+		return fmt.Errorf("failed to parse Cosigner signature: %w", err)
+	}
+
+	if len(cosSigParsed.Signatures()) != 1 {
+		return fmt.Errorf("the Cosigner signature does not have the correct number of signatures: %w", err)
+	}
+
+	ph := cosSigParsed.Signatures()[0].ProtectedHeaders()
+	nonceRet, ok := ph.Get("nonce")
+	if !ok {
+		return fmt.Errorf("nonce not set in Cosigner signature protected header")
+	}
+
+	if expectedNonce != nonceRet {
+		return fmt.Errorf("incorrect nonce set in Cosigner signature")
+	}
+
+	ruriRet, ok := ph.Get("ruri")
+	if !ok {
+		return fmt.Errorf("ruri (redirect URI) not set in Cosigner signature protected header")
+	}
+
+	if expectedRedirectURI != ruriRet {
+		return fmt.Errorf("unexpected ruri (redirect URI) set in Cosigner signature, got %s expected %s", ruriRet, expectedRedirectURI)
+	}
+
+	issRet, ok := ph.Get("iss")
+	if !ok {
+		return fmt.Errorf("iss (Cosigner Issuer) not set in Cosigner signature protected header")
+	}
+
+	if c.Issuer != issRet {
+		return fmt.Errorf("unexpected iss (Cosigner Issuer) set in Cosigner signature, expected %s", c.Issuer)
+	}
+	return nil
+}
+
+func (c *MFACosignerClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// newInitAuthMsg generates a random nonce and returns it along with the
+// JSON InitMFAAuth message
+func newInitAuthMsg(issuer string, redirectURI string) ([]byte, string, error) {
+	bits := 256
+	rBytes := make([]byte, bits/8)
+	if _, err := rand.Read(rBytes); err != nil {
+		return nil, "", err
+	}
+	nonce := hex.EncodeToString(rBytes)
+
+	msg := msgs.InitMFAAuth{
+		Issuer:      issuer,
+		RedirectUri: redirectURI,
+		TimeSigned:  time.Now().Unix(),
+		Nonce:       nonce,
+	}
+	msgJson, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	return msgJson, nonce, nil
+}
+
+func initAuthURI(issuer string, pktBytes []byte, mediaType string, sig1 []byte) (string, error) {
+	pktB63 := util.Base64EncodeForJWT(pktBytes)
+	if uri, err := url.Parse(issuer); err != nil {
+		return "", err
+	} else {
+		uri := uri.JoinPath("mfa-auth-init")
+		v := uri.Query()
+		v.Add("pkt", string(pktB63))
+		// Cosigners predating PK Token media types only accept JSON and
+		// ignore pkt_type, so it is only sent when it isn't JSON
+		if mediaType != pktoken.MediaTypeJSON {
+			v.Add("pkt_type", mediaType)
+		}
+		v.Add("sig1", string(sig1))
+		uri.RawQuery = v.Encode()
+
+		// URI Should be: https://<issuer>/mfa-auth-init?pkt=<pktB64>&pkt_type=<mediaType>&sig1=<sig1>
+		return uri.String(), nil
+	}
+}
+
+func authcodeURI(issuer string, sig2 []byte) (string, error) {
+	if uri, err := url.Parse(issuer); err != nil {
+		return "", err
+	} else {
+		uri := uri.JoinPath("sign")
+		v := uri.Query()
+		v.Add("sig2", string(sig2))
+		uri.RawQuery = v.Encode()
+
+		// URI Should be: https://<issuer>/sign?&sig2=<sig2>
+		return uri.String(), nil
+	}
+}
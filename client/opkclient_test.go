@@ -18,15 +18,21 @@ package client_test
 
 import (
 	"context"
+	"crypto"
 	"crypto/rsa"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
 	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
 	"github.com/stretchr/testify/require"
 )
 
@@ -203,3 +209,85 @@ func TestClientRefreshNotSupported(t *testing.T) {
 	_, err = c.Refresh(context.Background())
 	require.ErrorContains(t, err, "does not support OIDC refresh requests")
 }
+
+// opaqueSigner hides the private key, as the signers of a KeyStore do
+type opaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (s *opaqueSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s *opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+type mockKeyStore struct{}
+
+func (mockKeyStore) GenerateKey(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &opaqueSigner{signer: signer}, nil
+}
+
+func TestClientKeyStore(t *testing.T) {
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	for _, alg := range []jwa.KeyAlgorithm{jwa.ES256, jwa.RS256} {
+		c, err := client.New(op, client.WithKeyStore(mockKeyStore{}, alg))
+		require.NoError(t, err)
+		require.IsType(t, &opaqueSigner{}, c.GetSigner())
+		require.Equal(t, alg, c.GetAlg())
+
+		pkt, err := c.Auth(context.Background())
+		require.NoError(t, err)
+		cic, err := pkt.GetCicValues()
+		require.NoError(t, err)
+		var upk crypto.PublicKey
+		require.NoError(t, cic.PublicKey().Raw(&upk))
+		require.True(t, c.GetSigner().Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(upk))
+
+		v, err := verifier.New(op)
+		require.NoError(t, err)
+		require.NoError(t, v.VerifyPKToken(context.Background(), pkt))
+	}
+
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	_, err = client.New(op, client.WithSigner(signer, jwa.ES256), client.WithKeyStore(mockKeyStore{}, jwa.ES256))
+	require.ErrorContains(t, err, "only one may be used")
+}
+
+// blockingProvider never issues tokens, like a user who never completes
+// the login in the browser
+type blockingProvider struct {
+	*providers.MockProvider
+}
+
+func (b *blockingProvider) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClientAuthTimeout(t *testing.T) {
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	c, err := client.New(&blockingProvider{MockProvider: op})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.Auth(ctx)
+	require.ErrorIs(t, err, providers.ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = c.Auth(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, providers.ErrTimeout)
+}
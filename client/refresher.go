@@ -0,0 +1,226 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRefreshMargin is how long before the ID Token expires the
+	// Refresher refreshes it
+	DefaultRefreshMargin = time.Minute
+	// DefaultRefreshRetryDelay is how long the Refresher waits before
+	// trying again when both refreshing and re-authenticating failed
+	DefaultRefreshRetryDelay = 30 * time.Second
+	// minRefreshInterval keeps the Refresher from spinning when the OP
+	// issues ID Tokens which expire sooner than the margin
+	minRefreshInterval = time.Second
+)
+
+// RefreshFunc is called by the Refresher with every new PK Token, or with
+// the error if both refreshing and re-authenticating failed
+type RefreshFunc func(pkt *pktoken.PKToken, err error)
+
+// Refresher keeps the PK Token of an OpkClient fresh in the background.
+// Shortly before the ID Token expires it refreshes it with Refresh, falling
+// back to running Auth again if the OP doesn't support refreshing or the
+// refresh fails. Run does the refreshing, Current and Subscribe may be
+// called concurrently with it.
+type Refresher struct {
+	// Margin is how long before the ID Token expires it is refreshed,
+	// defaults to DefaultRefreshMargin
+	Margin time.Duration
+	// RetryDelay is how long to wait before trying again when both
+	// refreshing and re-authenticating failed, defaults to
+	// DefaultRefreshRetryDelay
+	RetryDelay time.Duration
+	// AuthOpts are passed to Auth when re-authenticating
+	AuthOpts []AuthOpts
+
+	client *OpkClient
+
+	mu          sync.Mutex
+	current     *pktoken.PKToken
+	subscribers map[int]RefreshFunc
+	nextID      int
+}
+
+// NewRefresher returns a Refresher for the client. The client must not be
+// used by anything else while Run is running.
+func NewRefresher(opkClient *OpkClient) *Refresher {
+	r := &Refresher{
+		Margin:      DefaultRefreshMargin,
+		RetryDelay:  DefaultRefreshRetryDelay,
+		client:      opkClient,
+		subscribers: map[int]RefreshFunc{},
+	}
+	if opkClient.pkToken != nil {
+		// A copy, as Refresh modifies the client's PK Token
+		if pkt, err := opkClient.pkToken.DeepCopy(); err == nil {
+			r.current = pkt
+		}
+	}
+	return r
+}
+
+// Current returns a copy of the latest PK Token
+func (r *Refresher) Current() (*pktoken.PKToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil, fmt.Errorf("no PK Token yet, the client hasn't authenticated")
+	}
+	return r.current.DeepCopy()
+}
+
+// Subscribe calls fn with every new PK Token, and with the error whenever
+// getting one failed, until unsubscribe is called. fn is called from Run's
+// goroutine and delays the next refresh until it returns.
+func (r *Refresher) Subscribe(fn RefreshFunc) (unsubscribe func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.nextID
+	r.nextID++
+	r.subscribers[id] = fn
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subscribers, id)
+	}
+}
+
+// Run keeps the PK Token fresh until ctx is done and then returns the
+// context's error. If the client hasn't authenticated yet, Run starts by
+// running Auth.
+func (r *Refresher) Run(ctx context.Context) error {
+	r.mu.Lock()
+	pkt := r.current
+	r.mu.Unlock()
+
+	var wait time.Duration
+	if pkt != nil {
+		wait = r.untilRefresh(pkt)
+	}
+	for {
+		logrus.Debugf("Refreshing PK Token in %v", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		renewed, err := r.renew(ctx, pkt == nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			r.notify(nil, err)
+			wait = r.RetryDelay
+			continue
+		}
+
+		pkt = renewed
+		r.mu.Lock()
+		r.current = pkt
+		r.mu.Unlock()
+		r.notify(pkt, nil)
+		wait = r.untilRefresh(pkt)
+	}
+}
+
+// renew refreshes the PK Token, or runs Auth if refreshing isn't possible
+// or fails
+func (r *Refresher) renew(ctx context.Context, authOnly bool) (*pktoken.PKToken, error) {
+	if _, ok := r.client.Op.(providers.RefreshableOpenIdProvider); ok && !authOnly && r.client.GetRefreshToken() != nil {
+		pkt, err := r.client.Refresh(ctx)
+		if err == nil {
+			return pkt, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		logrus.Warnf("Failed to refresh PK Token, authenticating again: %v", err)
+	}
+	return r.client.Auth(ctx, r.AuthOpts...)
+}
+
+func (r *Refresher) notify(pkt *pktoken.PKToken, err error) {
+	r.mu.Lock()
+	subscribers := make([]RefreshFunc, 0, len(r.subscribers))
+	for _, fn := range r.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	r.mu.Unlock()
+
+	for _, fn := range subscribers {
+		if pkt == nil {
+			fn(nil, err)
+			continue
+		}
+		// Every subscriber gets its own copy to modify
+		pktCopy, copyErr := pkt.DeepCopy()
+		fn(pktCopy, copyErr)
+	}
+}
+
+// untilRefresh returns how long until the PK Token has to be refreshed.
+// If the ID Token lives shorter than the margin it is refreshed halfway
+// through its remaining lifetime.
+func (r *Refresher) untilRefresh(pkt *pktoken.PKToken) time.Duration {
+	exp, err := idTokenExpiration(pkt)
+	if err != nil {
+		logrus.Warnf("Failed to read PK Token expiration, refreshing now: %v", err)
+		return minRefreshInterval
+	}
+	untilExp := time.Until(exp)
+	return max(untilExp-r.Margin, untilExp/2, minRefreshInterval)
+}
+
+// idTokenExpiration returns when the freshest ID Token in the PK Token
+// expires
+func idTokenExpiration(pkt *pktoken.PKToken) (time.Time, error) {
+	payload := pkt.Payload
+	if pkt.FreshIDToken != nil {
+		_, payloadB64, _, err := jws.SplitCompact(pkt.FreshIDToken)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed refreshed ID Token: %w", err)
+		}
+		if payload, err = util.Base64DecodeForJWT(payloadB64); err != nil {
+			return time.Time{}, fmt.Errorf("malformed refreshed ID Token: %w", err)
+		}
+	}
+
+	var claims oidc.OidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("malformed ID Token payload: %w", err)
+	}
+	return time.Unix(claims.Expiration, 0), nil
+}
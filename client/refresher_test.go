@@ -0,0 +1,136 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// shortLivedProvider issues ID Tokens which expire after lifetime
+type shortLivedProvider struct {
+	*providers.MockProvider
+	template    *mocks.IDTokenTemplate
+	lifetime    time.Duration
+	failRefresh bool
+	auths       atomic.Int32
+	refreshes   atomic.Int32
+}
+
+func (p *shortLivedProvider) setExpiration() {
+	p.template.ExtraClaims = map[string]any{"exp": time.Now().Add(p.lifetime).Unix()}
+}
+
+func (p *shortLivedProvider) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	p.auths.Add(1)
+	p.setExpiration()
+	return p.MockProvider.RequestTokens(ctx, cic)
+}
+
+func (p *shortLivedProvider) RefreshTokens(ctx context.Context, refreshToken []byte) (*oidc.Tokens, error) {
+	p.refreshes.Add(1)
+	if p.failRefresh {
+		return nil, fmt.Errorf("refresh token revoked")
+	}
+	p.setExpiration()
+	return p.MockProvider.RefreshTokens(ctx, refreshToken)
+}
+
+func TestRefresher(t *testing.T) {
+	testCases := []struct {
+		name        string
+		failRefresh bool
+	}{
+		{name: "refresh"},
+		{name: "reauth when refresh fails", failRefresh: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockOp, _, template, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+			require.NoError(t, err)
+			op := &shortLivedProvider{MockProvider: mockOp, template: template, lifetime: 2 * time.Second, failRefresh: tc.failRefresh}
+			c, err := client.New(op)
+			require.NoError(t, err)
+
+			refresher := client.NewRefresher(c)
+			refresher.Margin = time.Second
+			_, err = refresher.Current()
+			require.Error(t, err, "no PK Token before authenticating")
+
+			pkts := make(chan *pktoken.PKToken, 10)
+			unsubscribe := refresher.Subscribe(func(pkt *pktoken.PKToken, err error) {
+				require.NoError(t, err)
+				pkts <- pkt
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- refresher.Run(ctx) }()
+
+			// The client hasn't authenticated, so the refresher starts with Auth
+			var first, second *pktoken.PKToken
+			select {
+			case first = <-pkts:
+			case <-time.After(5 * time.Second):
+				t.Fatal("refresher did not authenticate")
+			}
+			require.Nil(t, first.FreshIDToken)
+			select {
+			case second = <-pkts:
+			case <-time.After(5 * time.Second):
+				t.Fatal("refresher did not refresh the PK Token before it expired")
+			}
+			unsubscribe()
+
+			if tc.failRefresh {
+				require.Equal(t, int32(2), op.auths.Load())
+				require.Nil(t, second.FreshIDToken)
+			} else {
+				require.Equal(t, int32(1), op.auths.Load())
+				require.NotNil(t, second.FreshIDToken)
+			}
+			require.Equal(t, int32(1), op.refreshes.Load())
+
+			current, err := refresher.Current()
+			require.NoError(t, err)
+			secondCom, err := second.Compact()
+			require.NoError(t, err)
+			currentCom, err := current.Compact()
+			require.NoError(t, err)
+			require.Equal(t, secondCom, currentCom)
+
+			cancel()
+			select {
+			case err := <-done:
+				require.ErrorIs(t, err, context.Canceled)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not return after the context was cancelled")
+			}
+		})
+	}
+}
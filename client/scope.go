@@ -0,0 +1,78 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// DefaultScopeTTL is how long a scoped assertion is valid for if no TTL
+// is specified.
+const DefaultScopeTTL = 5 * time.Minute
+
+type ScopeOptsStruct struct {
+	action string
+	ttl    time.Duration
+}
+type ScopeOpts func(s *ScopeOptsStruct)
+
+// WithScopeAction restricts the scoped assertion to a single action at
+// the audience, e.g. "deploy" or "read".
+func WithScopeAction(action string) ScopeOpts {
+	return func(s *ScopeOptsStruct) {
+		s.action = action
+	}
+}
+
+// WithScopeTTL specifies how long the scoped assertion is valid for.
+// If not set DefaultScopeTTL is used.
+func WithScopeTTL(ttl time.Duration) ScopeOpts {
+	return func(s *ScopeOptsStruct) {
+		s.ttl = ttl
+	}
+}
+
+// Scope returns a scoped assertion for the client's current PK Token. The
+// assertion is signed by the client's key and restricts where the PK Token
+// may be used to the given audience. Send the assertion alongside the PK
+// Token so that a third party the PK Token is forwarded to can not replay
+// it against other services.
+func (o *OpkClient) Scope(audience string, opts ...ScopeOpts) ([]byte, error) {
+	if o.pkToken == nil {
+		return nil, fmt.Errorf("no PK Token set, run Auth() to create a PK Token first")
+	}
+
+	scopeOpts := &ScopeOptsStruct{ttl: DefaultScopeTTL}
+	for _, applyOpt := range opts {
+		applyOpt(scopeOpts)
+	}
+	if scopeOpts.ttl <= 0 {
+		return nil, fmt.Errorf("scope TTL must be positive, got %s", scopeOpts.ttl)
+	}
+
+	now := time.Now()
+	scope := pktoken.ScopeClaims{
+		Audience:   audience,
+		Action:     scopeOpts.action,
+		IssuedAt:   now.Unix(),
+		Expiration: now.Add(scopeOpts.ttl).Unix(),
+	}
+	return o.pkToken.NewScopedAssertion(scope, o.signer)
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package clockskew defines how far apart the clocks of the OpenID
+// Providers, clients, cosigners and verifiers are allowed to be. The
+// providers, verifier, cosigner and opkssh packages take a Policy wherever
+// they compare a time issued by another party with their own clock, so that
+// operators configure the tolerance once and every check agrees on it.
+package clockskew
+
+import "time"
+
+// DefaultTolerance is how far apart clocks may be unless configured
+// otherwise
+const DefaultTolerance = time.Minute
+
+// Policy tolerates clocks being up to Tolerance behind or ahead of each
+// other. The zero Policy tolerates no skew.
+type Policy struct {
+	Tolerance time.Duration
+}
+
+// Default is the Policy used unless configured otherwise
+var Default = Policy{Tolerance: DefaultTolerance}
+
+// None is the Policy which tolerates no skew
+var None = Policy{}
+
+// New returns a Policy tolerating the given skew. Negative values are
+// treated as zero.
+func New(tolerance time.Duration) Policy {
+	return Policy{Tolerance: max(tolerance, 0)}
+}
+
+// Expired returns true if a time limit set by another party, e.g. an exp
+// claim, has passed at now even allowing for the skew
+func (p Policy) Expired(expiration time.Time, now time.Time) bool {
+	return !now.Add(-p.tolerance()).Before(expiration)
+}
+
+// NotYetValid returns true if a time set by another party, e.g. an nbf or
+// iat claim, is still in the future at now even allowing for the skew
+func (p Policy) NotYetValid(notBefore time.Time, now time.Time) bool {
+	return now.Add(p.tolerance()).Before(notBefore)
+}
+
+func (p Policy) tolerance() time.Duration {
+	return max(p.Tolerance, 0)
+}
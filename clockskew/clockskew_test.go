@@ -0,0 +1,43 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package clockskew
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	now := time.Now()
+
+	require.False(t, None.Expired(now.Add(time.Second), now))
+	require.True(t, None.Expired(now, now))
+	require.False(t, Default.Expired(now.Add(-30*time.Second), now))
+	require.True(t, Default.Expired(now.Add(-DefaultTolerance), now))
+
+	require.False(t, None.NotYetValid(now, now))
+	require.True(t, None.NotYetValid(now.Add(time.Second), now))
+	require.False(t, Default.NotYetValid(now.Add(30*time.Second), now))
+	require.True(t, Default.NotYetValid(now.Add(2*DefaultTolerance), now))
+
+	// Negative tolerances are treated as zero
+	require.Equal(t, None, New(-time.Hour))
+	require.True(t, Policy{Tolerance: -time.Hour}.Expired(now.Add(time.Second), now.Add(2*time.Second)))
+	require.False(t, Policy{Tolerance: -time.Hour}.NotYetValid(now, now))
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+func newExtractKeyCmd() *cobra.Command {
+	extractKeyCmd := &cobra.Command{
+		Use:   "extract-key [file]",
+		Short: "Print the client's public key from a PK Token",
+		Long: "Print the public key in the client instance claims of a PK Token as a JWK,\n" +
+			"PEM or SSH authorized key. The PK Token is not verified.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			pkt, err := readPKToken(cmd, args)
+			if err != nil {
+				return err
+			}
+			cic, err := pkt.GetCicValues()
+			if err != nil {
+				return err
+			}
+			key := cic.PublicKey()
+
+			var out []byte
+			switch format {
+			case "jwk":
+				if out, err = json.MarshalIndent(key, "", "  "); err != nil {
+					return err
+				}
+				out = append(out, '\n')
+			case "pem", "ssh":
+				var raw any
+				if err := key.Raw(&raw); err != nil {
+					return fmt.Errorf("failed to decode public key: %w", err)
+				}
+				if format == "ssh" {
+					sshKey, err := ssh.NewPublicKey(raw)
+					if err != nil {
+						return err
+					}
+					out = ssh.MarshalAuthorizedKey(sshKey)
+					break
+				}
+				der, err := x509.MarshalPKIXPublicKey(raw)
+				if err != nil {
+					return err
+				}
+				out = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+			default:
+				return fmt.Errorf("unsupported format %s, must be jwk, pem or ssh", format)
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+	extractKeyCmd.Flags().String("format", "jwk", "Output format: jwk, pem or ssh")
+	return extractKeyCmd
+}
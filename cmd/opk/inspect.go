@@ -0,0 +1,126 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/spf13/cobra"
+)
+
+// inspection is what inspect prints of a PK Token
+type inspection struct {
+	Payload      json.RawMessage         `json:"payload"`
+	Signatures   []inspectedSignature    `json:"signatures"`
+	Cosigner     *pktoken.CosignerClaims `json:"cosigner,omitempty"`
+	FreshIDToken *inspectedFreshIDToken  `json:"fresh_id_token,omitempty"`
+}
+
+type inspectedSignature struct {
+	SigType   pktoken.SignatureType `json:"sig_type"`
+	Protected map[string]any        `json:"protected"`
+	Public    map[string]any        `json:"public,omitempty"`
+}
+
+type inspectedFreshIDToken struct {
+	Protected json.RawMessage `json:"protected"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func newInspectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect [file]",
+		Short: "Print the payload, signatures and cosigner claims of a PK Token",
+		Long: "Print the payload, signatures and cosigner claims of a PK Token as JSON.\n" +
+			"The PK Token is not verified.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pkt, err := readPKToken(cmd, args)
+			if err != nil {
+				return err
+			}
+			out, err := inspect(cmd, pkt)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), string(out))
+			return err
+		},
+	}
+}
+
+func inspect(cmd *cobra.Command, pkt *pktoken.PKToken) ([]byte, error) {
+	result := inspection{Payload: pkt.Payload, Signatures: []inspectedSignature{}}
+	for _, sig := range []struct {
+		typ pktoken.SignatureType
+		sig *pktoken.Signature
+	}{{pktoken.OIDC, pkt.Op}, {pktoken.CIC, pkt.Cic}, {pktoken.COS, pkt.Cos}} {
+		if sig.sig == nil {
+			continue
+		}
+		inspected := inspectedSignature{SigType: sig.typ}
+		var err error
+		if inspected.Protected, err = headersAsMap(cmd, sig.sig.ProtectedHeaders()); err != nil {
+			return nil, err
+		}
+		if inspected.Public, err = headersAsMap(cmd, sig.sig.PublicHeaders()); err != nil {
+			return nil, err
+		}
+		result.Signatures = append(result.Signatures, inspected)
+	}
+
+	if pkt.Cos != nil {
+		cosClaims, err := pkt.ParseCosignerClaims()
+		if err != nil {
+			return nil, err
+		}
+		result.Cosigner = cosClaims
+	}
+
+	if pkt.FreshIDToken != nil {
+		protected, payload, _, err := oidc.SplitCompact(pkt.FreshIDToken)
+		if err != nil {
+			return nil, fmt.Errorf("malformed refreshed ID Token: %w", err)
+		}
+		result.FreshIDToken = &inspectedFreshIDToken{}
+		if err := oidc.ParseJWTSegment(protected, &result.FreshIDToken.Protected); err != nil {
+			return nil, fmt.Errorf("malformed refreshed ID Token: %w", err)
+		}
+		if err := oidc.ParseJWTSegment(payload, &result.FreshIDToken.Payload); err != nil {
+			return nil, fmt.Errorf("malformed refreshed ID Token: %w", err)
+		}
+	}
+	return json.MarshalIndent(result, "", "  ")
+}
+
+func headersAsMap(cmd *cobra.Command, headers jws.Headers) (map[string]any, error) {
+	if headers == nil {
+		return nil, nil
+	}
+	m, err := headers.AsMap(cmd.Context())
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
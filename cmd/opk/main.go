@@ -0,0 +1,92 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Command opk inspects and verifies PK Tokens, so that debugging a token
+// doesn't require writing a Go program:
+//
+//	opk inspect token.pkt
+//	opk verify --issuer https://accounts.google.com --client-id my-client-id token.pkt
+//	opk verify --bundle bundle.jws --bundle-key exporter.pem token.pkt
+//	opk extract-key --format ssh token.pkt
+//
+// Tokens are read from the file given, or from stdin, in their compact or
+// JSON serialization.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := newRootCmd().ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:           "opk",
+		Short:         "Inspect and verify PK Tokens",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	rootCmd.AddCommand(newInspectCmd(), newVerifyCmd(), newExtractKeyCmd())
+	return rootCmd
+}
+
+// readPKToken reads the PK Token in the file named by args, or stdin if
+// there is none or it is "-"
+func readPKToken(cmd *cobra.Command, args []string) (*pktoken.PKToken, error) {
+	var data []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		data, err = io.ReadAll(cmd.InOrStdin())
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no PK Token given")
+	}
+
+	if data[0] == '{' {
+		pkt := &pktoken.PKToken{}
+		if err := pkt.UnmarshalJSON(data); err != nil {
+			return nil, fmt.Errorf("malformed PK Token: %w", err)
+		}
+		return pkt, nil
+	}
+	pkt, err := pktoken.NewFromCompact(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PK Token: %w", err)
+	}
+	return pkt, nil
+}
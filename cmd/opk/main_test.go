@@ -0,0 +1,168 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func runOpk(t *testing.T, stdin []byte, args ...string) (string, error) {
+	cmd := newRootCmd()
+	var out bytes.Buffer
+	cmd.SetIn(bytes.NewReader(stdin))
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	err := cmd.ExecuteContext(context.Background())
+	return out.String(), err
+}
+
+func TestOpk(t *testing.T) {
+	dir := t.TempDir()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opOpts := providers.DefaultMockProviderOpts()
+	op, backend, _, err := providers.NewMockProvider(opOpts)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	pktPath := filepath.Join(dir, "token.pkt")
+	require.NoError(t, os.WriteFile(pktPath, pktCom, 0600))
+	pktJSON, err := json.Marshal(pkt)
+	require.NoError(t, err)
+
+	t.Run("inspect", func(t *testing.T) {
+		for _, stdin := range [][]byte{pktCom, pktJSON} {
+			out, err := runOpk(t, stdin, "inspect")
+			require.NoError(t, err)
+			var inspected struct {
+				Payload struct {
+					Subject string `json:"sub"`
+				} `json:"payload"`
+				Signatures []struct {
+					SigType   string         `json:"sig_type"`
+					Protected map[string]any `json:"protected"`
+				} `json:"signatures"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(out), &inspected))
+			require.Equal(t, "me", inspected.Payload.Subject)
+			require.Len(t, inspected.Signatures, 2)
+			require.Equal(t, "JWT", inspected.Signatures[0].SigType)
+			require.Equal(t, "CIC", inspected.Signatures[1].SigType)
+			require.Contains(t, inspected.Signatures[1].Protected, "upk")
+		}
+		_, err := runOpk(t, []byte("not a token"), "inspect")
+		require.ErrorContains(t, err, "malformed PK Token")
+	})
+
+	t.Run("verify offline", func(t *testing.T) {
+		exporter, err := util.GenKeyPair(jwa.ES256)
+		require.NoError(t, err)
+		bundle, err := verifier.ExportBundle(context.Background(), backend.GetPublicKeyFinder(),
+			[]verifier.BundleIssuer{{
+				Issuer:      opOpts.Issuer,
+				ClientID:    opOpts.ClientID,
+				CommitClaim: providers.CommitTypesEnum.NONCE_CLAIM.Claim,
+			}}, nil, time.Hour, exporter, jwa.ES256)
+		require.NoError(t, err)
+		bundlePath := filepath.Join(dir, "bundle.jws")
+		require.NoError(t, os.WriteFile(bundlePath, bundle, 0600))
+		der, err := x509.MarshalPKIXPublicKey(exporter.Public())
+		require.NoError(t, err)
+		keyPath := filepath.Join(dir, "exporter.pem")
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+		out, err := runOpk(t, nil, "verify", "--bundle", bundlePath, "--bundle-key", keyPath, pktPath)
+		require.NoError(t, err)
+		require.Contains(t, out, "PK Token is valid")
+		require.Contains(t, out, "subject: me")
+
+		// A PK Token from another OP isn't in the bundle
+		otherOpts := providers.DefaultMockProviderOpts()
+		otherOpts.Issuer = "https://other.example.com"
+		otherOp, _, _, err := providers.NewMockProvider(otherOpts)
+		require.NoError(t, err)
+		otherClient, err := client.New(otherOp)
+		require.NoError(t, err)
+		otherPKT, err := otherClient.Auth(context.Background())
+		require.NoError(t, err)
+		otherCom, err := otherPKT.Compact()
+		require.NoError(t, err)
+		_, err = runOpk(t, otherCom, "verify", "--bundle", bundlePath, "--bundle-key", keyPath)
+		require.ErrorContains(t, err, "PK Token is invalid")
+
+		_, err = runOpk(t, pktCom, "verify", "--bundle", bundlePath)
+		require.Error(t, err)
+		_, err = runOpk(t, pktCom, "verify")
+		require.Error(t, err)
+		_, err = runOpk(t, pktCom, "verify", "--issuer", opOpts.Issuer)
+		require.ErrorContains(t, err, "--client-id")
+	})
+
+	t.Run("extract-key", func(t *testing.T) {
+		out, err := runOpk(t, nil, "extract-key", pktPath)
+		require.NoError(t, err)
+		key, err := jwk.ParseKey([]byte(out))
+		require.NoError(t, err)
+		var raw any
+		require.NoError(t, key.Raw(&raw))
+		require.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(raw))
+
+		out, err = runOpk(t, nil, "extract-key", "--format", "pem", pktPath)
+		require.NoError(t, err)
+		block, _ := pem.Decode([]byte(out))
+		require.NotNil(t, block)
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		require.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(pub))
+
+		out, err = runOpk(t, nil, "extract-key", "--format", "ssh", pktPath)
+		require.NoError(t, err)
+		sshPub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(out))
+		require.NoError(t, err)
+		expected, err := ssh.NewPublicKey(signer.Public())
+		require.NoError(t, err)
+		require.Equal(t, expected.Marshal(), sshPub.Marshal())
+		require.True(t, strings.HasPrefix(out, "ecdsa-sha2-nistp256 "))
+
+		_, err = runOpk(t, nil, "extract-key", "--format", "der", pktPath)
+		require.ErrorContains(t, err, "unsupported format")
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/config"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/spf13/cobra"
+)
+
+// commitTypes maps the values of verify --commit to how the ID Token
+// commits to the client instance claims
+var commitTypes = map[string]providers.CommitType{
+	"nonce": providers.CommitTypesEnum.NONCE_CLAIM,
+	"aud":   providers.CommitTypesEnum.AUD_CLAIM,
+	"gq":    providers.CommitTypesEnum.GQ_BOUND,
+}
+
+func newVerifyCmd() *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:   "verify [file]",
+		Short: "Verify a PK Token",
+		Long: "Verify a PK Token against an issuer, the providers of a config file or,\n" +
+			"without network access, a verification bundle.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pkt, err := readPKToken(cmd, args)
+			if err != nil {
+				return err
+			}
+			v, err := newVerifier(cmd)
+			if err != nil {
+				return err
+			}
+			if err := v.VerifyPKToken(cmd.Context(), pkt); err != nil {
+				return fmt.Errorf("PK Token is invalid: %w", err)
+			}
+
+			var claims oidc.OidcClaims
+			if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+				return fmt.Errorf("malformed ID Token claims: %w", err)
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintln(out, "PK Token is valid")
+			fmt.Fprintf(out, "issuer:  %s\nsubject: %s\n", claims.Issuer, claims.Subject)
+			if claims.Email != "" {
+				fmt.Fprintf(out, "email:   %s\n", claims.Email)
+			}
+			return nil
+		},
+	}
+	verifyCmd.Flags().String("issuer", "", "Issuer the PK Token must be from, its keys are discovered online")
+	verifyCmd.Flags().String("client-id", "", "Client ID the ID Token's audience must contain, with --issuer")
+	verifyCmd.Flags().Bool("skip-client-id-check", false, "Accept any audience, with --issuer")
+	verifyCmd.Flags().String("commit", "", "Claim committing to the client instance claims, with --issuer: nonce, aud or gq (default: the one registered for the issuer, else nonce)")
+	verifyCmd.Flags().Bool("gq-only", false, "Require a GQ signed ID Token, with --issuer")
+	verifyCmd.Flags().String("config", "", "Config file whose providers the PK Token may be from")
+	verifyCmd.Flags().String("bundle", "", "Signed verification bundle to verify with offline")
+	verifyCmd.Flags().String("bundle-key", "", "PEM public key of the bundle's exporter, with --bundle")
+	verifyCmd.Flags().String("bundle-alg", string(jwa.ES256), "Signing algorithm of the bundle's exporter, with --bundle")
+	verifyCmd.Flags().Bool("ignore-expiration", false, "Accept expired ID Tokens, e.g. to verify old artifacts, with --issuer or --bundle")
+	verifyCmd.MarkFlagsMutuallyExclusive("issuer", "config", "bundle")
+	verifyCmd.MarkFlagsOneRequired("issuer", "config", "bundle")
+	verifyCmd.MarkFlagsRequiredTogether("bundle", "bundle-key")
+	verifyCmd.MarkFlagsMutuallyExclusive("config", "ignore-expiration")
+	_ = verifyCmd.MarkFlagFilename("config")
+	_ = verifyCmd.MarkFlagFilename("bundle")
+	_ = verifyCmd.MarkFlagFilename("bundle-key")
+	return verifyCmd
+}
+
+func newVerifier(cmd *cobra.Command) (*verifier.Verifier, error) {
+	// Expiration is checked by the provider verifiers, a config sets its
+	// own expiration policy
+	var expirationPolicy *providers.ExpirationPolicy
+	if ignoreExpiration, _ := cmd.Flags().GetBool("ignore-expiration"); ignoreExpiration {
+		expirationPolicy = &providers.ExpirationPolicies.NEVER_EXPIRE
+	}
+
+	if configPath, _ := cmd.Flags().GetString("config"); configPath != "" {
+		c, err := config.Load(configPath)
+		if err != nil {
+			return nil, err
+		}
+		return c.NewVerifier()
+	}
+
+	if bundlePath, _ := cmd.Flags().GetString("bundle"); bundlePath != "" {
+		keyPath, _ := cmd.Flags().GetString("bundle-key")
+		alg, _ := cmd.Flags().GetString("bundle-alg")
+		signedBundle, err := os.ReadFile(bundlePath)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in %s", keyPath)
+		}
+		exporterKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bundle exporter key: %w", err)
+		}
+		bundle, err := verifier.ParseBundle(signedBundle, exporterKey, jwa.SignatureAlgorithm(alg))
+		if err != nil {
+			return nil, err
+		}
+		return verifier.NewFromBundle(bundle, expirationPolicy)
+	}
+
+	issuer, _ := cmd.Flags().GetString("issuer")
+	clientID, _ := cmd.Flags().GetString("client-id")
+	skipClientIDCheck, _ := cmd.Flags().GetBool("skip-client-id-check")
+	commit, _ := cmd.Flags().GetString("commit")
+	gqOnly, _ := cmd.Flags().GetBool("gq-only")
+	commitType, ok := commitTypes[commit]
+	if commit == "" {
+		commitType = providers.Commitments.CommitType(issuer, providers.CommitTypesEnum.NONCE_CLAIM)
+	} else if !ok {
+		return nil, fmt.Errorf("unsupported commit %s, must be nonce, aud or gq", commit)
+	}
+	if clientID == "" && !skipClientIDCheck {
+		return nil, fmt.Errorf("--client-id or --skip-client-id-check is required with --issuer")
+	}
+	return verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+		ClientID:          clientID,
+		SkipClientIDCheck: skipClientIDCheck,
+		CommitType:        commitType,
+		GQOnly:            gqOnly,
+		ExpirationPolicy:  expirationPolicy,
+	}))
+}
@@ -0,0 +1,463 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/clockskew"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/notify"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/retry"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// NewProvider constructs the OpenID provider with the given name. If name
+// is empty and exactly one provider is configured, that provider is used.
+func (c *Config) NewProvider(name string) (providers.OpenIdProvider, error) {
+	p, err := c.provider(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.newProvider(true, c.clockSkew())
+}
+
+// NewProviders constructs every configured provider for verifying their ID
+// Tokens. Unlike NewProvider it doesn't need the credentials CI providers
+// read from the environment to request ID Tokens.
+func (c *Config) NewProviders() ([]providers.OpenIdProvider, error) {
+	ops := []providers.OpenIdProvider{}
+	for _, p := range c.Providers {
+		op, err := p.newProvider(false, c.clockSkew())
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.name(), err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// NewClient constructs an OpkClient for the provider with the given name,
+// see NewProvider. The client uses the configured key and, if a cosigner
+// sets callback_path or device_flow, requests cosigner signatures from it. Any opts are
+// applied after the configured options.
+func (c *Config) NewClient(providerName string, opts ...client.ClientOpts) (*client.OpkClient, error) {
+	op, err := c.NewProvider(providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, alg, err := c.Key.Signer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client key: %w", err)
+	}
+	clientOpts := []client.ClientOpts{client.WithSigner(signer, alg)}
+	for _, cos := range c.Cosigners {
+		if cos.CallbackPath != "" || cos.DeviceFlow {
+			clientOpts = append(clientOpts, client.WithCosignerProvider(&client.CosignerProvider{
+				Issuer:       cos.Issuer,
+				CallbackPath: cos.CallbackPath,
+				DeviceFlow:   cos.DeviceFlow,
+				PktMediaType: cos.PktMediaType,
+			}))
+		}
+	}
+	return client.New(op, append(clientOpts, opts...)...)
+}
+
+// NewVerifier constructs a verifier which accepts PK Tokens from every
+// configured provider and enforces the verifier policies and cosigner
+// requirements. Any opts are applied after the configured options.
+func (c *Config) NewVerifier(opts ...verifier.VerifierOpts) (*verifier.Verifier, error) {
+	if len(c.Providers) == 0 {
+		return nil, fmt.Errorf("no providers configured")
+	}
+
+	var finder *discover.PublicKeyFinder
+	if len(c.PinnedJwks) > 0 {
+		finder = c.pinnedFinder()
+	} else if allowlist, err := c.NewAllowlist(); err != nil {
+		return nil, err
+	} else if allowlist != nil {
+		finder = discover.NewPubkeyFinder(retry.Default.Client(allowlist.HTTPClient()))
+	}
+
+	providerVerifiers := []verifier.ProviderVerifier{}
+	for _, p := range c.Providers {
+		// Verification doesn't need the CI provider's environment
+		op, err := p.newProvider(false, c.clockSkew())
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.name(), err)
+		}
+		if finder == nil {
+			providerVerifiers = append(providerVerifiers, op)
+			continue
+		}
+		if _, ok := c.PinnedJwks[op.Issuer()]; !ok && len(c.PinnedJwks) > 0 {
+			return nil, fmt.Errorf("provider %s: no pinned JWKS for issuer (%s)", p.name(), op.Issuer())
+		}
+		pv, err := pinnedProviderVerifier(op, finder)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.name(), err)
+		}
+		providerVerifiers = append(providerVerifiers, pv)
+	}
+
+	verifierOpts := []verifier.VerifierOpts{}
+	if len(providerVerifiers) > 1 {
+		verifierOpts = append(verifierOpts, verifier.AddProviderVerifiers(providerVerifiers[1:]...))
+	}
+	if policy, ok := c.Verifier.expirationPolicy(); ok {
+		verifierOpts = append(verifierOpts, verifier.WithExpirationPolicy(policy))
+	}
+	if c.Verifier.ClockSkew != 0 {
+		verifierOpts = append(verifierOpts, verifier.WithClockSkew(clockskew.New(c.Verifier.ClockSkew)))
+	} else if skew := c.clockSkew(); skew != nil {
+		verifierOpts = append(verifierOpts, verifier.WithClockSkew(*skew))
+	}
+	if c.Verifier.RequireRefreshedIDToken {
+		verifierOpts = append(verifierOpts, verifier.RequireRefreshedIDToken())
+	}
+
+	checkers := []verifier.RevocationChecker{}
+	for _, path := range c.Verifier.Revocation.Files {
+		checkers = append(checkers, verifier.NewFileRevocationChecker(path))
+	}
+	for _, uri := range c.Verifier.Revocation.URLs {
+		checkers = append(checkers, verifier.NewHTTPRevocationChecker(uri, nil, c.Verifier.Revocation.TTL))
+	}
+	if len(checkers) > 0 {
+		verifierOpts = append(verifierOpts, verifier.WithRevocationCheckers(checkers...))
+	}
+
+	if len(c.Cosigners) > 0 {
+		cosignerVerifiers := []*cosigner.DefaultCosignerVerifier{}
+		for _, cos := range c.Cosigners {
+			algs := []jwa.SignatureAlgorithm{}
+			for _, alg := range cos.AllowedAlgorithms {
+				algs = append(algs, jwa.SignatureAlgorithm(alg))
+			}
+			cosOpts := cosigner.CosignerVerifierOpts{
+				Strict:            cos.Strict,
+				AllowedAlgorithms: algs,
+			}
+			if finder != nil {
+				if _, ok := c.PinnedJwks[cos.Issuer]; !ok && len(c.PinnedJwks) > 0 {
+					return nil, fmt.Errorf("cosigner %s: no pinned JWKS", cos.Issuer)
+				}
+				cosOpts.DiscoverPublicKey = finder
+			}
+			if skew := c.clockSkew(); skew != nil {
+				cosOpts.ClockSkew = *skew
+			}
+			cosignerVerifiers = append(cosignerVerifiers, cosigner.NewCosignerVerifier(cos.Issuer, cosOpts))
+		}
+		verifierOpts = append(verifierOpts, verifier.WithCosignerVerifiers(cosignerVerifiers...))
+	}
+
+	return verifier.New(providerVerifiers[0], append(verifierOpts, opts...)...)
+}
+
+// NewAllowlist returns the Allowlist verifiers fetch the providers'
+// configuration and JWKS through, or nil if no allowlist is configured. It
+// allows the hosts of the providers' issuers and the configured hosts. The
+// cosigners' hosts must be listed too.
+func (c *Config) NewAllowlist() (*discover.Allowlist, error) {
+	if c.Allowlist == nil {
+		return nil, nil
+	}
+	issuers := []string{}
+	for _, p := range c.Providers {
+		op, err := p.newProvider(false, c.clockSkew())
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.name(), err)
+		}
+		issuers = append(issuers, op.Issuer())
+	}
+	allowlist, err := discover.AllowlistFromIssuers(issuers...)
+	if err != nil {
+		return nil, err
+	}
+	allowlist.Hosts = append(allowlist.Hosts, c.Allowlist.Hosts...)
+	for _, ip := range c.Allowlist.IPs {
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: invalid IP range %q: %w", ip, err)
+		}
+		allowlist.IPs = append(allowlist.IPs, prefix)
+	}
+	return allowlist, nil
+}
+
+// NewAuthCosigner constructs the cosigner described by cosigner_server
+// using the given store for auth state
+func (c *Config) NewAuthCosigner(store cosigner.AuthStateStore) (*cosigner.AuthCosigner, error) {
+	if c.CosignerServer == nil {
+		return nil, fmt.Errorf("no cosigner_server configured")
+	}
+	signer, alg, err := c.CosignerServer.Key.Signer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cosigner key: %w", err)
+	}
+	cos, err := cosigner.New(signer, alg, c.CosignerServer.Issuer, c.CosignerServer.KeyID, store)
+	if err != nil {
+		return nil, err
+	}
+	if skew := c.clockSkew(); skew != nil {
+		cos.ClockSkew = *skew
+	}
+	if policy := c.CosignerServer.Policy; policy != nil {
+		cos.Policy = cosigner.ClaimsPolicy{
+			Issuers:      policy.Issuers,
+			Audiences:    policy.Audiences,
+			EmailDomains: policy.EmailDomains,
+			Groups:       policy.Groups,
+		}
+	}
+	if n := c.CosignerServer.Notify; n != nil {
+		if cos.Notifier, err = n.notifier(); err != nil {
+			return nil, err
+		}
+	}
+	return cos, nil
+}
+
+// notifier constructs the configured notifiers. They deliver in the
+// background so that slow endpoints don't delay the cosigner
+func (n *NotifyConfig) notifier() (notify.Notifier, error) {
+	var notifiers notify.Multi
+	for _, w := range n.Webhooks {
+		webhook := &notify.Webhook{URL: w.URL}
+		if w.SecretPath != "" {
+			secret, err := os.ReadFile(w.SecretPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read webhook secret: %w", err)
+			}
+			webhook.Secret = bytes.TrimSpace(secret)
+		}
+		notifiers = append(notifiers, filterEvents(webhook, w.Events))
+	}
+	if e := n.Email; e != nil {
+		mailer := &notify.SMTP{Addr: e.Addr, From: e.From, To: e.To, NotifyUser: e.NotifyUser}
+		if e.Username != "" {
+			password, err := os.ReadFile(e.PasswordPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SMTP password: %w", err)
+			}
+			host, _, _ := strings.Cut(e.Addr, ":")
+			mailer.Auth = smtp.PlainAuth("", e.Username, string(bytes.TrimSpace(password)), host)
+		}
+		notifiers = append(notifiers, filterEvents(mailer, e.Events))
+	}
+	return notify.Async(notifiers, 0), nil
+}
+
+func filterEvents(n notify.Notifier, events []string) notify.Notifier {
+	if len(events) == 0 {
+		return n
+	}
+	types := make([]notify.EventType, len(events))
+	for i, event := range events {
+		types[i] = notify.EventType(event)
+	}
+	return notify.Filter(n, types...)
+}
+
+// clockSkew returns the configured clock skew policy, nil if clock_skew is
+// unset
+func (c *Config) clockSkew() *clockskew.Policy {
+	if c.ClockSkew == 0 {
+		return nil
+	}
+	skew := clockskew.New(c.ClockSkew)
+	return &skew
+}
+
+// Signer returns the signing key described by the KeyConfig. If Path is
+// set and no key exists there yet, a new key is generated and written to
+// Path.
+func (k KeyConfig) Signer() (crypto.Signer, jwa.SignatureAlgorithm, error) {
+	alg := jwa.SignatureAlgorithm(k.alg())
+	if k.Path == "" {
+		signer, err := util.GenKeyPair(alg)
+		return signer, alg, err
+	}
+
+	curve := elliptic.P256()
+	if alg == jwa.ES384 {
+		curve = elliptic.P384()
+	}
+
+	sk, err := util.ReadSKFile(k.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		signer, err := util.GenKeyPair(alg)
+		if err != nil {
+			return nil, "", err
+		}
+		sk = signer.(*ecdsa.PrivateKey)
+		if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+			return nil, "", err
+		}
+		if err := util.WriteSKFile(k.Path, sk); err != nil {
+			return nil, "", err
+		}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if sk.Curve != curve {
+		return nil, "", fmt.Errorf("key at %s is not a %s key", k.Path, alg)
+	}
+	return sk, alg, nil
+}
+
+func (c *Config) provider(name string) (*ProviderConfig, error) {
+	if name == "" {
+		if len(c.Providers) != 1 {
+			return nil, fmt.Errorf("provider name required when %d providers are configured", len(c.Providers))
+		}
+		return &c.Providers[0], nil
+	}
+	for i := range c.Providers {
+		if c.Providers[i].name() == name {
+			return &c.Providers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no provider named %s", name)
+}
+
+// newProvider constructs the provider. The Github provider reads the
+// credentials for requesting an ID Token from the environment, forClient
+// is false when they aren't needed. If skew is nil the provider's default
+// clock skew is used.
+func (p ProviderConfig) newProvider(forClient bool, skew *clockskew.Policy) (providers.OpenIdProvider, error) {
+	switch p.Type {
+	case ProviderGoogle:
+		opts := providers.GetDefaultGoogleOpOptions()
+		if p.ClientID != "" {
+			opts.ClientID = p.ClientID
+			opts.ClientSecret = p.ClientSecret
+		}
+		opts.AcceptedClientIDs = p.AcceptedClientIDs
+		setIfNotEmpty(&opts.Issuer, p.Issuer)
+		setIfNotEmpty(&opts.Scopes, p.Scopes)
+		setIfNotEmpty(&opts.RedirectURIs, p.RedirectURIs)
+		opts.GQSign = p.GQSign
+		if p.OpenBrowser != nil {
+			opts.OpenBrowser = *p.OpenBrowser
+		}
+		if skew != nil {
+			opts.ClockSkew = *skew
+		}
+		return providers.NewGoogleOpWithOptions(opts), nil
+	case ProviderAzure:
+		opts := providers.GetDefaultAzureOpOptions()
+		setIfNotEmpty(&opts.ClientID, p.ClientID)
+		opts.AcceptedClientIDs = p.AcceptedClientIDs
+		setIfNotEmpty(&opts.Issuer, p.Issuer)
+		if p.TenantID != "" {
+			opts.TenantID = p.TenantID
+			opts.Issuer = fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", p.TenantID)
+		}
+		setIfNotEmpty(&opts.Scopes, p.Scopes)
+		setIfNotEmpty(&opts.RedirectURIs, p.RedirectURIs)
+		opts.GQSign = p.GQSign
+		if p.OpenBrowser != nil {
+			opts.OpenBrowser = *p.OpenBrowser
+		}
+		if skew != nil {
+			opts.ClockSkew = *skew
+		}
+		return providers.NewAzureOpWithOptions(opts), nil
+	case ProviderGitlab:
+		op := providers.NewGitlabOpFromEnvironmentDefault()
+		if p.Issuer != "" || p.TokenEnvVar != "" {
+			issuer, tokenEnvVar := p.Issuer, p.TokenEnvVar
+			if issuer == "" {
+				issuer = op.Issuer()
+			}
+			if tokenEnvVar == "" {
+				tokenEnvVar = "OPENPUBKEY_JWT"
+			}
+			op = providers.NewGitlabOp(issuer, tokenEnvVar)
+		}
+		return op, nil
+	case ProviderGithub:
+		if forClient {
+			return providers.NewGithubOpFromEnvironment()
+		}
+		return providers.NewGithubOp("", ""), nil
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %s", p.Type)
+	}
+}
+
+// expirationPolicy returns the expiration policy the verifier enforces in
+// addition to the providers' own, if any
+func (v VerifierConfig) expirationPolicy() (providers.ExpirationPolicy, bool) {
+	var policy providers.ExpirationPolicy
+	switch v.Expiration {
+	case ExpirationOIDC:
+		policy = providers.ExpirationPolicies.OIDC
+	case ExpirationMaxAge24h:
+		policy = providers.ExpirationPolicies.MAX_AGE_24HOURS
+	case ExpirationMaxAge48h:
+		policy = providers.ExpirationPolicies.MAX_AGE_48HOURS
+	case ExpirationMaxAge1Week:
+		policy = providers.ExpirationPolicies.MAX_AGE_1WEEK
+	case ExpirationNeverExpires:
+		policy = providers.ExpirationPolicies.NEVER_EXPIRE
+	case "":
+		if v.MaxAge == 0 && v.ClockSkew == 0 && !v.RequireNotBefore {
+			return policy, false
+		}
+		policy = providers.ExpirationPolicies.OIDC
+	}
+
+	if v.MaxAge != 0 {
+		policy = policy.WithMaxAge(v.MaxAge)
+	}
+	if v.ClockSkew != 0 {
+		policy = policy.WithClockSkew(v.ClockSkew)
+	}
+	if v.RequireNotBefore {
+		policy = policy.WithRequireNotBefore()
+	}
+	return policy, true
+}
+
+func setIfNotEmpty[T string | []string](field *T, value T) {
+	if len(value) > 0 {
+		*field = value
+	}
+}
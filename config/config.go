@@ -0,0 +1,469 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package config loads a single declarative file describing the OpenID
+// providers, verifier policies, cosigner requirements and key storage of an
+// OpenPubkey deployment and constructs the wired-up client, verifier and
+// cosigner from it.
+//
+// An example config:
+//
+//	providers:
+//	  - type: google
+//	    client_id: my-client-id
+//	    client_secret: my-client-secret
+//	  - type: gitlab
+//	clock_skew: 1m
+//	verifier:
+//	  expiration: oidc
+//	  revocation:
+//	    urls: [https://example.com/revoked.json]
+//	cosigners:
+//	  - issuer: https://mfacosigner.example.com
+//	    callback_path: /mfaredirect
+//	key:
+//	  alg: ES256
+//	  path: /etc/openpubkey/signing.pem
+//	allowlist:
+//	  hosts: [www.googleapis.com]
+//
+// The trust configuration of a config, the parts which decide which PK
+// Tokens its verifier accepts, can be exported as a signed trust document
+// with Config.ExportTrust and imported by other verifiers with ParseTrust.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/notify"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"gopkg.in/yaml.v3"
+)
+
+// Provider types supported in ProviderConfig.Type
+const (
+	ProviderGoogle = "google"
+	ProviderAzure  = "azure"
+	ProviderGitlab = "gitlab"
+	ProviderGithub = "github"
+)
+
+// Expiration policy names supported in VerifierConfig.Expiration, they
+// correspond to providers.ExpirationPolicies
+const (
+	ExpirationOIDC         = "oidc"
+	ExpirationMaxAge24h    = "max_age_24hours"
+	ExpirationMaxAge48h    = "max_age_48hours"
+	ExpirationMaxAge1Week  = "max_age_1week"
+	ExpirationNeverExpires = "never_expire"
+)
+
+type Config struct {
+	// ClockSkew is how far apart the clocks of the providers, clients,
+	// cosigners and verifiers may be. It is applied to the providers, the
+	// verifier, the cosigner verifiers and the cosigner server, see
+	// clockskew.Policy. If unset each uses its own default.
+	ClockSkew time.Duration    `yaml:"clock_skew"`
+	Providers []ProviderConfig `yaml:"providers"`
+	Verifier  VerifierConfig   `yaml:"verifier"`
+	Cosigners []CosignerConfig `yaml:"cosigners"`
+	Key       KeyConfig        `yaml:"key"`
+	// CosignerServer configures the cosigner run by this deployment, if any
+	CosignerServer *CosignerServerConfig `yaml:"cosigner_server"`
+	// PinnedJwks maps the issuer of a provider or cosigner to its JWKS. If
+	// set, the verifier only uses these keys and never fetches them, so
+	// every provider and cosigner must have an entry. Verifying refreshed
+	// ID Tokens still contacts the provider. See Config.PinJwks.
+	PinnedJwks map[string]string `yaml:"pinned_jwks"`
+	// Allowlist, if set, restricts which hosts the verifier fetches the
+	// providers' configuration and JWKS from, see Config.NewAllowlist
+	Allowlist *AllowlistConfig `yaml:"allowlist"`
+}
+
+// AllowlistConfig lists the hosts and IP ranges, besides the hosts of the
+// providers' issuers, that OP configuration and JWKS may be fetched from,
+// see discover.Allowlist. Many OPs serve their JWKS from another host than
+// the issuer, e.g. Google's is at www.googleapis.com.
+type AllowlistConfig struct {
+	Hosts []string `yaml:"hosts,omitempty"`
+	// IPs are the CIDR ranges the hosts may resolve to, e.g. to keep
+	// verifiers from being pointed at internal addresses
+	IPs []string `yaml:"ips,omitempty"`
+}
+
+// ProviderConfig describes an OpenID provider. Fields not used by the
+// provider type are rejected by Validate. Unset fields take the defaults of
+// the provider's constructor in the providers package.
+type ProviderConfig struct {
+	Type string `yaml:"type,omitempty"`
+	// Name identifies the provider when selecting it in NewClient, defaults
+	// to Type
+	Name     string `yaml:"name,omitempty"`
+	Issuer   string `yaml:"issuer,omitempty"`
+	ClientID string `yaml:"client_id,omitempty"`
+	// AcceptedClientIDs are further client IDs the verifier accepts ID Tokens
+	// for, e.g. those of the other apps of an app family
+	AcceptedClientIDs []string `yaml:"accepted_client_ids,omitempty"`
+	ClientSecret      string   `yaml:"client_secret,omitempty"`
+	Scopes            []string `yaml:"scopes,omitempty"`
+	RedirectURIs      []string `yaml:"redirect_uris,omitempty"`
+	GQSign            bool     `yaml:"gq_sign,omitempty"`
+	// OpenBrowser defaults to true
+	OpenBrowser *bool `yaml:"open_browser,omitempty"`
+	// TenantID is the Azure tenant, see providers.AzureOptions
+	TenantID string `yaml:"tenant_id,omitempty"`
+	// TokenEnvVar is the environment variable the Gitlab ID Token is read from
+	TokenEnvVar string `yaml:"token_env_var,omitempty"`
+}
+
+// VerifierConfig describes the policies the verifier enforces on top of the
+// checks each provider performs.
+type VerifierConfig struct {
+	// Expiration is the name of an expiration policy. If unset, only the
+	// providers' own expiration policies are enforced unless one of MaxAge,
+	// ClockSkew or RequireNotBefore is set, in which case it defaults to oidc.
+	// ClockSkew overrides Config.ClockSkew for the verifier.
+	Expiration       string        `yaml:"expiration,omitempty"`
+	MaxAge           time.Duration `yaml:"max_age,omitempty"`
+	ClockSkew        time.Duration `yaml:"clock_skew,omitempty"`
+	RequireNotBefore bool          `yaml:"require_not_before,omitempty"`
+
+	RequireRefreshedIDToken bool             `yaml:"require_refreshed_id_token,omitempty"`
+	Revocation              RevocationConfig `yaml:"revocation,omitempty"`
+}
+
+// RevocationConfig lists the revocation lists PK Tokens are checked against
+type RevocationConfig struct {
+	Files []string      `yaml:"files,omitempty"`
+	URLs  []string      `yaml:"urls,omitempty"`
+	TTL   time.Duration `yaml:"ttl,omitempty"`
+}
+
+// CosignerConfig describes a cosigner trusted by the verifier. If
+// CallbackPath or DeviceFlow is set, the client also requests cosigner
+// signatures from it. Only one cosigner may set either.
+type CosignerConfig struct {
+	Issuer string `yaml:"issuer,omitempty"`
+	// Strict defaults to true
+	Strict            *bool    `yaml:"strict,omitempty"`
+	AllowedAlgorithms []string `yaml:"allowed_algorithms,omitempty"`
+	CallbackPath      string   `yaml:"callback_path,omitempty"`
+	// DeviceFlow has the client poll the cosigner instead of receiving a
+	// redirect on CallbackPath, see client.CosignerProvider
+	DeviceFlow   bool   `yaml:"device_flow,omitempty"`
+	PktMediaType string `yaml:"pkt_media_type,omitempty"`
+}
+
+// KeyConfig describes where a signing key is stored. If Path is unset a
+// new key is generated every time. If Path is set, the key is read from
+// the PEM file at Path, which is created if it doesn't exist.
+type KeyConfig struct {
+	// Alg defaults to ES256
+	Alg  string `yaml:"alg"`
+	Path string `yaml:"path"`
+}
+
+// CosignerServerConfig describes the cosigner run by this deployment
+type CosignerServerConfig struct {
+	Issuer string    `yaml:"issuer"`
+	KeyID  string    `yaml:"key_id"`
+	Key    KeyConfig `yaml:"key"`
+	// Policy restricts which PK Tokens the cosigner signs, see
+	// cosigner.ClaimsPolicy
+	Policy *CosignPolicyConfig `yaml:"policy"`
+	// Notify sends login, device enrollment and cosigning alerts
+	Notify *NotifyConfig `yaml:"notify"`
+}
+
+// NotifyConfig lists where notification events are sent, see package notify
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	Email    *EmailConfig    `yaml:"email"`
+}
+
+// WebhookConfig sends events as signed JSON POST requests
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// SecretPath is a file holding the HMAC secret requests are signed with
+	SecretPath string `yaml:"secret_path"`
+	// Events limits which events are sent, defaults to all of them
+	Events []string `yaml:"events"`
+}
+
+// EmailConfig sends events as emails through an SMTP server
+type EmailConfig struct {
+	Addr string `yaml:"addr"`
+	From string `yaml:"from"`
+	// Username and PasswordPath, a file holding the password, authenticate
+	// to the SMTP server if set
+	Username     string `yaml:"username"`
+	PasswordPath string `yaml:"password_path"`
+	// To are the addresses, e.g. of the security team, every event is sent to
+	To []string `yaml:"to"`
+	// NotifyUser also emails the user each event is about
+	NotifyUser bool `yaml:"notify_user"`
+	// Events limits which events are sent, defaults to all of them
+	Events []string `yaml:"events"`
+}
+
+// CosignPolicyConfig lists the ID Token claim values the cosigner accepts,
+// unset fields accept anything
+type CosignPolicyConfig struct {
+	Issuers      []string `yaml:"issuers"`
+	Audiences    []string `yaml:"audiences"`
+	EmailDomains []string `yaml:"email_domains"`
+	Groups       []string `yaml:"groups"`
+}
+
+// Load reads and validates the config file at path
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates a config. Unknown fields are an error so that
+// typos don't silently leave a policy unenforced.
+func Parse(data []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var config Config
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("malformed config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks the config for mistakes which can be found without
+// constructing any objects
+func (c *Config) Validate() error {
+	if c.ClockSkew < 0 {
+		return fmt.Errorf("clock_skew must not be negative")
+	}
+
+	names := map[string]bool{}
+	for i, p := range c.Providers {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("provider %d: %w", i, err)
+		}
+		if names[p.name()] {
+			return fmt.Errorf("duplicate provider name: %s", p.name())
+		}
+		names[p.name()] = true
+	}
+
+	if err := c.Verifier.validate(); err != nil {
+		return fmt.Errorf("verifier: %w", err)
+	}
+
+	issuers := map[string]bool{}
+	clientCosigners := 0
+	for i, cos := range c.Cosigners {
+		if cos.Issuer == "" {
+			return fmt.Errorf("cosigner %d: missing issuer", i)
+		}
+		if issuers[cos.Issuer] {
+			return fmt.Errorf("duplicate cosigner issuer: %s", cos.Issuer)
+		}
+		issuers[cos.Issuer] = true
+		for _, alg := range cos.AllowedAlgorithms {
+			if !slices.Contains(cosigner.DefaultCosignerAlgorithms, jwa.SignatureAlgorithm(alg)) {
+				return fmt.Errorf("cosigner %s: unsupported algorithm: %s", cos.Issuer, alg)
+			}
+		}
+		if cos.PktMediaType != "" && cos.PktMediaType != pktoken.MediaTypeJSON && cos.PktMediaType != pktoken.MediaTypeCompact {
+			return fmt.Errorf("cosigner %s: unsupported PK Token media type: %s", cos.Issuer, cos.PktMediaType)
+		}
+		if cos.CallbackPath != "" && cos.DeviceFlow {
+			return fmt.Errorf("cosigner %s: only one of callback_path and device_flow may be set", cos.Issuer)
+		}
+		if cos.CallbackPath != "" || cos.DeviceFlow {
+			clientCosigners++
+		}
+	}
+	if clientCosigners > 1 {
+		return fmt.Errorf("only one cosigner may set callback_path or device_flow, got %d", clientCosigners)
+	}
+
+	if err := validatePinnedJwks(c.PinnedJwks); err != nil {
+		return err
+	}
+	if c.Allowlist != nil {
+		for _, ip := range c.Allowlist.IPs {
+			if _, err := netip.ParsePrefix(ip); err != nil {
+				return fmt.Errorf("allowlist: invalid IP range %q: %w", ip, err)
+			}
+		}
+	}
+
+	if err := c.Key.validate(); err != nil {
+		return fmt.Errorf("key: %w", err)
+	}
+	if c.CosignerServer != nil {
+		if c.CosignerServer.Issuer == "" {
+			return fmt.Errorf("cosigner_server: missing issuer")
+		}
+		if c.CosignerServer.KeyID == "" {
+			return fmt.Errorf("cosigner_server: missing key_id")
+		}
+		if err := c.CosignerServer.Key.validate(); err != nil {
+			return fmt.Errorf("cosigner_server key: %w", err)
+		}
+		if n := c.CosignerServer.Notify; n != nil {
+			if err := n.validate(); err != nil {
+				return fmt.Errorf("cosigner_server notify: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (n *NotifyConfig) validate() error {
+	for i, w := range n.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("webhooks[%d]: invalid url %q", i, w.URL)
+		}
+		if err := validateEvents(w.Events); err != nil {
+			return fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+	}
+	if e := n.Email; e != nil {
+		if e.Addr == "" || e.From == "" {
+			return fmt.Errorf("email: addr and from are required")
+		}
+		if len(e.To) == 0 && !e.NotifyUser {
+			return fmt.Errorf("email: set to or notify_user")
+		}
+		if (e.Username == "") != (e.PasswordPath == "") {
+			return fmt.Errorf("email: username and password_path must be set together")
+		}
+		if err := validateEvents(e.Events); err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateEvents(events []string) error {
+	known := []notify.EventType{notify.EventLogin, notify.EventDeviceEnrolled, notify.EventCosigned}
+	for _, event := range events {
+		if !slices.Contains(known, notify.EventType(event)) {
+			return fmt.Errorf("unknown event %q, expected one of %v", event, known)
+		}
+	}
+	return nil
+}
+
+func (p ProviderConfig) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Type
+}
+
+func (p ProviderConfig) validate() error {
+	// Fields which only some provider types use
+	unsupported := map[string]bool{}
+	switch p.Type {
+	case ProviderGoogle:
+		unsupported["tenant_id"] = p.TenantID != ""
+		unsupported["token_env_var"] = p.TokenEnvVar != ""
+	case ProviderAzure:
+		unsupported["client_secret"] = p.ClientSecret != ""
+		unsupported["token_env_var"] = p.TokenEnvVar != ""
+		if p.TenantID != "" && p.Issuer != "" {
+			return fmt.Errorf("only one of tenant_id and issuer may be set")
+		}
+	case ProviderGitlab, ProviderGithub:
+		unsupported["client_id"] = p.ClientID != ""
+		unsupported["accepted_client_ids"] = len(p.AcceptedClientIDs) > 0
+		unsupported["client_secret"] = p.ClientSecret != ""
+		unsupported["scopes"] = len(p.Scopes) > 0
+		unsupported["redirect_uris"] = len(p.RedirectURIs) > 0
+		unsupported["gq_sign"] = p.GQSign // CI providers always GQ sign
+		unsupported["open_browser"] = p.OpenBrowser != nil
+		unsupported["tenant_id"] = p.TenantID != ""
+		if p.Type == ProviderGithub {
+			unsupported["issuer"] = p.Issuer != ""
+			unsupported["token_env_var"] = p.TokenEnvVar != ""
+		}
+	case "":
+		return fmt.Errorf("missing provider type")
+	default:
+		return fmt.Errorf("unsupported provider type: %s", p.Type)
+	}
+
+	for _, field := range []string{"issuer", "client_id", "accepted_client_ids", "client_secret", "scopes",
+		"redirect_uris", "gq_sign", "open_browser", "tenant_id", "token_env_var"} {
+		if unsupported[field] {
+			return fmt.Errorf("%s is not supported by provider type %s", field, p.Type)
+		}
+	}
+	return nil
+}
+
+func (v VerifierConfig) validate() error {
+	switch v.Expiration {
+	case "", ExpirationOIDC, ExpirationMaxAge24h, ExpirationMaxAge48h, ExpirationMaxAge1Week, ExpirationNeverExpires:
+	default:
+		return fmt.Errorf("unsupported expiration policy: %s", v.Expiration)
+	}
+	if v.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	if v.ClockSkew < 0 {
+		return fmt.Errorf("clock_skew must not be negative")
+	}
+	if v.Revocation.TTL < 0 {
+		return fmt.Errorf("revocation ttl must not be negative")
+	}
+	return nil
+}
+
+// keyAlgs are the algorithms a KeyConfig may use. Keys can only be stored
+// at a Path for the ECDSA algorithms.
+var keyAlgs = []string{"ES256", "ES384", "RS256", "EdDSA"}
+
+func (k KeyConfig) alg() string {
+	if k.Alg == "" {
+		return "ES256"
+	}
+	return k.Alg
+}
+
+func (k KeyConfig) validate() error {
+	if !slices.Contains(keyAlgs, k.alg()) {
+		return fmt.Errorf("unsupported key algorithm: %s", k.alg())
+	}
+	if k.Path != "" && k.alg() != "ES256" && k.alg() != "ES384" {
+		return fmt.Errorf("keys of algorithm %s can't be stored at a path", k.alg())
+	}
+	return nil
+}
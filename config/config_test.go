@@ -0,0 +1,224 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/clockskew"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+const exampleConfig = `
+clock_skew: 2m
+providers:
+  - type: google
+    client_id: my-client-id
+    client_secret: my-client-secret
+    open_browser: false
+  - type: azure
+    tenant_id: my-tenant
+  - type: gitlab
+    name: gitlab-ci
+verifier:
+  expiration: max_age_24hours
+  clock_skew: 1m
+  require_not_before: true
+  revocation:
+    files: [/etc/openpubkey/revoked.json]
+    ttl: 10m
+cosigners:
+  - issuer: https://mfacosigner.example.com
+    allowed_algorithms: [ES256, RS256]
+    callback_path: /mfaredirect
+key:
+  alg: ES384
+cosigner_server:
+  issuer: https://mfacosigner.example.com
+  key_id: kid1234
+  policy:
+    email_domains: [example.com]
+  notify:
+    webhooks:
+      - url: https://siem.example.com/hooks/opk
+        events: [device_enrolled, cosigned]
+    email:
+      addr: smtp.example.com:587
+      from: security@example.com
+      notify_user: true
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse([]byte(exampleConfig))
+	require.NoError(t, err)
+
+	require.Len(t, config.Providers, 3)
+	require.Equal(t, "gitlab-ci", config.Providers[2].name())
+	require.Equal(t, time.Minute, config.Verifier.ClockSkew)
+	require.Equal(t, 10*time.Minute, config.Verifier.Revocation.TTL)
+
+	op, err := config.NewProvider("google")
+	require.NoError(t, err)
+	require.Equal(t, "https://accounts.google.com", op.Issuer())
+	require.False(t, op.(*providers.GoogleOp).OpenBrowser)
+	require.Equal(t, clockskew.New(2*time.Minute), op.(*providers.GoogleOp).ClockSkew)
+
+	op, err = config.NewProvider("azure")
+	require.NoError(t, err)
+	require.Equal(t, "https://login.microsoftonline.com/my-tenant/v2.0", op.Issuer())
+
+	_, err = config.NewProvider("")
+	require.ErrorContains(t, err, "provider name required")
+	_, err = config.NewProvider("okta")
+	require.ErrorContains(t, err, "no provider named okta")
+
+	opkClient, err := config.NewClient("google")
+	require.NoError(t, err)
+	require.Equal(t, "https://accounts.google.com", opkClient.Op.Issuer())
+
+	_, err = config.NewVerifier()
+	require.NoError(t, err)
+
+	ops, err := config.NewProviders()
+	require.NoError(t, err)
+	require.Len(t, ops, 3)
+	require.Equal(t, "https://login.microsoftonline.com/my-tenant/v2.0", ops[1].Issuer())
+
+	cos, err := config.NewAuthCosigner(mocks.NewAuthStateInMemoryStore([]byte("1234567890123456")))
+	require.NoError(t, err)
+	require.Equal(t, "kid1234", cos.KeyID)
+	require.Equal(t, jwa.ES256, cos.Alg)
+	require.Equal(t, clockskew.New(2*time.Minute), cos.ClockSkew)
+	require.Equal(t, cosigner.ClaimsPolicy{EmailDomains: []string{"example.com"}}, cos.Policy)
+	require.NotNil(t, cos.Notifier)
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		expError string
+	}{
+		{name: "unknown field", config: "providers:\n  - type: google\n    clientid: abc\n",
+			expError: "field clientid not found"},
+		{name: "unknown provider type", config: "providers:\n  - type: okta\n",
+			expError: "unsupported provider type: okta"},
+		{name: "missing provider type", config: "providers:\n  - client_id: abc\n",
+			expError: "missing provider type"},
+		{name: "field unsupported by provider", config: "providers:\n  - type: github\n    client_id: abc\n",
+			expError: "client_id is not supported by provider type github"},
+		{name: "duplicate provider", config: "providers:\n  - type: google\n  - type: google\n",
+			expError: "duplicate provider name: google"},
+		{name: "negative clock skew", config: "clock_skew: -1m\n",
+			expError: "clock_skew must not be negative"},
+		{name: "unknown expiration policy", config: "verifier:\n  expiration: forever\n",
+			expError: "unsupported expiration policy: forever"},
+		{name: "two client cosigners", config: "cosigners:\n  - issuer: a\n    callback_path: /a\n  - issuer: b\n    callback_path: /b\n",
+			expError: "only one cosigner may set callback_path"},
+		{name: "callback path and device flow", config: "cosigners:\n  - issuer: a\n    callback_path: /a\n    device_flow: true\n",
+			expError: "only one of callback_path and device_flow may be set"},
+		{name: "unknown cosigner algorithm", config: "cosigners:\n  - issuer: a\n    allowed_algorithms: [HS256]\n",
+			expError: "unsupported algorithm: HS256"},
+		{name: "stored RSA key", config: "key:\n  alg: RS256\n  path: /tmp/key.pem\n",
+			expError: "keys of algorithm RS256 can't be stored at a path"},
+		{name: "cosigner server missing key id", config: "cosigner_server:\n  issuer: a\n",
+			expError: "cosigner_server: missing key_id"},
+		{name: "notify unknown event", config: "cosigner_server:\n  issuer: a\n  key_id: b\n  notify:\n    webhooks:\n      - url: https://a.example.com\n        events: [logout]\n",
+			expError: `cosigner_server notify: webhooks[0]: unknown event "logout"`},
+		{name: "notify webhook url", config: "cosigner_server:\n  issuer: a\n  key_id: b\n  notify:\n    webhooks:\n      - url: a.example.com\n",
+			expError: `webhooks[0]: invalid url "a.example.com"`},
+		{name: "notify email without recipients", config: "cosigner_server:\n  issuer: a\n  key_id: b\n  notify:\n    email:\n      addr: smtp.example.com:25\n      from: a@example.com\n",
+			expError: "email: set to or notify_user"},
+		{name: "allowlist invalid IP range", config: "allowlist:\n  ips: [10.0.0.1]\n",
+			expError: `allowlist: invalid IP range "10.0.0.1"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.config))
+			require.ErrorContains(t, err, tc.expError)
+		})
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	cfg, err := Parse([]byte(exampleConfig))
+	require.NoError(t, err)
+	allowlist, err := cfg.NewAllowlist()
+	require.NoError(t, err)
+	require.Nil(t, allowlist)
+
+	cfg, err = Parse([]byte("providers:\n  - type: google\nallowlist:\n  hosts: [www.googleapis.com]\n  ips: [203.0.113.0/24]\n"))
+	require.NoError(t, err)
+	allowlist, err = cfg.NewAllowlist()
+	require.NoError(t, err)
+	require.Equal(t, []string{"accounts.google.com", "www.googleapis.com"}, allowlist.Hosts)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}, allowlist.IPs)
+
+	_, err = allowlist.HTTPClient().Get("https://evil.example.com/.well-known/openid-configuration")
+	require.ErrorIs(t, err, discover.ErrNotAllowed)
+	_, err = cfg.NewVerifier()
+	require.NoError(t, err)
+}
+
+func TestKeyStorage(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "keys", "signing.pem")
+	keyConfig := KeyConfig{Alg: "ES384", Path: keyPath}
+
+	signer, alg, err := keyConfig.Signer()
+	require.NoError(t, err)
+	require.Equal(t, jwa.ES384, alg)
+
+	info, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The stored key is reused
+	reloaded, _, err := keyConfig.Signer()
+	require.NoError(t, err)
+	require.True(t, signer.(*ecdsa.PrivateKey).Equal(reloaded))
+
+	// A stored key of another algorithm is rejected
+	_, _, err = KeyConfig{Alg: "ES256", Path: keyPath}.Signer()
+	require.ErrorContains(t, err, "is not a ES256 key")
+
+	require.NoError(t, os.WriteFile(keyPath, []byte("not a key"), 0600))
+	_, _, err = keyConfig.Signer()
+	require.Error(t, err)
+}
+
+func TestVerifierExpirationPolicy(t *testing.T) {
+	_, ok := VerifierConfig{}.expirationPolicy()
+	require.False(t, ok)
+
+	policy, ok := VerifierConfig{ClockSkew: time.Minute}.expirationPolicy()
+	require.True(t, ok)
+	require.Equal(t, providers.ExpirationPolicies.OIDC.WithClockSkew(time.Minute), policy)
+
+	policy, ok = VerifierConfig{Expiration: ExpirationNeverExpires, MaxAge: time.Hour}.expirationPolicy()
+	require.True(t, ok)
+	require.Equal(t, providers.ExpirationPolicies.NEVER_EXPIRE.WithMaxAge(time.Hour), policy)
+}
@@ -0,0 +1,247 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"gopkg.in/yaml.v3"
+)
+
+// TrustTyp is the typ of a signed trust document
+const TrustTyp = "OPK-TRUST"
+
+// TrustConfig is the part of a Config which decides which PK Tokens a
+// verifier accepts: the providers and their client IDs, the verifier
+// policies, the required cosigners and any pinned JWKS. Client-side
+// settings such as client secrets, redirect URIs and keys are not part of
+// it.
+type TrustConfig struct {
+	ClockSkew time.Duration    `yaml:"clock_skew,omitempty"`
+	Providers []ProviderConfig `yaml:"providers"`
+	Verifier  VerifierConfig   `yaml:"verifier"`
+	Cosigners []CosignerConfig `yaml:"cosigners,omitempty"`
+	// PinnedJwks maps an issuer to its JWKS, see Config.PinnedJwks
+	PinnedJwks map[string]string `yaml:"pinned_jwks,omitempty"`
+}
+
+// TrustDocument is a versioned TrustConfig as distributed to verifiers. It
+// is only valid until Expiration. Importers should reject documents whose
+// Version is not greater than the version they last imported, so that an
+// old document can't be replayed to roll back their trust configuration.
+type TrustDocument struct {
+	Version    uint64      `yaml:"version"`
+	IssuedAt   time.Time   `yaml:"issued_at"`
+	Expiration time.Time   `yaml:"expiration"`
+	Trust      TrustConfig `yaml:"trust"`
+}
+
+// Trust returns the trust configuration of the config
+func (c *Config) Trust() TrustConfig {
+	trust := TrustConfig{
+		ClockSkew:  c.ClockSkew,
+		Verifier:   c.Verifier,
+		PinnedJwks: c.PinnedJwks,
+	}
+	for _, p := range c.Providers {
+		trust.Providers = append(trust.Providers, ProviderConfig{
+			Type:     p.Type,
+			Name:     p.Name,
+			Issuer:   p.Issuer,
+			ClientID: p.ClientID,
+			TenantID: p.TenantID,
+		})
+	}
+	for _, cos := range c.Cosigners {
+		trust.Cosigners = append(trust.Cosigners, CosignerConfig{
+			Issuer:            cos.Issuer,
+			Strict:            cos.Strict,
+			AllowedAlgorithms: cos.AllowedAlgorithms,
+		})
+	}
+	return trust
+}
+
+// Config returns a Config with the trust configuration, from which a
+// verifier can be constructed with NewVerifier
+func (t TrustConfig) Config() *Config {
+	return &Config{
+		ClockSkew:  t.ClockSkew,
+		Providers:  t.Providers,
+		Verifier:   t.Verifier,
+		Cosigners:  t.Cosigners,
+		PinnedJwks: t.PinnedJwks,
+	}
+}
+
+// PinJwks fetches the JWKS of every provider and cosigner using finder, or
+// discover.DefaultPubkeyFinder if nil, and pins them in PinnedJwks
+func (c *Config) PinJwks(ctx context.Context, finder *discover.PublicKeyFinder) error {
+	if finder == nil {
+		finder = discover.DefaultPubkeyFinder()
+	}
+	issuers := []string{}
+	for _, p := range c.Providers {
+		op, err := p.newProvider(false, nil)
+		if err != nil {
+			return fmt.Errorf("provider %s: %w", p.name(), err)
+		}
+		issuers = append(issuers, op.Issuer())
+	}
+	for _, cos := range c.Cosigners {
+		issuers = append(issuers, cos.Issuer)
+	}
+
+	pinned := map[string]string{}
+	for _, issuer := range issuers {
+		jwks, err := finder.JwksFunc(ctx, issuer)
+		if err != nil {
+			return fmt.Errorf("failed to fetch JWKS of issuer (%s): %w", issuer, err)
+		}
+		pinned[issuer] = string(jwks)
+	}
+	c.PinnedJwks = pinned
+	return nil
+}
+
+// ExportTrust signs the trust configuration of the config into a trust
+// document valid for validity from now. Verifiers importing it with
+// ParseTrust only need to trust the exporter's public key.
+func (c *Config) ExportTrust(version uint64, validity time.Duration, signer crypto.Signer, alg jwa.SignatureAlgorithm) ([]byte, error) {
+	trust := c.Trust()
+	if err := trust.Config().Validate(); err != nil {
+		return nil, err
+	}
+	if len(trust.Providers) == 0 {
+		return nil, fmt.Errorf("trust document requires at least one provider")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	doc := TrustDocument{
+		Version:    version,
+		IssuedAt:   now,
+		Expiration: now.Add(validity),
+		Trust:      trust,
+	}
+	payload, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, TrustTyp); err != nil {
+		return nil, err
+	}
+	return jws.Sign(payload, jws.WithKey(alg, signer, jws.WithProtectedHeaders(headers)))
+}
+
+// ParseTrust verifies that the trust document was signed by the exporter's
+// public key, that it hasn't expired and that its trust configuration is
+// valid.
+func ParseTrust(signedDoc []byte, exporterKey crypto.PublicKey, alg jwa.SignatureAlgorithm) (*TrustDocument, error) {
+	msg, err := jws.Parse(signedDoc)
+	if err != nil {
+		return nil, fmt.Errorf("malformed trust document: %w", err)
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, fmt.Errorf("trust document must have exactly one signature, got %d", len(msg.Signatures()))
+	}
+	if typ := msg.Signatures()[0].ProtectedHeaders().Type(); typ != TrustTyp {
+		return nil, fmt.Errorf("expected typ (%s) for trust document, got (%s)", TrustTyp, typ)
+	}
+	payload, err := jws.Verify(signedDoc, jws.WithKey(alg, exporterKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify trust document signature: %w", err)
+	}
+
+	var doc TrustDocument
+	if err := yaml.Unmarshal(payload, &doc); err != nil {
+		return nil, fmt.Errorf("malformed trust document: %w", err)
+	}
+	if !time.Now().Before(doc.Expiration) {
+		return nil, fmt.Errorf("trust document has expired (exp = %v)", doc.Expiration)
+	}
+	if err := doc.Trust.Config().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid trust document: %w", err)
+	}
+	return &doc, nil
+}
+
+// pinnedFinder returns a PublicKeyFinder which looks up keys only in
+// PinnedJwks and never makes network requests
+func (c *Config) pinnedFinder() *discover.PublicKeyFinder {
+	return &discover.PublicKeyFinder{
+		JwksFunc: func(_ context.Context, issuer string) ([]byte, error) {
+			jwks, ok := c.PinnedJwks[issuer]
+			if !ok {
+				return nil, fmt.Errorf("no pinned JWKS for issuer (%s)", issuer)
+			}
+			return []byte(jwks), nil
+		},
+	}
+}
+
+// pinnedProviderVerifier verifies ID Tokens from op the same way op does,
+// but with the pinned keys of finder
+func pinnedProviderVerifier(op providers.OpenIdProvider, finder *discover.PublicKeyFinder) (verifier.ProviderVerifier, error) {
+	switch op := op.(type) {
+	case *providers.StandardOp:
+		expirationPolicy := providers.ExpirationPolicies.MAX_AGE_24HOURS.WithClockSkewPolicy(op.ClockSkew)
+		return providers.NewProviderVerifier(op.Issuer(), providers.ProviderVerifierOpts{
+			CommitType:        op.CommitType(),
+			ClientID:          op.ClientID(),
+			AcceptedClientIDs: op.AcceptedClientIDs,
+			DiscoverPublicKey: finder,
+			ExpirationPolicy:  &expirationPolicy,
+		}), nil
+	case *providers.GitlabOp:
+		return providers.NewProviderVerifier(op.Issuer(), providers.ProviderVerifierOpts{
+			CommitType:        op.CommitType(),
+			GQOnly:            true,
+			SkipClientIDCheck: true,
+			DiscoverPublicKey: finder,
+			ExpirationPolicy:  &providers.ExpirationPolicies.OIDC,
+		}), nil
+	case *providers.GithubOp:
+		return providers.NewProviderVerifier(op.Issuer(), providers.ProviderVerifierOpts{
+			CommitType:        op.CommitType(),
+			GQOnly:            true,
+			SkipClientIDCheck: true,
+			DiscoverPublicKey: finder,
+			ExpirationPolicy:  &providers.ExpirationPolicies.OIDC,
+		}), nil
+	default:
+		return nil, fmt.Errorf("pinned keys are not supported for provider %T", op)
+	}
+}
+
+func validatePinnedJwks(pinned map[string]string) error {
+	for issuer, jwks := range pinned {
+		if _, err := jwk.Parse([]byte(jwks)); err != nil {
+			return fmt.Errorf("malformed pinned JWKS of issuer (%s): %w", issuer, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTrust(t *testing.T) {
+	config, err := Parse([]byte(exampleConfig))
+	require.NoError(t, err)
+	exporterKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	signedDoc, err := config.ExportTrust(7, time.Hour, exporterKey, jwa.ES256)
+	require.NoError(t, err)
+	require.NotContains(t, string(signedDoc), "my-client-secret")
+
+	doc, err := ParseTrust(signedDoc, exporterKey.Public(), jwa.ES256)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), doc.Version)
+	require.Equal(t, config.Trust(), doc.Trust)
+	require.Empty(t, doc.Trust.Providers[0].ClientSecret)
+	require.Empty(t, doc.Trust.Cosigners[0].CallbackPath)
+	require.Equal(t, "my-client-id", doc.Trust.Providers[0].ClientID)
+
+	_, err = doc.Trust.Config().NewVerifier()
+	require.NoError(t, err)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = ParseTrust(signedDoc, otherKey.Public(), jwa.ES256)
+	require.ErrorContains(t, err, "failed to verify trust document signature")
+
+	expiredDoc, err := config.ExportTrust(8, -time.Minute, exporterKey, jwa.ES256)
+	require.NoError(t, err)
+	_, err = ParseTrust(expiredDoc, exporterKey.Public(), jwa.ES256)
+	require.ErrorContains(t, err, "trust document has expired")
+
+	_, err = (&Config{}).ExportTrust(1, time.Hour, exporterKey, jwa.ES256)
+	require.ErrorContains(t, err, "requires at least one provider")
+}
+
+func TestPinnedJwks(t *testing.T) {
+	config, err := Parse([]byte(exampleConfig))
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pub, err := jwk.FromRaw(key.Public())
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(pub))
+	jwks, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	fetched := []string{}
+	finder := &discover.PublicKeyFinder{
+		JwksFunc: func(_ context.Context, issuer string) ([]byte, error) {
+			fetched = append(fetched, issuer)
+			return jwks, nil
+		},
+	}
+	require.NoError(t, config.PinJwks(context.Background(), finder))
+	require.Equal(t, []string{
+		"https://accounts.google.com",
+		"https://login.microsoftonline.com/my-tenant/v2.0",
+		"https://gitlab.com",
+		"https://mfacosigner.example.com",
+	}, fetched)
+
+	// Pinned keys survive export and import
+	exporterKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signedDoc, err := config.ExportTrust(1, time.Hour, exporterKey, jwa.ES256)
+	require.NoError(t, err)
+	doc, err := ParseTrust(signedDoc, exporterKey.Public(), jwa.ES256)
+	require.NoError(t, err)
+	require.Equal(t, config.PinnedJwks, doc.Trust.PinnedJwks)
+
+	imported := doc.Trust.Config()
+	_, err = imported.NewVerifier()
+	require.NoError(t, err)
+
+	delete(imported.PinnedJwks, "https://mfacosigner.example.com")
+	_, err = imported.NewVerifier()
+	require.ErrorContains(t, err, "cosigner https://mfacosigner.example.com: no pinned JWKS")
+
+	delete(imported.PinnedJwks, "https://gitlab.com")
+	_, err = imported.NewVerifier()
+	require.ErrorContains(t, err, "provider gitlab-ci: no pinned JWKS")
+
+	imported.PinnedJwks["https://gitlab.com"] = "not a jwks"
+	require.ErrorContains(t, imported.Validate(), "malformed pinned JWKS of issuer (https://gitlab.com)")
+}
@@ -17,6 +17,7 @@
 package cosigner
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	"fmt"
@@ -24,15 +25,36 @@ import (
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/notify"
 	"github.com/openpubkey/openpubkey/pktoken"
 )
 
+// initAuthMaxAge is how long after the client signs an InitMFAAuth message
+// the cosigner accepts it
+const initAuthMaxAge = 2 * time.Minute
+
 type AuthCosigner struct {
 	Cosigner
 	Issuer         string
 	KeyID          string
 	AuthStateStore AuthStateStore
+	// SessionStore records cosigned sessions so they can be listed and
+	// revoked. If nil, sessions are not recorded.
+	SessionStore SessionStore
+	// ClockSkew is how far apart the client's clock and the cosigner's may
+	// be when checking when an InitMFAAuth message was signed
+	ClockSkew clockskew.Policy
+	// Keyring, if set, holds the keys signatures are made with in place of
+	// Signer, Alg and KeyID, so that they can be rotated
+	Keyring *Keyring
+	// Policy, if set, is checked before every PK Token is cosigned. If nil,
+	// every PK Token whose user completes MFA is cosigned.
+	Policy CosignPolicy
+	// Notifier, if set, is sent an event when a user logs in by completing
+	// MFA, enrolls an MFA device or has a PK Token cosigned
+	Notifier notify.Notifier
 }
 
 func New(signer crypto.Signer, alg jwa.SignatureAlgorithm, issuer, keyID string, store AuthStateStore) (*AuthCosigner, error) {
@@ -43,6 +65,7 @@ func New(signer crypto.Signer, alg jwa.SignatureAlgorithm, issuer, keyID string,
 		Issuer:         issuer,
 		KeyID:          keyID,
 		AuthStateStore: store,
+		ClockSkew:      clockskew.Default,
 	}, nil
 }
 
@@ -56,9 +79,9 @@ func (c *AuthCosigner) InitAuth(pkt *pktoken.PKToken, sig []byte) (string, error
 		return "", fmt.Errorf("failed to parse InitMFAAuth message: %w", err)
 	} else if initMFAAuth.Issuer != c.Issuer {
 		return "", fmt.Errorf("signed message is for wrong cosigner, got issuer=(%s), expected issuer=(%s)", initMFAAuth.Issuer, c.Issuer)
-	} else if time.Since(time.Unix(initMFAAuth.TimeSigned, 0)).Minutes() > 2 {
+	} else if c.ClockSkew.Expired(time.Unix(initMFAAuth.TimeSigned, 0).Add(initAuthMaxAge), time.Now()) {
 		return "", fmt.Errorf("timestamp (%d) in InitMFAAuth message too old, current time is (%d)", initMFAAuth.TimeSigned, time.Now().Unix())
-	} else if time.Until(time.Unix(initMFAAuth.TimeSigned, 0)).Minutes() > 2 {
+	} else if c.ClockSkew.NotYetValid(time.Unix(initMFAAuth.TimeSigned, 0), time.Now()) {
 		return "", fmt.Errorf("timestamp (%d) in InitMFAAuth message too far in the future, current time is (%d)", initMFAAuth.TimeSigned, time.Now().Unix())
 	} else if authID, err := c.AuthStateStore.CreateNewAuthSession(pkt, initMFAAuth.RedirectUri, initMFAAuth.Nonce); err != nil {
 		return "", err
@@ -68,7 +91,26 @@ func (c *AuthCosigner) InitAuth(pkt *pktoken.PKToken, sig []byte) (string, error
 }
 
 func (c *AuthCosigner) NewAuthcode(authID string) (string, error) {
-	return c.AuthStateStore.CreateAuthcode(authID)
+	authcode, err := c.AuthStateStore.CreateAuthcode(authID)
+	if err != nil {
+		return "", err
+	}
+	if authState, ok := c.AuthStateStore.LookupAuthState(authID); ok {
+		c.Notify(notify.EventLogin, authState, "")
+	}
+	return authcode, nil
+}
+
+// Notify sends an event of type typ about the user of authState to the
+// Notifier, if set. MFA cosigners call it when a user enrolls a device.
+func (c *AuthCosigner) Notify(typ notify.EventType, authState *AuthState, device string) {
+	if c.Notifier == nil {
+		return
+	}
+	event := notify.NewEvent(typ, authState.Pkt)
+	event.Source = c.Issuer
+	event.Device = device
+	notify.Send(context.Background(), c.Notifier, event)
 }
 
 func (c *AuthCosigner) RedeemAuthcode(sig []byte) ([]byte, error) {
@@ -91,21 +133,54 @@ func (c *AuthCosigner) RedeemAuthcode(sig []byte) ([]byte, error) {
 	}
 }
 
+// SigningKey returns the key signatures are made with
+func (c *AuthCosigner) SigningKey() SigningKey {
+	if c.Keyring != nil {
+		return c.Keyring.Current()
+	}
+	return SigningKey{
+		KeyID:  c.KeyID,
+		Alg:    jwa.SignatureAlgorithm(c.Alg.String()),
+		Signer: c.Signer,
+	}
+}
+
 func (c *AuthCosigner) IssueSignature(pkt *pktoken.PKToken, authState AuthState, authID string) ([]byte, error) {
+	if c.Policy != nil {
+		if err := c.Policy.CheckCosign(pkt, authState); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCosignDenied, err)
+		}
+	}
 
+	key := c.SigningKey()
 	protected := pktoken.CosignerClaims{
 		Issuer:      c.Issuer,
-		KeyID:       c.KeyID,
-		Algorithm:   c.Alg.String(),
+		KeyID:       key.KeyID,
+		Algorithm:   key.Alg.String(),
 		AuthID:      authID,
 		AuthTime:    time.Now().Unix(),
 		IssuedAt:    time.Now().Unix(),
-		Expiration:  time.Now().Add(time.Hour).Unix(),
+		Expiration:  time.Now().Add(SignatureLifetime).Unix(),
 		RedirectURI: authState.RedirectURI,
 		Nonce:       authState.Nonce,
 		Typ:         string(pktoken.COS),
 	}
 
 	// Now that our mfa has authenticated the user, we can add our signature
-	return c.Cosign(pkt, protected)
+	cosToken, err := cosign(pkt, key.Signer, key.Alg, protected)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SessionStore != nil {
+		session, err := newSession(pkt, authState, protected)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.SessionStore.AddSession(*session); err != nil {
+			return nil, fmt.Errorf("failed to record session: %w", err)
+		}
+	}
+	c.Notify(notify.EventCosigned, &authState, "")
+	return cosToken, nil
 }
@@ -17,6 +17,7 @@
 package cosigner_test
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"github.com/openpubkey/openpubkey/client"
 	"github.com/openpubkey/openpubkey/cosigner"
 	cosmock "github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/notify"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/pktoken/mocks"
 	"github.com/openpubkey/openpubkey/util"
@@ -210,3 +212,59 @@ func CreateAuthCosigner(t *testing.T) *cosigner.AuthCosigner {
 	require.NoError(t, err, "failed to create auth cosigner")
 	return authCosigner
 }
+
+func TestNotifier(t *testing.T) {
+	cos := CreateAuthCosigner(t)
+	var events []notify.Event
+	cos.Notifier = notify.NotifierFunc(func(ctx context.Context, event notify.Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err, "failed to generate key pair")
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err, "failed to generate mock PK Token")
+
+	cosP := client.CosignerProvider{
+		Issuer:       "https://example.com",
+		CallbackPath: "/mfaredirect",
+	}
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig("http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+	require.Empty(t, events, "starting auth isn't a login")
+
+	authcode, err := cos.NewAuthcode(authID)
+	require.NoError(t, err)
+	acSig, err := pkt.NewSignedMessage([]byte(authcode), signer)
+	require.NoError(t, err)
+	_, err = cos.RedeemAuthcode(acSig)
+	require.NoError(t, err)
+
+	require.Len(t, events, 2)
+	require.Equal(t, notify.EventLogin, events[0].Type)
+	require.Equal(t, notify.EventCosigned, events[1].Type)
+	for _, event := range events {
+		require.Equal(t, "https://example.com", event.Source)
+		require.Equal(t, "mockIssuer", event.Issuer)
+		require.NotEmpty(t, event.Subject)
+	}
+
+	// Notification failures don't fail cosigning
+	cos.Notifier = notify.NotifierFunc(func(ctx context.Context, event notify.Event) error {
+		return fmt.Errorf("webhook down")
+	})
+	authID, err = cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+	authcode, err = cos.NewAuthcode(authID)
+	require.NoError(t, err)
+	acSig, err = pkt.NewSignedMessage([]byte(authcode), signer)
+	require.NoError(t, err)
+	_, err = cos.RedeemAuthcode(acSig)
+	require.NoError(t, err)
+}
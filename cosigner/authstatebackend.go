@@ -0,0 +1,287 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// ErrAuthStateNotFound is returned by an AuthStateBackend when a key does
+// not exist or has expired
+var ErrAuthStateNotFound = errors.New("auth state not found")
+
+// DefaultAuthStateTTL is how long an auth session lives in a
+// BackendAuthStateStore when no TTL is given
+const DefaultAuthStateTTL = 10 * time.Minute
+
+// redeemedAuthStateTTL bounds how long an auth session is kept after its
+// authcode is redeemed, as it can no longer be used to get a signature
+const redeemedAuthStateTTL = time.Minute
+
+// AuthStateBackend is the key-value storage used by BackendAuthStateStore.
+// Implementations backed by a shared database, such as those in the
+// cosigner/authstore package, let several cosigner replicas serve the same
+// auth sessions and keep them across restarts.
+type AuthStateBackend interface {
+	// Get returns the value stored under key or ErrAuthStateNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores value under key, replacing any existing value, and expires
+	// it after ttl
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key and reports whether it existed. Delete must be
+	// atomic, if called concurrently for the same key only one caller may
+	// see true. This is what ensures an authcode is only issued and
+	// redeemed once.
+	Delete(ctx context.Context, key string) (bool, error)
+	// Expire sets the time to live of an existing key to ttl
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// BackendAuthStateStore is an AuthStateStore which keeps auth sessions and
+// authcodes in an AuthStateBackend.
+type BackendAuthStateStore struct {
+	Backend AuthStateBackend
+	TTL     time.Duration
+}
+
+var _ AuthStateStore = (*BackendAuthStateStore)(nil)
+
+// NewBackendAuthStateStore returns a store whose auth sessions and
+// authcodes expire after ttl, if ttl is zero DefaultAuthStateTTL is used.
+func NewBackendAuthStateStore(backend AuthStateBackend, ttl time.Duration) *BackendAuthStateStore {
+	if ttl <= 0 {
+		ttl = DefaultAuthStateTTL
+	}
+	return &BackendAuthStateStore{
+		Backend: backend,
+		TTL:     ttl,
+	}
+}
+
+// storedAuthState is the serialized form of an AuthState. The expiration is
+// kept alongside so updates don't extend the session's lifetime.
+type storedAuthState struct {
+	Pkt              json.RawMessage `json:"pkt"`
+	Issuer           string          `json:"iss"`
+	Aud              string          `json:"aud"`
+	Sub              string          `json:"sub"`
+	Username         string          `json:"username"`
+	DisplayName      string          `json:"display_name"`
+	RedirectURI      string          `json:"ruri"`
+	Nonce            string          `json:"nonce"`
+	AuthcodeIssued   bool            `json:"authcode_issued"`
+	AuthcodeRedeemed bool            `json:"authcode_redeemed"`
+	Expiration       int64           `json:"exp"`
+}
+
+func authStateKey(authID string) string {
+	return "authstate:" + authID
+}
+
+// issuableKey exists until an authcode is issued for the auth session
+func issuableKey(authID string) string {
+	return "issuable:" + authID
+}
+
+func authcodeKey(authcode string) string {
+	return "authcode:" + authcode
+}
+
+func randomHex() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *BackendAuthStateStore) CreateNewAuthSession(pkt *pktoken.PKToken, ruri string, nonce string) (string, error) {
+	authState, err := NewAuthState(pkt, ruri, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	// Auth IDs are random rather than issued by an AuthIDIssuer as the
+	// issuer's counter is not shared between replicas
+	authID, err := randomHex()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	expiration := time.Now().Add(s.TTL)
+	if err := s.put(ctx, authID, *authState, expiration); err != nil {
+		return "", err
+	}
+	if err := s.Backend.Put(ctx, issuableKey(authID), []byte(authID), s.TTL); err != nil {
+		return "", fmt.Errorf("failed to store auth session: %w", err)
+	}
+	return authID, nil
+}
+
+func (s *BackendAuthStateStore) LookupAuthState(authID string) (*AuthState, bool) {
+	authState, _, err := s.get(context.Background(), authID)
+	if err != nil {
+		return nil, false
+	}
+	return authState, true
+}
+
+func (s *BackendAuthStateStore) UpdateAuthState(authID string, authState AuthState) error {
+	ctx := context.Background()
+	_, expiration, err := s.get(ctx, authID)
+	if errors.Is(err, ErrAuthStateNotFound) {
+		return fmt.Errorf("failed to upload auth session because authID specified matches no session")
+	} else if err != nil {
+		return err
+	}
+	return s.put(ctx, authID, authState, expiration)
+}
+
+func (s *BackendAuthStateStore) CreateAuthcode(authID string) (string, error) {
+	ctx := context.Background()
+	authState, expiration, err := s.get(ctx, authID)
+	if errors.Is(err, ErrAuthStateNotFound) {
+		return "", fmt.Errorf("no such authID")
+	} else if err != nil {
+		return "", err
+	}
+
+	// Only one replica can delete the issuable key, so only one authcode is
+	// issued per auth session
+	if issuable, err := s.Backend.Delete(ctx, issuableKey(authID)); err != nil {
+		return "", fmt.Errorf("failed to issue authcode: %w", err)
+	} else if !issuable {
+		return "", fmt.Errorf("authcode already issued for this authID")
+	}
+
+	authcode, err := randomHex()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Backend.Put(ctx, authcodeKey(authcode), []byte(authID), time.Until(expiration)); err != nil {
+		return "", fmt.Errorf("failed to issue authcode: %w", err)
+	}
+	authState.AuthcodeIssued = true
+	if err := s.put(ctx, authID, *authState, expiration); err != nil {
+		return "", err
+	}
+	return authcode, nil
+}
+
+func (s *BackendAuthStateStore) RedeemAuthcode(authcode string) (AuthState, string, error) {
+	ctx := context.Background()
+	authID, err := s.Backend.Get(ctx, authcodeKey(authcode))
+	if errors.Is(err, ErrAuthStateNotFound) {
+		return AuthState{}, "", fmt.Errorf("invalid authcode")
+	} else if err != nil {
+		return AuthState{}, "", err
+	}
+
+	// As with issuing, only one replica can delete the authcode so it can
+	// only be redeemed once
+	if redeemable, err := s.Backend.Delete(ctx, authcodeKey(authcode)); err != nil {
+		return AuthState{}, "", fmt.Errorf("failed to redeem authcode: %w", err)
+	} else if !redeemable {
+		return AuthState{}, "", fmt.Errorf("authcode has already been redeemed")
+	}
+
+	authState, expiration, err := s.get(ctx, string(authID))
+	if err != nil {
+		return AuthState{}, "", fmt.Errorf("failed to find auth session for authcode: %w", err)
+	}
+	if !authState.AuthcodeIssued {
+		// This should never happen
+		return AuthState{}, "", fmt.Errorf("no authcode issued for this authID")
+	}
+	authState.AuthcodeRedeemed = true
+	if err := s.put(ctx, string(authID), *authState, expiration); err != nil {
+		return AuthState{}, "", err
+	}
+	if time.Until(expiration) > redeemedAuthStateTTL {
+		if err := s.Backend.Expire(ctx, authStateKey(string(authID)), redeemedAuthStateTTL); err != nil {
+			return AuthState{}, "", fmt.Errorf("failed to expire auth session: %w", err)
+		}
+	}
+	return *authState, string(authID), nil
+}
+
+func (s *BackendAuthStateStore) get(ctx context.Context, authID string) (*AuthState, time.Time, error) {
+	value, err := s.Backend.Get(ctx, authStateKey(authID))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var stored storedAuthState
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to unmarshal auth session: %w", err)
+	}
+	pkt := &pktoken.PKToken{}
+	if err := json.Unmarshal(stored.Pkt, pkt); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to unmarshal PK Token in auth session: %w", err)
+	}
+	return &AuthState{
+		Pkt:              pkt,
+		Issuer:           stored.Issuer,
+		Aud:              stored.Aud,
+		Sub:              stored.Sub,
+		Username:         stored.Username,
+		DisplayName:      stored.DisplayName,
+		RedirectURI:      stored.RedirectURI,
+		Nonce:            stored.Nonce,
+		AuthcodeIssued:   stored.AuthcodeIssued,
+		AuthcodeRedeemed: stored.AuthcodeRedeemed,
+	}, time.UnixMilli(stored.Expiration), nil
+}
+
+func (s *BackendAuthStateStore) put(ctx context.Context, authID string, authState AuthState, expiration time.Time) error {
+	ttl := time.Until(expiration)
+	if ttl <= 0 {
+		return fmt.Errorf("auth session has expired")
+	}
+	pktJson, err := json.Marshal(authState.Pkt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal PK Token in auth session: %w", err)
+	}
+	value, err := json.Marshal(storedAuthState{
+		Pkt:              pktJson,
+		Issuer:           authState.Issuer,
+		Aud:              authState.Aud,
+		Sub:              authState.Sub,
+		Username:         authState.Username,
+		DisplayName:      authState.DisplayName,
+		RedirectURI:      authState.RedirectURI,
+		Nonce:            authState.Nonce,
+		AuthcodeIssued:   authState.AuthcodeIssued,
+		AuthcodeRedeemed: authState.AuthcodeRedeemed,
+		Expiration:       expiration.UnixMilli(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal auth session: %w", err)
+	}
+	if err := s.Backend.Put(ctx, authStateKey(authID), value, ttl); err != nil {
+		return fmt.Errorf("failed to store auth session: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner_test
+
+import (
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/authstore"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendAuthStateStore(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	// Two stores sharing a backend act like two replicas of a cosigner
+	backend := authstore.NewMemoryBackend()
+	replica1 := cosigner.NewBackendAuthStateStore(backend, 0)
+	replica2 := cosigner.NewBackendAuthStateStore(backend, 0)
+	require.Equal(t, cosigner.DefaultAuthStateTTL, replica1.TTL)
+
+	authID, err := replica1.CreateNewAuthSession(pkt, "http://localhost:5555/mfaredirect", "nonce")
+	require.NoError(t, err)
+
+	authState, ok := replica2.LookupAuthState(authID)
+	require.True(t, ok)
+	require.Equal(t, "http://localhost:5555/mfaredirect", authState.RedirectURI)
+	require.Equal(t, "nonce", authState.Nonce)
+	wantHash, err := pkt.Hash()
+	require.NoError(t, err)
+	gotHash, err := authState.Pkt.Hash()
+	require.NoError(t, err)
+	require.Equal(t, wantHash, gotHash)
+	require.False(t, authState.AuthcodeIssued)
+
+	authState.DisplayName = "updated"
+	require.NoError(t, replica2.UpdateAuthState(authID, *authState))
+	authState, ok = replica1.LookupAuthState(authID)
+	require.True(t, ok)
+	require.Equal(t, "updated", authState.DisplayName)
+
+	err = replica1.UpdateAuthState("unknown", *authState)
+	require.ErrorContains(t, err, "matches no session")
+	_, ok = replica1.LookupAuthState("unknown")
+	require.False(t, ok)
+
+	authcode, err := replica1.CreateAuthcode(authID)
+	require.NoError(t, err)
+	_, err = replica2.CreateAuthcode(authID)
+	require.ErrorContains(t, err, "authcode already issued for this authID")
+	_, err = replica2.CreateAuthcode("unknown")
+	require.ErrorContains(t, err, "no such authID")
+
+	_, _, err = replica1.RedeemAuthcode("invalid")
+	require.ErrorContains(t, err, "invalid authcode")
+
+	redeemed, redeemedAuthID, err := replica2.RedeemAuthcode(authcode)
+	require.NoError(t, err)
+	require.Equal(t, authID, redeemedAuthID)
+	require.True(t, redeemed.AuthcodeIssued)
+	require.True(t, redeemed.AuthcodeRedeemed)
+	require.Equal(t, "updated", redeemed.DisplayName)
+
+	_, _, err = replica1.RedeemAuthcode(authcode)
+	require.Error(t, err)
+
+	authState, ok = replica1.LookupAuthState(authID)
+	require.True(t, ok)
+	require.True(t, authState.AuthcodeRedeemed)
+}
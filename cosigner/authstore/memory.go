@@ -0,0 +1,104 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package authstore provides AuthStateBackend implementations for
+// cosigner.BackendAuthStateStore.
+package authstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+type memoryEntry struct {
+	value      []byte
+	expiration time.Time
+}
+
+// MemoryBackend keeps auth state in process memory. It is useful for tests
+// and for a cosigner running a single replica.
+type MemoryBackend struct {
+	entries map[string]memoryEntry
+	lock    sync.Mutex
+}
+
+var _ cosigner.AuthStateBackend = (*MemoryBackend)(nil)
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		entries: map[string]memoryEntry{},
+	}
+}
+
+func (m *MemoryBackend) Get(_ context.Context, key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry, ok := m.lookup(key)
+	if !ok {
+		return nil, cosigner.ErrAuthStateNotFound
+	}
+	return append([]byte{}, entry.value...), nil
+}
+
+func (m *MemoryBackend) Put(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.entries[key] = memoryEntry{
+		value:      append([]byte{}, value...),
+		expiration: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Delete(_ context.Context, key string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.lookup(key)
+	delete(m.entries, key)
+	return ok, nil
+}
+
+func (m *MemoryBackend) Expire(_ context.Context, key string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry, ok := m.lookup(key)
+	if !ok {
+		return cosigner.ErrAuthStateNotFound
+	}
+	entry.expiration = time.Now().Add(ttl)
+	m.entries[key] = entry
+	return nil
+}
+
+// lookup returns the unexpired entry for key, removing it if it has expired
+func (m *MemoryBackend) lookup(key string) (memoryEntry, bool) {
+	entry, ok := m.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !time.Now().Before(entry.expiration) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package authstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+const (
+	defaultRedisPoolSize    = 10
+	defaultRedisDialTimeout = 5 * time.Second
+)
+
+type RedisOptions struct {
+	Addr     string // host:port of the Redis server
+	Username string // Optional, for Redis ACL users
+	Password string // Optional
+	DB       int    // Database selected after connecting
+	// KeyPrefix is prepended to every key so several cosigners can share a
+	// Redis database
+	KeyPrefix string
+	// TLSConfig, if set, connects to Redis over TLS
+	TLSConfig   *tls.Config
+	DialTimeout time.Duration // Defaults to 5 seconds
+	PoolSize    int           // Maximum idle connections kept, defaults to 10
+}
+
+// RedisBackend stores auth state in Redis. Every replica of the cosigner
+// pointed at the same Redis server shares auth sessions. It speaks the
+// Redis protocol (RESP) directly and only uses the GET, SET, DEL and
+// PEXPIRE commands.
+type RedisBackend struct {
+	opts RedisOptions
+	pool chan *redisConn
+}
+
+var _ cosigner.AuthStateBackend = (*RedisBackend)(nil)
+
+func NewRedisBackend(opts RedisOptions) *RedisBackend {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultRedisDialTimeout
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = defaultRedisPoolSize
+	}
+	return &RedisBackend{
+		opts: opts,
+		pool: make(chan *redisConn, opts.PoolSize),
+	}
+}
+
+func (r *RedisBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := r.do(ctx, "GET", r.opts.KeyPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, cosigner.ErrAuthStateNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to redis GET: %T", reply)
+	}
+	return value, nil
+}
+
+func (r *RedisBackend) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	reply, err := r.do(ctx, "SET", r.opts.KeyPrefix+key, value, "PX", redisMillis(ttl))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("unexpected reply to redis SET: %v", reply)
+	}
+	return nil
+}
+
+func (r *RedisBackend) Delete(ctx context.Context, key string) (bool, error) {
+	reply, err := r.do(ctx, "DEL", r.opts.KeyPrefix+key)
+	if err != nil {
+		return false, err
+	}
+	deleted, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply to redis DEL: %T", reply)
+	}
+	return deleted > 0, nil
+}
+
+func (r *RedisBackend) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	reply, err := r.do(ctx, "PEXPIRE", r.opts.KeyPrefix+key, redisMillis(ttl))
+	if err != nil {
+		return err
+	}
+	if set, ok := reply.(int64); !ok {
+		return fmt.Errorf("unexpected reply to redis PEXPIRE: %T", reply)
+	} else if set == 0 {
+		return cosigner.ErrAuthStateNotFound
+	}
+	return nil
+}
+
+// Close closes the idle connections to Redis
+func (r *RedisBackend) Close() error {
+	var errs []error
+	for {
+		select {
+		case conn := <-r.pool:
+			errs = append(errs, conn.Close())
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// redisMillis converts ttl to milliseconds, Redis rejects a TTL of zero
+func redisMillis(ttl time.Duration) string {
+	return strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+}
+
+// RedisError is an error reply sent by the Redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command to Redis and returns its reply. Replies are nil,
+// string, int64, []byte or []any.
+func (r *RedisBackend) do(ctx context.Context, args ...any) (any, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be left mid reply, so it can't be reused
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case r.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (r *RedisBackend) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	default:
+	}
+
+	var netConn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: r.opts.DialTimeout}
+	if r.opts.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: r.opts.TLSConfig}
+		netConn, err = tlsDialer.DialContext(ctx, "tcp", r.opts.Addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", r.opts.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if r.opts.Password != "" {
+		args := []any{"AUTH", r.opts.Password}
+		if r.opts.Username != "" {
+			args = []any{"AUTH", r.opts.Username, r.opts.Password}
+		}
+		if _, err := conn.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %w", err)
+		}
+	}
+	if r.opts.DB != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select redis database: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(ctx context.Context, args ...any) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+
+	cmd := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		var b []byte
+		switch arg := arg.(type) {
+		case string:
+			b = []byte(arg)
+		case []byte:
+			b = arg
+		default:
+			return nil, fmt.Errorf("unsupported redis argument type: %T", arg)
+		}
+		cmd = append(cmd, "$"+strconv.Itoa(len(b))+"\r\n"...)
+		cmd = append(cmd, b...)
+		cmd = append(cmd, "\r\n"...)
+	}
+	if _, err := c.Write(cmd); err != nil {
+		return nil, fmt.Errorf("failed to send redis command: %w", err)
+	}
+	return readRedisReply(c.reader)
+}
+
+func readRedisReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redis reply: %w", err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply: %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis integer reply: %w", err)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis bulk string reply: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, fmt.Errorf("failed to read redis reply: %w", err)
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis array reply: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]any, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type: %q", kind)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package authstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis serves the subset of the Redis protocol used by RedisBackend
+// from a MemoryBackend
+func fakeRedis(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	store := NewMemoryBackend()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeRedis(conn, store, password)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveFakeRedis(conn net.Conn, store *MemoryBackend, password string) {
+	defer conn.Close()
+	ctx := context.Background()
+	reader := bufio.NewReader(conn)
+	authenticated := password == ""
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]any) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		var resp string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authenticated = args[len(args)-1] == password
+			if authenticated {
+				resp = "+OK\r\n"
+			} else {
+				resp = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			resp = "-NOAUTH Authentication required\r\n"
+		case cmd == "GET":
+			if value, err := store.Get(ctx, args[1]); err != nil {
+				resp = "$-1\r\n"
+			} else {
+				resp = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			}
+		case cmd == "SET":
+			ms, _ := strconv.Atoi(args[4])
+			store.Put(ctx, args[1], []byte(args[2]), time.Duration(ms)*time.Millisecond)
+			resp = "+OK\r\n"
+		case cmd == "DEL":
+			deleted, _ := store.Delete(ctx, args[1])
+			resp = fmt.Sprintf(":%d\r\n", map[bool]int{false: 0, true: 1}[deleted])
+		case cmd == "PEXPIRE":
+			ms, _ := strconv.Atoi(args[2])
+			err := store.Expire(ctx, args[1], time.Duration(ms)*time.Millisecond)
+			resp = fmt.Sprintf(":%d\r\n", map[bool]int{false: 1, true: 0}[err != nil])
+		default:
+			resp = "-ERR unknown command\r\n"
+		}
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	ctx := context.Background()
+	backend := NewRedisBackend(RedisOptions{
+		Addr:      fakeRedis(t, "secret"),
+		Password:  "secret",
+		KeyPrefix: "opk:",
+	})
+	defer backend.Close()
+
+	_, err := backend.Get(ctx, "missing")
+	require.ErrorIs(t, err, cosigner.ErrAuthStateNotFound)
+
+	value := []byte("value\r\nwith\x00binary")
+	require.NoError(t, backend.Put(ctx, "key", value, time.Minute))
+	got, err := backend.Get(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	require.NoError(t, backend.Expire(ctx, "key", time.Minute))
+	require.ErrorIs(t, backend.Expire(ctx, "missing", time.Minute), cosigner.ErrAuthStateNotFound)
+
+	deleted, err := backend.Delete(ctx, "key")
+	require.NoError(t, err)
+	require.True(t, deleted)
+	deleted, err = backend.Delete(ctx, "key")
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	require.NoError(t, backend.Put(ctx, "short", value, time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	_, err = backend.Get(ctx, "short")
+	require.ErrorIs(t, err, cosigner.ErrAuthStateNotFound)
+}
+
+func TestRedisBackendAuthFailure(t *testing.T) {
+	backend := NewRedisBackend(RedisOptions{
+		Addr:     fakeRedis(t, "secret"),
+		Password: "wrong",
+	})
+	_, err := backend.Get(context.Background(), "key")
+	var redisErr RedisError
+	require.True(t, errors.As(err, &redisErr))
+	require.ErrorContains(t, err, "failed to authenticate to redis")
+}
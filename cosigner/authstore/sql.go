@@ -0,0 +1,181 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package authstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// SQLDialect describes the SQL differences between databases that matter
+// to SQLBackend
+type SQLDialect struct {
+	// Placeholder returns the bind parameter for the nth (1-indexed)
+	// argument of a statement
+	Placeholder func(n int) string
+	BlobType    string // Column type used for values
+}
+
+var SQLDialects = struct {
+	Postgres SQLDialect
+	MySQL    SQLDialect
+	SQLite   SQLDialect
+}{
+	Postgres: SQLDialect{
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		BlobType:    "BYTEA",
+	},
+	MySQL: SQLDialect{
+		Placeholder: func(int) string { return "?" },
+		BlobType:    "LONGBLOB",
+	},
+	SQLite: SQLDialect{
+		Placeholder: func(int) string { return "?" },
+		BlobType:    "BLOB",
+	},
+}
+
+var tableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLBackend stores auth state in a SQL database table, letting every
+// replica of the cosigner connected to that database share auth sessions.
+// The caller opens the database with the driver of their choice. Expired
+// rows are ignored but are only removed by DeleteExpired.
+type SQLBackend struct {
+	db      *sql.DB
+	table   string
+	dialect SQLDialect
+}
+
+var _ cosigner.AuthStateBackend = (*SQLBackend)(nil)
+
+func NewSQLBackend(db *sql.DB, table string, dialect SQLDialect) (*SQLBackend, error) {
+	if !tableNameRegex.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %q", table)
+	}
+	return &SQLBackend{
+		db:      db,
+		table:   table,
+		dialect: dialect,
+	}, nil
+}
+
+// CreateTable creates the table used by the backend if it doesn't exist
+func (s *SQLBackend) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (k VARCHAR(255) PRIMARY KEY, v %s NOT NULL, expires_at BIGINT NOT NULL)",
+		s.table, s.dialect.BlobType))
+	return err
+}
+
+func (s *SQLBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.query("SELECT v FROM %s WHERE k = %s AND expires_at > %s"),
+		key, time.Now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, cosigner.ErrAuthStateNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *SQLBackend) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	// Upserts differ between databases, deleting then inserting in a
+	// transaction works everywhere
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s WHERE k = %s"), key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.query("INSERT INTO %s (k, v, expires_at) VALUES (%s, %s, %s)"),
+		key, value, time.Now().Add(ttl).UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLBackend) Delete(ctx context.Context, key string) (bool, error) {
+	// The database only reports the row as affected to one of several
+	// concurrent deletes
+	res, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE k = %s AND expires_at > %s"),
+		key, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *SQLBackend) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, s.query("UPDATE %s SET expires_at = %s WHERE k = %s AND expires_at > %s"),
+		now.Add(ttl).UnixMilli(), key, now.UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return cosigner.ErrAuthStateNotFound
+	}
+	return nil
+}
+
+// DeleteExpired removes expired rows from the table and returns how many
+// were removed. It should be called periodically.
+func (s *SQLBackend) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE expires_at <= %s"), time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// query fills in the table name and the dialect's placeholders for the
+// %s verbs following it
+func (s *SQLBackend) query(format string) string {
+	args := []any{s.table}
+	for i := 1; len(args) < countVerbs(format); i++ {
+		args = append(args, s.dialect.Placeholder(i))
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func countVerbs(format string) int {
+	n := 0
+	for i := 0; i+1 < len(format); i++ {
+		if format[i] == '%' && format[i+1] == 's' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package authstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLBackendQuery(t *testing.T) {
+	postgres, err := NewSQLBackend(nil, "auth_state", SQLDialects.Postgres)
+	require.NoError(t, err)
+	require.Equal(t,
+		"UPDATE auth_state SET expires_at = $1 WHERE k = $2 AND expires_at > $3",
+		postgres.query("UPDATE %s SET expires_at = %s WHERE k = %s AND expires_at > %s"))
+
+	mysql, err := NewSQLBackend(nil, "auth_state", SQLDialects.MySQL)
+	require.NoError(t, err)
+	require.Equal(t,
+		"INSERT INTO auth_state (k, v, expires_at) VALUES (?, ?, ?)",
+		mysql.query("INSERT INTO %s (k, v, expires_at) VALUES (%s, %s, %s)"))
+
+	_, err = NewSQLBackend(nil, "auth_state; DROP TABLE users", SQLDialects.SQLite)
+	require.ErrorContains(t, err, "invalid table name")
+}
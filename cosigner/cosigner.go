@@ -30,6 +30,10 @@ type Cosigner struct {
 }
 
 func (c *Cosigner) Cosign(pkt *pktoken.PKToken, cosClaims pktoken.CosignerClaims) ([]byte, error) {
+	return cosign(pkt, c.Signer, c.Alg, cosClaims)
+}
+
+func cosign(pkt *pktoken.PKToken, signer crypto.Signer, alg jwa.KeyAlgorithm, cosClaims pktoken.CosignerClaims) ([]byte, error) {
 	jsonBytes, err := json.Marshal(cosClaims)
 	if err != nil {
 		return nil, err
@@ -38,5 +42,5 @@ func (c *Cosigner) Cosign(pkt *pktoken.PKToken, cosClaims pktoken.CosignerClaims
 	if err := json.Unmarshal(jsonBytes, &headers); err != nil {
 		return nil, err
 	}
-	return pkt.SignToken(c.Signer, c.Alg, headers)
+	return pkt.SignToken(signer, alg, headers)
 }
@@ -19,10 +19,12 @@ package cosigner
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/discover"
 	"github.com/openpubkey/openpubkey/pktoken"
 )
@@ -38,6 +40,23 @@ type CosignerVerifierOpts struct {
 	Strict *bool
 	// Allows users to set custom function for discovering public key of Cosigner
 	DiscoverPublicKey *discover.PublicKeyFinder
+	// AllowedAlgorithms are the signature algorithms the cosigner may use.
+	// Cosigners backed by a KMS are often limited to the algorithms that KMS
+	// offers. Defaults to DefaultCosignerAlgorithms.
+	AllowedAlgorithms []jwa.SignatureAlgorithm
+	// ClockSkew is how far apart the cosigner's clock and the verifier's may
+	// be when checking the expiration of the cosigner signature. Defaults to
+	// no tolerance.
+	ClockSkew clockskew.Policy
+}
+
+// DefaultCosignerAlgorithms are the cosigner signature algorithms accepted
+// if CosignerVerifierOpts.AllowedAlgorithms is not set.
+var DefaultCosignerAlgorithms = []jwa.SignatureAlgorithm{
+	jwa.ES256,
+	jwa.ES384,
+	jwa.RS256,
+	jwa.EdDSA,
 }
 
 func NewCosignerVerifier(issuer string, options CosignerVerifierOpts) *DefaultCosignerVerifier {
@@ -57,6 +76,10 @@ func NewCosignerVerifier(issuer string, options CosignerVerifierOpts) *DefaultCo
 		*v.options.Strict = true
 	}
 
+	if len(v.options.AllowedAlgorithms) == 0 {
+		v.options.AllowedAlgorithms = DefaultCosignerAlgorithms
+	}
+
 	return v
 }
 
@@ -83,21 +106,27 @@ func (v *DefaultCosignerVerifier) VerifyCosigner(ctx context.Context, pkt *pktok
 		return fmt.Errorf("cosigner issuer (%s) doesn't match expected issuer (%s)", header.Issuer, v.issuer)
 	}
 
+	// The alg is taken from the COS protected header, but only algorithms on
+	// the allowlist are accepted
+	alg := jwa.SignatureAlgorithm(header.Algorithm)
+	if !slices.Contains(v.options.AllowedAlgorithms, alg) {
+		return fmt.Errorf("cosigner alg (%s) is not allowed", header.Algorithm)
+	}
+
 	keyRecord, err := v.options.DiscoverPublicKey.ByKeyID(ctx, v.issuer, header.KeyID)
 	if err != nil {
 		return err
 	}
 	key := keyRecord.PublicKey
-	alg := keyRecord.Alg
 
 	// Check if it's expired
-	if time.Now().After(time.Unix(header.Expiration, 0)) {
+	if v.options.ClockSkew.Expired(time.Unix(header.Expiration, 0), time.Now()) {
 		return fmt.Errorf("cosigner signature expired")
 	}
-	if header.Algorithm != alg {
-		return fmt.Errorf("key (kid=%s) has alg (%s) which doesn't match alg (%s) in protected", header.KeyID, alg, header.Algorithm)
+	if keyRecord.Alg != alg.String() {
+		return fmt.Errorf("key (kid=%s) has alg (%s) which doesn't match alg (%s) in protected", header.KeyID, keyRecord.Alg, header.Algorithm)
 	}
-	jwsPubkey := jws.WithKey(jwa.KeyAlgorithmFrom(alg), key)
+	jwsPubkey := jws.WithKey(alg, key)
 	_, err = jws.Verify(pkt.CosToken, jwsPubkey)
 
 	return err
@@ -33,64 +33,90 @@ import (
 )
 
 func TestCosignerVerifier(t *testing.T) {
-	// Generate the key pair for our cosigner
-	alg := jwa.ES256
-	signer, err := util.GenKeyPair(alg)
-	require.NoError(t, err, "failed to generate key pair")
-
-	cos := &cosigner.Cosigner{
-		Alg:    alg,
-		Signer: signer,
+	testCases := []struct {
+		name        string
+		alg         jwa.SignatureAlgorithm
+		allowedAlgs []jwa.SignatureAlgorithm
+		expError    string
+	}{
+		{name: "ES256", alg: jwa.ES256},
+		{name: "ES384", alg: jwa.ES384},
+		{name: "RS256", alg: jwa.RS256},
+		{name: "EdDSA", alg: jwa.EdDSA},
+		{name: "alg not on allowlist", alg: jwa.RS256,
+			allowedAlgs: []jwa.SignatureAlgorithm{jwa.ES256}, expError: "cosigner alg (RS256) is not allowed"},
 	}
 
-	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
-	require.NoError(t, err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Generate the key pair for our cosigner
+			signer, err := util.GenKeyPair(tc.alg)
+			require.NoError(t, err, "failed to generate key pair")
 
-	fakeIssuer := "https://example.com"
-	kid := "1234"
-	cosignerClaims := pktoken.CosignerClaims{
-		Issuer:      fakeIssuer,
-		KeyID:       kid,
-		Algorithm:   cos.Alg.String(),
-		AuthID:      "none",
-		AuthTime:    time.Now().Unix(),
-		IssuedAt:    time.Now().Unix(),
-		Expiration:  time.Now().Add(time.Hour).Unix(),
-		RedirectURI: "none",
-		Nonce:       "test-nonce",
-		Typ:         "COS",
-	}
+			cos := &cosigner.Cosigner{
+				Alg:    tc.alg,
+				Signer: signer,
+			}
 
-	cosToken, err := cos.Cosign(pkt, cosignerClaims)
-	require.NoError(t, err, "failed cosign PK Token")
-	require.NotNil(t, cosToken, "cosign signature is nil")
+			// The user's key is independent of the cosigner's key
+			userAlg := jwa.ES256
+			userSigner, err := util.GenKeyPair(userAlg)
+			require.NoError(t, err)
+			pkt, err := mocks.GenerateMockPKToken(t, userSigner, userAlg)
+			require.NoError(t, err)
 
-	err = pkt.AddSignature(cosToken, pktoken.COS)
-	require.NoError(t, err, "failed to add cosign signature to pk token")
+			fakeIssuer := "https://example.com"
+			kid := "1234"
+			cosignerClaims := pktoken.CosignerClaims{
+				Issuer:      fakeIssuer,
+				KeyID:       kid,
+				Algorithm:   cos.Alg.String(),
+				AuthID:      "none",
+				AuthTime:    time.Now().Unix(),
+				IssuedAt:    time.Now().Unix(),
+				Expiration:  time.Now().Add(time.Hour).Unix(),
+				RedirectURI: "none",
+				Nonce:       "test-nonce",
+				Typ:         "COS",
+			}
 
-	mockPublicKeyFinder := func(ctx context.Context, issuer string) ([]byte, error) {
-		keySet := jwk.NewSet()
-		jwkKey, err := jwk.PublicKeyOf(signer)
-		if err != nil {
-			return nil, err
-		}
-		if err := jwkKey.Set(jwk.AlgorithmKey, alg); err != nil {
-			return nil, err
-		}
-		if err := jwkKey.Set(jwk.KeyIDKey, kid); err != nil {
-			return nil, err
-		}
-		if err := keySet.AddKey(jwkKey); err != nil {
-			return nil, err
-		}
-		return json.MarshalIndent(keySet, "", "  ")
-	}
+			cosToken, err := cos.Cosign(pkt, cosignerClaims)
+			require.NoError(t, err, "failed cosign PK Token")
+			require.NotNil(t, cosToken, "cosign signature is nil")
 
-	cosVerifier := cosigner.NewCosignerVerifier(fakeIssuer, cosigner.CosignerVerifierOpts{
-		DiscoverPublicKey: &discover.PublicKeyFinder{
-			JwksFunc: mockPublicKeyFinder,
-		},
-	})
-	err = cosVerifier.VerifyCosigner(context.Background(), pkt)
-	require.NoError(t, err, "failed to verify cosigned pk token")
+			err = pkt.AddSignature(cosToken, pktoken.COS)
+			require.NoError(t, err, "failed to add cosign signature to pk token")
+
+			mockPublicKeyFinder := func(ctx context.Context, issuer string) ([]byte, error) {
+				keySet := jwk.NewSet()
+				jwkKey, err := jwk.PublicKeyOf(signer)
+				if err != nil {
+					return nil, err
+				}
+				if err := jwkKey.Set(jwk.AlgorithmKey, tc.alg); err != nil {
+					return nil, err
+				}
+				if err := jwkKey.Set(jwk.KeyIDKey, kid); err != nil {
+					return nil, err
+				}
+				if err := keySet.AddKey(jwkKey); err != nil {
+					return nil, err
+				}
+				return json.MarshalIndent(keySet, "", "  ")
+			}
+
+			cosVerifier := cosigner.NewCosignerVerifier(fakeIssuer, cosigner.CosignerVerifierOpts{
+				DiscoverPublicKey: &discover.PublicKeyFinder{
+					JwksFunc: mockPublicKeyFinder,
+				},
+				AllowedAlgorithms: tc.allowedAlgs,
+			})
+			err = cosVerifier.VerifyCosigner(context.Background(), pkt)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err, "failed to verify cosigned pk token")
+			}
+		})
+	}
 }
@@ -0,0 +1,81 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// InitAuthHandler serves the mfa-auth-init endpoint a client.CosignerProvider
+// opens in the user's browser. It starts an auth session and redirects the
+// browser to the MFA page, given relative to the endpoint, with the authID
+// in the authid query parameter.
+func (c *AuthCosigner) InitAuthHandler(mfaPage string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Clients predating PK Token media types send JSON without a pkt_type
+		mediaType := pktoken.MediaTypeJSON
+		if pktType := r.URL.Query().Get("pkt_type"); pktType != "" {
+			var err error
+			if mediaType, err = pktoken.ParseMediaType(pktType); err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		pktBytes, err := util.Base64DecodeForJWT([]byte(r.URL.Query().Get("pkt")))
+		if err != nil {
+			http.Error(w, "Error decoding PK Token", http.StatusBadRequest)
+			return
+		}
+		pkt, err := pktoken.NewFromMediaType(pktBytes, mediaType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sig := []byte(r.URL.Query().Get("sig1"))
+
+		authID, err := c.InitAuth(pkt, sig)
+		if err != nil {
+			http.Error(w, "Error initiating authentication", http.StatusBadRequest)
+			return
+		}
+		// http.Redirect would make the location absolute using the request
+		// path, which is missing the prefix when the handler is mounted with
+		// http.StripPrefix, so the relative location is left for the browser
+		w.Header().Set("Location", fmt.Sprintf("%s?authid=%s", mfaPage, url.QueryEscape(authID)))
+		w.WriteHeader(http.StatusFound)
+	}
+}
+
+// SignHandler serves the sign endpoint a client.CosignerProvider redeems
+// the authcode at for the cosigner signature
+func (c *AuthCosigner) SignHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sig := []byte(r.URL.Query().Get("sig2"))
+		cosSig, err := c.RedeemAuthcode(sig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(util.Base64EncodeForJWT(cosSig))
+	}
+}
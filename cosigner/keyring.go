@@ -0,0 +1,205 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// SignatureLifetime is how long a cosigner signature is valid for
+const SignatureLifetime = time.Hour
+
+// SigningKey is a key the cosigner signs with
+type SigningKey struct {
+	KeyID  string
+	Alg    jwa.SignatureAlgorithm
+	Signer crypto.Signer
+	// RetiredAt is when the key was replaced by a newer one, zero while it
+	// is the current key
+	RetiredAt time.Time
+}
+
+// NewSigningKey generates a key for alg, identified by its RFC 7638 JWK
+// thumbprint
+func NewSigningKey(alg jwa.SignatureAlgorithm) (SigningKey, error) {
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	jwkKey, err := jwk.PublicKeyOf(signer.Public())
+	if err != nil {
+		return SigningKey{}, err
+	}
+	thumbprint, err := jwkKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{
+		KeyID:  string(util.Base64EncodeForJWT(thumbprint)),
+		Alg:    alg,
+		Signer: signer,
+	}, nil
+}
+
+// Keyring holds the cosigner's signing keys. Signatures are made with the
+// current key. Keys it replaced stay published until every signature made
+// with them has expired, so verifiers accept PK Tokens cosigned shortly
+// before a rotation.
+type Keyring struct {
+	// Retention is how long a replaced key stays published, it defaults to
+	// SignatureLifetime
+	Retention time.Duration
+
+	lock     sync.RWMutex
+	current  SigningKey
+	previous []SigningKey
+	now      func() time.Time
+}
+
+func NewKeyring(current SigningKey) *Keyring {
+	return &Keyring{
+		Retention: SignatureLifetime,
+		current:   current,
+		now:       time.Now,
+	}
+}
+
+// Current returns the key new signatures are made with
+func (k *Keyring) Current() SigningKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current
+}
+
+// Rotate makes next the current key, retiring the current one
+func (k *Keyring) Rotate(next SigningKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if next.KeyID == "" {
+		return fmt.Errorf("signing key has no key ID")
+	}
+	for _, key := range append([]SigningKey{k.current}, k.previous...) {
+		if key.KeyID == next.KeyID {
+			return fmt.Errorf("signing key with key ID %s is already in the keyring", next.KeyID)
+		}
+	}
+	retired := k.current
+	retired.RetiredAt = k.now()
+	k.current = next
+	k.current.RetiredAt = time.Time{}
+	k.previous = append([]SigningKey{retired}, k.previous...)
+	k.prune()
+	return nil
+}
+
+// Keys returns the published keys, the current key first
+func (k *Keyring) Keys() []SigningKey {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.prune()
+	return append([]SigningKey{k.current}, k.previous...)
+}
+
+// prune drops replaced keys whose signatures have all expired. The caller
+// must hold lock for writing.
+func (k *Keyring) prune() {
+	now := k.now()
+	kept := k.previous[:0]
+	for _, key := range k.previous {
+		if now.Before(key.RetiredAt.Add(k.Retention)) {
+			kept = append(kept, key)
+		}
+	}
+	k.previous = kept
+}
+
+// JWKS returns the public keys of the published keys
+func (k *Keyring) JWKS() (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, key := range k.Keys() {
+		jwkKey, err := jwk.PublicKeyOf(key.Signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		if err := jwkKey.Set(jwk.KeyIDKey, key.KeyID); err != nil {
+			return nil, err
+		}
+		if err := jwkKey.Set(jwk.AlgorithmKey, key.Alg); err != nil {
+			return nil, err
+		}
+		if err := jwkKey.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+			return nil, err
+		}
+		if err := set.AddKey(jwkKey); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// JWKSHandler serves the published keys as a JWKS
+func (k *Keyring) JWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		set, err := k.JWKS()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(set)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// StartRotation rotates to a key from generate every interval until ctx is
+// done. Failures are passed to onError, if set, and the current key is kept
+// until the next interval.
+func (k *Keyring) StartRotation(ctx context.Context, interval time.Duration, generate func() (SigningKey, error), onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				next, err := generate()
+				if err == nil {
+					err = k.Rotate(next)
+				}
+				if err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) SigningKey {
+	key, err := NewSigningKey(jwa.ES256)
+	require.NoError(t, err)
+	return key
+}
+
+func keyIDs(keys []SigningKey) []string {
+	ids := []string{}
+	for _, key := range keys {
+		ids = append(ids, key.KeyID)
+	}
+	return ids
+}
+
+func TestKeyring(t *testing.T) {
+	now := time.Now()
+	first, second, third := newTestKey(t), newTestKey(t), newTestKey(t)
+	keyring := NewKeyring(first)
+	keyring.now = func() time.Time { return now }
+
+	require.Equal(t, first.KeyID, keyring.Current().KeyID)
+	require.Equal(t, []string{first.KeyID}, keyIDs(keyring.Keys()))
+
+	require.NoError(t, keyring.Rotate(second))
+	require.Equal(t, second.KeyID, keyring.Current().KeyID)
+	require.Equal(t, []string{second.KeyID, first.KeyID}, keyIDs(keyring.Keys()))
+	require.Equal(t, now, keyring.Keys()[1].RetiredAt)
+
+	require.ErrorContains(t, keyring.Rotate(first), "already in the keyring")
+	require.ErrorContains(t, keyring.Rotate(SigningKey{Alg: jwa.ES256, Signer: third.Signer}), "no key ID")
+
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, keyring.Rotate(third))
+	require.Equal(t, []string{third.KeyID, second.KeyID, first.KeyID}, keyIDs(keyring.Keys()))
+
+	// Replaced keys are published until their signatures have expired
+	now = now.Add(SignatureLifetime - 30*time.Minute)
+	require.Equal(t, []string{third.KeyID, second.KeyID}, keyIDs(keyring.Keys()))
+	now = now.Add(30 * time.Minute)
+	require.Equal(t, []string{third.KeyID}, keyIDs(keyring.Keys()))
+
+	set, err := keyring.JWKS()
+	require.NoError(t, err)
+	require.Equal(t, 1, set.Len())
+	jwkKey, ok := set.LookupKeyID(third.KeyID)
+	require.True(t, ok)
+	require.Equal(t, jwa.ES256, jwkKey.Algorithm())
+	require.Equal(t, "sig", string(jwkKey.KeyUsage()))
+	_, isPrivate := jwkKey.(jwk.ECDSAPrivateKey)
+	require.False(t, isPrivate)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keyring := NewKeyring(newTestKey(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rotated := make(chan string, 10)
+	keyring.StartRotation(ctx, 10*time.Millisecond, func() (SigningKey, error) {
+		key, err := NewSigningKey(jwa.ES256)
+		if err == nil {
+			rotated <- key.KeyID
+		}
+		return key, err
+	}, func(err error) {
+		t.Error(err)
+	})
+
+	kid := <-rotated
+	require.Eventually(t, func() bool {
+		for _, key := range keyring.Keys() {
+			if key.KeyID == kid {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCosignWithRotatedKeys(t *testing.T) {
+	issuer := "https://cosigner.example.com"
+	first := newTestKey(t)
+	cos, err := New(first.Signer, first.Alg, issuer, first.KeyID, nil)
+	require.NoError(t, err)
+	cos.Keyring = NewKeyring(first)
+
+	// The verifier reads the JWKS from the keyring as it would from the
+	// cosigner's JWKS endpoint
+	verifier := NewCosignerVerifier(issuer, CosignerVerifierOpts{
+		DiscoverPublicKey: &discover.PublicKeyFinder{
+			JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+				set, err := cos.Keyring.JWKS()
+				if err != nil {
+					return nil, err
+				}
+				return json.Marshal(set)
+			},
+		},
+	})
+
+	cosign := func() *pktoken.PKToken {
+		alg := jwa.ES256
+		signer, err := util.GenKeyPair(alg)
+		require.NoError(t, err)
+		pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+		require.NoError(t, err)
+		authState := AuthState{Pkt: pkt, RedirectURI: "http://localhost:5555/mfaredirect", Nonce: "nonce"}
+		cosSig, err := cos.IssueSignature(pkt, authState, "authID")
+		require.NoError(t, err)
+		require.NoError(t, pkt.AddSignature(cosSig, pktoken.COS))
+		return pkt
+	}
+
+	before := cosign()
+	second := newTestKey(t)
+	require.NoError(t, cos.Keyring.Rotate(second))
+	after := cosign()
+
+	claims, err := before.ParseCosignerClaims()
+	require.NoError(t, err)
+	require.Equal(t, first.KeyID, claims.KeyID)
+	claims, err = after.ParseCosignerClaims()
+	require.NoError(t, err)
+	require.Equal(t, second.KeyID, claims.KeyID)
+
+	// PK Tokens cosigned before the rotation are still accepted
+	require.NoError(t, verifier.VerifyCosigner(context.Background(), before))
+	require.NoError(t, verifier.VerifyCosigner(context.Background(), after))
+
+	// Once the old key is no longer published they aren't
+	cos.Keyring.now = func() time.Time { return time.Now().Add(SignatureLifetime) }
+	require.ErrorContains(t, verifier.VerifyCosigner(context.Background(), before), "no matching public key")
+	require.NoError(t, verifier.VerifyCosigner(context.Background(), after))
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+)
+
+// AWSCredentials are the credentials used to sign requests to AWS KMS
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Only set for temporary credentials
+}
+
+// AWSKey is an asymmetric ECC_NIST_P256 or RSA signing key in AWS KMS.
+// Requests are signed with AWS Signature Version 4.
+type AWSKey struct {
+	KeyID       string // Key ID, key ARN, alias name or alias ARN
+	Region      string
+	Credentials AWSCredentials
+	Endpoint    string       // Defaults to https://kms.<region>.amazonaws.com
+	HTTPClient  *http.Client // Defaults to http.DefaultClient
+
+	// keyARN is the key the public key was fetched for, signing uses it so
+	// signatures always match the public key even if an alias is updated
+	keyARN string
+	now    func() time.Time
+}
+
+var _ NamedKey = (*AWSKey)(nil)
+
+// KeyName returns the ARN of the key, even if KeyID is an alias
+func (k *AWSKey) KeyName() string {
+	return k.keyARN
+}
+
+func (k *AWSKey) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	var resp struct {
+		KeyId     string
+		PublicKey string
+		KeyUsage  string
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]string{"KeyId": k.KeyID}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("AWS KMS key usage must be SIGN_VERIFY, got %s", resp.KeyUsage)
+	}
+	der, err := base64.StdEncoding.DecodeString(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	k.keyARN = resp.KeyId
+	return x509.ParsePKIXPublicKey(der)
+}
+
+func (k *AWSKey) SignDigest(ctx context.Context, digest []byte, alg jwa.SignatureAlgorithm) ([]byte, error) {
+	if k.keyARN == "" {
+		return nil, fmt.Errorf("the public key must be fetched before signing")
+	}
+	var signingAlg string
+	switch alg {
+	case jwa.ES256:
+		signingAlg = "ECDSA_SHA_256"
+	case jwa.RS256:
+		signingAlg = "RSASSA_PKCS1_V1_5_SHA_256"
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+	req := map[string]string{
+		"KeyId":            k.keyARN,
+		"Message":          base64.StdEncoding.EncodeToString(digest),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": signingAlg,
+	}
+	var resp struct {
+		Signature string
+	}
+	if err := k.call(ctx, "Sign", req, &resp); err != nil {
+		return nil, err
+	}
+	// AWS KMS returns ECDSA signatures DER encoded
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+func (k *AWSKey) call(ctx context.Context, action string, reqBody any, respBody any) error {
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	endpoint := k.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", k.Region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now
+	if k.now != nil {
+		now = k.now
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-amz-json-1.1")
+	header.Set("X-Amz-Target", "TrentService."+action)
+	header.Set("X-Amz-Date", now().UTC().Format("20060102T150405Z"))
+	if k.Credentials.SessionToken != "" {
+		header.Set("X-Amz-Security-Token", k.Credentials.SessionToken)
+	}
+	header.Set("Authorization", signV4(k.Credentials, k.Region, "kms", endpointURL.Host, header, body))
+
+	return doJSON(ctx, k.HTTPClient, http.MethodPost, endpointURL.String(), header, json.RawMessage(body), respBody)
+}
+
+// signV4 returns the Authorization header for a POST to / with the headers
+// and body, following AWS Signature Version 4
+func signV4(creds AWSCredentials, region string, service string, host string, header http.Header, body []byte) string {
+	amzDate := header.Get("X-Amz-Date")
+	date := amzDate[:8]
+
+	canonicalHeaders := map[string]string{"host": host}
+	for k := range header {
+		canonicalHeaders[strings.ToLower(k)] = strings.TrimSpace(header.Get(k))
+	}
+	names := make([]string, 0, len(canonicalHeaders))
+	for name := range canonicalHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headerLines strings.Builder
+	for _, name := range names {
+		headerLines.WriteString(name + ":" + canonicalHeaders[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		"/",
+		"", // No query string
+		headerLines.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
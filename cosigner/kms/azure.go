@@ -0,0 +1,119 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+const azureAPIVersion = "7.4"
+
+// AzureKey is an EC P-256 or RSA key in Azure Key Vault or Managed HSM
+type AzureKey struct {
+	VaultURL string // e.g. https://myvault.vault.azure.net
+	Name     string
+	Version  string // Uses the current version if empty
+	// HTTPClient must add a bearer token for the https://vault.azure.net
+	// resource to requests
+	HTTPClient *http.Client
+
+	// version is the version the public key was fetched for, signing uses
+	// it so signatures always match the public key even if the key rotates
+	version string
+	kid     string
+}
+
+var _ NamedKey = (*AzureKey)(nil)
+
+// KeyName returns the key identifier of the version the public key was
+// fetched for, its URL
+func (k *AzureKey) KeyName() string {
+	return k.kid
+}
+
+func (k *AzureKey) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	var resp struct {
+		Key json.RawMessage `json:"key"`
+	}
+	if err := doJSON(ctx, k.HTTPClient, http.MethodGet, k.url(k.Version, ""), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	var kid struct {
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(resp.Key, &kid); err != nil {
+		return nil, err
+	}
+	// The kid is the key's URL ending in its version
+	k.version = kid.Kid[strings.LastIndex(kid.Kid, "/")+1:]
+	if k.version == "" {
+		return nil, fmt.Errorf("azure key vault returned a key without a version: %s", kid.Kid)
+	}
+	k.kid = kid.Kid
+	jwkKey, err := jwk.ParseKey(resp.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key returned by Azure Key Vault: %w", err)
+	}
+	var public any
+	if err := jwkKey.Raw(&public); err != nil {
+		return nil, err
+	}
+	return public, nil
+}
+
+func (k *AzureKey) SignDigest(ctx context.Context, digest []byte, alg jwa.SignatureAlgorithm) ([]byte, error) {
+	if k.version == "" {
+		return nil, fmt.Errorf("the public key must be fetched before signing")
+	}
+	req := map[string]string{
+		"alg":   alg.String(),
+		"value": string(util.Base64EncodeForJWT(digest)),
+	}
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := doJSON(ctx, k.HTTPClient, http.MethodPost, k.url(k.version, "/sign"), nil, req, &resp); err != nil {
+		return nil, err
+	}
+	sig, err := util.Base64DecodeForJWT([]byte(resp.Value))
+	if err != nil {
+		return nil, err
+	}
+	if alg == jwa.ES256 {
+		// Key Vault returns ECDSA signatures in the raw JWS form
+		return RawECDSAToASN1(sig)
+	}
+	return sig, nil
+}
+
+func (k *AzureKey) url(version string, suffix string) string {
+	path := "/keys/" + url.PathEscape(k.Name)
+	if version != "" {
+		path += "/" + url.PathEscape(version)
+	}
+	return strings.TrimSuffix(k.VaultURL, "/") + path + suffix + "?api-version=" + azureAPIVersion
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+)
+
+const defaultGCPEndpoint = "https://cloudkms.googleapis.com"
+
+// GCPKey is an asymmetric signing key version in GCP Cloud KMS, with
+// algorithm EC_SIGN_P256_SHA256 or RSA_SIGN_PKCS1_*_SHA256
+type GCPKey struct {
+	// Name is the resource name of the key version, i.e.
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*
+	Name string
+	// HTTPClient must authenticate requests to Cloud KMS, for instance the
+	// client returned by google.DefaultClient in golang.org/x/oauth2/google
+	HTTPClient *http.Client
+	Endpoint   string // Defaults to https://cloudkms.googleapis.com
+}
+
+var _ NamedKey = (*GCPKey)(nil)
+
+func (k *GCPKey) KeyName() string {
+	return k.Name
+}
+
+func (k *GCPKey) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	var resp struct {
+		Pem string `json:"pem"`
+	}
+	if err := doJSON(ctx, k.HTTPClient, http.MethodGet, k.url("/publicKey"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("GCP KMS returned a public key which is not PEM encoded")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func (k *GCPKey) SignDigest(ctx context.Context, digest []byte, _ jwa.SignatureAlgorithm) ([]byte, error) {
+	req := map[string]any{
+		"digest": map[string]string{
+			"sha256": base64.StdEncoding.EncodeToString(digest),
+		},
+	}
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	if err := doJSON(ctx, k.HTTPClient, http.MethodPost, k.url(":asymmetricSign"), nil, req, &resp); err != nil {
+		return nil, err
+	}
+	// Cloud KMS returns ECDSA signatures DER encoded
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+func (k *GCPKey) url(suffix string) string {
+	endpoint := k.Endpoint
+	if endpoint == "" {
+		endpoint = defaultGCPEndpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/" + k.Name + suffix
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// httpError is returned by doJSON when the service responds with an error
+type httpError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// retryable returns true if the request failed because the service is
+// throttling requests or temporarily unavailable
+func retryable(err error) bool {
+	var httpErr *httpError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= http.StatusInternalServerError
+}
+
+// doJSON sends reqBody, if not nil, as JSON and decodes the JSON response
+// into respBody
+func doJSON(ctx context.Context, client *http.Client, method string, url string, header http.Header, reqBody any, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		reqJson, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(reqJson)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if reqBody != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respJson, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &httpError{
+			StatusCode: resp.StatusCode,
+			msg:        fmt.Sprintf("%s %s returned %s: %s", method, url, resp.Status, respJson),
+		}
+	}
+	if err := json.Unmarshal(respJson, respBody); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
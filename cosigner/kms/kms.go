@@ -0,0 +1,221 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package kms provides crypto.Signers for keys held by a key management
+// service or HSM, for cosigners and for clients, e.g. CI pipelines whose
+// CIC key must never leave the KMS. The private key never enters process
+// memory, digests are sent to the service to be signed.
+//
+// AWS KMS, GCP Cloud KMS and Azure Key Vault are supported through AWSKey,
+// GCPKey and AzureKey. Keys in a PKCS #11 HSM can be used by implementing
+// RemoteKey with C_Sign, for instance using github.com/miekg/pkcs11, and
+// converting raw ECDSA signatures with RawECDSAToASN1.
+//
+//	signer, err := kms.NewSigner(ctx, &kms.GCPKey{Name: keyVersionName, HTTPClient: oauthClient})
+//	kid, err := signer.KeyID()
+//	cos, err := cosigner.New(signer, signer.Algorithm(), issuer, kid, store)
+//
+// A Signer works as the key of an OpkClient:
+//
+//	opkClient, err := client.New(op, client.WithSigner(signer, signer.Algorithm()))
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// DefaultSignTimeout bounds how long Signer waits for the remote key to
+// sign a digest, including retries
+const DefaultSignTimeout = 30 * time.Second
+
+// signRetries is how many times Signer retries signing when the service
+// is throttling requests or temporarily unavailable, with signRetryDelay
+// doubling between attempts
+const (
+	signRetries    = 3
+	signRetryDelay = 200 * time.Millisecond
+)
+
+// RemoteKey is a private key held outside the process
+type RemoteKey interface {
+	PublicKey(ctx context.Context) (crypto.PublicKey, error)
+	// SignDigest signs a SHA-256 digest under alg, which is ES256 or RS256.
+	// ECDSA signatures must be ASN.1 DER encoded as crypto.Signer requires.
+	SignDigest(ctx context.Context, digest []byte, alg jwa.SignatureAlgorithm) ([]byte, error)
+}
+
+// NamedKey is a RemoteKey with a name identifying it in the service, e.g.
+// an AWS key ARN
+type NamedKey interface {
+	RemoteKey
+	// KeyName returns the name of the key the public key was fetched for
+	KeyName() string
+}
+
+// Signer is a crypto.Signer backed by a RemoteKey
+type Signer struct {
+	key     RemoteKey
+	public  crypto.PublicKey
+	alg     jwa.SignatureAlgorithm
+	Timeout time.Duration
+}
+
+var _ crypto.Signer = (*Signer)(nil)
+
+// NewSigner fetches the public key of the remote key. Only P-256 ECDSA keys,
+// used with ES256, and RSA keys, used with RS256, are supported.
+func NewSigner(ctx context.Context, key RemoteKey) (*Signer, error) {
+	public, err := key.PublicKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key of remote key: %w", err)
+	}
+	alg, err := AlgorithmOf(public)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		key:     key,
+		public:  public,
+		alg:     alg,
+		Timeout: DefaultSignTimeout,
+	}, nil
+}
+
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Algorithm returns the algorithm signatures are made under
+func (s *Signer) Algorithm() jwa.SignatureAlgorithm {
+	return s.alg
+}
+
+// KeyID returns the kid to publish the key under, see KeyID
+func (s *Signer) KeyID() (string, error) {
+	return KeyID(s.public)
+}
+
+// KeyName returns the name of the key in the service: the key ARN for
+// AWSKey, the key version name for GCPKey and the key identifier, its URL
+// with the version, for AzureKey. It is empty if the RemoteKey isn't a
+// NamedKey. It can be used as kid instead of KeyID so the kid tells which
+// KMS key signed, but then changes if the key is moved to another service.
+func (s *Signer) KeyName() string {
+	if named, ok := s.key.(NamedKey); ok {
+		return named.KeyName()
+	}
+	return ""
+}
+
+// Sign signs with a context bounded by Timeout, see SignContext
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	return s.SignContext(ctx, digest, opts)
+}
+
+// SignContext signs the digest with the remote key, retrying if the
+// service is throttling requests or temporarily unavailable, until ctx is
+// done
+func (s *Signer) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("RSA-PSS signatures are not supported")
+	}
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash function: %v, expected SHA-256", opts.HashFunc())
+	}
+	if len(digest) != crypto.SHA256.Size() {
+		return nil, fmt.Errorf("digest is %d bytes, expected %d", len(digest), crypto.SHA256.Size())
+	}
+
+	delay := signRetryDelay
+	for attempt := 0; ; attempt++ {
+		sig, err := s.key.SignDigest(ctx, digest, s.alg)
+		if err == nil {
+			return sig, nil
+		}
+		if attempt == signRetries || !retryable(err) {
+			return nil, fmt.Errorf("remote key failed to sign: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("remote key failed to sign: %w", errors.Join(err, ctx.Err()))
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// KeyID derives a kid from a public key as its base64url encoded JWK SHA-256
+// thumbprint (RFC 7638), so the kid stays the same however the key is
+// stored.
+func KeyID(public crypto.PublicKey) (string, error) {
+	jwkKey, err := jwk.PublicKeyOf(public)
+	if err != nil {
+		return "", err
+	}
+	thumbprint, err := jwkKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return string(util.Base64EncodeForJWT(thumbprint)), nil
+}
+
+// AlgorithmOf returns the algorithm used to sign with a key
+func AlgorithmOf(public crypto.PublicKey) (jwa.SignatureAlgorithm, error) {
+	switch public := public.(type) {
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported ECDSA curve: %s", public.Curve.Params().Name)
+		}
+		return jwa.ES256, nil
+	case *rsa.PublicKey:
+		return jwa.RS256, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", public)
+	}
+}
+
+// RawECDSAToASN1 converts an ECDSA signature in the raw r || s form used by
+// JWS, Azure Key Vault and PKCS #11 to the ASN.1 DER form crypto.Signer
+// returns
+func RawECDSAToASN1(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("raw ECDSA signature has invalid length: %d", len(raw))
+	}
+	half := len(raw) / 2
+	return asn1.Marshal(struct {
+		R *big.Int
+		S *big.Int
+	}{
+		R: new(big.Int).SetBytes(raw[:half]),
+		S: new(big.Int).SetBytes(raw[half:]),
+	})
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func genKeys(t *testing.T) []crypto.Signer {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return []crypto.Signer{ecKey, rsaKey}
+}
+
+func signDigest(t *testing.T, key crypto.Signer, digest []byte) []byte {
+	sig, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(t, err)
+	return sig
+}
+
+func TestRemoteKeys(t *testing.T) {
+	for _, key := range genKeys(t) {
+		spki, err := x509.MarshalPKIXPublicKey(key.Public())
+		require.NoError(t, err)
+
+		gcpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/projects/p/cryptoKeyVersions/1/publicKey":
+				json.NewEncoder(w).Encode(map[string]string{
+					"pem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: spki})),
+				})
+			case "/v1/projects/p/cryptoKeyVersions/1:asymmetricSign":
+				var req struct {
+					Digest struct {
+						Sha256 []byte `json:"sha256"`
+					} `json:"digest"`
+				}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				json.NewEncoder(w).Encode(map[string][]byte{"signature": signDigest(t, key, req.Digest.Sha256)})
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer gcpServer.Close()
+
+		azureServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, azureAPIVersion, r.URL.Query().Get("api-version"))
+			switch r.URL.Path {
+			case "/keys/cos":
+				jwkKey, err := jwk.PublicKeyOf(key.Public())
+				require.NoError(t, err)
+				require.NoError(t, jwkKey.Set(jwk.KeyIDKey, "https://vault/keys/cos/v2"))
+				json.NewEncoder(w).Encode(map[string]any{"key": jwkKey})
+			case "/keys/cos/v2/sign":
+				var req struct {
+					Alg   string `json:"alg"`
+					Value string `json:"value"`
+				}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				digest, err := util.Base64DecodeForJWT([]byte(req.Value))
+				require.NoError(t, err)
+				sig := signDigest(t, key, digest)
+				if req.Alg == "ES256" {
+					// Key Vault returns raw r || s signatures
+					var p struct{ R, S *big.Int }
+					_, err := asn1.Unmarshal(sig, &p)
+					require.NoError(t, err)
+					sig = append(p.R.FillBytes(make([]byte, 32)), p.S.FillBytes(make([]byte, 32))...)
+				}
+				json.NewEncoder(w).Encode(map[string]string{"value": string(util.Base64EncodeForJWT(sig))})
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer azureServer.Close()
+
+		awsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+			require.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+			require.Equal(t, r.Header.Get("Authorization"), signV4(AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+				"us-east-1", "kms", r.Host, http.Header{
+					"Content-Type":         r.Header.Values("Content-Type"),
+					"X-Amz-Target":         r.Header.Values("X-Amz-Target"),
+					"X-Amz-Date":           r.Header.Values("X-Amz-Date"),
+					"X-Amz-Security-Token": r.Header.Values("X-Amz-Security-Token"),
+				}, body))
+
+			switch r.Header.Get("X-Amz-Target") {
+			case "TrentService.GetPublicKey":
+				json.NewEncoder(w).Encode(map[string]any{
+					"KeyId": "arn:aws:kms:us-east-1:111122223333:key/1234", "PublicKey": spki, "KeyUsage": "SIGN_VERIFY"})
+			case "TrentService.Sign":
+				var req struct {
+					KeyId       string
+					Message     []byte
+					MessageType string
+				}
+				require.NoError(t, json.Unmarshal(body, &req))
+				require.Equal(t, "arn:aws:kms:us-east-1:111122223333:key/1234", req.KeyId)
+				require.Equal(t, "DIGEST", req.MessageType)
+				json.NewEncoder(w).Encode(map[string][]byte{"Signature": signDigest(t, key, req.Message)})
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+			}
+		}))
+		defer awsServer.Close()
+
+		remoteKeys := map[string]RemoteKey{
+			"gcp":   &GCPKey{Name: "projects/p/cryptoKeyVersions/1", Endpoint: gcpServer.URL},
+			"azure": &AzureKey{VaultURL: azureServer.URL, Name: "cos"},
+			"aws": &AWSKey{KeyID: "alias/cosigner", Region: "us-east-1", Endpoint: awsServer.URL,
+				Credentials: AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}},
+		}
+		keyNames := map[string]string{
+			"gcp":   "projects/p/cryptoKeyVersions/1",
+			"azure": "https://vault/keys/cos/v2",
+			"aws":   "arn:aws:kms:us-east-1:111122223333:key/1234",
+		}
+		for name, remoteKey := range remoteKeys {
+			t.Run(name, func(t *testing.T) {
+				signer, err := NewSigner(context.Background(), remoteKey)
+				require.NoError(t, err)
+				require.Equal(t, keyNames[name], signer.KeyName())
+				expAlg, err := AlgorithmOf(key.Public())
+				require.NoError(t, err)
+				require.Equal(t, expAlg, signer.Algorithm())
+
+				kid, err := signer.KeyID()
+				require.NoError(t, err)
+				expKid, err := KeyID(key.Public())
+				require.NoError(t, err)
+				require.Equal(t, expKid, kid)
+
+				signed, err := jws.Sign([]byte("payload"), jws.WithKey(signer.Algorithm(), signer))
+				require.NoError(t, err)
+				_, err = jws.Verify(signed, jws.WithKey(signer.Algorithm(), key.Public()))
+				require.NoError(t, err)
+			})
+		}
+	}
+}
+
+func TestSignerRejectsUnsupportedOpts(t *testing.T) {
+	key := genKeys(t)[0]
+	signer := &Signer{public: key.Public(), alg: jwa.ES256, Timeout: DefaultSignTimeout}
+
+	digest := sha256.Sum256([]byte("payload"))
+	_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA384)
+	require.ErrorContains(t, err, "unsupported hash function")
+	_, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+	require.ErrorContains(t, err, "RSA-PSS signatures are not supported")
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = AlgorithmOf(p384Key.Public())
+	require.ErrorContains(t, err, "unsupported ECDSA curve")
+}
+
+// localKey is a RemoteKey that signs in process, failing with the errors
+// in failures first
+type localKey struct {
+	key      crypto.Signer
+	failures []error
+	calls    int
+}
+
+func (k *localKey) PublicKey(context.Context) (crypto.PublicKey, error) {
+	return k.key.Public(), nil
+}
+
+func (k *localKey) SignDigest(_ context.Context, digest []byte, _ jwa.SignatureAlgorithm) ([]byte, error) {
+	k.calls++
+	if len(k.failures) > 0 {
+		err := k.failures[0]
+		k.failures = k.failures[1:]
+		return nil, err
+	}
+	return k.key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+func TestSignerRetries(t *testing.T) {
+	key := genKeys(t)[0]
+	digest := sha256.Sum256([]byte("payload"))
+	throttled := &httpError{StatusCode: http.StatusTooManyRequests, msg: "throttled"}
+
+	remoteKey := &localKey{key: key, failures: []error{throttled, &httpError{StatusCode: http.StatusServiceUnavailable}}}
+	signer, err := NewSigner(context.Background(), remoteKey)
+	require.NoError(t, err)
+	require.Empty(t, signer.KeyName())
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.True(t, ecdsa.VerifyASN1(key.Public().(*ecdsa.PublicKey), digest[:], sig))
+	require.Equal(t, 3, remoteKey.calls)
+
+	remoteKey = &localKey{key: key, failures: []error{&httpError{StatusCode: http.StatusForbidden, msg: "denied"}}}
+	signer, err = NewSigner(context.Background(), remoteKey)
+	require.NoError(t, err)
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.ErrorContains(t, err, "denied")
+	require.Equal(t, 1, remoteKey.calls)
+
+	remoteKey = &localKey{key: key, failures: []error{throttled, throttled}}
+	signer, err = NewSigner(context.Background(), remoteKey)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = signer.SignContext(ctx, digest[:], crypto.SHA256)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientWithSigner(t *testing.T) {
+	for _, key := range genKeys(t) {
+		signer, err := NewSigner(context.Background(), &localKey{key: key})
+		require.NoError(t, err)
+		op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+		require.NoError(t, err)
+		opkClient, err := client.New(op, client.WithSigner(signer, signer.Algorithm()))
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+
+		v, err := verifier.New(op)
+		require.NoError(t, err)
+		require.NoError(t, v.VerifyPKToken(context.Background(), pkt))
+		cic, err := pkt.GetCicValues()
+		require.NoError(t, err)
+		require.Equal(t, signer.Algorithm(), cic.PublicKey().Algorithm())
+	}
+}
@@ -17,6 +17,7 @@
 package mocks
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -29,15 +30,38 @@ import (
 	"github.com/openpubkey/openpubkey/pktoken"
 )
 
+// DefaultAuthcodeTTL is how long an authcode can be redeemed for after it is
+// issued when no AuthcodeTTL is set
+const DefaultAuthcodeTTL = time.Minute
+
+// redeemedAuthStateTTL bounds how long an auth session is kept after its
+// authcode is redeemed, as it can no longer be used to get a signature
+const redeemedAuthStateTTL = time.Minute
+
 // This is intended for testing purposes. The locking strategy used is not
 // particularly efficient. Anyone building a Cosigner should use the interface
 // above to replace this in-memory store with a database.
+//
+// Auth sessions expire AuthStateTTL after they are created and authcodes
+// AuthcodeTTL after they are issued. Expired entries can't be used and are
+// deleted when looked up or by Reap, run StartReaper to remove entries that
+// are never looked up again.
 type AuthStateInMemoryStore struct {
 	AuthIDIssuer     *cosigner.AuthIDIssuer
 	AuthStateMap     map[string]*cosigner.AuthState
 	AuthCodeMap      map[string]string
 	AuthStateMapLock sync.RWMutex
 	AuthcodeMapLock  sync.RWMutex
+	AuthStateTTL     time.Duration
+	AuthcodeTTL      time.Duration
+
+	authStateExpiry map[string]time.Time // guarded by AuthStateMapLock
+	authcodeExpiry  map[string]time.Time // guarded by AuthcodeMapLock
+	// redeemed remembers redeemed authcodes until they would have expired,
+	// so that redeeming one again is reported as such. Guarded by
+	// AuthcodeMapLock.
+	redeemed map[string]time.Time
+	now      func() time.Time
 }
 
 func NewAuthStateInMemoryStore(hmacKey []byte) *AuthStateInMemoryStore {
@@ -47,14 +71,20 @@ func NewAuthStateInMemoryStore(hmacKey []byte) *AuthStateInMemoryStore {
 		AuthcodeMapLock:  sync.RWMutex{},
 		AuthStateMapLock: sync.RWMutex{},
 		AuthIDIssuer:     cosigner.NewAuthIDIssuer(hmacKey),
+		AuthStateTTL:     cosigner.DefaultAuthStateTTL,
+		AuthcodeTTL:      DefaultAuthcodeTTL,
+		authStateExpiry:  make(map[string]time.Time),
+		authcodeExpiry:   make(map[string]time.Time),
+		redeemed:         make(map[string]time.Time),
+		now:              time.Now,
 	}
 }
 
 // Writes to the AuthState are not concurrency safe, do not write
 func (s *AuthStateInMemoryStore) LookupAuthState(authID string) (*cosigner.AuthState, bool) {
-	s.AuthStateMapLock.RLock()
-	as, ok := s.AuthStateMap[authID]
-	s.AuthStateMapLock.RUnlock()
+	s.AuthStateMapLock.Lock()
+	as, ok := s.lookupAuthState(authID)
+	s.AuthStateMapLock.Unlock()
 	return as, ok // Pass by value to prevent writes to the original
 }
 
@@ -62,7 +92,7 @@ func (s *AuthStateInMemoryStore) UpdateAuthState(authID string, authState cosign
 	s.AuthStateMapLock.Lock()
 	defer s.AuthStateMapLock.Unlock()
 
-	if _, ok := s.AuthStateMap[authID]; !ok {
+	if _, ok := s.lookupAuthState(authID); !ok {
 		return fmt.Errorf("failed to upload auth session because authID specified matches no session")
 	} else {
 		s.AuthStateMap[authID] = &authState
@@ -119,11 +149,12 @@ func (s *AuthStateInMemoryStore) CreateNewAuthSession(pkt *pktoken.PKToken, ruri
 		return "", err
 	} else {
 		s.AuthStateMapLock.Lock()
-		if _, ok := s.AuthStateMap[authID]; ok {
+		defer s.AuthStateMapLock.Unlock()
+		if _, ok := s.lookupAuthState(authID); ok {
 			return "", fmt.Errorf("specified authID is already in use")
 		}
 		s.AuthStateMap[authID] = authState
-		s.AuthStateMapLock.Unlock()
+		s.authStateExpiry[authID] = s.now().Add(s.AuthStateTTL)
 		return authID, nil
 	}
 }
@@ -139,7 +170,7 @@ func (s *AuthStateInMemoryStore) CreateAuthcode(authID string) (string, error) {
 	s.AuthStateMapLock.Lock()
 	defer s.AuthStateMapLock.Unlock()
 
-	if authState, ok := s.AuthStateMap[authID]; !ok {
+	if authState, ok := s.lookupAuthState(authID); !ok {
 		return "", fmt.Errorf("no such authID")
 	} else if authState.AuthcodeIssued {
 		return "", fmt.Errorf("authcode already issued for this authID")
@@ -152,22 +183,36 @@ func (s *AuthStateInMemoryStore) CreateAuthcode(authID string) (string, error) {
 		}
 		authState.AuthcodeIssued = true
 		s.AuthCodeMap[authcode] = authID
+		s.authcodeExpiry[authcode] = s.now().Add(s.AuthcodeTTL)
 
 		return authcode, nil
 	}
 }
 
+// RedeemAuthcode deletes the authcode so that it can only be redeemed once
 func (s *AuthStateInMemoryStore) RedeemAuthcode(authcode string) (cosigner.AuthState, string, error) {
-	s.AuthcodeMapLock.RLock()
+	s.AuthcodeMapLock.Lock()
 	authID, authcodeFound := s.AuthCodeMap[authcode]
-	s.AuthcodeMapLock.RUnlock()
-	if !authcodeFound {
+	expiration := s.authcodeExpiry[authcode]
+	_, alreadyRedeemed := s.redeemed[authcode]
+	if authcodeFound {
+		delete(s.AuthCodeMap, authcode)
+		delete(s.authcodeExpiry, authcode)
+		s.redeemed[authcode] = expiration
+	}
+	s.AuthcodeMapLock.Unlock()
+	if alreadyRedeemed {
+		return cosigner.AuthState{}, "", fmt.Errorf("authcode has already been redeemed")
+	} else if !authcodeFound || !s.now().Before(expiration) {
 		return cosigner.AuthState{}, "", fmt.Errorf("invalid authcode")
 	} else {
 		s.AuthStateMapLock.Lock()
 		defer s.AuthStateMapLock.Unlock()
 
-		authState := s.AuthStateMap[authID]
+		authState, ok := s.lookupAuthState(authID)
+		if !ok {
+			return cosigner.AuthState{}, "", fmt.Errorf("auth session has expired")
+		}
 		if !authState.AuthcodeIssued {
 			// This should never happen
 			return cosigner.AuthState{}, "", fmt.Errorf("no authcode issued for this authID")
@@ -176,6 +221,77 @@ func (s *AuthStateInMemoryStore) RedeemAuthcode(authcode string) (cosigner.AuthS
 			return cosigner.AuthState{}, "", fmt.Errorf("authcode has already been redeemed")
 		}
 		authState.AuthcodeRedeemed = true
+		if redeemedExpiration := s.now().Add(redeemedAuthStateTTL); redeemedExpiration.Before(s.authStateExpiry[authID]) {
+			s.authStateExpiry[authID] = redeemedExpiration
+		}
 		return *authState, authID, nil
 	}
 }
+
+// Reap deletes expired auth sessions and authcodes and returns how many
+// entries it deleted
+func (s *AuthStateInMemoryStore) Reap() int {
+	now := s.now()
+	reaped := 0
+
+	s.AuthStateMapLock.Lock()
+	for authID, expiration := range s.authStateExpiry {
+		if !now.Before(expiration) {
+			delete(s.AuthStateMap, authID)
+			delete(s.authStateExpiry, authID)
+			reaped++
+		}
+	}
+	s.AuthStateMapLock.Unlock()
+
+	s.AuthcodeMapLock.Lock()
+	for authcode, expiration := range s.authcodeExpiry {
+		if !now.Before(expiration) {
+			delete(s.AuthCodeMap, authcode)
+			delete(s.authcodeExpiry, authcode)
+			reaped++
+		}
+	}
+	for authcode, expiration := range s.redeemed {
+		if !now.Before(expiration) {
+			delete(s.redeemed, authcode)
+			reaped++
+		}
+	}
+	s.AuthcodeMapLock.Unlock()
+	return reaped
+}
+
+// StartReaper runs Reap every interval in the background until ctx is
+// cancelled, so that a long-running cosigner doesn't accumulate auth
+// sessions that were abandoned
+func (s *AuthStateInMemoryStore) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Reap()
+			}
+		}
+	}()
+}
+
+// lookupAuthState returns the unexpired auth session, deleting it if it has
+// expired. The caller must hold AuthStateMapLock for writing.
+func (s *AuthStateInMemoryStore) lookupAuthState(authID string) (*cosigner.AuthState, bool) {
+	authState, ok := s.AuthStateMap[authID]
+	if !ok {
+		return nil, false
+	}
+	// Entries added directly to AuthStateMap have no expiry
+	if expiration, ok := s.authStateExpiry[authID]; ok && !s.now().Before(expiration) {
+		delete(s.AuthStateMap, authID)
+		delete(s.authStateExpiry, authID)
+		return nil, false
+	}
+	return authState, true
+}
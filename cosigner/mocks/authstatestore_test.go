@@ -0,0 +1,143 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newStore(t *testing.T) (*AuthStateInMemoryStore, *clock) {
+	store := NewAuthStateInMemoryStore([]byte("hmac-key"))
+	c := &clock{now: time.Now()}
+	store.now = c.Now
+	return store, c
+}
+
+func newAuthSession(t *testing.T, store *AuthStateInMemoryStore) string {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	authID, err := store.CreateNewAuthSession(pkt, "http://localhost:5555/mfaredirect", "test-nonce")
+	require.NoError(t, err)
+	return authID
+}
+
+func TestAuthStateExpires(t *testing.T) {
+	store, c := newStore(t)
+	authID := newAuthSession(t, store)
+
+	c.now = c.now.Add(store.AuthStateTTL - time.Second)
+	_, ok := store.LookupAuthState(authID)
+	require.True(t, ok)
+
+	c.now = c.now.Add(time.Second)
+	_, ok = store.LookupAuthState(authID)
+	require.False(t, ok)
+	require.Empty(t, store.AuthStateMap)
+
+	_, err := store.CreateAuthcode(authID)
+	require.ErrorContains(t, err, "no such authID")
+}
+
+func TestAuthcodeExpires(t *testing.T) {
+	store, c := newStore(t)
+	authID := newAuthSession(t, store)
+
+	authcode, err := store.CreateAuthcode(authID)
+	require.NoError(t, err)
+
+	c.now = c.now.Add(store.AuthcodeTTL)
+	_, _, err = store.RedeemAuthcode(authcode)
+	require.ErrorContains(t, err, "invalid authcode")
+}
+
+func TestAuthcodeRedeemedOnce(t *testing.T) {
+	store, _ := newStore(t)
+	authID := newAuthSession(t, store)
+
+	authcode, err := store.CreateAuthcode(authID)
+	require.NoError(t, err)
+
+	authState, redeemedAuthID, err := store.RedeemAuthcode(authcode)
+	require.NoError(t, err)
+	require.Equal(t, authID, redeemedAuthID)
+	require.True(t, authState.AuthcodeRedeemed)
+	require.NotContains(t, store.AuthCodeMap, authcode)
+
+	_, _, err = store.RedeemAuthcode(authcode)
+	require.ErrorContains(t, err, "authcode has already been redeemed")
+}
+
+func TestReap(t *testing.T) {
+	store, c := newStore(t)
+	redeemedAuthID := newAuthSession(t, store)
+	authcode, err := store.CreateAuthcode(redeemedAuthID)
+	require.NoError(t, err)
+	_, _, err = store.RedeemAuthcode(authcode)
+	require.NoError(t, err)
+
+	issuedAuthID := newAuthSession(t, store)
+	_, err = store.CreateAuthcode(issuedAuthID)
+	require.NoError(t, err)
+
+	c.now = c.now.Add(time.Minute)
+	// The redeemed session, its authcode and the unredeemed authcode expire
+	// after a minute
+	require.Equal(t, 3, store.Reap())
+	require.Len(t, store.AuthStateMap, 1)
+	require.Contains(t, store.AuthStateMap, issuedAuthID)
+	require.Empty(t, store.AuthCodeMap)
+
+	c.now = c.now.Add(store.AuthStateTTL)
+	require.Equal(t, 1, store.Reap())
+	require.Empty(t, store.AuthStateMap)
+	require.Equal(t, 0, store.Reap())
+}
+
+func TestStartReaper(t *testing.T) {
+	store, c := newStore(t)
+	newAuthSession(t, store)
+	c.now = c.now.Add(store.AuthStateTTL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.StartReaper(ctx, time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		store.AuthStateMapLock.RLock()
+		defer store.AuthStateMapLock.RUnlock()
+		return len(store.AuthStateMap) == 0
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,237 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/server"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// Decision is how MockCosigner responds to a user authenticating
+type Decision struct {
+	// Delay is how long the user takes to authenticate
+	Delay time.Duration
+	// Deny fails the authentication. In the redirect flow the browser is
+	// sent to the client's callback without an authcode, so the client
+	// returns an error. In the device flow the client keeps polling until
+	// its context is done.
+	Deny bool
+	// Reason is the error returned to the browser when denying
+	Reason string
+}
+
+// Approve authenticates the user straight away
+var Approve = Decision{}
+
+// Deny returns a Decision denying the user with reason
+func Deny(reason string) Decision {
+	return Decision{Deny: true, Reason: reason}
+}
+
+// Delay returns a Decision approving the user after d
+func Delay(d time.Duration) Decision {
+	return Decision{Delay: d}
+}
+
+// MockCosigner is an in-process cosigner serving the wire protocol of
+// cosigner/server over httptest, with an MFA page that approves or denies
+// users as scripted instead of authenticating them. It lets tests of
+// cosigner-required flows run without a browser or the example web server.
+type MockCosigner struct {
+	*cosigner.AuthCosigner
+	Server *httptest.Server
+	// CallbackPath is the callback path of CosignerProvider
+	CallbackPath string
+
+	lock      sync.Mutex
+	script    []Decision
+	decisions int
+}
+
+// NewMockCosigner starts a MockCosigner which is shut down when the test
+// ends. Users are authenticated with the decisions of script in order and
+// approved once the script is used up.
+func NewMockCosigner(t testing.TB, script ...Decision) (*MockCosigner, error) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return nil, err
+	}
+	hmacKey := make([]byte, 64)
+	if _, err := rand.Read(hmacKey); err != nil {
+		return nil, err
+	}
+
+	m := &MockCosigner{
+		CallbackPath: "/mfaredirect",
+		script:       script,
+	}
+	// The issuer is the URL of the server, so the server is started before
+	// the cosigner it serves is created
+	var handler http.Handler
+	ready := make(chan struct{})
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-ready
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(m.Server.Close)
+
+	m.AuthCosigner, err = cosigner.New(signer, alg, m.Server.URL, "mock-cosigner", NewAuthStateInMemoryStore(hmacKey))
+	if err != nil {
+		return nil, err
+	}
+	// Device flow clients poll every second, the shortest interval the
+	// protocol can express
+	handler = server.NewHandler(m.AuthCosigner, http.HandlerFunc(m.mfa), server.WithDeviceInterval(time.Second))
+	close(ready)
+	return m, nil
+}
+
+// Script appends decisions to the script
+func (m *MockCosigner) Script(decisions ...Decision) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.script = append(m.script, decisions...)
+}
+
+// Decisions returns how many times a user has been approved or denied
+func (m *MockCosigner) Decisions() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.decisions
+}
+
+// PublicKey returns the public key cosigner signatures are verified with
+func (m *MockCosigner) PublicKey() crypto.PublicKey {
+	return m.Signer.Public()
+}
+
+// CosignerProvider returns a client.CosignerProvider for the MockCosigner,
+// pass it to client.WithCosignerProvider
+func (m *MockCosigner) CosignerProvider() *client.CosignerProvider {
+	return &client.CosignerProvider{
+		Issuer:       m.Issuer,
+		CallbackPath: m.CallbackPath,
+	}
+}
+
+// Cosign runs cosP.RequestToken for pkt, acting as the user's browser, and
+// returns the cosigned PK Token. If cosP is nil, CosignerProvider is used.
+func (m *MockCosigner) Cosign(ctx context.Context, cosP *client.CosignerProvider, pkt *pktoken.PKToken, signer crypto.Signer) (*pktoken.PKToken, error) {
+	if cosP == nil {
+		cosP = m.CosignerProvider()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The client reports why cosigning failed, so errors of the browser,
+	// e.g. the callback page of a denied login, are ignored
+	redirCh := make(chan string)
+	go Browser(ctx, redirCh)
+	return cosP.RequestToken(ctx, signer, pkt, redirCh)
+}
+
+// Browser plays the user's browser: it opens the first URI sent on redirCh
+// and follows the redirects from there, as client.OpkClient does when the
+// OP's callback redirects the browser to the cosigner. It returns once the
+// final page has loaded.
+func Browser(ctx context.Context, redirCh <-chan string) error {
+	var uri string
+	select {
+	case uri = <-redirCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// The device flow keeps the user code in a cookie
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	res, err := (&http.Client{Jar: jar}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("browser got %s from %s", res.Status, res.Request.URL)
+	}
+	return nil
+}
+
+// mfa is the MFA page, it authenticates users with the next decision of
+// the script
+func (m *MockCosigner) mfa(w http.ResponseWriter, r *http.Request) {
+	authID := r.URL.Query().Get("authid")
+	authState, ok := m.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		http.Error(w, "no auth session found for authID", http.StatusBadRequest)
+		return
+	}
+
+	m.lock.Lock()
+	decision := Approve
+	if len(m.script) > 0 {
+		decision, m.script = m.script[0], m.script[1:]
+	}
+	m.decisions++
+	m.lock.Unlock()
+
+	select {
+	case <-time.After(decision.Delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	if decision.Deny {
+		// Without an authcode the client fails the login
+		ruri, err := url.Parse(authState.RedirectURI)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ruri.RawQuery = url.Values{"error": {"access_denied"}, "error_description": {decision.Reason}}.Encode()
+		http.Redirect(w, r, ruri.String(), http.StatusFound)
+		return
+	}
+
+	authcode, err := m.NewAuthcode(authID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s?authcode=%s", authState.RedirectURI, url.QueryEscape(authcode)), http.StatusFound)
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockCosigner(t *testing.T) {
+	mockCos, err := NewMockCosigner(t, Approve, Deny("not on the list"), Delay(50*time.Millisecond))
+	require.NoError(t, err)
+
+	cosign := func(t *testing.T, deviceFlow bool) error {
+		signer, err := util.GenKeyPair(jwa.ES256)
+		require.NoError(t, err)
+		pkt, err := pktmocks.GenerateMockPKToken(t, signer, jwa.ES256)
+		require.NoError(t, err)
+
+		cosP := mockCos.CosignerProvider()
+		cosP.DeviceFlow = deviceFlow
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cosPkt, err := mockCos.Cosign(ctx, cosP, pkt, signer)
+		if err != nil {
+			return err
+		}
+		_, err = jws.Verify(cosPkt.CosToken, jws.WithKey(jwa.ES256, mockCos.PublicKey()))
+		require.NoError(t, err)
+		return nil
+	}
+
+	require.NoError(t, cosign(t, false))
+	require.ErrorContains(t, cosign(t, false), "cosigner did not return an authcode")
+
+	start := time.Now()
+	require.NoError(t, cosign(t, false))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Once the script is used up users are approved
+	require.NoError(t, cosign(t, true))
+	require.Equal(t, 4, mockCos.Decisions())
+
+	mockCos.Script(Deny("locked out"))
+	require.Error(t, cosign(t, false))
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// This is intended for testing purposes. Anyone building a Cosigner should
+// replace this in-memory store with a database.
+type SessionInMemoryStore struct {
+	SessionMap     map[string]*cosigner.Session // authID -> session
+	SessionMapLock sync.RWMutex
+}
+
+func NewSessionInMemoryStore() *SessionInMemoryStore {
+	return &SessionInMemoryStore{
+		SessionMap: make(map[string]*cosigner.Session),
+	}
+}
+
+func (s *SessionInMemoryStore) AddSession(session cosigner.Session) error {
+	s.SessionMapLock.Lock()
+	defer s.SessionMapLock.Unlock()
+
+	if _, ok := s.SessionMap[session.AuthID]; ok {
+		return fmt.Errorf("session with authID already exists")
+	}
+	s.SessionMap[session.AuthID] = &session
+	return nil
+}
+
+func (s *SessionInMemoryStore) Sessions(filter cosigner.SessionFilter) ([]cosigner.Session, error) {
+	s.SessionMapLock.RLock()
+	defer s.SessionMapLock.RUnlock()
+
+	sessions := []cosigner.Session{}
+	for _, session := range s.SessionMap {
+		if filter.Matches(*session) {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *SessionInMemoryStore) Revoke(authID string, revokedAt time.Time) error {
+	s.SessionMapLock.Lock()
+	defer s.SessionMapLock.Unlock()
+
+	session, ok := s.SessionMap[authID]
+	if !ok {
+		return fmt.Errorf("no such authID")
+	}
+	if !session.Revoked {
+		session.Revoked = true
+		session.RevokedAt = revokedAt
+	}
+	return nil
+}
@@ -22,3 +22,22 @@ type InitMFAAuth struct {
 	TimeSigned  int64  `json:"time"`
 	Nonce       string `json:"nonce"`
 }
+
+// DeviceAuthorization is the cosigner's response to a device authorization
+// request, see the cosigner/server package
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceToken is the cosigner's response when polled with a device code.
+// Error is one of the RFC 8628 device access token error codes, e.g.
+// authorization_pending, until the user is authenticated.
+type DeviceToken struct {
+	Authcode string `json:"authcode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
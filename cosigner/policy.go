@@ -0,0 +1,119 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// ErrCosignDenied is wrapped by the errors of IssueSignature when the
+// cosigner's policy refuses to cosign a PK Token
+var ErrCosignDenied = errors.New("cosign policy denied")
+
+// CosignPolicy decides whether the cosigner signs a PK Token whose user has
+// completed MFA. Returning an error refuses to cosign it.
+type CosignPolicy interface {
+	CheckCosign(pkt *pktoken.PKToken, authState AuthState) error
+}
+
+// CosignPolicyFunc adapts a function to a CosignPolicy
+type CosignPolicyFunc func(pkt *pktoken.PKToken, authState AuthState) error
+
+func (f CosignPolicyFunc) CheckCosign(pkt *pktoken.PKToken, authState AuthState) error {
+	return f(pkt, authState)
+}
+
+// ClaimsPolicy is a CosignPolicy on the claims of the PK Token's ID Token.
+// Each field which is set must be matched, unset fields match anything.
+type ClaimsPolicy struct {
+	// Issuers the ID Token's iss must be one of
+	Issuers []string
+	// Audiences one of the ID Token's aud must be in
+	Audiences []string
+	// EmailDomains the domain of the ID Token's email must be one of. The
+	// email must not have email_verified set to false.
+	EmailDomains []string
+	// Groups one of the ID Token's groups must be in
+	Groups []string
+}
+
+func (p ClaimsPolicy) CheckCosign(pkt *pktoken.PKToken, _ AuthState) error {
+	var claims struct {
+		Issuer        string `json:"iss"`
+		Aud           any    `json:"aud"`
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+		Groups        any    `json:"groups"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return fmt.Errorf("failed to unmarshal PK Token: %w", err)
+	}
+
+	if len(p.Issuers) > 0 && !slices.Contains(p.Issuers, claims.Issuer) {
+		return fmt.Errorf("issuer (%s) is not allowed", claims.Issuer)
+	}
+	if len(p.Audiences) > 0 && !containsAny(p.Audiences, stringOrList(claims.Aud)) {
+		return fmt.Errorf("audience (%v) is not allowed", claims.Aud)
+	}
+	if len(p.EmailDomains) > 0 {
+		if claims.EmailVerified != nil && !*claims.EmailVerified {
+			return fmt.Errorf("email (%s) is not verified", claims.Email)
+		}
+		_, domain, ok := strings.Cut(claims.Email, "@")
+		if !ok || !slices.ContainsFunc(p.EmailDomains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return fmt.Errorf("email (%s) is not in an allowed domain", claims.Email)
+		}
+	}
+	if len(p.Groups) > 0 && !containsAny(p.Groups, stringOrList(claims.Groups)) {
+		return fmt.Errorf("groups (%v) are not allowed", claims.Groups)
+	}
+	return nil
+}
+
+// stringOrList returns the values of a claim which is either a string or
+// a list of strings, like aud
+func stringOrList(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := []string{}
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func containsAny(allowed []string, values []string) bool {
+	for _, v := range values {
+		if slices.Contains(allowed, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimsPolicy(t *testing.T) {
+	policy := cosigner.ClaimsPolicy{
+		Issuers:      []string{"https://accounts.google.com"},
+		Audiences:    []string{"client-a", "client-b"},
+		EmailDomains: []string{"example.com"},
+		Groups:       []string{"admins"},
+	}
+	allowed := map[string]any{
+		"iss":    "https://accounts.google.com",
+		"aud":    []string{"other", "client-b"},
+		"email":  "alice@Example.com",
+		"groups": []string{"users", "admins"},
+	}
+
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		expError string
+	}{
+		{name: "allowed", claims: map[string]any{}},
+		{name: "single group", claims: map[string]any{"groups": "admins"}},
+		{name: "wrong issuer", claims: map[string]any{"iss": "https://gitlab.com"},
+			expError: "issuer (https://gitlab.com) is not allowed"},
+		{name: "wrong audience", claims: map[string]any{"aud": "client-c"},
+			expError: "audience (client-c) is not allowed"},
+		{name: "wrong email domain", claims: map[string]any{"email": "mallory@example.com.evil"},
+			expError: "is not in an allowed domain"},
+		{name: "missing email", claims: map[string]any{"email": nil},
+			expError: "is not in an allowed domain"},
+		{name: "unverified email", claims: map[string]any{"email_verified": false},
+			expError: "email (alice@Example.com) is not verified"},
+		{name: "missing groups", claims: map[string]any{"groups": nil},
+			expError: "groups (<nil>) are not allowed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := map[string]any{}
+			for k, v := range allowed {
+				claims[k] = v
+			}
+			for k, v := range tc.claims {
+				claims[k] = v
+			}
+			payload, err := json.Marshal(claims)
+			require.NoError(t, err)
+
+			err = policy.CheckCosign(&pktoken.PKToken{Payload: payload}, cosigner.AuthState{})
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	// An empty policy allows anything
+	require.NoError(t, cosigner.ClaimsPolicy{}.CheckCosign(&pktoken.PKToken{Payload: []byte("{}")}, cosigner.AuthState{}))
+}
+
+func TestIssueSignaturePolicy(t *testing.T) {
+	cos := CreateAuthCosigner(t)
+
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+	authState, err := cosigner.NewAuthState(pkt, "http://localhost:5555/mfaredirect", "nonce")
+	require.NoError(t, err)
+
+	var checked cosigner.AuthState
+	cos.Policy = cosigner.CosignPolicyFunc(func(_ *pktoken.PKToken, authState cosigner.AuthState) error {
+		checked = authState
+		return fmt.Errorf("subject (%s) is not allowed", authState.Sub)
+	})
+	cosSig, err := cos.IssueSignature(pkt, *authState, "authID")
+	require.ErrorIs(t, err, cosigner.ErrCosignDenied)
+	require.ErrorContains(t, err, "subject (me) is not allowed")
+	require.Nil(t, cosSig)
+	require.Equal(t, *authState, checked)
+
+	cos.Policy = cosigner.CosignPolicyFunc(func(*pktoken.PKToken, cosigner.AuthState) error { return nil })
+	cosSig, err = cos.IssueSignature(pkt, *authState, "authID")
+	require.NoError(t, err)
+	require.NotNil(t, cosSig)
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pushcosigner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Device is a mobile device registered by a user to approve cosigning
+// requests out-of-band.
+type Device struct {
+	ID       string // Identifier assigned to the device by the push provider
+	Endpoint string // Address the push provider uses to reach the device
+}
+
+// ApprovalRequest is the message sent to a user's device asking them to
+// approve or deny a cosigning request.
+type ApprovalRequest struct {
+	AuthID        string `json:"auth_id"`
+	ApprovalToken string `json:"approval_token"`
+	Issuer        string `json:"iss"`
+	Username      string `json:"username"`
+	Expiration    int64  `json:"exp"`
+}
+
+// Notifier delivers approval requests to a registered device. Implement
+// this interface to integrate with a push provider such as APNs or FCM.
+type Notifier interface {
+	Notify(ctx context.Context, device Device, req ApprovalRequest) error
+}
+
+// WebhookNotifier is a Notifier that POSTs the approval request as JSON to
+// the endpoint of the device.
+type WebhookNotifier struct {
+	HttpClient *http.Client
+}
+
+var _ Notifier = (*WebhookNotifier)(nil)
+
+func (n *WebhookNotifier) Notify(ctx context.Context, device Device, req ApprovalRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, device.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpClient := n.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send approval request to device %s: %w", device.ID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook for device %s returned unexpected status code: %d", device.ID, resp.StatusCode)
+	}
+	return nil
+}
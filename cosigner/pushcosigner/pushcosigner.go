@@ -0,0 +1,243 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pushcosigner
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// DefaultApprovalTimeout is how long a user has to respond to an approval
+// request sent to their device.
+const DefaultApprovalTimeout = 2 * time.Minute
+
+type pendingApproval struct {
+	token      string
+	expiration time.Time
+}
+
+// approvalResult receives the authcode on approval and is closed on
+// denial. It is kept until a waiter has collected it.
+type approvalResult struct {
+	ch      chan string
+	waiting bool
+}
+
+// PushCosigner is a cosigner that authenticates users by sending an
+// approval request to a registered mobile device rather than requiring a
+// browser on the machine running the client. Once the user approves on their
+// device an authcode is issued which the client redeems as usual.
+type PushCosigner struct {
+	*cosigner.AuthCosigner
+	Notifier        Notifier
+	ApprovalTimeout time.Duration
+
+	lock    sync.Mutex
+	devices map[cosigner.UserKey]Device
+	pending map[string]pendingApproval
+	results map[string]*approvalResult
+}
+
+func New(signer crypto.Signer, alg jwa.SignatureAlgorithm, issuer, keyID string, store cosigner.AuthStateStore, notifier Notifier) (*PushCosigner, error) {
+	authCos, err := cosigner.New(signer, alg, issuer, keyID, store)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushCosigner{
+		AuthCosigner:    authCos,
+		Notifier:        notifier,
+		ApprovalTimeout: DefaultApprovalTimeout,
+		devices:         make(map[cosigner.UserKey]Device),
+		pending:         make(map[string]pendingApproval),
+		results:         make(map[string]*approvalResult),
+	}, nil
+}
+
+// RegisterDevice associates a device with a user. Any previously registered
+// device for that user is replaced.
+func (c *PushCosigner) RegisterDevice(userKey cosigner.UserKey, device Device) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.devices[userKey] = device
+}
+
+func (c *PushCosigner) IsRegistered(userKey cosigner.UserKey) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.devices[userKey]
+	return ok
+}
+
+// RequestApproval sends an approval request for the auth session to the
+// user's registered device.
+func (c *PushCosigner) RequestApproval(ctx context.Context, authID string) error {
+	authState, ok := c.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		return fmt.Errorf("no auth session found for authID")
+	}
+
+	c.lock.Lock()
+	device, ok := c.devices[authState.UserKey()]
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no device registered for user %s", authState.Username)
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	expiration := time.Now().Add(c.ApprovalTimeout)
+
+	c.lock.Lock()
+	c.pending[authID] = pendingApproval{token: token, expiration: expiration}
+	c.results[authID] = &approvalResult{ch: make(chan string, 1)}
+	c.lock.Unlock()
+
+	req := ApprovalRequest{
+		AuthID:        authID,
+		ApprovalToken: token,
+		Issuer:        c.Issuer,
+		Username:      authState.Username,
+		Expiration:    expiration.Unix(),
+	}
+	if err := c.Notifier.Notify(ctx, device, req); err != nil {
+		c.lock.Lock()
+		delete(c.pending, authID)
+		delete(c.results, authID)
+		c.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Approve is called when the user approves the request on their device. It
+// returns an authcode and the redirect URI the authcode should be sent to.
+func (c *PushCosigner) Approve(authID string, approvalToken string) (string, string, error) {
+	if err := c.consumePending(authID, approvalToken); err != nil {
+		return "", "", err
+	}
+
+	authState, ok := c.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		return "", "", fmt.Errorf("no auth session found for authID")
+	}
+	authcode, err := c.NewAuthcode(authID)
+	if err != nil {
+		return "", "", err
+	}
+
+	c.lock.Lock()
+	if result, ok := c.results[authID]; ok {
+		result.ch <- authcode
+		close(result.ch)
+		if result.waiting {
+			delete(c.results, authID)
+		}
+	}
+	c.lock.Unlock()
+
+	return authcode, authState.RedirectURI, nil
+}
+
+// Deny is called when the user rejects the request on their device. The
+// pending approval is discarded so it can no longer be approved.
+func (c *PushCosigner) Deny(authID string, approvalToken string) error {
+	if err := c.consumePending(authID, approvalToken); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if result, ok := c.results[authID]; ok {
+		close(result.ch)
+		if result.waiting {
+			delete(c.results, authID)
+		}
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// WaitForApproval blocks until the user approves or denies the request for
+// the auth session or the context is cancelled. On approval the authcode is
+// returned. It may be called before or after the user responds, but only a
+// single caller may wait on a given auth session.
+func (c *PushCosigner) WaitForApproval(ctx context.Context, authID string) (string, error) {
+	c.lock.Lock()
+	result, ok := c.results[authID]
+	if !ok {
+		c.lock.Unlock()
+		return "", fmt.Errorf("no approval requested for authID")
+	}
+	if result.waiting {
+		c.lock.Unlock()
+		return "", fmt.Errorf("already waiting for approval of authID")
+	}
+	result.waiting = true
+	c.lock.Unlock()
+
+	select {
+	case authcode, ok := <-result.ch:
+		c.forgetResult(authID, result)
+		if !ok {
+			return "", fmt.Errorf("approval request was denied")
+		}
+		return authcode, nil
+	case <-ctx.Done():
+		c.forgetResult(authID, result)
+		return "", ctx.Err()
+	}
+}
+
+// forgetResult removes the result of an auth session once its waiter is
+// done with it, unless the session has since been replaced
+func (c *PushCosigner) forgetResult(authID string, result *approvalResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.results[authID] == result {
+		delete(c.results, authID)
+	}
+}
+
+func (c *PushCosigner) consumePending(authID string, approvalToken string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending, ok := c.pending[authID]
+	if !ok {
+		return fmt.Errorf("no pending approval for authID")
+	}
+	if subtle.ConstantTimeCompare([]byte(pending.token), []byte(approvalToken)) != 1 {
+		return fmt.Errorf("invalid approval token")
+	}
+	delete(c.pending, authID)
+	if time.Now().After(pending.expiration) {
+		return fmt.Errorf("approval request expired")
+	}
+	return nil
+}
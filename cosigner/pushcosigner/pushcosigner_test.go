@@ -0,0 +1,239 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pushcosigner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	cosmocks "github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+type mockNotifier struct {
+	requests chan ApprovalRequest
+}
+
+func (n *mockNotifier) Notify(_ context.Context, _ Device, req ApprovalRequest) error {
+	n.requests <- req
+	return nil
+}
+
+func TestPushFlow(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	cosSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	notifier := &mockNotifier{requests: make(chan ApprovalRequest, 1)}
+	store := cosmocks.NewAuthStateInMemoryStore([]byte("hmac-key"))
+	cos, err := New(cosSigner, alg, "https://example.com", "test-kid", store, notifier)
+	require.NoError(t, err)
+
+	cosP := client.CosignerProvider{
+		Issuer:       "https://example.com",
+		CallbackPath: "/mfaredirect",
+	}
+	redirectURI := fmt.Sprintf("%s%s", "http://localhost:5555", cosP.CallbackPath)
+
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig(redirectURI)
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+
+	// No device registered yet
+	err = cos.RequestApproval(context.Background(), authID)
+	require.ErrorContains(t, err, "no device registered")
+
+	authState, ok := store.LookupAuthState(authID)
+	require.True(t, ok)
+	cos.RegisterDevice(authState.UserKey(), Device{ID: "phone"})
+	require.True(t, cos.IsRegistered(authState.UserKey()))
+
+	err = cos.RequestApproval(context.Background(), authID)
+	require.NoError(t, err)
+	req := <-notifier.requests
+	require.Equal(t, authID, req.AuthID)
+
+	_, _, err = cos.Approve(authID, "wrong-token")
+	require.ErrorContains(t, err, "invalid approval token")
+
+	authcode, ruri, err := cos.Approve(authID, req.ApprovalToken)
+	require.NoError(t, err)
+	require.Equal(t, redirectURI, ruri)
+
+	waitedAuthcode, err := cos.WaitForApproval(context.Background(), authID)
+	require.NoError(t, err)
+	require.Equal(t, authcode, waitedAuthcode)
+
+	// Approval can only be used once
+	_, _, err = cos.Approve(authID, req.ApprovalToken)
+	require.ErrorContains(t, err, "no pending approval")
+
+	authcodeSig, err := pkt.NewSignedMessage([]byte(authcode), signer)
+	require.NoError(t, err)
+	cosSig, err := cos.RedeemAuthcode(authcodeSig)
+	require.NoError(t, err)
+	err = pkt.AddSignature(cosSig, pktoken.COS)
+	require.NoError(t, err)
+}
+
+func TestPushDeny(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	cosSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	notifier := &mockNotifier{requests: make(chan ApprovalRequest, 1)}
+	store := cosmocks.NewAuthStateInMemoryStore([]byte("hmac-key"))
+	cos, err := New(cosSigner, alg, "https://example.com", "test-kid", store, notifier)
+	require.NoError(t, err)
+
+	cosP := client.CosignerProvider{Issuer: "https://example.com", CallbackPath: "/mfaredirect"}
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig("http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+
+	authState, _ := store.LookupAuthState(authID)
+	cos.RegisterDevice(authState.UserKey(), Device{ID: "phone"})
+	require.NoError(t, cos.RequestApproval(context.Background(), authID))
+	req := <-notifier.requests
+
+	require.NoError(t, cos.Deny(authID, req.ApprovalToken))
+	_, _, err = cos.Approve(authID, req.ApprovalToken)
+	require.ErrorContains(t, err, "no pending approval")
+
+	_, err = cos.WaitForApproval(context.Background(), authID)
+	require.ErrorContains(t, err, "approval request was denied")
+}
+
+func TestPushWaitBeforeApproval(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	pkt, err := mocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	cosSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	notifier := &mockNotifier{requests: make(chan ApprovalRequest, 1)}
+	store := cosmocks.NewAuthStateInMemoryStore([]byte("hmac-key"))
+	cos, err := New(cosSigner, alg, "https://example.com", "test-kid", store, notifier)
+	require.NoError(t, err)
+
+	cosP := client.CosignerProvider{Issuer: "https://example.com", CallbackPath: "/mfaredirect"}
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig("http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+
+	authState, _ := store.LookupAuthState(authID)
+	cos.RegisterDevice(authState.UserKey(), Device{ID: "phone"})
+	require.NoError(t, cos.RequestApproval(context.Background(), authID))
+	req := <-notifier.requests
+
+	// The client usually starts waiting before the user responds
+	type waited struct {
+		authcode string
+		err      error
+	}
+	done := make(chan waited)
+	go func() {
+		authcode, err := cos.WaitForApproval(context.Background(), authID)
+		done <- waited{authcode, err}
+	}()
+	require.Eventually(t, func() bool {
+		cos.lock.Lock()
+		defer cos.lock.Unlock()
+		return cos.results[authID].waiting
+	}, time.Second, time.Millisecond)
+
+	_, err = cos.WaitForApproval(context.Background(), authID)
+	require.ErrorContains(t, err, "already waiting")
+
+	authcode, _, err := cos.Approve(authID, req.ApprovalToken)
+	require.NoError(t, err)
+	select {
+	case w := <-done:
+		require.NoError(t, w.err)
+		require.Equal(t, authcode, w.authcode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForApproval did not return after approval")
+	}
+
+	// A waiter that gives up doesn't leave the result behind
+	require.NoError(t, cos.RequestApproval(context.Background(), authID))
+	<-notifier.requests
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = cos.WaitForApproval(ctx, authID)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = cos.WaitForApproval(context.Background(), authID)
+	require.ErrorContains(t, err, "no approval requested")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received ApprovalRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	notifier := &WebhookNotifier{}
+	req := ApprovalRequest{AuthID: "auth-id", ApprovalToken: "token", Username: "alice"}
+	err := notifier.Notify(context.Background(), Device{ID: "phone", Endpoint: ts.URL}, req)
+	require.NoError(t, err)
+	require.Equal(t, req, received)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer failing.Close()
+	err = notifier.Notify(context.Background(), Device{ID: "phone", Endpoint: failing.URL}, req)
+	require.ErrorContains(t, err, "unexpected status code: 404")
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package recovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+type EventType string
+
+const (
+	EventRequested          EventType = "requested"
+	EventApproved           EventType = "approved"
+	EventDenied             EventType = "denied"
+	EventCancelled          EventType = "cancelled"
+	EventCompleted          EventType = "completed"
+	EventResetFailed        EventType = "reset_failed"
+	EventNotified           EventType = "notified"
+	EventNotificationFailed EventType = "notification_failed"
+)
+
+// Event is an entry in the audit log of recovery requests
+type Event struct {
+	Time      time.Time        `json:"time"`
+	Type      EventType        `json:"type"`
+	RequestID string           `json:"request_id"`
+	User      cosigner.UserKey `json:"user"`
+	// Actor is who caused the event: the user's sub, an administrator or
+	// SystemActor
+	Actor  string `json:"actor"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditLog records recovery events. Deployments should back it with
+// append-only storage that the administrators approving requests can't
+// modify.
+type AuditLog interface {
+	Record(event Event) error
+	// Events returns the events for the request in the order they were
+	// recorded, every event if requestID is empty
+	Events(requestID string) ([]Event, error)
+}
+
+// MemoryAuditLog is an AuditLog kept in process memory
+type MemoryAuditLog struct {
+	lock   sync.RWMutex
+	events []Event
+}
+
+var _ AuditLog = (*MemoryAuditLog)(nil)
+
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+func (l *MemoryAuditLog) Record(event Event) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *MemoryAuditLog) Events(requestID string) ([]Event, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	events := []Event{}
+	for _, event := range l.events {
+		if requestID == "" || event.RequestID == requestID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
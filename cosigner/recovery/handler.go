@@ -0,0 +1,200 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package recovery
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/openpubkey/openpubkey/i18n"
+)
+
+// CancelPage is the name of the page the cancel link in notifications
+// opens. It is executed with an i18n.Page whose Data is the cancel token
+// and must POST it back to the cancel endpoint as the token form value.
+const CancelPage = "recovery-cancel"
+
+//go:embed cancel.tmpl
+var cancelTemplateFile string
+
+var cancelTemplate = template.Must(template.New(CancelPage).Parse(cancelTemplateFile))
+
+type handler struct {
+	manager   *Manager
+	localizer *i18n.Localizer
+}
+
+type HandlerOpts func(h *handler)
+
+// WithLocalizer localizes and rebrands the cancel pages
+func WithLocalizer(localizer *i18n.Localizer) HandlerOpts {
+	return func(h *handler) {
+		h.localizer = localizer
+	}
+}
+
+// NewHandler returns the endpoints used by users: request, which opens a
+// recovery request for the auth session in the authid query parameter, and
+// cancel, which the cancel link in notifications opens. Mount it next to
+// the cosigner's MFA endpoints, e.g. under "/recovery/" with
+// http.StripPrefix, and set the Manager's CancelURL to match.
+func NewHandler(m *Manager, opts ...HandlerOpts) http.Handler {
+	h := &handler{manager: m}
+	for _, applyOpt := range opts {
+		applyOpt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request", h.request)
+	mux.HandleFunc("/cancel", h.cancel)
+	return mux
+}
+
+func (h *handler) request(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "Error in parsing request", http.StatusBadRequest)
+		return
+	}
+
+	req, err := h.manager.Request(r.Context(), r.URL.Query().Get("authid"), body.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, req)
+}
+
+func (h *handler) cancel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Cancelling on GET would let mail scanners which follow links
+		// cancel requests, so the link opens a page which POSTs the token
+		w.Header().Set("Cache-Control", "no-store")
+		h.localizer.Render(w, r, CancelPage, cancelTemplate, r.URL.Query().Get("token"))
+	case http.MethodPost:
+		if _, err := h.manager.Cancel(r.Context(), r.PostFormValue("token")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			h.localizer.RenderStatus(w, r, i18n.RecoveryCancelFailed, err.Error())
+			return
+		}
+		h.localizer.RenderStatus(w, r, i18n.RecoveryCancelled, "")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type adminHandler struct {
+	manager      *Manager
+	authenticate func(r *http.Request) (string, bool)
+}
+
+// NewAdminHandler returns the endpoints administrators use to review,
+// approve, deny and complete recovery requests and read the audit log.
+// authenticate returns the administrator making the request, which is
+// recorded in the audit log, or false if the request isn't from one.
+//
+//	GET  /requests?status=pending
+//	POST /requests/approve?id=...
+//	POST /requests/deny?id=...&reason=...
+//	POST /requests/complete?id=...
+//	GET  /events?request_id=...
+func NewAdminHandler(m *Manager, authenticate func(r *http.Request) (admin string, ok bool)) http.Handler {
+	h := &adminHandler{manager: m, authenticate: authenticate}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/requests", h.requireAdmin(http.MethodGet, h.listRequests))
+	mux.HandleFunc("/requests/approve", h.requireAdmin(http.MethodPost, h.approve))
+	mux.HandleFunc("/requests/deny", h.requireAdmin(http.MethodPost, h.deny))
+	mux.HandleFunc("/requests/complete", h.requireAdmin(http.MethodPost, h.complete))
+	mux.HandleFunc("/events", h.requireAdmin(http.MethodGet, h.events))
+	return mux
+}
+
+func (h *adminHandler) requireAdmin(method string, handler func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := h.authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r, admin)
+	}
+}
+
+func (h *adminHandler) listRequests(w http.ResponseWriter, r *http.Request, _ string) {
+	writeJSON(w, http.StatusOK, h.manager.Requests(Status(r.URL.Query().Get("status"))))
+}
+
+func (h *adminHandler) approve(w http.ResponseWriter, r *http.Request, admin string) {
+	req, err := h.manager.Approve(r.Context(), r.URL.Query().Get("id"), admin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *adminHandler) deny(w http.ResponseWriter, r *http.Request, admin string) {
+	req, err := h.manager.Deny(r.Context(), r.URL.Query().Get("id"), admin, r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *adminHandler) complete(w http.ResponseWriter, r *http.Request, admin string) {
+	req, err := h.manager.Complete(r.Context(), r.URL.Query().Get("id"), admin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *adminHandler) events(w http.ResponseWriter, r *http.Request, _ string) {
+	events, err := h.manager.Audit.Events(r.URL.Query().Get("request_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/i18n"
+)
+
+// Notification tells the user about a change to their recovery request
+type Notification struct {
+	Request Request
+	// CancelURL cancels the request, it is set while the request can be
+	// cancelled
+	CancelURL string
+}
+
+// Notifier sends notifications to the user's verified email address.
+// Implement this interface to send them through a mail provider's API.
+type Notifier interface {
+	Notify(ctx context.Context, email string, notification Notification) error
+}
+
+// SMTPNotifier is a Notifier that sends plain text emails through an SMTP
+// server
+type SMTPNotifier struct {
+	Addr string // Address of the SMTP server, e.g. "smtp.example.com:587"
+	Auth smtp.Auth
+	From string
+	// Localizer translates the emails into its Languages
+	Localizer *i18n.Localizer
+}
+
+var _ Notifier = (*SMTPNotifier)(nil)
+
+func (n *SMTPNotifier) Notify(ctx context.Context, email string, notification Notification) error {
+	if strings.ContainsAny(email, "\r\n") {
+		return fmt.Errorf("invalid email address")
+	}
+	body, err := n.body(notification)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Localizer.Message(i18n.RecoveryEmailSubject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	if err := smtp.SendMail(n.Addr, n.Auth, n.From, []string{email}, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send recovery email: %w", err)
+	}
+	return nil
+}
+
+func (n *SMTPNotifier) body(notification Notification) (string, error) {
+	req := notification.Request
+	switch req.Status {
+	case StatusPending:
+		return n.Localizer.Sprintf(i18n.RecoveryEmailRequested, notification.CancelURL), nil
+	case StatusApproved:
+		return n.Localizer.Sprintf(i18n.RecoveryEmailApproved, req.EffectiveAt.UTC().Format(time.RFC1123), notification.CancelURL), nil
+	case StatusDenied:
+		return n.Localizer.Message(i18n.RecoveryEmailDenied), nil
+	case StatusCancelled:
+		return n.Localizer.Message(i18n.RecoveryEmailCancelled), nil
+	case StatusCompleted:
+		return n.Localizer.Message(i18n.RecoveryEmailCompleted), nil
+	default:
+		return "", fmt.Errorf("unknown recovery request status %s", req.Status)
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package recovery lets users who have lost their cosigner authenticator,
+// e.g. a security key, get it reset without key escrow and without giving
+// administrators a way to quietly take over accounts.
+//
+// Recovery has to be requested by the user from an auth session, that is
+// after logging in to their OpenID Provider, and is approved by an
+// administrator. Approval only takes effect after a delay, during which the
+// user can cancel the request using a link emailed to the verified email
+// address in their ID Token. Once complete the user's authenticators are
+// reset so that they register a new one the next time they log in, the
+// administrator never gets a credential. Every step is recorded in an
+// AuditLog.
+package recovery
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// DefaultDelay is how long after approval a recovery request takes effect,
+// giving the user time to notice the notification and cancel it
+const DefaultDelay = 72 * time.Hour
+
+// SystemActor is the actor recorded for events not caused by a person, such
+// as requests completed by CompleteDue
+const SystemActor = "system"
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"   // Awaiting approval by an administrator
+	StatusApproved  Status = "approved"  // Approved, takes effect at EffectiveAt
+	StatusDenied    Status = "denied"    // Denied by an administrator
+	StatusCancelled Status = "cancelled" // Cancelled by the user
+	StatusCompleted Status = "completed" // The user's authenticators were reset
+)
+
+// Request is a request by a user to reset their authenticators
+type Request struct {
+	ID          string           `json:"id"`
+	User        cosigner.UserKey `json:"user"`
+	Email       string           `json:"email"` // Verified email notifications are sent to
+	Reason      string           `json:"reason,omitempty"`
+	Status      Status           `json:"status"`
+	RequestedAt time.Time        `json:"requested_at"`
+	// DecidedBy is the administrator who approved or denied the request
+	DecidedBy   string    `json:"decided_by,omitempty"`
+	DecidedAt   time.Time `json:"decided_at,omitempty"`
+	EffectiveAt time.Time `json:"effective_at,omitempty"`
+	ClosedAt    time.Time `json:"closed_at,omitempty"`
+
+	cancelTokenHash string
+}
+
+// IsOpen returns true if the request can still be approved, cancelled or
+// completed
+func (r Request) IsOpen() bool {
+	return r.Status == StatusPending || r.Status == StatusApproved
+}
+
+// Resetter resets a user's authenticators. The webauthn and totp cosigners
+// implement it.
+type Resetter interface {
+	ResetAuthenticators(user cosigner.UserKey) error
+}
+
+// Manager tracks recovery requests through approval, the delay and
+// completion
+type Manager struct {
+	AuthStateStore cosigner.AuthStateStore
+	Resetter       Resetter
+	Notifier       Notifier
+	Audit          AuditLog
+	Delay          time.Duration
+	// CancelURL is where the cancel endpoint of the Handler is served, the
+	// cancel token is added to it as the token query parameter in
+	// notifications
+	CancelURL string
+
+	lock     sync.Mutex
+	requests map[string]*Request
+	now      func() time.Time
+}
+
+func New(store cosigner.AuthStateStore, resetter Resetter, notifier Notifier, audit AuditLog, cancelURL string) *Manager {
+	return &Manager{
+		AuthStateStore: store,
+		Resetter:       resetter,
+		Notifier:       notifier,
+		Audit:          audit,
+		Delay:          DefaultDelay,
+		CancelURL:      cancelURL,
+		requests:       make(map[string]*Request),
+		now:            time.Now,
+	}
+}
+
+// Request opens a recovery request for the user of the auth session. The
+// user must not have another open request and their ID Token must have an
+// email the OpenID Provider verified, as that is the only channel the user
+// is told about the request through.
+func (m *Manager) Request(ctx context.Context, authID string, reason string) (Request, error) {
+	authState, ok := m.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		return Request{}, fmt.Errorf("no auth session found for authID")
+	}
+	email, err := verifiedEmail(authState)
+	if err != nil {
+		return Request{}, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	user := authState.UserKey()
+	for _, req := range m.requests {
+		if req.User == user && req.IsOpen() {
+			return Request{}, fmt.Errorf("user already has an open recovery request (%s)", req.ID)
+		}
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return Request{}, err
+	}
+	cancelToken, err := randomHex(32)
+	if err != nil {
+		return Request{}, err
+	}
+	req := &Request{
+		ID:              id,
+		User:            user,
+		Email:           email,
+		Reason:          reason,
+		Status:          StatusPending,
+		RequestedAt:     m.now(),
+		cancelTokenHash: hashToken(cancelToken),
+	}
+
+	if err := m.record(EventRequested, *req, user.Sub, reason); err != nil {
+		return Request{}, err
+	}
+	m.requests[id] = req
+	m.notify(ctx, *req, cancelToken)
+	return *req, nil
+}
+
+// Approve approves a pending request, it takes effect after the Delay. The
+// user must be notified of the approval, so if notifying them fails the
+// request stays pending.
+func (m *Manager) Approve(ctx context.Context, id string, admin string) (Request, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	req, err := m.lookup(id, StatusPending)
+	if err != nil {
+		return Request{}, err
+	}
+	approved := *req
+	now := m.now()
+	approved.Status = StatusApproved
+	approved.DecidedBy = admin
+	approved.DecidedAt = now
+	approved.EffectiveAt = now.Add(m.Delay)
+
+	// A new cancel token is issued as the one sent when the request was made
+	// may have been lost or deleted
+	cancelToken, err := randomHex(32)
+	if err != nil {
+		return Request{}, err
+	}
+	approved.cancelTokenHash = hashToken(cancelToken)
+
+	if !m.notify(ctx, approved, cancelToken) {
+		return Request{}, fmt.Errorf("failed to notify user of approval, request remains pending")
+	}
+	if err := m.record(EventApproved, approved, admin, ""); err != nil {
+		return Request{}, err
+	}
+	*req = approved
+	return approved, nil
+}
+
+// Deny closes a pending request without resetting the user's
+// authenticators
+func (m *Manager) Deny(ctx context.Context, id string, admin string, reason string) (Request, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	req, err := m.lookup(id, StatusPending)
+	if err != nil {
+		return Request{}, err
+	}
+	denied := *req
+	now := m.now()
+	denied.Status = StatusDenied
+	denied.DecidedBy = admin
+	denied.DecidedAt = now
+	denied.ClosedAt = now
+
+	if err := m.record(EventDenied, denied, admin, reason); err != nil {
+		return Request{}, err
+	}
+	*req = denied
+	m.notify(ctx, denied, "")
+	return denied, nil
+}
+
+// Cancel cancels the open request the cancel token was sent for. Only the
+// user receives cancel tokens, so administrators can't cancel requests,
+// they deny them instead.
+func (m *Manager) Cancel(ctx context.Context, cancelToken string) (Request, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tokenHash := hashToken(cancelToken)
+	for _, req := range m.requests {
+		if req.cancelTokenHash != tokenHash {
+			continue
+		}
+		if !req.IsOpen() {
+			return Request{}, fmt.Errorf("recovery request is %s", req.Status)
+		}
+		cancelled := *req
+		cancelled.Status = StatusCancelled
+		cancelled.ClosedAt = m.now()
+
+		if err := m.record(EventCancelled, cancelled, cancelled.User.Sub, ""); err != nil {
+			return Request{}, err
+		}
+		*req = cancelled
+		m.notify(ctx, cancelled, "")
+		return cancelled, nil
+	}
+	return Request{}, fmt.Errorf("invalid cancel token")
+}
+
+// Complete resets the user's authenticators for an approved request whose
+// delay has passed
+func (m *Manager) Complete(ctx context.Context, id string, actor string) (Request, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	req, err := m.lookup(id, StatusApproved)
+	if err != nil {
+		return Request{}, err
+	}
+	return m.complete(ctx, req, actor)
+}
+
+// CompleteDue completes every approved request whose delay has passed. Run
+// it periodically so users needn't wait for an administrator once the
+// delay is over.
+func (m *Manager) CompleteDue(ctx context.Context) ([]Request, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	completed := []Request{}
+	for _, req := range m.requests {
+		if req.Status != StatusApproved || m.now().Before(req.EffectiveAt) {
+			continue
+		}
+		done, err := m.complete(ctx, req, SystemActor)
+		if err != nil {
+			return completed, err
+		}
+		completed = append(completed, done)
+	}
+	return completed, nil
+}
+
+func (m *Manager) complete(ctx context.Context, req *Request, actor string) (Request, error) {
+	now := m.now()
+	if now.Before(req.EffectiveAt) {
+		return Request{}, fmt.Errorf("recovery request takes effect at %s", req.EffectiveAt.Format(time.RFC3339))
+	}
+	completed := *req
+	completed.Status = StatusCompleted
+	completed.ClosedAt = now
+
+	// Record first so that a reset is never left out of the audit log
+	if err := m.record(EventCompleted, completed, actor, ""); err != nil {
+		return Request{}, err
+	}
+	if err := m.Resetter.ResetAuthenticators(req.User); err != nil {
+		_ = m.record(EventResetFailed, *req, actor, err.Error())
+		return Request{}, fmt.Errorf("failed to reset authenticators: %w", err)
+	}
+	*req = completed
+	m.notify(ctx, completed, "")
+	return completed, nil
+}
+
+// Get returns the request with the ID
+func (m *Manager) Get(id string) (Request, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if req, ok := m.requests[id]; ok {
+		return *req, true
+	}
+	return Request{}, false
+}
+
+// Requests returns the requests with the status, every request if status
+// is empty
+func (m *Manager) Requests(status Status) []Request {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	requests := []Request{}
+	for _, req := range m.requests {
+		if status == "" || req.Status == status {
+			requests = append(requests, *req)
+		}
+	}
+	return requests
+}
+
+func (m *Manager) lookup(id string, status Status) (*Request, error) {
+	req, ok := m.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("no recovery request found with ID %s", id)
+	}
+	if req.Status != status {
+		return nil, fmt.Errorf("recovery request is %s, expected %s", req.Status, status)
+	}
+	return req, nil
+}
+
+func (m *Manager) record(typ EventType, req Request, actor string, detail string) error {
+	err := m.Audit.Record(Event{
+		Time:      m.now(),
+		Type:      typ,
+		RequestID: req.ID,
+		User:      req.User,
+		Actor:     actor,
+		Detail:    detail,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %s event in audit log: %w", typ, err)
+	}
+	return nil
+}
+
+// notify sends the notification for the request's status to the user and
+// records the outcome, returning false if it couldn't be sent
+func (m *Manager) notify(ctx context.Context, req Request, cancelToken string) bool {
+	notification := Notification{Request: req}
+	if cancelToken != "" {
+		notification.CancelURL = m.cancelURL(cancelToken)
+	}
+
+	if err := m.Notifier.Notify(ctx, req.Email, notification); err != nil {
+		_ = m.record(EventNotificationFailed, req, SystemActor, err.Error())
+		return false
+	}
+	_ = m.record(EventNotified, req, SystemActor, string(req.Status))
+	return true
+}
+
+func (m *Manager) cancelURL(cancelToken string) string {
+	cancelURL, err := url.Parse(m.CancelURL)
+	if err != nil {
+		return m.CancelURL + "?token=" + url.QueryEscape(cancelToken)
+	}
+	query := cancelURL.Query()
+	query.Set("token", cancelToken)
+	cancelURL.RawQuery = query.Encode()
+	return cancelURL.String()
+}
+
+func verifiedEmail(authState *cosigner.AuthState) (string, error) {
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"`
+	}
+	if err := json.Unmarshal(authState.Pkt.Payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to unmarshal PK Token: %w", err)
+	}
+	if claims.Email == "" {
+		return "", fmt.Errorf("ID Token has no email to send recovery notifications to")
+	}
+	// Some OpenID Providers send email_verified as a string
+	if claims.EmailVerified != true && claims.EmailVerified != "true" {
+		return "", fmt.Errorf("email in ID Token is not verified")
+	}
+	return claims.Email, nil
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,342 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package recovery
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/mocks"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/providers"
+	providermocks "github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+type resetter struct {
+	reset []cosigner.UserKey
+}
+
+func (r *resetter) ResetAuthenticators(user cosigner.UserKey) error {
+	r.reset = append(r.reset, user)
+	return nil
+}
+
+type notifier struct {
+	sent []Notification
+	err  error
+}
+
+func (n *notifier) Notify(ctx context.Context, email string, notification Notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+// cancelToken returns the token in the cancel URL of the last notification
+func (n *notifier) cancelToken(t *testing.T) string {
+	require.NotEmpty(t, n.sent)
+	cancelURL, err := url.Parse(n.sent[len(n.sent)-1].CancelURL)
+	require.NoError(t, err)
+	return cancelURL.Query().Get("token")
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newManager(t *testing.T) (*Manager, cosigner.AuthStateStore, *resetter, *notifier, *clock) {
+	hmacKey := make([]byte, 64)
+	_, err := rand.Read(hmacKey)
+	require.NoError(t, err)
+	store := mocks.NewAuthStateInMemoryStore(hmacKey)
+
+	r := &resetter{}
+	n := &notifier{}
+	c := &clock{now: time.Unix(1700000000, 0)}
+	m := New(store, r, n, NewMemoryAuditLog(), "https://cosigner.example.com/recovery/cancel")
+	m.now = c.Now
+	return m, store, r, n, c
+}
+
+func newAuthSession(t *testing.T, store cosigner.AuthStateStore, claims map[string]any) string {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	idtTemplate := providermocks.DefaultIDTokenTemplate()
+	idtTemplate.ExtraClaims = claims
+	pkt, _, err := pktmocks.GenerateMockPKTokenWithOpts(t, signer, alg, idtTemplate, &pktmocks.MockPKTokenOpts{
+		CommitType:     providers.CommitTypesEnum.NONCE_CLAIM,
+		CorrectCicHash: true,
+		CorrectCicSig:  true,
+	})
+	require.NoError(t, err)
+
+	authID, err := store.CreateNewAuthSession(pkt, "http://localhost:5555/mfaredirect", "test-nonce")
+	require.NoError(t, err)
+	return authID
+}
+
+var verifiedClaims = map[string]any{"email": "alice@example.com", "email_verified": true}
+
+func eventTypes(t *testing.T, m *Manager, id string) []EventType {
+	events, err := m.Audit.Events(id)
+	require.NoError(t, err)
+	types := []EventType{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+	m, store, r, n, c := newManager(t)
+	authID := newAuthSession(t, store, verifiedClaims)
+
+	req, err := m.Request(ctx, authID, "lost my security key")
+	require.NoError(t, err)
+	require.Equal(t, StatusPending, req.Status)
+	require.Equal(t, "alice@example.com", req.Email)
+	require.Len(t, n.sent, 1)
+	require.NotEmpty(t, n.cancelToken(t))
+
+	_, err = m.Request(ctx, authID, "again")
+	require.ErrorContains(t, err, "already has an open recovery request")
+
+	// Requests can't be completed before they are approved
+	_, err = m.Complete(ctx, req.ID, "admin")
+	require.ErrorContains(t, err, "recovery request is pending")
+
+	req, err = m.Approve(ctx, req.ID, "admin")
+	require.NoError(t, err)
+	require.Equal(t, StatusApproved, req.Status)
+	require.Equal(t, c.now.Add(DefaultDelay), req.EffectiveAt)
+	require.Len(t, n.sent, 2)
+	require.NotEmpty(t, n.sent[1].CancelURL)
+
+	// Approval only takes effect after the delay
+	_, err = m.Complete(ctx, req.ID, "admin")
+	require.ErrorContains(t, err, "recovery request takes effect at")
+	completed, err := m.CompleteDue(ctx)
+	require.NoError(t, err)
+	require.Empty(t, completed)
+	require.Empty(t, r.reset)
+
+	c.now = c.now.Add(DefaultDelay)
+	completed, err = m.CompleteDue(ctx)
+	require.NoError(t, err)
+	require.Len(t, completed, 1)
+	require.Equal(t, StatusCompleted, completed[0].Status)
+	require.Equal(t, []cosigner.UserKey{req.User}, r.reset)
+	require.Len(t, n.sent, 3)
+
+	require.Equal(t, []EventType{
+		EventRequested, EventNotified,
+		EventNotified, EventApproved,
+		EventCompleted, EventNotified,
+	}, eventTypes(t, m, req.ID))
+
+	// Once completed the user can open a new request
+	_, err = m.Request(ctx, authID, "lost the new one too")
+	require.NoError(t, err)
+}
+
+func TestRecoveryCancel(t *testing.T) {
+	ctx := context.Background()
+	m, store, r, n, c := newManager(t)
+
+	req, err := m.Request(ctx, newAuthSession(t, store, verifiedClaims), "")
+	require.NoError(t, err)
+	requestToken := n.cancelToken(t)
+
+	_, err = m.Approve(ctx, req.ID, "admin")
+	require.NoError(t, err)
+	approvalToken := n.cancelToken(t)
+	require.NotEqual(t, requestToken, approvalToken)
+
+	// The token sent with the request was replaced on approval
+	_, err = m.Cancel(ctx, requestToken)
+	require.ErrorContains(t, err, "invalid cancel token")
+
+	cancelled, err := m.Cancel(ctx, approvalToken)
+	require.NoError(t, err)
+	require.Equal(t, StatusCancelled, cancelled.Status)
+
+	_, err = m.Cancel(ctx, approvalToken)
+	require.ErrorContains(t, err, "recovery request is cancelled")
+
+	c.now = c.now.Add(DefaultDelay)
+	_, err = m.Complete(ctx, req.ID, "admin")
+	require.ErrorContains(t, err, "recovery request is cancelled")
+	require.Empty(t, r.reset)
+
+	events, err := m.Audit.Events(req.ID)
+	require.NoError(t, err)
+	require.Contains(t, eventTypes(t, m, req.ID), EventCancelled)
+	for _, event := range events {
+		if event.Type == EventCancelled {
+			require.Equal(t, req.User.Sub, event.Actor)
+		}
+	}
+}
+
+func TestRecoveryDeny(t *testing.T) {
+	ctx := context.Background()
+	m, store, r, n, _ := newManager(t)
+
+	req, err := m.Request(ctx, newAuthSession(t, store, verifiedClaims), "")
+	require.NoError(t, err)
+
+	denied, err := m.Deny(ctx, req.ID, "admin", "couldn't confirm identity")
+	require.NoError(t, err)
+	require.Equal(t, StatusDenied, denied.Status)
+	require.Equal(t, "admin", denied.DecidedBy)
+	require.Len(t, n.sent, 2)
+	require.Empty(t, n.sent[1].CancelURL)
+
+	_, err = m.Approve(ctx, req.ID, "admin")
+	require.ErrorContains(t, err, "recovery request is denied")
+	require.Empty(t, r.reset)
+}
+
+func TestRecoveryApprovalRequiresNotification(t *testing.T) {
+	ctx := context.Background()
+	m, store, _, n, _ := newManager(t)
+
+	req, err := m.Request(ctx, newAuthSession(t, store, verifiedClaims), "")
+	require.NoError(t, err)
+
+	// An approval the user isn't told about would be a silent takeover
+	n.err = fmt.Errorf("mail server down")
+	_, err = m.Approve(ctx, req.ID, "admin")
+	require.ErrorContains(t, err, "failed to notify user")
+
+	req, ok := m.Get(req.ID)
+	require.True(t, ok)
+	require.Equal(t, StatusPending, req.Status)
+	require.Equal(t, []EventType{EventRequested, EventNotified, EventNotificationFailed}, eventTypes(t, m, req.ID))
+}
+
+func TestRecoveryRequiresVerifiedEmail(t *testing.T) {
+	testCases := []struct {
+		name   string
+		claims map[string]any
+		err    string
+	}{
+		{name: "no email", claims: nil, err: "ID Token has no email"},
+		{name: "unverified", claims: map[string]any{"email": "alice@example.com"}, err: "not verified"},
+		{name: "verified false", claims: map[string]any{"email": "alice@example.com", "email_verified": false}, err: "not verified"},
+		{name: "verified string", claims: map[string]any{"email": "alice@example.com", "email_verified": "true"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, store, _, _, _ := newManager(t)
+			_, err := m.Request(context.Background(), newAuthSession(t, store, tc.claims), "")
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	m, _, _, _, _ := newManager(t)
+	_, err := m.Request(context.Background(), "unknown", "")
+	require.ErrorContains(t, err, "no auth session found")
+}
+
+func TestHandlers(t *testing.T) {
+	m, store, r, n, c := newManager(t)
+	authID := newAuthSession(t, store, verifiedClaims)
+
+	mux := http.NewServeMux()
+	mux.Handle("/recovery/", http.StripPrefix("/recovery", NewHandler(m)))
+	mux.Handle("/admin/recovery/", http.StripPrefix("/admin/recovery", NewAdminHandler(m, func(r *http.Request) (string, bool) {
+		admin := r.Header.Get("X-Admin")
+		return admin, admin != ""
+	})))
+
+	do := func(method, target string, body string, admin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if method == http.MethodPost && strings.HasSuffix(target, "/cancel") {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if admin != "" {
+			req.Header.Set("X-Admin", admin)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/recovery/request?authid="+url.QueryEscape(authID), `{"reason":"lost key"}`, "")
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	require.Len(t, m.Requests(StatusPending), 1)
+	id := m.Requests(StatusPending)[0].ID
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/recovery/requests", "", "").Code)
+	rr = do(http.MethodGet, "/admin/recovery/requests?status=pending", "", "bob")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), id)
+
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/admin/recovery/requests/approve?id="+id, "", "bob").Code)
+	rr = do(http.MethodPost, "/admin/recovery/requests/approve?id="+id, "", "bob")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Following the cancel link doesn't cancel, the page POSTs the token
+	token := n.cancelToken(t)
+	rr = do(http.MethodGet, "/recovery/cancel?token="+token, "", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), token)
+	req, _ := m.Get(id)
+	require.Equal(t, StatusApproved, req.Status)
+
+	rr = do(http.MethodPost, "/recovery/cancel", "token=wrong", "")
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = do(http.MethodPost, "/recovery/cancel", "token="+token, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	req, _ = m.Get(id)
+	require.Equal(t, StatusCancelled, req.Status)
+
+	c.now = c.now.Add(DefaultDelay)
+	rr = do(http.MethodPost, "/admin/recovery/requests/complete?id="+id, "", "bob")
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Empty(t, r.reset)
+
+	rr = do(http.MethodGet, "/admin/recovery/events?request_id="+id, "", "bob")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"actor":"bob"`)
+	require.Contains(t, rr.Body.String(), `"type":"cancelled"`)
+}
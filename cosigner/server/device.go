@@ -0,0 +1,353 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+const (
+	// DeviceCodeLifetime is how long the user has to authenticate after
+	// the client registers a device authorization
+	DeviceCodeLifetime = 10 * time.Minute
+	// DefaultDeviceInterval is how long clients wait between polls
+	DefaultDeviceInterval = 5 * time.Second
+
+	deviceCookie = "opk_device"
+	// userCodeAlphabet has no vowels so that user codes don't spell words,
+	// as RFC 8628 recommends
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// Device token error codes, see RFC 8628 section 3.5
+const (
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+)
+
+type deviceSession struct {
+	userCode  string
+	authID    string
+	authcode  string
+	expiresAt time.Time
+	interval  time.Duration
+	lastPoll  time.Time
+}
+
+// deviceFlow holds the device authorizations waiting for the user to
+// authenticate, keyed by device code
+type deviceFlow struct {
+	cosigner *cosigner.AuthCosigner
+	mfaPage  string
+	interval time.Duration
+
+	lock      sync.Mutex
+	sessions  map[string]*deviceSession
+	userCodes map[string]string
+	now       func() time.Time
+}
+
+func newDeviceFlow(c *cosigner.AuthCosigner, mfaPage string, interval time.Duration) *deviceFlow {
+	return &deviceFlow{
+		cosigner:  c,
+		mfaPage:   mfaPage,
+		interval:  interval,
+		sessions:  map[string]*deviceSession{},
+		userCodes: map[string]string{},
+		now:       time.Now,
+	}
+}
+
+// authorize starts an auth session for the PK Token like the init auth
+// endpoint, but instead of redirecting a browser it responds with the
+// codes the client shows the user and polls with
+func (d *deviceFlow) authorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType := pktoken.MediaTypeJSON
+	if pktType := r.PostFormValue("pkt_type"); pktType != "" {
+		var err error
+		if mediaType, err = pktoken.ParseMediaType(pktType); err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	pktBytes, err := util.Base64DecodeForJWT([]byte(r.PostFormValue("pkt")))
+	if err != nil {
+		http.Error(w, "Error decoding PK Token", http.StatusBadRequest)
+		return
+	}
+	pkt, err := pktoken.NewFromMediaType(pktBytes, mediaType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	authID, err := d.cosigner.InitAuth(pkt, []byte(r.PostFormValue("sig1")))
+	if err != nil {
+		http.Error(w, "Error initiating authentication", http.StatusBadRequest)
+		return
+	}
+	// The browser is sent back to the cosigner rather than the client, so
+	// the client must have signed the device complete URI as its redirect
+	// URI for the cosigner signature to name where the authcode went
+	completeURI, err := url.JoinPath(d.cosigner.Issuer, DeviceCompletePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if authState, ok := d.cosigner.AuthStateStore.LookupAuthState(authID); !ok || authState.RedirectURI != completeURI {
+		http.Error(w, fmt.Sprintf("redirect URI must be %s", completeURI), http.StatusBadRequest)
+		return
+	}
+
+	verificationURI, err := url.JoinPath(d.cosigner.Issuer, DevicePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deviceCode, userCode, err := d.add(authID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, msgs.DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+		ExpiresIn:               int64(DeviceCodeLifetime / time.Second),
+		Interval:                int64(d.interval / time.Second),
+	})
+}
+
+func (d *deviceFlow) add(authID string) (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	deviceCode := hex.EncodeToString(b)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.reap()
+
+	var userCode string
+	for {
+		code, err := randomUserCode()
+		if err != nil {
+			return "", "", err
+		}
+		if _, ok := d.userCodes[code]; !ok {
+			userCode = code
+			break
+		}
+	}
+	d.sessions[deviceCode] = &deviceSession{
+		userCode:  userCode,
+		authID:    authID,
+		expiresAt: d.now().Add(DeviceCodeLifetime),
+		interval:  d.interval,
+	}
+	d.userCodes[userCode] = deviceCode
+	return deviceCode, userCode, nil
+}
+
+// reap removes expired sessions, the lock must be held
+func (d *deviceFlow) reap() {
+	for deviceCode, session := range d.sessions {
+		if !d.now().Before(session.expiresAt) {
+			delete(d.sessions, deviceCode)
+			delete(d.userCodes, session.userCode)
+		}
+	}
+}
+
+// lookupUserCode returns the session for a user code the user entered
+func (d *deviceFlow) lookupUserCode(userCode string) (*deviceSession, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	session, ok := d.sessions[d.userCodes[normalizeUserCode(userCode)]]
+	if !ok || !d.now().Before(session.expiresAt) {
+		return nil, false
+	}
+	return session, true
+}
+
+var enterCodePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Enter code</title></head>
+<body>
+<form method="get">
+<p>Enter the code shown in your terminal</p>
+{{if .}}<p>{{.}}</p>{{end}}
+<input name="user_code" autocomplete="off" autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// verify is the page the user opens. Once they have entered a user code
+// the browser is sent to the MFA page for the auth session.
+func (d *deviceFlow) verify(w http.ResponseWriter, r *http.Request) {
+	userCode := r.URL.Query().Get("user_code")
+	if userCode == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		enterCodePage.Execute(w, "")
+		return
+	}
+	session, ok := d.lookupUserCode(userCode)
+	if !ok {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		enterCodePage.Execute(w, "That code is invalid or has expired.")
+		return
+	}
+
+	// The MFA handler redirects the browser to the device complete
+	// endpoint with only the authcode, the cookie says whose it is
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookie,
+		Value:    session.userCode,
+		MaxAge:   int(DeviceCodeLifetime / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Relative for the same reason as the init auth endpoint's redirect
+	w.Header().Set("Location", fmt.Sprintf("%s?authid=%s", d.mfaPage, url.QueryEscape(session.authID)))
+	w.WriteHeader(http.StatusFound)
+}
+
+// complete receives the authcode from the MFA handler and holds it for
+// the client's next poll
+func (d *deviceFlow) complete(w http.ResponseWriter, r *http.Request) {
+	authcode := r.URL.Query().Get("authcode")
+	cookie, err := r.Cookie(deviceCookie)
+	if authcode == "" || err != nil {
+		http.Error(w, "missing authcode or device session", http.StatusBadRequest)
+		return
+	}
+
+	d.lock.Lock()
+	session, ok := d.sessions[d.userCodes[cookie.Value]]
+	if ok && d.now().Before(session.expiresAt) && session.authcode == "" {
+		session.authcode = authcode
+	} else {
+		ok = false
+	}
+	d.lock.Unlock()
+	if !ok {
+		http.Error(w, "device session not found or already completed", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("You are authenticated, you can return to your terminal."))
+}
+
+// token is polled by the client with the device code. Once the user is
+// authenticated it responds with the authcode, which the client redeems
+// at the redeem endpoint.
+func (d *deviceFlow) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceCode := r.PostFormValue("device_code")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	session, ok := d.sessions[deviceCode]
+	switch {
+	case !ok || !d.now().Before(session.expiresAt):
+		writeJSON(w, http.StatusBadRequest, msgs.DeviceToken{Error: errExpiredToken})
+	case session.authcode != "":
+		delete(d.sessions, deviceCode)
+		delete(d.userCodes, session.userCode)
+		writeJSON(w, http.StatusOK, msgs.DeviceToken{Authcode: session.authcode})
+	case !session.lastPoll.IsZero() && d.now().Sub(session.lastPoll) < session.interval:
+		session.lastPoll = d.now()
+		session.interval += DefaultDeviceInterval
+		writeJSON(w, http.StatusBadRequest, msgs.DeviceToken{Error: errSlowDown})
+	default:
+		session.lastPoll = d.now()
+		writeJSON(w, http.StatusBadRequest, msgs.DeviceToken{Error: errAuthorizationPending})
+	}
+}
+
+func randomUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits the user code in two to make it easier to read
+func formatUserCode(userCode string) string {
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// normalizeUserCode undoes formatUserCode and forgives the user typing the
+// code in lower case or with spaces
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
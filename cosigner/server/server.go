@@ -0,0 +1,226 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package server serves the HTTP endpoints of a cosigner which
+// authenticates users in their browser, so that deployments don't each
+// need to write their own. How users are authenticated, e.g. with WebAuthn
+// or TOTP, is left to the MFA handler given to NewHandler.
+// client.MFACosignerClient is the client for these endpoints.
+//
+// # Wire protocol
+//
+// Paths are relative to the cosigner's issuer URI. Errors are responded to
+// with a 4xx or 5xx status and a plain text message.
+//
+//  1. Init auth. The client opens
+//
+//     GET /mfa-auth-init?pkt=<pkt>&pkt_type=<media type>&sig1=<sig1>
+//
+//     in the user's browser. pkt is the base64url encoded PK Token in the
+//     pkt_type media type, which defaults to application/pkt+json when
+//     pkt_type is missing. sig1 is a signed message under the PK Token, see
+//     pktoken.PKToken.NewSignedMessage, of a JSON msgs.InitMFAAuth with the
+//     cosigner's issuer, the URI to redirect the browser to once the user is
+//     authenticated, the time it was signed and a nonce. The cosigner starts
+//     an auth session and responds 302 Found to the MFA page with the
+//     session's ID in the authid query parameter.
+//
+//  2. MFA. The MFA handler authenticates the user, then gets an authcode for
+//     the session from cosigner.AuthCosigner.NewAuthcode and sends the
+//     browser to the redirect URI with the authcode in the authcode query
+//     parameter.
+//
+//  3. Redeem. The client signs the authcode under the PK Token as sig2 and
+//     sends
+//
+//     POST /redeem
+//     Content-Type: application/x-www-form-urlencoded
+//
+//     sig2=<sig2>
+//
+//     The cosigner responds 201 Created with the base64url encoded
+//     cosigner signature, a JWS whose protected header carries the nonce and
+//     redirect URI from sig1, which the client adds to the PK Token. An
+//     authcode can only be redeemed once.
+//
+// GET /sign?sig2=<sig2> redeems an authcode the same way for clients
+// predating /redeem, which put sig2 in the URI where it ends up in access
+// logs.
+//
+// # Device flow
+//
+// Clients which can't receive the redirect, e.g. because they run in a
+// container or behind NAT, can instead poll for the authcode, modelled on
+// the OAuth 2.0 device authorization grant (RFC 8628):
+//
+//  1. The client sends
+//
+//     POST /device_authorization
+//     Content-Type: application/x-www-form-urlencoded
+//
+//     pkt=<pkt>&pkt_type=<media type>&sig1=<sig1>
+//
+//     with the same parameters as init auth, except that the redirect URI
+//     in sig1 must be the cosigner's /device/complete endpoint. The
+//     cosigner responds with a JSON msgs.DeviceAuthorization holding a
+//     device code for the client and a user code and verification URI for
+//     the user.
+//
+//  2. The user opens GET /device, enters the user code and is sent to the
+//     MFA page. Once authenticated the MFA handler redirects the browser to
+//     GET /device/complete, which holds on to the authcode.
+//
+//  3. The client polls
+//
+//     POST /device/token
+//     Content-Type: application/x-www-form-urlencoded
+//
+//     device_code=<device code>
+//
+//     no more often than the interval from step 1. The cosigner responds
+//     400 Bad Request with a JSON msgs.DeviceToken with the error
+//     authorization_pending until the user is authenticated, slow_down if
+//     the client polls too often, after which it must wait 5 seconds
+//     longer, or expired_token, and 200 OK with the authcode once. The
+//     client then redeems the authcode as in step 3 above.
+//
+// # Keys
+//
+// If the cosigner has a cosigner.Keyring when NewHandler is called, its
+// keys are published for verifiers at GET /.well-known/jwks.json, which the
+// jwks_uri of GET /.well-known/openid-configuration points to. Keys the
+// cosigner has rotated away from stay published until the signatures made
+// with them have expired.
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+const (
+	InitAuthPath = "/mfa-auth-init"
+	RedeemPath   = "/redeem"
+	// SignPath redeems authcodes for clients predating RedeemPath
+	SignPath = "/sign"
+
+	DeviceAuthorizationPath = "/device_authorization"
+	DevicePath              = "/device"
+	DeviceCompletePath      = "/device/complete"
+	DeviceTokenPath         = "/device/token"
+
+	WellKnownConfigPath = "/.well-known/openid-configuration"
+	JWKSPath            = "/.well-known/jwks.json"
+)
+
+type handler struct {
+	cosigner       *cosigner.AuthCosigner
+	mfaPage        string
+	deviceInterval time.Duration
+}
+
+type HandlerOpts func(h *handler)
+
+// WithMFAPage sets where the browser is sent to authenticate the user once
+// the auth session is started, relative to the init auth endpoint. It
+// defaults to the root of the MFA handler.
+func WithMFAPage(mfaPage string) HandlerOpts {
+	return func(h *handler) {
+		h.mfaPage = mfaPage
+	}
+}
+
+// WithDeviceInterval sets how long device flow clients wait between polls,
+// it defaults to DefaultDeviceInterval
+func WithDeviceInterval(interval time.Duration) HandlerOpts {
+	return func(h *handler) {
+		h.deviceInterval = interval
+	}
+}
+
+// NewHandler returns the cosigner's endpoints with the MFA handler serving
+// every path they don't. Redirects are relative so the handler can be
+// mounted under a path prefix with http.StripPrefix.
+func NewHandler(c *cosigner.AuthCosigner, mfa http.Handler, opts ...HandlerOpts) http.Handler {
+	h := &handler{
+		cosigner:       c,
+		mfaPage:        "./",
+		deviceInterval: DefaultDeviceInterval,
+	}
+	for _, applyOpt := range opts {
+		applyOpt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", mfa)
+	mux.HandleFunc(InitAuthPath, c.InitAuthHandler(h.mfaPage))
+	mux.HandleFunc(RedeemPath, h.redeem)
+	mux.HandleFunc(SignPath, c.SignHandler())
+
+	devices := newDeviceFlow(c, h.mfaPage, h.deviceInterval)
+	mux.HandleFunc(DeviceAuthorizationPath, devices.authorize)
+	mux.HandleFunc(DevicePath, devices.verify)
+	mux.HandleFunc(DeviceCompletePath, devices.complete)
+	mux.HandleFunc(DeviceTokenPath, devices.token)
+	if c.Keyring != nil {
+		mux.HandleFunc(WellKnownConfigPath, h.wellKnownConfig)
+		mux.HandleFunc(JWKSPath, c.Keyring.JWKSHandler())
+	}
+	return mux
+}
+
+func (h *handler) wellKnownConfig(w http.ResponseWriter, r *http.Request) {
+	jwksURI, err := url.JoinPath(h.cosigner.Issuer, JWKSPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(map[string]string{
+		"issuer":   h.cosigner.Issuer,
+		"jwks_uri": jwksURI,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (h *handler) redeem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sig := []byte(r.PostFormValue("sig2"))
+	if len(sig) == 0 {
+		http.Error(w, "missing sig2", http.StatusBadRequest)
+		return
+	}
+	cosSig, err := h.cosigner.RedeemAuthcode(sig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(util.Base64EncodeForJWT(cosSig))
+}
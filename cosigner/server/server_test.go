@@ -0,0 +1,378 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package server_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/cosigner/msgs"
+	"github.com/openpubkey/openpubkey/cosigner/server"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/pktoken"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+// approveAll is an MFA handler which authenticates every user straight
+// away
+func approveAll(c *cosigner.AuthCosigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authID := r.URL.Query().Get("authid")
+		authState, ok := c.AuthStateStore.LookupAuthState(authID)
+		if !ok {
+			http.Error(w, "no auth session found for authID", http.StatusBadRequest)
+			return
+		}
+		authcode, err := c.NewAuthcode(authID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s?authcode=%s", authState.RedirectURI, url.QueryEscape(authcode)), http.StatusFound)
+	})
+}
+
+func newServer(t *testing.T, newHandler func(c *cosigner.AuthCosigner) http.Handler) (*httptest.Server, *cosigner.AuthCosigner) {
+	cosAlg := jwa.ES256
+	cosSigner, err := util.GenKeyPair(cosAlg)
+	require.NoError(t, err)
+	hmacKey := make([]byte, 64)
+	_, err = rand.Read(hmacKey)
+	require.NoError(t, err)
+
+	// The issuer isn't known until the server is started, so the handler is
+	// created on the first request
+	var cos *cosigner.AuthCosigner
+	var handler http.Handler
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { handler = newHandler(cos) })
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	cos, err = cosigner.New(cosSigner, cosAlg, srv.URL, "test-kid", mocks.NewAuthStateInMemoryStore(hmacKey))
+	require.NoError(t, err)
+	return srv, cos
+}
+
+func newPKT(t *testing.T) (*pktoken.PKToken, crypto.Signer) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+	return pkt, signer
+}
+
+func TestCosignerProvider(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c))
+	})
+
+	pkt, signer := newPKT(t)
+
+	cosP := client.CosignerProvider{
+		Issuer:       srv.URL,
+		CallbackPath: "/mfaredirect",
+	}
+	redirCh := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cosP.RequestToken(context.Background(), signer, pkt, redirCh)
+		done <- err
+	}()
+
+	// The browser follows the redirects from init auth through the MFA page
+	// to the client's callback
+	res, err := http.Get(<-redirCh)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, <-done)
+	require.NotNil(t, pkt.Cos)
+}
+
+func TestMFACosignerClient(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c))
+	})
+	ctx := context.Background()
+
+	pkt, signer := newPKT(t)
+
+	for _, mediaType := range []string{pktoken.MediaTypeJSON, pktoken.MediaTypeCompact} {
+		t.Run(mediaType, func(t *testing.T) {
+			cosClient := client.MFACosignerClient{
+				Issuer:       srv.URL,
+				PktMediaType: mediaType,
+			}
+			redirectURI := "http://localhost:5555/mfaredirect"
+			authcode := authenticate(t, &cosClient, pkt, signer, redirectURI)
+
+			cosSig, err := cosClient.Redeem(ctx, pkt, signer, authcode)
+			require.NoError(t, err)
+			require.NoError(t, cosClient.ValidateCos(cosSig, nonceOf(t, cosSig), redirectURI))
+			require.ErrorContains(t, cosClient.ValidateCos(cosSig, "wrong", redirectURI), "incorrect nonce")
+			require.ErrorContains(t, cosClient.ValidateCos(cosSig, nonceOf(t, cosSig), "http://localhost:6666/mfaredirect"), "unexpected ruri")
+
+			// Authcodes can only be redeemed once
+			_, err = cosClient.Redeem(ctx, pkt, signer, authcode)
+			require.ErrorContains(t, err, "400 Bad Request")
+		})
+	}
+}
+
+func TestRedeemEndpoint(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c))
+	})
+
+	res, err := http.Get(srv.URL + server.RedeemPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, err = http.PostForm(srv.URL+server.RedeemPath, url.Values{})
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.PostForm(srv.URL+server.RedeemPath, url.Values{"sig2": {"not a signature"}})
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestRedeemFallsBackToSign(t *testing.T) {
+	// A cosigner predating the redeem endpoint
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			// Like the MFA pages of those cosigners, every other path is
+			// not found
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			approveAll(c).ServeHTTP(w, r)
+		})
+		mux.HandleFunc("/mfa-auth-init", c.InitAuthHandler("./"))
+		mux.HandleFunc("/sign", c.SignHandler())
+		return mux
+	})
+
+	pkt, signer := newPKT(t)
+
+	cosClient := client.MFACosignerClient{Issuer: srv.URL}
+	authcode := authenticate(t, &cosClient, pkt, signer, "http://localhost:5555/mfaredirect")
+	cosSig, err := cosClient.Redeem(context.Background(), pkt, signer, authcode)
+	require.NoError(t, err)
+	require.NoError(t, pkt.AddSignature(cosSig, pktoken.COS))
+}
+
+func TestWithMFAPage(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, http.NotFoundHandler(), server.WithMFAPage("mfa/"))
+	})
+
+	pkt, signer := newPKT(t)
+
+	cosClient := client.MFACosignerClient{Issuer: srv.URL}
+	initURI, _, err := cosClient.InitAuthURI(pkt, signer, "http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	res, err := noRedirects.Get(initURI)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Location"), "mfa/?authid="))
+}
+
+var noRedirects = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// authenticate plays the part of the user's browser, opening the init auth
+// URI and following redirects until the cosigner sends it to redirectURI,
+// returning the authcode
+func authenticate(t *testing.T, cosClient *client.MFACosignerClient, pkt *pktoken.PKToken, signer crypto.Signer, redirectURI string) string {
+	uri, _, err := cosClient.InitAuthURI(pkt, signer, redirectURI)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		if strings.HasPrefix(uri, redirectURI) {
+			parsed, err := url.Parse(uri)
+			require.NoError(t, err)
+			authcode := parsed.Query().Get("authcode")
+			require.NotEmpty(t, authcode)
+			return authcode
+		}
+		res, err := noRedirects.Get(uri)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusFound, res.StatusCode)
+		location, err := res.Request.URL.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+		uri = location.String()
+	}
+	require.Fail(t, "too many redirects")
+	return ""
+}
+
+func nonceOf(t *testing.T, cosSig []byte) string {
+	msg, err := jws.Parse(cosSig)
+	require.NoError(t, err)
+	nonce, ok := msg.Signatures()[0].ProtectedHeaders().Get("nonce")
+	require.True(t, ok)
+	return nonce.(string)
+}
+
+func TestPublishesKeyring(t *testing.T) {
+	srv, cos := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c))
+	})
+	first := cos.SigningKey()
+	cos.Keyring = cosigner.NewKeyring(first)
+	ctx := context.Background()
+
+	pkt, signer := newPKT(t)
+	cosClient := client.MFACosignerClient{Issuer: srv.URL}
+	authcode := authenticate(t, &cosClient, pkt, signer, "http://localhost:5555/mfaredirect")
+	cosSig, err := cosClient.Redeem(ctx, pkt, signer, authcode)
+	require.NoError(t, err)
+	require.NoError(t, pkt.AddSignature(cosSig, pktoken.COS))
+
+	second, err := cosigner.NewSigningKey(jwa.ES256)
+	require.NoError(t, err)
+	require.NoError(t, cos.Keyring.Rotate(second))
+
+	// Verifiers find both keys through the cosigner's well-known config, so
+	// the PK Token cosigned before the rotation is still accepted
+	verifier := cosigner.NewCosignerVerifier(srv.URL, cosigner.CosignerVerifierOpts{})
+	require.NoError(t, verifier.VerifyCosigner(ctx, pkt))
+
+	record, err := discover.DefaultPubkeyFinder().ByKeyID(ctx, srv.URL, second.KeyID)
+	require.NoError(t, err)
+	require.Equal(t, second.Signer.Public(), record.PublicKey)
+}
+
+func TestDeviceFlow(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c), server.WithDeviceInterval(time.Second))
+	})
+
+	pkt, signer := newPKT(t)
+
+	prompt := &strings.Builder{}
+	cosP := client.CosignerProvider{
+		Issuer:       srv.URL,
+		DeviceFlow:   true,
+		DevicePrompt: prompt,
+	}
+	redirCh := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cosP.RequestToken(context.Background(), signer, pkt, redirCh)
+		done <- err
+	}()
+
+	// The browser, which could be on another machine, opens the
+	// verification URI and follows the redirects through the MFA page back
+	// to the cosigner
+	verificationURI := <-redirCh
+	require.Contains(t, prompt.String(), srv.URL+server.DevicePath)
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	res, err := (&http.Client{Jar: jar}).Get(verificationURI)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, server.DeviceCompletePath, res.Request.URL.Path)
+
+	require.NoError(t, <-done)
+	require.NotNil(t, pkt.Cos)
+}
+
+func TestDeviceEndpoints(t *testing.T) {
+	srv, _ := newServer(t, func(c *cosigner.AuthCosigner) http.Handler {
+		return server.NewHandler(c, approveAll(c))
+	})
+	ctx := context.Background()
+
+	pkt, signer := newPKT(t)
+	cosClient := client.MFACosignerClient{Issuer: srv.URL}
+	auth, err := cosClient.DeviceAuth(ctx, pkt, signer)
+	require.NoError(t, err)
+	require.Equal(t, int64(server.DefaultDeviceInterval/time.Second), auth.Interval)
+	require.Regexp(t, "^[A-Z]{4}-[A-Z]{4}$", auth.UserCode)
+
+	poll := func(deviceCode string) msgs.DeviceToken {
+		res, err := http.PostForm(srv.URL+server.DeviceTokenPath, url.Values{"device_code": {deviceCode}})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var token msgs.DeviceToken
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&token))
+		return token
+	}
+	require.Equal(t, "authorization_pending", poll(auth.DeviceCode).Error)
+	require.Equal(t, "slow_down", poll(auth.DeviceCode).Error)
+	require.Equal(t, "expired_token", poll("unknown").Error)
+
+	// User codes are forgiving of case and separators, but must exist
+	res, err := noRedirects.Get(srv.URL + server.DevicePath + "?user_code=" + url.QueryEscape(strings.ToLower(strings.ReplaceAll(auth.UserCode, "-", " "))))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	res, err = noRedirects.Get(srv.URL + server.DevicePath + "?user_code=BBBB-BBBB")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// The authcode is only accepted from the browser which entered the code
+	res, err = http.Get(srv.URL + server.DeviceCompletePath + "?authcode=1234")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// The browser must be sent back to the cosigner, not the client
+	initURI, _, err := cosClient.InitAuthURI(pkt, signer, "http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	parsed, err := url.Parse(initURI)
+	require.NoError(t, err)
+	res, err = http.PostForm(srv.URL+server.DeviceAuthorizationPath, parsed.Query())
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
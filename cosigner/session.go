@@ -0,0 +1,200 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// RevocationListTyp is the typ of the signed revocation list published by
+// the cosigner
+const RevocationListTyp = "COS-RL"
+
+// Session is a cosigned session, that is an auth session for which the
+// cosigner issued a signature.
+type Session struct {
+	AuthID     string    // Auth ID (eid) in the cosigner signature
+	User       UserKey   // User the PK Token was issued to
+	Username   string    // ID Token email or username
+	DeviceID   string    // JWK thumbprint of the user's public key (upk)
+	IssuedAt   time.Time // When the cosigner signature was issued
+	Expiration time.Time // When the cosigner signature expires
+	Revoked    bool
+	RevokedAt  time.Time
+}
+
+// SessionFilter selects sessions. Only sessions matching every field set
+// are selected.
+type SessionFilter struct {
+	User     *UserKey
+	AuthID   string
+	DeviceID string
+}
+
+// IsEmpty returns true if the filter has no fields set and so would select
+// every session.
+func (f SessionFilter) IsEmpty() bool {
+	return f.User == nil && f.AuthID == "" && f.DeviceID == ""
+}
+
+// Matches returns true if the session is selected by the filter
+func (f SessionFilter) Matches(s Session) bool {
+	if f.User != nil && *f.User != s.User {
+		return false
+	}
+	if f.AuthID != "" && f.AuthID != s.AuthID {
+		return false
+	}
+	if f.DeviceID != "" && f.DeviceID != s.DeviceID {
+		return false
+	}
+	return true
+}
+
+type SessionStore interface {
+	AddSession(session Session) error
+	// Sessions returns all sessions, revoked or not, matching the filter
+	Sessions(filter SessionFilter) ([]Session, error)
+	// Revoke marks the session with the authID as revoked
+	Revoke(authID string, revokedAt time.Time) error
+}
+
+// RevokedSession is an entry in the RevocationList
+type RevokedSession struct {
+	AuthID     string `json:"eid"`
+	RevokedAt  int64  `json:"revoked_at"`
+	Expiration int64  `json:"exp"`
+}
+
+// RevocationList lists the cosigner signatures which have been revoked
+// before they expired. Signatures which have expired are not listed as
+// verifiers reject them regardless.
+type RevocationList struct {
+	Issuer   string           `json:"iss"`
+	IssuedAt int64            `json:"iat"`
+	Revoked  []RevokedSession `json:"revoked"`
+}
+
+func newSession(pkt *pktoken.PKToken, authState AuthState, claims pktoken.CosignerClaims) (*Session, error) {
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return nil, err
+	}
+	jkt, err := cic.PublicKey().Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute thumbprint of user's public key: %w", err)
+	}
+	return &Session{
+		AuthID:     claims.AuthID,
+		User:       authState.UserKey(),
+		Username:   authState.Username,
+		DeviceID:   string(util.Base64EncodeForJWT(jkt)),
+		IssuedAt:   time.Unix(claims.IssuedAt, 0),
+		Expiration: time.Unix(claims.Expiration, 0),
+	}, nil
+}
+
+// ListSessions returns the cosigned sessions matching the filter
+func (c *AuthCosigner) ListSessions(filter SessionFilter) ([]Session, error) {
+	if c.SessionStore == nil {
+		return nil, fmt.Errorf("cosigner is not configured with a session store")
+	}
+	return c.SessionStore.Sessions(filter)
+}
+
+// RevokeSessions revokes every unrevoked session matching the filter and
+// returns the sessions revoked. For instance, when a user reports a stolen
+// laptop, revoke by the DeviceID of that laptop or by the user. Revoked
+// sessions are published in the RevocationList.
+func (c *AuthCosigner) RevokeSessions(filter SessionFilter) ([]Session, error) {
+	if c.SessionStore == nil {
+		return nil, fmt.Errorf("cosigner is not configured with a session store")
+	}
+	if filter.IsEmpty() {
+		return nil, fmt.Errorf("refusing to revoke all sessions, filter must be set")
+	}
+
+	sessions, err := c.SessionStore.Sessions(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	revoked := []Session{}
+	for _, session := range sessions {
+		if session.Revoked {
+			continue
+		}
+		if err := c.SessionStore.Revoke(session.AuthID, now); err != nil {
+			return revoked, fmt.Errorf("failed to revoke session (%s): %w", session.AuthID, err)
+		}
+		session.Revoked = true
+		session.RevokedAt = now
+		revoked = append(revoked, session)
+	}
+	return revoked, nil
+}
+
+// RevocationList returns the cosigner's current revocation list as a JWS
+// signed by the cosigner's key so that it can be served from an untrusted
+// location.
+func (c *AuthCosigner) RevocationList() ([]byte, error) {
+	if c.SessionStore == nil {
+		return nil, fmt.Errorf("cosigner is not configured with a session store")
+	}
+	sessions, err := c.SessionStore.Sessions(SessionFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rl := RevocationList{
+		Issuer:   c.Issuer,
+		IssuedAt: now.Unix(),
+		Revoked:  []RevokedSession{},
+	}
+	for _, session := range sessions {
+		if session.Revoked && now.Before(session.Expiration) {
+			rl.Revoked = append(rl.Revoked, RevokedSession{
+				AuthID:     session.AuthID,
+				RevokedAt:  session.RevokedAt.Unix(),
+				Expiration: session.Expiration.Unix(),
+			})
+		}
+	}
+	payload, err := json.Marshal(rl)
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.SigningKey()
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.KeyIDKey, key.KeyID); err != nil {
+		return nil, err
+	}
+	if err := headers.Set(jws.TypeKey, RevocationListTyp); err != nil {
+		return nil, err
+	}
+	return jws.Sign(payload, jws.WithKey(key.Alg, key.Signer, jws.WithProtectedHeaders(headers)))
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cosigner_test
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner"
+	cosmock "github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRevocation(t *testing.T) {
+	cos := CreateAuthCosigner(t)
+	store := cosmock.NewSessionInMemoryStore()
+	cos.SessionStore = store
+
+	alg := jwa.ES256
+	laptopSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	laptopPkt, err := mocks.GenerateMockPKToken(t, laptopSigner, alg)
+	require.NoError(t, err)
+
+	phoneSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	phonePkt, err := mocks.GenerateMockPKToken(t, phoneSigner, alg)
+	require.NoError(t, err)
+
+	laptopAuthID := cosignSession(t, cos, laptopPkt, laptopSigner)
+	phoneAuthID := cosignSession(t, cos, phonePkt, phoneSigner)
+
+	allSessions, err := store.Sessions(cosigner.SessionFilter{})
+	require.NoError(t, err)
+	require.Len(t, allSessions, 2)
+
+	laptopSessions, err := cos.ListSessions(cosigner.SessionFilter{AuthID: laptopAuthID})
+	require.NoError(t, err)
+	require.Len(t, laptopSessions, 1)
+	laptopDevice := laptopSessions[0].DeviceID
+	require.NotEmpty(t, laptopDevice)
+
+	user := laptopSessions[0].User
+	userSessions, err := cos.ListSessions(cosigner.SessionFilter{User: &user})
+	require.NoError(t, err)
+	require.Len(t, userSessions, 2, "both sessions should belong to the same mock user")
+
+	_, err = cos.RevokeSessions(cosigner.SessionFilter{})
+	require.ErrorContains(t, err, "refusing to revoke all sessions")
+
+	// Revoke the stolen laptop
+	revoked, err := cos.RevokeSessions(cosigner.SessionFilter{DeviceID: laptopDevice})
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	require.Equal(t, laptopAuthID, revoked[0].AuthID)
+	require.True(t, revoked[0].Revoked)
+
+	// Revoking again is a no-op
+	revoked, err = cos.RevokeSessions(cosigner.SessionFilter{DeviceID: laptopDevice})
+	require.NoError(t, err)
+	require.Empty(t, revoked)
+
+	rlJws, err := cos.RevocationList()
+	require.NoError(t, err)
+
+	payload, err := jws.Verify(rlJws, jws.WithKey(cos.Alg, cos.Signer.Public()))
+	require.NoError(t, err)
+	msg, err := jws.Parse(rlJws)
+	require.NoError(t, err)
+	require.Equal(t, cosigner.RevocationListTyp, msg.Signatures()[0].ProtectedHeaders().Type())
+	require.Equal(t, cos.KeyID, msg.Signatures()[0].ProtectedHeaders().KeyID())
+
+	var rl cosigner.RevocationList
+	require.NoError(t, json.Unmarshal(payload, &rl))
+	require.Equal(t, cos.Issuer, rl.Issuer)
+	require.Len(t, rl.Revoked, 1)
+	require.Equal(t, laptopAuthID, rl.Revoked[0].AuthID)
+
+	// Revoking the user revokes the remaining phone session
+	revoked, err = cos.RevokeSessions(cosigner.SessionFilter{User: &user})
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	require.Equal(t, phoneAuthID, revoked[0].AuthID)
+}
+
+func TestSessionRevocationNoStore(t *testing.T) {
+	cos := CreateAuthCosigner(t)
+
+	_, err := cos.ListSessions(cosigner.SessionFilter{})
+	require.ErrorContains(t, err, "not configured with a session store")
+	_, err = cos.RevokeSessions(cosigner.SessionFilter{AuthID: "1234"})
+	require.ErrorContains(t, err, "not configured with a session store")
+	_, err = cos.RevocationList()
+	require.ErrorContains(t, err, "not configured with a session store")
+}
+
+func cosignSession(t *testing.T, cos *cosigner.AuthCosigner, pkt *pktoken.PKToken, signer crypto.Signer) string {
+	cosP := client.CosignerProvider{
+		Issuer:       "https://example.com",
+		CallbackPath: "/mfaredirect",
+	}
+	redirectURI := fmt.Sprintf("%s/%s", "http://localhost:5555", cosP.CallbackPath)
+
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig(redirectURI)
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+
+	authcode, err := cos.NewAuthcode(authID)
+	require.NoError(t, err)
+	acSig, err := pkt.NewSignedMessage([]byte(authcode), signer)
+	require.NoError(t, err)
+	cosSig, err := cos.RedeemAuthcode(acSig)
+	require.NoError(t, err)
+	require.NotEmpty(t, cosSig)
+	return authID
+}
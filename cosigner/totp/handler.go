@@ -0,0 +1,144 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/openpubkey/openpubkey/cosigner/server"
+	"github.com/openpubkey/openpubkey/i18n"
+)
+
+// MFAPage is the name of the page which enrolls the user and asks them for
+// a code. It is executed with an i18n.Page. Products wanting to show the
+// provisioning URI as a QR code can replace it with a page which renders
+// one.
+const MFAPage = "totp-mfa"
+
+//go:embed totp.tmpl
+var mfaTemplateFile string
+
+var mfaTemplate = template.Must(template.New(MFAPage).Parse(mfaTemplateFile))
+
+type handler struct {
+	cosigner  *Cosigner
+	localizer *i18n.Localizer
+}
+
+type HandlerOpts func(h *handler)
+
+// WithLocalizer localizes and rebrands the MFA page
+func WithLocalizer(localizer *i18n.Localizer) HandlerOpts {
+	return func(h *handler) {
+		h.localizer = localizer
+	}
+}
+
+// NewHandler returns the HTTP endpoints a client.CosignerProvider and the
+// user's browser use to get a PK Token cosigned, see the server package. The page and the endpoints
+// use relative URLs so the handler can be mounted under a path prefix with
+// http.StripPrefix.
+func NewHandler(c *Cosigner, opts ...HandlerOpts) http.Handler {
+	h := &handler{cosigner: c}
+	for _, applyOpt := range opts {
+		applyOpt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.mfaPage)
+	mux.HandleFunc("/check-enrollment", h.checkIfEnrolled)
+	mux.HandleFunc("/enroll/begin", h.beginEnrollment)
+	mux.HandleFunc("/enroll/finish", h.finishEnrollment)
+	mux.HandleFunc("/login", h.login)
+	return server.NewHandler(c.AuthCosigner, mux)
+}
+
+func (h *handler) mfaPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	h.localizer.Render(w, r, MFAPage, mfaTemplate, nil)
+}
+
+func (h *handler) checkIfEnrolled(w http.ResponseWriter, r *http.Request) {
+	enrolled, err := h.cosigner.IsEnrolled(r.URL.Query().Get("authid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{
+		"isEnrolled": enrolled,
+	})
+}
+
+func (h *handler) beginEnrollment(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := h.cosigner.BeginEnrollment(r.URL.Query().Get("authid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The secret must not linger in caches
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, enrollment)
+}
+
+func (h *handler) finishEnrollment(w http.ResponseWriter, r *http.Request) {
+	h.checkCode(w, r, h.cosigner.FinishEnrollment)
+}
+
+func (h *handler) login(w http.ResponseWriter, r *http.Request) {
+	h.checkCode(w, r, h.cosigner.Login)
+}
+
+func (h *handler) checkCode(w http.ResponseWriter, r *http.Request, check func(authID, code string) (string, string, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body); err != nil {
+		http.Error(w, "Error in parsing code", http.StatusBadRequest)
+		return
+	}
+
+	authcode, ruri, err := check(r.URL.Query().Get("authid"), body.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"redirect_uri": fmt.Sprintf("%s?authcode=%s", ruri, authcode),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// SecretStore stores each user's TOTP secret. Anyone who reads a secret can
+// generate the user's codes, so implementations backed by a database should
+// encrypt secrets at rest.
+type SecretStore interface {
+	// Secret returns the user's secret, nil if the user hasn't enrolled
+	Secret(user cosigner.UserKey) ([]byte, error)
+	// Enroll stores the user's secret, it fails if the user has already
+	// enrolled
+	Enroll(user cosigner.UserKey, secret []byte) error
+	// UseStep records that a code for the time step was accepted for the
+	// user. It returns false if a code for the same or a later step was
+	// accepted already, so that codes can't be replayed.
+	UseStep(user cosigner.UserKey, step int64) (bool, error)
+	// Unenroll removes the user's secret so that they can enroll again,
+	// see the recovery package
+	Unenroll(user cosigner.UserKey) error
+}
+
+type enrollment struct {
+	secret   []byte
+	lastStep int64
+}
+
+// MemorySecretStore is a SecretStore kept in process memory
+type MemorySecretStore struct {
+	lock        sync.Mutex
+	enrollments map[cosigner.UserKey]*enrollment
+}
+
+var _ SecretStore = (*MemorySecretStore)(nil)
+
+func NewMemorySecretStore() *MemorySecretStore {
+	return &MemorySecretStore{
+		enrollments: map[cosigner.UserKey]*enrollment{},
+	}
+}
+
+func (s *MemorySecretStore) Secret(user cosigner.UserKey) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.enrollments[user]; ok {
+		return append([]byte{}, e.secret...), nil
+	}
+	return nil, nil
+}
+
+func (s *MemorySecretStore) Enroll(user cosigner.UserKey, secret []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.enrollments[user]; ok {
+		return fmt.Errorf("user has already enrolled")
+	}
+	s.enrollments[user] = &enrollment{secret: append([]byte{}, secret...)}
+	return nil
+}
+
+func (s *MemorySecretStore) UseStep(user cosigner.UserKey, step int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.enrollments[user]
+	if !ok {
+		return false, fmt.Errorf("user has not enrolled")
+	}
+	if step <= e.lastStep {
+		return false, nil
+	}
+	e.lastStep = step
+	return true, nil
+}
+
+func (s *MemorySecretStore) Unenroll(user cosigner.UserKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.enrollments, user)
+	return nil
+}
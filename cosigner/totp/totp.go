@@ -0,0 +1,352 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package totp is a cosigner which requires users to enter a time-based one
+// time password (TOTP, RFC 6238) from an authenticator app before their PK
+// Token is cosigned. It is a second factor for deployments whose users don't
+// have WebAuthn authenticators. Users enroll the first time they cosign by
+// adding the secret to their app, from then on they enter the code it shows.
+package totp
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/notify"
+)
+
+const (
+	DefaultPeriod            = 30 * time.Second
+	DefaultDigits            = 6
+	DefaultSkew              = 1
+	DefaultMaxAttempts       = 5
+	DefaultLockout           = 15 * time.Minute
+	DefaultEnrollmentTimeout = 10 * time.Minute
+
+	// secretSize is the size RFC 4226 recommends for HMAC-SHA1
+	secretSize = 20
+)
+
+// Enrollment is what the user adds to their authenticator app
+type Enrollment struct {
+	// Secret is the base32 encoded secret for entering by hand
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI, it is what enrollment QR codes
+	// encode and opens the authenticator app on phones
+	URI string `json:"uri"`
+}
+
+type pendingEnrollment struct {
+	secret     []byte
+	expiration time.Time
+}
+
+type failures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// Cosigner is an AuthCosigner which issues an authcode once the user has
+// entered a valid TOTP code
+type Cosigner struct {
+	*cosigner.AuthCosigner
+	Secrets SecretStore
+	// Label names the account in authenticator apps, defaults to the host
+	// of the cosigner's issuer
+	Label  string
+	Period time.Duration
+	Digits int
+	// Skew is how many periods before or after the current one codes are
+	// accepted from, to tolerate drift between the cosigner's clock and the
+	// user's device
+	Skew int
+	// MaxAttempts is how many wrong codes in a row lock the user out for
+	// Lockout, it stops codes from being guessed
+	MaxAttempts       int
+	Lockout           time.Duration
+	EnrollmentTimeout time.Duration
+
+	lock     sync.Mutex
+	pending  map[string]pendingEnrollment // authID -> enrollment in progress
+	failures map[cosigner.UserKey]*failures
+	now      func() time.Time
+}
+
+func New(signer crypto.Signer, alg jwa.SignatureAlgorithm, issuer, keyID string, store cosigner.AuthStateStore, secrets SecretStore) (*Cosigner, error) {
+	authCos, err := cosigner.New(signer, alg, issuer, keyID, store)
+	if err != nil {
+		return nil, err
+	}
+
+	label := issuer
+	if issuerURI, err := url.Parse(issuer); err == nil && issuerURI.Host != "" {
+		label = issuerURI.Host
+	}
+
+	return &Cosigner{
+		AuthCosigner:      authCos,
+		Secrets:           secrets,
+		Label:             label,
+		Period:            DefaultPeriod,
+		Digits:            DefaultDigits,
+		Skew:              DefaultSkew,
+		MaxAttempts:       DefaultMaxAttempts,
+		Lockout:           DefaultLockout,
+		EnrollmentTimeout: DefaultEnrollmentTimeout,
+		pending:           make(map[string]pendingEnrollment),
+		failures:          make(map[cosigner.UserKey]*failures),
+		now:               time.Now,
+	}, nil
+}
+
+// IsEnrolled returns true if the user of the auth session has enrolled
+func (c *Cosigner) IsEnrolled(authID string) (bool, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return false, err
+	}
+	secret, err := c.Secrets.Secret(authState.UserKey())
+	if err != nil {
+		return false, err
+	}
+	return secret != nil, nil
+}
+
+// BeginEnrollment generates a secret for the user of the auth session to add
+// to their authenticator app. Users can only enroll once, replacing a lost
+// secret has to go through the recovery package.
+func (c *Cosigner) BeginEnrollment(authID string) (*Enrollment, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return nil, err
+	}
+	if secret, err := c.Secrets.Secret(authState.UserKey()); err != nil {
+		return nil, err
+	} else if secret != nil {
+		return nil, fmt.Errorf("already has a TOTP secret enrolled for this user")
+	}
+
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for id, p := range c.pending {
+		if now.After(p.expiration) {
+			delete(c.pending, id)
+		}
+	}
+	c.pending[authID] = pendingEnrollment{
+		secret:     secret,
+		expiration: now.Add(c.EnrollmentTimeout),
+	}
+
+	account := authState.Username
+	if account == "" {
+		account = authState.Sub
+	}
+	return &Enrollment{
+		Secret: encodeSecret(secret),
+		URI:    c.provisioningURI(secret, account),
+	}, nil
+}
+
+// FinishEnrollment enrolls the user once they enter a code generated from
+// the secret, which shows their app was set up correctly. As that proves
+// the user has the secret it also returns an authcode and the redirect URI
+// the authcode should be sent to.
+func (c *Cosigner) FinishEnrollment(authID string, code string) (string, string, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return "", "", err
+	}
+	user := authState.UserKey()
+
+	c.lock.Lock()
+	p, ok := c.pending[authID]
+	c.lock.Unlock()
+	if !ok || c.now().After(p.expiration) {
+		return "", "", fmt.Errorf("no enrollment in progress for authID")
+	}
+
+	step, err := c.check(user, p.secret, code)
+	if err != nil {
+		return "", "", err
+	}
+	if err := c.Secrets.Enroll(user, p.secret); err != nil {
+		return "", "", err
+	}
+	c.Notify(notify.EventDeviceEnrolled, authState, "totp")
+	c.lock.Lock()
+	delete(c.pending, authID)
+	c.lock.Unlock()
+	if _, err := c.Secrets.UseStep(user, step); err != nil {
+		return "", "", err
+	}
+
+	authcode, err := c.NewAuthcode(authID)
+	if err != nil {
+		return "", "", err
+	}
+	return authcode, authState.RedirectURI, nil
+}
+
+// Login checks the code from the user's authenticator app and returns an
+// authcode and the redirect URI the authcode should be sent to
+func (c *Cosigner) Login(authID string, code string) (string, string, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return "", "", err
+	}
+	user := authState.UserKey()
+
+	secret, err := c.Secrets.Secret(user)
+	if err != nil {
+		return "", "", err
+	} else if secret == nil {
+		return "", "", fmt.Errorf("no TOTP secret enrolled for this user")
+	}
+
+	step, err := c.check(user, secret, code)
+	if err != nil {
+		return "", "", err
+	}
+	if fresh, err := c.Secrets.UseStep(user, step); err != nil {
+		return "", "", err
+	} else if !fresh {
+		return "", "", fmt.Errorf("code has already been used, wait for the next code")
+	}
+
+	authcode, err := c.NewAuthcode(authID)
+	if err != nil {
+		return "", "", err
+	}
+	return authcode, authState.RedirectURI, nil
+}
+
+// check returns the time step of the code if it is valid for the secret,
+// counting failures towards locking the user out
+func (c *Cosigner) check(user cosigner.UserKey, secret []byte, code string) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	f, ok := c.failures[user]
+	if !ok {
+		f = &failures{}
+		c.failures[user] = f
+	}
+	if now.Before(f.lockedUntil) {
+		return 0, fmt.Errorf("too many invalid codes, try again later")
+	}
+
+	current := now.Unix() / int64(c.Period.Seconds())
+	for i := -c.Skew; i <= c.Skew; i++ {
+		step := current + int64(i)
+		expected := generate(secret, step, c.Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			delete(c.failures, user)
+			return step, nil
+		}
+	}
+
+	f.count++
+	if f.count >= c.MaxAttempts {
+		f.count = 0
+		f.lockedUntil = now.Add(c.Lockout)
+	}
+	return 0, fmt.Errorf("invalid code")
+}
+
+// ResetAuthenticators removes the user's secret and any lockout so that they
+// can enroll a new authenticator app the next time they log in. It
+// implements recovery.Resetter.
+func (c *Cosigner) ResetAuthenticators(user cosigner.UserKey) error {
+	if err := c.Secrets.Unenroll(user); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.failures, user)
+	return nil
+}
+
+func (c *Cosigner) lookupAuthState(authID string) (*cosigner.AuthState, error) {
+	authState, ok := c.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		return nil, fmt.Errorf("no auth session found for authID")
+	}
+	return authState, nil
+}
+
+// provisioningURI returns the otpauth:// URI authenticator apps are
+// enrolled with, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func (c *Cosigner) provisioningURI(secret []byte, account string) string {
+	v := url.Values{}
+	v.Set("secret", encodeSecret(secret))
+	v.Set("issuer", c.Label)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(c.Digits))
+	v.Set("period", strconv.Itoa(int(c.Period.Seconds())))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + c.Label + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return uri.String()
+}
+
+func encodeSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// Code returns the TOTP code for the secret at time t
+func Code(secret []byte, t time.Time, period time.Duration, digits int) string {
+	return generate(secret, t.Unix()/int64(period.Seconds()), digits)
+}
+
+// generate returns the HOTP (RFC 4226) code for the counter
+func generate(secret []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := value % uint32(math.Pow10(digits))
+	return fmt.Sprintf("%0*d", digits, code)
+}
@@ -0,0 +1,332 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package totp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/notify"
+	"github.com/openpubkey/openpubkey/pktoken"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	// Test vectors from RFC 6238 Appendix B for SHA1
+	secret := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "94287082"},
+		{unix: 1111111109, code: "07081804"},
+		{unix: 1111111111, code: "14050471"},
+		{unix: 1234567890, code: "89005924"},
+		{unix: 2000000000, code: "69279037"},
+		{unix: 20000000000, code: "65353130"},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.code, Code(secret, time.Unix(tc.unix, 0), 30*time.Second, 8), tc.unix)
+	}
+	require.Equal(t, "287082", Code(secret, time.Unix(59, 0), 30*time.Second, 6))
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newCosigner(t *testing.T, issuer string) (*Cosigner, *clock) {
+	alg := jwa.ES256
+	cosSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	hmacKey := make([]byte, 64)
+	_, err = rand.Read(hmacKey)
+	require.NoError(t, err)
+
+	cos, err := New(cosSigner, alg, issuer, "test-kid", mocks.NewAuthStateInMemoryStore(hmacKey), NewMemorySecretStore())
+	require.NoError(t, err)
+
+	clk := &clock{now: time.Now()}
+	cos.now = clk.Now
+	return cos, clk
+}
+
+type user struct {
+	pkt    *pktoken.PKToken
+	signer func([]byte) []byte
+	cosP   client.CosignerProvider
+}
+
+func newUser(t *testing.T, issuer string) *user {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+	return &user{
+		pkt: pkt,
+		signer: func(msg []byte) []byte {
+			sig, err := pkt.NewSignedMessage(msg, signer)
+			require.NoError(t, err)
+			return sig
+		},
+		cosP: client.CosignerProvider{
+			Issuer:       issuer,
+			CallbackPath: "/mfaredirect",
+		},
+	}
+}
+
+func (u *user) sig1(t *testing.T) []byte {
+	initAuthMsgJson, _, err := u.cosP.CreateInitAuthSig("http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	return u.signer(initAuthMsgJson)
+}
+
+func (u *user) initAuth(t *testing.T, cos *Cosigner) string {
+	authID, err := cos.InitAuth(u.pkt, u.sig1(t))
+	require.NoError(t, err)
+	return authID
+}
+
+func decodeSecret(t *testing.T, secret string) []byte {
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+	return decoded
+}
+
+func TestCosigner(t *testing.T) {
+	issuer := "https://mfa.example.com"
+	cos, clk := newCosigner(t, issuer)
+	alice := newUser(t, issuer)
+	var events []notify.Event
+	cos.Notifier = notify.NotifierFunc(func(ctx context.Context, event notify.Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	authID := alice.initAuth(t, cos)
+	enrolled, err := cos.IsEnrolled(authID)
+	require.NoError(t, err)
+	require.False(t, enrolled)
+
+	_, _, err = cos.Login(authID, "123456")
+	require.ErrorContains(t, err, "no TOTP secret enrolled")
+	_, _, err = cos.FinishEnrollment(authID, "123456")
+	require.ErrorContains(t, err, "no enrollment in progress")
+
+	enrollment, err := cos.BeginEnrollment(authID)
+	require.NoError(t, err)
+	secret := decodeSecret(t, enrollment.Secret)
+	require.Len(t, secret, secretSize)
+
+	uri, err := url.Parse(enrollment.URI)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.True(t, strings.HasPrefix(uri.Path, "/mfa.example.com:"))
+	require.Equal(t, enrollment.Secret, uri.Query().Get("secret"))
+	require.Equal(t, "mfa.example.com", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+	require.Equal(t, "30", uri.Query().Get("period"))
+
+	_, _, err = cos.FinishEnrollment(authID, "not-a-code")
+	require.ErrorContains(t, err, "invalid code")
+
+	code := Code(secret, clk.now, DefaultPeriod, DefaultDigits)
+	authcode, ruri, err := cos.FinishEnrollment(authID, code)
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:5555/mfaredirect", ruri)
+	require.Len(t, events, 2)
+	require.Equal(t, notify.EventDeviceEnrolled, events[0].Type)
+	require.Equal(t, "totp", events[0].Device)
+	require.Equal(t, notify.EventLogin, events[1].Type)
+
+	cosSig, err := cos.RedeemAuthcode(alice.signer([]byte(authcode)))
+	require.NoError(t, err)
+	require.NoError(t, alice.pkt.AddSignature(cosSig, pktoken.COS))
+
+	// Users can only enroll once
+	authID = alice.initAuth(t, cos)
+	enrolled, err = cos.IsEnrolled(authID)
+	require.NoError(t, err)
+	require.True(t, enrolled)
+	_, err = cos.BeginEnrollment(authID)
+	require.ErrorContains(t, err, "already has a TOTP secret enrolled")
+
+	// The code used to enroll can't be replayed
+	_, _, err = cos.Login(authID, code)
+	require.ErrorContains(t, err, "already been used")
+
+	// Codes from the previous period are accepted to tolerate clock drift
+	clk.now = clk.now.Add(2 * DefaultPeriod)
+	_, _, err = cos.Login(authID, Code(secret, clk.now.Add(-DefaultPeriod), DefaultPeriod, DefaultDigits))
+	require.NoError(t, err)
+
+	// but not once a later code was used
+	clk.now = clk.now.Add(DefaultPeriod)
+	authID = alice.initAuth(t, cos)
+	_, _, err = cos.Login(authID, Code(secret, clk.now, DefaultPeriod, DefaultDigits))
+	require.NoError(t, err)
+	authID = alice.initAuth(t, cos)
+	_, _, err = cos.Login(authID, Code(secret, clk.now.Add(-DefaultPeriod), DefaultPeriod, DefaultDigits))
+	require.ErrorContains(t, err, "already been used")
+
+	// Codes from too long ago are rejected
+	clk.now = clk.now.Add(3 * DefaultPeriod)
+	_, _, err = cos.Login(authID, Code(secret, clk.now.Add(-2*DefaultPeriod), DefaultPeriod, DefaultDigits))
+	require.ErrorContains(t, err, "invalid code")
+
+	_, err = cos.IsEnrolled("unknown-auth-id")
+	require.ErrorContains(t, err, "no auth session found")
+}
+
+func TestLockout(t *testing.T) {
+	issuer := "https://mfa.example.com"
+	cos, clk := newCosigner(t, issuer)
+	alice := newUser(t, issuer)
+
+	authID := alice.initAuth(t, cos)
+	enrollment, err := cos.BeginEnrollment(authID)
+	require.NoError(t, err)
+	secret := decodeSecret(t, enrollment.Secret)
+	_, _, err = cos.FinishEnrollment(authID, Code(secret, clk.now, DefaultPeriod, DefaultDigits))
+	require.NoError(t, err)
+
+	clk.now = clk.now.Add(time.Minute)
+	wrongCode := "000000"
+	if wrongCode == Code(secret, clk.now, DefaultPeriod, DefaultDigits) {
+		wrongCode = "111111"
+	}
+
+	// New auth sessions don't reset the count, the lockout is per user
+	for i := 0; i < DefaultMaxAttempts; i++ {
+		authID = alice.initAuth(t, cos)
+		_, _, err = cos.Login(authID, wrongCode)
+		require.ErrorContains(t, err, "invalid code")
+	}
+	_, _, err = cos.Login(authID, Code(secret, clk.now, DefaultPeriod, DefaultDigits))
+	require.ErrorContains(t, err, "too many invalid codes")
+
+	clk.now = clk.now.Add(DefaultLockout)
+	authID = alice.initAuth(t, cos)
+	_, _, err = cos.Login(authID, Code(secret, clk.now, DefaultPeriod, DefaultDigits))
+	require.NoError(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	issuer := server.URL + "/totp"
+	cos, clk := newCosigner(t, issuer)
+	mux.Handle("/totp/", http.StripPrefix("/totp", NewHandler(cos)))
+	alice := newUser(t, issuer)
+
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) (*http.Response, []byte) {
+		res, err := httpClient.Get(server.URL + "/totp" + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+	post := func(path string, code string) (*http.Response, []byte) {
+		reqBody, err := json.Marshal(map[string]string{"code": code})
+		require.NoError(t, err)
+		res, err := httpClient.Post(server.URL+"/totp"+path, "application/json", bytes.NewReader(reqBody))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+
+	pktJson, err := alice.pkt.MarshalJSON()
+	require.NoError(t, err)
+	res, _ := get(fmt.Sprintf("/mfa-auth-init?pkt=%s&sig1=%s",
+		util.Base64EncodeForJWT(pktJson), url.QueryEscape(string(alice.sig1(t)))))
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "./", location.Path)
+	authID := url.QueryEscape(location.Query().Get("authid"))
+
+	res, body := get("/")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Contains(t, string(body), "check-enrollment?authid=")
+
+	res, body = get("/check-enrollment?authid=" + authID)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"isEnrolled":false}`, string(body))
+
+	res, body = get("/enroll/begin?authid=" + authID)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	var enrollment Enrollment
+	require.NoError(t, json.Unmarshal(body, &enrollment))
+	secret := decodeSecret(t, enrollment.Secret)
+
+	res, _ = get("/enroll/finish?authid=" + authID)
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, _ = post("/enroll/finish?authid="+authID, "bad")
+	require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, body = post("/enroll/finish?authid="+authID, Code(secret, clk.now, DefaultPeriod, DefaultDigits))
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var redirect struct {
+		RedirectURI string `json:"redirect_uri"`
+	}
+	require.NoError(t, json.Unmarshal(body, &redirect))
+	redirectURI, err := url.Parse(redirect.RedirectURI)
+	require.NoError(t, err)
+	authcode := redirectURI.Query().Get("authcode")
+	require.NotEmpty(t, authcode)
+
+	res, body = get("/sign?sig2=" + url.QueryEscape(string(alice.signer([]byte(authcode)))))
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	cosSig, err := util.Base64DecodeForJWT(body)
+	require.NoError(t, err)
+	require.NoError(t, alice.pkt.AddSignature(cosSig, pktoken.COS))
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package webauthn
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	gowebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/openpubkey/openpubkey/cosigner"
+)
+
+// CredentialStore stores the WebAuthn credentials registered by each user.
+// Deployments running more than one cosigner replica should back it with a
+// shared database.
+type CredentialStore interface {
+	// Credentials returns the credentials registered by the user, none if
+	// the user hasn't registered
+	Credentials(user cosigner.UserKey) ([]gowebauthn.Credential, error)
+	AddCredential(user cosigner.UserKey, credential gowebauthn.Credential) error
+	// UpdateCredential replaces the stored credential with the same ID, it
+	// is called after each login to record the authenticator's sign count
+	UpdateCredential(user cosigner.UserKey, credential gowebauthn.Credential) error
+	// RemoveCredentials removes every credential registered by the user so
+	// that they can register a new authenticator, see the recovery package
+	RemoveCredentials(user cosigner.UserKey) error
+}
+
+// MemoryCredentialStore is a CredentialStore kept in process memory
+type MemoryCredentialStore struct {
+	lock        sync.RWMutex
+	credentials map[cosigner.UserKey][]gowebauthn.Credential
+}
+
+var _ CredentialStore = (*MemoryCredentialStore)(nil)
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		credentials: map[cosigner.UserKey][]gowebauthn.Credential{},
+	}
+}
+
+func (s *MemoryCredentialStore) Credentials(user cosigner.UserKey) ([]gowebauthn.Credential, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]gowebauthn.Credential{}, s.credentials[user]...), nil
+}
+
+func (s *MemoryCredentialStore) AddCredential(user cosigner.UserKey, credential gowebauthn.Credential) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, existing := range s.credentials[user] {
+		if bytes.Equal(existing.ID, credential.ID) {
+			return fmt.Errorf("credential already registered")
+		}
+	}
+	s.credentials[user] = append(s.credentials[user], credential)
+	return nil
+}
+
+func (s *MemoryCredentialStore) UpdateCredential(user cosigner.UserKey, credential gowebauthn.Credential) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, existing := range s.credentials[user] {
+		if bytes.Equal(existing.ID, credential.ID) {
+			s.credentials[user][i] = credential
+			return nil
+		}
+	}
+	return fmt.Errorf("credential not found")
+}
+
+func (s *MemoryCredentialStore) RemoveCredentials(user cosigner.UserKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.credentials, user)
+	return nil
+}
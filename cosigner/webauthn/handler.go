@@ -0,0 +1,149 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package webauthn
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/openpubkey/openpubkey/cosigner/server"
+	"github.com/openpubkey/openpubkey/i18n"
+)
+
+// MFAPage is the name of the page which registers the user's authenticator
+// and logs them in with it. It is executed with an i18n.Page.
+const MFAPage = "webauthn-mfa"
+
+//go:embed mfa.tmpl
+var mfaTemplateFile string
+
+var mfaTemplate = template.Must(template.New(MFAPage).Parse(mfaTemplateFile))
+
+type handler struct {
+	cosigner  *Cosigner
+	localizer *i18n.Localizer
+}
+
+type HandlerOpts func(h *handler)
+
+// WithLocalizer localizes and rebrands the MFA page
+func WithLocalizer(localizer *i18n.Localizer) HandlerOpts {
+	return func(h *handler) {
+		h.localizer = localizer
+	}
+}
+
+// NewHandler returns the HTTP endpoints a client.CosignerProvider and the
+// user's browser use to get a PK Token cosigned, see the server package. The page and the endpoints
+// use relative URLs so the handler can be mounted under a path prefix with
+// http.StripPrefix.
+func NewHandler(c *Cosigner, opts ...HandlerOpts) http.Handler {
+	h := &handler{cosigner: c}
+	for _, applyOpt := range opts {
+		applyOpt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.mfaPage)
+	mux.HandleFunc("/check-registration", h.checkIfRegistered)
+	mux.HandleFunc("/register/begin", h.beginRegistration)
+	mux.HandleFunc("/register/finish", h.finishRegistration)
+	mux.HandleFunc("/login/begin", h.beginLogin)
+	mux.HandleFunc("/login/finish", h.finishLogin)
+	return server.NewHandler(c.AuthCosigner, mux)
+}
+
+func (h *handler) mfaPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	h.localizer.Render(w, r, MFAPage, mfaTemplate, nil)
+}
+
+func (h *handler) checkIfRegistered(w http.ResponseWriter, r *http.Request) {
+	registered, err := h.cosigner.IsRegistered(r.URL.Query().Get("authid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{
+		"isRegistered": registered,
+	})
+}
+
+func (h *handler) beginRegistration(w http.ResponseWriter, r *http.Request) {
+	options, err := h.cosigner.BeginRegistration(r.URL.Query().Get("authid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+func (h *handler) finishRegistration(w http.ResponseWriter, r *http.Request) {
+	parsedResponse, err := protocol.ParseCredentialCreationResponse(r)
+	if err != nil {
+		http.Error(w, "Error in parsing credential", http.StatusBadRequest)
+		return
+	}
+	if err := h.cosigner.FinishRegistration(r.URL.Query().Get("authid"), parsedResponse); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) beginLogin(w http.ResponseWriter, r *http.Request) {
+	options, err := h.cosigner.BeginLogin(r.URL.Query().Get("authid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+func (h *handler) finishLogin(w http.ResponseWriter, r *http.Request) {
+	parsedResponse, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		http.Error(w, "Error in parsing credential", http.StatusBadRequest)
+		return
+	}
+	authcode, ruri, err := h.cosigner.FinishLogin(r.URL.Query().Get("authid"), parsedResponse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"redirect_uri": fmt.Sprintf("%s?authcode=%s", ruri, authcode),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
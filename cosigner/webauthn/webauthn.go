@@ -0,0 +1,298 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package webauthn is a cosigner which requires users to authenticate with
+// a WebAuthn authenticator, such as a security key or passkey, before their
+// PK Token is cosigned. The first time a user cosigns they register an
+// authenticator, afterwards they must log in with it.
+package webauthn
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	gowebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/notify"
+)
+
+// DefaultCeremonyTimeout is how long a user has to complete a registration
+// or login ceremony once it has begun
+const DefaultCeremonyTimeout = 5 * time.Minute
+
+type ceremonyKind string
+
+const (
+	registration ceremonyKind = "registration"
+	login        ceremonyKind = "login"
+)
+
+type ceremony struct {
+	kind       ceremonyKind
+	session    *gowebauthn.SessionData
+	expiration time.Time
+}
+
+// Cosigner is an AuthCosigner which issues an authcode once the user has
+// logged in with a registered WebAuthn authenticator
+type Cosigner struct {
+	*cosigner.AuthCosigner
+	WebAuthn        *gowebauthn.WebAuthn
+	Credentials     CredentialStore
+	CeremonyTimeout time.Duration
+
+	lock       sync.Mutex
+	ceremonies map[string]ceremony // authID -> ceremony in progress
+}
+
+func New(signer crypto.Signer, alg jwa.SignatureAlgorithm, issuer, keyID string, store cosigner.AuthStateStore, cfg *gowebauthn.Config, credentials CredentialStore) (*Cosigner, error) {
+	authCos, err := cosigner.New(signer, alg, issuer, keyID, store)
+	if err != nil {
+		return nil, err
+	}
+	wauth, err := gowebauthn.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cosigner{
+		AuthCosigner:    authCos,
+		WebAuthn:        wauth,
+		Credentials:     credentials,
+		CeremonyTimeout: DefaultCeremonyTimeout,
+		ceremonies:      make(map[string]ceremony),
+	}, nil
+}
+
+// IsRegistered returns true if the user of the auth session has registered
+// an authenticator
+func (c *Cosigner) IsRegistered(authID string) (bool, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return false, err
+	}
+	credentials, err := c.Credentials.Credentials(authState.UserKey())
+	if err != nil {
+		return false, err
+	}
+	return len(credentials) > 0, nil
+}
+
+// BeginRegistration starts registering an authenticator for the user of
+// the auth session. Users can only register while they have no
+// authenticator, adding further authenticators requires logging in with an
+// existing one and isn't supported by this cosigner.
+func (c *Cosigner) BeginRegistration(authID string) (*protocol.CredentialCreation, error) {
+	user, err := c.user(authID)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.credentials) > 0 {
+		return nil, fmt.Errorf("already has a webauthn device registered for this user")
+	}
+	credCreation, session, err := c.WebAuthn.BeginRegistration(user)
+	if err != nil {
+		return nil, err
+	}
+	c.begin(authID, registration, session)
+	return credCreation, nil
+}
+
+func (c *Cosigner) FinishRegistration(authID string, parsedResponse *protocol.ParsedCredentialCreationData) error {
+	session, err := c.finish(authID, registration)
+	if err != nil {
+		return err
+	}
+	user, err := c.user(authID)
+	if err != nil {
+		return err
+	}
+	// Checked again in case another registration for the same user finished
+	// since this one began
+	if len(user.credentials) > 0 {
+		return fmt.Errorf("already has a webauthn device registered for this user")
+	}
+	credential, err := c.WebAuthn.CreateCredential(user, *session, parsedResponse)
+	if err != nil {
+		return err
+	}
+	if err := c.Credentials.AddCredential(user.key, *credential); err != nil {
+		return err
+	}
+	if authState, err := c.lookupAuthState(authID); err == nil {
+		c.Notify(notify.EventDeviceEnrolled, authState, "webauthn")
+	}
+	return nil
+}
+
+func (c *Cosigner) BeginLogin(authID string) (*protocol.CredentialAssertion, error) {
+	user, err := c.user(authID)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.credentials) == 0 {
+		return nil, fmt.Errorf("no webauthn device registered for this user")
+	}
+	credAssertion, session, err := c.WebAuthn.BeginLogin(user)
+	if err != nil {
+		return nil, err
+	}
+	c.begin(authID, login, session)
+	return credAssertion, nil
+}
+
+// FinishLogin checks the authenticator's assertion and returns an authcode
+// and the redirect URI the authcode should be sent to
+func (c *Cosigner) FinishLogin(authID string, parsedResponse *protocol.ParsedCredentialAssertionData) (string, string, error) {
+	session, err := c.finish(authID, login)
+	if err != nil {
+		return "", "", err
+	}
+	user, err := c.user(authID)
+	if err != nil {
+		return "", "", err
+	}
+	credential, err := c.WebAuthn.ValidateLogin(user, *session, parsedResponse)
+	if err != nil {
+		return "", "", err
+	}
+	if credential.Authenticator.CloneWarning {
+		return "", "", fmt.Errorf("authenticator sign count did not increase, it may have been cloned")
+	}
+	if err := c.Credentials.UpdateCredential(user.key, *credential); err != nil {
+		return "", "", err
+	}
+
+	authcode, err := c.NewAuthcode(authID)
+	if err != nil {
+		return "", "", err
+	}
+	return authcode, user.redirectURI, nil
+}
+
+// ResetAuthenticators removes the user's registered authenticators so that
+// they can register a new one the next time they log in. It implements
+// recovery.Resetter.
+func (c *Cosigner) ResetAuthenticators(user cosigner.UserKey) error {
+	return c.Credentials.RemoveCredentials(user)
+}
+
+func (c *Cosigner) lookupAuthState(authID string) (*cosigner.AuthState, error) {
+	authState, ok := c.AuthStateStore.LookupAuthState(authID)
+	if !ok {
+		return nil, fmt.Errorf("no auth session found for authID")
+	}
+	return authState, nil
+}
+
+func (c *Cosigner) user(authID string) (*user, error) {
+	authState, err := c.lookupAuthState(authID)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := c.Credentials.Credentials(authState.UserKey())
+	if err != nil {
+		return nil, err
+	}
+	return newUser(authState, credentials), nil
+}
+
+func (c *Cosigner) begin(authID string, kind ceremonyKind, session *gowebauthn.SessionData) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for id, cer := range c.ceremonies {
+		if now.After(cer.expiration) {
+			delete(c.ceremonies, id)
+		}
+	}
+	c.ceremonies[authID] = ceremony{
+		kind:       kind,
+		session:    session,
+		expiration: now.Add(c.CeremonyTimeout),
+	}
+}
+
+// finish returns the session of the ceremony begun for the auth session.
+// A ceremony can only be finished once.
+func (c *Cosigner) finish(authID string, kind ceremonyKind) (*gowebauthn.SessionData, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cer, ok := c.ceremonies[authID]
+	if !ok || cer.kind != kind {
+		return nil, fmt.Errorf("no %s in progress for authID", kind)
+	}
+	delete(c.ceremonies, authID)
+	if time.Now().After(cer.expiration) {
+		return nil, fmt.Errorf("%s has expired", kind)
+	}
+	return cer.session, nil
+}
+
+type user struct {
+	key         cosigner.UserKey
+	id          []byte
+	username    string
+	displayName string
+	redirectURI string
+	credentials []gowebauthn.Credential
+}
+
+var _ gowebauthn.User = (*user)(nil)
+
+func newUser(authState *cosigner.AuthState, credentials []gowebauthn.Credential) *user {
+	key := authState.UserKey()
+	// The sub is only unique for an issuer and audience, so the user handle
+	// is derived from all three. It is a hash as user handles are limited to
+	// 64 bytes.
+	id := sha256.Sum256([]byte(strings.Join([]string{key.Issuer, key.Aud, key.Sub}, "\n")))
+	return &user{
+		key:         key,
+		id:          id[:],
+		username:    authState.Username,
+		displayName: authState.DisplayName,
+		redirectURI: authState.RedirectURI,
+		credentials: credentials,
+	}
+}
+
+func (u *user) WebAuthnID() []byte {
+	return u.id
+}
+
+func (u *user) WebAuthnName() string {
+	return u.username
+}
+
+func (u *user) WebAuthnDisplayName() string {
+	return u.displayName
+}
+
+func (u *user) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *user) WebAuthnCredentials() []gowebauthn.Credential {
+	return u.credentials
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package webauthn_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	gowebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner/mocks"
+	"github.com/openpubkey/openpubkey/cosigner/webauthn"
+	wauthnmocks "github.com/openpubkey/openpubkey/cosigner/webauthn/mocks"
+	"github.com/openpubkey/openpubkey/pktoken"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+const rpID = "http://localhost"
+
+func newCosigner(t *testing.T) *webauthn.Cosigner {
+	alg := jwa.ES256
+	cosSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	hmacKey := make([]byte, 64)
+	_, err = rand.Read(hmacKey)
+	require.NoError(t, err)
+
+	cfg := &gowebauthn.Config{
+		RPDisplayName: "OpenPubkey",
+		RPID:          rpID,
+		RPOrigin:      rpID,
+	}
+	cos, err := webauthn.New(cosSigner, alg, "https://example.com", "test-kid",
+		mocks.NewAuthStateInMemoryStore(hmacKey), cfg, webauthn.NewMemoryCredentialStore())
+	require.NoError(t, err)
+	return cos
+}
+
+func initAuth(t *testing.T, cos *webauthn.Cosigner) (*pktoken.PKToken, func([]byte) []byte, string, string) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	cosP := client.CosignerProvider{
+		Issuer:       "https://example.com",
+		CallbackPath: "/mfaredirect",
+	}
+	redirectURI := fmt.Sprintf("%s%s", "http://localhost:5555", cosP.CallbackPath)
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig(redirectURI)
+	require.NoError(t, err)
+	sig, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	authID, err := cos.InitAuth(pkt, sig)
+	require.NoError(t, err)
+
+	signMsg := func(msg []byte) []byte {
+		sig, err := pkt.NewSignedMessage(msg, signer)
+		require.NoError(t, err)
+		return sig
+	}
+	return pkt, signMsg, authID, redirectURI
+}
+
+func TestCosigner(t *testing.T) {
+	cos := newCosigner(t)
+	device, err := wauthnmocks.NewWebauthnDevice(rpID)
+	require.NoError(t, err)
+
+	pkt, signMsg, authID, redirectURI := initAuth(t, cos)
+
+	registered, err := cos.IsRegistered(authID)
+	require.NoError(t, err)
+	require.False(t, registered)
+
+	_, err = cos.BeginLogin(authID)
+	require.ErrorContains(t, err, "no webauthn device registered")
+
+	credCreation, err := cos.BeginRegistration(authID)
+	require.NoError(t, err)
+	credCreationResp, err := device.RegResp(credCreation)
+	require.NoError(t, err)
+	err = cos.FinishRegistration(authID, credCreationResp)
+	require.NoError(t, err)
+
+	// A registration ceremony can only be finished once
+	err = cos.FinishRegistration(authID, credCreationResp)
+	require.ErrorContains(t, err, "no registration in progress")
+
+	registered, err = cos.IsRegistered(authID)
+	require.NoError(t, err)
+	require.True(t, registered)
+
+	_, err = cos.BeginRegistration(authID)
+	require.ErrorContains(t, err, "already has a webauthn device registered")
+
+	credAssert, err := cos.BeginLogin(authID)
+	require.NoError(t, err)
+	loginResp, err := device.LoginResp(credAssert)
+	require.NoError(t, err)
+	authcode, ruri, err := cos.FinishLogin(authID, loginResp)
+	require.NoError(t, err)
+	require.Equal(t, redirectURI, ruri)
+
+	// Replaying the assertion fails as the login ceremony is finished
+	_, _, err = cos.FinishLogin(authID, loginResp)
+	require.ErrorContains(t, err, "no login in progress")
+
+	cosSig, err := cos.RedeemAuthcode(signMsg([]byte(authcode)))
+	require.NoError(t, err)
+	err = pkt.AddSignature(cosSig, pktoken.COS)
+	require.NoError(t, err)
+
+	_, err = cos.RedeemAuthcode(signMsg([]byte(authcode)))
+	require.Error(t, err)
+
+	// The same user logs in again with their registered device in a new
+	// auth session
+	_, _, authID2, _ := initAuth(t, cos)
+	registered, err = cos.IsRegistered(authID2)
+	require.NoError(t, err)
+	require.True(t, registered)
+
+	credAssert, err = cos.BeginLogin(authID2)
+	require.NoError(t, err)
+	loginResp, err = device.LoginResp(credAssert)
+	require.NoError(t, err)
+	_, _, err = cos.FinishLogin(authID2, loginResp)
+	require.NoError(t, err)
+
+	_, err = cos.IsRegistered("unknown-auth-id")
+	require.ErrorContains(t, err, "no auth session found")
+}
+
+func TestHandler(t *testing.T) {
+	cos := newCosigner(t)
+	server := httptest.NewServer(http.StripPrefix("/mfa", webauthn.NewHandler(cos)))
+	defer server.Close()
+	cos.Issuer = server.URL + "/mfa"
+
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, alg)
+	require.NoError(t, err)
+
+	cosP := client.CosignerProvider{
+		Issuer:       cos.Issuer,
+		CallbackPath: "/mfaredirect",
+	}
+	initAuthMsgJson, _, err := cosP.CreateInitAuthSig("http://localhost:5555/mfaredirect")
+	require.NoError(t, err)
+	sig1, err := pkt.NewSignedMessage(initAuthMsgJson, signer)
+	require.NoError(t, err)
+	pktJson, err := pkt.MarshalJSON()
+	require.NoError(t, err)
+	initAuthURI := fmt.Sprintf("%s/mfa-auth-init?pkt=%s&sig1=%s", cosP.Issuer,
+		util.Base64EncodeForJWT(pktJson), url.QueryEscape(string(sig1)))
+
+	res, err := httpClient.Get(initAuthURI)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	location, err := res.Location()
+	require.NoError(t, err)
+	require.Equal(t, "/mfa/", location.Path)
+	authID := location.Query().Get("authid")
+	require.NotEmpty(t, authID)
+
+	res, err = httpClient.Get(location.String())
+	require.NoError(t, err)
+	page, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Contains(t, string(page), "check-registration?authid=")
+
+	res, err = httpClient.Get(server.URL + "/mfa/check-registration?authid=" + url.QueryEscape(authID))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t, `{"isRegistered":false}`, string(body))
+
+	res, err = httpClient.Get(server.URL + "/mfa/register/begin?authid=" + url.QueryEscape(authID))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	res, err = httpClient.Get(server.URL + "/mfa/check-registration?authid=unknown")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
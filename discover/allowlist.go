@@ -0,0 +1,126 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// ErrNotAllowed is returned when a request is made to a host or IP address
+// that isn't on the Allowlist.
+var ErrNotAllowed = errors.New("destination not on allowlist")
+
+// Allowlist restricts which hosts may be contacted when fetching OP
+// configuration and JWKS. Tokens are attacker supplied, so without an
+// allowlist anything reachable from a verifier (e.g. the sshd
+// AuthorizedKeysCommand) could be probed via a crafted issuer or a
+// malicious discovery document pointing the jwks_uri at an internal host.
+//
+// Hosts are DNS names which must match the request host exactly, or
+// wildcards of the form "*.example.com" which match any subdomain of
+// example.com. IPs are the address ranges the resolved host may connect
+// to. An empty Hosts or IPs places no restriction on that dimension.
+type Allowlist struct {
+	Hosts []string
+	IPs   []netip.Prefix
+	// TLSConfig, if set, is used for HTTPS connections, e.g. to trust the
+	// private CA of an internal OP. Ignored under js/wasm, where the browser
+	// makes the connections
+	TLSConfig *tls.Config
+}
+
+// AllowlistFromIssuers returns an Allowlist permitting the hosts of the
+// supplied issuers. Many OPs serve their JWKS from a different host than
+// the issuer, e.g. Google's JWKS is at www.googleapis.com, so these hosts
+// must be added to the Allowlist as well.
+func AllowlistFromIssuers(issuers ...string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, issuer := range issuers {
+		u, err := url.Parse(issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse issuer (%s): %w", issuer, err)
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("issuer (%s) has no host", issuer)
+		}
+		a.Hosts = append(a.Hosts, u.Hostname())
+	}
+	return a, nil
+}
+
+// HTTPClient returns an http.Client which refuses to contact any host or
+// IP address not permitted by the Allowlist. The checks apply to redirects
+// as well. Proxies are not used, as the IP check must see the address that
+// is actually dialed.
+func (a *Allowlist) HTTPClient() *http.Client {
+	return &http.Client{Transport: a.Transport()}
+}
+
+// Transport returns an http.RoundTripper enforcing the Allowlist. See
+// HTTPClient.
+func (a *Allowlist) Transport() http.RoundTripper {
+	return &allowlistTransport{allowlist: a, base: a.baseTransport()}
+}
+
+type allowlistTransport struct {
+	allowlist *Allowlist
+	base      http.RoundTripper
+}
+
+func (t *allowlistTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.allowlist.allowsHost(req.URL.Hostname()) {
+		return nil, fmt.Errorf("%w: host %s", ErrNotAllowed, req.URL.Hostname())
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (a *Allowlist) allowsHost(host string) bool {
+	if len(a.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range a.Hosts {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "."))
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) allowsIP(ip netip.Addr) bool {
+	if len(a.IPs) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, prefix := range a.IPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
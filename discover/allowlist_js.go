@@ -14,41 +14,28 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-package mfacosigner
+//go:build js
+
+package discover
 
 import (
-	"github.com/go-webauthn/webauthn/webauthn"
+	"fmt"
+	"net/http"
 )
 
-type user struct {
-	id          []byte
-	username    string
-	displayName string
-	credentials []webauthn.Credential
-}
-
-var _ webauthn.User = (*user)(nil)
-
-func (u *user) WebAuthnID() []byte {
-	return u.id
-}
-
-func (u *user) WebAuthnName() string {
-	return u.username
+// baseTransport returns the transport that sends requests to allowed
+// hosts. Under js/wasm requests go through the browser's fetch API, which
+// resolves and dials hosts itself, so IPs can't be checked and an
+// Allowlist restricting them refuses every request.
+func (a *Allowlist) baseTransport() http.RoundTripper {
+	if len(a.IPs) > 0 {
+		return refuseTransport{}
+	}
+	return http.DefaultTransport
 }
 
-func (u *user) WebAuthnDisplayName() string {
-	return u.displayName
-}
-
-func (u *user) WebAuthnIcon() string {
-	return ""
-}
-
-func (u *user) AddCredential(cred webauthn.Credential) {
-	u.credentials = append(u.credentials, cred)
-}
+type refuseTransport struct{}
 
-func (u *user) WebAuthnCredentials() []webauthn.Credential {
-	return u.credentials
+func (refuseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%w: IPs can't be checked under js/wasm", ErrNotAllowed)
 }
@@ -0,0 +1,115 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlistHosts(t *testing.T) {
+	a := &Allowlist{Hosts: []string{"accounts.google.com", "*.googleapis.com"}}
+
+	require.True(t, a.allowsHost("accounts.google.com"))
+	require.True(t, a.allowsHost("Accounts.Google.com."))
+	require.True(t, a.allowsHost("www.googleapis.com"))
+	require.False(t, a.allowsHost("googleapis.com"))
+	require.False(t, a.allowsHost("evilgoogleapis.com"))
+	require.False(t, a.allowsHost("accounts.google.com.evil.com"))
+	require.False(t, a.allowsHost("169.254.169.254"))
+
+	require.True(t, (&Allowlist{}).allowsHost("anything.example.com"))
+
+	fromIssuers, err := AllowlistFromIssuers("https://accounts.google.com", "https://login.microsoftonline.com/tenant/v2.0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"accounts.google.com", "login.microsoftonline.com"}, fromIssuers.Hosts)
+
+	_, err = AllowlistFromIssuers("not-a-url")
+	require.ErrorContains(t, err, "has no host")
+}
+
+func TestAllowlistHTTPClient(t *testing.T) {
+	var jwksURI string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			issuer := "http://" + r.Host
+			fmt.Fprintf(w, `{"issuer": %q, "jwks_uri": %q}`, issuer, jwksURI)
+		case "/jwks":
+			fmt.Fprint(w, `{"keys": []}`)
+		case "/redirect":
+			http.Redirect(w, r, "http://localhost/jwks", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	issuer := server.URL
+	jwksURI = server.URL + "/jwks"
+
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	private := netip.MustParsePrefix("10.0.0.0/8")
+
+	testCases := []struct {
+		name      string
+		allowlist Allowlist
+		jwksURI   string
+		expError  bool
+	}{
+		{name: "host and IP allowed",
+			allowlist: Allowlist{Hosts: []string{"127.0.0.1"}, IPs: []netip.Prefix{loopback}},
+			jwksURI:   server.URL + "/jwks",
+		},
+		{name: "host not allowed",
+			allowlist: Allowlist{Hosts: []string{"accounts.example.com"}},
+			jwksURI:   server.URL + "/jwks",
+			expError:  true,
+		},
+		{name: "IP not allowed",
+			allowlist: Allowlist{IPs: []netip.Prefix{private}},
+			jwksURI:   server.URL + "/jwks",
+			expError:  true,
+		},
+		{name: "jwks_uri points at a host not allowed",
+			allowlist: Allowlist{Hosts: []string{"127.0.0.1"}},
+			jwksURI:   "http://169.254.169.254/latest/meta-data",
+			expError:  true,
+		},
+		{name: "redirect to a host not allowed",
+			allowlist: Allowlist{Hosts: []string{"127.0.0.1"}},
+			jwksURI:   server.URL + "/redirect",
+			expError:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jwksURI = tc.jwksURI
+			jwks, err := GetJwksByIssuer(context.Background(), issuer, tc.allowlist.HTTPClient())
+			if tc.expError {
+				require.ErrorIs(t, err, ErrNotAllowed)
+			} else {
+				require.NoError(t, err)
+				require.JSONEq(t, `{"keys": []}`, string(jwks))
+			}
+		})
+	}
+}
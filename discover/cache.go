@@ -0,0 +1,274 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultJwksCacheTTL is how long NewCachingPubkeyFinder caches a JWKS if
+// no TTL is given
+const DefaultJwksCacheTTL = 10 * time.Minute
+
+// JwksLookupFunc is called on every JWKS lookup of a caching
+// PublicKeyFinder with whether the JWKS was served from the cache
+type JwksLookupFunc func(issuer string, hit bool)
+
+// minJwksRefresh is how often a caching PublicKeyFinder refetches a JWKS
+// which doesn't have a key ID a token was signed under. Issuers publish a
+// new key before or as they start signing with it, so refetching finds keys
+// added since the JWKS was cached, while the limit stops tokens with bogus
+// key IDs from making every verification fetch the JWKS.
+const minJwksRefresh = 30 * time.Second
+
+type cachedJwks struct {
+	jwks      []byte
+	fetchedAt time.Time
+}
+
+// jwksSnapshot is the file a disk-backed cache keeps an issuer's JWKS in
+type jwksSnapshot struct {
+	Issuer    string          `json:"iss"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	Jwks      json.RawMessage `json:"jwks"`
+}
+
+type jwksCache struct {
+	finder   *PublicKeyFinder
+	ttl      time.Duration
+	onLookup JwksLookupFunc
+	// dir, if set, is where snapshots of the cached JWKS are kept
+	dir string
+	// maxStale is how long past ttl a cached JWKS is used when fetching
+	// fails
+	maxStale time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedJwks
+	now   func() time.Time
+}
+
+// NewCachingPubkeyFinder returns a PublicKeyFinder which caches the JWKS
+// fetched by finder for ttl so verifying many PK Tokens doesn't fetch the
+// OP's JWKS every time. Failed fetches are not cached. If onLookup is not
+// nil it is called on every lookup, e.g. to record the cache hit rate.
+//
+// Looking up a key ID missing from the cached JWKS refetches it, so keys
+// an issuer rotates to are found before the cached JWKS expires.
+func NewCachingPubkeyFinder(finder *PublicKeyFinder, ttl time.Duration, onLookup JwksLookupFunc) *PublicKeyFinder {
+	return newJwksCache(finder, ttl, onLookup).pubkeyFinder()
+}
+
+// NewDiskCachingPubkeyFinder returns a PublicKeyFinder which caches the
+// JWKS fetched by finder like NewCachingPubkeyFinder, but also keeps a
+// snapshot of each issuer's JWKS and when it was fetched in dir. Short-lived
+// processes such as sshd's AuthorizedKeysCommand then share the cache
+// rather than fetching the JWKS on every run. If fetching fails, a JWKS
+// fetched within ttl + maxStale is used so that brief OP outages don't fail
+// verification.
+//
+// Keys in dir are trusted as the OPs' keys, so snapshots are ignored unless
+// dir and the snapshot are owned by the user verifying PK Tokens, dir isn't
+// writable by other users and the snapshot is 0600. Failing to write a
+// snapshot is not an error, the JWKS is then only cached in memory.
+func NewDiskCachingPubkeyFinder(finder *PublicKeyFinder, dir string, ttl time.Duration, maxStale time.Duration, onLookup JwksLookupFunc) *PublicKeyFinder {
+	cache := newJwksCache(finder, ttl, onLookup)
+	cache.dir = dir
+	cache.maxStale = maxStale
+	return cache.pubkeyFinder()
+}
+
+func newJwksCache(finder *PublicKeyFinder, ttl time.Duration, onLookup JwksLookupFunc) *jwksCache {
+	if ttl == 0 {
+		ttl = DefaultJwksCacheTTL
+	}
+	return &jwksCache{
+		finder:   finder,
+		ttl:      ttl,
+		onLookup: onLookup,
+		cache:    map[string]cachedJwks{},
+		now:      time.Now,
+	}
+}
+
+func (c *jwksCache) pubkeyFinder() *PublicKeyFinder {
+	return &PublicKeyFinder{
+		JwksFunc:     c.lookup,
+		refreshJwks:  c.refresh,
+		prefetchJwks: c.prefetch,
+	}
+}
+
+func (c *jwksCache) lookup(ctx context.Context, issuer string) ([]byte, error) {
+	entry, ok := c.entry(issuer)
+	hit := ok && c.now().Sub(entry.fetchedAt) < c.ttl
+	if c.onLookup != nil {
+		c.onLookup(issuer, hit)
+	}
+	if hit {
+		return entry.jwks, nil
+	}
+	return c.fetch(ctx, issuer)
+}
+
+// refresh refetches the JWKS unless it was fetched within minJwksRefresh
+func (c *jwksCache) refresh(ctx context.Context, issuer string) ([]byte, error) {
+	entry, ok := c.entry(issuer)
+	if ok && c.now().Sub(entry.fetchedAt) < minJwksRefresh {
+		return entry.jwks, nil
+	}
+	if c.onLookup != nil {
+		c.onLookup(issuer, false)
+	}
+	return c.fetch(ctx, issuer)
+}
+
+// prefetch refetches the JWKS regardless of its age. Unlike lookups, it
+// fails rather than falling back to a stale JWKS, so outages are reported
+func (c *jwksCache) prefetch(ctx context.Context, issuer string) ([]byte, error) {
+	jwks, err := c.finder.JwksFunc(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	c.store(issuer, jwks)
+	return jwks, nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context, issuer string) ([]byte, error) {
+	jwks, err := c.finder.JwksFunc(ctx, issuer)
+	if err != nil {
+		// Ride out OP outages with the JWKS fetched last
+		if entry, ok := c.entry(issuer); ok && c.now().Sub(entry.fetchedAt) < c.ttl+c.maxStale {
+			return entry.jwks, nil
+		}
+		return nil, err
+	}
+	c.store(issuer, jwks)
+	return jwks, nil
+}
+
+func (c *jwksCache) store(issuer string, jwks []byte) {
+	entry := cachedJwks{jwks: jwks, fetchedAt: c.now()}
+	c.mu.Lock()
+	c.cache[issuer] = entry
+	c.mu.Unlock()
+	if c.dir != "" {
+		_ = c.writeSnapshot(issuer, entry)
+	}
+}
+
+// entry returns the cached JWKS of the issuer, reading its snapshot if it
+// isn't cached in memory yet
+func (c *jwksCache) entry(issuer string) (cachedJwks, bool) {
+	c.mu.Lock()
+	entry, ok := c.cache[issuer]
+	c.mu.Unlock()
+	if ok || c.dir == "" {
+		return entry, ok
+	}
+
+	snapshot, err := c.readSnapshot(issuer)
+	if err != nil {
+		return cachedJwks{}, false
+	}
+	entry = cachedJwks{jwks: snapshot.Jwks, fetchedAt: snapshot.FetchedAt}
+	c.mu.Lock()
+	// Don't overwrite a JWKS fetched meanwhile
+	if cached, ok := c.cache[issuer]; ok {
+		entry = cached
+	} else {
+		c.cache[issuer] = entry
+	}
+	c.mu.Unlock()
+	return entry, true
+}
+
+// snapshotPath returns the file the JWKS of the issuer is kept in, named
+// by the hash of the issuer as issuers are URLs
+func (c *jwksCache) snapshotPath(issuer string) string {
+	digest := sha256.Sum256([]byte(issuer))
+	return filepath.Join(c.dir, hex.EncodeToString(digest[:])+".json")
+}
+
+// readSnapshot reads the snapshot of the issuer. As its keys are trusted,
+// snapshots other users can write are ignored.
+func (c *jwksCache) readSnapshot(issuer string) (*jwksSnapshot, error) {
+	dirInfo, err := os.Stat(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotPerm(dirInfo, true); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(c.snapshotPath(issuer))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotPerm(info, false); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &jwksSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Issuer != issuer || len(snapshot.Jwks) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return snapshot, nil
+}
+
+// writeSnapshot replaces the snapshot of the issuer atomically, so
+// concurrent processes never read a partially written one
+func (c *jwksCache) writeSnapshot(issuer string, entry cachedJwks) error {
+	data, err := json.Marshal(jwksSnapshot{Issuer: issuer, FetchedAt: entry.fetchedAt, Jwks: entry.jwks})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".jwks-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.snapshotPath(issuer))
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows && !js
+
+package discover
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// checkSnapshotPerm returns an error unless a snapshot file, or with dir
+// their directory, is owned by this user and can't be written by anyone
+// else. Snapshot files must be 0600, like those writeSnapshot creates.
+func checkSnapshotPerm(info fs.FileInfo, dir bool) error {
+	perm := info.Mode().Perm()
+	if dir && perm&0022 != 0 {
+		return fmt.Errorf("JWKS cache directory is writable by other users (%o)", perm)
+	}
+	if !dir && perm != 0600 {
+		return fmt.Errorf("JWKS snapshot has insecure permissions (%o)", perm)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("JWKS cache is owned by another user (%d)", stat.Uid)
+	}
+	return nil
+}
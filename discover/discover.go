@@ -20,16 +20,23 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/retry"
+	"github.com/openpubkey/openpubkey/telemetry"
 	"github.com/openpubkey/openpubkey/util"
 
 	oidcclient "github.com/zitadel/oidc/v3/pkg/client"
@@ -39,14 +46,19 @@ type PublicKeyRecord struct {
 	PublicKey crypto.PublicKey
 	Alg       string
 	Issuer    string
+	// CertChain is the x5c certificate chain of the key, leaf first, if the
+	// JWKS has one for it. See VerifyCertChain
+	CertChain []*x509.Certificate
 }
 
 func NewPublicKeyRecord(key jwk.Key, issuer string) (*PublicKeyRecord, error) {
 	var pubKey interface{}
-	if key.Algorithm() == jwa.RS256 {
+	if key.Algorithm() == jwa.RS256 || key.Algorithm() == jwa.PS256 {
 		pubKey = new(rsa.PublicKey)
-	} else if key.Algorithm() == jwa.ES256 {
+	} else if key.Algorithm() == jwa.ES256 || key.Algorithm() == jwa.ES384 {
 		pubKey = new(ecdsa.PublicKey)
+	} else if key.Algorithm() == jwa.EdDSA {
+		pubKey = ed25519.PublicKey{}
 	} else if key.Algorithm().String() == "" {
 		// OPs such as azure (microsoft) do not specify alg in their JWKS. To
 		// handle this case, assume no alg in JWKS means RSA as OIDC requires
@@ -67,17 +79,35 @@ func NewPublicKeyRecord(key jwk.Key, issuer string) (*PublicKeyRecord, error) {
 		alg = key.Algorithm().String()
 	}
 
+	// A malformed x5c is only an error when chains are checked, see
+	// PublicKeyFinder.X5CRoots, as verifiers ignoring x5c must keep working
+	certChain, _ := parseCertChain(key, pubKey)
+
 	return &PublicKeyRecord{
 		PublicKey: pubKey,
 		Alg:       alg,
 		Issuer:    issuer,
+		CertChain: certChain,
 	}, nil
 }
 
+// DefaultPubkeyFinder returns a PublicKeyFinder which fetches JWKS with
+// the default http.Client, retrying transient failures under retry.Default.
 func DefaultPubkeyFinder() *PublicKeyFinder {
+	httpClient := retry.Default.Client(nil)
+	return &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			return GetJwksByIssuer(ctx, issuer, httpClient)
+		},
+	}
+}
+
+// NewPubkeyFinder returns a PublicKeyFinder which fetches JWKS using the
+// supplied http.Client, e.g. one enforcing an Allowlist.
+func NewPubkeyFinder(httpClient *http.Client) *PublicKeyFinder {
 	return &PublicKeyFinder{
 		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
-			return GetJwksByIssuer(ctx, issuer, nil)
+			return GetJwksByIssuer(ctx, issuer, httpClient)
 		},
 	}
 }
@@ -86,6 +116,39 @@ type JwksFetchFunc func(ctx context.Context, issuer string) ([]byte, error)
 
 type PublicKeyFinder struct {
 	JwksFunc JwksFetchFunc
+
+	// SignatureSearch bounds the keys tried against a token whose kid is
+	// missing or shared by several keys in the JWKS. Defaults to
+	// DefaultSignatureSearch
+	SignatureSearch *SignatureSearch
+
+	// X5CRoots, if set, only accepts keys whose x5c certificate chain in the
+	// JWKS validates to one of these roots, for OPs which certify their
+	// signing keys. Keys without an x5c chain are rejected
+	X5CRoots *x509.CertPool
+
+	// refreshJwks, if set, bypasses a cache in JwksFunc when a key ID isn't
+	// in the JWKS, see NewCachingPubkeyFinder
+	refreshJwks JwksFetchFunc
+	// prefetchJwks, if set, is used by Prefetch to refetch the JWKS into a
+	// cache in JwksFunc
+	prefetchJwks JwksFetchFunc
+}
+
+// SignatureSearch is the budget for finding the key of a token by trying
+// candidate keys from the JWKS, see PublicKeyFinder.ByToken. Candidates are
+// verified in parallel.
+type SignatureSearch struct {
+	// MaxKeys is the maximum number of candidate keys tried, further
+	// candidates are skipped
+	MaxKeys int
+	// Timeout bounds the time spent verifying the token with the candidates
+	Timeout time.Duration
+}
+
+var DefaultSignatureSearch = SignatureSearch{
+	MaxKeys: 16,
+	Timeout: 5 * time.Second,
 }
 
 // GetJwksByIssuer fetches the JWKS from the issuer's JWKS endpoint found at the
@@ -109,21 +172,20 @@ func GetJwksByIssuer(ctx context.Context, issuer string, httpClient *http.Client
 
 	response, err := httpClient.Do(request)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to fetch to JWKS: %w", err)
 	}
 	defer response.Body.Close()
 
-	resp, err := httpClient.Get(discConf.JwksURI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch to JWKS: %w", err)
-	}
-	if resp.StatusCode != http.StatusOK {
+	if response.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("received non-200 from JWKS URI: %s", http.StatusText(response.StatusCode))
 	}
-	return io.ReadAll(resp.Body)
+	return io.ReadAll(response.Body)
 }
 
-func (f *PublicKeyFinder) fetchAndParseJwks(ctx context.Context, issuer string) (jwk.Set, error) {
+func (f *PublicKeyFinder) fetchAndParseJwks(ctx context.Context, issuer string) (_ jwk.Set, err error) {
+	ctx, end := telemetry.Start(ctx, telemetry.OpFetchJwks, telemetry.IssuerKey.String(issuer))
+	defer end(&err)
+
 	jwksJson, err := f.JwksFunc(ctx, issuer)
 	if err != nil {
 		return nil, fmt.Errorf(`failed to fetch JWKS: %w`, err)
@@ -137,10 +199,39 @@ func (f *PublicKeyFinder) fetchAndParseJwks(ctx context.Context, issuer string)
 
 // ByToken looks up an OP public key in the JWKS using the KeyID (kid) in the
 // protected header from the supplied token.
+//
+// Some OPs don't set a KeyID (kid). If the token has no kid, the key is
+// instead found by the RFC 7638 JWK thumbprint (jkt) in the protected header,
+// as GQ signed tokens contain. Failing that, each key in the JWKS with the
+// token's alg is tried and the key that verifies the token's signature is
+// returned. The same search is done among the keys sharing the token's kid
+// when the JWKS has several of them, see SignatureSearch.
 func (f *PublicKeyFinder) ByToken(ctx context.Context, issuer string, token []byte) (*PublicKeyRecord, error) {
+	keyID, err := keyIDFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != "" {
+		// Use the KeyID (kid) in the headers from the supplied token to look up the public key
+		return f.byKeyID(ctx, issuer, keyID, token)
+	}
+
+	jkt, err := jktFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if jkt != "" {
+		return f.ByJKT(ctx, issuer, jkt)
+	}
+	return f.bySignature(ctx, issuer, token)
+}
+
+// keyIDFromToken returns the KeyID (kid) in the protected header of the
+// token. For GQ signed tokens the kid of the original headers is returned.
+func keyIDFromToken(token []byte) (string, error) {
 	jwt, err := jws.Parse(token)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing JWK in JWKS: %w", err)
+		return "", fmt.Errorf("error parsing JWK in JWKS: %w", err)
 	}
 	// a JWT is guaranteed to have exactly one signature
 	headers := jwt.Signatures()[0].ProtectedHeaders()
@@ -148,53 +239,191 @@ func (f *PublicKeyFinder) ByToken(ctx context.Context, issuer string, token []by
 	if headers.Algorithm() == gq.GQ256 {
 		origHeadersJson, err := util.Base64DecodeForJWT([]byte(headers.KeyID()))
 		if err != nil {
-			return nil, fmt.Errorf("error base64 decoding GQ kid: %w", err)
+			return "", fmt.Errorf("error base64 decoding GQ kid: %w", err)
 		}
 
 		// If GQ then replace the GQ headers with the original headers
 		err = json.Unmarshal(origHeadersJson, &headers)
 		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling GQ kid to original headers: %w", err)
+			return "", fmt.Errorf("error unmarshalling GQ kid to original headers: %w", err)
 		}
 	}
-	// Use the KeyID (kid) in the headers from the supplied token to look up the public key
-	return f.ByKeyID(ctx, issuer, headers.KeyID())
+	return headers.KeyID(), nil
 }
 
-// ByKeyID looks up an OP public key in the JWKS using the KeyID (kid) supplied.
-// If no KeyID (kid) exists in the header and there is only one key in the JWKS,
-// that key is returned. This  is useful for cases where an OP may not set a KeyID
-// (kid) in the JWT header.
-//
-// The JWT RFC states that it is acceptable to not use a KeyID (kid) if there is
-// only one key in the JWKS:
-// "The "kid" (key ID) parameter is used to match a specific key.  This is used,
-// for instance, to choose among a set of keys within a JWK Set
-// during key rollover.  The structure of the "kid" value is
-// unspecified.  When "kid" values are used within a JWK Set, different
-// keys within the JWK Set SHOULD use distinct "kid" values.  (One
-// example in which different keys might use the same "kid" value is if
-// they have different "kty" (key type) values but are considered to be
-// equivalent alternatives by the application using them.)  The "kid"
-// value is a case-sensitive string.  Use of this member is OPTIONAL.
-// When used with JWS or JWE, the "kid" value is used to match a JWS or
-// JWE "kid" Header Parameter value." - RFC 7517
-// https://datatracker.ietf.org/doc/html/rfc7517#section-4.5
+// jktFromToken returns the JWK thumbprint (jkt) in the protected header of
+// the token or the empty string if there is none.
+func jktFromToken(token []byte) (string, error) {
+	jwt, err := jws.Parse(token)
+	if err != nil {
+		return "", fmt.Errorf("error parsing JWK in JWKS: %w", err)
+	}
+	jkt, ok := jwt.Signatures()[0].ProtectedHeaders().Get("jkt")
+	if !ok {
+		return "", nil
+	}
+	jktStr, ok := jkt.(string)
+	if !ok {
+		return "", fmt.Errorf("jkt in protected header is not a string")
+	}
+	return jktStr, nil
+}
+
+// bySignature returns the public key in the JWKS which verifies the
+// signature on the token. This lets us find the key for OPs which set
+// neither a kid nor a jkt, even when the JWKS contains more than one key.
+func (f *PublicKeyFinder) bySignature(ctx context.Context, issuer string, token []byte) (*PublicKeyRecord, error) {
+	jwks, err := f.fetchAndParseJwks(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to fetch JWK set: %w`, err)
+	}
+
+	var keys []jwk.Key
+	it := jwks.Keys(ctx)
+	for it.Next(ctx) {
+		keys = append(keys, it.Pair().Value.(jwk.Key))
+	}
+	record, err := f.searchBySignature(ctx, issuer, token, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w without kid", err)
+	}
+	return record, nil
+}
+
+// searchBySignature verifies the token with each of the candidate keys that
+// supports the token's alg, in parallel and within the SignatureSearch
+// budget, and returns the first that verifies it.
+func (f *PublicKeyFinder) searchBySignature(ctx context.Context, issuer string, token []byte, keys []jwk.Key) (*PublicKeyRecord, error) {
+	budget := DefaultSignatureSearch
+	if f.SignatureSearch != nil {
+		budget = *f.SignatureSearch
+	}
+
+	jwt, err := jws.Parse(token)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JWK in JWKS: %w", err)
+	}
+	alg := jwt.Signatures()[0].ProtectedHeaders().Algorithm()
+
+	var candidates []*PublicKeyRecord
+	for _, key := range keys {
+		record, err := f.newRecord(key, issuer)
+		if err != nil {
+			// Skip keys we don't support or trust, they can't have signed the token
+			continue
+		}
+		if alg == gq.GQ256 {
+			if _, ok := record.PublicKey.(*rsa.PublicKey); !ok {
+				continue
+			}
+		} else if key.Algorithm().String() == "" {
+			// Like NewPublicKeyRecord, assume keys without alg are RSA keys
+			if !strings.HasPrefix(alg.String(), "RS") && !strings.HasPrefix(alg.String(), "PS") {
+				continue
+			}
+		} else if record.Alg != alg.String() {
+			continue
+		}
+		candidates = append(candidates, record)
+	}
+	if len(candidates) > budget.MaxKeys {
+		candidates = candidates[:budget.MaxKeys]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, budget.Timeout)
+	defer cancel()
+
+	// Buffered so that verifications finishing after we return don't block
+	verified := make(chan *PublicKeyRecord, len(candidates))
+	var wg sync.WaitGroup
+	for _, record := range candidates {
+		wg.Add(1)
+		go func(record *PublicKeyRecord) {
+			defer wg.Done()
+			if alg == gq.GQ256 {
+				if ok, err := gq.GQ256VerifyJWT(record.PublicKey.(*rsa.PublicKey), token); err == nil && ok {
+					verified <- record
+				}
+			} else if _, err := jws.Verify(token, jws.WithKey(alg, record.PublicKey)); err == nil {
+				verified <- record
+			}
+		}(record)
+	}
+	go func() {
+		wg.Wait()
+		close(verified)
+	}()
+
+	select {
+	case record, ok := <-verified:
+		if ok {
+			return record, nil
+		}
+		return nil, fmt.Errorf("no public key in JWKS verifies token")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no public key in JWKS verified token in time: %w", ctx.Err())
+	}
+}
+
+// ByKeyID looks up an OP public key in the JWKS using the KeyID (kid)
+// supplied. A blank keyID only matches keys without a kid, the single key of
+// a JWKS is not returned for any kid. To verify tokens of OPs that don't set
+// a kid use ByToken, which falls back to the JWK thumbprint (jkt) and then to
+// a bounded search for the key that verifies the token's signature.
 func (f *PublicKeyFinder) ByKeyID(ctx context.Context, issuer string, keyID string) (*PublicKeyRecord, error) {
+	return f.byKeyID(ctx, issuer, keyID, nil)
+}
+
+// byKeyID is ByKeyID but, if token is set and several keys in the JWKS have
+// the kid, returns the one of them that verifies the token
+func (f *PublicKeyFinder) byKeyID(ctx context.Context, issuer string, keyID string, token []byte) (*PublicKeyRecord, error) {
 	jwks, err := f.fetchAndParseJwks(ctx, issuer)
 	if err != nil {
 		return nil, fmt.Errorf(`failed to fetch JWK set: %w`, err)
 	}
 
-	// If keyID is blank and there is only one key in the JWKS, return that key
-	key, ok := jwks.LookupKeyID(keyID)
-	if ok {
-		return NewPublicKeyRecord(key, issuer)
+	if keys := keysWithID(ctx, jwks, keyID); len(keys) > 0 {
+		return f.recordForKeys(ctx, issuer, keyID, token, keys)
+	}
+
+	// The issuer may have rotated to a key since the JWKS was cached
+	if f.refreshJwks != nil {
+		refreshed := &PublicKeyFinder{JwksFunc: f.refreshJwks}
+		if jwks, err := refreshed.fetchAndParseJwks(ctx, issuer); err == nil {
+			if keys := keysWithID(ctx, jwks, keyID); len(keys) > 0 {
+				return f.recordForKeys(ctx, issuer, keyID, token, keys)
+			}
+		}
 	}
 
 	return nil, fmt.Errorf("no matching public key found for kid %s", keyID)
 }
 
+// recordForKeys returns the record of the first of the keys sharing keyID or,
+// given a token and several keys, of the key that verifies the token
+func (f *PublicKeyFinder) recordForKeys(ctx context.Context, issuer string, keyID string, token []byte, keys []jwk.Key) (*PublicKeyRecord, error) {
+	if len(keys) == 1 || token == nil {
+		return f.newRecord(keys[0], issuer)
+	}
+	record, err := f.searchBySignature(ctx, issuer, token, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w among %d keys with kid %s", err, len(keys), keyID)
+	}
+	return record, nil
+}
+
+func keysWithID(ctx context.Context, jwks jwk.Set, keyID string) []jwk.Key {
+	var keys []jwk.Key
+	it := jwks.Keys(ctx)
+	for it.Next(ctx) {
+		key := it.Pair().Value.(jwk.Key)
+		if key.KeyID() == keyID {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func (f *PublicKeyFinder) ByJKT(ctx context.Context, issuer string, jkt string) (*PublicKeyRecord, error) {
 	jwks, err := f.fetchAndParseJwks(ctx, issuer)
 	if err != nil {
@@ -210,7 +439,7 @@ func (f *PublicKeyFinder) ByJKT(ctx context.Context, issuer string, jkt string)
 		}
 		jktOfKeyB64 := util.Base64EncodeForJWT(jktOfKey)
 		if jkt == string(jktOfKeyB64) {
-			return NewPublicKeyRecord(key, issuer)
+			return f.newRecord(key, issuer)
 		}
 	}
 
@@ -25,6 +25,10 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -54,6 +58,16 @@ func TestNewPublicKeyRecord(t *testing.T) {
 			},
 			expectedAlg: jwa.RS256.String(),
 		},
+		{
+			name: "alg=PS256",
+			keyJson: map[string]string{
+				jwk.AlgorithmKey: "PS256",
+				jwk.KeyTypeKey:   "RSA",
+				jwk.RSAEKey:      "AQAB",
+				jwk.RSANKey:      "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+			},
+			expectedAlg: jwa.PS256.String(),
+		},
 		{
 			name: "alg=ES256",
 			keyJson: map[string]string{
@@ -193,7 +207,7 @@ func TestPublicKeyFinder(t *testing.T) {
 	// Tests we don't return the wrong Public Key even if not kid is supplied
 	wrongIdToken2 := CreateIDToken(t, issuer, wrongSigner, "RS256", "")
 	pubkeyRecord, err = finder.ByToken(ctx, issuer, wrongIdToken2)
-	require.EqualError(t, err, "no matching public key found for kid ")
+	require.EqualError(t, err, "no public key in JWKS verifies token without kid")
 	require.Nil(t, pubkeyRecord)
 
 	wrongJKT := "not-a-jkt"
@@ -256,6 +270,121 @@ func TestByTokenWhenOnePublicKey(t *testing.T) {
 	}
 }
 
+func TestByTokenWithoutKeyID(t *testing.T) {
+	ctx := context.Background()
+	issuer := "testIssuer"
+
+	publicKeys := []crypto.PublicKey{}
+	algs := []string{}
+	idTokens := [][]byte{}
+	gqTokens := [][]byte{}
+
+	for i := 0; i < 3; i++ {
+		algOp := "RS256"
+		signer, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		publicKeys = append(publicKeys, signer.Public())
+		algs = append(algs, algOp)
+
+		idToken := CreateIDToken(t, issuer, signer, algOp, "")
+		idTokens = append(idTokens, idToken)
+
+		jwkKey, err := jwk.FromRaw(signer.Public())
+		require.NoError(t, err)
+		jkt, err := jwkKey.Thumbprint(crypto.SHA256)
+		require.NoError(t, err)
+		gqToken, err := gq.GQ256SignJWT(&signer.PublicKey, idToken,
+			gq.WithExtraClaim("jkt", string(util.Base64EncodeForJWT(jkt))))
+		require.NoError(t, err)
+		gqTokens = append(gqTokens, gqToken)
+	}
+
+	// JWKS has several keys, none of which have a kid
+	mockJwks, err := MockGetJwksByIssuer(publicKeys, nil, algs)
+	require.NoError(t, err)
+
+	finder := &PublicKeyFinder{
+		JwksFunc: mockJwks,
+	}
+
+	for i := 0; i < len(publicKeys); i++ {
+		pubkeyRecord, err := finder.ByToken(ctx, issuer, idTokens[i])
+		require.NoError(t, err)
+		require.Equal(t, publicKeys[i], pubkeyRecord.PublicKey)
+		require.Equal(t, algs[i], pubkeyRecord.Alg)
+		require.Equal(t, issuer, pubkeyRecord.Issuer)
+	}
+
+	for i := 0; i < len(publicKeys); i++ {
+		pubkeyRecord, err := finder.ByToken(ctx, issuer, gqTokens[i])
+		require.NoError(t, err)
+		require.Equal(t, publicKeys[i], pubkeyRecord.PublicKey)
+		require.Equal(t, algs[i], pubkeyRecord.Alg)
+		require.Equal(t, issuer, pubkeyRecord.Issuer)
+	}
+
+	otherSigner, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherToken := CreateIDToken(t, issuer, otherSigner, "RS256", "")
+	pubkeyRecord, err := finder.ByToken(ctx, issuer, otherToken)
+	require.EqualError(t, err, "no public key in JWKS verifies token without kid")
+	require.Nil(t, pubkeyRecord)
+}
+
+func TestByTokenWithAmbiguousKeyID(t *testing.T) {
+	ctx := context.Background()
+	issuer := "testIssuer"
+
+	publicKeys := []crypto.PublicKey{}
+	algs := []string{}
+	signers := []*rsa.PrivateKey{}
+	for i := 0; i < 3; i++ {
+		signer, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		signers = append(signers, signer)
+		publicKeys = append(publicKeys, signer.Public())
+		algs = append(algs, "RS256")
+	}
+	// An ES256 key sharing the kid is never a candidate for RS256 tokens
+	ecSigner, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	publicKeys = append(publicKeys, ecSigner.Public())
+	algs = append(algs, "ES256")
+
+	// Every key in the JWKS has the same kid
+	mockJwks, err := MockGetJwksByIssuer(publicKeys, []string{"kid-1", "kid-1", "kid-1", "kid-1"}, algs)
+	require.NoError(t, err)
+	finder := &PublicKeyFinder{JwksFunc: mockJwks}
+
+	for i, signer := range signers {
+		idToken := CreateIDToken(t, issuer, signer, "RS256", "kid-1")
+		pubkeyRecord, err := finder.ByToken(ctx, issuer, idToken)
+		require.NoError(t, err)
+		require.Equal(t, publicKeys[i], pubkeyRecord.PublicKey)
+	}
+	ecToken := CreateIDToken(t, issuer, ecSigner, "ES256", "kid-1")
+	pubkeyRecord, err := finder.ByToken(ctx, issuer, ecToken)
+	require.NoError(t, err)
+	require.Equal(t, ecSigner.Public(), pubkeyRecord.PublicKey)
+
+	otherSigner, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherToken := CreateIDToken(t, issuer, otherSigner, "RS256", "kid-1")
+	_, err = finder.ByToken(ctx, issuer, otherToken)
+	require.EqualError(t, err, "no public key in JWKS verifies token among 4 keys with kid kid-1")
+
+	// Keys beyond the budget are not tried
+	finder.SignatureSearch = &SignatureSearch{MaxKeys: 2, Timeout: time.Second}
+	lastToken := CreateIDToken(t, issuer, signers[2], "RS256", "kid-1")
+	_, err = finder.ByToken(ctx, issuer, lastToken)
+	require.Error(t, err)
+
+	// ByKeyID has no token to search with and returns the first key
+	pubkeyRecord, err = finder.ByKeyID(ctx, issuer, "kid-1")
+	require.NoError(t, err)
+	require.Equal(t, publicKeys[0], pubkeyRecord.PublicKey)
+}
+
 func TestGQTokens(t *testing.T) {
 	ctx := context.Background()
 	issuer := "testIssuer"
@@ -358,3 +487,243 @@ func CreateIDToken(t *testing.T, issuer string, signer crypto.Signer, alg string
 	return idToken
 
 }
+
+func TestCachingPubkeyFinder(t *testing.T) {
+	fetches := 0
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			fetches++
+			if issuer == "bad-issuer" {
+				return nil, fmt.Errorf("fetch failed")
+			}
+			return []byte(`{"keys": []}`), nil
+		},
+	}
+
+	lookups := map[bool]int{}
+	cachingFinder := NewCachingPubkeyFinder(finder, 50*time.Millisecond, func(issuer string, hit bool) {
+		lookups[hit]++
+	})
+
+	for i := 0; i < 3; i++ {
+		jwks, err := cachingFinder.JwksFunc(context.Background(), "issuer")
+		require.NoError(t, err)
+		require.Equal(t, `{"keys": []}`, string(jwks))
+	}
+	require.Equal(t, 1, fetches)
+	require.Equal(t, map[bool]int{false: 1, true: 2}, lookups)
+
+	// Failures aren't cached
+	for i := 0; i < 2; i++ {
+		_, err := cachingFinder.JwksFunc(context.Background(), "bad-issuer")
+		require.Error(t, err)
+	}
+	require.Equal(t, 3, fetches)
+
+	// Expired entries are refetched
+	time.Sleep(60 * time.Millisecond)
+	_, err := cachingFinder.JwksFunc(context.Background(), "issuer")
+	require.NoError(t, err)
+	require.Equal(t, 4, fetches)
+}
+
+func TestCachingPubkeyFinderRefreshesUnknownKeyID(t *testing.T) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	rotatedSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+
+	jwksFunc, err := MockGetJwksByIssuerOneKey(signer.Public(), "kid-1", "ES256")
+	require.NoError(t, err)
+	fetches := 0
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			fetches++
+			return jwksFunc(ctx, issuer)
+		},
+	}
+	now := time.Now()
+	cache := newJwksCache(finder, time.Hour, nil)
+	cache.now = func() time.Time { return now }
+	cachingFinder := cache.pubkeyFinder()
+
+	_, err = cachingFinder.ByKeyID(context.Background(), "issuer", "kid-1")
+	require.NoError(t, err)
+	require.Equal(t, 1, fetches)
+
+	// Unknown key IDs aren't refetched while the JWKS was just fetched
+	_, err = cachingFinder.ByKeyID(context.Background(), "issuer", "kid-2")
+	require.ErrorContains(t, err, "no matching public key found for kid kid-2")
+	require.Equal(t, 1, fetches)
+
+	// The issuer rotates to a new key after the JWKS was cached
+	jwksFunc, err = MockGetJwksByIssuer(
+		[]crypto.PublicKey{signer.Public(), rotatedSigner.Public()},
+		[]string{"kid-1", "kid-2"},
+		[]string{"ES256", "ES256"},
+	)
+	require.NoError(t, err)
+	now = now.Add(minJwksRefresh)
+	record, err := cachingFinder.ByKeyID(context.Background(), "issuer", "kid-2")
+	require.NoError(t, err)
+	require.Equal(t, rotatedSigner.Public(), record.PublicKey)
+	require.Equal(t, 2, fetches)
+
+	// The refetched JWKS is cached
+	_, err = cachingFinder.ByKeyID(context.Background(), "issuer", "kid-2")
+	require.NoError(t, err)
+	require.Equal(t, 2, fetches)
+}
+
+func TestDiskCachingPubkeyFinder(t *testing.T) {
+	dir := t.TempDir()
+	fetches := 0
+	outage := false
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			fetches++
+			if outage {
+				return nil, fmt.Errorf("fetch failed")
+			}
+			return []byte(`{"keys":[]}`), nil
+		},
+	}
+	now := time.Now()
+	newCache := func() *jwksCache {
+		cache := newJwksCache(finder, time.Hour, nil)
+		cache.dir = dir
+		cache.maxStale = 2 * time.Hour
+		cache.now = func() time.Time { return now }
+		return cache
+	}
+
+	jwks, err := newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, `{"keys":[]}`, string(jwks))
+	require.Equal(t, 1, fetches)
+
+	// A later process reads the snapshot rather than fetching the JWKS
+	jwks, err = newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, `{"keys":[]}`, string(jwks))
+	require.Equal(t, 1, fetches)
+
+	// Past the TTL the JWKS is fetched again, unless the OP is unreachable
+	outage = true
+	now = now.Add(2 * time.Hour)
+	jwks, err = newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, `{"keys":[]}`, string(jwks))
+	require.Equal(t, 2, fetches)
+
+	// A snapshot staler than maxStale isn't used
+	now = now.Add(2 * time.Hour)
+	_, err = newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.ErrorContains(t, err, "fetch failed")
+	require.Equal(t, 3, fetches)
+
+	// Once the OP is back, the snapshot is replaced
+	outage = false
+	_, err = newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 4, fetches)
+	_, err = newCache().lookup(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 4, fetches)
+
+	// Snapshots of other issuers are never used
+	_, err = newCache().lookup(context.Background(), "https://other.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 5, fetches)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// The exported constructor caches on disk too
+	diskFinder := NewDiskCachingPubkeyFinder(finder, dir, time.Hour, 0, nil)
+	_, err = diskFinder.JwksFunc(context.Background(), "https://issuer.example.com")
+	require.NoError(t, err)
+	require.Equal(t, 5, fetches)
+}
+
+func TestDiskCachingPubkeyFinderPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("snapshot permissions aren't checked on Windows")
+	}
+	dir := t.TempDir()
+	fetches := 0
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			fetches++
+			return []byte(`{"keys":[]}`), nil
+		},
+	}
+	lookup := func() {
+		_, err := NewDiskCachingPubkeyFinder(finder, dir, time.Hour, 0, nil).JwksFunc(context.Background(), "https://issuer.example.com")
+		require.NoError(t, err)
+	}
+	lookup()
+	require.Equal(t, 1, fetches)
+	lookup()
+	require.Equal(t, 1, fetches)
+
+	// Snapshots other users could have planted keys in are ignored
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	snapshot := filepath.Join(dir, entries[0].Name())
+	require.NoError(t, os.Chmod(snapshot, 0644))
+	lookup()
+	require.Equal(t, 2, fetches)
+
+	// The snapshot written by the fetch is 0600 again
+	lookup()
+	require.Equal(t, 2, fetches)
+
+	require.NoError(t, os.Chmod(dir, 0777))
+	lookup()
+	require.Equal(t, 3, fetches)
+}
+
+func TestPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	fetches := map[string]int{}
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetches[issuer]++
+			if issuer == "bad-issuer" {
+				return nil, fmt.Errorf("fetch failed")
+			}
+			return []byte(`{"keys": []}`), nil
+		},
+	}
+
+	err := finder.Prefetch(context.Background(), "issuer-1", "bad-issuer", "issuer-2")
+	require.ErrorContains(t, err, "failed to prefetch JWKS of issuer bad-issuer: failed to fetch JWKS: fetch failed")
+	require.NotContains(t, err.Error(), "issuer-1")
+	require.Equal(t, map[string]int{"issuer-1": 1, "bad-issuer": 1, "issuer-2": 1}, fetches)
+
+	// Prefetching warms a caching finder and refreshes it even when cached
+	cachingFinder := NewCachingPubkeyFinder(finder, time.Hour, nil)
+	require.NoError(t, cachingFinder.Prefetch(context.Background(), "issuer-1", "issuer-2"))
+	_, err = cachingFinder.JwksFunc(context.Background(), "issuer-1")
+	require.NoError(t, err)
+	require.Equal(t, 2, fetches["issuer-1"])
+	require.NoError(t, cachingFinder.Prefetch(context.Background(), "issuer-1"))
+	require.Equal(t, 3, fetches["issuer-1"])
+
+	// PrefetchEvery prefetches until the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 10)
+	done := make(chan struct{})
+	go func() {
+		cachingFinder.PrefetchEvery(ctx, 10*time.Millisecond, func(err error) { errs <- err }, "bad-issuer")
+		close(done)
+	}()
+	require.ErrorContains(t, <-errs, "bad-issuer")
+	require.ErrorContains(t, <-errs, "bad-issuer")
+	cancel()
+	<-done
+}
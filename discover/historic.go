@@ -0,0 +1,239 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+// HistoricKeyRecord is an OP public key that was seen in the OP's JWKS
+// between FirstSeen and LastSeen.
+type HistoricKeyRecord struct {
+	Issuer    string
+	KeyID     string
+	Key       jwk.Key
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// HistoricKeyStore is an append-only log of the public keys OPs have
+// published. Once an OP rotates its JWKS, PK Tokens signed by the old key
+// can no longer be verified using the JWKS. Verifiers which don't enforce
+// expiration can instead find the key in a HistoricKeyStore.
+//
+// Implementations must never remove or replace a key once recorded, only
+// extend its LastSeen time. Otherwise an attacker who can influence the
+// JWKS could swap the key used to verify old PK Tokens.
+type HistoricKeyStore interface {
+	// Record notes that key was present in the issuer's JWKS at the time seen
+	Record(ctx context.Context, issuer string, key jwk.Key, seen time.Time) error
+	// ByKeyID returns the record for the issuer's key with the KeyID (kid)
+	ByKeyID(ctx context.Context, issuer string, keyID string) (*HistoricKeyRecord, error)
+}
+
+// MemoryHistoricKeyStore is a HistoricKeyStore held in memory. It is
+// mainly useful for testing and short lived verifiers.
+type MemoryHistoricKeyStore struct {
+	mu      sync.Mutex
+	records map[string]map[string]*HistoricKeyRecord // issuer -> kid -> record
+}
+
+var _ HistoricKeyStore = (*MemoryHistoricKeyStore)(nil)
+
+func NewMemoryHistoricKeyStore() *MemoryHistoricKeyStore {
+	return &MemoryHistoricKeyStore{
+		records: map[string]map[string]*HistoricKeyRecord{},
+	}
+}
+
+func (s *MemoryHistoricKeyStore) Record(_ context.Context, issuer string, key jwk.Key, seen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[issuer]; !ok {
+		s.records[issuer] = map[string]*HistoricKeyRecord{}
+	}
+	existing, ok := s.records[issuer][key.KeyID()]
+	if !ok {
+		s.records[issuer][key.KeyID()] = &HistoricKeyRecord{
+			Issuer:    issuer,
+			KeyID:     key.KeyID(),
+			Key:       key,
+			FirstSeen: seen,
+			LastSeen:  seen,
+		}
+		return nil
+	}
+
+	if !jwk.Equal(existing.Key, key) {
+		return fmt.Errorf("issuer %s published a different key with previously seen kid %s", issuer, key.KeyID())
+	}
+	if seen.After(existing.LastSeen) {
+		existing.LastSeen = seen
+	}
+	if seen.Before(existing.FirstSeen) {
+		existing.FirstSeen = seen
+	}
+	return nil
+}
+
+func (s *MemoryHistoricKeyStore) ByKeyID(_ context.Context, issuer string, keyID string) (*HistoricKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[issuer][keyID]
+	if !ok {
+		return nil, fmt.Errorf("no historic public key found for kid %s", keyID)
+	}
+	recordCopy := *record
+	return &recordCopy, nil
+}
+
+// DefaultHistoricKeyTolerance is how far outside the time its key was seen
+// in the JWKS a token may have been issued, as JWKS snapshots are taken
+// periodically and the OP may have used the key before or after them
+const DefaultHistoricKeyTolerance = time.Hour
+
+// HistoricKeyByToken looks up an OP public key in the HistoricKeyStore
+// using the KeyID (kid) in the protected header of the supplied token. The
+// token must have been issued while the key was in the JWKS, give or take
+// tolerance, so that a key the OP removed, e.g. because it leaked, doesn't
+// verify tokens minted after.
+func HistoricKeyByToken(ctx context.Context, store HistoricKeyStore, issuer string, token []byte, tolerance time.Duration) (*PublicKeyRecord, error) {
+	keyID, err := keyIDFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	record, err := store.ByKeyID(ctx, issuer, keyID)
+	if err != nil {
+		return nil, err
+	}
+	issuedAt, err := issuedAtFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if issuedAt.Before(record.FirstSeen.Add(-tolerance)) || issuedAt.After(record.LastSeen.Add(tolerance)) {
+		return nil, fmt.Errorf("token issued at %s, outside the time historic key %s was seen (%s to %s)",
+			issuedAt.Format(time.RFC3339), keyID, record.FirstSeen.Format(time.RFC3339), record.LastSeen.Format(time.RFC3339))
+	}
+	return NewPublicKeyRecord(record.Key, issuer)
+}
+
+// issuedAtFromToken returns the iat claim of the token
+func issuedAtFromToken(token []byte) (time.Time, error) {
+	message, err := jws.Parse(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		IssuedAt *int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(message.Payload(), &claims); err != nil {
+		return time.Time{}, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if claims.IssuedAt == nil {
+		return time.Time{}, fmt.Errorf("token has no iat claim")
+	}
+	return time.Unix(*claims.IssuedAt, 0), nil
+}
+
+// JwksRecorder archives snapshots of OP JWKS to a HistoricKeyStore.
+type JwksRecorder struct {
+	// OnError, if set, is called with the errors recording the keys of a
+	// JWKS fetched through JwksFunc, e.g. when an OP reuses a kid for a new
+	// key. JwksFunc still returns the JWKS, so recording never stops
+	// verification.
+	OnError func(issuer string, err error)
+
+	store    HistoricKeyStore
+	jwksFunc JwksFetchFunc
+	now      func() time.Time
+}
+
+// NewJwksRecorder returns a JwksRecorder which fetches JWKS using jwksFunc
+// and records them to store. If jwksFunc is nil, JWKS are fetched from the
+// issuer's JWKS endpoint.
+func NewJwksRecorder(store HistoricKeyStore, jwksFunc JwksFetchFunc) *JwksRecorder {
+	if jwksFunc == nil {
+		jwksFunc = DefaultPubkeyFinder().JwksFunc
+	}
+	return &JwksRecorder{
+		store:    store,
+		jwksFunc: jwksFunc,
+		now:      time.Now,
+	}
+}
+
+// Snapshot fetches the issuer's current JWKS and records every key in it.
+// Call this periodically, e.g. from a cron job, to build up the log. Unlike
+// JwksFunc, it returns the errors recording keys.
+func (r *JwksRecorder) Snapshot(ctx context.Context, issuer string) error {
+	jwksJson, err := r.jwksFunc(ctx, issuer)
+	if err != nil {
+		return err
+	}
+	return r.record(ctx, issuer, jwksJson)
+}
+
+// JwksFunc returns a JwksFetchFunc which records every JWKS it fetches.
+// Setting it as the JwksFunc of a PublicKeyFinder archives each JWKS the
+// verifier sees without a separate snapshot job. Errors recording the
+// JWKS are passed to OnError rather than failing the fetch.
+func (r *JwksRecorder) JwksFunc() JwksFetchFunc {
+	return func(ctx context.Context, issuer string) ([]byte, error) {
+		jwksJson, err := r.jwksFunc(ctx, issuer)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.record(ctx, issuer, jwksJson); err != nil && r.OnError != nil {
+			r.OnError(issuer, err)
+		}
+		return jwksJson, nil
+	}
+}
+
+// record records every key with a kid in the JWKS, continuing past keys
+// that fail to record
+func (r *JwksRecorder) record(ctx context.Context, issuer string, jwksJson []byte) error {
+	jwks := jwk.NewSet()
+	if err := json.Unmarshal(jwksJson, jwks); err != nil {
+		return fmt.Errorf(`failed to unmarshal JWKS: %w`, err)
+	}
+
+	var errs []error
+	seen := r.now()
+	it := jwks.Keys(ctx)
+	for it.Next(ctx) {
+		key := it.Pair().Value.(jwk.Key)
+		if key.KeyID() == "" {
+			// Keys without a kid can't be looked up later
+			continue
+		}
+		if err := r.store.Record(ctx, issuer, key, seen); err != nil {
+			errs = append(errs, fmt.Errorf("failed to record JWKS key: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryHistoricKeyStore(t *testing.T) {
+	ctx := context.Background()
+	issuer := "https://accounts.example.com"
+
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	firstJwks, err := MockGetJwksByIssuer([]crypto.PublicKey{key1.Public()}, []string{"kid-1"}, []string{"RS256"})
+	require.NoError(t, err)
+	rotatedJwks, err := MockGetJwksByIssuer([]crypto.PublicKey{key1.Public(), key2.Public()}, []string{"kid-1", "kid-2"}, []string{"RS256", "RS256"})
+	require.NoError(t, err)
+	swappedJwks, err := MockGetJwksByIssuer([]crypto.PublicKey{key2.Public()}, []string{"kid-1"}, []string{"RS256"})
+	require.NoError(t, err)
+
+	store := NewMemoryHistoricKeyStore()
+	t0 := time.Unix(1700000000, 0)
+
+	recorder := NewJwksRecorder(store, firstJwks)
+	recorder.now = func() time.Time { return t0 }
+	require.NoError(t, recorder.Snapshot(ctx, issuer))
+
+	recorder = NewJwksRecorder(store, rotatedJwks)
+	recorder.now = func() time.Time { return t0.Add(time.Hour) }
+	require.NoError(t, recorder.Snapshot(ctx, issuer))
+
+	record, err := store.ByKeyID(ctx, issuer, "kid-1")
+	require.NoError(t, err)
+	require.Equal(t, t0, record.FirstSeen)
+	require.Equal(t, t0.Add(time.Hour), record.LastSeen)
+
+	record, err = store.ByKeyID(ctx, issuer, "kid-2")
+	require.NoError(t, err)
+	require.Equal(t, t0.Add(time.Hour), record.FirstSeen)
+
+	pkr, err := NewPublicKeyRecord(record.Key, issuer)
+	require.NoError(t, err)
+	require.True(t, key2.PublicKey.Equal(pkr.PublicKey))
+
+	// A key once recorded can not be replaced
+	recorder = NewJwksRecorder(store, swappedJwks)
+	err = recorder.Snapshot(ctx, issuer)
+	require.ErrorContains(t, err, "published a different key with previously seen kid kid-1")
+	record, err = store.ByKeyID(ctx, issuer, "kid-1")
+	require.NoError(t, err)
+	pkr, err = NewPublicKeyRecord(record.Key, issuer)
+	require.NoError(t, err)
+	require.True(t, key1.PublicKey.Equal(pkr.PublicKey))
+
+	// but a verifier fetching through the recorder still gets the JWKS
+	var recordErr error
+	recorder.OnError = func(_ string, err error) { recordErr = err }
+	jwks, err := recorder.JwksFunc()(ctx, issuer)
+	require.NoError(t, err)
+	require.NotEmpty(t, jwks)
+	require.ErrorContains(t, recordErr, "published a different key with previously seen kid kid-1")
+
+	_, err = store.ByKeyID(ctx, "https://other.example.com", "kid-1")
+	require.ErrorContains(t, err, "no historic public key found for kid kid-1")
+}
+
+func TestHistoricKeyByToken(t *testing.T) {
+	ctx := context.Background()
+	issuer := "https://accounts.example.com"
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks, err := MockGetJwksByIssuer([]crypto.PublicKey{key.Public()}, []string{"kid-1"}, []string{"RS256"})
+	require.NoError(t, err)
+
+	// The key was in the JWKS from t0 to t0 + 1 day
+	store := NewMemoryHistoricKeyStore()
+	t0 := time.Unix(1700000000, 0)
+	recorder := NewJwksRecorder(store, jwks)
+	recorder.now = func() time.Time { return t0 }
+	require.NoError(t, recorder.Snapshot(ctx, issuer))
+	recorder.now = func() time.Time { return t0.Add(24 * time.Hour) }
+	require.NoError(t, recorder.Snapshot(ctx, issuer))
+
+	signToken := func(payload string) []byte {
+		headers := jws.NewHeaders()
+		require.NoError(t, headers.Set(jws.KeyIDKey, "kid-1"))
+		token, err := jws.Sign([]byte(payload), jws.WithKey(jwa.RS256, key, jws.WithProtectedHeaders(headers)))
+		require.NoError(t, err)
+		return token
+	}
+
+	testCases := []struct {
+		name     string
+		issuedAt time.Time
+		expError string
+	}{
+		{name: "issued while the key was seen", issuedAt: t0.Add(12 * time.Hour)},
+		{name: "issued between snapshots", issuedAt: t0.Add(-30 * time.Minute)},
+		{name: "issued before the key was seen", issuedAt: t0.Add(-2 * time.Hour), expError: "outside the time historic key kid-1 was seen"},
+		{name: "issued after the key was removed", issuedAt: t0.Add(48 * time.Hour), expError: "outside the time historic key kid-1 was seen"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			token := signToken(fmt.Sprintf(`{"iat":%d}`, tc.issuedAt.Unix()))
+			record, err := HistoricKeyByToken(ctx, store, issuer, token, DefaultHistoricKeyTolerance)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+				require.True(t, key.PublicKey.Equal(record.PublicKey))
+			}
+		})
+	}
+
+	_, err = HistoricKeyByToken(ctx, store, issuer, signToken(`{}`), DefaultHistoricKeyTolerance)
+	require.ErrorContains(t, err, "token has no iat claim")
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Prefetch fetches and parses the JWKS of each issuer concurrently, so that
+// long-running verifiers can warm their keys at startup rather than paying
+// the latency on the first verification. A caching PublicKeyFinder, see
+// NewCachingPubkeyFinder, refetches the JWKS even if it is cached, which
+// keeps the cache fresh when Prefetch is called periodically. The errors of
+// the issuers whose JWKS couldn't be fetched are joined.
+func (f *PublicKeyFinder) Prefetch(ctx context.Context, issuers ...string) error {
+	fetch := f.fetchAndParseJwks
+	if f.prefetchJwks != nil {
+		fetch = (&PublicKeyFinder{JwksFunc: f.prefetchJwks}).fetchAndParseJwks
+	}
+
+	errs := make([]error, len(issuers))
+	var wg sync.WaitGroup
+	for i, issuer := range issuers {
+		wg.Add(1)
+		go func(i int, issuer string) {
+			defer wg.Done()
+			if _, err := fetch(ctx, issuer); err != nil {
+				errs[i] = fmt.Errorf("failed to prefetch JWKS of issuer %s: %w", issuer, err)
+			}
+		}(i, issuer)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// PrefetchEvery calls Prefetch with the issuers now and then every interval
+// until ctx is done. Failures are passed to onError if it is not nil and
+// retried at the next interval. With a caching PublicKeyFinder, an interval
+// shorter than the cache TTL means verifications never wait on a JWKS fetch.
+// It blocks, run it in its own goroutine.
+func (f *PublicKeyFinder) PrefetchEvery(ctx context.Context, interval time.Duration, onError func(error), issuers ...string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Prefetch(ctx, issuers...); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
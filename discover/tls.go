@@ -0,0 +1,76 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/openpubkey/openpubkey/retry"
+)
+
+// TLSClient returns a copy of client, or of http.DefaultClient if nil, whose
+// HTTPS connections use config, e.g. to trust the private CA of an internal
+// OP without modifying the system trust store. The client's transport must
+// be an *http.Transport. Transports wrapped by retry, telemetry or other
+// round trippers can't be reconfigured, so rather than silently using the
+// system trust store an error is returned. Set the TLS config on the
+// wrapped transport instead, or Allowlist.TLSConfig for an Allowlist's
+// client, and wrap the client after calling TLSClient.
+func TLSClient(client *http.Client, config *tls.Config) (*http.Client, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	tlsClient := *client
+	base := tlsClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("can't apply TLS config to HTTP transport %T, only to *http.Transport", base)
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = config.Clone()
+	tlsClient.Transport = transport
+	return &tlsClient, nil
+}
+
+// RootCAsTLSConfig returns a TLS config trusting only the roots, e.g. the
+// private CA bundle of internal OPs
+func RootCAsTLSConfig(roots *x509.CertPool) *tls.Config {
+	return &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+// NewTLSPubkeyFinder returns a PublicKeyFinder which fetches the OP's
+// configuration and JWKS over HTTPS connections using config, retrying
+// transient failures like DefaultPubkeyFinder. If http.DefaultTransport has
+// been replaced by a transport TLSClient can't configure, every fetch fails.
+func NewTLSPubkeyFinder(config *tls.Config) *PublicKeyFinder {
+	tlsClient, err := TLSClient(nil, config)
+	if err != nil {
+		return &PublicKeyFinder{
+			JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+				return nil, err
+			},
+		}
+	}
+	return NewPubkeyFinder(retry.Default.Client(tlsClient))
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/retry"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+// newTLSIssuer serves an OIDC discovery document and a JWKS with one key,
+// under a certificate signed by a CA only known to the returned pool
+func newTLSIssuer(t *testing.T, keyID string) (*httptest.Server, *x509.CertPool) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	jwksFunc, err := MockGetJwksByIssuerOneKey(signer.Public(), keyID, "ES256")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwks, _ := jwksFunc(r.Context(), server.URL)
+		_, _ = w.Write(jwks)
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return server, roots
+}
+
+func TestTLSPubkeyFinder(t *testing.T) {
+	ctx := context.Background()
+	server, roots := newTLSIssuer(t, "kid-1")
+
+	// The system trust store doesn't know the OP's CA
+	_, err := NewPubkeyFinder(nil).ByKeyID(ctx, server.URL, "kid-1")
+	require.ErrorContains(t, err, "certificate")
+
+	_, err = NewTLSPubkeyFinder(RootCAsTLSConfig(roots)).ByKeyID(ctx, server.URL, "kid-1")
+	require.NoError(t, err)
+
+	tlsClient, err := TLSClient(nil, RootCAsTLSConfig(roots))
+	require.NoError(t, err)
+	_, err = NewPubkeyFinder(tlsClient).ByKeyID(ctx, server.URL, "kid-1")
+	require.NoError(t, err)
+
+	allowlist, err := AllowlistFromIssuers(server.URL)
+	require.NoError(t, err)
+	allowlist.TLSConfig = RootCAsTLSConfig(roots)
+	_, err = NewPubkeyFinder(allowlist.HTTPClient()).ByKeyID(ctx, server.URL, "kid-1")
+	require.NoError(t, err)
+
+	// TLSClient doesn't modify the client it copies
+	client := &http.Client{}
+	_, err = TLSClient(client, RootCAsTLSConfig(roots))
+	require.NoError(t, err)
+	require.Nil(t, client.Transport)
+
+	// Wrapped transports can't be configured, rather than falling back to
+	// the system trust store TLSClient fails
+	_, err = TLSClient(retry.Default.Client(nil), RootCAsTLSConfig(roots))
+	require.ErrorContains(t, err, "can't apply TLS config")
+
+	// so the TLS config is applied before wrapping
+	wrapped := retry.Default.Client(tlsClient)
+	_, err = NewPubkeyFinder(wrapped).ByKeyID(ctx, server.URL, "kid-1")
+	require.NoError(t, err)
+}
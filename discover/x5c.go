@@ -0,0 +1,99 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// parseCertChain returns the certificates in the x5c parameter of the key,
+// leaf first, or nil if it has none. As RFC 7517 requires, the key in the
+// leaf certificate must be the JWK's key.
+func parseCertChain(key jwk.Key, pubKey crypto.PublicKey) ([]*x509.Certificate, error) {
+	chain := key.X509CertChain()
+	if chain == nil || chain.Len() == 0 {
+		return nil, nil
+	}
+
+	certs := make([]*x509.Certificate, 0, chain.Len())
+	for i := 0; i < chain.Len(); i++ {
+		// x5c entries are standard, not URL safe, base64 encoded DER
+		certB64, _ := chain.Get(i)
+		der, err := base64.StdEncoding.DecodeString(string(certB64))
+		if err != nil {
+			return nil, fmt.Errorf("malformed certificate %d in x5c: %w", i, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("malformed certificate %d in x5c: %w", i, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	leafKey, ok := certs[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(pubKey) {
+		return nil, fmt.Errorf("public key of the first certificate in x5c doesn't match the JWK")
+	}
+	return certs, nil
+}
+
+// VerifyCertChain checks that the key's x5c certificate chain is valid at
+// now and chains up to one of the roots. Keys without an x5c chain fail.
+func (r *PublicKeyRecord) VerifyCertChain(roots *x509.CertPool, now time.Time) error {
+	if len(r.CertChain) == 0 {
+		return fmt.Errorf("public key has no x5c certificate chain")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.CertChain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := r.CertChain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		// The certificate vouches for a signing key, not a TLS server
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("x5c certificate chain of public key is invalid: %w", err)
+	}
+	return nil
+}
+
+// newRecord returns the PublicKeyRecord of the key, checking its x5c
+// certificate chain against X5CRoots if they are set
+func (f *PublicKeyFinder) newRecord(key jwk.Key, issuer string) (*PublicKeyRecord, error) {
+	record, err := NewPublicKeyRecord(key, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if f.X5CRoots != nil {
+		if record.CertChain, err = parseCertChain(key, record.PublicKey); err == nil {
+			err = record.VerifyCertChain(f.X5CRoots, time.Now())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("public key %s of issuer %s: %w", key.KeyID(), issuer, err)
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package discover
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/cert"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+// issueCert returns a certificate for pub signed by parent's key, self
+// signed if parent is nil
+func issueCert(t *testing.T, name string, pub crypto.PublicKey, parent *x509.Certificate, parentKey crypto.Signer, isCA bool) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func jwksWithChain(t *testing.T, pub crypto.PublicKey, keyID string, chain ...*x509.Certificate) []byte {
+	key, err := jwk.FromRaw(pub)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, keyID))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.ES256))
+	if len(chain) > 0 {
+		x5c := &cert.Chain{}
+		for _, c := range chain {
+			require.NoError(t, x5c.AddString(base64.StdEncoding.EncodeToString(c.Raw)))
+		}
+		require.NoError(t, key.Set(jwk.X509CertChainKey, x5c))
+	}
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(key))
+	jwks, err := json.Marshal(set)
+	require.NoError(t, err)
+	return jwks
+}
+
+func TestX5CCertChain(t *testing.T) {
+	ctx := context.Background()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root := issueCert(t, "root", rootKey.Public(), nil, rootKey, true)
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	intermediate := issueCert(t, "intermediate", intermediateKey.Public(), root, rootKey, true)
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leaf := issueCert(t, "signing key", signingKey.Public(), intermediate, intermediateKey, false)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherRoot := issueCert(t, "other root", otherKey.Public(), nil, otherKey, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherRoot)
+
+	testCases := []struct {
+		name     string
+		jwks     []byte
+		roots    *x509.CertPool
+		expError string
+	}{
+		{name: "chain without roots", jwks: jwksWithChain(t, signingKey.Public(), "kid", leaf, intermediate)},
+		{name: "no chain without roots", jwks: jwksWithChain(t, signingKey.Public(), "kid")},
+		{name: "chain to root", jwks: jwksWithChain(t, signingKey.Public(), "kid", leaf, intermediate), roots: roots},
+		{name: "chain to other root", jwks: jwksWithChain(t, signingKey.Public(), "kid", leaf, intermediate), roots: otherRoots,
+			expError: "x5c certificate chain of public key is invalid"},
+		{name: "incomplete chain", jwks: jwksWithChain(t, signingKey.Public(), "kid", leaf), roots: roots,
+			expError: "x5c certificate chain of public key is invalid"},
+		{name: "no chain", jwks: jwksWithChain(t, signingKey.Public(), "kid"), roots: roots,
+			expError: "public key has no x5c certificate chain"},
+		{name: "leaf of another key", jwks: jwksWithChain(t, otherKey.Public(), "kid", leaf, intermediate), roots: roots,
+			expError: "public key of the first certificate in x5c doesn't match the JWK"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			finder := &PublicKeyFinder{
+				JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+					return tc.jwks, nil
+				},
+				X5CRoots: tc.roots,
+			}
+			record, err := finder.ByKeyID(ctx, "https://issuer.example.com", "kid")
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, signingKey.Public(), record.PublicKey)
+		})
+	}
+
+	// Without roots a mismatched chain is ignored rather than trusted
+	finder := &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			return jwksWithChain(t, otherKey.Public(), "kid", leaf, intermediate), nil
+		},
+	}
+	record, err := finder.ByKeyID(ctx, "https://issuer.example.com", "kid")
+	require.NoError(t, err)
+	require.Empty(t, record.CertChain)
+
+	// Records keep the chain so it can be checked later
+	finder = &PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			return jwksWithChain(t, signingKey.Public(), "kid", leaf, intermediate), nil
+		},
+	}
+	record, err = finder.ByKeyID(ctx, "https://issuer.example.com", "kid")
+	require.NoError(t, err)
+	require.Len(t, record.CertChain, 2)
+	require.NoError(t, record.VerifyCertChain(roots, time.Now()))
+	require.ErrorContains(t, record.VerifyCertChain(roots, time.Now().Add(2*time.Hour)), "expired")
+}
@@ -24,7 +24,7 @@ import (
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
-	wauthnmock "github.com/openpubkey/openpubkey/examples/mfa/mfacosigner/mocks"
+	wauthnmock "github.com/openpubkey/openpubkey/cosigner/webauthn/mocks"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/pktoken/mocks"
 	"github.com/openpubkey/openpubkey/util"
@@ -17,21 +17,26 @@
 package mfacosigner
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/openpubkey/openpubkey/examples/mfa/mfacosigner/jwks"
-	"github.com/openpubkey/openpubkey/pktoken"
-	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/cosigner"
+	wauthn "github.com/openpubkey/openpubkey/cosigner/webauthn"
 )
 
 type Server struct {
-	cosigner *MfaCosigner
-	jwksUri  string
+	cosigner   *MfaCosigner
+	jwksUri    string
+	adminToken string
 }
 
 func NewMfaCosignerHttpServer(serverUri, rpID, rpOrigin, RPDisplayName string) (*Server, error) {
@@ -45,36 +50,41 @@ func NewMfaCosignerHttpServer(serverUri, rpID, rpOrigin, RPDisplayName string) (
 	}
 
 	// Generate the key pair for our cosigner
-	alg := jwa.ES256
-	signer, err := util.GenKeyPair(alg)
+	key, err := cosigner.NewSigningKey(jwa.ES256)
 	if err != nil {
 		return nil, err
 	}
-
-	jwksServer, kid, err := jwks.NewJwksServer(signer, alg)
+	issuer := rpOrigin
+	server.cosigner, err = New(key.Signer, key.Alg, issuer, key.KeyID, cfg)
 	if err != nil {
 		return nil, err
 	}
-	jwksHost := jwksServer.URI()
-	server.jwksUri = fmt.Sprintf("%s/.well-known/jwks.json", jwksHost)
-	issuer := rpOrigin
 
+	// Rotate the cosigner's key daily. Keys it rotates away from stay in the
+	// JWKS, served by the webauthn handler, until their signatures expire.
+	server.cosigner.Keyring = cosigner.NewKeyring(key)
+	server.cosigner.Keyring.StartRotation(context.Background(), 24*time.Hour, newSigningKey, func(err error) {
+		fmt.Println("Failed to rotate cosigner key:", err)
+	})
+	server.jwksUri = fmt.Sprintf("%s/.well-known/jwks.json", issuer)
 	fmt.Println("JWKS hosted at", server.jwksUri)
-	server.cosigner, err = New(signer, alg, issuer, kid, cfg)
-	if err != nil {
-		return nil, err
-	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir("mfacosigner/static")))
-	mux.HandleFunc("/mfa-auth-init", server.initAuth)
-	mux.HandleFunc("/check-registration", server.checkIfRegistered)
-	mux.HandleFunc("/register/begin", server.beginRegistration)
-	mux.HandleFunc("/register/finish", server.finishRegistration)
-	mux.HandleFunc("/login/begin", server.beginLogin)
-	mux.HandleFunc("/login/finish", server.finishLogin)
-	mux.HandleFunc("/sign", server.signPkt)
+	mux.Handle("/", wauthn.NewHandler(server.cosigner.Cosigner))
 	mux.HandleFunc("/.well-known/openid-configuration", server.wellKnownConf)
+	mux.HandleFunc("/.well-known/revocations.jwt", server.revocationList)
+
+	// Help desk endpoints for listing and revoking cosigned sessions, e.g.
+	// when a user reports a stolen laptop. These require the admin token.
+	adminToken := make([]byte, 32)
+	if _, err := rand.Read(adminToken); err != nil {
+		return nil, err
+	}
+	server.adminToken = hex.EncodeToString(adminToken)
+	fmt.Println("Admin token:", server.adminToken)
+	mux.HandleFunc("/admin/sessions", server.requireAdmin(server.listSessions))
+	mux.HandleFunc("/admin/sessions/revoke", server.requireAdmin(server.revokeSessions))
+	mux.HandleFunc("/admin/keys/rotate", server.requireAdmin(server.rotateKey))
 
 	err = http.ListenAndServe(":3003", mux)
 	return server, err
@@ -84,181 +94,131 @@ func (s *Server) URI() string {
 	return s.cosigner.Issuer
 }
 
-func (s *Server) initAuth(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		return
-	}
-	pktB64 := []byte(r.URL.Query().Get("pkt"))
-	pktJson, err := util.Base64DecodeForJWT(pktB64)
-	if err != nil {
-		return
-	}
-	var pkt *pktoken.PKToken
-	if err := json.Unmarshal(pktJson, &pkt); err != nil {
-		return
+func (s *Server) wellKnownConf(w http.ResponseWriter, r *http.Request) {
+	type WellKnown struct {
+		Issuer        string `json:"issuer"`
+		JwksUri       string `json:"jwks_uri"`
+		RevocationUri string `json:"revocation_uri"`
 	}
-	sig := []byte(r.URL.Query().Get("sig1"))
 
-	authID, err := s.cosigner.InitAuth(pkt, sig)
-	if err != nil {
-		http.Error(w, "Error initiating authentication", http.StatusInternalServerError)
-		return
+	wk := WellKnown{
+		Issuer:        s.cosigner.Issuer,
+		JwksUri:       s.jwksUri,
+		RevocationUri: fmt.Sprintf("%s/.well-known/revocations.jwt", s.cosigner.Issuer),
 	}
-	mfapage := fmt.Sprintf("/?authid=%s", authID)
 
-	http.Redirect(w, r, mfapage, http.StatusFound)
-}
-
-func (s *Server) checkIfRegistered(w http.ResponseWriter, r *http.Request) {
-	authID, err := GetAuthID(r)
+	wkJson, err := json.Marshal(wk)
 	if err != nil {
-		http.Error(w, "Error in authID", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	registered := s.cosigner.CheckIsRegistered(authID)
-
-	response, _ := json.Marshal(map[string]bool{
-		"isRegistered": registered,
-	})
-
 	w.WriteHeader(200)
-	w.Write(response)
-}
-
-func GetAuthID(r *http.Request) (string, error) {
-	if err := r.ParseForm(); err != nil {
-		return "", err
-	}
-	return string([]byte(r.URL.Query().Get("authid"))), nil
+	w.Write(wkJson)
 }
 
-func (s *Server) beginRegistration(w http.ResponseWriter, r *http.Request) {
-	authID, err := GetAuthID(r)
-	if err != nil {
-		http.Error(w, "Error in authID", http.StatusInternalServerError)
-		return
-	}
-
-	options, err := s.cosigner.BeginRegistration(authID)
-
-	optionsJson, err := json.Marshal(options)
+func (s *Server) revocationList(w http.ResponseWriter, r *http.Request) {
+	rl, err := s.cosigner.RevocationList()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(optionsJson)
+	w.Header().Set("Content-Type", "application/jwt")
+	w.WriteHeader(200)
+	w.Write(rl)
 }
 
-func (s *Server) finishRegistration(w http.ResponseWriter, r *http.Request) {
-	authID, err := GetAuthID(r)
-	if err != nil {
-		http.Error(w, "Error in authID", http.StatusInternalServerError)
-		return
-	}
+func newSigningKey() (cosigner.SigningKey, error) {
+	return cosigner.NewSigningKey(jwa.ES256)
+}
 
-	parsedResponse, err := protocol.ParseCredentialCreationResponse(r)
-	if err != nil {
-		http.Error(w, "Error in parsing credential", http.StatusInternalServerError)
+// rotateKey rotates the cosigner's key straight away, e.g. when it may have
+// been compromised
+func (s *Server) rotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	err = s.cosigner.FinishRegistration(authID, parsedResponse)
+	key, err := newSigningKey()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	w.WriteHeader(201)
-	fmt.Println("MFA registration complete")
-}
-
-func (s *Server) beginLogin(w http.ResponseWriter, r *http.Request) {
-	authID, err := GetAuthID(r)
-	if err != nil {
-		http.Error(w, "Error in authID", http.StatusInternalServerError)
-		return
-	}
-	options, err := s.cosigner.BeginLogin(authID)
-	if err != nil {
+	if err := s.cosigner.Keyring.Rotate(key); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	optionsJson, err := json.Marshal(options)
+	keyJson, err := json.Marshal(map[string]string{"kid": key.KeyID})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(optionsJson)
+	w.WriteHeader(200)
+	w.Write(keyJson)
 }
 
-func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request) {
-	authID, err := GetAuthID(r)
-	if err != nil {
-		http.Error(w, "Error in authID", http.StatusInternalServerError)
-		return
+func (s *Server) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
 	}
+}
 
-	parsedResponse, err := protocol.ParseCredentialRequestResponse(r)
-	if err != nil {
-		http.Error(w, "Error in parsing credential", http.StatusInternalServerError)
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	authcode, ruri, err := s.cosigner.FinishLogin(authID, parsedResponse)
+	sessions, err := s.cosigner.ListSessions(SessionFilterFromQuery(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	redirectURIl := fmt.Sprintf("%s?authcode=%s", ruri, authcode)
-	response, _ := json.Marshal(map[string]string{
-		"redirect_uri": redirectURIl,
-	})
-	w.WriteHeader(201)
-	w.Write(response)
+	writeSessions(w, sessions)
 }
 
-func (s *Server) signPkt(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *Server) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	sig := []byte(r.URL.Query().Get("sig2"))
-
-	if cosSig, err := s.cosigner.RedeemAuthcode(sig); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	revoked, err := s.cosigner.RevokeSessions(SessionFilterFromQuery(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
-	} else {
-		cosSigB64 := util.Base64EncodeForJWT(cosSig)
-		w.WriteHeader(201)
-		w.Write(cosSigB64)
 	}
+	writeSessions(w, revoked)
 }
 
-func (s *Server) wellKnownConf(w http.ResponseWriter, r *http.Request) {
-	type WellKnown struct {
-		Issuer  string `json:"issuer"`
-		JwksUri string `json:"jwks_uri"`
-	}
-
-	wk := WellKnown{
-		Issuer:  s.cosigner.Issuer,
-		JwksUri: s.jwksUri,
-	}
+// SessionFilterFromQuery selects sessions by the auth_id, device_id or the
+// user (iss, aud and sub) query parameters
+func SessionFilterFromQuery(r *http.Request) cosigner.SessionFilter {
+	query := r.URL.Query()
+	filter := cosigner.SessionFilter{
+		AuthID:   query.Get("auth_id"),
+		DeviceID: query.Get("device_id"),
+	}
+	if query.Has("sub") {
+		filter.User = &cosigner.UserKey{
+			Issuer: query.Get("iss"),
+			Aud:    query.Get("aud"),
+			Sub:    query.Get("sub"),
+		}
+	}
+	return filter
+}
 
-	wkJson, err := json.Marshal(wk)
+func writeSessions(w http.ResponseWriter, sessions []cosigner.Session) {
+	sessionsJson, err := json.Marshal(sessions)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	w.Write(wkJson)
+	w.Write(sessionsJson)
 }
@@ -26,6 +26,7 @@ import (
 
 	"github.com/openpubkey/openpubkey/client"
 	"github.com/openpubkey/openpubkey/examples/x509/ca"
+	"github.com/openpubkey/openpubkey/examples/x509/rolesanywhere"
 	"github.com/openpubkey/openpubkey/providers"
 )
 
@@ -37,7 +38,7 @@ func main() {
 	defer memguard.Purge()
 
 	if len(os.Args) < 2 {
-		fmt.Printf("OpenPubkey: command choices are login, sign, and cert")
+		fmt.Printf("OpenPubkey: command choices are login, sign, cert and aws")
 		return
 	}
 
@@ -52,11 +53,62 @@ func main() {
 		} else {
 			fmt.Println("Login and X509 issuance successful!")
 		}
+	case "aws":
+		// Prints AWS credentials in the credential_process format, e.g.
+		//  [profile opk]
+		//  credential_process = /path/to/x509 aws
+		op := providers.NewGoogleOp()
+		req := rolesanywhere.SessionRequest{
+			TrustAnchorArn: os.Getenv("OPK_TRUST_ANCHOR_ARN"),
+			ProfileArn:     os.Getenv("OPK_PROFILE_ARN"),
+			RoleArn:        os.Getenv("OPK_ROLE_ARN"),
+		}
+		if err := awsCredentials(op, os.Getenv("AWS_REGION"), req); err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting AWS credentials:", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Println("Unrecognized command:", command)
 	}
 }
 
+// awsCredentials issues an X.509 certificate for the user and exchanges it
+// for AWS credentials using IAM Roles Anywhere. The CA's root certificate
+// must be registered as the trust anchor.
+func awsCredentials(op client.OpenIdProvider, region string, req rolesanywhere.SessionRequest) error {
+	opkClient, err := client.New(op)
+	if err != nil {
+		return err
+	}
+	pkt, err := opkClient.Auth(context.Background())
+	if err != nil {
+		return err
+	}
+	pktJson, err := json.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	certAuth, err := ca.New(op)
+	if err != nil {
+		return err
+	}
+	certPEM, err := certAuth.PktToSignedX509(pktJson)
+	if err != nil {
+		return err
+	}
+
+	creds, err := rolesanywhere.New(region).CreateSession(context.Background(), certPEM, opkClient.GetSigner(), req)
+	if err != nil {
+		return err
+	}
+	credsJson, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(credsJson))
+	return nil
+}
+
 func login(op client.OpenIdProvider) error {
 	opkClient, err := client.New(
 		op,
@@ -0,0 +1,186 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fulcio exchanges a PK Token for a short-lived code signing
+// certificate issued by Fulcio, the sigstore CA. The certificate is for the
+// key in the PK Token, so OpenPubkey identities can sign artifacts that
+// cosign and other sigstore clients verify, without running our own CA.
+package fulcio
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// DefaultURL is the public sigstore Fulcio instance
+const DefaultURL = "https://fulcio.sigstore.dev"
+
+const signingCertPath = "/api/v2/signingCert"
+
+// SigningCert is a certificate issued by Fulcio
+type SigningCert struct {
+	// ChainPEM is the certificate followed by the certificates of its
+	// issuers, PEM encoded
+	ChainPEM []byte
+	// SCT is the signed certificate timestamp of the certificate if Fulcio
+	// didn't embed it in the certificate
+	SCT []byte
+}
+
+type Client struct {
+	// URL of the Fulcio instance, DefaultURL if empty
+	URL        string
+	HttpClient *http.Client
+}
+
+// New returns a client for the Fulcio instance at url
+func New(url string) *Client {
+	return &Client{
+		URL:        url,
+		HttpClient: http.DefaultClient,
+	}
+}
+
+// SigningCert requests a code signing certificate for the key in the PK
+// Token. signer must hold that key, e.g. the OpkClient's signer. It signs
+// the certificate signing request, which proves possession of the key to
+// Fulcio, and Fulcio verifies the ID Token in the PK Token.
+//
+// Fulcio only accepts ID Tokens for the audience it is configured with,
+// "sigstore" for the public instance, so the OpenID Provider client must be
+// registered with that audience, or a private Fulcio configured with the
+// client ID. PK Tokens with GQ signatures are rejected as Fulcio can't
+// verify them.
+func (c *Client) SigningCert(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Signer) (*SigningCert, error) {
+	if alg, ok := pkt.ProviderAlgorithm(); ok && alg == gq.GQ256 {
+		return nil, fmt.Errorf("fulcio can't verify ID Tokens with GQ signatures")
+	}
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return nil, err
+	}
+	var upk crypto.PublicKey
+	if err := cic.PublicKey().Raw(&upk); err != nil {
+		return nil, err
+	}
+	signerKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !signerKey.Equal(upk) {
+		return nil, fmt.Errorf("signer does not hold the PK Token's key")
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate signing request: %w", err)
+	}
+	var reqBody struct {
+		Credentials struct {
+			OIDCIdentityToken string `json:"oidcIdentityToken"`
+		} `json:"credentials"`
+		// encoding/json encodes []byte as base64 like protobuf JSON does
+		CertificateSigningRequest []byte `json:"certificateSigningRequest"`
+	}
+	reqBody.Credentials.OIDCIdentityToken = string(pkt.OpToken)
+	reqBody.CertificateSigningRequest = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.URL
+	if url == "" {
+		url = DefaultURL
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+signingCertPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received %s from Fulcio: %s", resp.Status, respBody)
+	}
+
+	type chain struct {
+		Certificates []string `json:"certificates"`
+	}
+	var signingCert struct {
+		Embedded *struct {
+			Chain chain `json:"chain"`
+		} `json:"signedCertificateEmbeddedSct"`
+		Detached *struct {
+			Chain chain  `json:"chain"`
+			SCT   []byte `json:"signedCertificateTimestamp"`
+		} `json:"signedCertificateDetachedSct"`
+	}
+	if err := json.Unmarshal(respBody, &signingCert); err != nil {
+		return nil, fmt.Errorf("failed to parse Fulcio response: %w", err)
+	}
+	var certs []string
+	result := &SigningCert{}
+	switch {
+	case signingCert.Embedded != nil:
+		certs = signingCert.Embedded.Chain.Certificates
+	case signingCert.Detached != nil:
+		certs = signingCert.Detached.Chain.Certificates
+		result.SCT = signingCert.Detached.SCT
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in Fulcio response")
+	}
+	for _, certPEM := range certs {
+		result.ChainPEM = append(result.ChainPEM, strings.TrimSpace(certPEM)+"\n"...)
+	}
+
+	// Check the certificate is for our key before anyone signs with it
+	block, _ := pem.Decode(result.ChainPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if !signerKey.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("fulcio issued a certificate for another key")
+	}
+	return result, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fulcio
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+func TestSigningCert(t *testing.T) {
+	ctx := context.Background()
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	issue := func(key crypto.PublicKey) string {
+		leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(10 * time.Minute),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}, caTemplate, key, caKey)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}))
+	}
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+
+	var respond func(w http.ResponseWriter, csr *x509.CertificateRequest)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, signingCertPath, r.URL.Path)
+		var req struct {
+			Credentials struct {
+				OIDCIdentityToken string `json:"oidcIdentityToken"`
+			} `json:"credentials"`
+			CertificateSigningRequest []byte `json:"certificateSigningRequest"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, string(pkt.OpToken), req.Credentials.OIDCIdentityToken)
+		block, _ := pem.Decode(req.CertificateSigningRequest)
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		require.NoError(t, csr.CheckSignature())
+		respond(w, csr)
+	}))
+	defer server.Close()
+	fulcio := New(server.URL)
+
+	respond = func(w http.ResponseWriter, csr *x509.CertificateRequest) {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"signedCertificateEmbeddedSct": map[string]any{
+				"chain": map[string]any{"certificates": []string{issue(csr.PublicKey), caPEM}},
+			},
+		})
+	}
+	cert, err := fulcio.SigningCert(ctx, pkt, signer)
+	require.NoError(t, err)
+	require.Empty(t, cert.SCT)
+	block, rest := pem.Decode(cert.ChainPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.True(t, leaf.PublicKey.(*ecdsa.PublicKey).Equal(signer.Public()))
+	block, _ = pem.Decode(rest)
+	require.Equal(t, caDER, block.Bytes)
+
+	respond = func(w http.ResponseWriter, csr *x509.CertificateRequest) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"signedCertificateDetachedSct": map[string]any{
+				"chain":                      map[string]any{"certificates": []string{issue(csr.PublicKey)}},
+				"signedCertificateTimestamp": []byte("sct"),
+			},
+		})
+	}
+	cert, err = fulcio.SigningCert(ctx, pkt, signer)
+	require.NoError(t, err)
+	require.Equal(t, []byte("sct"), cert.SCT)
+
+	respond = func(w http.ResponseWriter, csr *x509.CertificateRequest) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"signedCertificateEmbeddedSct": map[string]any{
+				"chain": map[string]any{"certificates": []string{issue(&caKey.PublicKey)}},
+			},
+		})
+	}
+	_, err = fulcio.SigningCert(ctx, pkt, signer)
+	require.ErrorContains(t, err, "another key")
+
+	respond = func(w http.ResponseWriter, csr *x509.CertificateRequest) {
+		http.Error(w, `{"message": "invalid audience"}`, http.StatusUnauthorized)
+	}
+	_, err = fulcio.SigningCert(ctx, pkt, signer)
+	require.ErrorContains(t, err, "401 Unauthorized")
+
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	_, err = fulcio.SigningCert(ctx, pkt, otherSigner)
+	require.ErrorContains(t, err, "does not hold the PK Token's key")
+}
+
+func TestSigningCertGQ(t *testing.T) {
+	ctx := context.Background()
+	providerOpts := providers.DefaultMockProviderOpts()
+	providerOpts.GQSign = true
+	op, _, _, err := providers.NewMockProvider(providerOpts)
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+
+	_, err = New(DefaultURL).SigningCert(ctx, pkt, signer)
+	require.ErrorContains(t, err, "GQ signatures")
+}
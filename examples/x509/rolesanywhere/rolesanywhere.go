@@ -0,0 +1,241 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package rolesanywhere exchanges an X.509 certificate issued by the
+// OpenPubkey CA for temporary AWS credentials using IAM Roles Anywhere.
+// This completes the workload path: OIDC identity -> PK Token -> X.509
+// certificate -> cloud credentials.
+package rolesanywhere
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultDuration is the session duration used if none is specified.
+const DefaultDuration = time.Hour
+
+const (
+	service           = "rolesanywhere"
+	amzDateFormat     = "20060102T150405Z"
+	shortDateFormat   = "20060102"
+	signedHeaders     = "content-type;host;x-amz-date;x-amz-x509"
+	credentialVersion = 1
+)
+
+// SessionRequest identifies the Roles Anywhere trust anchor, profile and
+// role to create a session for.
+type SessionRequest struct {
+	TrustAnchorArn string
+	ProfileArn     string
+	RoleArn        string
+	// Duration of the session, if zero DefaultDuration is used
+	Duration time.Duration
+}
+
+// Credentials are temporary AWS credentials. They marshal to the format
+// expected from an AWS credential_process, so the output of this helper can
+// be used directly in ~/.aws/config.
+type Credentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+type Client struct {
+	Region string
+	// Endpoint overrides the Roles Anywhere endpoint for Region. Used for
+	// testing and for FIPS or VPC endpoints.
+	Endpoint   string
+	HttpClient *http.Client
+	// now is overridden in tests
+	now func() time.Time
+}
+
+// New returns a Roles Anywhere client for the given AWS region.
+func New(region string) *Client {
+	return &Client{
+		Region:     region,
+		HttpClient: http.DefaultClient,
+		now:        time.Now,
+	}
+}
+
+// CreateSession exchanges a PEM encoded X.509 certificate, and the signer
+// holding its private key, for temporary AWS credentials. For a certificate
+// issued by the OpenPubkey CA the signer is the OpkClient's signer.
+func (c *Client) CreateSession(ctx context.Context, certPEM []byte, signer crypto.Signer, req SessionRequest) (*Credentials, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	duration := req.Duration
+	if duration == 0 {
+		duration = DefaultDuration
+	}
+	body, err := json.Marshal(struct {
+		DurationSeconds int    `json:"durationSeconds"`
+		ProfileArn      string `json:"profileArn"`
+		RoleArn         string `json:"roleArn"`
+		TrustAnchorArn  string `json:"trustAnchorArn"`
+	}{
+		DurationSeconds: int(duration.Seconds()),
+		ProfileArn:      req.ProfileArn,
+		RoleArn:         req.RoleArn,
+		TrustAnchorArn:  req.TrustAnchorArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://rolesanywhere.%s.amazonaws.com", c.Region)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/sessions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sign(httpReq, body, cert, signer); err != nil {
+		return nil, fmt.Errorf("error signing request: %w", err)
+	}
+
+	resp, err := c.HttpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received %s from Roles Anywhere: %s", resp.Status, respBody)
+	}
+
+	var session struct {
+		CredentialSet []struct {
+			Credentials struct {
+				AccessKeyId     string `json:"accessKeyId"`
+				SecretAccessKey string `json:"secretAccessKey"`
+				SessionToken    string `json:"sessionToken"`
+				Expiration      string `json:"expiration"`
+			} `json:"credentials"`
+		} `json:"credentialSet"`
+	}
+	if err := json.Unmarshal(respBody, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse Roles Anywhere response: %w", err)
+	}
+	if len(session.CredentialSet) == 0 {
+		return nil, fmt.Errorf("no credentials in Roles Anywhere response")
+	}
+	creds := session.CredentialSet[0].Credentials
+	return &Credentials{
+		Version:         credentialVersion,
+		AccessKeyId:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiration:      creds.Expiration,
+	}, nil
+}
+
+// sign adds the headers for the AWS4-X509 signature scheme used by Roles
+// Anywhere. It follows SigV4, except the string to sign is signed with the
+// certificate's private key and the credential is the certificate serial
+// number.
+func (c *Client) sign(req *http.Request, body []byte, cert *x509.Certificate, signer crypto.Signer) error {
+	var algorithm string
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		algorithm = "AWS4-X509-ECDSA-SHA256"
+	case *rsa.PublicKey:
+		algorithm = "AWS4-X509-RSA-SHA256"
+	default:
+		return fmt.Errorf("unsupported signer key type %T", signer.Public())
+	}
+
+	now := c.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-X509", base64.StdEncoding.EncodeToString(cert.Raw))
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		req.URL.Query().Encode(),
+		"content-type:application/json",
+		"host:" + req.URL.Host,
+		"x-amz-date:" + amzDate,
+		"x-amz-x509:" + req.Header.Get("X-Amz-X509"),
+		"",
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(shortDateFormat), c.Region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, cert.SerialNumber.String(), scope, signedHeaders, hex.EncodeToString(sig)))
+	return nil
+}
+
+func canonicalPath(u *url.URL) string {
+	if u.EscapedPath() == "" {
+		return "/"
+	}
+	return u.EscapedPath()
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rolesanywhere
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/examples/x509/ca"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+func TestCreateSession(t *testing.T) {
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	certAuth, err := ca.New(op)
+	require.NoError(t, err)
+
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	pktJson, err := json.Marshal(pkt)
+	require.NoError(t, err)
+	certPEM, err := certAuth.PktToSignedX509(pktJson)
+	require.NoError(t, err)
+
+	req := SessionRequest{
+		TrustAnchorArn: "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/ta",
+		ProfileArn:     "arn:aws:rolesanywhere:us-east-1:123456789012:profile/p",
+		RoleArn:        "arn:aws:iam::123456789012:role/opk",
+	}
+
+	authRe := regexp.MustCompile(`^AWS4-X509-ECDSA-SHA256 Credential=(\d+)/(\d{8}/us-east-1/rolesanywhere/aws4_request), SignedHeaders=content-type;host;x-amz-date;x-amz-x509, Signature=([0-9a-f]+)$`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		var sessionReq map[string]any
+		require.NoError(t, json.Unmarshal(body, &sessionReq))
+		require.Equal(t, req.TrustAnchorArn, sessionReq["trustAnchorArn"])
+		require.Equal(t, req.ProfileArn, sessionReq["profileArn"])
+		require.Equal(t, req.RoleArn, sessionReq["roleArn"])
+		require.Equal(t, float64(3600), sessionReq["durationSeconds"])
+
+		certDER, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Amz-X509"))
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(certDER)
+		require.NoError(t, err)
+
+		matches := authRe.FindStringSubmatch(r.Header.Get("Authorization"))
+		require.NotNil(t, matches, "unexpected Authorization header: %s", r.Header.Get("Authorization"))
+		require.Equal(t, cert.SerialNumber.String(), matches[1])
+
+		bodyHash := sha256.Sum256(body)
+		canonicalRequest := strings.Join([]string{
+			"POST", "/sessions", "",
+			"content-type:" + r.Header.Get("Content-Type"),
+			"host:" + r.Host,
+			"x-amz-date:" + r.Header.Get("X-Amz-Date"),
+			"x-amz-x509:" + r.Header.Get("X-Amz-X509"),
+			"",
+			"content-type;host;x-amz-date;x-amz-x509",
+			hex.EncodeToString(bodyHash[:]),
+		}, "\n")
+		crHash := sha256.Sum256([]byte(canonicalRequest))
+		stringToSign := strings.Join([]string{
+			"AWS4-X509-ECDSA-SHA256",
+			r.Header.Get("X-Amz-Date"),
+			matches[2],
+			hex.EncodeToString(crHash[:]),
+		}, "\n")
+		digest := sha256.Sum256([]byte(stringToSign))
+		sig, err := hex.DecodeString(matches[3])
+		require.NoError(t, err)
+		if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"credentialSet":[{"credentials":{"accessKeyId":"AKIA","secretAccessKey":"secret","sessionToken":"token","expiration":"2024-01-01T01:00:00Z"}}],"subjectArn":"arn"}`)
+	}))
+	defer server.Close()
+
+	raClient := New("us-east-1")
+	raClient.Endpoint = server.URL
+	creds, err := raClient.CreateSession(context.Background(), certPEM, opkClient.GetSigner(), req)
+	require.NoError(t, err)
+	require.Equal(t, &Credentials{
+		Version:         1,
+		AccessKeyId:     "AKIA",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		Expiration:      "2024-01-01T01:00:00Z",
+	}, creds)
+
+	// Signing with a key that doesn't match the certificate must be rejected
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	_, err = raClient.CreateSession(context.Background(), certPEM, otherSigner, req)
+	require.ErrorContains(t, err, "403 Forbidden")
+
+	_, err = raClient.CreateSession(context.Background(), []byte("not a cert"), opkClient.GetSigner(), req)
+	require.ErrorContains(t, err, "failed to parse certificate PEM")
+}
+
+func TestSignDate(t *testing.T) {
+	c := New("eu-west-1")
+	c.now = func() time.Time { return time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC) }
+
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	certPEM, err := selfSignedCert(signer.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, "https://rolesanywhere.eu-west-1.amazonaws.com/sessions", nil)
+	require.NoError(t, err)
+	require.NoError(t, c.sign(req, []byte("{}"), cert, signer))
+	require.Equal(t, "20240304T050607Z", req.Header.Get("X-Amz-Date"))
+	require.Contains(t, req.Header.Get("Authorization"), "/20240304/eu-west-1/rolesanywhere/aws4_request,")
+}
+
+func selfSignedCert(key *ecdsa.PrivateKey) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -17,7 +17,9 @@
 package gq
 
 import (
+	"context"
 	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/big"
@@ -25,20 +27,53 @@ import (
 	"filippo.io/bigmod"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/util"
 	"golang.org/x/crypto/sha3"
 )
 
 var GQ256 = jwa.SignatureAlgorithm("GQ256")
 
+// PSSEncodedMessageKey is the protected header of a GQ signed JWT that
+// carries the EMSA-PSS encoded message recovered from a PS256 signature.
+// Unlike PKCS #1 v1.5, PSS encoding is randomized, so the verifier cannot
+// recompute the GQ public number from the JWT alone and needs it supplied.
+const PSSEncodedMessageKey = "pss"
+
 func init() {
 	jwa.RegisterSignatureAlgorithm(GQ256)
 }
 
 type OptsStruct struct {
 	extraClaims map[string]any
+	ctx         context.Context
+	progress    ProgressFunc
 }
 type Opts func(a *OptsStruct)
 
+// ProgressFunc is called as GQ signing progresses with the number of steps
+// done out of the total number of steps. It is called from the signing
+// goroutine and should return quickly.
+type ProgressFunc func(done int, total int)
+
+// WithProgress reports the progress of GQ signing to progress, which lets
+// interactive tools show that signing on slow hardware hasn't hung.
+// Example use:
+//
+//	WithProgress(func(done, total int) { fmt.Printf("\rGQ signing %d/%d", done, total) })
+func WithProgress(progress ProgressFunc) Opts {
+	return func(a *OptsStruct) {
+		a.progress = progress
+	}
+}
+
+// withContext makes signing check ctx between rounds of the proof and
+// abort once it is cancelled or its deadline passes
+func withContext(ctx context.Context) Opts {
+	return func(a *OptsStruct) {
+		a.ctx = ctx
+	}
+}
+
 // WithExtraClaim specifies additional values to be included in the
 // GQ signed JWT. These claims will be included in the protected header
 // of the JWT
@@ -59,8 +94,29 @@ func WithExtraClaim(k string, v string) Opts {
 // the GQ signature. It is wrapper around SignerVerifier.SignJWT
 // an additional check that the correct rsa public key has been supplied.
 // Use this instead of SignerVerifier.SignJWT.
+//
+// Both RS256 and PS256 signed JWTs are supported.
 func GQ256SignJWT(rsaPublicKey *rsa.PublicKey, jwt []byte, opts ...Opts) ([]byte, error) {
-	_, err := jws.Verify(jwt, jws.WithKey(jwa.RS256, rsaPublicKey))
+	return GQ256SignJWTContext(context.Background(), rsaPublicKey, jwt, opts...)
+}
+
+// GQ256SignJWTContext is GQ256SignJWT which stops signing and returns an
+// error wrapping ctx.Err() once ctx is cancelled or its deadline passes.
+// Cancellation is checked between the rounds of the proof, so signing
+// returns shortly after rather than immediately.
+func GQ256SignJWTContext(ctx context.Context, rsaPublicKey *rsa.PublicKey, jwt []byte, opts ...Opts) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("GQ signing aborted: %w", err)
+	}
+	token, err := jws.Parse(jwt)
+	if err != nil {
+		return nil, err
+	}
+	alg := token.Signatures()[0].ProtectedHeaders().Algorithm()
+	if alg != jwa.RS256 && alg != jwa.PS256 {
+		return nil, fmt.Errorf("unsupported jwt alg for GQ signing: %s", alg)
+	}
+	_, err = jws.Verify(jwt, jws.WithKey(alg, rsaPublicKey))
 	if err != nil {
 		return nil, fmt.Errorf("incorrect public key supplied when GQ signing jwt: %w", err)
 	}
@@ -68,7 +124,7 @@ func GQ256SignJWT(rsaPublicKey *rsa.PublicKey, jwt []byte, opts ...Opts) ([]byte
 	if err != nil {
 		return nil, fmt.Errorf("error creating GQ signer: %w", err)
 	}
-	gqJWT, err := sv.SignJWT(jwt, opts...)
+	gqJWT, err := sv.SignJWT(jwt, append(opts, withContext(ctx))...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating GQ signature: %w", err)
 	}
@@ -196,3 +252,17 @@ func OriginalJWTHeaders(jwt []byte) ([]byte, error) {
 	origHeaders := []byte(headers.KeyID())
 	return origHeaders, nil
 }
+
+// originalAlgorithm returns the alg of the original JWT headers as returned
+// by OriginalJWTHeaders.
+func originalAlgorithm(origHeaders []byte) (jwa.SignatureAlgorithm, error) {
+	headersJSON, err := util.Base64DecodeForJWT(origHeaders)
+	if err != nil {
+		return "", err
+	}
+	headers := jws.NewHeaders()
+	if err := json.Unmarshal(headersJSON, &headers); err != nil {
+		return "", err
+	}
+	return headers.Algorithm(), nil
+}
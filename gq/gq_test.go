@@ -17,6 +17,7 @@
 package gq
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
@@ -107,6 +108,67 @@ func TestGQ256SignJWT(t *testing.T) {
 	require.Nil(t, gqTokenReservedClaim)
 }
 
+func TestSignVerifyJWTPS256(t *testing.T) {
+	oidcPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idToken, err := createOIDCTokenWithAlg(oidcPrivKey, "test", jwa.PS256)
+	require.NoError(t, err)
+
+	gqToken, err := GQ256SignJWT(&oidcPrivKey.PublicKey, idToken)
+	require.NoError(t, err)
+	ok, err := GQ256VerifyJWT(&oidcPrivKey.PublicKey, gqToken)
+	require.NoError(t, err)
+	require.True(t, ok, "signature verification failed")
+
+	em, ok, err := getClaimInProtected(PSSEncodedMessageKey, gqToken)
+	require.NoError(t, err)
+	require.True(t, ok, "expected %s header in GQ signed PS256 token", PSSEncodedMessageKey)
+	require.NotEmpty(t, em)
+
+	// A PS256 token must not verify if the encoded message is swapped for one
+	// from a different token
+	otherToken, err := createOIDCTokenWithAlg(oidcPrivKey, "other", jwa.PS256)
+	require.NoError(t, err)
+	otherGQToken, err := GQ256SignJWT(&oidcPrivKey.PublicKey, otherToken)
+	require.NoError(t, err)
+	otherEm, _, err := getClaimInProtected(PSSEncodedMessageKey, otherGQToken)
+	require.NoError(t, err)
+
+	headersB64, payload, signature, err := jws.SplitCompact(gqToken)
+	require.NoError(t, err)
+	headersJson, err := util.Base64DecodeForJWT(headersB64)
+	require.NoError(t, err)
+	headers := jws.NewHeaders()
+	require.NoError(t, json.Unmarshal(headersJson, &headers))
+	require.NoError(t, headers.Set(PSSEncodedMessageKey, otherEm))
+	headersJson, err = json.Marshal(headers)
+	require.NoError(t, err)
+	swappedToken := util.JoinJWTSegments(util.Base64EncodeForJWT(headersJson), payload, signature)
+
+	ok, err = GQ256VerifyJWT(&oidcPrivKey.PublicKey, swappedToken)
+	require.NoError(t, err)
+	require.False(t, ok, "GQ signature verification passed with swapped PSS encoded message")
+
+	// The same JWT signed with the wrong key must be rejected
+	oidcPrivKeyWrong, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = GQ256SignJWT(&oidcPrivKeyWrong.PublicKey, idToken)
+	require.ErrorContains(t, err, "incorrect public key supplied when GQ signing jwt")
+}
+
+func TestGQ256SignJWTUnsupportedAlg(t *testing.T) {
+	oidcPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idToken, err := createOIDCTokenWithAlg(oidcPrivKey, "test", jwa.RS512)
+	require.NoError(t, err)
+
+	gqToken, err := GQ256SignJWT(&oidcPrivKey.PublicKey, idToken)
+	require.EqualError(t, err, "unsupported jwt alg for GQ signing: RS512")
+	require.Nil(t, gqToken)
+}
+
 func TestVerifyModifiedIdPayload(t *testing.T) {
 	oidcPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
@@ -185,8 +247,10 @@ func modifyTokenPayload(token []byte, audience string) ([]byte, error) {
 }
 
 func createOIDCToken(oidcPrivKey *rsa.PrivateKey, audience string) ([]byte, error) {
-	alg := jwa.RS256 // RSASSA-PKCS-v1.5 using SHA-256
+	return createOIDCTokenWithAlg(oidcPrivKey, audience, jwa.RS256) // RSASSA-PKCS-v1.5 using SHA-256
+}
 
+func createOIDCTokenWithAlg(oidcPrivKey *rsa.PrivateKey, audience string, alg jwa.SignatureAlgorithm) ([]byte, error) {
 	oidcHeader := jws.NewHeaders()
 	err := oidcHeader.Set(jws.AlgorithmKey, alg)
 	if err != nil {
@@ -238,3 +302,65 @@ func getClaimInProtected(claimKey string, token []byte) (any, bool, error) {
 	claimValue, ok := headers.Get(claimKey)
 	return claimValue, ok, nil
 }
+
+func TestGQ256SignJWTContext(t *testing.T) {
+	oidcPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oidcPubKey := &oidcPrivKey.PublicKey
+
+	idToken, err := createOIDCToken(oidcPrivKey, "test")
+	require.NoError(t, err)
+
+	t.Run("progress", func(t *testing.T) {
+		steps := []int{}
+		totals := map[int]bool{}
+		gqToken, err := GQ256SignJWTContext(context.Background(), oidcPubKey, idToken,
+			WithProgress(func(done, total int) {
+				steps = append(steps, done)
+				totals[total] = true
+			}))
+		require.NoError(t, err)
+
+		ok, err := GQ256VerifyJWT(oidcPubKey, gqToken)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		require.Len(t, totals, 1)
+		for total := range totals {
+			require.Len(t, steps, total)
+		}
+		for i, done := range steps {
+			require.Equal(t, i+1, done)
+		}
+	})
+
+	t.Run("already cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := GQ256SignJWTContext(ctx, oidcPubKey, idToken)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("cancelled between rounds", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		steps := 0
+		_, err := GQ256SignJWTContext(ctx, oidcPubKey, idToken,
+			WithProgress(func(done, total int) {
+				steps = done
+				if done == 3 {
+					cancel()
+				}
+			}))
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 3, steps)
+	})
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		_, err := GQ256SignJWTContext(ctx, oidcPubKey, idToken)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
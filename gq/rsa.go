@@ -17,8 +17,10 @@
 package gq
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/sha256"
+	"errors"
 )
 
 // Hardcoded padding prefix for SHA-256 from https://github.com/golang/go/blob/eca5a97340e6b475268a522012f30e8e25bb8b8f/src/crypto/rsa/pkcs1v15.go#L268
@@ -43,3 +45,94 @@ var encodePKCS1v15 = func(k int, data []byte) []byte {
 	copy(em[k-hashLen:k], hashed[:])
 	return em
 }
+
+// verifyPSS checks that em is a valid EMSA-PSS encoding of the SHA-256 digest
+// mHash, for a modulus of emBits+1 bits. The salt length is detected
+// automatically as in [crypto/rsa.PSSSaltLengthAuto].
+//
+// Adapted from emsaPSSVerify in the go stdlib, see [crypto/rsa.VerifyPSS].
+//
+// https://github.com/golang/go/blob/eca5a97340e6b475268a522012f30e8e25bb8b8f/src/crypto/rsa/pss.go#L96-L197
+func verifyPSS(mHash, em []byte, emBits int) error {
+	hashLen := crypto.SHA256.Size()
+	if hashLen != len(mHash) {
+		return errPSSVerification
+	}
+
+	emLen := bytesForBits(emBits)
+	// If the modulus is one bit longer than a multiple of eight, em will
+	// have a leading zero byte that is not part of the encoding.
+	if len(em) == emLen+1 {
+		if em[0] != 0 {
+			return errPSSVerification
+		}
+		em = em[1:]
+	}
+	if len(em) != emLen || emLen < hashLen+2 {
+		return errPSSVerification
+	}
+
+	// EM = maskedDB || H || 0xbc
+	if em[emLen-1] != 0xbc {
+		return errPSSVerification
+	}
+	db := make([]byte, emLen-hashLen-1)
+	copy(db, em[:emLen-hashLen-1])
+	h := em[emLen-hashLen-1 : emLen-1]
+
+	// The leftmost 8 * emLen - emBits bits of maskedDB must be zero.
+	bitMask := byte(0xff >> (8*emLen - emBits))
+	if db[0] & ^bitMask != 0 {
+		return errPSSVerification
+	}
+
+	// dbMask = MGF1(H, emLen - hLen - 1), DB = maskedDB XOR dbMask
+	mgf1XOR(db, h)
+	db[0] &= bitMask
+
+	// DB = PS || 0x01 || salt, where PS is all zeros
+	psLen := 0
+	for psLen < len(db) && db[psLen] == 0 {
+		psLen++
+	}
+	if psLen == len(db) || db[psLen] != 0x01 {
+		return errPSSVerification
+	}
+	salt := db[psLen+1:]
+
+	// M' = (0x)00 00 00 00 00 00 00 00 || mHash || salt, H' = Hash(M')
+	var prefix [8]byte
+	hPrime := sha256.New()
+	hPrime.Write(prefix[:])
+	hPrime.Write(mHash)
+	hPrime.Write(salt)
+	if !bytes.Equal(h, hPrime.Sum(nil)) {
+		return errPSSVerification
+	}
+	return nil
+}
+
+var errPSSVerification = errors.New("invalid PSS encoding")
+
+// mgf1XOR XORs the bytes in out with a mask generated from seed using MGF1
+// with SHA-256, as specified in PKCS #1 v2.1.
+func mgf1XOR(out []byte, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for done < len(out) {
+		h := sha256.New()
+		h.Write(seed)
+		h.Write(counter[:])
+		digest := h.Sum(nil)
+		for i := 0; i < len(digest) && done < len(out); i++ {
+			out[done] ^= digest[i]
+			done++
+		}
+		for i := 3; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
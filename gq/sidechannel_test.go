@@ -0,0 +1,128 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build sidechannel
+
+package gq
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math"
+	mathrand "math/rand"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests measure whether the running time of GQ signing and verification
+// depends on secret or adversarially chosen inputs. They are slow and
+// sensitive to machine noise, so they only run with the sidechannel build tag:
+//
+//	go test -tags sidechannel -run SideChannel ./gq
+
+const sideChannelSamples = 2000
+
+func sideChannelClasses(n int) []byte {
+	classes := make([]byte, n)
+	for i := range classes {
+		classes[i] = byte(mathrand.Intn(2))
+	}
+	return classes
+}
+
+func sideChannelSignerVerifier(t *testing.T) (*signerVerifier, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	sv, err := New256SignerVerifier(&key.PublicKey)
+	require.NoError(t, err)
+	return sv.(*signerVerifier), key
+}
+
+func requireIndistinguishable(t *testing.T, samples timingSamples) {
+	tStat := welchT(samples.crop(0.9).fixed, samples.crop(0.9).random)
+	t.Logf("welch t-statistic: %f (fixed=%d, random=%d)", tStat, len(samples.fixed), len(samples.random))
+	require.Less(t, math.Abs(tStat), timingThreshold, "timing of fixed and random inputs is distinguishable")
+}
+
+// TestSideChannelSignPrivate checks that signing time does not depend on the
+// GQ private number. The fixed class uses a private number with very low
+// Hamming weight, the random class uses a uniformly random private number.
+func TestSideChannelSignPrivate(t *testing.T) {
+	sv, _ := sideChannelSignerVerifier(t)
+	message := []byte("side channel test message")
+
+	fixedPrivate := make([]byte, sv.nBytes)
+	fixedPrivate[len(fixedPrivate)-1] = 1
+
+	samples := measureTiming(sideChannelClasses(sideChannelSamples), func(class byte, start func()) {
+		private := fixedPrivate
+		if class == 1 {
+			n, err := randomNumbers(1, sv.n)
+			require.NoError(t, err)
+			private = n[0].Bytes(sv.n)
+		}
+		start()
+		_, err := sv.Sign(private, message)
+		require.NoError(t, err)
+	})
+	requireIndistinguishable(t, samples)
+}
+
+// TestSideChannelVerifyProof checks that verification time does not depend on
+// whether an adversarially chosen proof is valid. The fixed class verifies a
+// freshly signed valid proof, the random class verifies a well-formed proof
+// made of random numbers. Both classes use fresh values each iteration so the
+// only difference between them is whether the proof verifies.
+func TestSideChannelVerifyProof(t *testing.T) {
+	sv, key := sideChannelSignerVerifier(t)
+	message := []byte("side channel test message")
+
+	identity := []byte("side channel identity")
+	digest := sha256.Sum256(identity)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	private, err := sv.modInverse(util.NewLockedBuffer(sig))
+	require.NoError(t, err)
+	defer private.Destroy()
+	samples := measureTiming(sideChannelClasses(sideChannelSamples), func(class byte, start func()) {
+		var proof []byte
+		if class == 0 {
+			var err error
+			proof, err = sv.Sign(private.Bytes(), message)
+			require.NoError(t, err)
+		} else {
+			R, err := randomBytes(rand.Reader, sv.t*sv.vBytes)
+			require.NoError(t, err)
+			// Draw S_i < n so the proof is not rejected by the range check
+			// before the expensive part of verification runs.
+			Ss, err := randomNumbers(sv.t, sv.n)
+			require.NoError(t, err)
+			var S []byte
+			for _, S_i := range Ss {
+				S = append(S, S_i.Bytes(sv.n)...)
+			}
+			proof = encodeProof(R, S)
+		}
+		start()
+		ok := sv.Verify(proof, identity, message)
+		require.Equal(t, class == 0, ok)
+	})
+	requireIndistinguishable(t, samples)
+}
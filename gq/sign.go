@@ -23,7 +23,7 @@ import (
 	"math/big"
 
 	"filippo.io/bigmod"
-	"github.com/awnumar/memguard"
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/util"
 )
@@ -32,6 +32,30 @@ import (
 //
 // Comments throughout refer to stages as specified in the ISO/IEC 14888-2 standard.
 func (sv *signerVerifier) Sign(private []byte, message []byte) ([]byte, error) {
+	return sv.sign(&OptsStruct{}, private, message)
+}
+
+// signSteps is the number of steps reported to a ProgressFunc when signing
+// a JWT: the GQ1 private number is computed in one step and then each of
+// the t rounds of stage 2 and of stage 4 is a step.
+func (sv *signerVerifier) signSteps() int {
+	return 1 + 2*sv.t
+}
+
+// step checks whether signing should continue and reports progress
+func (o *OptsStruct) step(done int, total int) error {
+	if o.ctx != nil {
+		if err := o.ctx.Err(); err != nil {
+			return fmt.Errorf("GQ signing aborted: %w", err)
+		}
+	}
+	if o.progress != nil {
+		o.progress(done, total)
+	}
+	return nil
+}
+
+func (sv *signerVerifier) sign(options *OptsStruct, private []byte, message []byte) ([]byte, error) {
 	n, v, t := sv.n, sv.v, sv.t
 	vBytes := sv.vBytes
 
@@ -52,10 +76,14 @@ func (sv *signerVerifier) Sign(private []byte, message []byte) ([]byte, error) {
 	// Stage 2 - calculate test number W
 	// for i from 1 to t, compute W_i <- r_i^v mod n
 	// combine to form W
+	total := sv.signSteps()
 	var W []byte
 	for i := 0; i < t; i++ {
 		W_i := bigmod.NewNat().Exp(r[i], v.Bytes(), n)
 		W = append(W, W_i.Bytes(n)...)
+		if err := options.step(2+i, total); err != nil {
+			return nil, err
+		}
 	}
 
 	// Stage 3 - calculate question number R
@@ -82,6 +110,9 @@ func (sv *signerVerifier) Sign(private []byte, message []byte) ([]byte, error) {
 		S_i := bigmod.NewNat().Exp(Q, Rs[i].Bytes(n), n)
 		S_i.Mul(r[i], n)
 		S = append(S, S_i.Bytes(n)...)
+		if err := options.step(2+t+i, total); err != nil {
+			return nil, err
+		}
 	}
 
 	// proof is combination of R and S
@@ -94,7 +125,7 @@ func (sv *signerVerifier) SignJWT(jwt []byte, opts ...Opts) ([]byte, error) {
 		applyOpt(options)
 	}
 	// Ensure that someone doesn't use a reserved protected header claim name
-	for _, reserved := range []string{"alg", "typ", "kid"} {
+	for _, reserved := range []string{"alg", "typ", "kid", PSSEncodedMessageKey} {
 		if _, ok := options.extraClaims[reserved]; ok {
 			return nil, fmt.Errorf("use of reserved header name, %s, in additional headers", reserved)
 		}
@@ -127,29 +158,47 @@ func (sv *signerVerifier) SignJWT(jwt []byte, opts ...Opts) ([]byte, error) {
 		}
 	}
 
-	headersJSON, err := json.Marshal(headers)
+	// When jwt is parsed it's split into base64-encoded bytes, but
+	// we need the raw signature to calculate mod inverse
+	decodedSig, err := util.Base64DecodeForJWT(signature)
 	if err != nil {
 		return nil, err
 	}
 
-	headersEnc := util.Base64EncodeForJWT(headersJSON)
+	origAlg, err := originalAlgorithm(origHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if origAlg == jwa.PS256 {
+		// The verifier can't recompute a randomized PSS encoding, so we
+		// include the encoded message (the RSA signature raised to v) in
+		// the headers. This is public information as anyone holding the
+		// original JWT could compute it.
+		em := sv.encodedMessage(decodedSig)
+		if err = headers.Set(PSSEncodedMessageKey, string(util.Base64EncodeForJWT(em))); err != nil {
+			return nil, err
+		}
+	}
 
-	// When jwt is parsed it's split into base64-encoded bytes, but
-	// we need the raw signature to calculate mod inverse
-	decodedSig, err := util.Base64DecodeForJWT(signature)
+	headersJSON, err := json.Marshal(headers)
 	if err != nil {
 		return nil, err
 	}
 
+	headersEnc := util.Base64EncodeForJWT(headersJSON)
+
 	// GQ1 private number (Q) is inverse of RSA signature mod n
-	private, err := sv.modInverse(memguard.NewBufferFromBytes(decodedSig))
+	private, err := sv.modInverse(util.NewLockedBuffer(decodedSig))
 	if err != nil {
 		return nil, err
 	}
 
 	defer private.Destroy()
+	if err := options.step(1, sv.signSteps()); err != nil {
+		return nil, err
+	}
 
-	gqSig, err := sv.Sign(private.Bytes(), signingPayload)
+	gqSig, err := sv.sign(options, private.Bytes(), signingPayload)
 	if err != nil {
 		return nil, err
 	}
@@ -164,7 +213,7 @@ func (sv *signerVerifier) SignJWT(jwt []byte, opts ...Opts) ([]byte, error) {
 //
 // All operations involving the secret value are performed either with constant-
 // time methods or with blinding (if sv has a source of randomness)
-func (sv *signerVerifier) modInverse(b *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+func (sv *signerVerifier) modInverse(b *util.LockedBuffer) (*util.LockedBuffer, error) {
 	x, err := bigmod.NewNat().SetBytes(b.Bytes(), sv.n)
 	if err != nil {
 		return nil, err
@@ -231,7 +280,15 @@ func (sv *signerVerifier) modInverse(b *memguard.LockedBuffer) (*memguard.Locked
 	ret := make([]byte, len(b.Bytes()))
 	defer b.Destroy()
 
-	return memguard.NewBufferFromBytes(mFinal.FillBytes(ret)), nil
+	return util.NewLockedBuffer(mFinal.FillBytes(ret)), nil
+}
+
+// encodedMessage computes sig^v mod n, i.e. the encoded message an RSA
+// signature sig was created over.
+func (sv *signerVerifier) encodedMessage(sig []byte) []byte {
+	nInt := modAsInt(sv.n)
+	em := new(big.Int).Exp(new(big.Int).SetBytes(sig), sv.v, nInt)
+	return em.FillBytes(make([]byte, sv.nBytes))
 }
 
 func encodeProof(R, S []byte) []byte {
@@ -0,0 +1,113 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gq
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// timingThreshold is the |t| value above which two timing distributions are
+// considered distinguishable. 4.5 is the threshold used by dudect.
+const timingThreshold = 4.5
+
+// timingSamples collects execution times of two input classes, interleaving
+// the classes in a random order to avoid drift biasing one class.
+type timingSamples struct {
+	fixed  []float64
+	random []float64
+}
+
+// measureTiming runs op once per entry in classes. op is given the class
+// (0 = fixed, 1 = random) and must prepare its inputs before calling start,
+// so input generation is not timed.
+func measureTiming(classes []byte, op func(class byte, start func())) timingSamples {
+	var samples timingSamples
+	for _, class := range classes {
+		var begin time.Time
+		op(class, func() { begin = time.Now() })
+		elapsed := float64(time.Since(begin).Nanoseconds())
+		if class == 0 {
+			samples.fixed = append(samples.fixed, elapsed)
+		} else {
+			samples.random = append(samples.random, elapsed)
+		}
+	}
+	return samples
+}
+
+// crop discards measurements above the given percentile of the combined
+// samples. Outliers caused by scheduling and GC otherwise dominate the test.
+func (s timingSamples) crop(percentile float64) timingSamples {
+	all := append(append([]float64{}, s.fixed...), s.random...)
+	sort.Float64s(all)
+	limit := all[int(float64(len(all)-1)*percentile)]
+
+	filter := func(xs []float64) []float64 {
+		var out []float64
+		for _, x := range xs {
+			if x <= limit {
+				out = append(out, x)
+			}
+		}
+		return out
+	}
+	return timingSamples{fixed: filter(s.fixed), random: filter(s.random)}
+}
+
+// welchT computes Welch's t-statistic for two independent samples.
+func welchT(a, b []float64) float64 {
+	meanA, varA := meanVariance(a)
+	meanB, varB := meanVariance(b)
+	denom := math.Sqrt(varA/float64(len(a)) + varB/float64(len(b)))
+	if denom == 0 {
+		return 0
+	}
+	return (meanA - meanB) / denom
+}
+
+func meanVariance(xs []float64) (float64, float64) {
+	var mean float64
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+
+	var variance float64
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	variance /= float64(len(xs) - 1)
+	return mean, variance
+}
+
+func TestWelchT(t *testing.T) {
+	same := []float64{10, 11, 9, 10, 11, 9, 10, 10}
+	require.InDelta(t, 0, welchT(same, same), 1e-9)
+
+	slow := []float64{20, 21, 19, 20, 21, 19, 20, 20}
+	require.Greater(t, math.Abs(welchT(same, slow)), timingThreshold)
+
+	samples := timingSamples{fixed: []float64{1, 2, 3, 1000}, random: []float64{1, 2, 3, 4}}
+	cropped := samples.crop(0.9)
+	require.Equal(t, []float64{1, 2, 3}, cropped.fixed)
+	require.Equal(t, []float64{1, 2, 3, 4}, cropped.random)
+}
@@ -18,9 +18,11 @@ package gq
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"math/big"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/util"
 )
@@ -29,6 +31,15 @@ import (
 //
 // Comments throughout refer to stages as specified in the ISO/IEC 14888-2 standard.
 func (sv *signerVerifier) Verify(proof []byte, identity []byte, message []byte) bool {
+	// Stage 1 - create public number G
+	// Verify uses PKCS#1 v1.5 padding as the format mechanism
+	return sv.verifyPublicNumber(proof, encodePKCS1v15(sv.nBytes, identity), message)
+}
+
+// verifyPublicNumber verifies a GQ1 signature over a message, using an already
+// formatted public number G. This lets callers support format mechanisms,
+// such as PSS, where G can't be derived from the identity alone.
+func (sv *signerVerifier) verifyPublicNumber(proof []byte, publicNumber []byte, message []byte) bool {
 	n, v, t := modAsInt(sv.n), sv.v, sv.t
 	nBytes, vBytes := sv.nBytes, sv.vBytes
 
@@ -40,10 +51,11 @@ func (sv *signerVerifier) Verify(proof []byte, identity []byte, message []byte)
 		return false
 	}
 
-	// Stage 1 - create public number G
-	// currently this hardcoded to use PKCS#1 v1.5 padding as the format mechanism
-	paddedIdentity := encodePKCS1v15(nBytes, identity)
-	G := new(big.Int).SetBytes(paddedIdentity)
+	G := new(big.Int).SetBytes(publicNumber)
+	// reject if G = 0 or >= n
+	if G.Sign() == 0 || G.Cmp(n) != -1 {
+		return false
+	}
 
 	// Stage 2 - parse signature numbers and recalculate test number W*
 	// split R into t strings, each consisting of vBytes bytes
@@ -103,7 +115,42 @@ func (sv *signerVerifier) VerifyJWT(jwt []byte) bool {
 
 	signingPayload := util.JoinJWTSegments(origHeaders, payload)
 
-	return sv.Verify(signature, signingPayload, signingPayload)
+	origAlg, err := originalAlgorithm(origHeaders)
+	if err != nil {
+		return false
+	}
+	if origAlg != jwa.PS256 {
+		return sv.Verify(signature, signingPayload, signingPayload)
+	}
+
+	// For PS256 the public number G is the PSS encoded message carried in
+	// the headers. Check it is a valid encoding of the signing payload
+	// before using it.
+	em, err := pssEncodedMessage(jwt)
+	if err != nil {
+		return false
+	}
+	mHash := sha256.Sum256(signingPayload)
+	if err := verifyPSS(mHash[:], em, sv.n.BitLen()-1); err != nil {
+		return false
+	}
+	return sv.verifyPublicNumber(signature, em, signingPayload)
+}
+
+func pssEncodedMessage(jwt []byte) ([]byte, error) {
+	token, err := jws.Parse(jwt)
+	if err != nil {
+		return nil, err
+	}
+	emB64, ok := token.Signatures()[0].ProtectedHeaders().Get(PSSEncodedMessageKey)
+	if !ok {
+		return nil, fmt.Errorf("missing %s header", PSSEncodedMessageKey)
+	}
+	emStr, ok := emB64.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s header must be a string", PSSEncodedMessageKey)
+	}
+	return util.Base64DecodeForJWT([]byte(emStr))
 }
 
 func (sv *signerVerifier) decodeProof(s []byte) (R, S []byte, err error) {
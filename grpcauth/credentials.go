@@ -0,0 +1,96 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package grpcauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"google.golang.org/grpc/credentials"
+)
+
+// PerRPCCredentials attach the PK Token and a signature of the call, made
+// with Signer, to every call. Use them with grpc.WithPerRPCCredentials.
+type PerRPCCredentials struct {
+	// PKToken returns the PK Token to send, e.g. the Current method of a
+	// client.Refresher
+	PKToken func() (*pktoken.PKToken, error)
+	// Signer must hold the PK Token's client key, e.g. the OpkClient's
+	// signer
+	Signer crypto.Signer
+	// AllowInsecure allows calls on connections without TLS, whose
+	// signatures can't be bound to the connection. Only use it for
+	// connections that are otherwise secured, e.g. over a Unix socket.
+	AllowInsecure bool
+}
+
+var _ credentials.PerRPCCredentials = (*PerRPCCredentials)(nil)
+
+func (c *PerRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	ri, ok := credentials.RequestInfoFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("no request info in context")
+	}
+	if len(uri) == 0 {
+		return nil, fmt.Errorf("no request URI")
+	}
+	u, err := url.Parse(uri[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed request URI: %w", err)
+	}
+	binding, err := channelBinding(ri.AuthInfo)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	pkt, err := c.PKToken()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := pkt.NewRequestSignature(pktoken.RequestClaims{
+		Method:         ri.Method,
+		Host:           u.Host,
+		IssuedAt:       time.Now().Unix(),
+		Nonce:          base64.RawURLEncoding.EncodeToString(nonce),
+		ChannelBinding: binding,
+	}, c.Signer)
+	if err != nil {
+		return nil, err
+	}
+	pktCom, err := pkt.Compact()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		PKTokenKey:   string(pktCom),
+		SignatureKey: string(sig),
+	}, nil
+}
+
+func (c *PerRPCCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
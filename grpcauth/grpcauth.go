@@ -0,0 +1,249 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package grpcauth authenticates gRPC calls with PK Tokens. Clients attach
+// PerRPCCredentials, which send the compact PK Token and a signature of
+// the call made with the PK Token's client key in the call's metadata.
+// On TLS connections the signature is bound to the connection with TLS
+// exporter keying material, so it can't be used on any other connection.
+// Servers install the interceptors of an Interceptor, which verify both
+// and make the caller's Identity available to handlers with FromContext.
+package grpcauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// PKTokenKey is the metadata key carrying the compact PK Token of the
+	// client
+	PKTokenKey = "openpubkey-pkt"
+	// SignatureKey is the metadata key carrying the call signature made
+	// with the PK Token's client key
+	SignatureKey = "openpubkey-signature"
+
+	// DefaultMaxAge is how long after it is made a call signature is
+	// accepted
+	DefaultMaxAge = time.Minute
+
+	// exporterLabel is the TLS exporter label the channel binding is
+	// derived with, see RFC 5705
+	exporterLabel = "EXPORTER-openpubkey-grpc"
+)
+
+// Identity is the authenticated client of a call
+type Identity struct {
+	// PKToken is the verified PK Token of the client
+	PKToken *pktoken.PKToken
+	// Claims are the claims of the PK Token's ID Token
+	Claims *oidc.OidcClaims
+}
+
+type identityKey struct{}
+
+// FromContext returns the identity an Interceptor authenticated the call
+// with, given the context passed to the handler
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// Interceptor rejects calls without a valid PK Token and call signature
+// with codes.Unauthenticated
+type Interceptor struct {
+	// Verifier fully verifies PK Tokens, configure it with the OpenID
+	// Providers whose users may make calls
+	Verifier *verifier.Verifier
+	// Checks are further checks PK Tokens must pass, e.g. GQOnly
+	Checks []verifier.Check
+	// MaxAge defaults to DefaultMaxAge
+	MaxAge time.Duration
+	// Replays remembers the call signatures used, by client key and nonce.
+	// Share a UseCounter between the instances of a service so a signature
+	// can't be replayed against another instance.
+	Replays verifier.UseCounter
+}
+
+// New returns an Interceptor accepting PK Tokens that v verifies and that
+// pass the checks, remembering used call signatures in memory
+func New(v *verifier.Verifier, checks ...verifier.Check) *Interceptor {
+	replays := verifier.NewMemoryUseCounter()
+	replays.Retention = 2 * DefaultMaxAge
+	return &Interceptor{
+		Verifier: v,
+		Checks:   checks,
+		MaxAge:   DefaultMaxAge,
+		Replays:  replays,
+	}
+}
+
+// Unary returns a server interceptor authenticating unary calls, install
+// it with grpc.ChainUnaryInterceptor
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		identity, err := i.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "unauthenticated: %v", err)
+		}
+		return handler(context.WithValue(ctx, identityKey{}, identity), req)
+	}
+}
+
+// Stream returns a server interceptor authenticating streaming calls,
+// install it with grpc.ChainStreamInterceptor
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		identity, err := i.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "unauthenticated: %v", err)
+		}
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ss.Context(), identityKey{}, identity),
+		})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (i *Interceptor) authenticate(ctx context.Context, method string) (*Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	pktCom, sig := firstValue(md, PKTokenKey), firstValue(md, SignatureKey)
+	if pktCom == "" || sig == "" {
+		return nil, fmt.Errorf("missing %s or %s metadata", PKTokenKey, SignatureKey)
+	}
+	pkt, err := pktoken.NewFromCompact([]byte(pktCom))
+	if err != nil {
+		return nil, fmt.Errorf("malformed PK Token: %w", err)
+	}
+	// The PK Token is verified last as verifying it uses up a use of
+	// limited-use PK Tokens and may fetch the OP's JWKS, which calls with
+	// a forged or stale signature must not be able to trigger
+	claims, err := pkt.VerifyRequestSignature([]byte(sig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify call signature: %w", err)
+	}
+	if claims.Method != method || claims.Host != firstValue(md, ":authority") {
+		return nil, fmt.Errorf("call signature is for another call")
+	}
+	maxAge := i.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	issuedAt, now := time.Unix(claims.IssuedAt, 0), time.Now()
+	skew := i.Verifier.ClockSkew()
+	if skew.NotYetValid(issuedAt, now) || skew.Expired(issuedAt.Add(maxAge), now) {
+		return nil, fmt.Errorf("call signature has expired")
+	}
+
+	var authInfo credentials.AuthInfo
+	if p, ok := peer.FromContext(ctx); ok {
+		authInfo = p.AuthInfo
+	}
+	binding, err := channelBinding(authInfo)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ChannelBinding != binding {
+		return nil, fmt.Errorf("call signature is for another connection")
+	}
+
+	// Checked after the call so that failed calls don't use up the
+	// signature. Signatures are remembered by their client key and nonce
+	// rather than their bytes, which can be re-encoded and still verify.
+	replayKey, err := replayKey(pkt, claims.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if uses, err := i.Replays.Use(ctx, "call:"+replayKey); err != nil {
+		return nil, err
+	} else if uses > 1 {
+		return nil, fmt.Errorf("call signature has already been used")
+	}
+
+	if err := i.Verifier.VerifyPKToken(ctx, pkt, i.Checks...); err != nil {
+		return nil, fmt.Errorf("failed to verify PK Token: %w", err)
+	}
+
+	identity := &Identity{PKToken: pkt, Claims: new(oidc.OidcClaims)}
+	if err := json.Unmarshal(pkt.Payload, identity.Claims); err != nil {
+		return nil, fmt.Errorf("malformed ID Token claims: %w", err)
+	}
+	return identity, nil
+}
+
+// channelBinding returns the base64url encoded TLS exporter keying
+// material of a connection, or "" if the connection doesn't use TLS
+func channelBinding(authInfo credentials.AuthInfo) (string, error) {
+	tlsInfo, ok := authInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", nil
+	}
+	ekm, err := tlsInfo.State.ExportKeyingMaterial(exporterLabel, nil, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to export TLS keying material: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(ekm), nil
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// replayKey identifies a call signature by the thumbprint of the PK
+// Token's client key and the signature's nonce
+func replayKey(pkt *pktoken.PKToken, nonce string) (string, error) {
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return "", err
+	}
+	jkt, err := cic.PublicKey().Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(jkt) + ":" + hash([]byte(nonce)), nil
+}
+
+func hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
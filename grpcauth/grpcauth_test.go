@@ -0,0 +1,255 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package grpcauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/tls"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/mtls"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestInterceptor(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	// serve starts a health server, recording the subject of the last
+	// authenticated caller, and returns a connection to it
+	var subject string
+	serve := func(serverCreds, clientCreds credentials.TransportCredentials, opts ...grpc.DialOption) *grpc.ClientConn {
+		interceptor := New(v)
+		record := func(ctx context.Context) {
+			identity, ok := FromContext(ctx)
+			require.True(t, ok)
+			subject = identity.Claims.Subject
+		}
+		server := grpc.NewServer(
+			grpc.Creds(serverCreds),
+			grpc.ChainUnaryInterceptor(interceptor.Unary(), func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				record(ctx)
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(interceptor.Stream(), func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				record(ss.Context())
+				return handler(srv, ss)
+			}),
+		)
+		healthpb.RegisterHealthServer(server, health.NewServer())
+		lis := bufconn.Listen(1 << 20)
+		go func() { _ = server.Serve(lis) }()
+		t.Cleanup(server.Stop)
+
+		conn, err := grpc.NewClient("passthrough:///bufnet", append([]grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(clientCreds),
+		}, opts...)...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	certificate, err := mtls.Certificate(pkt, signer)
+	require.NoError(t, err)
+	serverTLS := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{*certificate}})
+	clientTLS := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	tlsConn := serve(serverTLS, clientTLS,
+		grpc.WithPerRPCCredentials(&PerRPCCredentials{PKToken: opkClient.GetPKToken, Signer: signer}),
+	)
+	healthClient := healthpb.NewHealthClient(tlsConn)
+	_, err = healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "me", subject)
+
+	subject = ""
+	watch, err := healthClient.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "me", subject)
+
+	// Calls without credentials are rejected
+	plainConn := serve(insecure.NewCredentials(), insecure.NewCredentials())
+	_, err = healthpb.NewHealthClient(plainConn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// A signature made for one call is accepted only once, and only on
+	// the connection it is bound to
+	sig, err := pkt.NewRequestSignature(pktoken.RequestClaims{
+		Method:   "/grpc.health.v1.Health/Check",
+		Host:     "bufnet",
+		IssuedAt: time.Now().Unix(),
+		Nonce:    base64.RawURLEncoding.EncodeToString([]byte("nonce")),
+	}, signer)
+	require.NoError(t, err)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	signedCtx := metadata.AppendToOutgoingContext(ctx, PKTokenKey, string(pktCom), SignatureKey, string(sig))
+
+	_, err = healthpb.NewHealthClient(serve(serverTLS, clientTLS)).Check(signedCtx, &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.ErrorContains(t, err, "another connection")
+
+	plainClient := healthpb.NewHealthClient(plainConn)
+	_, err = plainClient.Check(signedCtx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = plainClient.Check(signedCtx, &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.ErrorContains(t, err, "already been used")
+
+	// even when the signature is re-encoded into different bytes that
+	// still verify
+	reencodedCtx := metadata.AppendToOutgoingContext(ctx, PKTokenKey, string(pktCom), SignatureKey, malleate(t, string(sig)))
+	_, err = plainClient.Check(reencodedCtx, &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.ErrorContains(t, err, "already been used")
+
+	// Nor for another method
+	watch, err = plainClient.Watch(signedCtx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = watch.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.ErrorContains(t, err, "another call")
+
+	// PerRPCCredentials refuse to send the PK Token without TLS unless
+	// allowed to
+	creds := &PerRPCCredentials{PKToken: opkClient.GetPKToken, Signer: signer}
+	_, err = grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(creds),
+	)
+	require.ErrorContains(t, err, "transport level security")
+	creds.AllowInsecure = true
+	_, err = healthpb.NewHealthClient(serve(insecure.NewCredentials(), insecure.NewCredentials(), grpc.WithPerRPCCredentials(creds))).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
+
+// countingUseCounter counts the uses the verifier records
+type countingUseCounter struct {
+	*verifier.MemoryUseCounter
+	calls int
+}
+
+func (c *countingUseCounter) Use(ctx context.Context, key string) (int, error) {
+	c.calls++
+	return c.MemoryUseCounter.Use(ctx, key)
+}
+
+func TestForgedCallKeepsUses(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx, client.WithMaxUses(1))
+	require.NoError(t, err)
+	counter := &countingUseCounter{MemoryUseCounter: verifier.NewMemoryUseCounter()}
+	v, err := verifier.New(op, verifier.WithUseCounter(counter))
+	require.NoError(t, err)
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(New(v).Unary()))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	check := func(method string, key crypto.Signer) error {
+		sig, err := pkt.NewRequestSignature(pktoken.RequestClaims{
+			Method:   method,
+			Host:     "bufnet",
+			IssuedAt: time.Now().Unix(),
+			Nonce:    base64.RawURLEncoding.EncodeToString([]byte(method)),
+		}, key)
+		require.NoError(t, err)
+		_, err = healthClient.Check(metadata.AppendToOutgoingContext(ctx, PKTokenKey, string(pktCom), SignatureKey, string(sig)), &healthpb.HealthCheckRequest{})
+		return err
+	}
+
+	// A captured PK Token with a signature by another key
+	attacker, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	err = check("/grpc.health.v1.Health/Check", attacker)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	// or a signature for another call
+	err = check("/grpc.health.v1.Health/Watch", signer)
+	require.ErrorContains(t, err, "another call")
+	require.Zero(t, counter.calls)
+
+	require.NoError(t, check("/grpc.health.v1.Health/Check", signer))
+	require.Equal(t, 1, counter.calls)
+}
+
+// malleate returns an ES256 signature with s replaced by n - s, which
+// verifies for the same claims
+func malleate(t *testing.T, sig string) string {
+	parts := strings.Split(sig, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, raw, 64)
+	s := new(big.Int).SetBytes(raw[32:])
+	s.Sub(elliptic.P256().Params().N, s)
+	s.FillBytes(raw[32:])
+	parts[2] = base64.RawURLEncoding.EncodeToString(raw)
+	return strings.Join(parts, ".")
+}
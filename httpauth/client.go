@@ -0,0 +1,99 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// SignRequest adds the compact PK Token and a signature of the request,
+// made with signer, to the request's headers. signer must hold the PK
+// Token's client key, e.g. the OpkClient's signer. The request body is
+// read to hash it and replaced.
+func SignRequest(r *http.Request, pkt *pktoken.PKToken, signer crypto.Signer) error {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	sig, err := pkt.NewRequestSignature(pktoken.RequestClaims{
+		Method:   r.Method,
+		Host:     host,
+		Path:     r.URL.RequestURI(),
+		BodyHash: hashBody(body),
+		IssuedAt: time.Now().Unix(),
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+	}, signer)
+	if err != nil {
+		return err
+	}
+	pktCom, err := pkt.Compact()
+	if err != nil {
+		return err
+	}
+	r.Header.Set(PKTokenHeader, string(pktCom))
+	r.Header.Set(SignatureHeader, string(sig))
+	return nil
+}
+
+// Transport signs every request with SignRequest before sending it with
+// Base
+type Transport struct {
+	// PKToken returns the PK Token to send, e.g. the Current method of a
+	// client.Refresher
+	PKToken func() (*pktoken.PKToken, error)
+	Signer  crypto.Signer
+	// Base defaults to http.DefaultTransport
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	r = r.Clone(r.Context())
+	pkt, err := t.PKToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := SignRequest(r, pkt, t.Signer); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package httpauth authenticates HTTP requests with PK Tokens, so services
+// can accept them directly rather than minting their own tokens. Clients
+// send their compact PK Token in the PKTokenHeader and a request signature
+// in the SignatureHeader, see SignRequest. The signature, made with the
+// PK Token's client key, covers the method, host, path, query and body of
+// the request and is only accepted once and for MaxAge, so a PK Token
+// seen in transit or in logs can't be used to make other requests.
+package httpauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+const (
+	// PKTokenHeader carries the compact PK Token of the client
+	PKTokenHeader = "OpenPubkey-PKT"
+	// SignatureHeader carries the request signature made with the PK
+	// Token's client key
+	SignatureHeader = "OpenPubkey-Signature"
+
+	// DefaultMaxAge is how long after it is made a request signature is
+	// accepted
+	DefaultMaxAge = time.Minute
+	// DefaultMaxBodySize is the largest request body that is hashed to
+	// check the signature
+	DefaultMaxBodySize = 10 << 20
+)
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	// PKToken is the verified PK Token of the client
+	PKToken *pktoken.PKToken
+	// Claims are the claims of the PK Token's ID Token
+	Claims *oidc.OidcClaims
+}
+
+type identityKey struct{}
+
+// FromContext returns the identity Middleware authenticated the request
+// with, given the request's context
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// Middleware rejects requests without a valid PK Token and request
+// signature with 401 Unauthorized
+type Middleware struct {
+	// Verifier fully verifies PK Tokens, configure it with the OpenID
+	// Providers whose users may make requests
+	Verifier *verifier.Verifier
+	// Checks are further checks PK Tokens must pass, e.g. GQOnly
+	Checks []verifier.Check
+	// MaxAge defaults to DefaultMaxAge
+	MaxAge time.Duration
+	// MaxBodySize defaults to DefaultMaxBodySize
+	MaxBodySize int64
+	// Replays remembers the request signatures used, by client key and
+	// nonce. Share a UseCounter between the instances of a service so a
+	// signature can't be replayed against another instance.
+	Replays verifier.UseCounter
+}
+
+// New returns a Middleware accepting PK Tokens that v verifies and that
+// pass the checks, remembering used request signatures in memory
+func New(v *verifier.Verifier, checks ...verifier.Check) *Middleware {
+	replays := verifier.NewMemoryUseCounter()
+	replays.Retention = 2 * DefaultMaxAge
+	return &Middleware{
+		Verifier:    v,
+		Checks:      checks,
+		MaxAge:      DefaultMaxAge,
+		MaxBodySize: DefaultMaxBodySize,
+		Replays:     replays,
+	}
+}
+
+// Handler authenticates requests before passing them to next, with the
+// client's Identity in the request context
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := m.authenticate(r)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("unauthorized: %v", err), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+func (m *Middleware) authenticate(r *http.Request) (*Identity, error) {
+	pktCom, sig := r.Header.Get(PKTokenHeader), r.Header.Get(SignatureHeader)
+	if pktCom == "" || sig == "" {
+		return nil, fmt.Errorf("missing %s or %s header", PKTokenHeader, SignatureHeader)
+	}
+	pkt, err := pktoken.NewFromCompact([]byte(pktCom))
+	if err != nil {
+		return nil, fmt.Errorf("malformed PK Token: %w", err)
+	}
+	// The PK Token is verified last as verifying it uses up a use of
+	// limited-use PK Tokens and may fetch the OP's JWKS, which requests
+	// with a forged or stale signature must not be able to trigger
+	claims, err := pkt.VerifyRequestSignature([]byte(sig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify request signature: %w", err)
+	}
+	if claims.Method != r.Method || claims.Host != r.Host || claims.Path != r.URL.RequestURI() {
+		return nil, fmt.Errorf("request signature is for another request")
+	}
+	maxAge := m.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	issuedAt, now := time.Unix(claims.IssuedAt, 0), time.Now()
+	skew := m.Verifier.ClockSkew()
+	if skew.NotYetValid(issuedAt, now) || skew.Expired(issuedAt.Add(maxAge), now) {
+		return nil, fmt.Errorf("request signature has expired")
+	}
+
+	maxBodySize := m.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize)); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if claims.BodyHash != hashBody(body) {
+		return nil, fmt.Errorf("request signature is for another body")
+	}
+
+	// Checked after the request so that failed requests don't use up the
+	// signature. Signatures are remembered by their client key and nonce
+	// rather than their bytes, which can be re-encoded and still verify.
+	replayKey, err := replayKey(pkt, claims.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if uses, err := m.Replays.Use(r.Context(), "request:"+replayKey); err != nil {
+		return nil, err
+	} else if uses > 1 {
+		return nil, fmt.Errorf("request signature has already been used")
+	}
+
+	if err := m.Verifier.VerifyPKToken(r.Context(), pkt, m.Checks...); err != nil {
+		return nil, fmt.Errorf("failed to verify PK Token: %w", err)
+	}
+
+	identity := &Identity{PKToken: pkt, Claims: new(oidc.OidcClaims)}
+	if err := json.Unmarshal(pkt.Payload, identity.Claims); err != nil {
+		return nil, fmt.Errorf("malformed ID Token claims: %w", err)
+	}
+	return identity, nil
+}
+
+// replayKey identifies a request signature by the thumbprint of the PK
+// Token's client key and the signature's nonce
+func replayKey(pkt *pktoken.PKToken, nonce string) (string, error) {
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return "", err
+	}
+	jkt, err := cic.PublicKey().Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(jkt) + ":" + hashBody([]byte(nonce)), nil
+}
+
+func hashBody(body []byte) string {
+	hash := sha256.Sum256(body)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
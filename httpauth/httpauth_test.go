@@ -0,0 +1,204 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpauth
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(New(v).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := FromContext(r.Context())
+		require.True(t, ok)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		_, _ = w.Write([]byte(identity.Claims.Subject + ":" + string(body)))
+	})))
+	defer server.Close()
+
+	send := func(r *http.Request) (int, string) {
+		res, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	httpClient := &http.Client{Transport: &Transport{PKToken: opkClient.GetPKToken, Signer: signer}}
+	res, err := httpClient.Post(server.URL+"/deploy?env=prod", "text/plain", strings.NewReader("v1.2.3"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "me:v1.2.3", string(body))
+
+	unsigned, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	status, _ := send(unsigned)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// Signatures are only good for the request they were made for
+	r, err := http.NewRequest(http.MethodPost, server.URL+"/deploy?env=prod", strings.NewReader("v1.2.3"))
+	require.NoError(t, err)
+	require.NoError(t, SignRequest(r, pkt, signer))
+	for _, tamper := range []func(*http.Request){
+		func(r *http.Request) { r.URL.RawQuery = "env=staging" },
+		func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader("v0.0.1")) },
+		func(r *http.Request) { r.Method = http.MethodPut },
+	} {
+		tampered, err := http.NewRequest(http.MethodPost, server.URL+"/deploy?env=prod", strings.NewReader("v1.2.3"))
+		require.NoError(t, err)
+		tampered.Header = r.Header.Clone()
+		tamper(tampered)
+		status, body := send(tampered)
+		require.Equal(t, http.StatusUnauthorized, status)
+		require.Contains(t, body, "another")
+	}
+
+	// and only once
+	header := r.Header.Clone()
+	status, _ = send(r)
+	require.Equal(t, http.StatusOK, status)
+	replayed, err := http.NewRequest(http.MethodPost, server.URL+"/deploy?env=prod", strings.NewReader("v1.2.3"))
+	require.NoError(t, err)
+	replayed.Header = header
+	status, msg := send(replayed)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Contains(t, msg, "already been used")
+
+	// even when the signature is re-encoded into different bytes that
+	// still verify
+	reencoded, err := http.NewRequest(http.MethodPost, server.URL+"/deploy?env=prod", strings.NewReader("v1.2.3"))
+	require.NoError(t, err)
+	reencoded.Header = header.Clone()
+	reencoded.Header.Set(SignatureHeader, malleate(t, header.Get(SignatureHeader)))
+	status, msg = send(reencoded)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Contains(t, msg, "already been used")
+
+	// Only the compact serialization is accepted
+	parts := strings.Split(header.Get(SignatureHeader), ".")
+	jsonSig, err := json.Marshal(map[string]string{"protected": parts[0], "payload": parts[1], "signature": parts[2]})
+	require.NoError(t, err)
+	reserialized, err := http.NewRequest(http.MethodPost, server.URL+"/deploy?env=prod", strings.NewReader("v1.2.3"))
+	require.NoError(t, err)
+	reserialized.Header = header.Clone()
+	reserialized.Header.Set(SignatureHeader, string(jsonSig))
+	status, msg = send(reserialized)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Contains(t, msg, "compact serialization")
+}
+
+// countingUseCounter counts the uses the verifier records
+type countingUseCounter struct {
+	*verifier.MemoryUseCounter
+	calls int
+}
+
+func (c *countingUseCounter) Use(ctx context.Context, key string) (int, error) {
+	c.calls++
+	return c.MemoryUseCounter.Use(ctx, key)
+}
+
+func TestForgedRequestKeepsUses(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx, client.WithMaxUses(1))
+	require.NoError(t, err)
+	counter := &countingUseCounter{MemoryUseCounter: verifier.NewMemoryUseCounter()}
+	v, err := verifier.New(op, verifier.WithUseCounter(counter))
+	require.NoError(t, err)
+
+	server := httptest.NewServer(New(v).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer server.Close()
+	send := func(r *http.Request) int {
+		res, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A captured PK Token with a signature by another key
+	attacker, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	forged, err := http.NewRequest(http.MethodGet, server.URL+"/deploy", nil)
+	require.NoError(t, err)
+	require.NoError(t, SignRequest(forged, pkt, attacker))
+	require.Equal(t, http.StatusUnauthorized, send(forged))
+
+	// or a signature for another request
+	r, err := http.NewRequest(http.MethodGet, server.URL+"/deploy", nil)
+	require.NoError(t, err)
+	require.NoError(t, SignRequest(r, pkt, signer))
+	tampered, err := http.NewRequest(http.MethodGet, server.URL+"/admin", nil)
+	require.NoError(t, err)
+	tampered.Header = r.Header.Clone()
+	require.Equal(t, http.StatusUnauthorized, send(tampered))
+	require.Zero(t, counter.calls)
+
+	require.Equal(t, http.StatusOK, send(r))
+	require.Equal(t, 1, counter.calls)
+}
+
+// malleate returns an ES256 signature with s replaced by n - s, which
+// verifies for the same claims
+func malleate(t *testing.T, sig string) string {
+	parts := strings.Split(sig, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, raw, 64)
+	s := new(big.Int).SetBytes(raw[32:])
+	s.Sub(elliptic.P256().Params().N, s)
+	s.FillBytes(raw[32:])
+	parts[2] = base64.RawURLEncoding.EncodeToString(raw)
+	return strings.Join(parts, ".")
+}
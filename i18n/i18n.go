@@ -0,0 +1,299 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package i18n lets products embedding the OpenPubkey login and cosigner
+// flows localize and brand the text and pages shown to users. Messages are
+// looked up by ID in a Catalog, and each page can be replaced with a custom
+// html/template which is given a Page to render.
+package i18n
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type MessageID string
+
+const (
+	// Shown in the browser once the OpenID Provider login is complete
+	LoginComplete MessageID = "login_complete"
+	LoginFailed   MessageID = "login_failed"
+	// Shown in the browser once the PK Token has been cosigned
+	CosignComplete MessageID = "cosign_complete"
+	CosignFailed   MessageID = "cosign_failed"
+
+	ChooserTitle        MessageID = "chooser_title"
+	ChooserHeading      MessageID = "chooser_heading"
+	ChooserSignInGoogle MessageID = "chooser_sign_in_google"
+	ChooserSignInAzure  MessageID = "chooser_sign_in_azure"
+
+	MFAStarted            MessageID = "mfa_started"
+	MFARegistering        MessageID = "mfa_registering"
+	MFARegistrationFailed MessageID = "mfa_registration_failed"
+	MFALoggingIn          MessageID = "mfa_logging_in"
+	MFALoginFailed        MessageID = "mfa_login_failed"
+	MFAComplete           MessageID = "mfa_complete"
+
+	TOTPEnroll      MessageID = "totp_enroll"
+	TOTPSecret      MessageID = "totp_secret"
+	TOTPEnterCode   MessageID = "totp_enter_code"
+	TOTPSubmit      MessageID = "totp_submit"
+	TOTPInvalidCode MessageID = "totp_invalid_code"
+
+	// Shown on the page a recovery cancel link opens
+	RecoveryCancelPrompt MessageID = "recovery_cancel_prompt"
+	RecoveryCancel       MessageID = "recovery_cancel"
+	RecoveryCancelled    MessageID = "recovery_cancelled"
+	RecoveryCancelFailed MessageID = "recovery_cancel_failed"
+
+	// Emailed to the user as their recovery request progresses. The
+	// arguments are given in the comments.
+	RecoveryEmailSubject   MessageID = "recovery_email_subject"
+	RecoveryEmailRequested MessageID = "recovery_email_requested" // cancel URL
+	RecoveryEmailApproved  MessageID = "recovery_email_approved"  // effective time, cancel URL
+	RecoveryEmailDenied    MessageID = "recovery_email_denied"
+	RecoveryEmailCancelled MessageID = "recovery_email_cancelled"
+	RecoveryEmailCompleted MessageID = "recovery_email_completed"
+
+	// Printed on the command line while waiting for the user to log in, the
+	// argument is the URI of the local login server
+	CLIListening   MessageID = "cli_listening"
+	CLIPressCtrlC  MessageID = "cli_press_ctrl_c"
+	CLIOpenBrowser MessageID = "cli_open_browser"
+)
+
+// Catalog holds the text of messages in one or more languages
+type Catalog interface {
+	// Message returns the text of the message in the language, a BCP 47
+	// language tag such as "pt-BR", and false if the catalog doesn't have it
+	Message(lang string, id MessageID) (string, bool)
+}
+
+// Messages is a Catalog of message texts by language tag and message ID.
+// Messages for a regional language tag, e.g. "pt-BR", fall back to the
+// base language, e.g. "pt".
+type Messages map[string]map[MessageID]string
+
+var _ Catalog = Messages{}
+
+func (m Messages) Message(lang string, id MessageID) (string, bool) {
+	lang = strings.ToLower(lang)
+	for {
+		for tag, messages := range m {
+			if strings.ToLower(tag) != lang {
+				continue
+			}
+			if text, ok := messages[id]; ok {
+				return text, true
+			}
+		}
+		i := strings.LastIndex(lang, "-")
+		if i < 0 {
+			return "", false
+		}
+		lang = lang[:i]
+	}
+}
+
+// English is the default text of every message
+var English = Messages{
+	"en": {
+		LoginComplete:  "You may now close this window",
+		LoginFailed:    "Login failed",
+		CosignComplete: "You may now close this window",
+		CosignFailed:   "Cosigning failed",
+
+		ChooserTitle:        "OpenPubkey: OpenID Providers",
+		ChooserHeading:      "OpenPubkey:",
+		ChooserSignInGoogle: "Sign in with Google",
+		ChooserSignInAzure:  "Sign in with Azure",
+
+		MFAStarted:            "Authenticating with MFA...",
+		MFARegistering:        "Registering user with WebAuthn...",
+		MFARegistrationFailed: "Error during registration",
+		MFALoggingIn:          "Authenticating user with WebAuthn...",
+		MFALoginFailed:        "Error during login",
+		MFAComplete:           "MFA authentication complete!",
+
+		TOTPEnroll:      "Add this account to your authenticator app by opening the link below or entering the secret, then enter the code it shows.",
+		TOTPSecret:      "Secret",
+		TOTPEnterCode:   "Enter the code from your authenticator app",
+		TOTPSubmit:      "Verify",
+		TOTPInvalidCode: "Invalid code, try again",
+
+		RecoveryCancelPrompt: "A request was made to reset the authenticators on your account. If you didn't make it, cancel it.",
+		RecoveryCancel:       "Cancel the request",
+		RecoveryCancelled:    "The recovery request was cancelled. Your authenticators have not been reset.",
+		RecoveryCancelFailed: "The recovery request could not be cancelled",
+
+		RecoveryEmailSubject:   "Authenticator recovery for your account",
+		RecoveryEmailRequested: "A request was made to reset the authenticators on your account. An administrator has to approve it before it takes effect. If you didn't make it, cancel it now:\n\n%s",
+		RecoveryEmailApproved:  "An administrator approved the request to reset the authenticators on your account. They will be reset at %s unless you cancel the request:\n\n%s",
+		RecoveryEmailDenied:    "The request to reset the authenticators on your account was denied by an administrator.",
+		RecoveryEmailCancelled: "The request to reset the authenticators on your account was cancelled.",
+		RecoveryEmailCompleted: "The authenticators on your account were reset. Log in to register a new one. If you didn't request this, contact your administrator immediately.",
+
+		CLIListening:   "listening on %s",
+		CLIPressCtrlC:  "press ctrl+c to stop",
+		CLIOpenBrowser: "Opening browser to %s",
+	},
+}
+
+// Localizer chooses the text and templates shown to users. A nil Localizer
+// shows the English text and default pages, so products that don't localize
+// need not configure one.
+type Localizer struct {
+	// Catalog is consulted before English, it need not have every message
+	Catalog Catalog
+	// Languages are the preferred languages for text which isn't shown in
+	// response to an HTTP request, such as command line messages. Pages use
+	// the Accept-Language header of the request instead.
+	Languages []string
+	// Templates replace the default pages, keyed by page name, e.g.
+	// StatusPage. Templates are executed with a Page.
+	Templates map[string]*template.Template
+}
+
+// Message returns the text of the message in the first of the languages the
+// Catalog has it in. If no languages are given the Localizer's Languages
+// are used.
+func (l *Localizer) Message(id MessageID, languages ...string) string {
+	if l != nil && l.Catalog != nil {
+		if len(languages) == 0 {
+			languages = l.Languages
+		}
+		for _, lang := range languages {
+			if text, ok := l.Catalog.Message(lang, id); ok {
+				return text
+			}
+		}
+	}
+	if text, ok := English.Message("en", id); ok {
+		return text
+	}
+	return string(id)
+}
+
+// Sprintf formats the message with the arguments, see Message
+func (l *Localizer) Sprintf(id MessageID, args ...any) string {
+	return fmt.Sprintf(l.Message(id), args...)
+}
+
+// Template returns the template replacing the named page, or def if it
+// hasn't been replaced
+func (l *Localizer) Template(name string, def *template.Template) *template.Template {
+	if l != nil {
+		if tmpl, ok := l.Templates[name]; ok {
+			return tmpl
+		}
+	}
+	return def
+}
+
+// Render writes the named page, in the languages the request accepts, as
+// the response
+func (l *Localizer) Render(w http.ResponseWriter, r *http.Request, name string, def *template.Template, data any) {
+	page := Page{
+		Lang:      "en",
+		Data:      data,
+		localizer: l,
+		languages: AcceptLanguages(r),
+	}
+	if len(page.languages) > 0 {
+		page.Lang = page.languages[0]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := l.Template(name, def).Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Page is what page templates are executed with
+type Page struct {
+	// Lang is the user's preferred language, for the html lang attribute
+	Lang string
+	// Data is specific to the page
+	Data any
+
+	localizer *Localizer
+	languages []string
+}
+
+// T returns the text of the message in the user's language, e.g.
+// {{.T "login_complete"}}
+func (p Page) T(id MessageID) string {
+	return p.localizer.Message(id, p.languages...)
+}
+
+// AcceptLanguages returns the languages in the Accept-Language header of
+// the request, most preferred first
+func AcceptLanguages(r *http.Request) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var accepted []weighted
+	for _, header := range r.Header.Values("Accept-Language") {
+		for _, part := range strings.Split(header, ",") {
+			lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if lang == "" || lang == "*" {
+				continue
+			}
+			q := 1.0
+			if qStr, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(qStr, 64); err != nil {
+					continue
+				}
+			}
+			if q > 0 {
+				accepted = append(accepted, weighted{lang: lang, q: q})
+			}
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+
+	languages := make([]string, len(accepted))
+	for i, a := range accepted {
+		languages[i] = a.lang
+	}
+	return languages
+}
+
+// EnvLanguages returns the language set by the LC_ALL, LC_MESSAGES or LANG
+// environment variables as a language tag, for use as Localizer.Languages
+// in command line tools
+func EnvLanguages() []string {
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(key)
+		// Strip the encoding and modifier, e.g. "pt_BR.UTF-8@euro"
+		locale, _, _ = strings.Cut(locale, ".")
+		locale, _, _ = strings.Cut(locale, "@")
+		if locale == "" || locale == "C" || locale == "POSIX" {
+			continue
+		}
+		return []string{strings.ReplaceAll(locale, "_", "-")}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package i18n_test
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/i18n"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalizerMessage(t *testing.T) {
+	var nilLocalizer *i18n.Localizer
+	require.Equal(t, "You may now close this window", nilLocalizer.Message(i18n.LoginComplete))
+	require.Equal(t, "listening on http://localhost:3000/", nilLocalizer.Sprintf(i18n.CLIListening, "http://localhost:3000/"))
+
+	localizer := &i18n.Localizer{
+		Catalog: i18n.Messages{
+			"pt": {
+				i18n.LoginComplete: "Você já pode fechar esta janela",
+				i18n.CLIListening:  "ouvindo em %s",
+			},
+			"pt-BR": {
+				i18n.CosignComplete: "Pronto!",
+			},
+		},
+		Languages: []string{"pt-BR"},
+	}
+	// Regional tags fall back to the base language
+	require.Equal(t, "Você já pode fechar esta janela", localizer.Message(i18n.LoginComplete))
+	require.Equal(t, "Pronto!", localizer.Message(i18n.CosignComplete))
+	require.Equal(t, "ouvindo em :3000", localizer.Sprintf(i18n.CLIListening, ":3000"))
+	// Messages missing from the catalog fall back to English
+	require.Equal(t, "Cosigning failed", localizer.Message(i18n.CosignFailed))
+	require.Equal(t, "You may now close this window", localizer.Message(i18n.LoginComplete, "de", "en"))
+	require.Equal(t, "Pronto!", localizer.Message(i18n.CosignComplete, "de", "PT-br"))
+}
+
+func TestAcceptLanguages(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected []string
+	}{
+		{header: "", expected: []string{}},
+		{header: "fr", expected: []string{"fr"}},
+		{header: "fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", expected: []string{"fr-CH", "fr", "en", "de"}},
+		{header: "en;q=0.5, de, nl;q=0", expected: []string{"de", "en"}},
+		{header: "en;q=bad, de", expected: []string{"de"}},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			r.Header.Set("Accept-Language", tc.header)
+		}
+		require.Equal(t, tc.expected, i18n.AcceptLanguages(r), tc.header)
+	}
+}
+
+func TestEnvLanguages(t *testing.T) {
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "")
+	t.Setenv("LANG", "pt_BR.UTF-8")
+	require.Equal(t, []string{"pt-BR"}, i18n.EnvLanguages())
+
+	t.Setenv("LC_ALL", "C")
+	t.Setenv("LC_MESSAGES", "de_DE@euro")
+	require.Equal(t, []string{"de-DE"}, i18n.EnvLanguages())
+
+	t.Setenv("LC_MESSAGES", "")
+	t.Setenv("LANG", "")
+	require.Nil(t, i18n.EnvLanguages())
+}
+
+func TestRenderStatus(t *testing.T) {
+	render := func(localizer *i18n.Localizer, acceptLanguage string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		w := httptest.NewRecorder()
+		localizer.RenderStatus(w, r, i18n.CosignFailed, "<error>")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		return w.Body.String()
+	}
+
+	page := render(nil, "fr")
+	require.Contains(t, page, `<html lang="fr">`)
+	require.Contains(t, page, "Cosigning failed")
+	require.Contains(t, page, "&lt;error&gt;")
+
+	localizer := &i18n.Localizer{
+		Catalog: i18n.Messages{"fr": {i18n.CosignFailed: "Échec de la cosignature"}},
+	}
+	page = render(localizer, "fr-FR, en;q=0.5")
+	require.Contains(t, page, `<html lang="fr-FR">`)
+	require.Contains(t, page, "Échec de la cosignature")
+
+	// Products can brand the page by replacing its template
+	localizer.Templates = map[string]*template.Template{
+		i18n.StatusPage: template.Must(template.New("").Parse(`<h1>Acme</h1><p>{{.T .Data.Message}}: {{.Data.Detail}}</p>`)),
+	}
+	page = render(localizer, "fr")
+	require.Equal(t, "<h1>Acme</h1><p>Échec de la cosignature: &lt;error&gt;</p>", page)
+
+	// Pages of one step of a flow fall back to the status page
+	w := httptest.NewRecorder()
+	localizer.RenderStatusPage(w, httptest.NewRequest(http.MethodGet, "/", nil), i18n.LoginFailurePage, i18n.LoginFailed, "")
+	require.Equal(t, "<h1>Acme</h1><p>Login failed: </p>", w.Body.String())
+}
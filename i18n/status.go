@@ -0,0 +1,57 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package i18n
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+// StatusPage is the name of the page shown in the browser at the end of the
+// login and cosigning flows. It is executed with a Page whose Data is a
+// Status.
+const StatusPage = "status"
+
+// LoginSuccessPage and LoginFailurePage, if replaced, are shown at the end
+// of the login flow instead of the status page, with the same Status data
+const (
+	LoginSuccessPage = "login_success"
+	LoginFailurePage = "login_failure"
+)
+
+//go:embed status.tmpl
+var statusTemplateFile string
+
+var statusTemplate = template.Must(template.New(StatusPage).Parse(statusTemplateFile))
+
+type Status struct {
+	Message MessageID
+	// Detail is shown as is, e.g. an error message
+	Detail string
+}
+
+// RenderStatus writes the status page as the response
+func (l *Localizer) RenderStatus(w http.ResponseWriter, r *http.Request, message MessageID, detail string) {
+	l.RenderStatusPage(w, r, StatusPage, message, detail)
+}
+
+// RenderStatusPage writes the named page as the response, or the status
+// page if the named page hasn't been replaced
+func (l *Localizer) RenderStatusPage(w http.ResponseWriter, r *http.Request, name string, message MessageID, detail string) {
+	l.Render(w, r, name, l.Template(StatusPage, statusTemplate), Status{Message: message, Detail: detail})
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mobile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+)
+
+// callbackSession serves the provider's callback server over an in-memory
+// listener, since the platform browser can't reach a local port. The
+// login page is fetched over it to find the OP's authorization URL for
+// the platform browser, and the redirect the app link delivers is replayed
+// over it, with the cookies the login page set.
+type callbackSession struct {
+	redirectURI *url.URL
+	conns       chan net.Conn
+	closed      chan struct{}
+	closeOnce   sync.Once
+	httpClient  *http.Client
+	// base is the scheme and host the provider serves its pages at
+	base string
+}
+
+func newCallbackSession() (*callbackSession, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &callbackSession{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	s.httpClient = &http.Client{
+		Jar:       jar,
+		Transport: &http.Transport{DialContext: s.dial},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return s, nil
+}
+
+// Listen makes the session the provider's providers.CallbackListener
+func (s *callbackSession) Listen(redirectURIs []string) (*url.URL, net.Listener, error) {
+	if len(redirectURIs) == 0 {
+		return nil, nil, fmt.Errorf("no redirect URI")
+	}
+	u, err := url.Parse(redirectURIs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	s.redirectURI = u
+	return u, s, nil
+}
+
+func (s *callbackSession) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *callbackSession) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *callbackSession) Addr() net.Addr {
+	return &net.UnixAddr{Name: "openpubkey-callback", Net: "memory"}
+}
+
+func (s *callbackSession) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case s.conns <- server:
+		return client, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// authURL fetches the provider's login page, which redirects to the OP's
+// authorization URL
+func (s *callbackSession) authURL(loginURI string) (string, error) {
+	u, err := url.Parse(loginURI)
+	if err != nil {
+		return "", err
+	}
+	s.base = u.Scheme + "://" + u.Host
+	res, err := s.httpClient.Get(loginURI)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	location := res.Header.Get("Location")
+	if res.StatusCode != http.StatusFound || location == "" {
+		return "", fmt.Errorf("login page returned %s instead of a redirect to the OP", res.Status)
+	}
+	return location, nil
+}
+
+// callback replays the redirect from the OP, which must be to the
+// redirect URI, to the provider's callback server
+func (s *callbackSession) callback(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if s.redirectURI == nil || s.base == "" {
+		return fmt.Errorf("no login in progress")
+	}
+	if u.Scheme != s.redirectURI.Scheme || u.Host != s.redirectURI.Host || u.Path != s.redirectURI.Path {
+		return fmt.Errorf("callback URL %s doesn't match the redirect URI %s", u.Redacted(), s.redirectURI)
+	}
+	res, err := s.httpClient.Get(s.base + u.EscapedPath() + "?" + u.RawQuery)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mobile is the OpenPubkey client for iOS and Android apps, built
+// with gomobile bind:
+//
+//	gomobile bind -target=ios,android github.com/openpubkey/openpubkey/mobile
+//
+// Its API only uses types gomobile can bind: strings, integers, byte
+// slices, structs with exported fields and interfaces the app implements.
+// PK Tokens cross into the app as their compact serialization.
+//
+// The login runs in the platform browser, e.g. ASWebAuthenticationSession
+// or Custom Tabs, which the app opens for Browser.OpenURL. The OP sends
+// the user back to the app's redirect URI, an app link or custom scheme
+// URI, and the app passes the URL it is opened with to
+// Client.HandleCallback, completing the login.
+package mobile
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// Browser is implemented by the app to show the OP's login page
+type Browser interface {
+	OpenURL(url string) error
+}
+
+// Config says which OP to log in with
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURI is the app link or custom scheme URI, with a path, that
+	// the OP sends the user back to, e.g. com.example.app:/callback. It
+	// must be registered with the OP.
+	RedirectURI string
+	// Scopes are space separated
+	Scopes string
+	GQSign bool
+	// PrivateKeyPEM is the client key from an earlier Client's
+	// PrivateKeyPEM, if empty a new key is generated
+	PrivateKeyPEM []byte
+}
+
+// NewConfig returns a Config requesting the openid, profile and email
+// scopes
+func NewConfig(issuer, clientID, redirectURI string) *Config {
+	return &Config{
+		Issuer:      issuer,
+		ClientID:    clientID,
+		RedirectURI: redirectURI,
+		Scopes:      "openid profile email",
+	}
+}
+
+// Client logs the user in and holds their PK Token and client key. Its
+// blocking methods must not be called on the app's main thread.
+type Client struct {
+	browser   Browser
+	opkClient *client.OpkClient
+
+	mu      sync.Mutex
+	session *callbackSession
+	cancel  context.CancelFunc
+}
+
+// NewClient returns a Client logging in with the OP of cfg, showing the
+// login page with browser
+func NewClient(cfg *Config, browser Browser) (*Client, error) {
+	redirectURI, err := url.Parse(cfg.RedirectURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect URI: %w", err)
+	}
+	if redirectURI.Scheme == "" || redirectURI.Path == "" {
+		return nil, fmt.Errorf("redirect URI %s must have a scheme and path", cfg.RedirectURI)
+	}
+	c := &Client{browser: browser}
+
+	opts := providers.GetDefaultGoogleOpOptions()
+	opts.Issuer = cfg.Issuer
+	opts.ClientID = cfg.ClientID
+	opts.ClientSecret = cfg.ClientSecret
+	opts.RedirectURIs = []string{cfg.RedirectURI}
+	if cfg.Scopes != "" {
+		opts.Scopes = []string{cfg.Scopes}
+	}
+	opts.GQSign = cfg.GQSign
+	opts.OpenBrowser = true
+	opts.CallbackListener = (*hooks)(c)
+	opts.BrowserOpener = (*hooks)(c)
+	op := providers.NewGoogleOpWithOptions(opts)
+
+	var clientOpts []client.ClientOpts
+	if len(cfg.PrivateKeyPEM) > 0 {
+		block, _ := pem.Decode(cfg.PrivateKeyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in private key")
+		}
+		sk, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		clientOpts = append(clientOpts, client.WithSigner(sk, jwa.ES256))
+	}
+	if c.opkClient, err = client.New(op, clientOpts...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Login opens the OP's login page with the Browser and blocks until
+// HandleCallback completes the login or Cancel is called, then returns
+// the compact PK Token
+func (c *Client) Login() ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("login already in progress")
+	}
+	c.cancel = cancel
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.cancel, c.session = nil, nil
+		c.mu.Unlock()
+	}()
+
+	pkt, err := c.opkClient.Auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Compact()
+}
+
+// HandleCallback completes the login with the URL the app was opened with
+// at the redirect URI
+func (c *Client) HandleCallback(callbackURL string) error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session == nil {
+		return fmt.Errorf("no login in progress")
+	}
+	return session.callback(callbackURL)
+}
+
+// Cancel ends the login in progress, if any, Login then returns an error
+func (c *Client) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// Refresh refreshes the ID Token of the PK Token with the OP, without the
+// user logging in again, and returns the compact PK Token
+func (c *Client) Refresh() ([]byte, error) {
+	pkt, err := c.opkClient.Refresh(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Compact()
+}
+
+// PKToken returns the current compact PK Token
+func (c *Client) PKToken() ([]byte, error) {
+	pkt, err := c.opkClient.GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Compact()
+}
+
+// SignMessage signs msg with the client key, returning an OpenPubkey
+// Signed Message that verifiers check against the PK Token
+func (c *Client) SignMessage(msg []byte) ([]byte, error) {
+	pkt, err := c.opkClient.GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	return pkt.NewSignedMessage(msg, c.opkClient.GetSigner())
+}
+
+// PrivateKeyPEM returns the client key so the app can keep it, e.g. in
+// the Keychain or Keystore, and pass it to the next Client in
+// Config.PrivateKeyPEM
+func (c *Client) PrivateKeyPEM() ([]byte, error) {
+	sk, ok := c.opkClient.GetSigner().(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("client key is not an ECDSA key")
+	}
+	return util.SKToX509Bytes(sk)
+}
+
+// hooks are the provider's providers.CallbackListener and
+// providers.BrowserOpener. They aren't methods of Client as gomobile can't
+// bind their types.
+type hooks Client
+
+// Listen starts a callbackSession for the login
+func (c *hooks) Listen(redirectURIs []string) (*url.URL, net.Listener, error) {
+	session, err := newCallbackSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+	return session.Listen(redirectURIs)
+}
+
+// OpenURL hands the OP's authorization URL to the Browser
+func (c *hooks) OpenURL(loginURI string) error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	authURL, err := session.authURL(loginURI)
+	if err != nil {
+		return err
+	}
+	return c.browser.OpenURL(authURL)
+}
+
+// Claims are the identity claims of a PK Token
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  string
+	Email     string
+	ExpiresAt int64
+}
+
+// ParseClaims returns the claims of a compact PK Token. It does not verify
+// the PK Token.
+func ParseClaims(pktCom []byte) (*Claims, error) {
+	pkt, err := pktoken.NewFromCompact(pktCom)
+	if err != nil {
+		return nil, err
+	}
+	var claims oidc.OidcClaims
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID Token claims: %w", err)
+	}
+	return &Claims{
+		Issuer:    claims.Issuer,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Email:     claims.Email,
+		ExpiresAt: claims.Expiration,
+	}, nil
+}
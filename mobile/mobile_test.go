@@ -0,0 +1,176 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mobile
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOP is an OP issuing ID Tokens for the subject "me" to whoever asks,
+// with the nonce of the last authorization request
+func fakeOP(t *testing.T, clientID string) *httptest.Server {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signingKey, err := jwk.FromRaw(rsaKey)
+	require.NoError(t, err)
+	require.NoError(t, signingKey.Set(jwk.KeyIDKey, "fake"))
+	require.NoError(t, signingKey.Set(jwk.AlgorithmKey, jwa.RS256))
+	publicKey, err := signingKey.PublicKey()
+	require.NoError(t, err)
+
+	var issuer, nonce string
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		set := jwk.NewSet()
+		require.NoError(t, set.AddKey(publicKey))
+		writeJSON(w, set)
+	})
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		nonce = r.URL.Query().Get("nonce")
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := map[string]any{
+			"iss":   issuer,
+			"sub":   "me",
+			"aud":   clientID,
+			"email": "me@example.com",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		if r.FormValue("grant_type") == "authorization_code" {
+			claims["nonce"] = nonce
+		}
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		idToken, err := jws.Sign(payload, jws.WithKey(jwa.RS256, signingKey))
+		require.NoError(t, err)
+		writeJSON(w, map[string]any{
+			"access_token":  "access",
+			"token_type":    "Bearer",
+			"refresh_token": "refresh",
+			"expires_in":    3600,
+			"id_token":      string(idToken),
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	issuer = server.URL
+	return server
+}
+
+type browserFunc func(url string) error
+
+func (f browserFunc) OpenURL(url string) error {
+	return f(url)
+}
+
+func TestClientLogin(t *testing.T) {
+	op := fakeOP(t, "app")
+
+	var c *Client
+	browser := browserFunc(func(authURL string) error {
+		// The app link delivers the OP's redirect to the app
+		u, err := url.Parse(authURL)
+		require.NoError(t, err)
+		res, err := http.Get(authURL)
+		require.NoError(t, err)
+		res.Body.Close()
+		callback := u.Query().Get("redirect_uri") + "?" + url.Values{
+			"code":  {"code"},
+			"state": {u.Query().Get("state")},
+		}.Encode()
+		go func() {
+			require.Error(t, c.HandleCallback("com.example.app:/elsewhere?code=code"))
+			require.NoError(t, c.HandleCallback(callback))
+		}()
+		return nil
+	})
+	c, err := NewClient(NewConfig(op.URL, "app", "com.example.app:/callback"), browser)
+	require.NoError(t, err)
+	require.Error(t, c.HandleCallback("com.example.app:/callback?code=code"))
+
+	pktCom, err := c.Login()
+	require.NoError(t, err)
+	claims, err := ParseClaims(pktCom)
+	require.NoError(t, err)
+	require.Equal(t, op.URL, claims.Issuer)
+	require.Equal(t, "me", claims.Subject)
+	require.Equal(t, "me@example.com", claims.Email)
+
+	pkt, err := pktoken.NewFromCompact(pktCom)
+	require.NoError(t, err)
+	osm, err := c.SignMessage([]byte("hello"))
+	require.NoError(t, err)
+	msg, err := pkt.VerifySignedMessage(osm)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(msg))
+
+	refreshed, err := c.Refresh()
+	require.NoError(t, err)
+	refreshedPKT, err := pktoken.NewFromCompact(refreshed)
+	require.NoError(t, err)
+	require.NotNil(t, refreshedPKT.FreshIDToken)
+
+	// A Client with the same key continues to sign for the PK Token
+	keyPEM, err := c.PrivateKeyPEM()
+	require.NoError(t, err)
+	cfg := NewConfig(op.URL, "app", "com.example.app:/callback")
+	cfg.PrivateKeyPEM = keyPEM
+	c2, err := NewClient(cfg, browser)
+	require.NoError(t, err)
+	require.Equal(t, c.opkClient.GetSigner().Public(), c2.opkClient.GetSigner().Public())
+
+	_, err = NewClient(NewConfig(op.URL, "app", "com.example.app://callback"), browser)
+	require.ErrorContains(t, err, "path")
+}
+
+func TestClientCancel(t *testing.T) {
+	op := fakeOP(t, "app")
+	var c *Client
+	c, err := NewClient(NewConfig(op.URL, "app", "com.example.app:/callback"), browserFunc(func(string) error {
+		go c.Cancel()
+		return nil
+	}))
+	require.NoError(t, err)
+	_, err = c.Login()
+	require.Error(t, err)
+}
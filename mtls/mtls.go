@@ -0,0 +1,120 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mtls sets up mutual TLS between services authenticated by their
+// PK Tokens. Each side presents a self-signed certificate for the key in
+// its PK Token with the PK Token embedded, see cert.CreateX509Cert, and
+// accepts the peer if the PK Token in the peer's certificate verifies. The
+// TLS handshake proves the peer holds the key, so no CA is involved and
+// identities are those of the OpenID Provider.
+package mtls
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/openpubkey/openpubkey/cert"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// Certificate returns a TLS certificate for the key in the PK Token, which
+// signer must hold, e.g. the OpkClient's signer. The certificate is valid
+// for client and server authentication unless opts say otherwise.
+func Certificate(pkt *pktoken.PKToken, signer crypto.Signer, opts ...cert.TemplateOpts) (*tls.Certificate, error) {
+	opts = append([]cert.TemplateOpts{
+		cert.WithExtKeyUsages(x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth),
+	}, opts...)
+	certPEM, err := cert.CreateX509Cert(pkt, signer, opts...)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  signer,
+		Leaf:        leaf,
+	}, nil
+}
+
+// VerifyPeer returns a tls.Config VerifyPeerCertificate hook that accepts
+// peers whose certificate carries a PK Token for its key which v verifies
+// with the checks
+func VerifyPeer(v *verifier.Verifier, checks ...verifier.Check) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+		pkt, err := cert.PKTokenFromCert(leaf)
+		if err != nil {
+			return err
+		}
+		if err := v.VerifyPKToken(context.Background(), pkt, checks...); err != nil {
+			return fmt.Errorf("failed to verify peer's PK Token: %w", err)
+		}
+		return nil
+	}
+}
+
+// ServerConfig returns the TLS config of a server presenting certificate,
+// e.g. from Certificate, that requires clients to present a certificate
+// accepted by VerifyPeer
+func ServerConfig(certificate *tls.Certificate, v *verifier.Verifier, checks ...verifier.Check) *tls.Config {
+	return &tls.Config{
+		Certificates:          []tls.Certificate{*certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: VerifyPeer(v, checks...),
+		// Resumed sessions skip VerifyPeerCertificate, so the PK Token
+		// wouldn't be verified again once it expired
+		SessionTicketsDisabled: true,
+		MinVersion:             tls.VersionTLS12,
+	}
+}
+
+// ClientConfig returns the TLS config of a client presenting certificate
+// that requires the server to present a certificate accepted by VerifyPeer
+func ClientConfig(certificate *tls.Certificate, v *verifier.Verifier, checks ...verifier.Check) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		// The server's certificate is self-signed, VerifyPeerCertificate
+		// verifies the PK Token in it instead of a chain and host name
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: VerifyPeer(v, checks...),
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+// PeerPKToken returns the PK Token of the peer of a connection set up with
+// ServerConfig or ClientConfig, e.g. from http.Request.TLS, whose claims
+// identify the peer
+func PeerPKToken(state *tls.ConnectionState) (*pktoken.PKToken, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("peer presented no certificate")
+	}
+	return cert.PKTokenFromCert(state.PeerCertificates[0])
+}
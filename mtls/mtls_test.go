@@ -0,0 +1,95 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	ctx := context.Background()
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+	newCertificate := func(op providers.OpenIdProvider) *tls.Certificate {
+		signer, err := util.GenKeyPair(jwa.ES256)
+		require.NoError(t, err)
+		opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(ctx)
+		require.NoError(t, err)
+		certificate, err := Certificate(pkt, signer)
+		require.NoError(t, err)
+		return certificate
+	}
+	serverCert, clientCert := newCertificate(op), newCertificate(op)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkt, err := PeerPKToken(r.TLS)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var claims oidc.OidcClaims
+		if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(claims.Subject))
+	}))
+	server.TLS = ServerConfig(serverCert, v)
+	server.StartTLS()
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: ClientConfig(clientCert, v)}}
+	res, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "me", string(body))
+
+	// Clients with PK Tokens from an OP the server doesn't trust are refused
+	otherOp, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	otherClient := &http.Client{Transport: &http.Transport{TLSClientConfig: ClientConfig(newCertificate(otherOp), v)}}
+	_, err = otherClient.Get(server.URL)
+	require.Error(t, err)
+
+	// and so are servers
+	otherVerifier, err := verifier.New(otherOp)
+	require.NoError(t, err)
+	distrustingClient := &http.Client{Transport: &http.Transport{TLSClientConfig: ClientConfig(clientCert, otherVerifier)}}
+	_, err = distrustingClient.Get(server.URL)
+	require.ErrorContains(t, err, "failed to verify peer's PK Token")
+}
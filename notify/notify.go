@@ -0,0 +1,160 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package notify sends "new sign-in" style alerts about OpenPubkey
+// identities. Cosigners fire events when users log in, enroll a new MFA
+// device or have a PK Token cosigned, and opkssh fires one for every SSH
+// login it allows. Deployments choose where events go, e.g. a Webhook for
+// the security team's SIEM and an SMTP notifier emailing the user, and which
+// events each receives with Filter:
+//
+//	notifier := notify.Multi{
+//		notify.Async(&notify.Webhook{URL: "https://siem.example.com/hooks/opk", Secret: secret}, 0),
+//		notify.Filter(&notify.SMTP{Addr: "smtp.example.com:587", From: "security@example.com", NotifyUser: true},
+//			notify.EventDeviceEnrolled),
+//	}
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// EventType identifies what happened
+type EventType string
+
+const (
+	// EventLogin is fired when a user logs in, i.e. completes MFA at a
+	// cosigner or is allowed to SSH by opkssh
+	EventLogin EventType = "login"
+	// EventDeviceEnrolled is fired when a user enrolls a new MFA device,
+	// e.g. a WebAuthn authenticator or a TOTP app
+	EventDeviceEnrolled EventType = "device_enrolled"
+	// EventCosigned is fired when a cosigner issues a signature on a PK
+	// Token
+	EventCosigned EventType = "cosigned"
+)
+
+// Event describes something that happened to an OpenPubkey identity
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Issuer  string    `json:"iss,omitempty"` // ID Token issuer
+	Subject string    `json:"sub,omitempty"` // ID Token subject
+	Email   string    `json:"email,omitempty"`
+	// Source is the issuer of the cosigner or the host name of the SSH
+	// server that fired the event
+	Source string `json:"source,omitempty"`
+	// Device describes the device involved, e.g. "webauthn", "totp" or the
+	// client's host name
+	Device string `json:"device,omitempty"`
+	// Principal is the account logged in to, set by opkssh
+	Principal string `json:"principal,omitempty"`
+}
+
+// NewEvent returns an event of type typ about the identity in pkt
+func NewEvent(typ EventType, pkt *pktoken.PKToken) Event {
+	event := Event{Type: typ, Time: time.Now()}
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if pkt != nil && json.Unmarshal(pkt.Payload, &claims) == nil {
+		event.Issuer = claims.Issuer
+		event.Subject = claims.Subject
+		event.Email = claims.Email
+	}
+	return event
+}
+
+// Notifier delivers events. Implement this interface to send them through
+// a chat, paging or mail provider's API.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// NotifierFunc adapts a function to a Notifier
+type NotifierFunc func(ctx context.Context, event Event) error
+
+func (f NotifierFunc) Notify(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// Multi sends every event to all of its notifiers, returning their joined
+// errors
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Filter returns a Notifier that only passes events of the given types on to
+// n
+func Filter(n Notifier, types ...EventType) Notifier {
+	return NotifierFunc(func(ctx context.Context, event Event) error {
+		if !slices.Contains(types, event.Type) {
+			return nil
+		}
+		return n.Notify(ctx, event)
+	})
+}
+
+// DefaultAsyncTimeout bounds how long an Async notifier spends on an event
+const DefaultAsyncTimeout = 30 * time.Second
+
+// Async returns a Notifier that delivers events to n in the background so
+// that slow webhooks or mail servers don't delay logins. Delivery errors are
+// logged. A timeout of 0 uses DefaultAsyncTimeout.
+func Async(n Notifier, timeout time.Duration) Notifier {
+	if timeout <= 0 {
+		timeout = DefaultAsyncTimeout
+	}
+	return NotifierFunc(func(ctx context.Context, event Event) error {
+		go func() {
+			// The caller's context usually ends with its request
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
+			if err := n.Notify(ctx, event); err != nil {
+				log.Printf("failed to deliver %s notification: %v", event.Type, err)
+			}
+		}()
+		return nil
+	})
+}
+
+// Send delivers event to n if it isn't nil. Notifications are best effort,
+// so errors are logged rather than returned.
+func Send(ctx context.Context, n Notifier, event Event) {
+	if n == nil {
+		return
+	}
+	if err := n.Notify(ctx, event); err != nil {
+		log.Printf("failed to deliver %s notification: %v", event.Type, err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testEvent = Event{
+	Type:    EventLogin,
+	Time:    time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+	Issuer:  "https://accounts.example.com",
+	Subject: "1234",
+	Email:   "alice@example.com",
+	Source:  "bastion-1",
+	Device:  "laptop-1.corp.example.com",
+}
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("webhook-secret")
+	received := make(chan *Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		event, err := VerifyWebhook(secret, r.Header, body, time.Minute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	webhook := &Webhook{URL: server.URL, Secret: secret}
+	require.NoError(t, webhook.Notify(context.Background(), testEvent))
+	require.Equal(t, testEvent, *<-received)
+
+	wrongSecret := &Webhook{URL: server.URL, Secret: []byte("other")}
+	require.ErrorContains(t, wrongSecret.Notify(context.Background(), testEvent), "unexpected status code: 401")
+	unsigned := &Webhook{URL: server.URL}
+	require.ErrorContains(t, unsigned.Notify(context.Background(), testEvent), "unexpected status code: 401")
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret := []byte("webhook-secret")
+	body := []byte(`{"type":"login"}`)
+	sign := func(sent time.Time, body []byte) http.Header {
+		timestamp := strconv.FormatInt(sent.Unix(), 10)
+		header := http.Header{}
+		header.Set(TimestampHeader, timestamp)
+		header.Set(SignatureHeader, fmt.Sprintf("sha256=%x", webhookMAC(secret, timestamp, body)))
+		return header
+	}
+
+	event, err := VerifyWebhook(secret, sign(time.Now(), body), body, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, EventLogin, event.Type)
+
+	_, err = VerifyWebhook(secret, sign(time.Now(), body), []byte(`{"type":"cosigned"}`), time.Minute)
+	require.ErrorContains(t, err, "invalid webhook signature")
+	_, err = VerifyWebhook(secret, sign(time.Now().Add(-time.Hour), body), body, time.Minute)
+	require.ErrorContains(t, err, "more than 1m0s")
+	_, err = VerifyWebhook(secret, http.Header{}, body, time.Minute)
+	require.ErrorContains(t, err, "malformed X-Opk-Timestamp")
+}
+
+func TestSMTP(t *testing.T) {
+	var gotTo []string
+	var gotMsg string
+	mailer := &SMTP{
+		Addr:       "smtp.example.com:587",
+		From:       "security@example.com",
+		To:         []string{"soc@example.com"},
+		NotifyUser: true,
+		sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotTo, gotMsg = to, string(msg)
+			return nil
+		},
+	}
+	event := testEvent
+	event.Device = "evil\r\nBcc: attacker@example.com"
+	require.NoError(t, mailer.Notify(context.Background(), event))
+	require.Equal(t, []string{"soc@example.com", "alice@example.com"}, gotTo)
+	require.Contains(t, gotMsg, "Subject: New sign-in\r\n")
+	require.Contains(t, gotMsg, "Email: alice@example.com\r\n")
+	require.Contains(t, gotMsg, "Device: evil  Bcc: attacker@example.com\r\n")
+	require.NotContains(t, gotMsg, "Principal:")
+
+	event.Email = "alice@example.com\r\nBcc: attacker@example.com"
+	require.ErrorContains(t, mailer.Notify(context.Background(), event), "invalid email address")
+}
+
+func TestFilterMultiAsync(t *testing.T) {
+	var got []EventType
+	record := NotifierFunc(func(ctx context.Context, event Event) error {
+		got = append(got, event.Type)
+		return nil
+	})
+	failing := NotifierFunc(func(ctx context.Context, event Event) error {
+		return fmt.Errorf("%s failed", event.Type)
+	})
+
+	n := Multi{Filter(record, EventDeviceEnrolled), failing}
+	require.ErrorContains(t, n.Notify(context.Background(), Event{Type: EventLogin}), "login failed")
+	require.Empty(t, got)
+	require.Error(t, n.Notify(context.Background(), Event{Type: EventDeviceEnrolled}))
+	require.Equal(t, []EventType{EventDeviceEnrolled}, got)
+
+	delivered := make(chan Event, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	async := Async(NotifierFunc(func(ctx context.Context, event Event) error {
+		require.NoError(t, ctx.Err(), "the caller's cancellation doesn't stop delivery")
+		delivered <- event
+		return nil
+	}), time.Minute)
+	require.NoError(t, async.Notify(ctx, testEvent))
+	cancel()
+	require.Equal(t, testEvent, <-delivered)
+
+	// Send tolerates a nil notifier and swallows errors
+	Send(context.Background(), nil, testEvent)
+	Send(context.Background(), failing, testEvent)
+}
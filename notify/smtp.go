@@ -0,0 +1,102 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP is a Notifier that emails events as plain text through an SMTP
+// server, to the security team at To and, if NotifyUser is set, to the
+// email address of the user the event is about
+type SMTP struct {
+	Addr       string // Address of the SMTP server, e.g. "smtp.example.com:587"
+	Auth       smtp.Auth
+	From       string
+	To         []string
+	NotifyUser bool
+
+	// sendMail is replaced in tests
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+var _ Notifier = (*SMTP)(nil)
+
+var subjects = map[EventType]string{
+	EventLogin:          "New sign-in",
+	EventDeviceEnrolled: "New MFA device enrolled",
+	EventCosigned:       "Sign-in confirmed by cosigner",
+}
+
+func (s *SMTP) Notify(ctx context.Context, event Event) error {
+	to := append([]string{}, s.To...)
+	if s.NotifyUser && event.Email != "" {
+		to = append(to, event.Email)
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	for _, addr := range to {
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("invalid email address")
+		}
+	}
+
+	subject, ok := subjects[event.Type]
+	if !ok {
+		subject = "OpenPubkey " + string(event.Type)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	writeField(&msg, "Event", string(event.Type))
+	writeField(&msg, "Time", event.Time.UTC().Format(time.RFC1123))
+	writeField(&msg, "Email", event.Email)
+	writeField(&msg, "Issuer", event.Issuer)
+	writeField(&msg, "Subject", event.Subject)
+	writeField(&msg, "Source", event.Source)
+	writeField(&msg, "Device", event.Device)
+	writeField(&msg, "Principal", event.Principal)
+	msg.WriteString("\r\nIf this wasn't you, contact your security team.\r\n")
+
+	sendMail := s.sendMail
+	if sendMail == nil {
+		sendMail = smtp.SendMail
+	}
+	if err := sendMail(s.Addr, s.Auth, s.From, to, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send notification email: %w", err)
+	}
+	return nil
+}
+
+func writeField(msg *bytes.Buffer, name string, value string) {
+	if value == "" {
+		return
+	}
+	// Values come from ID Tokens and clients, keep them on their line
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	fmt.Fprintf(msg, "%s: %s\r\n", name, value)
+}
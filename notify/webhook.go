@@ -0,0 +1,116 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the timestamp
+	// header, a period and the body, prefixed with "sha256="
+	SignatureHeader = "X-Opk-Signature"
+	// TimestampHeader carries the Unix time the webhook was sent at
+	TimestampHeader = "X-Opk-Timestamp"
+)
+
+// Webhook is a Notifier that POSTs events as JSON to URL. If Secret is set
+// every request is signed so the receiver can check it came from us, see
+// VerifyWebhook.
+type Webhook struct {
+	URL        string
+	Secret     []byte
+	HTTPClient *http.Client
+}
+
+var _ Notifier = (*Webhook)(nil)
+
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(webhookMAC(w.Secret, timestamp, body)))
+	}
+
+	httpClient := w.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// VerifyWebhook checks the signature of a webhook request body signed with
+// secret and returns the event. Requests signed more than maxAge ago are
+// rejected to stop replays.
+func VerifyWebhook(secret []byte, header http.Header, body []byte, maxAge time.Duration) (*Event, error) {
+	timestamp := header.Get(TimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("missing or malformed %s header", TimestampHeader)
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > maxAge || age < -maxAge {
+		return nil, fmt.Errorf("webhook was signed %s ago, more than %s", age.Round(time.Second), maxAge)
+	}
+	sigHex, ok := strings.CutPrefix(header.Get(SignatureHeader), "sha256=")
+	if !ok {
+		return nil, fmt.Errorf("missing or malformed %s header", SignatureHeader)
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || !hmac.Equal(sig, webhookMAC(secret, timestamp, body)) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("malformed webhook event: %w", err)
+	}
+	return &event, nil
+}
+
+func webhookMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
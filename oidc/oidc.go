@@ -26,16 +26,20 @@ import (
 )
 
 type OidcClaims struct {
-	Issuer     string `json:"iss"`
-	Subject    string `json:"sub"`
-	Audience   string `json:"-"`
-	Expiration int64  `json:"exp"`
-	IssuedAt   int64  `json:"iat"`
-	Email      string `json:"email,omitempty"`
-	Nonce      string `json:"nonce,omitempty"`
-	Username   string `json:"preferred_username,omitempty"`
-	FirstName  string `json:"given_name,omitempty"`
-	LastName   string `json:"family_name,omitempty"`
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"-"`
+	// AuthorizedParty (azp) is the client the ID Token was issued to, OPs set
+	// it when the token has several audiences
+	AuthorizedParty string `json:"azp,omitempty"`
+	Expiration      int64  `json:"exp"`
+	IssuedAt        int64  `json:"iat"`
+	NotBefore       int64  `json:"nbf,omitempty"`
+	Email           string `json:"email,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	Username        string `json:"preferred_username,omitempty"`
+	FirstName       string `json:"given_name,omitempty"`
+	LastName        string `json:"family_name,omitempty"`
 }
 
 // Implement UnmarshalJSON for custom handling during JSON unmarshalling
@@ -0,0 +1,309 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package audit keeps a tamper evident record of the authorization decisions
+// made by opkssh verify. Records are appended to a local file as JSON lines,
+// each holding the hash of the record before it, so editing, removing or
+// reordering records breaks the chain. Records can also be signed, so that
+// someone who can write to the file but doesn't have the signing key can't
+// rewrite the chain from the point they tampered with. Verify checks a log.
+//
+// Records removed from the end of the log leave a valid chain behind, to
+// detect that compare the sequence number of the last record with a copy
+// kept elsewhere, e.g. shipped to a log server.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// GenesisHash is the previous hash of the first record in a log
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// maxRecordSize bounds the length of a line in the log
+const maxRecordSize = 1 << 20
+
+type Decision string
+
+const (
+	Allow Decision = "allow"
+	Deny  Decision = "deny"
+)
+
+// Record is an authorization decision. The identity claims are only set
+// once the PK Token in the certificate has been verified.
+type Record struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Issuer    string    `json:"iss,omitempty"`
+	Subject   string    `json:"sub,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	// KeyFingerprint is the SHA256 fingerprint of the SSH certificate's key
+	KeyFingerprint string   `json:"key_fingerprint,omitempty"`
+	Decision       Decision `json:"decision"`
+	Reason         string   `json:"reason,omitempty"`
+	PrevHash       string   `json:"prev_hash"`
+	// Hash is the hex encoded SHA256 hash of the record with Hash and Sig
+	// unset
+	Hash string `json:"hash"`
+	// Sig is the base64 encoded signature of Hash, if the log is signed
+	Sig string `json:"sig,omitempty"`
+}
+
+// digest returns the SHA256 hash of the record with Hash and Sig unset
+func (r Record) digest() ([]byte, error) {
+	r.Hash = ""
+	r.Sig = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// Log appends records to a file. It is safe for several processes to append
+// to the same file, as sshd runs a verify process for every login.
+type Log struct {
+	Path string
+	// Signer signs records if set, ECDSA and Ed25519 keys are supported
+	Signer crypto.Signer
+
+	now func() time.Time
+}
+
+func NewLog(path string, signer crypto.Signer) *Log {
+	return &Log{
+		Path:   path,
+		Signer: signer,
+		now:    time.Now,
+	}
+}
+
+// Append chains the record onto the end of the log and writes it, returning
+// the record as written
+func (l *Log) Append(rec Record) (*Record, error) {
+	f, err := os.OpenFile(l.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return nil, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+	defer unlockFile(f)
+
+	last, err := lastRecord(f)
+	if err != nil {
+		return nil, err
+	}
+	rec.Seq = 0
+	rec.PrevHash = GenesisHash
+	if last != nil {
+		rec.Seq = last.Seq + 1
+		rec.PrevHash = last.Hash
+	}
+	rec.Time = l.now().UTC().Round(0)
+
+	digest, err := rec.digest()
+	if err != nil {
+		return nil, err
+	}
+	rec.Hash = hex.EncodeToString(digest)
+	rec.Sig = ""
+	if l.Signer != nil {
+		sig, err := sign(l.Signer, digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign audit record: %w", err)
+		}
+		rec.Sig = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// lastRecord returns the last record in the file, or nil if it is empty. It
+// reads backwards from the end so that appending doesn't get slower as the
+// log grows.
+func lastRecord(f *os.File) (*Record, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	for window := int64(4096); ; window *= 2 {
+		start := size - window
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, size-start)
+		if _, err := f.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if buf[len(buf)-1] != '\n' {
+			return nil, fmt.Errorf("audit log %s ends with an incomplete record", f.Name())
+		}
+		buf = buf[:len(buf)-1]
+		i := bytes.LastIndexByte(buf, '\n')
+		if i < 0 && start > 0 {
+			if window >= maxRecordSize {
+				return nil, fmt.Errorf("last record in audit log %s is too large", f.Name())
+			}
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(buf[i+1:], &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse last record in audit log %s: %w", f.Name(), err)
+		}
+		return &rec, nil
+	}
+}
+
+// Verify checks that every record in the log is intact and chained to the
+// one before it, returning the number of records. If pubkey is set every
+// record must be signed by it.
+func Verify(r io.Reader, pubkey crypto.PublicKey) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxRecordSize)
+
+	prevHash := GenesisHash
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if err := verifyRecord(line, uint64(n), prevHash, pubkey); err != nil {
+			return n, fmt.Errorf("record on line %d: %w", n+1, err)
+		}
+		var rec Record
+		_ = json.Unmarshal(line, &rec)
+		prevHash = rec.Hash
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func verifyRecord(line []byte, seq uint64, prevHash string, pubkey crypto.PublicKey) error {
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	// Fields added or reformatted after the record was written wouldn't
+	// change its hash, so the line has to be exactly as it was written
+	if canonical, err := json.Marshal(rec); err != nil {
+		return err
+	} else if !bytes.Equal(canonical, line) {
+		return fmt.Errorf("record has been modified")
+	}
+	if rec.Seq != seq {
+		return fmt.Errorf("expected sequence number %d, got %d", seq, rec.Seq)
+	}
+	if rec.PrevHash != prevHash {
+		return fmt.Errorf("previous hash does not match the record before it")
+	}
+	digest, err := rec.digest()
+	if err != nil {
+		return err
+	}
+	if rec.Hash != hex.EncodeToString(digest) {
+		return fmt.Errorf("hash does not match record")
+	}
+	if pubkey == nil {
+		return nil
+	}
+	if rec.Sig == "" {
+		return fmt.Errorf("record is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(rec.Sig)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	return verifySig(pubkey, digest, sig)
+}
+
+func sign(signer crypto.Signer, digest []byte) ([]byte, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return signer.Sign(rand.Reader, digest, crypto.SHA256)
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself rather than a hash of it
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer.Public())
+	}
+}
+
+func verifySig(pubkey crypto.PublicKey, digest []byte, sig []byte) error {
+	switch pk := pubkey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pk, digest, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pk, digest, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pubkey)
+	}
+	return nil
+}
+
+// ReadPublicKeyFile reads a PEM encoded public key, such as the output of
+// openssl ec -pubout for the key records are signed with
+func ReadPublicKeyFile(fpath string) (crypto.PublicKey, error) {
+	pemBytes, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", fpath)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,243 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeLog(t *testing.T, l *Log, n int) {
+	for i := 0; i < n; i++ {
+		decision := Allow
+		if i%2 == 1 {
+			decision = Deny
+		}
+		_, err := l.Append(Record{
+			Principal: "root",
+			Issuer:    "https://accounts.example.com",
+			Subject:   "me",
+			Email:     "arthur.aardvark@example.com",
+			Decision:  decision,
+		})
+		require.NoError(t, err)
+	}
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	return lines[:len(lines)-1]
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	require.NoError(t, os.WriteFile(path, bytes.Join(lines, nil), 0600))
+}
+
+func verifyFile(t *testing.T, path string, pubkey any) (int, error) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	return Verify(f, pubkey)
+}
+
+func TestAppendAndVerify(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewLog(path, nil)
+	writeLog(t, l, 2)
+	n, err := verifyFile(t, path, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	_, err = verifyFile(t, path, &ecdsaKey.PublicKey)
+	require.ErrorContains(t, err, "not signed")
+
+	// A new log for the same file, as the next verify process would have,
+	// continues the chain
+	l = NewLog(path, ecdsaKey)
+	writeLog(t, l, 3)
+	lines := readLines(t, path)
+	require.Len(t, lines, 5)
+	_, err = verifyFile(t, path, &ecdsaKey.PublicKey)
+	require.ErrorContains(t, err, "line 1: record is not signed")
+
+	signedPath := filepath.Join(t.TempDir(), "signed.log")
+	writeLog(t, NewLog(signedPath, ecdsaKey), 3)
+	n, err = verifyFile(t, signedPath, &ecdsaKey.PublicKey)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = verifyFile(t, signedPath, edKey.Public())
+	require.ErrorContains(t, err, "invalid signature")
+
+	edPath := filepath.Join(t.TempDir(), "ed25519.log")
+	writeLog(t, NewLog(edPath, edKey), 3)
+	n, err = verifyFile(t, edPath, edKey.Public())
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = verifyFile(t, signedPath, &otherKey.PublicKey)
+	require.ErrorContains(t, err, "invalid signature")
+}
+
+func TestAppendRecordFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewLog(path, nil)
+	now := time.Date(2025, 1, 2, 3, 4, 5, 6, time.FixedZone("test", 3600))
+	l.now = func() time.Time { return now }
+
+	first, err := l.Append(Record{Principal: "root", Decision: Deny, Reason: "no policy", Seq: 7, PrevHash: "forged"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first.Seq)
+	require.Equal(t, GenesisHash, first.PrevHash)
+	require.Equal(t, now.UTC(), first.Time)
+	require.Len(t, first.Hash, 64)
+	require.Empty(t, first.Sig)
+
+	second, err := l.Append(Record{Principal: "root", Decision: Allow})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), second.Seq)
+	require.Equal(t, first.Hash, second.PrevHash)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		tamper  func(lines [][]byte) [][]byte
+		wantErr string
+	}{
+		{
+			name: "Edited field",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"decision":"deny"`), []byte(`"decision":"allow"`), 1)
+				return lines
+			},
+			wantErr: "line 2: hash does not match record",
+		},
+		{
+			name: "Added field",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`{`), []byte(`{"extra":true,`), 1)
+				return lines
+			},
+			wantErr: "line 2: record has been modified",
+		},
+		{
+			name: "Removed record",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			wantErr: "line 2: expected sequence number 1, got 2",
+		},
+		{
+			name: "Reordered records",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			wantErr: "line 2: expected sequence number 1, got 2",
+		},
+		{
+			name: "Removed first record",
+			tamper: func(lines [][]byte) [][]byte {
+				return lines[1:]
+			},
+			wantErr: "line 1: expected sequence number 0, got 1",
+		},
+		{
+			name: "Garbage",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines, []byte("not json\n"))
+			},
+			wantErr: "line 4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeLog(t, NewLog(path, key), 3)
+			writeLines(t, path, tt.tamper(readLines(t, path)))
+
+			_, err := verifyFile(t, path, &key.PublicKey)
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestAppendRejectsIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeLog(t, NewLog(path, nil), 1)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":1`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = NewLog(path, nil).Append(Record{Principal: "root", Decision: Allow})
+	require.ErrorContains(t, err, "incomplete record")
+}
+
+func TestAppendLongRecords(t *testing.T) {
+	// The last record is longer than the first window read from the end
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewLog(path, nil)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(Record{Principal: "root", Decision: Deny, Reason: strings.Repeat("x", 10000)})
+		require.NoError(t, err)
+	}
+	n, err := verifyFile(t, path, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := NewLog(path, nil).Append(Record{Principal: "root", Decision: Allow})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	n, err := verifyFile(t, path, nil)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+}
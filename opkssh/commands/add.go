@@ -33,6 +33,13 @@ type AddCmd struct {
 	//
 	// See AddCmd.LoadPolicy for more details.
 	Username string
+
+	// Group, if set, adds the user to this policy group and grants the
+	// principal to the group instead of to the user directly
+	Group string
+	// Issuer, if set, constrains the updated entry to ID Tokens issued by this
+	// OpenID provider
+	Issuer string
 }
 
 // LoadPolicy reads the opkssh policy at the policy.SystemDefaultPolicyPath. If
@@ -43,13 +50,19 @@ type AddCmd struct {
 // If successful, returns the parsed policy and filepath used to read the
 // policy. Otherwise, a non-nil error is returned.
 func (a *AddCmd) LoadPolicy() (*policy.Policy, string, error) {
+	return loadPolicy(a.PolicyFileLoader, a.Username)
+}
+
+// loadPolicy reads the system policy, or the policy of username if the
+// system policy can't be read due to permissions, see AddCmd.LoadPolicy
+func loadPolicy(loader *policy.FileLoader, username string) (*policy.Policy, string, error) {
 	// Try to read system policy first
-	systemPolicy, err := a.PolicyFileLoader.LoadSystemDefaultPolicy()
+	systemPolicy, err := loader.LoadSystemDefaultPolicy()
 	if err != nil {
 		if errors.Is(err, os.ErrPermission) {
 			// If current process doesn't have permission, try reading the user
 			// policy file.
-			userPolicy, policyFilePath, err := a.PolicyFileLoader.LoadUserPolicy(a.Username, false)
+			userPolicy, policyFilePath, err := loader.LoadUserPolicy(username, false)
 			if err != nil {
 				return nil, "", err
 			}
@@ -65,22 +78,29 @@ func (a *AddCmd) LoadPolicy() (*policy.Policy, string, error) {
 }
 
 // Add adds a new allowed principal to the user whose email is equal to
-// userEmail. The current policy file is read and modified.
+// userEmail, or to AddCmd.Group after adding the user to it. The current policy
+// file is read and modified, keeping its other groups and entries intact.
+// The file is locked while it is modified, see policy.FileLoader.Update
 //
 // If successful, returns the policy filepath updated. Otherwise, returns a
 // non-nil error
 func (a *AddCmd) Add(userEmail string, principal string) (string, error) {
-	// Read current policy
-	currentPolicy, policyFilePath, err := a.LoadPolicy()
+	// Find the policy file to update
+	_, policyFilePath, err := a.LoadPolicy()
 	if err != nil {
 		return "", fmt.Errorf("failed to load current policy: %w", err)
 	}
 
-	// Update policy
-	currentPolicy.AddAllowedPrincipal(principal, userEmail)
-
-	// Dump contents back to disk
-	err = a.PolicyFileLoader.Dump(currentPolicy, policyFilePath)
+	// Update policy and dump contents back to disk
+	err = a.PolicyFileLoader.Update(policyFilePath, func(currentPolicy *policy.Policy) error {
+		if a.Group != "" {
+			currentPolicy.AddGroupMember(a.Group, userEmail)
+			currentPolicy.AddAllowedGroupPrincipal(principal, a.Group, a.Issuer)
+		} else {
+			currentPolicy.AddAllowedPrincipalForIssuer(principal, userEmail, a.Issuer)
+		}
+		return nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to write updated policy: %w", err)
 	}
@@ -0,0 +1,223 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"golang.org/x/crypto/ssh"
+)
+
+// CASignPath is where the handler returned by NewCAHandler signs
+// certificates
+const CASignPath = "/sign"
+
+// maxCARequestSize bounds the opkssh certificates the CA reads, they are
+// well within it even with large PK Tokens
+const maxCARequestSize = 1 << 20
+
+// CACmd is a site-operated SSH certificate authority. It verifies the PK
+// Token in the certificate written by opkssh login and issues a standard
+// certificate for the same key, signed by the CA key, which hosts trust
+// with sshd's TrustedUserCAKeys. Hosts then don't need to run opkssh verify
+// as an AuthorizedKeysCommand.
+type CACmd struct {
+	// Verify checks the opkssh certificate for each principal it asks for,
+	// exactly as opkssh verify on a host would. Policy entries scoped to
+	// hosts should not apply, as the CA doesn't know which hosts the
+	// certificate will be used on.
+	Verify *VerifyCmd
+	// Signer is the CA key, e.g. read from a file or a kms.Signer
+	Signer crypto.Signer
+	// Validity is how long issued certificates are valid for. They are
+	// never valid for longer than the opkssh certificate.
+	Validity time.Duration
+}
+
+// Sign verifies cert, an opkssh certificate self-signed by the key in its
+// PK Token, and returns a certificate signed by the CA for the same key and
+// principals
+func (c *CACmd) Sign(ctx context.Context, cert *ssh.Certificate) (*ssh.Certificate, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+	opkCert := &sshcert.SshCertSmuggler{SshCert: cert}
+	// Security key certificates are signed by the key in the PK Token
+	// instead, which verifying them checks
+	if !sshcert.IsSKKey(cert.Key) && !bytes.Equal(cert.SignatureKey.Marshal(), cert.Key.Marshal()) {
+		return nil, fmt.Errorf("certificate is not self-signed")
+	}
+	if err := opkCert.VerifyCaSig(cert.SignatureKey); err != nil {
+		return nil, fmt.Errorf("invalid certificate signature: %w", err)
+	}
+
+	typArg := cert.Type()
+	certB64Arg := base64.StdEncoding.EncodeToString(cert.Marshal())
+	for _, principal := range cert.ValidPrincipals {
+		if _, err := c.Verify.AuthorizedKeysCommand(ctx, principal, typArg, certB64Arg); err != nil {
+			return nil, fmt.Errorf("principal %s: %w", principal, err)
+		}
+	}
+
+	pkt, err := opkCert.GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	// The key ID is the subject so that sshcert.NewKRL can revoke it
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, err
+	}
+	// Permissions chosen at login are kept unless verify strips them, the
+	// PK Token is left out as hosts don't check it
+	extensions := map[string]string{}
+	for name, value := range cert.Extensions {
+		if !strings.HasPrefix(name, sshcert.ExtensionPrefix) && !slices.Contains(c.Verify.StrippedExtensions, name) {
+			extensions[name] = value
+		}
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	caCert := &sshcert.SshCertSmuggler{
+		SshCert: &ssh.Certificate{
+			Key:             cert.Key,
+			Serial:          binary.BigEndian.Uint64(serial[:]),
+			CertType:        ssh.UserCert,
+			KeyId:           claims.Subject,
+			ValidPrincipals: cert.ValidPrincipals,
+			Permissions:     ssh.Permissions{Extensions: extensions},
+		},
+	}
+	caCert.SetValidity(time.Now(), c.Validity)
+	if caCert.SshCert.ValidBefore > cert.ValidBefore {
+		caCert.SshCert.ValidBefore = cert.ValidBefore
+	}
+	signer, err := sshcert.NewSigner(c.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return caCert.SignCert(signer)
+}
+
+// NewCAHandler serves the CA at CASignPath. Clients send
+//
+//	POST /sign
+//	Content-Type: text/plain
+//
+//	<opkssh certificate in authorized_keys format>
+//
+// and get back 200 OK with the CA-signed certificate in authorized_keys
+// format, 400 Bad Request if the body isn't a certificate or 403 Forbidden
+// if the CA doesn't issue it. Login with WithCA sends these requests.
+func NewCAHandler(c *CACmd) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(CASignPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCARequestSize))
+		if err != nil {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey(body)
+		if err != nil {
+			http.Error(w, "malformed SSH certificate", http.StatusBadRequest)
+			return
+		}
+		cert, ok := pubkey.(*ssh.Certificate)
+		if !ok {
+			http.Error(w, "not an SSH certificate", http.StatusBadRequest)
+			return
+		}
+		caCert, err := c.Sign(r.Context(), cert)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(ssh.MarshalAuthorizedKey(caCert))
+	})
+	return mux
+}
+
+// requestCACert sends the opkssh certificate certBytes to the CA at caURL
+// and returns the certificate it signs, both in authorized_keys format
+func requestCACert(ctx context.Context, httpClient *http.Client, caURL string, certBytes []byte) ([]byte, error) {
+	signURI, err := url.JoinPath(caURL, CASignPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, signURI, bytes.NewReader(certBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting certificate from CA: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("CA returned error status: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxCARequestSize))
+	if err != nil {
+		return nil, err
+	}
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed certificate from CA: %w", err)
+	}
+	caCert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("CA did not return a certificate")
+	}
+	sent, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	if sentCert, ok := sent.(*ssh.Certificate); !ok || !bytes.Equal(caCert.Key.Marshal(), sentCert.Key.Marshal()) {
+		return nil, fmt.Errorf("CA returned a certificate for another key")
+	}
+	return bytes.TrimSuffix(ssh.MarshalAuthorizedKey(caCert), []byte("\n")), nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCA(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, jwa.ES256)
+	require.NoError(t, err)
+	extensions := certExtensions{remove: []string{sshcert.ExtPermitPortForwarding}}
+	certBytes, _, err := createSSHCert(pkt, signer, []string{"guest", "dev"}, time.Hour, extensions)
+	require.NoError(t, err)
+	typArg, certB64Arg, _ := strings.Cut(string(certBytes), " ")
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	require.NoError(t, err)
+	cert := pubkey.(*ssh.Certificate)
+
+	// Allow the logins in the cache, verifying the PK Token needs the OP
+	cache := &VerifyCache{Fs: afero.NewMemMapFs(), Path: "/var/cache/opk/verify.json", TTL: time.Minute}
+	cache.Allow(verifyCacheKey("guest", typArg, certB64Arg), time.Now().Add(time.Hour))
+	cache.Allow(verifyCacheKey("dev", typArg, certB64Arg), time.Now().Add(time.Hour))
+	caKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	ca := &CACmd{Verify: &VerifyCmd{Cache: cache}, Signer: caKey, Validity: 24 * time.Hour}
+
+	caCert, err := ca.Sign(ctx, cert)
+	require.NoError(t, err)
+	caPubkey, err := ssh.NewPublicKey(caKey.Public())
+	require.NoError(t, err)
+	require.Equal(t, caPubkey.Marshal(), caCert.SignatureKey.Marshal())
+	require.Equal(t, cert.Key.Marshal(), caCert.Key.Marshal())
+	require.Equal(t, []string{"guest", "dev"}, caCert.ValidPrincipals)
+	require.Equal(t, "me", caCert.KeyId)
+	// Never valid for longer than the opkssh certificate
+	require.Equal(t, cert.ValidBefore, caCert.ValidBefore)
+	require.Contains(t, caCert.Extensions, sshcert.ExtPermitPTY)
+	require.NotContains(t, caCert.Extensions, sshcert.ExtPermitPortForwarding)
+	for name := range caCert.Extensions {
+		require.False(t, strings.HasPrefix(name, sshcert.ExtensionPrefix), name)
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caPubkey.Marshal())
+		},
+	}
+	require.NoError(t, checker.CheckCert("guest", caCert))
+
+	// Extensions verify strips aren't granted by the CA either
+	ca.Verify.StrippedExtensions = []string{sshcert.ExtPermitAgentForwarding, sshcert.ExtPermitX11Forwarding}
+	require.Contains(t, cert.Extensions, sshcert.ExtPermitAgentForwarding)
+	strippedCert, err := ca.Sign(ctx, cert)
+	require.NoError(t, err)
+	require.Contains(t, strippedCert.Extensions, sshcert.ExtPermitPTY)
+	require.NotContains(t, strippedCert.Extensions, sshcert.ExtPermitAgentForwarding)
+	require.NotContains(t, strippedCert.Extensions, sshcert.ExtPermitX11Forwarding)
+	ca.Verify.StrippedExtensions = nil
+
+	// Each principal must be allowed
+	rootCertBytes, _, err := createSSHCert(pkt, signer, []string{"guest", "root"}, time.Hour, extensions)
+	require.NoError(t, err)
+	typArg, certB64Arg, _ = strings.Cut(string(rootCertBytes), " ")
+	cache.Allow(verifyCacheKey("guest", typArg, certB64Arg), time.Now().Add(time.Hour))
+	rootCert, _, _, _, err := ssh.ParseAuthorizedKey(rootCertBytes)
+	require.NoError(t, err)
+	_, err = ca.Sign(ctx, rootCert.(*ssh.Certificate))
+	require.ErrorContains(t, err, "principal root")
+
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	require.NoError(t, err)
+	cert.ValidPrincipals = nil
+	require.NoError(t, cert.SignCert(rand.Reader, sshSigner))
+	_, err = ca.Sign(ctx, cert)
+	require.ErrorContains(t, err, "no principals")
+
+	otherKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	otherSigner, err := ssh.NewSignerFromSigner(otherKey)
+	require.NoError(t, err)
+	cert.ValidPrincipals = []string{"guest"}
+	require.NoError(t, cert.SignCert(rand.Reader, otherSigner))
+	_, err = ca.Sign(ctx, cert)
+	require.ErrorContains(t, err, "not self-signed")
+}
+
+func TestCAHandler(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, jwa.ES256)
+	require.NoError(t, err)
+	certBytes, _, err := createSSHCert(pkt, signer, []string{"guest"}, time.Hour, certExtensions{})
+	require.NoError(t, err)
+	typArg, certB64Arg, _ := strings.Cut(string(certBytes), " ")
+
+	cache := &VerifyCache{Fs: afero.NewMemMapFs(), Path: "/var/cache/opk/verify.json", TTL: time.Minute}
+	cache.Allow(verifyCacheKey("guest", typArg, certB64Arg), time.Now().Add(time.Hour))
+	caKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	server := httptest.NewServer(NewCAHandler(&CACmd{Verify: &VerifyCmd{Cache: cache}, Signer: caKey, Validity: time.Hour}))
+	defer server.Close()
+
+	caCertBytes, err := requestCACert(ctx, server.Client(), server.URL, certBytes)
+	require.NoError(t, err)
+	caCert, _, _, _, err := ssh.ParseAuthorizedKey(caCertBytes)
+	require.NoError(t, err)
+	caPubkey, err := ssh.NewPublicKey(caKey.Public())
+	require.NoError(t, err)
+	require.Equal(t, caPubkey.Marshal(), caCert.(*ssh.Certificate).SignatureKey.Marshal())
+
+	// Not allowed for the principal, verifying the PK Token fails without an OP
+	otherCert, _, err := createSSHCert(pkt, signer, []string{"root"}, time.Hour, certExtensions{})
+	require.NoError(t, err)
+	_, err = requestCACert(ctx, server.Client(), server.URL, otherCert)
+	require.ErrorContains(t, err, "403 Forbidden")
+
+	res, err := server.Client().Post(server.URL+CASignPath, "text/plain", strings.NewReader("not a certificate"))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = server.Client().Get(server.URL + CASignPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
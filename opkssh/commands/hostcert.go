@@ -0,0 +1,77 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// DefaultHostKeyPath is where HostCert writes the host key, point sshd at it
+// and its certificate with
+//
+//	HostKey /etc/ssh/opkssh_host_ecdsa_key
+//	HostCertificate /etc/ssh/opkssh_host_ecdsa_key-cert.pub
+const DefaultHostKeyPath = "/etc/ssh/opkssh_host_ecdsa_key"
+
+// HostCert gets a PK Token for a fresh host key from provider, typically a
+// workload identity provider such as GitHub Actions, and writes the key to
+// keyPath and a host certificate for hostnames to keyPath-cert.pub. The
+// certificate is valid for validity, or forever if zero.
+func HostCert(ctx context.Context, provider client.OpenIdProvider, hostnames []string, keyPath string, validity time.Duration) error {
+	if len(hostnames) == 0 {
+		return fmt.Errorf("at least one hostname is required")
+	}
+
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return fmt.Errorf("failed to generate keypair: %w", err)
+	}
+	opkClient, err := client.New(provider, client.WithSigner(signer, alg))
+	if err != nil {
+		return err
+	}
+	pkt, err := opkClient.Auth(ctx)
+	if err != nil {
+		return err
+	}
+
+	cert, err := sshcert.NewHost(pkt, hostnames)
+	if err != nil {
+		return err
+	}
+	certBytes, seckeySshPem, err := signSSHCert(cert, signer, validity)
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH host cert: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0755); err != nil {
+		return err
+	}
+	return writeKeys(keyPath, keyPath+"-cert.pub", seckeySshPem, certBytes)
+}
@@ -0,0 +1,101 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/verifier"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKRLPath is where opkssh krl writes the KRL
+const DefaultKRLPath = "/etc/ssh/opk_revoked_keys"
+
+// KRLCmd writes an OpenSSH Key Revocation List revoking the certificates
+// opkssh ca issued to the subjects of a revocation list, for hosts that
+// trust the CA and name the KRL with RevokedKeys in sshd_config
+type KRLCmd struct {
+	// Path is the revocation list, DefaultRevocationListPath if empty. A
+	// missing list revokes nothing.
+	Path string
+	// CAKeyPath is the public key of the CA, without it the KRL revokes the
+	// certificates of any CA
+	CAKeyPath string
+	// Serials revokes individual certificates of the CA
+	Serials []uint64
+	// OutPath is where the KRL is written, DefaultKRLPath if empty
+	OutPath string
+}
+
+// Write writes the KRL and returns the entries of the revocation list that
+// can't be expressed in one
+func (k *KRLCmd) Write() ([]verifier.RevocationEntry, error) {
+	var caKey ssh.PublicKey
+	if k.CAKeyPath != "" {
+		caKeyBytes, err := os.ReadFile(k.CAKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if caKey, _, _, _, err = ssh.ParseAuthorizedKey(caKeyBytes); err != nil {
+			return nil, fmt.Errorf("failed to parse CA public key %s: %w", k.CAKeyPath, err)
+		}
+	}
+
+	path := k.Path
+	if path == "" {
+		path = DefaultRevocationListPath
+	}
+	var list verifier.RevocationList
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(content, &list); err != nil {
+			return nil, fmt.Errorf("malformed revocation list %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	outPath := k.OutPath
+	if outPath == "" {
+		outPath = DefaultKRLPath
+	}
+
+	krl, skipped := sshcert.NewKRL(caKey, &list)
+	krl.Serials = k.Serials
+	krl.Generated = time.Now()
+	// sshd doesn't compare versions, but ssh-keygen -Q -l shows it
+	krl.Version = uint64(krl.Generated.Unix())
+	krl.Comment = "generated by opkssh from " + path
+
+	// sshd rereads the KRL for every login, so it must never see a
+	// partially written one
+	tmp, err := writeTempFile(outPath, krl.Marshal(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	if err := os.Rename(tmp, outPath); err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
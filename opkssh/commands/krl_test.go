@@ -0,0 +1,69 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKRL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "revoked")
+	outPath := filepath.Join(dir, "revoked_keys")
+	caKeyPath := filepath.Join(dir, "ca.pub")
+
+	caKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	caPubkey, err := ssh.NewPublicKey(caKey.Public())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(caKeyPath, ssh.MarshalAuthorizedKey(caPubkey), 0644))
+
+	// A missing revocation list revokes nothing
+	k := &KRLCmd{Path: path, CAKeyPath: caKeyPath, OutPath: outPath}
+	skipped, err := k.Write()
+	require.NoError(t, err)
+	require.Empty(t, skipped)
+	krl, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(krl), "alice")
+
+	_, err = (&RevokeCmd{Path: path, Issuer: "mockIssuer", Subject: "alice"}).Revoke()
+	require.NoError(t, err)
+	_, err = (&RevokeCmd{Path: path, Issuer: "mockIssuer", TokenID: "1234"}).Revoke()
+	require.NoError(t, err)
+	k.Serials = []uint64{42}
+	skipped, err = k.Write()
+	require.NoError(t, err)
+	require.Len(t, skipped, 1)
+	require.Equal(t, "1234", skipped[0].JTI)
+	krl, err = os.ReadFile(outPath)
+	require.NoError(t, err)
+	require.Contains(t, string(krl), "alice")
+	require.True(t, bytes.Contains(krl, caPubkey.Marshal()))
+
+	k.CAKeyPath = path
+	_, err = k.Write()
+	require.ErrorContains(t, err, "failed to parse CA public key")
+}
@@ -19,19 +19,19 @@ package commands
 import (
 	"context"
 	"crypto"
-	"encoding/base64"
-	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/opkssh/device"
 	"github.com/openpubkey/openpubkey/opkssh/sshcert"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
@@ -39,20 +39,239 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// DefaultCertValidity is how long the SSH certificates written by the login
+// command are valid for
+const DefaultCertValidity = 24 * time.Hour
+
 type loginResult struct {
 	pkt        *pktoken.PKToken
 	signer     crypto.Signer
 	alg        jwa.SignatureAlgorithm
 	client     *client.OpkClient
 	principals []string
+	validity   time.Duration
+	// skKeyPath is the public key file of the security key the certificate
+	// is for, if any
+	skKeyPath  string
+	skKey      ssh.PublicKey
+	extensions certExtensions
+	// pubkeyPath is the certificate file of the existing key the PK Token
+	// is for, if one is reused
+	pubkeyPath string
+	caURL      string
+}
+
+type loginOptions struct {
+	deviceInventory bool
+	certValidity    time.Duration
+	renewable       bool
+	skKeyPath       string
+	keyAlg          jwa.SignatureAlgorithm
+	extensions      certExtensions
+	keepKey         bool
+	caURL           string
+	principals      []string
+}
+
+// certExtensions are the changes to the extensions sshcert.New sets
+type certExtensions struct {
+	set          map[string]string
+	remove       []string
+	compressPKT  bool
+	pktChunkSize int
+}
+
+// apply compresses and chunks the PK Token if asked to and then removes and
+// sets extensions of cert
+func (e certExtensions) apply(cert *sshcert.SshCertSmuggler) error {
+	if e.compressPKT {
+		if err := cert.CompressPKT(); err != nil {
+			return err
+		}
+	}
+	if e.pktChunkSize > 0 {
+		if err := cert.ChunkPKT(e.pktChunkSize); err != nil {
+			return err
+		}
+	}
+	for _, name := range e.remove {
+		if err := cert.RemoveExtension(name); err != nil {
+			return err
+		}
+	}
+	for name, value := range e.set {
+		if err := cert.SetExtension(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoginOpts configures Login and LoginWithRefresh
+type LoginOpts func(o *loginOptions)
+
+// WithDeviceInventory signs the posture of this device, such as its hostname
+// and whether its disk is encrypted, into the PK Token so that policy on the
+// SSH server can require it
+func WithDeviceInventory() LoginOpts {
+	return func(o *loginOptions) {
+		o.deviceInventory = true
+	}
+}
+
+// WithCertValidity limits the SSH certificate to being valid for d. If unset
+// the certificate is valid forever, it is then only accepted while the ID
+// Token in it is.
+func WithCertValidity(d time.Duration) LoginOpts {
+	return func(o *loginOptions) {
+		o.certValidity = d
+	}
+}
+
+// WithRenewal stores the refresh token issued by the OpenID Provider so that
+// Renew can mint a fresh certificate later without the browser flow. The
+// refresh token is written to ~/.opk/refresh_token readable only by the user.
+func WithRenewal() LoginOpts {
+	return func(o *loginOptions) {
+		o.renewable = true
+	}
+}
+
+// WithKeyAlgorithm sets the algorithm of the generated key, jwa.ES256 (the
+// default) or jwa.EdDSA for an Ed25519 key
+func WithKeyAlgorithm(alg jwa.SignatureAlgorithm) LoginOpts {
+	return func(o *loginOptions) {
+		o.keyAlg = alg
+	}
+}
+
+// WithSecurityKey writes a certificate for the FIDO security key whose
+// public key, e.g. generated by ssh-keygen -t ecdsa-sk, is at pubkeyPath
+// instead of generating a key. The certificate is written next to the
+// public key with the suffix -cert.pub, where ssh finds it, and the private
+// key never leaves the security key.
+func WithSecurityKey(pubkeyPath string) LoginOpts {
+	return func(o *loginOptions) {
+		o.skKeyPath = pubkeyPath
+	}
+}
+
+// WithExtension sets the extension name to value in the SSH certificate,
+// either a standard one such as sshcert.ExtNoTouchRequired or a custom one
+// named name@domain
+func WithExtension(name string, value string) LoginOpts {
+	return func(o *loginOptions) {
+		if o.extensions.set == nil {
+			o.extensions.set = map[string]string{}
+		}
+		o.extensions.set[name] = value
+	}
+}
+
+// WithoutExtension removes the extension name, e.g. one of
+// sshcert.DefaultUserExtensions, from the SSH certificate
+func WithoutExtension(name string) LoginOpts {
+	return func(o *loginOptions) {
+		o.extensions.remove = append(o.extensions.remove, name)
+	}
+}
+
+// WithExistingKey reuses the SSH key written by an earlier login, if there
+// is one of the requested algorithm, and only replaces its certificate.
+// Replacing the key would break ssh-agent sessions and multiplexed
+// connections that hold it.
+func WithExistingKey() LoginOpts {
+	return func(o *loginOptions) {
+		o.keepKey = true
+	}
+}
+
+// WithCompressedPKT compresses the PK Token in the SSH certificate, see
+// sshcert.SshCertSmuggler.CompressPKT. SSH servers need an opkssh verify
+// that knows extension schema version 2.
+func WithCompressedPKT() LoginOpts {
+	return func(o *loginOptions) {
+		o.extensions.compressPKT = true
+	}
+}
+
+// WithPKTChunkSize splits the PK Token in the SSH certificate across
+// extensions of at most chunkSize bytes, see sshcert.SshCertSmuggler.ChunkPKT.
+// SSH servers need an opkssh verify that knows extension schema version 3.
+func WithPKTChunkSize(chunkSize int) LoginOpts {
+	return func(o *loginOptions) {
+		o.extensions.pktChunkSize = chunkSize
+	}
+}
+
+// caRequestTimeout bounds how long login waits for the CA to sign the
+// certificate
+const caRequestTimeout = 30 * time.Second
+
+// WithCA has the CA at caURL, see NewCAHandler, sign the SSH certificate so
+// that hosts which trust the CA accept it without running opkssh verify.
+// The CA only signs certificates for principals, see WithPrincipals.
+func WithCA(caURL string) LoginOpts {
+	return func(o *loginOptions) {
+		o.caURL = caURL
+	}
+}
+
+// WithPrincipals sets the principals the SSH certificate is for. opkssh
+// verify ignores them and checks policy for the requested user instead.
+func WithPrincipals(principals ...string) LoginOpts {
+	return func(o *loginOptions) {
+		o.principals = append(o.principals, principals...)
+	}
 }
 
-func login(ctx context.Context, provider client.OpenIdProvider) (*loginResult, error) {
+func login(ctx context.Context, provider client.OpenIdProvider, opts ...LoginOpts) (*loginResult, error) {
+	options := &loginOptions{}
+	for _, applyOpt := range opts {
+		applyOpt(options)
+	}
+
 	var err error
 	alg := jwa.ES256
-	signer, err := util.GenKeyPair(alg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+	if options.keyAlg != "" {
+		alg = options.keyAlg
+	}
+	if _, ok := sshKeyFilenames[alg]; !ok {
+		return nil, fmt.Errorf("unsupported key algorithm %s", alg)
+	}
+	// Catch bad extensions before the user goes through the browser flow
+	emptyCert := &sshcert.SshCertSmuggler{SshCert: &ssh.Certificate{CertType: ssh.UserCert}}
+	if err := (certExtensions{set: options.extensions.set, remove: options.extensions.remove}).apply(emptyCert); err != nil {
+		return nil, err
+	}
+	if options.caURL != "" {
+		if len(options.principals) == 0 {
+			return nil, fmt.Errorf("the CA only signs certificates for the principals requested")
+		}
+		// The CA-signed certificate has no PK Token to renew
+		if options.renewable {
+			return nil, fmt.Errorf("certificates signed by a CA can't be renewed, log in again instead")
+		}
+	}
+	if options.keepKey && options.skKeyPath != "" {
+		return nil, fmt.Errorf("the key of a security key certificate is never reused")
+	}
+	var signer crypto.Signer
+	var existingPubkeyPath string
+	if options.keepKey {
+		if key, err := readOpkKey(); err != nil {
+			log.Println("not reusing SSH key:", err)
+		} else if sshKeyAlgorithm[alg] != key.cert.Key.Type() {
+			log.Printf("not reusing %s SSH key %s, %s was requested", key.cert.Key.Type(), key.seckeyPath, alg)
+		} else {
+			log.Printf("reusing SSH key %s", key.seckeyPath)
+			signer, existingPubkeyPath = key.signer, key.pubkeyPath
+		}
+	}
+	if signer == nil {
+		if signer, err = util.GenKeyPair(alg); err != nil {
+			return nil, fmt.Errorf("failed to generate keypair: %w", err)
+		}
 	}
 
 	opkClient, err := client.New(provider, client.WithSigner(signer, alg))
@@ -60,116 +279,230 @@ func login(ctx context.Context, provider client.OpenIdProvider) (*loginResult, e
 		return nil, err
 	}
 
-	pkt, err := opkClient.Auth(ctx)
+	authOpts := []client.AuthOpts{}
+	var skKey ssh.PublicKey
+	if options.skKeyPath != "" {
+		if skKey, err = readSKKey(options.skKeyPath); err != nil {
+			return nil, err
+		}
+		authOpts = append(authOpts, sshcert.SKAuthOpts(skKey))
+	}
+	if options.deviceInventory {
+		info := device.Collect(ctx)
+		log.Printf("including device info in PK Token: hostname=%q os=%q os_version=%q disk_encrypted=%s",
+			info.Hostname, info.OS, info.OSVersion, formatDiskEncrypted(info.DiskEncrypted))
+		authOpts = append(authOpts, info.AuthOpts())
+	}
+
+	pkt, err := opkClient.Auth(ctx, authOpts...)
 	if err != nil {
 		return nil, err
 	}
 
 	// If principals is empty the server does not enforce any principal. The OPK
 	// verifier should use policy to make this decision.
-	principals := []string{}
-	certBytes, seckeySshPem, err := createSSHCert(ctx, pkt, signer, principals)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate SSH cert: %w", err)
-	}
-
-	// Write ssh secret key and public key to filesystem
-	if err := writeKeysToSSHDir(seckeySshPem, certBytes); err != nil {
-		return nil, fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
+	principals := options.principals
+	if principals == nil {
+		principals = []string{}
 	}
-
-	return &loginResult{
+	result := &loginResult{
 		pkt:        pkt,
 		signer:     signer,
 		client:     opkClient,
 		alg:        alg,
 		principals: principals,
-	}, nil
-}
+		caURL:      options.caURL,
+		validity:   options.certValidity,
+		skKeyPath:  options.skKeyPath,
+		skKey:      skKey,
+		extensions: options.extensions,
+		pubkeyPath: existingPubkeyPath,
+	}
+	if err := result.writeCert(ctx); err != nil {
+		return nil, err
+	}
 
-// Login performs the OIDC login procedure and creates the SSH certs/keys in the
-// default SSH key location.
-func Login(ctx context.Context, provider client.OpenIdProvider) error {
-	_, err := login(ctx, provider)
-	return err
+	if options.renewable {
+		refreshToken := opkClient.GetRefreshToken()
+		if refreshToken == nil {
+			return nil, fmt.Errorf("OpenID Provider did not issue a refresh token, the certificate can't be renewed")
+		}
+		if err := writeRefreshToken(refreshToken); err != nil {
+			return nil, fmt.Errorf("failed to write refresh token: %w", err)
+		}
+	}
+
+	return result, nil
 }
 
-// LoginWithRefresh performs the OIDC login procedure, creates the SSH
-// certs/keys in the default SSH key location, and continues to run and refresh
-// the PKT (and create new SSH certs) indefinitely as its token expires. This
-// function only returns if it encounters an error or if the supplied context is
-// cancelled.
-func LoginWithRefresh(ctx context.Context, provider providers.RefreshableOpenIdProvider) error {
-	if loginResult, err := login(ctx, provider); err != nil {
-		return err
-	} else {
-		var claims struct {
-			Expiration int64 `json:"exp"`
+// writeCert creates an SSH certificate for the PK Token and writes it along
+// with its key or, for a security key, next to the security key
+func (r *loginResult) writeCert(ctx context.Context) error {
+	var certBytes, seckeySshPem []byte
+	var err error
+	if r.skKey != nil {
+		var cert *sshcert.SshCertSmuggler
+		if cert, err = sshcert.NewSK(r.pkt, r.skKey, r.principals); err == nil {
+			if err = r.extensions.apply(cert); err == nil {
+				// The key in the PK Token only signs the certificate
+				certBytes, _, err = signSSHCert(cert, r.signer, r.validity)
+			}
 		}
-		if err := json.Unmarshal(loginResult.pkt.Payload, &claims); err != nil {
+	} else if r.pubkeyPath != "" {
+		certBytes, err = r.renewSSHCert()
+	} else {
+		certBytes, seckeySshPem, err = createSSHCert(r.pkt, r.signer, r.principals, r.validity, r.extensions)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH cert: %w", err)
+	}
+
+	if r.caURL != "" {
+		httpClient := &http.Client{Timeout: caRequestTimeout}
+		if certBytes, err = requestCACert(ctx, httpClient, r.caURL, certBytes); err != nil {
 			return err
 		}
+	}
 
-		for {
-			// Sleep until a minute before expiration to give us time to refresh
-			// the token and minimize any interruptions
-			untilExpired := time.Until(time.Unix(claims.Expiration, 0)) - time.Minute
-			log.Printf("Waiting for %v before attempting to refresh id_token...", untilExpired)
-			select {
-			case <-time.After(untilExpired):
-				log.Print("Refreshing id_token...")
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+	// Don't leave keys behind if the user gave up (e.g. ctrl+c) while we
+	// were generating them
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-			refreshedPkt, err := loginResult.client.Refresh(ctx)
-			if err != nil {
-				return err
-			}
-			loginResult.pkt = refreshedPkt
+	if r.skKey != nil {
+		if err := writeSKCert(r.skKeyPath, certBytes); err != nil {
+			return fmt.Errorf("failed to write SSH certificate to filesystem: %w", err)
+		}
+		return nil
+	}
+	if r.pubkeyPath != "" {
+		if err := writeCertFile(r.pubkeyPath, certBytes); err != nil {
+			return fmt.Errorf("failed to write SSH certificate to filesystem: %w", err)
+		}
+		return nil
+	}
+	// Write ssh secret key and public key to filesystem
+	if err := writeKeysToSSHDir(sshKeyFilenames[r.alg], seckeySshPem, certBytes); err != nil {
+		return fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
+	}
+	return nil
+}
 
-			certBytes, seckeySshPem, err := createSSHCert(ctx, loginResult.pkt, loginResult.signer, loginResult.principals)
-			if err != nil {
-				return fmt.Errorf("failed to generate SSH cert: %w", err)
-			}
+// renewSSHCert creates an SSH certificate for the reused key
+func (r *loginResult) renewSSHCert() ([]byte, error) {
+	sshPubkey, err := ssh.NewPublicKey(r.signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := sshcert.Renew(r.pkt, sshPubkey)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.extensions.apply(cert); err != nil {
+		return nil, err
+	}
+	certBytes, _, err := signSSHCert(cert, r.signer, r.validity)
+	return certBytes, err
+}
 
-			// Write ssh secret key and public key to filesystem
-			if err := writeKeysToSSHDir(seckeySshPem, certBytes); err != nil {
-				return fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
-			}
+// readSKKey reads the public key of a security key from an authorized_keys
+// formatted file
+func readSKKey(pubkeyPath string) (ssh.PublicKey, error) {
+	pubkeyBytes, err := os.ReadFile(pubkeyPath)
+	if err != nil {
+		return nil, err
+	}
+	skKey, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH public key %s: %w", pubkeyPath, err)
+	}
+	if !sshcert.IsSKKey(skKey) {
+		return nil, fmt.Errorf("%s holds a %s key, not a security key", pubkeyPath, skKey.Type())
+	}
+	return skKey, nil
+}
 
-			comPkt, err := refreshedPkt.Compact()
-			if err != nil {
-				return err
-			}
+// writeSKCert writes the certificate for the security key whose public key
+// is at pubkeyPath, where ssh looks for it
+func writeSKCert(pubkeyPath string, certBytes []byte) error {
+	return writeCertFile(strings.TrimSuffix(pubkeyPath, ".pub")+"-cert.pub", certBytes)
+}
 
-			_, payloadB64, _, err := jws.SplitCompactString(string(comPkt))
-			if err != nil {
-				return fmt.Errorf("malformed ID token: %w", err)
-			}
-			payload, err := base64.RawURLEncoding.DecodeString(string(payloadB64))
-			if err != nil {
-				return fmt.Errorf("refreshed ID token payload is not base64 encoded: %w", err)
-			}
+// writeCertFile replaces the certificate at certPath, leaving its key as
+// it is
+func writeCertFile(certPath string, certBytes []byte) error {
+	log.Printf("writing opk ssh certificate to %s", certPath)
+	certBytes = append(certBytes, []byte(" openpubkey")...)
+	tmp, err := writeTempFile(certPath, certBytes, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, certPath)
+}
 
-			if err = json.Unmarshal(payload, &claims); err != nil {
-				return fmt.Errorf("malformed refreshed ID token payload: %w", err)
-			}
+// Login performs the OIDC login procedure and creates the SSH certs/keys in the
+// default SSH key location.
+func Login(ctx context.Context, provider client.OpenIdProvider, opts ...LoginOpts) error {
+	_, err := login(ctx, provider, opts...)
+	return err
+}
+
+// LoginWithRefresh performs the OIDC login procedure, creates the SSH
+// certs/keys in the default SSH key location, and continues to run and refresh
+// the PKT (and create new SSH certs) indefinitely as its token expires. If
+// refreshing fails it logs in again. This function only returns if it fails
+// to write a cert or if the supplied context is cancelled.
+func LoginWithRefresh(ctx context.Context, provider providers.RefreshableOpenIdProvider, opts ...LoginOpts) error {
+	loginResult, err := login(ctx, provider, opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	refresher := client.NewRefresher(loginResult.client)
+	refresher.Subscribe(func(pkt *pktoken.PKToken, err error) {
+		if err != nil {
+			log.Printf("Failed to refresh id_token: %v", err)
+			return
+		}
+		loginResult.pkt = pkt
+		if err := loginResult.writeCert(ctx); err != nil {
+			cancel(err)
 		}
+	})
+	// Run only returns once ctx is done, the cause is the error writing a
+	// cert if that is why
+	_ = refresher.Run(ctx)
+	return context.Cause(ctx)
+}
+
+func formatDiskEncrypted(encrypted *bool) string {
+	if encrypted == nil {
+		return "unknown"
 	}
+	return fmt.Sprint(*encrypted)
 }
 
-func createSSHCert(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Signer, principals []string) ([]byte, []byte, error) {
+func createSSHCert(pkt *pktoken.PKToken, signer crypto.Signer, principals []string, validity time.Duration, extensions certExtensions) ([]byte, []byte, error) {
 	cert, err := sshcert.New(pkt, principals)
 	if err != nil {
 		return nil, nil, err
 	}
-	sshSigner, err := ssh.NewSignerFromSigner(signer)
-	if err != nil {
+	if err := extensions.apply(cert); err != nil {
 		return nil, nil, err
 	}
+	return signSSHCert(cert, signer, validity)
+}
 
-	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+// signSSHCert signs cert with the key in its PK Token and returns the cert
+// in authorized_keys format and the key PEM encoded
+func signSSHCert(cert *sshcert.SshCertSmuggler, signer crypto.Signer, validity time.Duration) ([]byte, []byte, error) {
+	cert.SetValidity(time.Now(), validity)
+	signerMas, err := sshcert.NewSigner(signer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -191,7 +524,20 @@ func createSSHCert(ctx context.Context, pkt *pktoken.PKToken, signer crypto.Sign
 	return certBytes, seckeySshBytes, nil
 }
 
-func writeKeysToSSHDir(seckeySshPem []byte, certBytes []byte) error {
+// sshKeyAlgorithm is the SSH key type of each key algorithm
+var sshKeyAlgorithm = map[jwa.SignatureAlgorithm]string{
+	jwa.ES256: ssh.KeyAlgoECDSA256,
+	jwa.EdDSA: ssh.KeyAlgoED25519,
+}
+
+// sshKeyFilenames are the default key paths in ~/.ssh, by key algorithm,
+// that ssh tries when connecting
+var sshKeyFilenames = map[jwa.SignatureAlgorithm][]string{
+	jwa.ES256: {"id_ecdsa", "id_dsa"},
+	jwa.EdDSA: {"id_ed25519"},
+}
+
+func writeKeysToSSHDir(keyFilenames []string, seckeySshPem []byte, certBytes []byte) error {
 	homePath, err := os.UserHomeDir()
 	if err != nil {
 		return err
@@ -210,7 +556,7 @@ func writeKeysToSSHDir(seckeySshPem []byte, certBytes []byte) error {
 	// generated by openpubkey  which we check by looking at the associated
 	// comment. If the comment is equal to "openpubkey", we overwrite the file
 	// with a new key.
-	for _, keyFilename := range []string{"id_ecdsa", "id_dsa"} {
+	for _, keyFilename := range keyFilenames {
 		seckeyPath := filepath.Join(sshPath, keyFilename)
 		pubkeyPath := seckeyPath + ".pub"
 
@@ -242,19 +588,57 @@ func writeKeysToSSHDir(seckeySshPem []byte, certBytes []byte) error {
 }
 
 func writeKeys(seckeyPath string, pubkeyPath string, seckeySshPem []byte, certBytes []byte) error {
-	// Write ssh secret key to filesystem
-	if err := os.WriteFile(seckeyPath, seckeySshPem, 0600); err != nil {
+	log.Printf("writing opk ssh public key to %s and corresponding secret key to %s", pubkeyPath, seckeyPath)
+
+	// Write both keys to temporary files first and only move them into place
+	// once both are written. If we are interrupted part way through we
+	// don't leave a secret key without its matching certificate.
+	seckeyTmp, err := writeTempFile(seckeyPath, seckeySshPem, 0600)
+	if err != nil {
 		return err
 	}
-
-	log.Printf("writing opk ssh public key to %s and corresponding secret key to %s", pubkeyPath, seckeyPath)
+	defer os.Remove(seckeyTmp)
 
 	certBytes = append(certBytes, []byte(" openpubkey")...)
-	// Write ssh public key (certificate) to filesystem
-	return os.WriteFile(pubkeyPath, certBytes, 0777)
+	pubkeyTmp, err := writeTempFile(pubkeyPath, certBytes, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pubkeyTmp)
+
+	if err := os.Rename(seckeyTmp, seckeyPath); err != nil {
+		return err
+	}
+	return os.Rename(pubkeyTmp, pubkeyPath)
+}
+
+// writeTempFile writes data to a new temporary file in the same directory
+// as path, so that it can be atomically renamed to path, and returns the
+// name of the temporary file.
+func writeTempFile(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	if err := setPermissions(f, perm); err != nil {
+		f.Close()
+		os.Remove(name)
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(name)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
 }
 
 func fileExists(fPath string) bool {
-	_, err := os.Open(fPath)
+	_, err := os.Stat(fPath)
 	return !errors.Is(err, os.ErrNotExist)
 }
@@ -0,0 +1,217 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWriteKeys(t *testing.T) {
+	sshPath := t.TempDir()
+	seckeyPath := filepath.Join(sshPath, "id_ecdsa")
+	pubkeyPath := seckeyPath + ".pub"
+
+	// Overwrites keys written by a previous login
+	for _, seckey := range []string{"first", "second"} {
+		err := writeKeys(seckeyPath, pubkeyPath, []byte(seckey), []byte("ecdsa-sha2-nistp256-cert-v01@openssh.com AAAA"))
+		require.NoError(t, err)
+	}
+
+	seckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(seckey))
+	pubkey, err := os.ReadFile(pubkeyPath)
+	require.NoError(t, err)
+	require.Equal(t, "ecdsa-sha2-nistp256-cert-v01@openssh.com AAAA openpubkey", string(pubkey))
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(seckeyPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(sshPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestLoginSecurityKey(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	// ssh-keygen -t ecdsa-sk writes the key handle to id_ecdsa_sk and the
+	// public key to id_ecdsa_sk.pub
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skKey, err := sshcert.NewSKPublicKey(&sk.PublicKey, sshcert.DefaultSKApplication)
+	require.NoError(t, err)
+	pubkeyPath := filepath.Join(home, ".ssh", "id_ecdsa_sk.pub")
+	require.NoError(t, os.MkdirAll(filepath.Dir(pubkeyPath), 0700))
+	require.NoError(t, os.WriteFile(pubkeyPath, ssh.MarshalAuthorizedKey(skKey), 0644))
+
+	require.NoError(t, Login(ctx, op, WithSecurityKey(pubkeyPath), WithCertValidity(time.Hour)))
+	cert := readCert(t, filepath.Join(home, ".ssh", "id_ecdsa_sk-cert.pub"))
+	require.Equal(t, skKey.Marshal(), cert.SshCert.Key.Marshal())
+	require.NoError(t, cert.CheckValidity(time.Now(), time.Hour))
+	// No key is written, the user authenticates with the security key
+	require.NoFileExists(t, filepath.Join(home, ".ssh", "id_ecdsa"))
+
+	// Keys that aren't on a security key are rejected
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sshKey, err := ssh.NewPublicKey(&signer.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pubkeyPath, ssh.MarshalAuthorizedKey(sshKey), 0644))
+	require.ErrorContains(t, Login(ctx, op, WithSecurityKey(pubkeyPath)), "not a security key")
+}
+
+func TestLoginEd25519(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	require.NoError(t, Login(ctx, op, WithKeyAlgorithm(jwa.EdDSA), WithRenewal()))
+	seckeyPath, pubkeyPath, err := findOpkKey()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, ".ssh", "id_ed25519"), seckeyPath)
+
+	cert := readCert(t, pubkeyPath)
+	require.Equal(t, ssh.KeyAlgoED25519, cert.SshCert.Key.Type())
+	require.Equal(t, ssh.KeyAlgoED25519, cert.SshCert.Signature.Format)
+	pkt, err := cert.GetPKToken()
+	require.NoError(t, err)
+	cic, err := pkt.GetCicValues()
+	require.NoError(t, err)
+	require.Equal(t, jwa.EdDSA, cic.KeyAlgorithm())
+
+	// The certificate is signed by the key in the PK Token
+	seckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(seckey)
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey().Marshal(), cert.SshCert.SignatureKey.Marshal())
+
+	require.NoError(t, Renew(ctx, op))
+	renewed := readCert(t, pubkeyPath)
+	require.Equal(t, cert.SshCert.Key.Marshal(), renewed.SshCert.Key.Marshal())
+
+	require.ErrorContains(t, Login(ctx, op, WithKeyAlgorithm(jwa.RS256)), "unsupported key algorithm")
+}
+
+func TestLoginExtensions(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	err = Login(ctx, op, WithExtension("permit-everything", ""))
+	require.ErrorContains(t, err, "unknown extension")
+	_, _, err = findOpkKey()
+	require.Error(t, err, "expected no key to be written")
+
+	require.NoError(t, Login(ctx, op, WithRenewal(), WithCompressedPKT(), WithPKTChunkSize(512),
+		WithoutExtension(sshcert.ExtPermitPortForwarding),
+		WithExtension("session-recording@example.com", "on")))
+	_, pubkeyPath, err := findOpkKey()
+	require.NoError(t, err)
+	cert := readCert(t, pubkeyPath)
+	require.NotContains(t, cert.SshCert.Extensions, sshcert.ExtPermitPortForwarding)
+	require.Contains(t, cert.SshCert.Extensions, sshcert.ExtPermitPTY)
+	require.Equal(t, "on", cert.SshCert.Extensions["session-recording@example.com"])
+	opkExts, err := cert.Extensions()
+	require.NoError(t, err)
+	require.True(t, opkExts.Compress)
+	require.Equal(t, 512, opkExts.ChunkSize)
+
+	// Renewing keeps the extensions
+	require.NoError(t, Renew(ctx, op))
+	renewed := readCert(t, pubkeyPath)
+	require.NotContains(t, renewed.SshCert.Extensions, sshcert.ExtPermitPortForwarding)
+	require.Contains(t, renewed.SshCert.Extensions, sshcert.ExtPermitPTY)
+	require.Equal(t, "on", renewed.SshCert.Extensions["session-recording@example.com"])
+	renewedExts, err := renewed.Extensions()
+	require.NoError(t, err)
+	require.True(t, renewedExts.Compress)
+	require.Equal(t, 512, renewedExts.ChunkSize)
+	require.NotNil(t, renewedExts.PKT.FreshIDToken)
+}
+
+func TestLoginExistingKey(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	// Without an earlier login a key is generated
+	require.NoError(t, Login(ctx, op, WithExistingKey()))
+	seckeyPath, pubkeyPath, err := findOpkKey()
+	require.NoError(t, err)
+	seckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	cert := readCert(t, pubkeyPath)
+
+	require.NoError(t, Login(ctx, op, WithExistingKey()))
+	renewedSeckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	require.Equal(t, seckey, renewedSeckey, "expected the key file to be left as it is")
+	renewed := readCert(t, pubkeyPath)
+	require.Equal(t, cert.SshCert.Key.Marshal(), renewed.SshCert.Key.Marshal())
+	require.NotEqual(t, cert.SshCert.Marshal(), renewed.SshCert.Marshal())
+	require.NoError(t, renewed.VerifyCaSig(renewed.SshCert.Key))
+
+	// A key of another algorithm isn't reused
+	require.NoError(t, Login(ctx, op, WithExistingKey(), WithKeyAlgorithm(jwa.EdDSA)))
+	require.FileExists(t, filepath.Join(home, ".ssh", "id_ed25519"))
+
+	require.ErrorContains(t, Login(ctx, op, WithExistingKey(), WithSecurityKey("id_ecdsa_sk.pub")), "never reused")
+
+	// Without the option the key is replaced
+	require.NoError(t, Login(ctx, op))
+	replacedSeckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	require.NotEqual(t, seckey, replacedSeckey)
+}
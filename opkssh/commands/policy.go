@@ -0,0 +1,118 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/openpubkey/openpubkey/opkssh/policy"
+)
+
+// ListCmd prints the entries of the opkssh policy file
+type ListCmd struct {
+	PolicyFileLoader *policy.FileLoader
+
+	// Username is the user whose policy file is read when the system policy
+	// file cannot be read, see AddCmd.LoadPolicy
+	Username string
+	// JSON prints the policy and its filepath as a JSON object instead of a
+	// table
+	JSON bool
+}
+
+// PolicyListing is the JSON output of ListCmd
+type PolicyListing struct {
+	Path string `json:"path"`
+	*policy.Policy
+}
+
+// List writes the policy entries to w
+func (l *ListCmd) List(w io.Writer) error {
+	currentPolicy, policyFilePath, err := loadPolicy(l.PolicyFileLoader, l.Username)
+	if err != nil {
+		return fmt.Errorf("failed to load current policy: %w", err)
+	}
+
+	if l.JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(PolicyListing{Path: policyFilePath, Policy: currentPolicy})
+	}
+
+	fmt.Fprintf(w, "# %s\n", policyFilePath)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tPRINCIPALS\tISSUER\tHOSTS")
+	for _, user := range currentPolicy.Users {
+		who := user.Email
+		if user.Group != "" {
+			who = "group:" + user.Group
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", who,
+			strings.Join(user.Principals, ","),
+			dashIfEmpty(user.Issuer),
+			dashIfEmpty(strings.Join(currentPolicy.Hosts(user), ",")))
+	}
+	return tw.Flush()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// RemoveCmd removes principals from users in the opkssh policy file
+type RemoveCmd struct {
+	PolicyFileLoader *policy.FileLoader
+
+	// Username is the user whose policy file is updated when the system
+	// policy file cannot be read, see AddCmd.LoadPolicy
+	Username string
+	// Issuer selects the entries constrained to this OpenID provider, by
+	// default entries without an issuer constraint are updated
+	Issuer string
+}
+
+// Remove removes principal from the entries of the user whose email is equal
+// to userEmail, deleting entries left without principals. Group entries are
+// not changed. The policy file is locked while it is modified, see
+// policy.FileLoader.Update
+//
+// If successful, returns the policy filepath updated. Otherwise, returns a
+// non-nil error, including when no entry grants the principal to the user
+func (r *RemoveCmd) Remove(userEmail string, principal string) (string, error) {
+	_, policyFilePath, err := loadPolicy(r.PolicyFileLoader, r.Username)
+	if err != nil {
+		return "", fmt.Errorf("failed to load current policy: %w", err)
+	}
+
+	err = r.PolicyFileLoader.Update(policyFilePath, func(currentPolicy *policy.Policy) error {
+		if !currentPolicy.RemoveAllowedPrincipal(principal, userEmail, r.Issuer) {
+			return fmt.Errorf("no entry allows %s to assume %s", userEmail, principal)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to remove from policy: %w", err)
+	}
+	return policyFilePath, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/providers"
+	"golang.org/x/crypto/ssh"
+)
+
+// Renew mints a fresh SSH certificate for the key written by a previous
+// Login with WithRenewal, using the stored refresh token to get a fresh ID
+// Token from the OpenID Provider instead of opening the browser. The key,
+// principals and extensions are kept, the certificate's validity is set by
+// WithCertValidity.
+func Renew(ctx context.Context, provider providers.RefreshableOpenIdProvider, opts ...LoginOpts) error {
+	options := &loginOptions{}
+	for _, applyOpt := range opts {
+		applyOpt(options)
+	}
+
+	key, err := readOpkKey()
+	if err != nil {
+		return err
+	}
+	sshCert := key.cert
+
+	cert := &sshcert.SshCertSmuggler{SshCert: sshCert}
+	opkExts, err := cert.Extensions()
+	if err != nil {
+		return err
+	}
+	pkt := opkExts.PKT
+	if issuer, err := pkt.Issuer(); err != nil {
+		return err
+	} else if issuer != provider.Issuer() {
+		return fmt.Errorf("SSH certificate was issued by %s, not %s", issuer, provider.Issuer())
+	}
+
+	refreshToken, err := readRefreshToken()
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no refresh token stored, log in with renewal enabled first")
+	} else if err != nil {
+		return fmt.Errorf("failed to read refresh token: %w", err)
+	}
+	tokens, err := provider.RefreshTokens(ctx, refreshToken)
+	if err != nil {
+		return fmt.Errorf("error refreshing ID token: %w", err)
+	}
+	pkt.FreshIDToken = tokens.IDToken
+
+	newCertBytes, _, err := createSSHCert(pkt, key.signer, sshCert.ValidPrincipals, options.certValidity, extensionsOf(sshCert, opkExts))
+	if err != nil {
+		return fmt.Errorf("failed to generate SSH cert: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The key is unchanged, only replace the certificate
+	if err := writeCertFile(key.pubkeyPath, newCertBytes); err != nil {
+		return fmt.Errorf("failed to write SSH certificate to filesystem: %w", err)
+	}
+	// OPs may rotate the refresh token on every use
+	if err := writeRefreshToken(tokens.RefreshToken); err != nil {
+		return fmt.Errorf("failed to write refresh token: %w", err)
+	}
+	return nil
+}
+
+// extensionsOf returns the changes to the default extensions that cert,
+// whose OpenPubkey extensions are opkExts, was issued with
+func extensionsOf(cert *ssh.Certificate, opkExts *sshcert.Extensions) certExtensions {
+	extensions := certExtensions{
+		set:          map[string]string{},
+		compressPKT:  opkExts.Compress,
+		pktChunkSize: opkExts.ChunkSize,
+	}
+	for name, value := range cert.Extensions {
+		if !strings.HasPrefix(name, sshcert.ExtensionPrefix) {
+			extensions.set[name] = value
+		}
+	}
+	for _, name := range sshcert.DefaultUserExtensions {
+		if _, ok := cert.Extensions[name]; !ok {
+			extensions.remove = append(extensions.remove, name)
+		}
+	}
+	return extensions
+}
+
+// opkKey is an SSH key and certificate written by Login
+type opkKey struct {
+	seckeyPath string
+	pubkeyPath string
+	signer     crypto.Signer
+	cert       *ssh.Certificate
+}
+
+// readOpkKey reads the SSH key and certificate written by Login and checks
+// that they belong together
+func readOpkKey() (*opkKey, error) {
+	seckeyPath, pubkeyPath, err := findOpkKey()
+	if err != nil {
+		return nil, err
+	}
+	seckeyPem, err := os.ReadFile(seckeyPath)
+	if err != nil {
+		return nil, err
+	}
+	rawKey, err := ssh.ParseRawPrivateKey(seckeyPem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", seckeyPath, err)
+	}
+	// Ed25519 keys are parsed as a pointer, use them like generated ones
+	if edKey, ok := rawKey.(*ed25519.PrivateKey); ok {
+		rawKey = *edKey
+	}
+	signer, ok := rawKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("SSH key %s can't be used for signing", seckeyPath)
+	}
+
+	certBytes, err := os.ReadFile(pubkeyPath)
+	if err != nil {
+		return nil, err
+	}
+	certPubkey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH certificate %s: %w", pubkeyPath, err)
+	}
+	sshCert, ok := certPubkey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", pubkeyPath)
+	}
+	sshPubkey, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sshPubkey.Marshal(), sshCert.Key.Marshal()) {
+		return nil, fmt.Errorf("SSH certificate %s is not for the key in %s", pubkeyPath, seckeyPath)
+	}
+	return &opkKey{seckeyPath: seckeyPath, pubkeyPath: pubkeyPath, signer: signer, cert: sshCert}, nil
+}
+
+// findOpkKey returns the paths of the SSH key and certificate written by
+// Login, see writeKeysToSSHDir
+func findOpkKey() (string, string, error) {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	for _, keyFilename := range []string{"id_ecdsa", "id_dsa", "id_ed25519"} {
+		seckeyPath := filepath.Join(homePath, ".ssh", keyFilename)
+		pubkeyPath := seckeyPath + ".pub"
+		sshPubkey, err := os.ReadFile(pubkeyPath)
+		if err != nil {
+			continue
+		}
+		if _, comment, _, _, err := ssh.ParseAuthorizedKey(sshPubkey); err == nil && comment == "openpubkey" {
+			return seckeyPath, pubkeyPath, nil
+		}
+	}
+	return "", "", fmt.Errorf("no SSH key written by opkssh login found")
+}
+
+func refreshTokenPath() (string, error) {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homePath, ".opk", "refresh_token"), nil
+}
+
+func readRefreshToken() ([]byte, error) {
+	path, err := refreshTokenPath()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(refreshToken), nil
+}
+
+// writeRefreshToken replaces the stored refresh token, the file is only
+// readable by the user
+func writeRefreshToken(refreshToken []byte) error {
+	path, err := refreshTokenPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := writeTempFile(path, refreshToken, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	log.Printf("writing refresh token to %s", path)
+	return os.Rename(tmp, path)
+}
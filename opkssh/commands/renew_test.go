@@ -0,0 +1,83 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func readCert(t *testing.T, pubkeyPath string) *sshcert.SshCertSmuggler {
+	certBytes, err := os.ReadFile(pubkeyPath)
+	require.NoError(t, err)
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	require.NoError(t, err)
+	return &sshcert.SshCertSmuggler{SshCert: pubkey.(*ssh.Certificate)}
+}
+
+func TestRenew(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	require.ErrorContains(t, Renew(ctx, op), "no SSH key written by opkssh login found")
+
+	// Without renewal enabled no refresh token is stored
+	require.NoError(t, Login(ctx, op, WithCertValidity(time.Hour)))
+	require.ErrorContains(t, Renew(ctx, op), "no refresh token stored")
+
+	require.NoError(t, Login(ctx, op, WithCertValidity(time.Hour), WithRenewal()))
+	seckeyPath, pubkeyPath, err := findOpkKey()
+	require.NoError(t, err)
+	cert := readCert(t, pubkeyPath)
+	require.NoError(t, cert.CheckValidity(time.Now(), time.Hour))
+	pkt, err := cert.GetPKToken()
+	require.NoError(t, err)
+	require.Nil(t, pkt.FreshIDToken)
+	seckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+
+	require.NoError(t, Renew(ctx, op, WithCertValidity(8*time.Hour)))
+	renewed := readCert(t, pubkeyPath)
+	require.NoError(t, renewed.CheckValidity(time.Now(), 8*time.Hour))
+	require.Error(t, renewed.CheckValidity(time.Now(), time.Hour))
+	require.Equal(t, cert.SshCert.Key.Marshal(), renewed.SshCert.Key.Marshal())
+	renewedPkt, err := renewed.GetPKToken()
+	require.NoError(t, err)
+	require.NotNil(t, renewedPkt.FreshIDToken)
+	require.Equal(t, pkt.OpToken, renewedPkt.OpToken)
+
+	// The key is kept
+	renewedSeckey, err := os.ReadFile(seckeyPath)
+	require.NoError(t, err)
+	rawKey, err := ssh.ParseRawPrivateKey(seckey)
+	require.NoError(t, err)
+	renewedRawKey, err := ssh.ParseRawPrivateKey(renewedSeckey)
+	require.NoError(t, err)
+	require.Equal(t, rawKey, renewedRawKey)
+}
@@ -0,0 +1,126 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/verifier"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultRevocationListPath is the revocation list opkssh verify checks and
+// opkssh revoke appends to, see verifier.RevocationList for the format
+const DefaultRevocationListPath = "/etc/opk/revoked"
+
+// RevokeCmd appends an entry to a revocation list, so that opkssh verify
+// denies the PK Tokens it matches before they expire
+type RevokeCmd struct {
+	// Path is the revocation list, DefaultRevocationListPath if empty
+	Path string
+
+	// Issuer and Subject revoke every PK Token of a user, Issuer and TokenID
+	// a single ID Token by its JWT ID
+	Issuer  string
+	Subject string
+	TokenID string
+	// CertPath revokes the PK Token in the SSH certificate at the path by
+	// its verifier.TokenHash
+	CertPath string
+}
+
+// Revoke appends the entry to the revocation list and returns its path
+func (r *RevokeCmd) Revoke() (string, error) {
+	var entry verifier.RevocationEntry
+	if r.CertPath != "" {
+		if r.Issuer != "" || r.Subject != "" || r.TokenID != "" {
+			return "", fmt.Errorf("a certificate can't be revoked along with an issuer, subject or token ID")
+		}
+		hash, err := certTokenHash(r.CertPath)
+		if err != nil {
+			return "", err
+		}
+		entry.Hash = hash
+	} else {
+		// The verifier ignores entries revoking every PK Token of an issuer
+		if r.Issuer == "" || (r.Subject == "" && r.TokenID == "") {
+			return "", fmt.Errorf("specify a certificate, or an issuer with a subject and/or token ID")
+		}
+		entry = verifier.RevocationEntry{Issuer: r.Issuer, Subject: r.Subject, JTI: r.TokenID}
+	}
+
+	path := r.Path
+	if path == "" {
+		path = DefaultRevocationListPath
+	}
+	if err := appendRevocation(path, entry); err != nil {
+		return "", fmt.Errorf("failed to append to revocation list: %w", err)
+	}
+	return path, nil
+}
+
+// appendRevocation adds entry to the list at path, creating it if needed.
+// The file is replaced, so verify never reads a partially written list.
+func appendRevocation(path string, entry verifier.RevocationEntry) error {
+	var list verifier.RevocationList
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(content, &list); err != nil {
+			return fmt.Errorf("malformed revocation list %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	list.Revoked = append(list.Revoked, entry)
+
+	content, err = json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTempFile(path, append(content, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, path)
+}
+
+// certTokenHash returns the verifier.TokenHash of the PK Token in the SSH
+// certificate at path
+func certTokenHash(path string) (string, error) {
+	certBytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	certPubkey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse SSH certificate %s: %w", path, err)
+	}
+	sshCert, ok := certPubkey.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("%s is not an SSH certificate", path)
+	}
+	pkt, err := (&sshcert.SshCertSmuggler{SshCert: sshCert}).GetPKToken()
+	if err != nil {
+		return "", err
+	}
+	return verifier.TokenHash(pkt), nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "revoked")
+
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, jwa.ES256)
+	require.NoError(t, err)
+	cert, _, err := createSSHCert(pkt, signer, []string{"guest"}, DefaultCertValidity, certExtensions{})
+	require.NoError(t, err)
+	certPath := filepath.Join(dir, "id_ecdsa-cert.pub")
+	require.NoError(t, os.WriteFile(certPath, cert, 0600))
+
+	checker := verifier.NewFileRevocationChecker(path)
+
+	_, err = (&RevokeCmd{Path: path, Subject: "me"}).Revoke()
+	require.ErrorContains(t, err, "issuer")
+	_, err = (&RevokeCmd{Path: path, Issuer: "mockIssuer"}).Revoke()
+	require.ErrorContains(t, err, "subject")
+	_, err = (&RevokeCmd{Path: path, CertPath: certPath, Subject: "me"}).Revoke()
+	require.Error(t, err)
+	require.NoFileExists(t, path)
+
+	written, err := (&RevokeCmd{Path: path, Issuer: "mockIssuer", Subject: "someone-else"}).Revoke()
+	require.NoError(t, err)
+	require.Equal(t, path, written)
+	revoked, err := checker.IsRevoked(ctx, pkt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	_, err = (&RevokeCmd{Path: path, CertPath: certPath}).Revoke()
+	require.NoError(t, err)
+	// The checker rereads the list when its modification time changes,
+	// which may not have ticked yet
+	checker = verifier.NewFileRevocationChecker(path)
+	revoked, err = checker.IsRevoked(ctx, pkt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+}
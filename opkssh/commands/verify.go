@@ -18,11 +18,23 @@ package commands
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/openpubkey/openpubkey/clockskew"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/notify"
+	"github.com/openpubkey/openpubkey/opkssh/audit"
+	"github.com/openpubkey/openpubkey/opkssh/device"
 	"github.com/openpubkey/openpubkey/opkssh/policy"
 	"github.com/openpubkey/openpubkey/opkssh/sshcert"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -35,14 +47,45 @@ type PolicyEnforcerFunc func(username string, pkt *pktoken.PKToken) error
 // configurable authorization system. It is designed to be used in conjunction
 // with sshd's AuthorizedKeysCommand feature.
 type VerifyCmd struct {
-	// OPConfig returns configuration values used to verify the PK token
-	// contained in the SSH certificate
-	OPConfig providers.Config
+	// OPConfigs are the OpenID providers whose PK tokens are accepted. The
+	// configuration values of the one whose issuer matches the PK token
+	// contained in the SSH certificate are used to verify it
+	OPConfigs []providers.Config
 	// CheckPolicy determines whether the verified PK token is permitted to SSH as a
 	// specific user
 	CheckPolicy PolicyEnforcerFunc
+	// ClockSkew is how far apart the OP's clock and ours may be when checking
+	// whether the ID Token in the certificate has expired
+	ClockSkew clockskew.Policy
+	// PublicKeyFinder, if set, finds the OPs' signing keys, e.g. one from
+	// discover.NewDiskCachingPubkeyFinder so that runs of verify share the
+	// fetched JWKS
+	PublicKeyFinder *discover.PublicKeyFinder
+	// Audit records every authorization decision if set
+	Audit *audit.Log
+	// Notifier, if set, is sent a login event for every allowed login
+	Notifier notify.Notifier
+	// MaxCertValidity, if set, rejects SSH certificates valid for longer,
+	// including those that never expire
+	MaxCertValidity time.Duration
+	// Cache, if set, remembers allowed logins so that repeated logins with
+	// the same certificate skip verification and policy checks
+	Cache *VerifyCache
+	// RevocationCheckers are consulted before any login is allowed,
+	// including cached ones. A checker that fails denies every login.
+	RevocationCheckers []verifier.RevocationChecker
+	// RequiredExtensions deny logins with SSH certificates that lack any of
+	// these extensions
+	RequiredExtensions []string
+	// StrippedExtensions are standard extensions, see sshcert.RestrictOption,
+	// whose permissions logins don't get even if their certificate grants
+	// them
+	StrippedExtensions []string
 }
 
+// notifyTimeout bounds how long sshd waits on login notifications
+const notifyTimeout = 5 * time.Second
+
 // This function is called by the SSH server as the AuthorizedKeysCommand:
 //
 // The following lines are added to /etc/ssh/sshd_config:
@@ -70,33 +113,190 @@ type VerifyCmd struct {
 // format string is returned (i.e. the expected line to produce on standard
 // output when using sshd's AuthorizedKeysCommand feature). Otherwise, a non-nil
 // error is returned.
+//
+// If an Audit log is set the decision is recorded in it. Failing to write
+// the record or to notify is logged but doesn't change the decision.
 func (v *VerifyCmd) AuthorizedKeysCommand(ctx context.Context, userArg string, typArg string, certB64Arg string) (string, error) {
+	rec := audit.Record{Principal: userArg}
+	authKey, pkt, err := v.authorizedKeys(ctx, userArg, typArg, certB64Arg, &rec)
+	if err == nil && v.Notifier != nil {
+		v.notifyLogin(ctx, userArg, pkt)
+	}
+	if v.Audit != nil {
+		if err != nil {
+			rec.Decision = audit.Deny
+			rec.Reason = err.Error()
+		} else {
+			rec.Decision = audit.Allow
+		}
+		if _, auditErr := v.Audit.Append(rec); auditErr != nil {
+			log.Println("failed to write audit record:", auditErr)
+		}
+	}
+	return authKey, err
+}
+
+// authorizedKeys fills in the key and, once verified, the identity the
+// decision is about in rec. The verified PK Token is returned with the key
+func (v *VerifyCmd) authorizedKeys(ctx context.Context, userArg string, typArg string, certB64Arg string, rec *audit.Record) (string, *pktoken.PKToken, error) {
 	// Parse the b64 pubkey and expect it to be an ssh certificate
 	cert, err := sshcert.NewFromAuthorizedKey(typArg, certB64Arg)
 	if err != nil {
-		return "", err
-	}
-	if pkt, err := cert.VerifySshPktCert(ctx, v.OPConfig); err != nil { // Verify the PKT contained in the cert
-		return "", err
-	} else if err := v.CheckPolicy(userArg, pkt); err != nil { // Check if username is authorized
-		return "", err
-	} else { // Success!
-		// sshd expects the public key in the cert, not the cert itself. This
-		// public key is key of the CA that signs the cert, in our setting there
-		// is no CA.
-		pubkeyBytes := ssh.MarshalAuthorizedKey(cert.SshCert.SignatureKey)
-		return "cert-authority " + string(pubkeyBytes), nil
+		return "", nil, err
+	}
+	rec.KeyFingerprint = ssh.FingerprintSHA256(cert.SshCert.Key)
+	cert.ClockSkew = v.ClockSkew
+	if err := cert.CheckValidity(time.Now(), v.MaxCertValidity); err != nil {
+		return "", nil, err
+	}
+	for _, ext := range v.RequiredExtensions {
+		if _, ok := cert.SshCert.Extensions[ext]; !ok {
+			return "", nil, fmt.Errorf("SSH certificate lacks required extension %s", ext)
+		}
+	}
+	// sshd expects the public key in the cert, not the cert itself. This
+	// public key is key of the CA that signs the cert, in our setting there
+	// is no CA.
+	options := []string{"cert-authority"}
+	for _, ext := range v.StrippedExtensions {
+		option, ok := sshcert.RestrictOption(ext)
+		if !ok {
+			return "", nil, fmt.Errorf("extension %s can't be stripped", ext)
+		}
+		options = append(options, option)
+	}
+	authKey := strings.Join(options, ",") + " " + string(ssh.MarshalAuthorizedKey(cert.SshCert.SignatureKey))
+
+	if len(v.RevocationCheckers) > 0 {
+		if err := v.checkRevocations(ctx, cert); err != nil {
+			return "", nil, err
+		}
+	}
+
+	cacheKey := verifyCacheKey(userArg, typArg, certB64Arg)
+	if v.Cache != nil && v.Cache.Allowed(cacheKey) {
+		pkt, err := cert.GetPKToken()
+		if err != nil {
+			return "", nil, err
+		}
+		if err := setIdentity(rec, pkt); err != nil {
+			return "", nil, err
+		}
+		return authKey, pkt, nil
+	}
+
+	opConfig, err := v.opConfigFor(cert)
+	if err != nil {
+		return "", nil, err
 	}
+	cert.PublicKeyFinder = v.PublicKeyFinder
+	pkt, err := cert.VerifySshPktCert(ctx, opConfig) // Verify the PKT contained in the cert
+	if err != nil {
+		return "", nil, err
+	}
+	if err := setIdentity(rec, pkt); err != nil {
+		return "", nil, err
+	}
+	if err := v.CheckPolicy(userArg, pkt); err != nil { // Check if username is authorized
+		return "", nil, err
+	}
+	// Success!
+	if v.Cache != nil {
+		var claims struct {
+			Expiration int64 `json:"exp"`
+		}
+		if err := json.Unmarshal(pkt.Payload, &claims); err == nil {
+			v.Cache.Allow(cacheKey, time.Unix(claims.Expiration, 0))
+		}
+	}
+	return authKey, pkt, nil
+}
+
+// checkRevocations returns an error if the PK token in cert is revoked. It
+// doesn't need to be verified first, as it can only be denied
+func (v *VerifyCmd) checkRevocations(ctx context.Context, cert *sshcert.SshCertSmuggler) error {
+	pkt, err := cert.GetPKToken()
+	if err != nil {
+		return err
+	}
+	for _, checker := range v.RevocationCheckers {
+		revoked, err := checker.IsRevoked(ctx, pkt)
+		if err != nil {
+			return fmt.Errorf("failed to check revocation: %w", err)
+		}
+		if revoked {
+			return fmt.Errorf("PK token has been revoked")
+		}
+	}
+	return nil
+}
+
+// opConfigFor returns the configured OpenID provider that issued the PK
+// token in cert
+func (v *VerifyCmd) opConfigFor(cert *sshcert.SshCertSmuggler) (providers.Config, error) {
+	pkt, err := cert.GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := pkt.Issuer()
+	if err != nil {
+		return nil, err
+	}
+	for _, opConfig := range v.OPConfigs {
+		if opConfig.Issuer() == issuer {
+			return opConfig, nil
+		}
+	}
+	return nil, fmt.Errorf("PK token issuer %s is not a configured provider", issuer)
+}
+
+// notifyLogin sends a login event naming this host and, if the PK Token has
+// device info, the client's host
+func (v *VerifyCmd) notifyLogin(ctx context.Context, principal string, pkt *pktoken.PKToken) {
+	event := notify.NewEvent(notify.EventLogin, pkt)
+	event.Principal = principal
+	if hostname, err := os.Hostname(); err == nil {
+		event.Source = hostname
+	}
+	if info, ok, err := device.FromPKToken(pkt); err == nil && ok {
+		event.Device = info.Hostname
+	}
+	// verify exits once sshd has its answer, so deliver before returning
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	notify.Send(ctx, v.Notifier, event)
+}
+
+func setIdentity(rec *audit.Record, pkt *pktoken.PKToken) error {
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return err
+	}
+	rec.Issuer = claims.Issuer
+	rec.Subject = claims.Subject
+	rec.Email = claims.Email
+	return nil
 }
 
 // OpkPolicyEnforcerAuthFunc returns an opkssh policy.Enforcer that can be
-// used in the opkssh verify command.
-func OpkPolicyEnforcerFunc(username string) PolicyEnforcerFunc {
+// used in the opkssh verify command. Policy entries scoped to hosts apply if
+// they match hostname. Policies from extraLoaders, e.g. an LDAPLoader, are
+// merged with the policy files.
+func OpkPolicyEnforcerFunc(username string, hostname string, extraLoaders ...policy.Loader) PolicyEnforcerFunc {
+	var loader policy.Loader = &policy.MultiFileLoader{
+		FileLoader: policy.NewFileLoader(),
+		Username:   username,
+	}
+	if len(extraLoaders) > 0 {
+		loader = append(policy.MultiLoader{loader}, extraLoaders...)
+	}
 	policyEnforcer := &policy.Enforcer{
-		PolicyLoader: &policy.MultiFileLoader{
-			FileLoader: policy.NewFileLoader(),
-			Username:   username,
-		},
+		PolicyLoader: loader,
+		Hostname:     hostname,
 	}
 	return policyEnforcer.CheckPolicy
 }
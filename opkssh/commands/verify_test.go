@@ -16,6 +16,20 @@
 
 package commands
 
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	pktmocks "github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
 // TODO: Undisable this test once we can take a verifier as an argument
 // import (
 // 	"context"
@@ -86,3 +100,42 @@ package commands
 // 	expectedPubkeyList := "cert-authority ecdsa-sha2-nistp256"
 // 	require.Contains(t, pubkeyList, expectedPubkeyList)
 // }
+
+func TestVerifyExtensions(t *testing.T) {
+	ctx := context.Background()
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := pktmocks.GenerateMockPKToken(t, signer, jwa.ES256)
+	require.NoError(t, err)
+	extensions := certExtensions{
+		set:    map[string]string{"session-recording@example.com": "on"},
+		remove: []string{sshcert.ExtPermitUserRC},
+	}
+	certBytes, _, err := createSSHCert(pkt, signer, []string{"guest"}, time.Hour, extensions)
+	require.NoError(t, err)
+	typArg, certB64Arg, _ := strings.Cut(string(certBytes), " ")
+
+	// Allow the login in the cache, verifying the PK Token needs the OP
+	cache := &VerifyCache{Fs: afero.NewMemMapFs(), Path: "/var/cache/opk/verify.json", TTL: time.Minute}
+	cache.Allow(verifyCacheKey("guest", typArg, certB64Arg), time.Now().Add(time.Hour))
+	v := VerifyCmd{Cache: cache}
+
+	authKey, err := v.AuthorizedKeysCommand(ctx, "guest", typArg, certB64Arg)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authKey, "cert-authority ecdsa-sha2-nistp256 "), authKey)
+
+	v.RequiredExtensions = []string{"session-recording@example.com", sshcert.ExtPermitPTY}
+	v.StrippedExtensions = []string{sshcert.ExtPermitPortForwarding, sshcert.ExtPermitAgentForwarding}
+	authKey, err = v.AuthorizedKeysCommand(ctx, "guest", typArg, certB64Arg)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authKey, "cert-authority,no-port-forwarding,no-agent-forwarding ecdsa-sha2-nistp256 "), authKey)
+
+	v.RequiredExtensions = []string{sshcert.ExtPermitUserRC}
+	_, err = v.AuthorizedKeysCommand(ctx, "guest", typArg, certB64Arg)
+	require.ErrorContains(t, err, "lacks required extension permit-user-rc")
+
+	v.RequiredExtensions = nil
+	v.StrippedExtensions = []string{"session-recording@example.com"}
+	_, err = v.AuthorizedKeysCommand(ctx, "guest", typArg, certB64Arg)
+	require.ErrorContains(t, err, "can't be stripped")
+}
@@ -0,0 +1,208 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+)
+
+const (
+	// DefaultVerifyCacheTTL is how long an allowed login is remembered
+	DefaultVerifyCacheTTL = time.Minute
+	// DefaultVerifyCachePath is where allowed logins are remembered between
+	// invocations of opkssh verify, which runs once per SSH connection
+	DefaultVerifyCachePath = "/var/cache/opk/verify.json"
+	// DefaultJwksCacheDir is where the OPs' JWKS are kept between
+	// invocations of opkssh verify
+	DefaultJwksCacheDir = "/var/cache/opk/jwks"
+	// DefaultJwksMaxStale is how long past its TTL a cached JWKS is used
+	// while the OP can't be reached
+	DefaultJwksMaxStale = time.Hour
+)
+
+// VerifyCache remembers allowed logins so that repeated SSH connections with
+// the same certificate and principal skip verifying the PK token, which
+// fetches the OP's JWKS, and checking policy. Only allowed logins are
+// cached, so a denied login is retried in full every time.
+//
+// A cached login is forgotten once TTL has passed, the ID Token in the
+// certificate has expired, or any of PolicyPaths has changed. Changes not
+// made to PolicyPaths, e.g. to the members of LDAP groups, can take up to
+// TTL to apply.
+type VerifyCache struct {
+	// Fs is where the cache is stored
+	Fs   afero.Fs
+	Path string
+	TTL  time.Duration
+	// PolicyPaths are the files the cached logins were allowed by, the
+	// policy files and configs such as the accepted providers
+	PolicyPaths []string
+
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]verifyCacheEntry
+}
+
+type verifyCacheEntry struct {
+	Expires time.Time `json:"expires"`
+	// Policy identifies the version of the policy files the login was
+	// allowed by, see policyVersion
+	Policy string `json:"policy"`
+}
+
+// NewVerifyCache returns a VerifyCache stored at path on the OS filesystem
+func NewVerifyCache(path string, ttl time.Duration, policyPaths ...string) *VerifyCache {
+	return &VerifyCache{
+		Fs:          afero.NewOsFs(),
+		Path:        path,
+		TTL:         ttl,
+		PolicyPaths: policyPaths,
+	}
+}
+
+// verifyCacheKey hashes the login so the cache file doesn't hold the PK
+// tokens in the certificates
+func verifyCacheKey(principal string, typArg string, certB64Arg string) string {
+	h := sha256.New()
+	for _, s := range []string{principal, typArg, certB64Arg} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Allowed returns true if the login identified by key was allowed and is
+// still cached
+func (c *VerifyCache) Allowed(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	entry, ok := c.entries[key]
+	return ok && c.timeNow().Before(entry.Expires) && entry.Policy == c.policyVersion()
+}
+
+// Allow caches the login identified by key until TTL has passed or
+// idTokenExpiry, whichever is first. Failing to write the cache is logged.
+func (c *VerifyCache) Allow(key string, idTokenExpiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	now := c.timeNow()
+	expires := now.Add(c.TTL)
+	if idTokenExpiry.Before(expires) {
+		expires = idTokenExpiry
+	}
+	if !now.Before(expires) {
+		return
+	}
+	for k, entry := range c.entries {
+		if !now.Before(entry.Expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = verifyCacheEntry{Expires: expires, Policy: c.policyVersion()}
+	if err := c.write(); err != nil {
+		log.Printf("warning: failed to write verify cache %s: %v", c.Path, err)
+	}
+}
+
+// load reads the cache file the first time the cache is used. The cache
+// grants access, so it is ignored unless only its owner can write it
+func (c *VerifyCache) load() {
+	if c.entries != nil {
+		return
+	}
+	c.entries = map[string]verifyCacheEntry{}
+	info, err := c.Fs.Stat(c.Path)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm() != policy.ModeOnlyOwner {
+		log.Printf("warning: ignoring verify cache %s with insecure permissions (%o)", c.Path, info.Mode().Perm())
+		return
+	}
+	content, err := afero.ReadFile(c.Fs, c.Path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, &c.entries); err != nil {
+		log.Printf("warning: ignoring malformed verify cache %s", c.Path)
+		c.entries = map[string]verifyCacheEntry{}
+	}
+}
+
+// write replaces the cache file, so that concurrent invocations of verify
+// never read a partially written cache
+func (c *VerifyCache) write() error {
+	content, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.Path)
+	if err := c.Fs.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := afero.TempFile(c.Fs, dir, "."+filepath.Base(c.Path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer c.Fs.Remove(name)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := c.Fs.Chmod(name, policy.ModeOnlyOwner); err != nil {
+		return err
+	}
+	return c.Fs.Rename(name, c.Path)
+}
+
+// policyVersion hashes the size and modification time of each policy file,
+// or that it is missing, so that editing any of them bypasses the cache
+func (c *VerifyCache) policyVersion() string {
+	h := sha256.New()
+	for _, path := range c.PolicyPaths {
+		info, err := c.Fs.Stat(path)
+		if err != nil {
+			fmt.Fprintf(h, "%s:missing\n", path)
+			continue
+		}
+		fmt.Fprintf(h, "%s:%d:%d:%o\n", path, info.Size(), info.ModTime().UnixNano(), info.Mode())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *VerifyCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
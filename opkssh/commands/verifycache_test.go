@@ -0,0 +1,80 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	policyPath := "/etc/opk/policy.yml"
+	require.NoError(t, afero.WriteFile(fs, policyPath, []byte("users: []\n"), 0600))
+	providersPath := "/etc/opk/providers.yml"
+	require.NoError(t, afero.WriteFile(fs, providersPath, []byte("providers:\n  - type: google\n  - type: azure\n"), 0644))
+
+	now := time.Now()
+	newCache := func() *VerifyCache {
+		return &VerifyCache{
+			Fs:          fs,
+			Path:        "/var/cache/opk/verify.json",
+			TTL:         time.Minute,
+			PolicyPaths: []string{policyPath, "/home/alice/.opk/policy.yml", providersPath},
+			now:         func() time.Time { return now },
+		}
+	}
+	key := verifyCacheKey("alice", "ecdsa-sha2-nistp256-cert-v01@openssh.com", "AAAA")
+	require.NotEqual(t, key, verifyCacheKey("root", "ecdsa-sha2-nistp256-cert-v01@openssh.com", "AAAA"))
+
+	cache := newCache()
+	require.False(t, cache.Allowed(key))
+	cache.Allow(key, now.Add(time.Hour))
+	require.True(t, cache.Allowed(key))
+
+	// The cache is shared by later invocations of verify
+	require.True(t, newCache().Allowed(key))
+
+	now = now.Add(2 * time.Minute)
+	require.False(t, newCache().Allowed(key), "expected TTL to have passed")
+
+	// Entries never outlive the ID Token
+	newCache().Allow(key, now.Add(10*time.Second))
+	now = now.Add(20 * time.Second)
+	require.False(t, newCache().Allowed(key), "expected ID Token to have expired")
+
+	// Changing a policy file bypasses the cache
+	newCache().Allow(key, now.Add(time.Hour))
+	require.True(t, newCache().Allowed(key))
+	require.NoError(t, afero.WriteFile(fs, "/home/alice/.opk/policy.yml", []byte("users: []\n"), 0600))
+	require.False(t, newCache().Allowed(key), "expected policy change to bypass cache")
+
+	// and so does removing a provider
+	newCache().Allow(key, now.Add(time.Hour))
+	require.True(t, newCache().Allowed(key))
+	require.NoError(t, afero.WriteFile(fs, providersPath, []byte("providers:\n  - type: google\n"), 0644))
+	require.False(t, newCache().Allowed(key), "expected provider change to bypass cache")
+
+	// A cache others can write to is ignored
+	newCache().Allow(key, now.Add(time.Hour))
+	require.True(t, newCache().Allowed(key))
+	require.NoError(t, fs.Chmod("/var/cache/opk/verify.json", 0666))
+	require.False(t, newCache().Allowed(key), "expected insecure cache to be ignored")
+}
@@ -0,0 +1,150 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/openpubkey/openpubkey/config"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/opkssh/policy"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/retry"
+)
+
+// SystemProvidersPath is the config file listing the OpenID providers whose
+// PK tokens verify accepts and which login can choose from. Only its
+// providers, clock_skew and allowlist are used, see package config for the
+// format.
+const SystemProvidersPath = "/etc/opk/providers.yml"
+
+// userConfigPath returns ~/.opk/config.yml, which login reads instead of
+// SystemProvidersPath if it exists. verify never reads it, users must not be
+// able to add providers the server trusts.
+func userConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".opk", "config.yml"), nil
+}
+
+// loadConfig loads the first of paths that exists. If none exist, nil is
+// returned without an error and the built in provider should be used.
+func loadConfig(paths ...string) (*config.Config, error) {
+	for _, path := range paths {
+		cfg, err := config.Load(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load provider config %s: %w", path, err)
+		}
+		return cfg, nil
+	}
+	return nil, nil
+}
+
+// loginProvider returns the provider named providerName in the config at
+// configPath or, if configPath is empty, in the user or system config. If
+// neither exists defaultProvider is used.
+func loginProvider(configPath string, providerName string, defaultProvider providers.OpenIdProvider) (providers.OpenIdProvider, error) {
+	paths := []string{configPath}
+	if configPath == "" {
+		paths = []string{SystemProvidersPath}
+		if userPath, err := userConfigPath(); err == nil {
+			paths = []string{userPath, SystemProvidersPath}
+		}
+	}
+	cfg, err := loadConfig(paths...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		if configPath != "" || providerName != "" {
+			return nil, fmt.Errorf("no provider config found at %v", paths)
+		}
+		return defaultProvider, nil
+	}
+	return cfg.NewProvider(providerName)
+}
+
+// verifyConfigPath returns the provider config verify reads, configPath or,
+// if it is empty, SystemProvidersPath
+func verifyConfigPath(configPath string) string {
+	if configPath == "" {
+		return SystemProvidersPath
+	}
+	return configPath
+}
+
+// verifyCachePaths returns the files which decide whether verify allows a
+// login, so that editing the policy, the accepted providers or the LDAP
+// config bypasses the verify cache
+func verifyCachePaths(principal string, configPath string, ldapConfigPath string) []string {
+	paths := []string{policy.SystemDefaultPolicyPath}
+	if userPolicyPath, err := policy.NewFileLoader().UserPolicyPath(principal); err == nil {
+		paths = append(paths, userPolicyPath)
+	}
+	paths = append(paths, verifyConfigPath(configPath))
+	if ldapConfigPath != "" {
+		paths = append(paths, ldapConfigPath)
+	}
+	return paths
+}
+
+// verifyProviders returns the providers in the config at configPath or, if
+// configPath is empty, at SystemProvidersPath. If there is no config only
+// defaultProvider is accepted. If the config has an allowlist, the returned
+// PublicKeyFinder fetches the providers' configuration and JWKS only from
+// the allowed hosts, otherwise it is nil and the default finder is used.
+func verifyProviders(configPath string, defaultProvider providers.Config) ([]providers.Config, *discover.PublicKeyFinder, error) {
+	cfg, err := loadConfig(verifyConfigPath(configPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg == nil {
+		if configPath != "" {
+			return nil, nil, fmt.Errorf("no provider config found at %s", configPath)
+		}
+		return []providers.Config{defaultProvider}, nil, nil
+	}
+
+	ops, err := cfg.NewProviders()
+	if err != nil {
+		return nil, nil, err
+	}
+	opConfigs := []providers.Config{}
+	for _, op := range ops {
+		opConfig, ok := op.(providers.Config)
+		if !ok {
+			return nil, nil, fmt.Errorf("provider %s can't be used to SSH, it has no client ID", op.Issuer())
+		}
+		opConfigs = append(opConfigs, opConfig)
+	}
+	allowlist, err := cfg.NewAllowlist()
+	if err != nil {
+		return nil, nil, err
+	}
+	if allowlist == nil {
+		return opConfigs, nil, nil
+	}
+	return opConfigs, discover.NewPubkeyFinder(retry.Default.Client(allowlist.HTTPClient())), nil
+}
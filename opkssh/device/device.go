@@ -0,0 +1,99 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package device collects the posture of the device opkssh login runs on so
+// that it can be signed into the PK Token and required by opkssh policy.
+//
+// The device information is reported by the client and signed by the
+// client's key, not attested by the device. It lets fleets without an MDM
+// catch misconfigured laptops, it won't stop a user determined to lie about
+// their device.
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// Claim is the CIC claim holding the device Info
+const Claim = "device"
+
+var errUnknown = errors.New("unknown on this platform")
+
+// Info is the posture of a device at login. Fields which couldn't be
+// determined are left empty.
+type Info struct {
+	Hostname string `json:"hostname,omitempty"`
+	// OS is the operating system as named by runtime.GOOS, e.g. "linux"
+	OS        string `json:"os"`
+	OSVersion string `json:"os_version,omitempty"`
+	// DiskEncrypted is whether the disk holding the root filesystem is
+	// encrypted, nil if unknown
+	DiskEncrypted *bool `json:"disk_encrypted,omitempty"`
+}
+
+// Collect returns the posture of this device. It never fails, anything
+// which can't be determined is left out.
+func Collect(ctx context.Context) *Info {
+	info := &Info{OS: runtime.GOOS}
+	if hostname, err := os.Hostname(); err == nil {
+		info.Hostname = hostname
+	}
+	if version, err := osVersion(ctx); err == nil {
+		info.OSVersion = version
+	}
+	if encrypted, err := diskEncrypted(ctx); err == nil {
+		info.DiskEncrypted = &encrypted
+	}
+	return info
+}
+
+// AuthOpts returns the option to sign the device info into the CIC of the
+// PK Token
+func (i *Info) AuthOpts() client.AuthOpts {
+	// The claim has to be generic JSON values, see client.WithExtraClaimValue.
+	// Info always marshals, so the errors can be ignored.
+	infoJson, _ := json.Marshal(i)
+	var claim map[string]any
+	_ = json.Unmarshal(infoJson, &claim)
+	return client.WithExtraClaimValue(Claim, claim)
+}
+
+// FromPKToken returns the device info in the CIC of the PK Token and false
+// if it has none
+func FromPKToken(pkt *pktoken.PKToken) (*Info, bool, error) {
+	claim, ok := pkt.Cic.ProtectedHeaders().Get(Claim)
+	if !ok {
+		return nil, false, nil
+	}
+	// Parsed claims are generic JSON values, round trip them into Info
+	claimJson, err := json.Marshal(claim)
+	if err != nil {
+		return nil, false, err
+	}
+	info := &Info{}
+	if err := json.Unmarshal(claimJson, info); err != nil {
+		return nil, false, fmt.Errorf("malformed %s claim: %w", Claim, err)
+	}
+	return info, true, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+func osVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "sw_vers", "-productVersion").Output()
+	if err != nil {
+		return "", err
+	}
+	return "macOS " + strings.TrimSpace(string(out)), nil
+}
+
+func diskEncrypted(ctx context.Context) (bool, error) {
+	// fdesetup exits non-zero when FileVault is off, so only its output is
+	// relied on
+	out, _ := exec.CommandContext(ctx, "fdesetup", "isactive").Output()
+	switch strings.TrimSpace(string(out)) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errUnknown
+}
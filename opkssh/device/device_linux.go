@@ -0,0 +1,133 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func osVersion(ctx context.Context) (string, error) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	release := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		release[key] = strings.Trim(value, "'")
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if release["PRETTY_NAME"] != "" {
+		return release["PRETTY_NAME"], nil
+	}
+	if release["NAME"] != "" {
+		return strings.TrimSpace(release["NAME"] + " " + release["VERSION_ID"]), nil
+	}
+	return "", fmt.Errorf("no OS name in /etc/os-release")
+}
+
+func diskEncrypted(ctx context.Context) (bool, error) {
+	source, err := rootMountSource("/proc/self/mounts")
+	if err != nil {
+		return false, err
+	}
+	return blockDeviceEncrypted("/sys/class/block", source)
+}
+
+// rootMountSource returns the device mounted at /
+func rootMountSource(mounts string) (string, error) {
+	f, err := os.Open(mounts)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Later mounts over / hide earlier ones
+	source := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == "/" {
+			source = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", fmt.Errorf("no filesystem mounted at /")
+	}
+	return source, nil
+}
+
+// blockDeviceEncrypted returns whether the block device is, or sits on top
+// of, a dm-crypt device such as LUKS. Filesystems which aren't backed by a
+// block device, e.g. overlay or zfs, can't be checked.
+func blockDeviceEncrypted(sysBlock, source string) (bool, error) {
+	if !strings.HasPrefix(source, "/dev/") {
+		return false, fmt.Errorf("root filesystem %s isn't a block device", source)
+	}
+	// Resolves /dev/mapper/* and /dev/disk/by-* symlinks to the kernel name
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		source = resolved
+	}
+	name := filepath.Base(source)
+	if _, err := os.Stat(filepath.Join(sysBlock, name)); err != nil {
+		return false, fmt.Errorf("unknown block device %s: %w", source, err)
+	}
+	return dmCrypt(sysBlock, name, 0)
+}
+
+func dmCrypt(sysBlock, name string, depth int) (bool, error) {
+	// Guards against cycles in a malformed sysfs
+	if depth > 8 {
+		return false, fmt.Errorf("block devices nested too deep")
+	}
+	uuid, err := os.ReadFile(filepath.Join(sysBlock, name, "dm", "uuid"))
+	if err == nil && strings.HasPrefix(string(uuid), "CRYPT-") {
+		return true, nil
+	}
+	// Device mapper devices, e.g. LVM volumes, are encrypted if every
+	// device they are built on is
+	slaves, err := os.ReadDir(filepath.Join(sysBlock, name, "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return false, nil
+	}
+	for _, slave := range slaves {
+		if encrypted, err := dmCrypt(sysBlock, slave.Name(), depth+1); err != nil || !encrypted {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootMountSource(t *testing.T) {
+	mounts := filepath.Join(t.TempDir(), "mounts")
+	require.NoError(t, os.WriteFile(mounts, []byte(
+		"sysfs /sys sysfs rw 0 0\n"+
+			"/dev/sda1 / ext4 rw 0 0\n"+
+			"/dev/mapper/root / ext4 rw 0 0\n"+
+			"/dev/sda2 /boot ext4 rw 0 0\n"), 0600))
+	source, err := rootMountSource(mounts)
+	require.NoError(t, err)
+	require.Equal(t, "/dev/mapper/root", source)
+
+	require.NoError(t, os.WriteFile(mounts, []byte("/dev/sda2 /boot ext4 rw 0 0\n"), 0600))
+	_, err = rootMountSource(mounts)
+	require.Error(t, err)
+}
+
+func TestBlockDeviceEncrypted(t *testing.T) {
+	sysBlock := t.TempDir()
+	addDevice := func(name, dmUUID string, slaves ...string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "slaves"), 0700))
+		if dmUUID != "" {
+			require.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "dm"), 0700))
+			require.NoError(t, os.WriteFile(filepath.Join(sysBlock, name, "dm", "uuid"), []byte(dmUUID+"\n"), 0600))
+		}
+		for _, slave := range slaves {
+			require.NoError(t, os.MkdirAll(filepath.Join(sysBlock, name, "slaves", slave), 0700))
+		}
+	}
+	addDevice("sda1", "")
+	addDevice("sda2", "")
+	addDevice("dm-0", "CRYPT-LUKS2-0123-luks", "sda2")
+	// LVM volume on top of LUKS
+	addDevice("dm-1", "LVM-abcd", "dm-0")
+	// LVM volume on a plain partition
+	addDevice("dm-2", "LVM-efgh", "sda1")
+
+	testCases := []struct {
+		source    string
+		encrypted bool
+		wantErr   bool
+	}{
+		{source: "/dev/sda1", encrypted: false},
+		{source: "/dev/dm-0", encrypted: true},
+		{source: "/dev/dm-1", encrypted: true},
+		{source: "/dev/dm-2", encrypted: false},
+		{source: "/dev/nvme0n1p1", wantErr: true},
+		{source: "overlay", wantErr: true},
+	}
+	for _, tc := range testCases {
+		encrypted, err := blockDeviceEncrypted(sysBlock, tc.source)
+		if tc.wantErr {
+			require.Error(t, err, tc.source)
+			continue
+		}
+		require.NoError(t, err, tc.source)
+		require.Equal(t, tc.encrypted, encrypted, tc.source)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package device_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/opkssh/device"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollect(t *testing.T) {
+	info := device.Collect(context.Background())
+	require.Equal(t, runtime.GOOS, info.OS)
+}
+
+func TestFromPKToken(t *testing.T) {
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	_, ok, err := device.FromPKToken(pkt)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	encrypted := true
+	info := &device.Info{
+		Hostname:      "laptop-42.corp.example.com",
+		OS:            "linux",
+		OSVersion:     "Ubuntu 24.04 LTS",
+		DiskEncrypted: &encrypted,
+	}
+	pkt, err = opkClient.Auth(context.Background(), info.AuthOpts())
+	require.NoError(t, err)
+
+	// Round trip the PK Token so the claim is parsed from JSON
+	pktJson, err := pkt.MarshalJSON()
+	require.NoError(t, err)
+	require.NoError(t, pkt.UnmarshalJSON(pktJson))
+
+	got, ok, err := device.FromPKToken(pkt)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, info, got)
+}
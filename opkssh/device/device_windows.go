@@ -0,0 +1,48 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package device
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+func osVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "cmd", "/c", "ver").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func diskEncrypted(ctx context.Context) (bool, error) {
+	// Unlike manage-bde this doesn't require an elevated prompt
+	out, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command",
+		"(New-Object -ComObject Shell.Application).NameSpace($env:SystemDrive).Self.ExtendedProperty('System.Volume.BitLockerProtection')").Output()
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "1":
+		return true, nil
+	case "2":
+		return false, nil
+	}
+	// Other values are for volumes being encrypted or decrypted
+	return false, errUnknown
+}
@@ -17,23 +17,43 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ed25519"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/clockskew"
+	"github.com/openpubkey/openpubkey/cosigner/kms"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/notify"
+	"github.com/openpubkey/openpubkey/opkssh/audit"
 	"github.com/openpubkey/openpubkey/opkssh/commands"
 	"github.com/openpubkey/openpubkey/opkssh/policy"
+	"github.com/openpubkey/openpubkey/opkssh/sshcert"
+	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/relay"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -47,17 +67,21 @@ var (
 	}
 )
 
+// keyTypes maps the values of login --key-type to key algorithms
+var keyTypes = map[string]jwa.SignatureAlgorithm{
+	"ecdsa":   jwa.ES256,
+	"ed25519": jwa.EdDSA,
+}
+
+// revocationFetchTimeout bounds how long verify waits for the revocation
+// list at --revocation-url, sshd is waiting on verify
+const revocationFetchTimeout = 5 * time.Second
+
 func main() {
 	os.Exit(run())
 }
 
 func run() int {
-	if len(os.Args) < 2 {
-		fmt.Println("Example SSH key generator using OpenPubkey: command choices are: login, verify, and add")
-		return 1
-	}
-	command := os.Args[1]
-
 	opts := providers.GetDefaultGoogleOpOptions()
 	opts.Issuer = issuer
 	opts.ClientID = clientID
@@ -73,56 +97,214 @@ func run() int {
 		cancel()
 	}()
 
-	switch command {
-	case "login":
-		loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
-		autoRefresh := loginCmd.Bool("auto-refresh", false, "Used to specify whether login will begin a process that auto-refreshes PK token")
-		logFilePath := loginCmd.String("log-dir", "", "Specify which directory the output log is placed")
-		if err := loginCmd.Parse(os.Args[2:]); err != nil {
-			log.Println("ERROR parsing args:", err)
-			return 1
-		}
-
-		// If a log directory was provided, write any logs to a file in that directory AND stdout
-		if *logFilePath != "" {
-			logFilePath := filepath.Join(*logFilePath, "openpubkey.log")
-			logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0700)
-			if err == nil {
-				defer logFile.Close()
-				multiWriter := io.MultiWriter(os.Stdout, logFile)
-				log.SetOutput(multiWriter)
-			}
-		}
-
-		var err error
-		// Execute login command
-		if *autoRefresh {
-			err = commands.LoginWithRefresh(ctx, provider)
-		} else {
-			err = commands.Login(ctx, provider)
-		}
-
-		if err != nil {
-			log.Println("ERROR logging in:", err)
-			return 1
-		}
-	case "verify":
-		// Setup logger
-		logFile, err := os.OpenFile("/var/log/openpubkey.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0700)
-		if err != nil {
-			fmt.Println("ERROR opening log file:", err)
-		} else {
-			defer logFile.Close()
-			log.SetOutput(logFile)
-		}
-
-		// Logs if using an unsupported OpenSSH version
-		checkOpenSSHVersion()
-
-		// The "AuthorizedKeysCommand" func is designed to be used by sshd and specified as an AuthorizedKeysCommand
-		// ref: https://man.openbsd.org/sshd_config#AuthorizedKeysCommand
-		log.Println(strings.Join(os.Args, " "))
+	rootCmd := newRootCmd(provider)
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		log.Println("ERROR:", err)
+		return 1
+	}
+	return 0
+}
+
+// newRootCmd builds the opkssh command tree. Shell completions and man
+// pages are generated from these definitions, so flags and arguments
+// should be declared here rather than parsed by hand.
+func newRootCmd(provider providers.BrowserOpenIdProvider) *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:   "opkssh",
+		Short: "SSH with OpenPubkey",
+		Long:  "Example SSH key generator using OpenPubkey",
+		// Errors are logged by run so that they end up in the same place as
+		// the rest of the command's log output
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	rootCmd.PersistentFlags().String("config", "", "Provider config file, login defaults to ~/.opk/config.yml or "+SystemProvidersPath+" and verify to "+SystemProvidersPath)
+	_ = rootCmd.MarkPersistentFlagFilename("config")
+
+	loginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Authenticate with the OpenID Provider and write an SSH key and certificate",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			autoRefresh, _ := cmd.Flags().GetBool("auto-refresh")
+			logDir, _ := cmd.Flags().GetString("log-dir")
+			deviceInventory, _ := cmd.Flags().GetBool("device-inventory")
+			configPath, _ := cmd.Flags().GetString("config")
+			providerName, _ := cmd.Flags().GetString("provider")
+			duration, _ := cmd.Flags().GetDuration("duration")
+			renewable, _ := cmd.Flags().GetBool("renewable")
+			securityKey, _ := cmd.Flags().GetString("security-key")
+			keyType, _ := cmd.Flags().GetString("key-type")
+			keepKey, _ := cmd.Flags().GetBool("keep-key")
+			compressPKT, _ := cmd.Flags().GetBool("compress-pkt")
+			pktChunkSize, _ := cmd.Flags().GetInt("pkt-chunk-size")
+			extensions, _ := cmd.Flags().GetStringArray("extension")
+			withoutExtensions, _ := cmd.Flags().GetStringArray("no-extension")
+			caURL, _ := cmd.Flags().GetString("ca-url")
+			principals, _ := cmd.Flags().GetStringArray("principal")
+			relayURL, _ := cmd.Flags().GetString("relay-url")
+
+			// If a log directory was provided, write any logs to a file in that directory AND stdout
+			if logDir != "" {
+				logFilePath := filepath.Join(logDir, "openpubkey.log")
+				logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0700)
+				if err == nil {
+					defer logFile.Close()
+					multiWriter := io.MultiWriter(os.Stdout, logFile)
+					log.SetOutput(multiWriter)
+				}
+			}
+
+			op, err := loginProvider(configPath, providerName, provider)
+			if err != nil {
+				return err
+			}
+			if relayURL != "" {
+				if !strings.HasPrefix(relayURL, "https://") {
+					return fmt.Errorf("relay URL must use https: %s", relayURL)
+				}
+				standardOp, ok := op.(*providers.StandardOp)
+				if !ok {
+					return fmt.Errorf("provider %s does not support logging in on another device", op.Issuer())
+				}
+				standardOp.Relay = &relay.Client{URL: relayURL}
+			}
+
+			keyAlg, ok := keyTypes[keyType]
+			if !ok {
+				return fmt.Errorf("unsupported key type %s, must be ecdsa or ed25519", keyType)
+			}
+			loginOpts := []commands.LoginOpts{commands.WithCertValidity(duration), commands.WithKeyAlgorithm(keyAlg)}
+			if renewable {
+				loginOpts = append(loginOpts, commands.WithRenewal())
+			}
+			if deviceInventory {
+				loginOpts = append(loginOpts, commands.WithDeviceInventory())
+			}
+			if keepKey {
+				loginOpts = append(loginOpts, commands.WithExistingKey())
+			}
+			if compressPKT {
+				loginOpts = append(loginOpts, commands.WithCompressedPKT())
+			}
+			if pktChunkSize < 0 {
+				return fmt.Errorf("PK Token chunk size must not be negative")
+			} else if pktChunkSize > 0 {
+				loginOpts = append(loginOpts, commands.WithPKTChunkSize(pktChunkSize))
+			}
+			if securityKey != "" {
+				loginOpts = append(loginOpts, commands.WithSecurityKey(securityKey))
+			}
+			if caURL != "" {
+				if !strings.HasPrefix(caURL, "https://") {
+					return fmt.Errorf("CA URL must use https: %s", caURL)
+				}
+				loginOpts = append(loginOpts, commands.WithCA(caURL))
+			}
+			if len(principals) > 0 {
+				loginOpts = append(loginOpts, commands.WithPrincipals(principals...))
+			}
+			for _, name := range withoutExtensions {
+				loginOpts = append(loginOpts, commands.WithoutExtension(name))
+			}
+			for _, extension := range extensions {
+				name, value, _ := strings.Cut(extension, "=")
+				loginOpts = append(loginOpts, commands.WithExtension(name, value))
+			}
+
+			// Execute login command
+			if autoRefresh {
+				refreshableOp, ok := op.(providers.RefreshableOpenIdProvider)
+				if !ok {
+					return fmt.Errorf("provider %s does not support refreshing ID tokens", op.Issuer())
+				}
+				err = commands.LoginWithRefresh(cmd.Context(), refreshableOp, loginOpts...)
+			} else {
+				err = commands.Login(cmd.Context(), op, loginOpts...)
+			}
+			if err != nil {
+				return fmt.Errorf("logging in: %w", err)
+			}
+			return nil
+		},
+	}
+	loginCmd.Flags().Bool("auto-refresh", false, "Used to specify whether login will begin a process that auto-refreshes PK token")
+	loginCmd.Flags().String("log-dir", "", "Specify which directory the output log is placed")
+	loginCmd.Flags().Bool("device-inventory", false, "Include this device's hostname, OS version and disk encryption status in the PK Token for policy to check")
+	loginCmd.Flags().String("provider", "", "Name of the OpenID Provider to log in with, required if the provider config has several")
+	loginCmd.Flags().Duration("duration", commands.DefaultCertValidity, "How long the SSH certificate is valid for, 0 for no limit")
+	loginCmd.Flags().Bool("renewable", false, "Store the refresh token in ~/.opk so that opkssh renew can mint a fresh certificate without the browser")
+	loginCmd.Flags().String("key-type", "ecdsa", "Type of the SSH key to generate, ecdsa or ed25519")
+	_ = loginCmd.RegisterFlagCompletionFunc("key-type", cobra.FixedCompletions([]string{"ecdsa", "ed25519"}, cobra.ShellCompDirectiveNoFileComp))
+	loginCmd.Flags().Bool("compress-pkt", false, "Compress the PK Token in the SSH certificate, SSH servers must run an opkssh that supports it")
+	loginCmd.Flags().Int("pkt-chunk-size", 0, "Split the PK Token in the SSH certificate across extensions of at most this many bytes, SSH servers must run an opkssh that supports it")
+	loginCmd.Flags().Bool("keep-key", false, "Reuse the SSH key written by an earlier login and only replace its certificate, so ssh-agent and multiplexed connections keep working")
+	loginCmd.Flags().String("security-key", "", "Write a certificate for the FIDO security key with this public key file, e.g. ~/.ssh/id_ecdsa_sk.pub, instead of generating a key")
+	_ = loginCmd.MarkFlagFilename("security-key")
+	loginCmd.Flags().StringArray("extension", nil, "Add an extension to the SSH certificate, as name or name=value, custom extensions are named name@domain")
+	loginCmd.Flags().StringArray("no-extension", nil, "Remove one of the permit-* extensions the SSH certificate has by default")
+	_ = loginCmd.RegisterFlagCompletionFunc("no-extension", cobra.FixedCompletions(sshcert.DefaultUserExtensions, cobra.ShellCompDirectiveNoFileComp))
+	loginCmd.Flags().String("ca-url", "", "Have the opkssh ca at this HTTPS URL sign the SSH certificate, for hosts that trust it with TrustedUserCAKeys")
+	loginCmd.Flags().StringArray("principal", nil, "User the SSH certificate is for, required with --ca-url")
+	loginCmd.Flags().String("relay-url", "", "Log in on another device, e.g. a phone, by scanning a QR code relayed through the opkssh relay at this HTTPS URL")
+	_ = loginCmd.MarkFlagDirname("log-dir")
+
+	renewCmd := &cobra.Command{
+		Use:   "renew",
+		Short: "Mint a fresh SSH certificate for the key written by login --renewable using a refreshed ID Token",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, _ := cmd.Flags().GetString("config")
+			providerName, _ := cmd.Flags().GetString("provider")
+			duration, _ := cmd.Flags().GetDuration("duration")
 
+			op, err := loginProvider(configPath, providerName, provider)
+			if err != nil {
+				return err
+			}
+			refreshableOp, ok := op.(providers.RefreshableOpenIdProvider)
+			if !ok {
+				return fmt.Errorf("provider %s does not support refreshing ID tokens", op.Issuer())
+			}
+			if err := commands.Renew(cmd.Context(), refreshableOp, commands.WithCertValidity(duration)); err != nil {
+				return fmt.Errorf("renewing: %w", err)
+			}
+			return nil
+		},
+	}
+	renewCmd.Flags().Duration("duration", commands.DefaultCertValidity, "How long the SSH certificate is valid for, 0 for no limit")
+	renewCmd.Flags().String("provider", "", "Name of the OpenID Provider logged in with, required if the provider config has several")
+
+	hostCertCmd := &cobra.Command{
+		Use:     "host-cert <hostname>...",
+		Short:   "Write an SSH host key and a host certificate for it backed by this machine's OpenID identity",
+		Example: "  opkssh host-cert --provider github runner.example.com",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, _ := cmd.Flags().GetString("config")
+			providerName, _ := cmd.Flags().GetString("provider")
+			duration, _ := cmd.Flags().GetDuration("duration")
+			keyPath, _ := cmd.Flags().GetString("key")
+
+			op, err := loginProvider(configPath, providerName, provider)
+			if err != nil {
+				return err
+			}
+			if err := commands.HostCert(cmd.Context(), op, args, keyPath, duration); err != nil {
+				return fmt.Errorf("creating host certificate: %w", err)
+			}
+			return nil
+		},
+	}
+	hostCertCmd.Flags().Duration("duration", commands.DefaultCertValidity, "How long the host certificate is valid for, 0 for no limit")
+	hostCertCmd.Flags().String("provider", "", "Name of the OpenID Provider to get the identity from, required if the provider config has several")
+	hostCertCmd.Flags().String("key", commands.DefaultHostKeyPath, "Where to write the host key, the certificate is written next to it with the suffix -cert.pub")
+	_ = hostCertCmd.MarkFlagFilename("key")
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify <user> <cert> <key-type>",
+		Short: "Verify an SSH certificate, designed to be run by sshd as an AuthorizedKeysCommand",
 		// These arguments are sent by sshd and dictated by the pattern as defined in the sshd config
 		// Example line in sshd config:
 		// 		AuthorizedKeysCommand /etc/opk/opkssh verify %u %k %t
@@ -130,27 +312,408 @@ func run() int {
 		//	%u The desired user being assumed on the target (aka requested principal).
 		//	%k The base64-encoded public key for authentication.
 		//	%t The public key type, in this case an ssh certificate being used as a public key.
-		if len(os.Args) != 5 {
-			log.Println("Invalid number of arguments for verify, expected: `<User (TOKEN u)> <Key type (TOKEN t)> <Cert (TOKEN k)>`")
-			return 1
-		}
-		userArg := os.Args[2]
-		certB64Arg := os.Args[3]
-		typArg := os.Args[4]
-
-		// Execute verify command
-		v := commands.VerifyCmd{
-			OPConfig:    provider,
-			CheckPolicy: commands.OpkPolicyEnforcerFunc(userArg),
-		}
-		if authKey, err := v.AuthorizedKeysCommand(ctx, userArg, typArg, certB64Arg); err != nil {
-			log.Println("failed to verify:", err)
-			return 1
-		} else {
+		Example: "  AuthorizedKeysCommand /etc/opk/opkssh verify %u %k %t",
+		Args:    cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			// Setup logger
+			_ = os.MkdirAll(filepath.Dir(verifyLogPath), 0700)
+			logFile, err := os.OpenFile(verifyLogPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0700)
+			if err != nil {
+				fmt.Println("ERROR opening log file:", err)
+			} else {
+				log.SetOutput(logFile)
+				defer func() {
+					// Record why the login was denied before the log file
+					// is closed, run logs the error again to stderr
+					if err != nil {
+						log.Println("ERROR:", err)
+					}
+					log.SetOutput(os.Stderr)
+					logFile.Close()
+				}()
+			}
+
+			// Logs if using an unsupported OpenSSH version
+			checkOpenSSHVersion()
+
+			// The "AuthorizedKeysCommand" func is designed to be used by sshd and specified as an AuthorizedKeysCommand
+			// ref: https://man.openbsd.org/sshd_config#AuthorizedKeysCommand
+			log.Println(strings.Join(os.Args, " "))
+
+			userArg := args[0]
+			certB64Arg := args[1]
+			typArg := args[2]
+			clockSkew, _ := cmd.Flags().GetDuration("clock-skew")
+			maxCertValidity, _ := cmd.Flags().GetDuration("max-cert-validity")
+			auditLogPath, _ := cmd.Flags().GetString("audit-log")
+			auditKeyPath, _ := cmd.Flags().GetString("audit-key")
+			ldapConfigPath, _ := cmd.Flags().GetString("ldap-config")
+			hostname, _ := cmd.Flags().GetString("hostname")
+			if hostname == "" {
+				if hostname, err = os.Hostname(); err != nil {
+					log.Println("failed to get hostname, policy entries scoped to hosts won't apply:", err)
+				}
+			}
+			configPath, _ := cmd.Flags().GetString("config")
+			opConfigs, finder, err := verifyProviders(configPath, provider)
+			if err != nil {
+				return err
+			}
+			cacheTTL, _ := cmd.Flags().GetDuration("cache-ttl")
+			cachePath, _ := cmd.Flags().GetString("cache-path")
+			jwksCacheDir, _ := cmd.Flags().GetString("jwks-cache-dir")
+			jwksCacheTTL, _ := cmd.Flags().GetDuration("jwks-cache-ttl")
+			jwksMaxStale, _ := cmd.Flags().GetDuration("jwks-max-stale")
+			notifyWebhook, _ := cmd.Flags().GetString("notify-webhook")
+			notifySecretPath, _ := cmd.Flags().GetString("notify-webhook-secret")
+			revocationPath, _ := cmd.Flags().GetString("revocation-list")
+			revocationURL, _ := cmd.Flags().GetString("revocation-url")
+			requiredExtensions, _ := cmd.Flags().GetStringSlice("require-extension")
+			strippedExtensions, _ := cmd.Flags().GetStringSlice("strip-extension")
+
+			var extraLoaders []policy.Loader
+			if ldapConfigPath != "" {
+				ldapLoader, err := policy.NewFileLoader().LoadLDAPLoader(ldapConfigPath)
+				if err != nil {
+					return fmt.Errorf("failed to read LDAP config: %w", err)
+				}
+				extraLoaders = append(extraLoaders, ldapLoader)
+			}
+
+			// Execute verify command
+			v := commands.VerifyCmd{
+				OPConfigs:          opConfigs,
+				CheckPolicy:        commands.OpkPolicyEnforcerFunc(userArg, hostname, extraLoaders...),
+				ClockSkew:          clockskew.New(clockSkew),
+				MaxCertValidity:    maxCertValidity,
+				RequiredExtensions: requiredExtensions,
+				StrippedExtensions: strippedExtensions,
+				PublicKeyFinder:    finder,
+			}
+			if notifyWebhook != "" {
+				webhook := &notify.Webhook{URL: notifyWebhook}
+				if notifySecretPath != "" {
+					secret, err := os.ReadFile(notifySecretPath)
+					if err != nil {
+						return fmt.Errorf("failed to read webhook secret: %w", err)
+					}
+					webhook.Secret = bytes.TrimSpace(secret)
+				}
+				v.Notifier = webhook
+			}
+			if cacheTTL > 0 {
+				v.Cache = commands.NewVerifyCache(cachePath, cacheTTL, verifyCachePaths(userArg, configPath, ldapConfigPath)...)
+			}
+			if jwksCacheDir != "" {
+				if finder == nil {
+					finder = discover.DefaultPubkeyFinder()
+				}
+				v.PublicKeyFinder = discover.NewDiskCachingPubkeyFinder(finder, jwksCacheDir, jwksCacheTTL, jwksMaxStale, nil)
+			}
+			// The revocation list is optional, so that hosts without one keep
+			// working, but one that exists must be readable
+			if _, err := os.Stat(revocationPath); err == nil {
+				v.RevocationCheckers = append(v.RevocationCheckers, verifier.NewFileRevocationChecker(revocationPath))
+			}
+			if revocationURL != "" {
+				if !strings.HasPrefix(revocationURL, "https://") {
+					return fmt.Errorf("revocation list URL must use https: %s", revocationURL)
+				}
+				httpClient := &http.Client{Timeout: revocationFetchTimeout}
+				v.RevocationCheckers = append(v.RevocationCheckers, verifier.NewHTTPRevocationChecker(revocationURL, httpClient, 0))
+			}
+			if auditLogPath != "" {
+				v.Audit = audit.NewLog(auditLogPath, nil)
+				if auditKeyPath != "" {
+					sk, err := util.ReadSKFile(auditKeyPath)
+					if err != nil {
+						return fmt.Errorf("failed to read audit key: %w", err)
+					}
+					v.Audit.Signer = sk
+				}
+			}
+			authKey, err := v.AuthorizedKeysCommand(cmd.Context(), userArg, typArg, certB64Arg)
+			if err != nil {
+				return fmt.Errorf("failed to verify: %w", err)
+			}
 			// sshd is awaiting a specific line, which we print here. Printing anything else before or after will break our solution
 			fmt.Println(authKey)
-		}
-	case "add":
+			return nil
+		},
+	}
+
+	verifyCmd.Flags().Duration("clock-skew", 0, "How far apart the OpenID Provider's clock and this server's may be when checking whether the ID Token has expired")
+	verifyCmd.Flags().Duration("max-cert-validity", 0, "Reject SSH certificates valid for longer than this, including those that never expire, 0 for no limit")
+	verifyCmd.Flags().String("audit-log", "", "Append a hash chained record of every authorization decision to this file")
+	verifyCmd.Flags().String("audit-key", "", "Sign audit records with the ECDSA private key in this PEM file")
+	verifyCmd.Flags().String("notify-webhook", "", "POST a JSON login event to this URL for every allowed login")
+	verifyCmd.Flags().String("notify-webhook-secret", "", "Sign login events with the HMAC secret in this file, see notify.VerifyWebhook")
+	_ = verifyCmd.MarkFlagFilename("notify-webhook-secret")
+	verifyCmd.Flags().String("hostname", "", "Name of this host matched against the hosts of policy entries, defaults to the system hostname")
+	verifyCmd.Flags().String("ldap-config", "", "Also grant access to the members of the LDAP or Active Directory groups configured in this file")
+	_ = verifyCmd.MarkFlagFilename("ldap-config")
+	verifyCmd.Flags().Duration("cache-ttl", commands.DefaultVerifyCacheTTL, "How long an allowed login is remembered so repeated logins skip verification, 0 disables the cache")
+	verifyCmd.Flags().String("cache-path", commands.DefaultVerifyCachePath, "File allowed logins are remembered in")
+	_ = verifyCmd.MarkFlagFilename("cache-path")
+	verifyCmd.Flags().String("jwks-cache-dir", commands.DefaultJwksCacheDir, "Directory the OpenID Providers' signing keys are kept in between logins, empty to fetch them on every login")
+	_ = verifyCmd.MarkFlagDirname("jwks-cache-dir")
+	verifyCmd.Flags().Duration("jwks-cache-ttl", discover.DefaultJwksCacheTTL, "How long signing keys are kept before they are fetched again")
+	verifyCmd.Flags().Duration("jwks-max-stale", commands.DefaultJwksMaxStale, "How long past --jwks-cache-ttl kept signing keys are used while the OpenID Provider can't be reached")
+	verifyCmd.Flags().String("revocation-list", commands.DefaultRevocationListPath, "Deny PK Tokens revoked by this JSON file, see opkssh revoke, a missing file revokes nothing")
+	_ = verifyCmd.MarkFlagFilename("revocation-list")
+	verifyCmd.Flags().String("revocation-url", "", "Also deny PK Tokens revoked by the list at this HTTPS URL, every login is denied while it can't be fetched")
+	verifyCmd.Flags().StringSlice("require-extension", nil, "Deny logins with SSH certificates that lack these extensions")
+	verifyCmd.Flags().StringSlice("strip-extension", nil, "Withhold the permissions of these permit-* extensions from logins even if the SSH certificate grants them")
+	_ = verifyCmd.RegisterFlagCompletionFunc("strip-extension", cobra.FixedCompletions(sshcert.DefaultUserExtensions, cobra.ShellCompDirectiveNoFileComp))
+	_ = verifyCmd.MarkFlagFilename("audit-log")
+	_ = verifyCmd.MarkFlagFilename("audit-key")
+
+	caCmd := &cobra.Command{
+		Use:   "ca",
+		Short: "Run an SSH certificate authority that signs the certificates of users whose PK Tokens verify",
+		Long: `Run an SSH certificate authority that signs the certificates of users whose PK Tokens verify.
+
+The CA verifies the PK Token and policy for every principal the certificate
+of opkssh login --ca-url asks for, then signs a standard certificate for the
+same key. Hosts trust the CA with TrustedUserCAKeys instead of running opkssh
+verify. Policy entries scoped to hosts don't apply.`,
+		Example: "  opkssh ca --key /etc/opk/ca_key --tls-cert /etc/opk/tls.pem --tls-key /etc/opk/tls.key",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyPath, _ := cmd.Flags().GetString("key")
+			awsKMSKey, _ := cmd.Flags().GetString("aws-kms-key")
+			listen, _ := cmd.Flags().GetString("listen")
+			tlsCertPath, _ := cmd.Flags().GetString("tls-cert")
+			tlsKeyPath, _ := cmd.Flags().GetString("tls-key")
+			duration, _ := cmd.Flags().GetDuration("duration")
+			clockSkew, _ := cmd.Flags().GetDuration("clock-skew")
+			revocationPath, _ := cmd.Flags().GetString("revocation-list")
+			strippedExtensions, _ := cmd.Flags().GetStringSlice("strip-extension")
+			configPath, _ := cmd.Flags().GetString("config")
+
+			if (keyPath == "") == (awsKMSKey == "") {
+				return fmt.Errorf("exactly one of --key and --aws-kms-key is required")
+			}
+			if tlsCertPath == "" || tlsKeyPath == "" {
+				return fmt.Errorf("--tls-cert and --tls-key are required")
+			}
+			if duration <= 0 {
+				return fmt.Errorf("certificate duration must be positive")
+			}
+			opConfigs, finder, err := verifyProviders(configPath, provider)
+			if err != nil {
+				return err
+			}
+			signer, err := caSigner(cmd.Context(), keyPath, awsKMSKey)
+			if err != nil {
+				return fmt.Errorf("failed to load CA key: %w", err)
+			}
+			caPubkey, err := ssh.NewPublicKey(signer.Public())
+			if err != nil {
+				return err
+			}
+
+			v := &commands.VerifyCmd{
+				OPConfigs: opConfigs,
+				// The CA doesn't know which hosts the certificate will be
+				// used on so host scoped entries never apply
+				CheckPolicy: func(principal string, pkt *pktoken.PKToken) error {
+					return commands.OpkPolicyEnforcerFunc(principal, "")(principal, pkt)
+				},
+				ClockSkew:          clockskew.New(clockSkew),
+				StrippedExtensions: strippedExtensions,
+				PublicKeyFinder:    finder,
+			}
+			if _, err := os.Stat(revocationPath); err == nil {
+				v.RevocationCheckers = append(v.RevocationCheckers, verifier.NewFileRevocationChecker(revocationPath))
+			}
+			server := &http.Server{
+				Addr:              listen,
+				Handler:           commands.NewCAHandler(&commands.CACmd{Verify: v, Signer: signer, Validity: duration}),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				<-cmd.Context().Done()
+				server.Close()
+			}()
+			fmt.Fprintf(cmd.ErrOrStderr(), "CA listening on %s, hosts trust it with TrustedUserCAKeys containing:\n%s", listen, ssh.MarshalAuthorizedKey(caPubkey))
+			if err := server.ListenAndServeTLS(tlsCertPath, tlsKeyPath); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+	caCmd.Flags().String("key", "", "SSH private key file of the CA, e.g. written by ssh-keygen")
+	caCmd.Flags().String("aws-kms-key", "", "Sign with this AWS KMS key instead, using the region and credentials in AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	caCmd.Flags().String("listen", ":8443", "Address to serve the CA on")
+	caCmd.Flags().String("tls-cert", "", "TLS certificate file to serve the CA with")
+	caCmd.Flags().String("tls-key", "", "TLS private key file to serve the CA with")
+	caCmd.Flags().Duration("duration", commands.DefaultCertValidity, "How long signed certificates are valid for, never longer than the certificate of opkssh login")
+	caCmd.Flags().Duration("clock-skew", 0, "How far apart the OpenID Provider's clock and the CA's may be when checking whether the ID Token has expired")
+	caCmd.Flags().String("revocation-list", commands.DefaultRevocationListPath, "Deny PK Tokens revoked by this JSON file, see opkssh revoke, a missing file revokes nothing")
+	caCmd.Flags().StringSlice("strip-extension", nil, "Leave these permit-* extensions out of signed certificates even if the user's certificate has them")
+	_ = caCmd.RegisterFlagCompletionFunc("strip-extension", cobra.FixedCompletions(sshcert.DefaultUserExtensions, cobra.ShellCompDirectiveNoFileComp))
+	_ = caCmd.MarkFlagFilename("key")
+	_ = caCmd.MarkFlagFilename("tls-cert")
+	_ = caCmd.MarkFlagFilename("tls-key")
+	_ = caCmd.MarkFlagFilename("revocation-list")
+
+	relayCmd := &cobra.Command{
+		Use:   "relay",
+		Short: "Run a relay that lets users log in on another device by scanning a QR code",
+		Long: `Run a relay that lets users log in on another device by scanning a QR code.
+
+opkssh login --relay-url shows a QR code of a short URL at the relay and a
+binding code. The user opens the URL on their phone, enters the binding
+code and logs in with the OpenID Provider, which redirects back to the
+relay. The machine picks up the authorization code from the relay and
+redeems it with the PKCE verifier only it holds. This works with OpenID
+Providers that don't support the device authorization grant.
+
+Register the relay's callback URL, --url followed by /callback, as a
+redirect URI of the OpenID Provider's client.`,
+		Example: "  opkssh relay --url https://relay.example.com --allowed-auth-host accounts.google.com --tls-cert /etc/opk/tls.pem --tls-key /etc/opk/tls.key",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			relayURL, _ := cmd.Flags().GetString("url")
+			allowedAuthHosts, _ := cmd.Flags().GetStringArray("allowed-auth-host")
+			listen, _ := cmd.Flags().GetString("listen")
+			tlsCertPath, _ := cmd.Flags().GetString("tls-cert")
+			tlsKeyPath, _ := cmd.Flags().GetString("tls-key")
+
+			if !strings.HasPrefix(relayURL, "https://") {
+				return fmt.Errorf("relay URL must use https: %s", relayURL)
+			}
+			if tlsCertPath == "" || tlsKeyPath == "" {
+				return fmt.Errorf("--tls-cert and --tls-key are required")
+			}
+			r := relay.New(relayURL)
+			r.AllowedAuthHosts = allowedAuthHosts
+			server := &http.Server{
+				Addr:              listen,
+				Handler:           relay.NewHandler(r),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				<-cmd.Context().Done()
+				server.Close()
+			}()
+			fmt.Fprintf(cmd.ErrOrStderr(), "Relay listening on %s, register %s as a redirect URI with the OpenID Provider\n", listen, r.CallbackURL())
+			if err := server.ListenAndServeTLS(tlsCertPath, tlsKeyPath); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+	relayCmd.Flags().String("url", "", "External HTTPS URL the relay is reached at")
+	relayCmd.Flags().StringArray("allowed-auth-host", nil, "Host of an OpenID Provider logins may be sent to, by default any")
+	relayCmd.Flags().String("listen", ":8443", "Address to serve the relay on")
+	relayCmd.Flags().String("tls-cert", "", "TLS certificate file to serve the relay with")
+	relayCmd.Flags().String("tls-key", "", "TLS private key file to serve the relay with")
+	_ = relayCmd.MarkFlagFilename("tls-cert")
+	_ = relayCmd.MarkFlagFilename("tls-key")
+
+	auditVerifyCmd := &cobra.Command{
+		Use:     "audit-verify <file>",
+		Short:   "Check that an audit log written by verify has not been tampered with",
+		Example: "  opkssh audit-verify --pubkey /etc/opk/audit.pub /var/log/opkssh-audit.log",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pubkeyPath, _ := cmd.Flags().GetString("pubkey")
+
+			var pubkey crypto.PublicKey
+			if pubkeyPath != "" {
+				var err error
+				if pubkey, err = audit.ReadPublicKeyFile(pubkeyPath); err != nil {
+					return fmt.Errorf("failed to read public key: %w", err)
+				}
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			n, err := audit.Verify(f, pubkey)
+			if err != nil {
+				return fmt.Errorf("audit log failed verification after %d records: %w", n, err)
+			}
+			fmt.Printf("Verified %d records\n", n)
+			return nil
+		},
+	}
+	auditVerifyCmd.Flags().String("pubkey", "", "Require every record to be signed by the public key in this PEM file")
+	_ = auditVerifyCmd.MarkFlagFilename("pubkey")
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke PK Tokens so that verify denies them before they expire",
+		Example: "  opkssh revoke --issuer https://accounts.google.com --sub 1234567890\n" +
+			"  opkssh revoke --cert id_ecdsa-cert.pub",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r := commands.RevokeCmd{}
+			r.Path, _ = cmd.Flags().GetString("file")
+			r.Issuer, _ = cmd.Flags().GetString("issuer")
+			r.Subject, _ = cmd.Flags().GetString("sub")
+			r.TokenID, _ = cmd.Flags().GetString("jti")
+			r.CertPath, _ = cmd.Flags().GetString("cert")
+			path, err := r.Revoke()
+			if err != nil {
+				return err
+			}
+			log.Println("Successfully revoked in", path)
+			return nil
+		},
+	}
+	revokeCmd.Flags().String("file", commands.DefaultRevocationListPath, "Revocation list to append to")
+	_ = revokeCmd.MarkFlagFilename("file")
+	revokeCmd.Flags().String("issuer", "", "OpenID Provider of the PK Tokens to revoke, required with --sub and --jti")
+	revokeCmd.Flags().String("sub", "", "Revoke every PK Token for this subject")
+	revokeCmd.Flags().String("jti", "", "Revoke the PK Token whose ID Token has this JWT ID")
+	revokeCmd.Flags().String("cert", "", "Revoke the PK Token in this SSH certificate")
+	_ = revokeCmd.MarkFlagFilename("cert")
+
+	krlCmd := &cobra.Command{
+		Use:     "krl",
+		Short:   "Write an OpenSSH Key Revocation List revoking the certificates opkssh ca issued to revoked subjects",
+		Example: "  opkssh krl --ca-key /etc/ssh/opk_ca.pub --out /etc/ssh/opk_revoked_keys",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			k := commands.KRLCmd{}
+			k.Path, _ = cmd.Flags().GetString("file")
+			k.CAKeyPath, _ = cmd.Flags().GetString("ca-key")
+			k.OutPath, _ = cmd.Flags().GetString("out")
+			serials, _ := cmd.Flags().GetStringSlice("serial")
+			for _, serial := range serials {
+				n, err := strconv.ParseUint(serial, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid certificate serial %s", serial)
+				}
+				k.Serials = append(k.Serials, n)
+			}
+			skipped, err := k.Write()
+			if err != nil {
+				return err
+			}
+			for _, entry := range skipped {
+				log.Printf("warning: revocation of iss=%q sub=%q jti=%q hash=%q can't be expressed in a KRL", entry.Issuer, entry.Subject, entry.JTI, entry.Hash)
+			}
+			log.Println("Successfully wrote KRL to", k.OutPath)
+			return nil
+		},
+	}
+	krlCmd.Flags().String("file", commands.DefaultRevocationListPath, "Revocation list to revoke the subjects of, a missing file revokes nothing")
+	_ = krlCmd.MarkFlagFilename("file")
+	krlCmd.Flags().String("ca-key", "", "Public key of the CA whose certificates to revoke, without it certificates of any CA are revoked")
+	_ = krlCmd.MarkFlagFilename("ca-key")
+	krlCmd.Flags().StringSlice("serial", nil, "Also revoke the certificates with these serials")
+	krlCmd.Flags().String("out", commands.DefaultKRLPath, "Where to write the KRL, name it with RevokedKeys in sshd_config")
+	_ = krlCmd.MarkFlagFilename("out")
+
+	addCmd := &cobra.Command{
+		Use:   "add <email> <principal>",
+		Short: "Add a user to the policy file",
 		// The "add" command is designed to be used by the client configuration
 		// script to inject user entries into the policy file
 		//
@@ -159,30 +722,105 @@ func run() int {
 		//
 		//  %e The email of the user to be added to the policy file.
 		//	%p The desired principal being assumed on the target (aka requested principal).
-		if len(os.Args) != 4 {
-			fmt.Println("Invalid number of arguments for verify, expected: `<Email (TOKEN e)> <Principal (TOKEN p)>`")
-			return 1
-		}
-		inputEmail := os.Args[2]
-		inputPrincipal := os.Args[3]
-
-		// Execute add command
-		a := commands.AddCmd{
-			PolicyFileLoader: policy.NewFileLoader(),
-			Username:         inputPrincipal,
-		}
-		if policyFilePath, err := a.Add(inputEmail, inputPrincipal); err != nil {
-			log.Println("failed to add to policy:", err)
-			return 1
-		} else {
+		Example: "  opkssh add alice@example.com root\n  opkssh add --group admins --issuer https://accounts.google.com alice@example.com root",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inputEmail := args[0]
+			inputPrincipal := args[1]
+			group, _ := cmd.Flags().GetString("group")
+			issuer, _ := cmd.Flags().GetString("issuer")
+
+			// Execute add command
+			a := commands.AddCmd{
+				PolicyFileLoader: policy.NewFileLoader(),
+				Username:         inputPrincipal,
+				Group:            group,
+				Issuer:           issuer,
+			}
+			policyFilePath, err := a.Add(inputEmail, inputPrincipal)
+			if err != nil {
+				return fmt.Errorf("failed to add to policy: %w", err)
+			}
 			log.Println("Successfully added new policy to", policyFilePath)
-		}
-	default:
-		log.Println("ERROR! Unrecognized command:", command)
-		return 1
+			return nil
+		},
 	}
 
-	return 0
+	addCmd.Flags().String("group", "", "Add the user to this policy group and grant the principal to the group")
+	addCmd.Flags().String("issuer", "", "Only allow ID Tokens issued by this OpenID Provider for the entry")
+
+	policyCmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Inspect and edit the policy file",
+	}
+
+	policyListCmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List the entries of the policy file",
+		Example: "  opkssh policy list\n  opkssh policy list --json",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			asJSON, _ := cmd.Flags().GetBool("json")
+			currentUser, err := user.Current()
+			if err != nil {
+				return err
+			}
+
+			l := commands.ListCmd{
+				PolicyFileLoader: policy.NewFileLoader(),
+				Username:         currentUser.Username,
+				JSON:             asJSON,
+			}
+			return l.List(os.Stdout)
+		},
+	}
+	policyListCmd.Flags().Bool("json", false, "Print the policy and its path as JSON")
+
+	policyRemoveCmd := &cobra.Command{
+		Use:     "remove <email> <principal>",
+		Short:   "Remove a principal from a user in the policy file",
+		Example: "  opkssh policy remove alice@example.com root",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inputEmail := args[0]
+			inputPrincipal := args[1]
+			issuer, _ := cmd.Flags().GetString("issuer")
+
+			r := commands.RemoveCmd{
+				PolicyFileLoader: policy.NewFileLoader(),
+				Username:         inputPrincipal,
+				Issuer:           issuer,
+			}
+			policyFilePath, err := r.Remove(inputEmail, inputPrincipal)
+			if err != nil {
+				return err
+			}
+			log.Println("Successfully removed policy from", policyFilePath)
+			return nil
+		},
+	}
+	policyRemoveCmd.Flags().String("issuer", "", "Remove the principal from the entry constrained to this OpenID Provider")
+	policyCmd.AddCommand(policyListCmd, policyRemoveCmd)
+
+	manCmd := &cobra.Command{
+		Use:    "man <dir>",
+		Short:  "Generate man pages for opkssh into the given directory",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return nil, cobra.ShellCompDirectiveFilterDirs
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			header := &doc.GenManHeader{
+				Title:   "OPKSSH",
+				Section: "1",
+			}
+			return doc.GenManTree(rootCmd, header, args[0])
+		},
+	}
+
+	rootCmd.AddCommand(loginCmd, renewCmd, hostCertCmd, verifyCmd, caCmd, relayCmd, auditVerifyCmd, revokeCmd, krlCmd, addCmd, policyCmd, manCmd)
+	return rootCmd
 }
 
 // OpenSSH used to impose a 4096-octet limit on the string buffers available to
@@ -192,6 +830,39 @@ func run() int {
 // The following two functions check whether the OpenSSH version on the
 // system running the verifier is greater than or equal to 8.1;
 // if not then prints a warning
+// caSigner reads the CA key of opkssh ca from the SSH private key file at
+// keyPath or else uses the AWS KMS key awsKMSKey
+func caSigner(ctx context.Context, keyPath string, awsKMSKey string) (crypto.Signer, error) {
+	if awsKMSKey != "" {
+		return kms.NewSigner(ctx, &kms.AWSKey{
+			KeyID:  awsKMSKey,
+			Region: os.Getenv("AWS_REGION"),
+			Credentials: kms.AWSCredentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			},
+		})
+	}
+	pemBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	// ed25519 keys are parsed as pointers which don't implement crypto.Signer
+	if edKey, ok := key.(*ed25519.PrivateKey); ok {
+		key = *edKey
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+	return signer, nil
+}
+
 func checkOpenSSHVersion() {
 	cmd := exec.Command("sshd", "-V")
 	output, err := cmd.CombinedOutput()
@@ -17,8 +17,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/providers"
 )
 
 func TestIsOpenSSHVersion8Dot1OrGreater(t *testing.T) {
@@ -113,3 +122,133 @@ func TestIsOpenSSHVersion8Dot1OrGreater(t *testing.T) {
 		})
 	}
 }
+
+func TestRootCmdCompletionAndMan(t *testing.T) {
+	rootCmd := newRootCmd(providers.NewGoogleOpWithOptions(providers.GetDefaultGoogleOpOptions()))
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs([]string{"completion", "bash"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("generating bash completion: %v", err)
+	}
+	if !strings.Contains(out.String(), "opkssh") {
+		t.Errorf("bash completion does not reference opkssh")
+	}
+
+	manDir := t.TempDir()
+	rootCmd.SetArgs([]string{"man", manDir})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("generating man pages: %v", err)
+	}
+	for _, page := range []string{"opkssh.1", "opkssh-login.1", "opkssh-verify.1", "opkssh-add.1"} {
+		if _, err := os.Stat(filepath.Join(manDir, page)); err != nil {
+			t.Errorf("expected man page %s: %v", page, err)
+		}
+	}
+}
+
+func TestRootCmdArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "verify missing args", args: []string{"verify", "root"}},
+		{name: "add too many args", args: []string{"add", "alice@example.com", "root", "extra"}},
+		{name: "login unexpected arg", args: []string{"login", "extra"}},
+		{name: "login unsupported key type", args: []string{"login", "--key-type", "rsa"}},
+		{name: "login negative chunk size", args: []string{"login", "--pkt-chunk-size", "-1"}},
+		{name: "login unknown extension", args: []string{"login", "--extension", "permit-everything"}},
+		{name: "login http CA", args: []string{"login", "--ca-url", "http://ca.example.com", "--principal", "guest"}},
+		{name: "ca without key", args: []string{"ca", "--tls-cert", "tls.pem", "--tls-key", "tls.key"}},
+		{name: "ca without TLS", args: []string{"ca", "--key", "ca_key"}},
+		{name: "renew unexpected arg", args: []string{"renew", "extra"}},
+		{name: "host-cert missing hostname", args: []string{"host-cert"}},
+		{name: "revoke unexpected arg", args: []string{"revoke", "extra"}},
+		{name: "revoke without issuer", args: []string{"revoke", "--sub", "1234567890"}},
+		{name: "krl invalid serial", args: []string{"krl", "--serial", "-1"}},
+		{name: "unknown command", args: []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootCmd := newRootCmd(providers.NewGoogleOpWithOptions(providers.GetDefaultGoogleOpOptions()))
+			rootCmd.SetArgs(tt.args)
+			if err := rootCmd.Execute(); err == nil {
+				t.Errorf("expected error for args %v", tt.args)
+			}
+		})
+	}
+}
+
+func TestProviderConfig(t *testing.T) {
+	defaultProvider := providers.NewGoogleOpWithOptions(providers.GetDefaultGoogleOpOptions())
+	configPath := filepath.Join(t.TempDir(), "providers.yml")
+	err := os.WriteFile(configPath, []byte(`
+providers:
+  - type: google
+    client_id: my-client-id
+    redirect_uris: [http://localhost:3000/login-callback]
+    gq_sign: true
+  - type: azure
+    name: corp
+    tenant_id: my-tenant
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := loginProvider(configPath, "corp", defaultProvider)
+	if err != nil {
+		t.Fatalf("loading login provider: %v", err)
+	}
+	if op.Issuer() != "https://login.microsoftonline.com/my-tenant/v2.0" {
+		t.Errorf("unexpected login provider issuer %s", op.Issuer())
+	}
+	if _, err := loginProvider(configPath, "", defaultProvider); err == nil {
+		t.Errorf("expected an error when choosing between several providers without a name")
+	}
+	if _, err := loginProvider(filepath.Join(t.TempDir(), "missing.yml"), "", defaultProvider); err == nil {
+		t.Errorf("expected an error for a missing config file")
+	}
+
+	opConfigs, finder, err := verifyProviders(configPath, defaultProvider)
+	if err != nil {
+		t.Fatalf("loading verify providers: %v", err)
+	}
+	if len(opConfigs) != 2 || opConfigs[0].ClientID() != "my-client-id" {
+		t.Errorf("unexpected verify providers %v", opConfigs)
+	}
+	if finder != nil {
+		t.Errorf("expected the default finder without an allowlist")
+	}
+
+	err = os.WriteFile(configPath, []byte(`
+providers:
+  - type: google
+    client_id: my-client-id
+allowlist:
+  hosts: [www.googleapis.com]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, finder, err = verifyProviders(configPath, defaultProvider)
+	if err != nil {
+		t.Fatalf("loading verify providers: %v", err)
+	}
+	if _, err := finder.JwksFunc(context.Background(), "https://evil.example.com"); !errors.Is(err, discover.ErrNotAllowed) {
+		t.Errorf("expected fetching from a host not on the allowlist to fail, got %v", err)
+	}
+}
+
+func TestVerifyCachePaths(t *testing.T) {
+	// Changing the accepted providers must bypass the verify cache
+	paths := verifyCachePaths("root", "", "")
+	if !slices.Contains(paths, SystemProvidersPath) {
+		t.Errorf("expected %v to contain %s", paths, SystemProvidersPath)
+	}
+	paths = verifyCachePaths("root", "/etc/opk/other.yml", "/etc/opk/ldap.yml")
+	if !slices.Contains(paths, "/etc/opk/other.yml") || !slices.Contains(paths, "/etc/opk/ldap.yml") || slices.Contains(paths, SystemProvidersPath) {
+		t.Errorf("unexpected verify cache paths %v", paths)
+	}
+}
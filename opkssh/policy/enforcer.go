@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/openpubkey/openpubkey/opkssh/device"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"golang.org/x/exp/slices"
 )
@@ -28,12 +29,18 @@ import (
 // permitted
 type Enforcer struct {
 	PolicyLoader Loader
+	// Hostname is the name of this host. Policy entries scoped to hosts
+	// only apply if it matches them
+	Hostname string
 }
 
 // CheckPolicy loads the opkssh policy and checks to see if there is a policy
 // permitting access to principalDesired for the user identified by the PKT's
-// email claim. Returns nil if access is granted. Otherwise, an error is
-// returned.
+// email claim, either directly or through group membership. Entries with an
+// issuer only match PK Tokens from that issuer and entries scoped to hosts only
+// match if Enforcer.Hostname does. If the policy requires verified emails,
+// PK Tokens whose email_verified claim isn't true are denied. Returns nil if
+// access is granted. Otherwise, an error is returned.
 //
 // It is recommended to verify the pkt first before calling this function.
 func (p *Enforcer) CheckPolicy(principalDesired string, pkt *pktoken.PKToken) error {
@@ -48,22 +55,53 @@ func (p *Enforcer) CheckPolicy(principalDesired string, pkt *pktoken.PKToken) er
 	}
 
 	var claims struct {
-		Email string `json:"email"`
+		Email  string `json:"email"`
+		Issuer string `json:"iss"`
 	}
 	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
 		return fmt.Errorf("error unmarshalling pk token payload: %w", err)
 	}
 
+	if policy.RequireEmailVerified {
+		if _, verified, err := pkt.EmailVerified(); err != nil {
+			return err
+		} else if !verified {
+			return fmt.Errorf("email %s of %s is not verified, policy at %s requires email_verified", claims.Email, claims.Issuer, sourceStr)
+		}
+	}
+
+	var deviceErr error
 	for _, user := range policy.Users {
 		// check each entry to see if the user in the claims is included
-		if string(claims.Email) == user.Email {
+		if slices.Contains(policy.Members(user), claims.Email) &&
+			(user.Issuer == "" || user.Issuer == claims.Issuer) &&
+			policy.AppliesToHost(user, p.Hostname) {
 			// if they are, then check if the desired principal is allowed
 			if slices.Contains(user.Principals, principalDesired) {
+				if user.Device != nil {
+					if deviceErr = checkDevice(user.Device, pkt); deviceErr != nil {
+						// Another entry may allow the principal from this device
+						continue
+					}
+				}
 				// access granted
 				return nil
 			}
 		}
 	}
 
+	if deviceErr != nil {
+		return fmt.Errorf("device of %s is not allowed to assume %s: %w, check policy config at %s", claims.Email, principalDesired, deviceErr, sourceStr)
+	}
 	return fmt.Errorf("no policy to allow %s to assume %s, check policy config at %s", claims.Email, principalDesired, sourceStr)
 }
+
+func checkDevice(requirements *DeviceRequirements, pkt *pktoken.PKToken) error {
+	info, ok, err := device.FromPKToken(pkt)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("PK Token has no device info, login with device inventory enabled")
+	}
+	return requirements.Check(info)
+}
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/opkssh/device"
 	"github.com/openpubkey/openpubkey/opkssh/policy"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/providers/mocks"
@@ -176,3 +177,241 @@ func TestPolicyDeniedNoUserEntry(t *testing.T) {
 	err = policyEnforcer.CheckPolicy("test", pkt)
 	require.Error(t, err, "user should not have access")
 }
+
+func TestPolicyDeviceRequirements(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+
+	noDevicePkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	encrypted, unencrypted := true, false
+	encryptedPkt, err := opkClient.Auth(context.Background(), (&device.Info{
+		Hostname:      "laptop-1.corp.example.com",
+		OS:            "linux",
+		DiskEncrypted: &encrypted,
+	}).AuthOpts())
+	require.NoError(t, err)
+	unencryptedPkt, err := opkClient.Auth(context.Background(), (&device.Info{
+		Hostname:      "laptop-2.corp.example.com",
+		OS:            "darwin",
+		DiskEncrypted: &unencrypted,
+	}).AuthOpts())
+	require.NoError(t, err)
+
+	devicePolicy := &policy.Policy{
+		Users: []policy.User{
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"root"},
+				Device: &policy.DeviceRequirements{
+					DiskEncrypted: true,
+					OS:            []string{"linux", "darwin"},
+					Hostnames:     []string{"*.corp.example.com"},
+				},
+			},
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"test"},
+			},
+		},
+	}
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &MockPolicyLoader{Policy: devicePolicy},
+	}
+
+	require.NoError(t, policyEnforcer.CheckPolicy("root", encryptedPkt))
+	err = policyEnforcer.CheckPolicy("root", unencryptedPkt)
+	require.ErrorContains(t, err, "disk encryption is required")
+	err = policyEnforcer.CheckPolicy("root", noDevicePkt)
+	require.ErrorContains(t, err, "PK Token has no device info")
+
+	// Entries without device requirements allow any device
+	require.NoError(t, policyEnforcer.CheckPolicy("test", noDevicePkt))
+	require.NoError(t, policyEnforcer.CheckPolicy("test", unencryptedPkt))
+}
+
+func TestDeviceRequirementsCheck(t *testing.T) {
+	encrypted := true
+	info := &device.Info{
+		Hostname:      "build-7.ci.example.com",
+		OS:            "linux",
+		OSVersion:     "Debian GNU/Linux 12 (bookworm)",
+		DiskEncrypted: &encrypted,
+	}
+
+	require.NoError(t, (&policy.DeviceRequirements{}).Check(info))
+	require.NoError(t, (&policy.DeviceRequirements{OS: []string{"linux"}}).Check(info))
+	require.ErrorContains(t, (&policy.DeviceRequirements{OS: []string{"windows"}}).Check(info), "operating system")
+	require.NoError(t, (&policy.DeviceRequirements{Hostnames: []string{"*.corp.example.com", "*.ci.example.com"}}).Check(info))
+	require.ErrorContains(t, (&policy.DeviceRequirements{Hostnames: []string{"*.corp.example.com"}}).Check(info), "hostname")
+	require.ErrorContains(t, (&policy.DeviceRequirements{Hostnames: []string{"["}}).Check(info), "malformed hostname pattern")
+
+	// Unknown disk encryption doesn't satisfy the requirement
+	info.DiskEncrypted = nil
+	require.ErrorContains(t, (&policy.DeviceRequirements{DiskEncrypted: true}).Check(info), "disk encryption is required")
+}
+
+func TestDeviceRequirementsYAML(t *testing.T) {
+	p, err := policy.FromYAML([]byte(`
+users:
+  - email: alice@example.com
+    principals: [root]
+    device:
+      disk_encrypted: true
+      os: [linux, darwin]
+      hostnames: ["*.corp.example.com"]
+  - email: bob@example.com
+    principals: [test]
+`))
+	require.NoError(t, err)
+	require.Equal(t, &policy.DeviceRequirements{
+		DiskEncrypted: true,
+		OS:            []string{"linux", "darwin"},
+		Hostnames:     []string{"*.corp.example.com"},
+	}, p.Users[0].Device)
+	require.Nil(t, p.Users[1].Device)
+}
+
+func TestPolicyGroupsAndIssuer(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	groupPolicy := &policy.Policy{
+		Groups: map[string][]string{
+			"admins": {"alice@example.com", "arthur.aardvark@example.com"},
+			"devs":   {"bob@example.com"},
+		},
+		Users: []policy.User{
+			{
+				Group:      "admins",
+				Principals: []string{"root"},
+			},
+			{
+				Group:      "devs",
+				Principals: []string{"dev"},
+			},
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"ubuntu"},
+				Issuer:     op.Issuer(),
+			},
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"backup"},
+				Issuer:     "https://other-issuer.example.com",
+			},
+		},
+	}
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &MockPolicyLoader{Policy: groupPolicy},
+	}
+
+	require.NoError(t, policyEnforcer.CheckPolicy("root", pkt))
+	require.Error(t, policyEnforcer.CheckPolicy("dev", pkt), "not a member of devs")
+	require.NoError(t, policyEnforcer.CheckPolicy("ubuntu", pkt))
+	require.Error(t, policyEnforcer.CheckPolicy("backup", pkt), "entry requires another issuer")
+}
+
+func TestPolicyHosts(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	hostPolicy := &policy.Policy{
+		HostGroups: map[string][]string{
+			"web": {"web-*", "www.example.com"},
+		},
+		Users: []policy.User{
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"root"},
+				Hosts:      []string{"bastion-*"},
+			},
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"deploy"},
+				HostGroups: []string{"web"},
+			},
+			{
+				Email:      "arthur.aardvark@example.com",
+				Principals: []string{"test"},
+			},
+		},
+	}
+	enforcer := func(hostname string) *policy.Enforcer {
+		return &policy.Enforcer{
+			PolicyLoader: &MockPolicyLoader{Policy: hostPolicy},
+			Hostname:     hostname,
+		}
+	}
+
+	require.NoError(t, enforcer("bastion-1").CheckPolicy("root", pkt))
+	require.NoError(t, enforcer("Bastion-2").CheckPolicy("root", pkt), "hostnames are case insensitive")
+	require.Error(t, enforcer("web-1").CheckPolicy("root", pkt))
+	require.NoError(t, enforcer("web-1").CheckPolicy("deploy", pkt))
+	require.NoError(t, enforcer("www.example.com").CheckPolicy("deploy", pkt))
+	require.Error(t, enforcer("bastion-1").CheckPolicy("deploy", pkt))
+
+	// Entries without hosts apply everywhere, scoped entries never apply
+	// when the hostname is unknown
+	require.NoError(t, enforcer("db-1").CheckPolicy("test", pkt))
+	require.NoError(t, enforcer("").CheckPolicy("test", pkt))
+	require.Error(t, enforcer("").CheckPolicy("root", pkt))
+}
+
+func TestPolicyRequireEmailVerified(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		extraClaims map[string]any
+		expError    string
+	}{
+		{name: "verified", extraClaims: map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}},
+		{name: "verified as string", extraClaims: map[string]any{"email": "arthur.aardvark@example.com", "email_verified": "true"}},
+		{name: "unverified", extraClaims: map[string]any{"email": "arthur.aardvark@example.com", "email_verified": false},
+			expError: "email arthur.aardvark@example.com of https://accounts.example.com is not verified"},
+		{name: "no email_verified claim", extraClaims: map[string]any{"email": "arthur.aardvark@example.com"},
+			expError: "is not verified"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			op, _, err := NewMockOpenIdProvider2(false, "https://accounts.example.com", "test_client_id", tc.extraClaims)
+			require.NoError(t, err)
+			opkClient, err := client.New(op)
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			requiring := *policyTest
+			requiring.RequireEmailVerified = true
+			err = (&policy.Enforcer{PolicyLoader: &MockPolicyLoader{Policy: &requiring}}).CheckPolicy("test", pkt)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// Without the setting the email is trusted as is
+			err = (&policy.Enforcer{PolicyLoader: &MockPolicyLoader{Policy: policyTest}}).CheckPolicy("test", pkt)
+			require.NoError(t, err)
+		})
+	}
+}
@@ -19,8 +19,10 @@ package policy
 import (
 	"fmt"
 	"io/fs"
+	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 
 	"github.com/spf13/afero"
 	"golang.org/x/exp/slices"
@@ -118,18 +120,15 @@ func (l *FileLoader) LoadSystemDefaultPolicy() (*Policy, error) {
 //
 // If skipInvalidEntries is true, then invalid user entries are skipped and not
 // included in the returned policy. A user policy's entry is considered valid if
-// it gives username access. The returned policy is stripped of invalid entries.
+// it gives username access. The returned policy is stripped of invalid entries
+// and its group entries are expanded into one entry per member, and host
+// groups into host patterns, so that groups defined by a user never apply to
+// entries of other policies.
 func (l *FileLoader) LoadUserPolicy(username string, skipInvalidEntries bool) (*Policy, string, error) {
-	user, err := l.UserLookup.Lookup(username)
+	policyFilePath, err := l.UserPolicyPath(username)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to lookup username %s: %w", username, err)
-	}
-	userHomeDirectory := user.HomeDir
-	if userHomeDirectory == "" {
-		return nil, "", fmt.Errorf("user %s does not have a home directory", username)
+		return nil, "", err
 	}
-
-	policyFilePath := path.Join(userHomeDirectory, ".opk", "policy.yml")
 	policy, err := l.LoadPolicyAtPath(policyFilePath)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to read user policy file %s: %w", policyFilePath, err)
@@ -142,11 +141,16 @@ func (l *FileLoader) LoadUserPolicy(username string, skipInvalidEntries bool) (*
 		validUserPolicy := new(Policy)
 		for _, user := range policy.Users {
 			if slices.Contains(user.Principals, username) {
-				// Build clean entry that only gives access to username
-				validUserPolicy.Users = append(validUserPolicy.Users, User{
-					Email:      user.Email,
-					Principals: []string{username},
-				})
+				// Build clean entries that only give access to username
+				for _, email := range policy.Members(user) {
+					validUserPolicy.Users = append(validUserPolicy.Users, User{
+						Email:      email,
+						Principals: []string{username},
+						Issuer:     user.Issuer,
+						Hosts:      policy.Hosts(user),
+						Device:     user.Device,
+					})
+				}
 			}
 		}
 
@@ -157,6 +161,19 @@ func (l *FileLoader) LoadUserPolicy(username string, skipInvalidEntries bool) (*
 	}
 }
 
+// UserPolicyPath returns the path of the policy file in the home directory
+// of username
+func (l *FileLoader) UserPolicyPath(username string) (string, error) {
+	user, err := l.UserLookup.Lookup(username)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup username %s: %w", username, err)
+	}
+	if user.HomeDir == "" {
+		return "", fmt.Errorf("user %s does not have a home directory", username)
+	}
+	return path.Join(user.HomeDir, ".opk", "policy.yml"), nil
+}
+
 func (l *FileLoader) validatePermissions(fileInfo fs.FileInfo) error {
 	mode := fileInfo.Mode()
 
@@ -168,18 +185,70 @@ func (l *FileLoader) validatePermissions(fileInfo fs.FileInfo) error {
 	return nil
 }
 
-// Dump encodes the policy into YAML and writes the contents to the filepath
-// path
+// Dump validates and encodes the policy into YAML and writes the contents to
+// the filepath path. The contents are written to a temporary file that is
+// then renamed to path, so readers never see a partially written policy
 func (l *FileLoader) Dump(policy *Policy, path string) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
 	yamlBytes, err := policy.ToYAML()
 	if err != nil {
 		return err
 	}
 
 	// Write to disk
-	if err := afero.WriteFile(l.Fs, path, yamlBytes, ModeOnlyOwner); err != nil {
+	if err := l.writeAtomic(path, yamlBytes); err != nil {
 		return fmt.Errorf("failed to write to policy file %s: %w", path, err)
 	}
 
 	return nil
 }
+
+// Update reads the policy at path, applies update to it and writes it back
+// with Dump. Concurrent updates of the same file by other opkssh processes
+// are serialized by locking path + ".lock", so none of them are lost. Nothing
+// is written if update returns an error
+func (l *FileLoader) Update(path string, update func(*Policy) error) error {
+	lock, err := l.Fs.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, ModeOnlyOwner)
+	if err != nil {
+		return fmt.Errorf("failed to open policy lock file: %w", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock policy file %s: %w", path, err)
+	}
+	defer unlockFile(lock)
+
+	policy, err := l.LoadPolicyAtPath(path)
+	if err != nil {
+		return err
+	}
+	if err := update(policy); err != nil {
+		return err
+	}
+	return l.Dump(policy, path)
+}
+
+// writeAtomic writes data to a temporary file in the same directory as path
+// and renames it to path
+func (l *FileLoader) writeAtomic(path string, data []byte) error {
+	f, err := afero.TempFile(l.Fs, filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer l.Fs.Remove(name)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := l.Fs.Chmod(name, ModeOnlyOwner); err != nil {
+		return err
+	}
+	return l.Fs.Rename(name, path)
+}
@@ -18,6 +18,7 @@ package policy_test
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"os/user"
 	"path"
@@ -341,3 +342,132 @@ func TestDump_Success(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expectedContents, gotContents)
 }
+
+func TestLoadUserPolicy_SkipInvalidEntries_ExpandsGroups(t *testing.T) {
+	// Test that user policy groups and host groups are expanded so they
+	// can't extend groups of the root policy
+	t.Parallel()
+
+	mockUserLookup := &MockUserLookup{User: ValidUser}
+	policyLoader := NewTestPolicyFileLoader(afero.NewMemMapFs(), mockUserLookup)
+	testPolicy := &policy.Policy{
+		Groups: map[string][]string{
+			"admins": {"alice@example.com", "bob@example.com"},
+		},
+		HostGroups: map[string][]string{
+			"bastions": {"bastion-*"},
+		},
+		Users: []policy.User{
+			{
+				Group:      "admins",
+				Principals: []string{ValidUser.Username, "root"},
+				Issuer:     "https://accounts.google.com",
+				HostGroups: []string{"bastions"},
+			},
+		},
+	}
+	expectedPolicy := &policy.Policy{
+		Users: []policy.User{
+			{
+				Email:      "alice@example.com",
+				Principals: []string{ValidUser.Username},
+				Issuer:     "https://accounts.google.com",
+				Hosts:      []string{"bastion-*"},
+			},
+			{
+				Email:      "bob@example.com",
+				Principals: []string{ValidUser.Username},
+				Issuer:     "https://accounts.google.com",
+				Hosts:      []string{"bastion-*"},
+			},
+		},
+	}
+	testPolicyYaml, err := testPolicy.ToYAML()
+	require.NoError(t, err)
+	err = afero.WriteFile(policyLoader.Fs, path.Join(ValidUser.HomeDir, ".opk", "policy.yml"), testPolicyYaml, 0600)
+	require.NoError(t, err)
+
+	gotPolicy, _, err := policyLoader.LoadUserPolicy(ValidUser.Username, true)
+	require.NoError(t, err)
+	require.Equal(t, expectedPolicy, gotPolicy)
+}
+
+func TestDump_Invalid(t *testing.T) {
+	// Test that Dump refuses to write a policy that doesn't pass validation
+	t.Parallel()
+
+	policyLoader := NewTestPolicyFileLoader(afero.NewMemMapFs(), &MockUserLookup{})
+	invalidPolicy := &policy.Policy{
+		Users: []policy.User{{Group: "admins", Principals: []string{"root"}}},
+	}
+
+	err := policyLoader.Dump(invalidPolicy, policy.SystemDefaultPolicyPath)
+	require.ErrorIs(t, err, policy.ErrInvalidPolicy)
+	exists, err := afero.Exists(policyLoader.Fs, policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestUpdate(t *testing.T) {
+	// Test that Update writes the modified policy and leaves it untouched if
+	// the update fails
+	t.Parallel()
+
+	policyLoader := NewTestPolicyFileLoader(afero.NewMemMapFs(), &MockUserLookup{})
+	initialPolicy := &policy.Policy{
+		Users: []policy.User{{Email: "alice@example.com", Principals: []string{"root"}}},
+	}
+	require.NoError(t, policyLoader.Dump(initialPolicy, policy.SystemDefaultPolicyPath))
+
+	err := policyLoader.Update(policy.SystemDefaultPolicyPath, func(p *policy.Policy) error {
+		p.AddAllowedPrincipal("dev", "bob@example.com")
+		return nil
+	})
+	require.NoError(t, err)
+	updated, err := policyLoader.LoadPolicyAtPath(policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Len(t, updated.Users, 2)
+
+	err = policyLoader.Update(policy.SystemDefaultPolicyPath, func(p *policy.Policy) error {
+		p.Users = nil
+		return errors.New("no such entry")
+	})
+	require.ErrorContains(t, err, "no such entry")
+	unchanged, err := policyLoader.LoadPolicyAtPath(policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, updated, unchanged)
+
+	// Only the policy and its lock file are left behind
+	entries, err := afero.ReadDir(policyLoader.Fs, path.Dir(policy.SystemDefaultPolicyPath))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestUpdate_Concurrent(t *testing.T) {
+	// Test that concurrent updates of a policy file on disk are not lost
+	t.Parallel()
+
+	policyLoader := NewTestPolicyFileLoader(afero.NewOsFs(), &MockUserLookup{})
+	policyPath := path.Join(t.TempDir(), "policy.yml")
+	require.NoError(t, policyLoader.Dump(&policy.Policy{}, policyPath))
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			// Each update uses its own loader, as separate opkssh processes would
+			loader := NewTestPolicyFileLoader(afero.NewOsFs(), &MockUserLookup{})
+			errs <- loader.Update(policyPath, func(p *policy.Policy) error {
+				p.AddAllowedPrincipal("root", fmt.Sprintf("user%d@example.com", i))
+				return nil
+			})
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	updated, err := policyLoader.LoadPolicyAtPath(policyPath)
+	require.NoError(t, err)
+	require.Len(t, updated.Users, n)
+}
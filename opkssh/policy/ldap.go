@@ -0,0 +1,464 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file implements the small subset of LDAPv3 (RFC 4511) that the
+// LDAPLoader needs: StartTLS, a simple bind and subtree searches returning a
+// single attribute.
+
+const (
+	// maxLDAPMessageSize bounds the length of a BER element read from the
+	// directory, so a hostile server can't make opkssh verify allocate
+	// gigabytes with a single length
+	maxLDAPMessageSize = 1 << 20
+	// maxLDAPSearchSize bounds the total size of the messages answering a
+	// search
+	maxLDAPSearchSize = 16 << 20
+)
+
+// BER identifiers of the LDAP messages and fields used below
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+
+	ldapSimpleAuth          = 0x80
+	ldapFilterEquality      = 0xa3
+	ldapFilterExtensible    = 0xa9
+	ldapMatchingRule        = 0x81
+	ldapMatchingType        = 0x82
+	ldapMatchValue          = 0x83
+	ldapScopeWholeSubtree   = 2
+	ldapResultSuccess       = 0
+	ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+	ldapExtendedRequestName = 0x80
+	ldapStartTLSOID         = "1.3.6.1.4.1.1466.20037"
+)
+
+// berElement is a decoded BER TLV
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berEncode(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	out := []byte{tag}
+	if n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for l := n; l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	// Keep non-negative values from reading as two's complement negatives
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte { return berEncode(tag, []byte(s)) }
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berBoolean, []byte{0xff})
+	}
+	return berEncode(berBoolean, []byte{0})
+}
+
+// berRead reads one element from r. Lengths may use the long form with
+// non-minimal encodings, as Active Directory does. Elements longer than
+// maxLDAPMessageSize are rejected before their content is read.
+func berRead(r io.ByteReader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return berElement{}, fmt.Errorf("unsupported multi-byte BER tag")
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return berElement{}, fmt.Errorf("unsupported BER length encoding")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLDAPMessageSize {
+		return berElement{}, fmt.Errorf("BER element of %d bytes exceeds the limit of %d bytes", length, maxLDAPMessageSize)
+	}
+	content := make([]byte, length)
+	for i := range content {
+		if content[i], err = r.ReadByte(); err != nil {
+			return berElement{}, err
+		}
+	}
+	return berElement{tag: tag, content: content}, nil
+}
+
+// children decodes the elements of a constructed element
+func (e berElement) children() ([]berElement, error) {
+	var out []berElement
+	r := &byteReader{b: e.content}
+	for r.i < len(r.b) {
+		child, err := berRead(r)
+		if err != nil {
+			return nil, fmt.Errorf("malformed BER element: %w", err)
+		}
+		out = append(out, child)
+	}
+	return out, nil
+}
+
+func (e berElement) int() int {
+	v := 0
+	for _, b := range e.content {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+type byteReader struct {
+	b []byte
+	i int
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.i >= len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.i++
+	return r.b[r.i-1], nil
+}
+
+// ldapConn is a connection to an LDAP server that sends one request at a time
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int
+	// read counts the bytes of the messages received since it was reset
+	read int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL, upgrading ldap://
+// connections to TLS with StartTLS if startTLS is set. The deadline applies
+// to the whole exchange on the connection.
+func dialLDAP(rawURL string, tlsConfig *tls.Config, startTLS bool, deadline time.Time) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed LDAP URL: %w", err)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, ldapTLSConfig(tlsConfig, u.Hostname()))
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q, expected ldap or ldaps", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn), nextID: 1}
+	if startTLS {
+		if u.Scheme != "ldap" {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS requires an ldap:// URL")
+		}
+		if err := c.startTLS(ldapTLSConfig(tlsConfig, u.Hostname())); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func ldapTLSConfig(tlsConfig *tls.Config, hostname string) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = hostname
+	}
+	return tlsConfig
+}
+
+// startTLS upgrades the connection to TLS (RFC 4511 section 4.14)
+func (c *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	id, err := c.send(berEncode(ldapExtendedRequest, berString(ldapExtendedRequestName, ldapStartTLSOID)))
+	if err != nil {
+		return fmt.Errorf("failed to send LDAP StartTLS: %w", err)
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return fmt.Errorf("unexpected LDAP response to StartTLS: %#x", op.tag)
+	}
+	if err := checkResult(op); err != nil {
+		return fmt.Errorf("LDAP StartTLS failed: %w", err)
+	}
+	// Anything sent before the handshake wasn't protected by TLS
+	if c.r.Buffered() > 0 {
+		return fmt.Errorf("unexpected data from the LDAP server before the TLS handshake")
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("LDAP StartTLS handshake failed: %w", err)
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (c *ldapConn) send(op []byte) (int, error) {
+	id := c.nextID
+	c.nextID++
+	_, err := c.conn.Write(berEncode(berSequence, berInt(berInteger, id), op))
+	return id, err
+}
+
+// receive reads the next message with the given message ID and returns its
+// protocol op
+func (c *ldapConn) receive(id int) (berElement, error) {
+	for {
+		msg, err := berRead(c.r)
+		if err != nil {
+			return berElement{}, fmt.Errorf("failed to read LDAP response: %w", err)
+		}
+		c.read += len(msg.content)
+		fields, err := msg.children()
+		if err != nil {
+			return berElement{}, err
+		}
+		if len(fields) < 2 || fields[0].tag != berInteger {
+			return berElement{}, fmt.Errorf("malformed LDAP message")
+		}
+		// Skip unsolicited notifications and anything else not for us
+		if fields[0].int() == id {
+			return fields[1], nil
+		}
+	}
+}
+
+// checkResult returns an error if the LDAPResult in op isn't a success
+func checkResult(op berElement) error {
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 || fields[0].tag != berEnumerated {
+		return fmt.Errorf("malformed LDAP result")
+	}
+	if code := fields[0].int(); code != ldapResultSuccess {
+		return fmt.Errorf("LDAP error %d: %s", code, fields[2].content)
+	}
+	return nil
+}
+
+// Bind authenticates with a simple bind. An empty dn binds anonymously
+func (c *ldapConn) Bind(dn string, password string) error {
+	id, err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapSimpleAuth, password),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to send LDAP bind: %w", err)
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("unexpected LDAP response to bind: %#x", op.tag)
+	}
+	if err := checkResult(op); err != nil {
+		return fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	return nil
+}
+
+// SearchMembers returns the values of attribute for every entry below baseDN
+// whose memberOf attribute equals groupDN. If nested is set, members of
+// nested groups are included using Active Directory's LDAP_MATCHING_RULE_IN_CHAIN.
+func (c *ldapConn) SearchMembers(baseDN string, groupDN string, attribute string, nested bool) ([]string, error) {
+	var filter []byte
+	if nested {
+		filter = berEncode(ldapFilterExtensible,
+			berString(ldapMatchingRule, ldapMatchingRuleInChain),
+			berString(ldapMatchingType, "memberOf"),
+			berString(ldapMatchValue, groupDN),
+		)
+	} else {
+		filter = berEncode(ldapFilterEquality,
+			berString(berOctetString, "memberOf"),
+			berString(berOctetString, groupDN),
+		)
+	}
+	id, err := c.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, baseDN),
+		berInt(berEnumerated, ldapScopeWholeSubtree),
+		berInt(berEnumerated, 0), // never dereference aliases
+		berInt(berInteger, 0),    // no size limit
+		berInt(berInteger, 0),    // no time limit
+		berBool(false),           // return values, not just types
+		filter,
+		berEncode(berSequence, berString(berOctetString, attribute)),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send LDAP search: %w", err)
+	}
+
+	var values []string
+	c.read = 0
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		if c.read > maxLDAPSearchSize {
+			return nil, fmt.Errorf("LDAP search for members of %s returned more than %d bytes", groupDN, maxLDAPSearchSize)
+		}
+		switch op.tag {
+		case ldapSearchResultEntry:
+			entryValues, err := entryAttribute(op, attribute)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, entryValues...)
+		case ldapSearchResultRef:
+			// Referrals to other servers are not followed
+		case ldapSearchResultDone:
+			if err := checkResult(op); err != nil {
+				return nil, fmt.Errorf("LDAP search for members of %s failed: %w", groupDN, err)
+			}
+			return values, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response to search: %#x", op.tag)
+		}
+	}
+}
+
+// entryAttribute returns the values of attribute in a SearchResultEntry
+func entryAttribute(entry berElement, attribute string) ([]string, error) {
+	fields, err := entry.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed LDAP search result entry")
+	}
+	attributes, err := fields[1].children()
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, a := range attributes {
+		typeAndVals, err := a.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(typeAndVals) != 2 || !strings.EqualFold(string(typeAndVals[0].content), attribute) {
+			continue
+		}
+		vals, err := typeAndVals[1].children()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			values = append(values, string(v.content))
+		}
+	}
+	return values, nil
+}
+
+// Close sends an unbind request and closes the connection
+func (c *ldapConn) Close() error {
+	_, err := c.send(berEncode(ldapUnbindRequest))
+	return errors.Join(err, c.conn.Close())
+}
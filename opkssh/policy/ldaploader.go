@@ -0,0 +1,323 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultLDAPCacheTTL is how long group memberships fetched from LDAP are
+	// used before the directory is queried again
+	DefaultLDAPCacheTTL = 5 * time.Minute
+	// DefaultLDAPMaxStale is how long cached group memberships keep being
+	// used while the directory can't be reached
+	DefaultLDAPMaxStale = time.Hour
+	// DefaultLDAPTimeout bounds the whole exchange with the directory
+	DefaultLDAPTimeout = 10 * time.Second
+	// DefaultLDAPCachePath is where group memberships are cached between
+	// invocations of opkssh verify, which runs once per SSH connection
+	DefaultLDAPCachePath = "/var/cache/opk/ldap-policy.yml"
+)
+
+var _ Loader = &LDAPLoader{}
+
+// LDAPGroup maps the members of a directory group to principals
+type LDAPGroup struct {
+	// DN is the distinguished name of the group, e.g.
+	// "CN=SSH Admins,OU=Groups,DC=example,DC=com"
+	DN string `yaml:"dn"`
+	// Principals are the principals every member of the group may assume
+	Principals []string `yaml:"principals"`
+	// Issuer, if set, requires the id_token to be issued by this OpenID
+	// provider
+	Issuer string `yaml:"issuer,omitempty"`
+	// Hosts, if set, scopes the group's access to hosts matching one of
+	// these hostname glob patterns
+	Hosts []string `yaml:"hosts,omitempty"`
+}
+
+// LDAPLoader implements policy.Loader by querying the members of directory
+// groups from an LDAP server or Active Directory. Each group becomes a policy
+// group named by its DN, whose members are identified by their email
+// attribute, with one user entry granting the group's principals.
+//
+// The resulting policy is cached in memory and at CachePath so that the
+// directory is queried at most once every CacheTTL. If the directory can't be
+// reached, the cached policy keeps being used until it is MaxStale old.
+type LDAPLoader struct {
+	// URL of the directory, ldaps://host[:port] or ldap://host[:port]
+	URL string `yaml:"url"`
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool `yaml:"start_tls,omitempty"`
+	// BindDN and BindPassword authenticate to the directory. Leave both empty
+	// to bind anonymously. A password is only sent over ldaps:// or with
+	// StartTLS
+	BindDN       string `yaml:"bind_dn,omitempty"`
+	BindPassword string `yaml:"bind_password,omitempty"`
+	// BaseDN is the subtree searched for group members
+	BaseDN string `yaml:"base_dn"`
+	// EmailAttribute is the attribute compared against the id_token's email
+	// claim. Defaults to mail
+	EmailAttribute string `yaml:"email_attribute,omitempty"`
+	// NestedGroups includes members of nested groups. Only supported by
+	// Active Directory
+	NestedGroups bool `yaml:"nested_groups,omitempty"`
+	// Groups lists the directory groups granted access
+	Groups []LDAPGroup `yaml:"groups"`
+
+	CacheTTL  time.Duration `yaml:"cache_ttl,omitempty"`
+	MaxStale  time.Duration `yaml:"max_stale,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	CachePath string        `yaml:"cache_path,omitempty"`
+
+	// Fs is where the cache is stored. No cache is written if nil
+	Fs afero.Fs `yaml:"-"`
+	// TLSConfig is used for ldaps:// URLs and StartTLS
+	TLSConfig *tls.Config `yaml:"-"`
+
+	now       func() time.Time
+	mu        sync.Mutex
+	cached    *Policy
+	fetchedAt time.Time
+}
+
+// ldapCache is the format of the cache file
+type ldapCache struct {
+	FetchedAt time.Time `yaml:"fetched_at"`
+	Policy    *Policy   `yaml:"policy"`
+}
+
+// LoadLDAPLoader reads the LDAPLoader configuration at path, which must have
+// the same permission bits as a policy file since it holds the bind password.
+// The returned loader caches through l.Fs.
+func (l *FileLoader) LoadLDAPLoader(path string) (*LDAPLoader, error) {
+	info, err := l.Fs.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the file at path: %w", err)
+	}
+	if err := l.validatePermissions(info); err != nil {
+		return nil, fmt.Errorf("LDAP config file has insecure permissions: %w", err)
+	}
+	content, err := afero.ReadFile(l.Fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := &LDAPLoader{}
+	if err := yaml.Unmarshal(content, loader); err != nil {
+		return nil, fmt.Errorf("error unmarshalling LDAP config: %w", err)
+	}
+	if err := loader.Validate(); err != nil {
+		return nil, err
+	}
+	loader.Fs = l.Fs
+	return loader, nil
+}
+
+// Validate checks that the configuration is complete
+func (l *LDAPLoader) Validate() error {
+	if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("%w: LDAP url must be ldap://host or ldaps://host, got %q", ErrInvalidPolicy, l.URL)
+	}
+	if err := l.checkTransport(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPolicy, err)
+	}
+	if l.BaseDN == "" {
+		return fmt.Errorf("%w: LDAP base_dn is required", ErrInvalidPolicy)
+	}
+	if len(l.Groups) == 0 {
+		return fmt.Errorf("%w: LDAP config has no groups", ErrInvalidPolicy)
+	}
+	for i, group := range l.Groups {
+		if group.DN == "" {
+			return fmt.Errorf("%w: LDAP groups[%d] has no dn", ErrInvalidPolicy, i)
+		}
+		if err := validateGrant(group.Principals, group.Issuer); err != nil {
+			return fmt.Errorf("%w: LDAP group %s %w", ErrInvalidPolicy, group.DN, err)
+		}
+		if err := validateHosts(group.Hosts); err != nil {
+			return fmt.Errorf("%w: LDAP group %s %w", ErrInvalidPolicy, group.DN, err)
+		}
+	}
+	return nil
+}
+
+// checkTransport refuses to send the bind password in the clear
+func (l *LDAPLoader) checkTransport() error {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return fmt.Errorf("malformed LDAP URL: %w", err)
+	}
+	if u.Scheme == "ldaps" && l.StartTLS {
+		return fmt.Errorf("LDAP start_tls requires an ldap:// url")
+	}
+	if u.Scheme == "ldap" && !l.StartTLS && l.BindPassword != "" {
+		return fmt.Errorf("LDAP bind_password requires an ldaps:// url or start_tls")
+	}
+	return nil
+}
+
+// Load implements policy.Loader
+func (l *LDAPLoader) Load() (*Policy, Source, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	source := LDAPSource(l.URL)
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.cached == nil {
+		l.readCache()
+	}
+	if l.cached != nil && now.Sub(l.fetchedAt) < durationOr(l.CacheTTL, DefaultLDAPCacheTTL) {
+		return l.cached, source, nil
+	}
+
+	policy, err := l.fetch(time.Now().Add(durationOr(l.Timeout, DefaultLDAPTimeout)))
+	if err != nil {
+		if l.cached != nil && now.Sub(l.fetchedAt) < durationOr(l.MaxStale, DefaultLDAPMaxStale) {
+			log.Printf("warning: failed to query LDAP, using group memberships cached at %s: %v", l.fetchedAt.Format(time.RFC3339), err)
+			return l.cached, source, nil
+		}
+		return nil, nil, err
+	}
+	l.cached, l.fetchedAt = policy, now
+	l.writeCache()
+	return policy, source, nil
+}
+
+// fetch queries the members of every group and builds the policy
+func (l *LDAPLoader) fetch(deadline time.Time) (*Policy, error) {
+	if err := l.checkTransport(); err != nil {
+		return nil, err
+	}
+	conn, err := dialLDAP(l.URL, l.TLSConfig, l.StartTLS, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+		return nil, err
+	}
+
+	attribute := l.EmailAttribute
+	if attribute == "" {
+		attribute = "mail"
+	}
+	policy := &Policy{Groups: map[string][]string{}}
+	for _, group := range l.Groups {
+		members, err := conn.SearchMembers(l.BaseDN, group.DN, attribute, l.NestedGroups)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) == 0 {
+			// Empty groups grant nothing and aren't valid policy groups
+			continue
+		}
+		policy.Groups[group.DN] = append(policy.Groups[group.DN], members...)
+		policy.Users = append(policy.Users, User{
+			Group:      group.DN,
+			Principals: group.Principals,
+			Issuer:     group.Issuer,
+			Hosts:      group.Hosts,
+		})
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (l *LDAPLoader) cachePath() string {
+	if l.CachePath != "" {
+		return l.CachePath
+	}
+	return DefaultLDAPCachePath
+}
+
+// readCache loads the cache file into memory if it exists. The cache grants
+// access, so it is ignored unless only its owner can write it
+func (l *LDAPLoader) readCache() {
+	if l.Fs == nil {
+		return
+	}
+	info, err := l.Fs.Stat(l.cachePath())
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm() != ModeOnlyOwner {
+		log.Printf("warning: ignoring LDAP cache %s with insecure permissions (%o)", l.cachePath(), info.Mode().Perm())
+		return
+	}
+	content, err := afero.ReadFile(l.Fs, l.cachePath())
+	if err != nil {
+		return
+	}
+	var cache ldapCache
+	if err := yaml.Unmarshal(content, &cache); err != nil || cache.Policy == nil {
+		log.Printf("warning: ignoring malformed LDAP cache %s", l.cachePath())
+		return
+	}
+	if err := cache.Policy.Validate(); err != nil {
+		log.Printf("warning: ignoring invalid LDAP cache %s: %v", l.cachePath(), err)
+		return
+	}
+	l.cached, l.fetchedAt = cache.Policy, cache.FetchedAt
+}
+
+func (l *LDAPLoader) writeCache() {
+	if l.Fs == nil {
+		return
+	}
+	content, err := yaml.Marshal(ldapCache{FetchedAt: l.fetchedAt, Policy: l.cached})
+	if err != nil {
+		log.Printf("warning: failed to encode LDAP cache: %v", err)
+		return
+	}
+	if err := l.Fs.MkdirAll(path.Dir(l.cachePath()), 0700); err != nil {
+		log.Printf("warning: failed to create LDAP cache directory: %v", err)
+		return
+	}
+	if err := afero.WriteFile(l.Fs, l.cachePath(), content, ModeOnlyOwner); err != nil {
+		log.Printf("warning: failed to write LDAP cache: %v", err)
+	}
+}
+
+func durationOr(d time.Duration, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// LDAPSource implements policy.Source by returning the URL of the directory
+type LDAPSource string
+
+func (s LDAPSource) Source() string {
+	return string(s)
+}
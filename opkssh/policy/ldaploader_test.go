@@ -0,0 +1,360 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDirectory is a minimal LDAP server answering memberOf searches
+type fakeDirectory struct {
+	listener net.Listener
+	password string
+	// members maps a group DN to the mail values of its members
+	members map[string][]string
+	// nested is additionally returned for searches using the in chain rule
+	nested   map[string][]string
+	searches atomic.Int32
+	wg       sync.WaitGroup
+	// serverTLS and clientTLS secure connections upgraded with StartTLS
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	d := &fakeDirectory{
+		listener: listener,
+		password: "hunter2",
+		members: map[string][]string{
+			"CN=Admins,DC=example,DC=com": {"alice@example.com", "bob@example.com"},
+			"CN=Devs,DC=example,DC=com":   {"carol@example.com"},
+		},
+		nested: map[string][]string{
+			"CN=Admins,DC=example,DC=com": {"dave@example.com"},
+		},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	d.serverTLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	d.clientTLS = &tls.Config{RootCAs: roots}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				defer conn.Close()
+				d.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		d.wg.Wait()
+	})
+	return d
+}
+
+func (d *fakeDirectory) URL() string { return "ldap://" + d.listener.Addr().String() }
+
+// adEncode encodes like Active Directory, always using a four byte length
+func adEncode(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	n := len(body)
+	return append([]byte{tag, 0x84, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := berRead(r)
+		if err != nil {
+			return
+		}
+		fields, _ := msg.children()
+		id := berInt(berInteger, fields[0].int())
+		op := fields[1]
+		result := func(tag byte, code int) []byte {
+			return adEncode(berSequence, id, adEncode(tag,
+				berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, "")))
+		}
+		switch op.tag {
+		case ldapExtendedRequest:
+			_, _ = conn.Write(result(ldapExtendedResponse, ldapResultSuccess))
+			tlsConn := tls.Server(conn, d.serverTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r = tlsConn, bufio.NewReader(tlsConn)
+		case ldapBindRequest:
+			bind, _ := op.children()
+			code := ldapResultSuccess
+			if string(bind[2].content) != d.password {
+				code = 49 // invalidCredentials
+			}
+			_, _ = conn.Write(result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			d.searches.Add(1)
+			search, _ := op.children()
+			filter, _ := search[6].children()
+			var groupDN string
+			var mails []string
+			if search[6].tag == ldapFilterExtensible {
+				groupDN = string(filter[2].content)
+				mails = append(append(mails, d.members[groupDN]...), d.nested[groupDN]...)
+			} else {
+				groupDN = string(filter[1].content)
+				mails = d.members[groupDN]
+			}
+			for _, mail := range mails {
+				_, _ = conn.Write(adEncode(berSequence, id, adEncode(ldapSearchResultEntry,
+					berString(berOctetString, "CN=someone,"+groupDN),
+					adEncode(berSequence, adEncode(berSequence,
+						berString(berOctetString, "Mail"),
+						adEncode(berSet, berString(berOctetString, mail)))),
+				)))
+			}
+			_, _ = conn.Write(result(ldapSearchResultDone, ldapResultSuccess))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func testLDAPLoader(d *fakeDirectory) *LDAPLoader {
+	return &LDAPLoader{
+		URL:          d.URL(),
+		StartTLS:     true,
+		TLSConfig:    d.clientTLS,
+		BindDN:       "CN=opkssh,DC=example,DC=com",
+		BindPassword: d.password,
+		BaseDN:       "DC=example,DC=com",
+		Groups: []LDAPGroup{
+			{DN: "CN=Admins,DC=example,DC=com", Principals: []string{"root"}},
+			{DN: "CN=Devs,DC=example,DC=com", Principals: []string{"dev"}, Issuer: "https://accounts.google.com"},
+			{DN: "CN=Empty,DC=example,DC=com", Principals: []string{"nobody"}},
+		},
+	}
+}
+
+func TestLDAPLoader(t *testing.T) {
+	d := newFakeDirectory(t)
+	loader := testLDAPLoader(d)
+
+	policy, source, err := loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, d.URL(), source.Source())
+	require.Equal(t, &Policy{
+		Groups: map[string][]string{
+			"CN=Admins,DC=example,DC=com": {"alice@example.com", "bob@example.com"},
+			"CN=Devs,DC=example,DC=com":   {"carol@example.com"},
+		},
+		Users: []User{
+			{Group: "CN=Admins,DC=example,DC=com", Principals: []string{"root"}},
+			{Group: "CN=Devs,DC=example,DC=com", Principals: []string{"dev"}, Issuer: "https://accounts.google.com"},
+		},
+	}, policy)
+
+	loader = testLDAPLoader(d)
+	loader.NestedGroups = true
+	policy, _, err = loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice@example.com", "bob@example.com", "dave@example.com"}, policy.Groups["CN=Admins,DC=example,DC=com"])
+
+	loader = testLDAPLoader(d)
+	loader.BindPassword = "wrong"
+	_, _, err = loader.Load()
+	require.ErrorContains(t, err, "LDAP bind failed")
+}
+
+func TestLDAPLoaderCache(t *testing.T) {
+	d := newFakeDirectory(t)
+	fs := afero.NewMemMapFs()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	loader := testLDAPLoader(d)
+	loader.Fs = fs
+	loader.now = func() time.Time { return now }
+
+	first, _, err := loader.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, d.searches.Load())
+
+	// Within the TTL the directory isn't queried, in this process or the next
+	now = now.Add(DefaultLDAPCacheTTL - time.Second)
+	_, _, err = loader.Load()
+	require.NoError(t, err)
+	next := testLDAPLoader(d)
+	next.Fs = fs
+	next.now = loader.now
+	cached, _, err := next.Load()
+	require.NoError(t, err)
+	require.Equal(t, first, cached)
+	require.EqualValues(t, 3, d.searches.Load())
+
+	info, err := fs.Stat(DefaultLDAPCachePath)
+	require.NoError(t, err)
+	require.Equal(t, ModeOnlyOwner, info.Mode().Perm())
+
+	// After the TTL the directory is queried again
+	now = now.Add(2 * time.Second)
+	_, _, err = loader.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 6, d.searches.Load())
+
+	// While the directory is unreachable the cache is used until MaxStale
+	loader.URL = "ldap://127.0.0.1:1"
+	now = now.Add(DefaultLDAPMaxStale - time.Second)
+	stale, _, err := loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, first, stale)
+	now = now.Add(2 * time.Second)
+	_, _, err = loader.Load()
+	require.ErrorContains(t, err, "failed to connect to LDAP server")
+
+	// A cache others can write is ignored
+	require.NoError(t, fs.Chmod(DefaultLDAPCachePath, 0666))
+	insecure := testLDAPLoader(d)
+	insecure.Fs = fs
+	insecure.readCache()
+	require.Nil(t, insecure.cached)
+}
+
+func TestLoadLDAPLoader(t *testing.T) {
+	fileLoader := &FileLoader{Fs: afero.NewMemMapFs()}
+	config := []byte(`url: ldaps://dc1.example.com
+bind_dn: CN=opkssh,DC=example,DC=com
+bind_password: hunter2
+base_dn: DC=example,DC=com
+nested_groups: true
+cache_ttl: 1m
+groups:
+  - dn: CN=Admins,DC=example,DC=com
+    principals: [root]
+`)
+	require.NoError(t, afero.WriteFile(fileLoader.Fs, "/etc/opk/ldap.yml", config, 0644))
+	_, err := fileLoader.LoadLDAPLoader("/etc/opk/ldap.yml")
+	require.ErrorContains(t, err, "insecure permissions")
+
+	require.NoError(t, fileLoader.Fs.Chmod("/etc/opk/ldap.yml", ModeOnlyOwner))
+	loader, err := fileLoader.LoadLDAPLoader("/etc/opk/ldap.yml")
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, loader.CacheTTL)
+	require.True(t, loader.NestedGroups)
+	require.Equal(t, fileLoader.Fs, loader.Fs)
+
+	invalid := []*LDAPLoader{
+		{URL: "https://dc1.example.com", BaseDN: "DC=example", Groups: []LDAPGroup{{DN: "CN=A", Principals: []string{"root"}}}},
+		{URL: "ldap://dc1.example.com", Groups: []LDAPGroup{{DN: "CN=A", Principals: []string{"root"}}}},
+		{URL: "ldap://dc1.example.com", BaseDN: "DC=example"},
+		{URL: "ldap://dc1.example.com", BaseDN: "DC=example", Groups: []LDAPGroup{{DN: "CN=A"}}},
+		{URL: "ldap://dc1.example.com", BindPassword: "hunter2", BaseDN: "DC=example", Groups: []LDAPGroup{{DN: "CN=A", Principals: []string{"root"}}}},
+		{URL: "ldaps://dc1.example.com", StartTLS: true, BaseDN: "DC=example", Groups: []LDAPGroup{{DN: "CN=A", Principals: []string{"root"}}}},
+	}
+	for _, l := range invalid {
+		require.ErrorIs(t, l.Validate(), ErrInvalidPolicy)
+	}
+}
+
+func TestLDAPLoaderPlaintextBind(t *testing.T) {
+	d := newFakeDirectory(t)
+	loader := testLDAPLoader(d)
+	loader.StartTLS = false
+	_, _, err := loader.Load()
+	require.ErrorContains(t, err, "requires an ldaps:// url or start_tls")
+	require.Zero(t, d.searches.Load())
+
+	// Anonymous binds send no password
+	loader.BindDN, loader.BindPassword = "", ""
+	require.NoError(t, loader.Validate())
+}
+
+func TestBerReadOversized(t *testing.T) {
+	// A 4 GB length is rejected without allocating it
+	_, err := berRead(bytes.NewReader([]byte{berSequence, 0x84, 0xff, 0xff, 0xff, 0xff}))
+	require.ErrorContains(t, err, "exceeds the limit")
+
+	_, err = berRead(bytes.NewReader(adEncode(berOctetString, make([]byte, maxLDAPMessageSize+1))))
+	require.ErrorContains(t, err, "exceeds the limit")
+	element, err := berRead(bytes.NewReader(adEncode(berOctetString, make([]byte, maxLDAPMessageSize))))
+	require.NoError(t, err)
+	require.Len(t, element.content, maxLDAPMessageSize)
+}
+
+func TestMultiLoader(t *testing.T) {
+	d := newFakeDirectory(t)
+	files := &mockLoader{policy: &Policy{
+		Groups: map[string][]string{"CN=Admins,DC=example,DC=com": {"erin@example.com"}},
+		Users:  []User{{Email: "frank@example.com", Principals: []string{"ubuntu"}}},
+	}}
+
+	policy, source, err := MultiLoader{files, testLDAPLoader(d)}.Load()
+	require.NoError(t, err)
+	require.Equal(t, "mock, "+d.URL(), source.Source())
+	require.Len(t, policy.Users, 3)
+	require.Equal(t, []string{"erin@example.com", "alice@example.com", "bob@example.com"}, policy.Groups["CN=Admins,DC=example,DC=com"])
+
+	// A failing loader is skipped
+	broken := testLDAPLoader(d)
+	broken.URL = "ldap://127.0.0.1:1"
+	policy, _, err = MultiLoader{files, broken}.Load()
+	require.NoError(t, err)
+	require.Len(t, policy.Users, 1)
+
+	_, _, err = MultiLoader{broken}.Load()
+	require.Error(t, err)
+}
+
+type mockLoader struct{ policy *Policy }
+
+func (m *mockLoader) Load() (*Policy, Source, error) { return m.policy, FileSource("mock"), nil }
@@ -0,0 +1,31 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux && !darwin
+
+package policy
+
+import "github.com/spf13/afero"
+
+// opkssh only manages policy files on Linux and macOS, elsewhere concurrent
+// updates may overwrite each other
+func lockFile(f afero.File) error {
+	return nil
+}
+
+func unlockFile(f afero.File) error {
+	return nil
+}
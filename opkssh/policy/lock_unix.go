@@ -0,0 +1,42 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux || darwin
+
+package policy
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// lockFile takes an exclusive lock on f if it is backed by the OS. Files of
+// other afero filesystems, e.g. in memory ones in tests, aren't locked
+func lockFile(f afero.File) error {
+	if osFile, ok := f.(*os.File); ok {
+		return syscall.Flock(int(osFile.Fd()), syscall.LOCK_EX)
+	}
+	return nil
+}
+
+func unlockFile(f afero.File) error {
+	if osFile, ok := f.(*os.File); ok {
+		return syscall.Flock(int(osFile.Fd()), syscall.LOCK_UN)
+	}
+	return nil
+}
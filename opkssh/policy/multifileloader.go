@@ -70,6 +70,11 @@ func (l *MultiFileLoader) Load() (*Policy, Source, error) {
 	// appending
 	readPaths := []string{}
 	if rootPolicy != nil {
+		// Only the root policy defines groups, user policies have theirs
+		// expanded when loaded
+		policy.Groups = rootPolicy.Groups
+		policy.HostGroups = rootPolicy.HostGroups
+		policy.RequireEmailVerified = rootPolicy.RequireEmailVerified
 		policy.Users = append(policy.Users, rootPolicy.Users...)
 		readPaths = append(readPaths, SystemDefaultPolicyPath)
 	}
@@ -0,0 +1,67 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+var _ Loader = MultiLoader{}
+
+// MultiLoader implements policy.Loader by merging the policies of several
+// loaders, e.g. the policy files and an LDAPLoader. Loaders that fail are
+// skipped with a warning; an error is returned only if all of them fail.
+// Groups and host groups with the same name are merged and verified emails
+// are required if any policy requires them.
+type MultiLoader []Loader
+
+func (m MultiLoader) Load() (*Policy, Source, error) {
+	merged := new(Policy)
+	sources := []string{}
+	var errs []error
+	for _, loader := range m {
+		policy, source, err := loader.Load()
+		if err != nil {
+			log.Println("warning: failed to load policy:", err)
+			errs = append(errs, err)
+			continue
+		}
+		for name, members := range policy.Groups {
+			if merged.Groups == nil {
+				merged.Groups = map[string][]string{}
+			}
+			merged.Groups[name] = append(merged.Groups[name], members...)
+		}
+		for name, patterns := range policy.HostGroups {
+			if merged.HostGroups == nil {
+				merged.HostGroups = map[string][]string{}
+			}
+			merged.HostGroups[name] = append(merged.HostGroups[name], patterns...)
+		}
+		merged.Users = append(merged.Users, policy.Users...)
+		merged.RequireEmailVerified = merged.RequireEmailVerified || policy.RequireEmailVerified
+		if s := source.Source(); s != "" {
+			sources = append(sources, s)
+		}
+	}
+	if len(errs) == len(m) {
+		return nil, EmptySource{}, errors.Join(errs...)
+	}
+	return merged, FileSource(strings.Join(sources, ", ")), nil
+}
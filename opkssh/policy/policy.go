@@ -17,8 +17,17 @@
 package policy
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/opkssh/device"
+	"golang.org/x/exp/slices"
 
 	"gopkg.in/yaml.v3"
 )
@@ -27,40 +36,239 @@ import (
 type User struct {
 	// Email is the user's email. It is the expected value used when comparing
 	// against an id_token's email claim
-	Email string `yaml:"email"`
+	Email string `yaml:"email,omitempty" json:"email,omitempty"`
+	// Group, set instead of Email, names an entry of Policy.Groups. Every
+	// member of the group is granted the entry's principals
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
 	// Principals is a list of allowed principals
-	Principals []string `yaml:"principals"`
+	Principals []string `yaml:"principals" json:"principals"`
+	// Issuer, if set, requires the id_token to be issued by this OpenID
+	// provider. Otherwise any trusted provider vouching for the email matches
+	Issuer string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	// Hosts and HostGroups, if either is set, scope the entry to the SSH
+	// servers whose hostname matches one of the glob patterns in Hosts or in
+	// the named entries of Policy.HostGroups, e.g. "bastion-*"
+	Hosts      []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	HostGroups []string `yaml:"host_groups,omitempty" json:"host_groups,omitempty"`
+	// Device, if set, restricts the devices the user can SSH from
+	Device *DeviceRequirements `yaml:"device,omitempty" json:"device,omitempty"`
 	// Sub        string   `yaml:"sub,omitempty"`
 }
 
+// DeviceRequirements are checked against the device info signed into the PK
+// Token when logging in with device inventory enabled. PK Tokens without
+// device info never satisfy them.
+type DeviceRequirements struct {
+	// DiskEncrypted requires that the device's root disk is known to be
+	// encrypted
+	DiskEncrypted bool `yaml:"disk_encrypted,omitempty" json:"disk_encrypted,omitempty"`
+	// OS lists the allowed operating systems as named by Go's runtime.GOOS,
+	// e.g. linux, darwin or windows
+	OS []string `yaml:"os,omitempty" json:"os,omitempty"`
+	// Hostnames lists glob patterns, e.g. "*.corp.example.com", one of which
+	// the device's hostname must match
+	Hostnames []string `yaml:"hostnames,omitempty" json:"hostnames,omitempty"`
+}
+
+// Check returns an error describing the first requirement the device
+// doesn't meet
+func (r *DeviceRequirements) Check(info *device.Info) error {
+	if r.DiskEncrypted && (info.DiskEncrypted == nil || !*info.DiskEncrypted) {
+		return fmt.Errorf("disk encryption is required")
+	}
+	if len(r.OS) > 0 && !slices.Contains(r.OS, info.OS) {
+		return fmt.Errorf("operating system %q is not allowed", info.OS)
+	}
+	if len(r.Hostnames) > 0 {
+		for _, pattern := range r.Hostnames {
+			if ok, err := path.Match(pattern, info.Hostname); err != nil {
+				return fmt.Errorf("malformed hostname pattern %q: %w", pattern, err)
+			} else if ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("hostname %q is not allowed", info.Hostname)
+	}
+	return nil
+}
+
 // Policy represents an opkssh policy
 type Policy struct {
+	// Groups maps a group name to the emails of its members. User entries
+	// reference a group by name to grant principals to all of its members
+	Groups map[string][]string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	// HostGroups maps a host group name to hostname glob patterns. User
+	// entries reference a host group by name to apply only on those hosts
+	HostGroups map[string][]string `yaml:"host_groups,omitempty" json:"host_groups,omitempty"`
 	// Users is a list of all user entries in the policy
-	Users []User `yaml:"users"`
+	Users []User `yaml:"users" json:"users"`
+	// RequireEmailVerified denies access to users whose id_token doesn't
+	// have an email_verified claim that is true. OPs such as Google and
+	// Azure include emails the user hasn't proven control of. Only read
+	// from the system default policy
+	RequireEmailVerified bool `yaml:"require_email_verified,omitempty" json:"require_email_verified,omitempty"`
 }
 
-// FromYAML decodes YAML encoded input into policy.Policy
+// ErrInvalidPolicy is returned when a policy doesn't conform to the policy
+// schema
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// FromYAML decodes YAML encoded input into policy.Policy. Unknown fields are
+// rejected and the decoded policy must pass Validate
 func FromYAML(input []byte) (*Policy, error) {
 	policy := &Policy{}
-	if err := yaml.Unmarshal(input, policy); err != nil {
+	decoder := yaml.NewDecoder(bytes.NewReader(input))
+	decoder.KnownFields(true)
+	// An empty document decodes to io.EOF, treat it as an empty policy
+	if err := decoder.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
 		return nil, fmt.Errorf("error unmarshalling input to policy.Policy: %w", err)
 	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
 	return policy, nil
 }
 
+// Validate checks that the policy conforms to the policy schema. Each user
+// entry must name exactly one of an email or an existing group, allow at
+// least one principal and, if it constrains the issuer, name it by URL.
+// Host patterns must be valid globs and host groups must exist
+func (p *Policy) Validate() error {
+	for name, patterns := range p.HostGroups {
+		if name == "" {
+			return fmt.Errorf("%w: host group with empty name", ErrInvalidPolicy)
+		}
+		if len(patterns) == 0 {
+			return fmt.Errorf("%w: host group %q has no hosts", ErrInvalidPolicy, name)
+		}
+		if err := validateHosts(patterns); err != nil {
+			return fmt.Errorf("%w: host group %q %w", ErrInvalidPolicy, name, err)
+		}
+	}
+	for name, members := range p.Groups {
+		if name == "" {
+			return fmt.Errorf("%w: group with empty name", ErrInvalidPolicy)
+		}
+		if len(members) == 0 {
+			return fmt.Errorf("%w: group %q has no members", ErrInvalidPolicy, name)
+		}
+		for _, email := range members {
+			if !strings.Contains(email, "@") {
+				return fmt.Errorf("%w: group %q member %q is not an email", ErrInvalidPolicy, name, email)
+			}
+		}
+	}
+	for i, user := range p.Users {
+		switch {
+		case user.Email == "" && user.Group == "":
+			return fmt.Errorf("%w: users[%d] must set email or group", ErrInvalidPolicy, i)
+		case user.Email != "" && user.Group != "":
+			return fmt.Errorf("%w: users[%d] sets both email and group", ErrInvalidPolicy, i)
+		case user.Group != "":
+			if _, ok := p.Groups[user.Group]; !ok {
+				return fmt.Errorf("%w: users[%d] references undefined group %q", ErrInvalidPolicy, i, user.Group)
+			}
+		}
+		if err := validateGrant(user.Principals, user.Issuer); err != nil {
+			return fmt.Errorf("%w: users[%d] %w", ErrInvalidPolicy, i, err)
+		}
+		if err := validateHosts(user.Hosts); err != nil {
+			return fmt.Errorf("%w: users[%d] %w", ErrInvalidPolicy, i, err)
+		}
+		for _, name := range user.HostGroups {
+			if _, ok := p.HostGroups[name]; !ok {
+				return fmt.Errorf("%w: users[%d] references undefined host group %q", ErrInvalidPolicy, i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateHosts checks that hostname glob patterns are well formed
+func validateHosts(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			return fmt.Errorf("has malformed host pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// validateGrant checks the principals and issuer constraint of an entry
+func validateGrant(principals []string, issuer string) error {
+	if len(principals) == 0 {
+		return fmt.Errorf("has no principals")
+	}
+	for _, principal := range principals {
+		if principal == "" || strings.ContainsAny(principal, " \t\n:") {
+			return fmt.Errorf("has malformed principal %q", principal)
+		}
+	}
+	if issuer != "" {
+		if u, err := url.Parse(issuer); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("has malformed issuer %q", issuer)
+		}
+	}
+	return nil
+}
+
+// Members returns the emails the user entry applies to, either its email or
+// the members of its group
+func (p *Policy) Members(user User) []string {
+	if user.Group != "" {
+		return p.Groups[user.Group]
+	}
+	return []string{user.Email}
+}
+
+// Hosts returns the hostname patterns the user entry is scoped to, those of
+// the entry and of its host groups. An empty result means every host
+func (p *Policy) Hosts(user User) []string {
+	var hosts []string
+	hosts = append(hosts, user.Hosts...)
+	for _, name := range user.HostGroups {
+		hosts = append(hosts, p.HostGroups[name]...)
+	}
+	return hosts
+}
+
+// AppliesToHost returns true if the user entry applies on the host named
+// hostname. Hostnames are compared case insensitively. Entries scoped to
+// hosts never apply if hostname is unknown
+func (p *Policy) AppliesToHost(user User, hostname string) bool {
+	hosts := p.Hosts(user)
+	if len(hosts) == 0 {
+		return true
+	}
+	hostname = strings.ToLower(hostname)
+	for _, pattern := range hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), hostname); ok && hostname != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // AddAllowedPrincipal adds a new allowed principal to the user whose email is
 // equal to userEmail. If no user can be found with the email userEmail, then a
 // new user entry is added with an initial allowed principals list containing
 // principal. No changes are made if the principal is already allowed for this
 // user.
 func (p *Policy) AddAllowedPrincipal(principal string, userEmail string) {
+	p.AddAllowedPrincipalForIssuer(principal, userEmail, "")
+}
+
+// AddAllowedPrincipalForIssuer is like AddAllowedPrincipal but only considers,
+// and creates, entries constrained to the OpenID provider issuer. An empty
+// issuer matches entries without an issuer constraint
+func (p *Policy) AddAllowedPrincipalForIssuer(principal string, userEmail string, issuer string) {
 	userExists := false
 	if len(p.Users) != 0 {
 		// search to see if the current user already has an entry in the policy
 		// file
 		for i := range p.Users {
 			user := &p.Users[i]
-			if user.Email == userEmail {
+			if user.Email == userEmail && user.Issuer == issuer {
 				principalExists := false
 				for _, p := range user.Principals {
 					// if the principal already exists for this user, then skip
@@ -85,12 +293,69 @@ func (p *Policy) AddAllowedPrincipal(principal string, userEmail string) {
 		newUser := User{
 			Email:      userEmail,
 			Principals: []string{principal},
+			Issuer:     issuer,
 		}
 		// add the new user to the list of users in the policy
 		p.Users = append(p.Users, newUser)
 	}
 }
 
+// RemoveAllowedPrincipal removes principal from the entries of the user
+// whose email is equal to userEmail and that are constrained to the OpenID
+// provider issuer, an empty issuer matches entries without an issuer
+// constraint. Entries left without principals are removed. Returns false if
+// no entry allowed the principal
+func (p *Policy) RemoveAllowedPrincipal(principal string, userEmail string, issuer string) bool {
+	removed := false
+	users := p.Users[:0]
+	for _, user := range p.Users {
+		if user.Email == userEmail && user.Issuer == issuer && slices.Contains(user.Principals, principal) {
+			user.Principals = slices.DeleteFunc(slices.Clone(user.Principals), func(p string) bool { return p == principal })
+			removed = true
+			log.Printf("Removed principal %s from user with email %s\n", principal, userEmail)
+			if len(user.Principals) == 0 {
+				continue
+			}
+		}
+		users = append(users, user)
+	}
+	p.Users = users
+	return removed
+}
+
+// AddGroupMember adds userEmail to the group, creating the group if it doesn't
+// exist. No changes are made if userEmail is already a member
+func (p *Policy) AddGroupMember(group string, userEmail string) {
+	if slices.Contains(p.Groups[group], userEmail) {
+		log.Printf("User with email %s is already a member of group %s, skipping...\n", userEmail, group)
+		return
+	}
+	if p.Groups == nil {
+		p.Groups = map[string][]string{}
+	}
+	p.Groups[group] = append(p.Groups[group], userEmail)
+}
+
+// AddAllowedGroupPrincipal adds a new allowed principal to the entry of group
+// constrained to issuer, creating the entry if there is none. An empty issuer
+// matches entries without an issuer constraint
+func (p *Policy) AddAllowedGroupPrincipal(principal string, group string, issuer string) {
+	for i := range p.Users {
+		user := &p.Users[i]
+		if user.Group == group && user.Issuer == issuer {
+			if !slices.Contains(user.Principals, principal) {
+				user.Principals = append(user.Principals, principal)
+			}
+			return
+		}
+	}
+	p.Users = append(p.Users, User{
+		Group:      group,
+		Principals: []string{principal},
+		Issuer:     issuer,
+	})
+}
+
 // ToYAML encodes the policy into YAML
 func (p *Policy) ToYAML() ([]byte, error) {
 	marshaledData, err := yaml.Marshal(p)
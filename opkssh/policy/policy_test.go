@@ -21,6 +21,7 @@ import (
 
 	"github.com/openpubkey/openpubkey/opkssh/policy"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAddAllowedPrincipal(t *testing.T) {
@@ -122,3 +123,163 @@ func TestAddAllowedPrincipal(t *testing.T) {
 		})
 	}
 }
+
+func TestFromYAMLGroups(t *testing.T) {
+	t.Parallel()
+
+	input := []byte(`groups:
+  admins:
+    - alice@example.com
+    - bob@example.com
+users:
+  - group: admins
+    principals: [root, ubuntu]
+    issuer: https://accounts.google.com
+  - email: charlie@example.com
+    principals: [ubuntu]
+    hosts: [web-*]
+    host_groups: [bastions]
+host_groups:
+  bastions: [bastion-*]
+`)
+	p, err := policy.FromYAML(input)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice@example.com", "bob@example.com"}, p.Groups["admins"])
+	require.Equal(t, "https://accounts.google.com", p.Users[0].Issuer)
+	require.Equal(t, []string{"alice@example.com", "bob@example.com"}, p.Members(p.Users[0]))
+	require.Equal(t, []string{"charlie@example.com"}, p.Members(p.Users[1]))
+	require.Equal(t, []string{"web-*", "bastion-*"}, p.Hosts(p.Users[1]))
+	require.Nil(t, p.Hosts(p.Users[0]))
+
+	// Round trip keeps groups and issuers
+	out, err := p.ToYAML()
+	require.NoError(t, err)
+	roundTrip, err := policy.FromYAML(out)
+	require.NoError(t, err)
+	require.Equal(t, p, roundTrip)
+
+	empty, err := policy.FromYAML(nil)
+	require.NoError(t, err)
+	require.Empty(t, empty.Users)
+}
+
+func TestFromYAMLInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "unknown field",
+			input: "users:\n  - email: alice@example.com\n    principal: [root]\n",
+			err:   "field principal not found",
+		},
+		{
+			name:  "no email or group",
+			input: "users:\n  - principals: [root]\n",
+			err:   "must set email or group",
+		},
+		{
+			name:  "email and group",
+			input: "groups:\n  admins: [bob@example.com]\nusers:\n  - email: alice@example.com\n    group: admins\n    principals: [root]\n",
+			err:   "sets both email and group",
+		},
+		{
+			name:  "undefined group",
+			input: "users:\n  - group: admins\n    principals: [root]\n",
+			err:   "undefined group",
+		},
+		{
+			name:  "empty group",
+			input: "groups:\n  admins: []\nusers:\n  - group: admins\n    principals: [root]\n",
+			err:   "has no members",
+		},
+		{
+			name:  "group member not an email",
+			input: "groups:\n  admins: [alice]\nusers:\n  - group: admins\n    principals: [root]\n",
+			err:   "is not an email",
+		},
+		{
+			name:  "no principals",
+			input: "users:\n  - email: alice@example.com\n",
+			err:   "has no principals",
+		},
+		{
+			name:  "malformed principal",
+			input: "users:\n  - email: alice@example.com\n    principals: [\"root user\"]\n",
+			err:   "malformed principal",
+		},
+		{
+			name:  "malformed host pattern",
+			input: "users:\n  - email: alice@example.com\n    principals: [root]\n    hosts: [\"bastion-[\"]\n",
+			err:   "malformed host pattern",
+		},
+		{
+			name:  "undefined host group",
+			input: "users:\n  - email: alice@example.com\n    principals: [root]\n    host_groups: [web]\n",
+			err:   "undefined host group",
+		},
+		{
+			name:  "empty host group",
+			input: "host_groups:\n  web: []\nusers:\n  - email: alice@example.com\n    principals: [root]\n    host_groups: [web]\n",
+			err:   "has no hosts",
+		},
+		{
+			name:  "malformed issuer",
+			input: "users:\n  - email: alice@example.com\n    principals: [root]\n    issuer: accounts.google.com\n",
+			err:   "malformed issuer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := policy.FromYAML([]byte(tt.input))
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestAddAllowedGroupPrincipal(t *testing.T) {
+	t.Parallel()
+
+	p := &policy.Policy{}
+	p.AddGroupMember("admins", "alice@example.com")
+	p.AddGroupMember("admins", "alice@example.com")
+	p.AddGroupMember("admins", "bob@example.com")
+	p.AddAllowedGroupPrincipal("root", "admins", "")
+	p.AddAllowedGroupPrincipal("root", "admins", "")
+	p.AddAllowedGroupPrincipal("ubuntu", "admins", "")
+	p.AddAllowedGroupPrincipal("root", "admins", "https://accounts.google.com")
+	p.AddAllowedPrincipalForIssuer("root", "alice@example.com", "https://accounts.google.com")
+
+	require.NoError(t, p.Validate())
+	require.Equal(t, map[string][]string{"admins": {"alice@example.com", "bob@example.com"}}, p.Groups)
+	require.Equal(t, []policy.User{
+		{Group: "admins", Principals: []string{"root", "ubuntu"}},
+		{Group: "admins", Principals: []string{"root"}, Issuer: "https://accounts.google.com"},
+		{Email: "alice@example.com", Principals: []string{"root"}, Issuer: "https://accounts.google.com"},
+	}, p.Users)
+}
+
+func TestRemoveAllowedPrincipal(t *testing.T) {
+	t.Parallel()
+
+	p := &policy.Policy{
+		Users: []policy.User{
+			{Email: "alice@example.com", Principals: []string{"root", "dev"}},
+			{Email: "alice@example.com", Principals: []string{"root"}, Issuer: "https://accounts.google.com"},
+			{Email: "bob@example.com", Principals: []string{"root"}},
+		},
+	}
+
+	require.True(t, p.RemoveAllowedPrincipal("root", "alice@example.com", ""))
+	require.Equal(t, []string{"dev"}, p.Users[0].Principals)
+	require.Equal(t, []string{"root"}, p.Users[1].Principals, "entries of other issuers must not change")
+
+	require.True(t, p.RemoveAllowedPrincipal("root", "bob@example.com", ""))
+	require.Len(t, p.Users, 2, "entries without principals must be removed")
+
+	require.False(t, p.RemoveAllowedPrincipal("root", "bob@example.com", ""))
+	require.False(t, p.RemoveAllowedPrincipal("admin", "alice@example.com", ""))
+}
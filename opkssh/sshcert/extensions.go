@@ -0,0 +1,483 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// ExtensionSchemaVersion is the version of the OpenPubkey SSH certificate
+// extension registry below. Certs carry it in the openpubkey-schema
+// extension, certs without it predate the registry and are version 1.
+// Extensions are only ever added to the registry, bumping the version, so a
+// verifier can tell a cert using extensions it doesn't know from a malformed
+// one. Certs are issued with the lowest version that has all the extensions
+// they use, so that older verifiers keep accepting them.
+const ExtensionSchemaVersion = 3
+
+// ExtensionPrefix is the prefix of all OpenPubkey SSH cert extensions. Names
+// with this prefix that aren't in the registry are rejected by
+// ParseExtensions.
+const ExtensionPrefix = "openpubkey-"
+
+// Encoding describes how an extension value is encoded as a string
+type Encoding string
+
+const (
+	// EncodingDecimal is a base 10 unsigned integer
+	EncodingDecimal Encoding = "decimal"
+	// EncodingCompactPKT is a PK Token in compact JWS form, see
+	// pktoken.PKToken.Compact
+	EncodingCompactPKT Encoding = "compact-pkt"
+	// EncodingJSONObject is a JSON object
+	EncodingJSONObject Encoding = "json-object"
+	// EncodingList is a comma separated list of non-empty values
+	EncodingList Encoding = "list"
+	// EncodingCompressedPKT is a byte naming the compression algorithm,
+	// CompressionDeflate, followed by the compressed PK Token in compact JWS
+	// form
+	EncodingCompressedPKT Encoding = "compressed-pkt"
+)
+
+const (
+	// EncodingChunk is a piece of a value split across numbered extensions
+	EncodingChunk Encoding = "chunk"
+	// EncodingChunkHeader is a comma separated list of the encoding of the
+	// reassembled chunks, EncodingCompactPKT or EncodingCompressedPKT, the
+	// number of chunks and the unpadded base64url SHA-256 digest of the
+	// reassembled value
+	EncodingChunkHeader Encoding = "chunk-header"
+)
+
+// CompressionDeflate is the raw DEFLATE algorithm of RFC 1951, the only
+// one ExtPKTCompressed is written with
+const CompressionDeflate byte = 1
+
+// Extension describes an entry of the extension registry
+type Extension struct {
+	Name     string
+	Encoding Encoding
+	// Since is the schema version that introduced the extension
+	Since int
+	// Required extensions must be present in every OpenPubkey SSH cert
+	Required bool
+	// Numbered extensions are a family of extensions named Name followed by
+	// 0, 1 and so on
+	Numbered    bool
+	Description string
+}
+
+var (
+	ExtSchema = Extension{
+		Name:        "openpubkey-schema",
+		Encoding:    EncodingDecimal,
+		Since:       1,
+		Description: "version of the extension registry the cert was issued with",
+	}
+	ExtPKT = Extension{
+		Name:        "openpubkey-pkt",
+		Encoding:    EncodingCompactPKT,
+		Since:       1,
+		Description: "PK Token binding the cert's public key to the ID Token, required unless openpubkey-pkt-compressed is set",
+	}
+	ExtPKTCompressed = Extension{
+		Name:     "openpubkey-pkt-compressed",
+		Encoding: EncodingCompressedPKT,
+		Since:    2,
+		Description: "compressed PK Token, set instead of openpubkey-pkt " +
+			"to keep large PK Tokens within sshd's limits",
+	}
+	ExtPKTChunked = Extension{
+		Name:     "openpubkey-pkt-chunked",
+		Encoding: EncodingChunkHeader,
+		Since:    3,
+		Description: "set instead of openpubkey-pkt when the PK Token is split " +
+			"across openpubkey-pkt-0 to openpubkey-pkt-n",
+	}
+	ExtPKTChunk = Extension{
+		Name:        "openpubkey-pkt-",
+		Encoding:    EncodingChunk,
+		Since:       3,
+		Numbered:    true,
+		Description: "piece of the PK Token described by openpubkey-pkt-chunked",
+	}
+	ExtClaims = Extension{
+		Name:     "openpubkey-claims",
+		Encoding: EncodingJSONObject,
+		Since:    1,
+		Description: "copy of ID Token claims for display and logging, " +
+			"each must equal the claim in the PK Token",
+	}
+	ExtPolicyHints = Extension{
+		Name:     "openpubkey-policy-hints",
+		Encoding: EncodingList,
+		Since:    1,
+		Description: "policy entries the client expects to match, e.g. host groups, " +
+			"advisory only and never grant access",
+	}
+)
+
+// Registry lists every OpenPubkey SSH cert extension
+var Registry = []Extension{ExtSchema, ExtPKT, ExtClaims, ExtPolicyHints, ExtPKTCompressed, ExtPKTChunked, ExtPKTChunk}
+
+// LookupExtension returns the registry entry for name
+func LookupExtension(name string) (Extension, bool) {
+	for _, ext := range Registry {
+		if ext.Name == name {
+			return ext, true
+		}
+		if number, ok := strings.CutPrefix(name, ext.Name); ok && ext.Numbered && isChunkNumber(number) {
+			return ext, true
+		}
+	}
+	return Extension{}, false
+}
+
+// isChunkNumber reports whether s is a decimal number without leading
+// zeros, so that every chunk has exactly one name
+func isChunkNumber(s string) bool {
+	if s == "" || len(s) > 1 && s[0] == '0' {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Extensions are the decoded OpenPubkey extensions of an SSH cert
+type Extensions struct {
+	SchemaVersion int
+	PKT           *pktoken.PKToken
+	// Claims are optional, when set every claim must equal the claim in PKT
+	Claims      map[string]any
+	PolicyHints []string
+	// Compress stores PKT in ExtPKTCompressed instead of ExtPKT. Verifiers
+	// older than schema version 2 reject such certs.
+	Compress bool
+	// ChunkSize, if set, splits PKT, compressed or not, across numbered
+	// ExtPKTChunk extensions of at most this many bytes, for PK Tokens that
+	// are too large for a single extension. Verifiers older than schema
+	// version 3 reject such certs.
+	ChunkSize int
+}
+
+// ParseExtensions decodes and validates the OpenPubkey extensions of an SSH
+// cert. Extensions without ExtensionPrefix, like permit-pty, are ignored.
+func ParseExtensions(certExts map[string]string) (*Extensions, error) {
+	exts := &Extensions{SchemaVersion: 1}
+	if v, ok := certExts[ExtSchema.Name]; ok {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("%s extension is not a valid version: %q", ExtSchema.Name, v)
+		}
+		if version > ExtensionSchemaVersion {
+			return nil, fmt.Errorf("cert uses extension schema version %d, only versions up to %d are supported", version, ExtensionSchemaVersion)
+		}
+		exts.SchemaVersion = version
+	}
+
+	for name := range certExts {
+		if !strings.HasPrefix(name, ExtensionPrefix) {
+			continue
+		}
+		ext, ok := LookupExtension(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown extension %s", name)
+		}
+		if ext.Since > exts.SchemaVersion {
+			return nil, fmt.Errorf("extension %s requires schema version %d but cert has version %d", name, ext.Since, exts.SchemaVersion)
+		}
+	}
+	for _, ext := range Registry {
+		if _, ok := certExts[ext.Name]; ext.Required && !ok {
+			return nil, fmt.Errorf("cert is missing required %s extension", ext.Name)
+		}
+	}
+
+	pktCom, hasPKT := certExts[ExtPKT.Name]
+	compressed, hasCompressed := certExts[ExtPKTCompressed.Name]
+	if header, ok := certExts[ExtPKTChunked.Name]; ok {
+		if hasPKT || hasCompressed {
+			return nil, fmt.Errorf("cert has both %s and an unchunked PK Token", ExtPKTChunked.Name)
+		}
+		encoding, value, err := joinChunks(header, certExts)
+		if err != nil {
+			return nil, fmt.Errorf("%s extension is invalid: %w", ExtPKTChunked.Name, err)
+		}
+		if encoding == EncodingCompressedPKT {
+			compressed, hasCompressed = value, true
+		} else {
+			pktCom, hasPKT = value, true
+		}
+		exts.ChunkSize = len(certExts[ExtPKTChunk.Name+"0"])
+	} else if chunks := countChunks(certExts); chunks > 0 {
+		return nil, fmt.Errorf("cert has %s extensions without %s", ExtPKTChunk.Name, ExtPKTChunked.Name)
+	}
+	if hasCompressed {
+		if hasPKT {
+			return nil, fmt.Errorf("cert has both %s and %s extensions", ExtPKT.Name, ExtPKTCompressed.Name)
+		}
+		decompressed, err := decompressPKT([]byte(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("%s extension in cert failed decompression: %w", ExtPKTCompressed.Name, err)
+		}
+		pktCom, hasPKT = string(decompressed), true
+		exts.Compress = true
+	}
+	if !hasPKT {
+		return nil, fmt.Errorf("cert is missing required %s extension", ExtPKT.Name)
+	}
+	pkt, err := pktoken.NewFromCompact([]byte(pktCom))
+	if err != nil {
+		return nil, fmt.Errorf("%s extension in cert failed deserialization: %w", ExtPKT.Name, err)
+	}
+	exts.PKT = pkt
+
+	if v, ok := certExts[ExtClaims.Name]; ok {
+		if err := json.Unmarshal([]byte(v), &exts.Claims); err != nil || exts.Claims == nil {
+			return nil, fmt.Errorf("%s extension is not a JSON object", ExtClaims.Name)
+		}
+		if err := checkClaims(exts.Claims, pkt); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := certExts[ExtPolicyHints.Name]; ok {
+		hints, err := parseList(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s extension is invalid: %w", ExtPolicyHints.Name, err)
+		}
+		exts.PolicyHints = hints
+	}
+	return exts, nil
+}
+
+// Encode returns the SSH cert extensions for e, writing the lowest schema
+// version that has all the extensions used
+func (e *Extensions) Encode() (map[string]string, error) {
+	if e.PKT == nil {
+		return nil, fmt.Errorf("%s is required", ExtPKT.Name)
+	}
+	pktCom, err := e.PKT.Compact()
+	if err != nil {
+		return nil, err
+	}
+	certExts := map[string]string{}
+	encoding, name := EncodingCompactPKT, ExtPKT.Name
+	if e.Compress {
+		if pktCom, err = compressPKT(pktCom); err != nil {
+			return nil, err
+		}
+		encoding, name = EncodingCompressedPKT, ExtPKTCompressed.Name
+	}
+	if e.ChunkSize > 0 {
+		splitChunks(certExts, encoding, pktCom, e.ChunkSize)
+	} else {
+		certExts[name] = string(pktCom)
+	}
+	if len(e.Claims) > 0 {
+		if err := checkClaims(e.Claims, e.PKT); err != nil {
+			return nil, err
+		}
+		claimsJSON, err := json.Marshal(e.Claims)
+		if err != nil {
+			return nil, err
+		}
+		certExts[ExtClaims.Name] = string(claimsJSON)
+	}
+	if len(e.PolicyHints) > 0 {
+		for _, hint := range e.PolicyHints {
+			if hint == "" || strings.Contains(hint, ",") {
+				return nil, fmt.Errorf("policy hint %q must be non-empty and not contain commas", hint)
+			}
+		}
+		certExts[ExtPolicyHints.Name] = strings.Join(e.PolicyHints, ",")
+	}
+	version := 1
+	for name := range certExts {
+		if ext, _ := LookupExtension(name); ext.Since > version {
+			version = ext.Since
+		}
+	}
+	certExts[ExtSchema.Name] = strconv.Itoa(version)
+	return certExts, nil
+}
+
+// splitChunks adds the ExtPKTChunked and ExtPKTChunk extensions for value
+// to certExts
+func splitChunks(certExts map[string]string, encoding Encoding, value []byte, chunkSize int) {
+	digest := sha256.Sum256(value)
+	n := 0
+	for ; len(value) > 0; n++ {
+		chunk := value[:min(chunkSize, len(value))]
+		certExts[ExtPKTChunk.Name+strconv.Itoa(n)] = string(chunk)
+		value = value[len(chunk):]
+	}
+	certExts[ExtPKTChunked.Name] = strings.Join([]string{
+		string(encoding), strconv.Itoa(n), base64.RawURLEncoding.EncodeToString(digest[:]),
+	}, ",")
+}
+
+// joinChunks reassembles the value described by header from the chunks in
+// certExts and checks it against the digest in header
+func joinChunks(header string, certExts map[string]string) (Encoding, string, error) {
+	fields, err := parseList(header)
+	if err != nil {
+		return "", "", err
+	}
+	if len(fields) != 3 {
+		return "", "", fmt.Errorf("expected encoding, number of chunks and digest")
+	}
+	encoding := Encoding(fields[0])
+	if encoding != EncodingCompactPKT && encoding != EncodingCompressedPKT {
+		return "", "", fmt.Errorf("unsupported encoding %s", encoding)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return "", "", fmt.Errorf("invalid number of chunks %q", fields[1])
+	}
+	// Every chunk must be accounted for, so none can be smuggled in
+	// besides the ones that were checked
+	if chunks := countChunks(certExts); chunks != n {
+		return "", "", fmt.Errorf("expected %d chunks, cert has %d", n, chunks)
+	}
+	var value strings.Builder
+	for i := 0; i < n; i++ {
+		chunk, ok := certExts[ExtPKTChunk.Name+strconv.Itoa(i)]
+		if !ok {
+			return "", "", fmt.Errorf("chunk %d is missing", i)
+		}
+		if value.Len()+len(chunk) > pktoken.DefaultLimits.MaxSize {
+			return "", "", pktoken.ErrTooLarge
+		}
+		value.WriteString(chunk)
+	}
+	digest := sha256.Sum256([]byte(value.String()))
+	if base64.RawURLEncoding.EncodeToString(digest[:]) != fields[2] {
+		return "", "", fmt.Errorf("reassembled chunks don't match the digest")
+	}
+	return encoding, value.String(), nil
+}
+
+// countChunks returns the number of ExtPKTChunk extensions in certExts
+func countChunks(certExts map[string]string) int {
+	chunks := 0
+	for name := range certExts {
+		if ext, ok := LookupExtension(name); ok && ext.Name == ExtPKTChunk.Name {
+			chunks++
+		}
+	}
+	return chunks
+}
+
+// compressPKT encodes pktCom as EncodingCompressedPKT
+func compressPKT(pktCom []byte) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{CompressionDeflate})
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(pktCom); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressPKT decodes EncodingCompressedPKT. Like NewFromCompact it
+// rejects PK Tokens larger than pktoken.DefaultLimits, without
+// decompressing more than that.
+func decompressPKT(compressed []byte) ([]byte, error) {
+	if len(compressed) == 0 || compressed[0] != CompressionDeflate {
+		return nil, fmt.Errorf("unsupported compression algorithm")
+	}
+	r := flate.NewReader(bytes.NewReader(compressed[1:]))
+	defer r.Close()
+	maxSize := pktoken.DefaultLimits.MaxSize
+	pktCom, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(pktCom) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", pktoken.ErrTooLarge, maxSize)
+	}
+	return pktCom, nil
+}
+
+// checkClaims makes sure claims can't be used to show anything other than
+// what the OP signed
+func checkClaims(claims map[string]any, pkt *pktoken.PKToken) error {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(pkt.Payload, &payload); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(claims))
+	for name := range claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		signed, ok := payload[name]
+		if !ok {
+			return fmt.Errorf("%s extension has claim %s which is not in the PK Token", ExtClaims.Name, name)
+		}
+		var signedValue any
+		if err := json.Unmarshal(signed, &signedValue); err != nil {
+			return err
+		}
+		a, err := json.Marshal(claims[name])
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(signedValue)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("%s extension claim %s does not match the PK Token", ExtClaims.Name, name)
+		}
+	}
+	return nil
+}
+
+func parseList(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	values := strings.Split(v, ",")
+	for _, value := range values {
+		if value == "" {
+			return nil, fmt.Errorf("empty value in %q", v)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPKT(t *testing.T) *pktoken.PKToken {
+	providerOpts := providers.DefaultMockProviderOpts()
+	op, _, idtTemplate, err := providers.NewMockProvider(providerOpts)
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com"}
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	return pkt
+}
+
+func TestExtensionsRoundTrip(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+
+	exts := &Extensions{
+		PKT:         pkt,
+		Claims:      map[string]any{"email": "arthur.aardvark@example.com"},
+		PolicyHints: []string{"web", "bastion"},
+	}
+	certExts, err := exts.Encode()
+	require.NoError(t, err)
+	require.Equal(t, "1", certExts[ExtSchema.Name])
+
+	certExts["permit-pty"] = ""
+	parsed, err := ParseExtensions(certExts)
+	require.NoError(t, err)
+	require.Equal(t, 1, parsed.SchemaVersion)
+	require.Equal(t, exts.Claims, parsed.Claims)
+	require.Equal(t, exts.PolicyHints, parsed.PolicyHints)
+	require.Equal(t, pkt.Payload, parsed.PKT.Payload)
+}
+
+func TestCompressedPKT(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+
+	exts := &Extensions{PKT: pkt, Compress: true}
+	certExts, err := exts.Encode()
+	require.NoError(t, err)
+	require.Equal(t, "2", certExts[ExtSchema.Name])
+	require.NotContains(t, certExts, ExtPKT.Name)
+	require.Less(t, len(certExts[ExtPKTCompressed.Name]), len(pktCom))
+
+	parsed, err := ParseExtensions(certExts)
+	require.NoError(t, err)
+	require.True(t, parsed.Compress)
+	require.Equal(t, 2, parsed.SchemaVersion)
+	parsedCom, err := parsed.PKT.Compact()
+	require.NoError(t, err)
+	require.Equal(t, pktCom, parsedCom)
+}
+
+func TestChunkedPKT(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+
+	for _, compress := range []bool{false, true} {
+		exts := &Extensions{PKT: pkt, Compress: compress, ChunkSize: 200}
+		certExts, err := exts.Encode()
+		require.NoError(t, err)
+		require.Equal(t, "3", certExts[ExtSchema.Name])
+		require.NotContains(t, certExts, ExtPKT.Name)
+		require.NotContains(t, certExts, ExtPKTCompressed.Name)
+		require.Contains(t, certExts, "openpubkey-pkt-1")
+		for name, value := range certExts {
+			if strings.HasPrefix(name, ExtPKTChunk.Name) && name != ExtPKTChunked.Name {
+				require.LessOrEqual(t, len(value), 200)
+			}
+		}
+
+		parsed, err := ParseExtensions(certExts)
+		require.NoError(t, err)
+		require.Equal(t, compress, parsed.Compress)
+		require.Equal(t, 200, parsed.ChunkSize)
+		parsedCom, err := parsed.PKT.Compact()
+		require.NoError(t, err)
+		require.Equal(t, pktCom, parsedCom)
+	}
+}
+
+func TestSshCertExtensions(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	exts, err := cert.Extensions()
+	require.NoError(t, err)
+	require.Equal(t, "arthur.aardvark@example.com", exts.Claims["email"])
+	require.Contains(t, exts.Claims, "iss")
+	require.Contains(t, cert.SshCert.Extensions, "permit-pty")
+}
+
+func TestParseExtensionsErrors(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	compressedBytes, err := compressPKT(pktCom)
+	require.NoError(t, err)
+	compressed := string(compressedBytes)
+	bomb, err := compressPKT(make([]byte, 1<<20))
+	require.NoError(t, err)
+	chunks := map[string]string{}
+	splitChunks(chunks, EncodingCompactPKT, pktCom, len(pktCom)/3+1)
+	chunks[ExtSchema.Name] = "3"
+	// withChunks returns the chunked PK Token with the extensions in set
+	// changed and those in remove removed
+	withChunks := func(set map[string]string, remove ...string) map[string]string {
+		certExts := map[string]string{}
+		for name, value := range chunks {
+			certExts[name] = value
+		}
+		for name, value := range set {
+			certExts[name] = value
+		}
+		for _, name := range remove {
+			delete(certExts, name)
+		}
+		return certExts
+	}
+
+	testCases := []struct {
+		name     string
+		certExts map[string]string
+		expError string
+	}{
+		{name: "missing pkt", certExts: map[string]string{"permit-pty": ""},
+			expError: "cert is missing required openpubkey-pkt extension"},
+		{name: "malformed pkt", certExts: map[string]string{"openpubkey-pkt": "abc"},
+			expError: "openpubkey-pkt extension in cert failed deserialization"},
+		{name: "newer schema", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-schema": "4"},
+			expError: "only versions up to 3 are supported"},
+		{name: "invalid schema", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-schema": "v1"},
+			expError: "openpubkey-schema extension is not a valid version"},
+		{name: "unknown extension", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-foo": ""},
+			expError: "unknown extension openpubkey-foo"},
+		{name: "claims not an object", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-claims": `["a"]`},
+			expError: "openpubkey-claims extension is not a JSON object"},
+		{name: "claim not in pkt", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-claims": `{"groups":["admin"]}`},
+			expError: "claim groups which is not in the PK Token"},
+		{name: "claim mismatch", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-claims": `{"email":"eve@example.com"}`},
+			expError: "claim email does not match the PK Token"},
+		{name: "compressed pkt with old schema", certExts: map[string]string{"openpubkey-pkt-compressed": compressed, "openpubkey-schema": "1"},
+			expError: "extension openpubkey-pkt-compressed requires schema version 2"},
+		{name: "compressed and uncompressed pkt", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-pkt-compressed": compressed, "openpubkey-schema": "2"},
+			expError: "cert has both"},
+		{name: "unknown compression", certExts: map[string]string{"openpubkey-pkt-compressed": "\x02" + compressed[1:], "openpubkey-schema": "2"},
+			expError: "unsupported compression algorithm"},
+		{name: "compressed pkt too large", certExts: map[string]string{"openpubkey-pkt-compressed": string(bomb), "openpubkey-schema": "2"},
+			expError: "PK Token exceeds maximum size"},
+		{name: "chunks without header", certExts: map[string]string{"openpubkey-pkt-0": string(pktCom), "openpubkey-schema": "3"},
+			expError: "openpubkey-pkt- extensions without openpubkey-pkt-chunked"},
+		{name: "chunk number with leading zero", certExts: withChunks(map[string]string{"openpubkey-pkt-01": ""}),
+			expError: "unknown extension openpubkey-pkt-01"},
+		{name: "extra chunk", certExts: withChunks(map[string]string{"openpubkey-pkt-9": ""}),
+			expError: "expected 3 chunks, cert has 4"},
+		{name: "missing chunk", certExts: withChunks(map[string]string{"openpubkey-pkt-3": ""}, "openpubkey-pkt-1"),
+			expError: "chunk 1 is missing"},
+		{name: "swapped chunks", certExts: withChunks(map[string]string{"openpubkey-pkt-0": chunks["openpubkey-pkt-1"], "openpubkey-pkt-1": chunks["openpubkey-pkt-0"]}),
+			expError: "don't match the digest"},
+		{name: "unknown chunk encoding", certExts: withChunks(map[string]string{"openpubkey-pkt-chunked": "json" + chunks["openpubkey-pkt-chunked"][len("compact-pkt"):]}),
+			expError: "unsupported encoding json"},
+		{name: "chunks and pkt", certExts: withChunks(map[string]string{"openpubkey-pkt": string(pktCom)}),
+			expError: "cert has both openpubkey-pkt-chunked and an unchunked PK Token"},
+		{name: "chunks with old schema", certExts: withChunks(map[string]string{"openpubkey-schema": "2"}),
+			expError: "requires schema version 3"},
+		{name: "empty policy hint", certExts: map[string]string{"openpubkey-pkt": string(pktCom), "openpubkey-policy-hints": "web,,db"},
+			expError: "openpubkey-policy-hints extension is invalid"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseExtensions(tc.certExts)
+			require.ErrorContains(t, err, tc.expError)
+		})
+	}
+}
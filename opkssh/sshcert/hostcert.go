@@ -0,0 +1,112 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostCertChecker lets SSH clients trust hosts presenting a certificate
+// created by NewHost. A host is trusted if the PK Token in its certificate
+// is accepted by the Verifier and CheckIdentity, its certificate is signed
+// by the key in the PK Token and lists the hostname the client connected to.
+type HostCertChecker struct {
+	// Verifier verifies the PK Token in the certificate, configure it with
+	// the OpenID Providers hosts get their identities from
+	Verifier *verifier.Verifier
+	// CheckIdentity, if set, must accept the verified PK Token, e.g. by
+	// checking it has the workload identity expected of hostname. Without it
+	// any identity the Verifier accepts is trusted for every hostname in its
+	// certificate.
+	CheckIdentity func(hostname string, pkt *pktoken.PKToken) error
+}
+
+// CheckHostCert returns the verified PK Token if key is a host certificate
+// that can be trusted for hostname
+func (c *HostCertChecker) CheckHostCert(ctx context.Context, hostname string, key ssh.PublicKey) (*pktoken.PKToken, error) {
+	sshCert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("host key is not an SSH certificate")
+	}
+	if sshCert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("SSH certificate is not a host certificate")
+	}
+	if !slices.Contains(sshCert.ValidPrincipals, hostname) {
+		return nil, fmt.Errorf("host certificate is not valid for %s", hostname)
+	}
+	// There is no CA, the certificate is signed by its own key
+	if !bytes.Equal(sshCert.SignatureKey.Marshal(), sshCert.Key.Marshal()) {
+		return nil, fmt.Errorf("host certificate is not signed by its own key")
+	}
+	cert := &SshCertSmuggler{SshCert: sshCert, ClockSkew: c.Verifier.ClockSkew()}
+	if err := cert.VerifyCaSig(sshCert.SignatureKey); err != nil {
+		return nil, fmt.Errorf("invalid host certificate signature: %w", err)
+	}
+	if err := cert.CheckValidity(time.Now(), 0); err != nil {
+		return nil, err
+	}
+
+	pkt, err := cert.GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verifier.VerifyPKToken(ctx, pkt); err != nil {
+		return nil, fmt.Errorf("failed to verify PK token: %w", err)
+	}
+	if err := cert.checkCertKey(pkt); err != nil {
+		return nil, err
+	}
+	if c.CheckIdentity != nil {
+		if err := c.CheckIdentity(hostname, pkt); err != nil {
+			return nil, err
+		}
+	}
+	return pkt, nil
+}
+
+// HostKeyCallback returns a callback for ssh.ClientConfig that trusts hosts
+// with CheckHostCert
+func (c *HostCertChecker) HostKeyCallback(ctx context.Context) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// The hostname is passed with the port dialed
+		if host, _, err := net.SplitHostPort(hostname); err == nil {
+			hostname = host
+		}
+		_, err := c.CheckHostCert(ctx, hostname, key)
+		return err
+	}
+}
+
+// KnownHostsLine returns an @cert-authority line for OpenSSH's known_hosts
+// trusting the key that signed the host certificate for hostPatterns. Add it
+// once the certificate has passed CheckHostCert so that OpenSSH clients,
+// which can't verify PK Tokens, trust the host as well. The key signs only
+// that host's certificate, so the line doesn't trust any other hosts.
+func KnownHostsLine(hostPatterns []string, cert *ssh.Certificate) string {
+	return "@cert-authority " + strings.TrimSpace(knownhosts.Line(hostPatterns, cert.SignatureKey))
+}
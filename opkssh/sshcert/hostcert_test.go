@@ -0,0 +1,111 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostCert(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	require.NoError(t, err)
+	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+
+	cert, err := NewHost(pkt, []string{"runner.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(ssh.HostCert), cert.SshCert.CertType)
+	require.NotContains(t, cert.SshCert.Extensions, "permit-pty")
+	hostCert, err := cert.SignCert(signerMas)
+	require.NoError(t, err)
+
+	ver, err := verifier.New(op)
+	require.NoError(t, err)
+	checker := &HostCertChecker{Verifier: ver}
+
+	verifiedPkt, err := checker.CheckHostCert(ctx, "runner.example.com", hostCert)
+	require.NoError(t, err)
+	require.Equal(t, pkt.OpToken, verifiedPkt.OpToken)
+
+	// ssh.ClientConfig passes the hostname with the port
+	callback := checker.HostKeyCallback(ctx)
+	require.NoError(t, callback("runner.example.com:22", &net.TCPAddr{}, hostCert))
+	require.ErrorContains(t, callback("other.example.com:22", &net.TCPAddr{}, hostCert), "not valid for other.example.com")
+	require.ErrorContains(t, callback("runner.example.com:22", &net.TCPAddr{}, hostCert.Key), "not an SSH certificate")
+
+	checker.CheckIdentity = func(hostname string, pkt *pktoken.PKToken) error {
+		return fmt.Errorf("unexpected identity for %s", hostname)
+	}
+	_, err = checker.CheckHostCert(ctx, "runner.example.com", hostCert)
+	require.ErrorContains(t, err, "unexpected identity for runner.example.com")
+	checker.CheckIdentity = nil
+
+	// User certificates aren't host certificates
+	userCert, err := New(pkt, []string{"runner.example.com"})
+	require.NoError(t, err)
+	signedUserCert, err := userCert.SignCert(signerMas)
+	require.NoError(t, err)
+	_, err = checker.CheckHostCert(ctx, "runner.example.com", signedUserCert)
+	require.ErrorContains(t, err, "not a host certificate")
+
+	// A host certificate signed by a key other than its own
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	otherSshSigner, err := ssh.NewSignerFromSigner(otherSigner)
+	require.NoError(t, err)
+	otherMas, err := ssh.NewSignerWithAlgorithms(otherSshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+	forged, err := NewHost(pkt, []string{"runner.example.com"})
+	require.NoError(t, err)
+	forgedCert, err := forged.SignCert(otherMas)
+	require.NoError(t, err)
+	_, err = checker.CheckHostCert(ctx, "runner.example.com", forgedCert)
+	require.ErrorContains(t, err, "not signed by its own key")
+
+	line := KnownHostsLine([]string{"runner.example.com"}, hostCert)
+	require.True(t, strings.HasPrefix(line, "@cert-authority runner.example.com ecdsa-sha2-nistp256 "), line)
+	marker, hosts, pubkey, _, _, err := ssh.ParseKnownHosts([]byte(line))
+	require.NoError(t, err)
+	require.Equal(t, "cert-authority", marker)
+	require.Equal(t, []string{"runner.example.com"}, hosts)
+	require.Equal(t, hostCert.SignatureKey.Marshal(), pubkey.Marshal())
+}
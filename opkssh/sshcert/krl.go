@@ -0,0 +1,154 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"github.com/openpubkey/openpubkey/verifier"
+	"golang.org/x/crypto/ssh"
+)
+
+// KRL wire format constants, see PROTOCOL.krl in OpenSSH
+const (
+	krlMagic         uint64 = 0x5353484b524c0a00
+	krlFormatVersion uint32 = 1
+
+	krlSectionCertificates      byte = 1
+	krlSectionFingerprintSHA256 byte = 5
+
+	krlSectionCertSerialList byte = 0x20
+	krlSectionCertKeyID      byte = 0x23
+)
+
+// KRL is an OpenSSH Key Revocation List, the format sshd reads from the
+// file named by RevokedKeys in sshd_config
+type KRL struct {
+	// Version should increase every time the KRL is regenerated
+	Version   uint64
+	Generated time.Time
+	Comment   string
+
+	// CA is the key of the CA whose certificates Serials and KeyIDs revoke,
+	// e.g. of opkssh ca. If nil they revoke certificates of any CA.
+	CA      ssh.PublicKey
+	Serials []uint64
+	KeyIDs  []string
+	// Keys are revoked whether they are used directly or certified. opkssh
+	// login generates a key per certificate, so this revokes a single one.
+	Keys []ssh.PublicKey
+}
+
+// NewKRL returns a KRL revoking the certificates ca issued to the subjects
+// revoked by list. opkssh ca uses the subject as the key ID. Entries that
+// revoke a single PK Token or ID Token, or a subject only for some token
+// IDs, can't be expressed in a KRL and are returned as skipped.
+func NewKRL(ca ssh.PublicKey, list *verifier.RevocationList) (krl *KRL, skipped []verifier.RevocationEntry) {
+	krl = &KRL{CA: ca}
+	for _, entry := range list.Revoked {
+		if entry.Hash != "" || entry.Issuer == "" || entry.Subject == "" || entry.JTI != "" {
+			skipped = append(skipped, entry)
+			continue
+		}
+		krl.KeyIDs = append(krl.KeyIDs, entry.Subject)
+	}
+	return krl, skipped
+}
+
+// Marshal encodes the KRL in the binary format sshd and ssh-keygen -Q read
+func (k *KRL) Marshal() []byte {
+	var generated uint64
+	if !k.Generated.IsZero() {
+		generated = uint64(k.Generated.Unix())
+	}
+	out := ssh.Marshal(struct {
+		Magic         uint64
+		FormatVersion uint32
+		Version       uint64
+		Generated     uint64
+		Flags         uint64
+		Reserved      string
+		Comment       string
+	}{
+		Magic:         krlMagic,
+		FormatVersion: krlFormatVersion,
+		Version:       k.Version,
+		Generated:     generated,
+		Comment:       k.Comment,
+	})
+
+	if len(k.Serials) > 0 || len(k.KeyIDs) > 0 {
+		var caBlob []byte
+		if k.CA != nil {
+			caBlob = k.CA.Marshal()
+		}
+		section := ssh.Marshal(struct {
+			CA       []byte
+			Reserved string
+		}{CA: caBlob})
+		if len(k.Serials) > 0 {
+			serials := slices.Clone(k.Serials)
+			slices.Sort(serials)
+			var data []byte
+			for _, serial := range slices.Compact(serials) {
+				data = binary.BigEndian.AppendUint64(data, serial)
+			}
+			section = appendKRLSection(section, krlSectionCertSerialList, data)
+		}
+		if len(k.KeyIDs) > 0 {
+			keyIDs := slices.Clone(k.KeyIDs)
+			slices.Sort(keyIDs)
+			var data []byte
+			for _, keyID := range slices.Compact(keyIDs) {
+				data = appendKRLString(data, []byte(keyID))
+			}
+			section = appendKRLSection(section, krlSectionCertKeyID, data)
+		}
+		out = appendKRLSection(out, krlSectionCertificates, section)
+	}
+
+	if len(k.Keys) > 0 {
+		// sshd requires the fingerprints in ascending order
+		var fingerprints [][]byte
+		for _, key := range k.Keys {
+			fingerprint := sha256.Sum256(key.Marshal())
+			fingerprints = append(fingerprints, fingerprint[:])
+		}
+		slices.SortFunc(fingerprints, bytes.Compare)
+		var data []byte
+		for _, fingerprint := range slices.CompactFunc(fingerprints, bytes.Equal) {
+			data = appendKRLString(data, fingerprint)
+		}
+		out = appendKRLSection(out, krlSectionFingerprintSHA256, data)
+	}
+	return out
+}
+
+// appendKRLSection appends a section, its type followed by its data as an
+// SSH string
+func appendKRLSection(out []byte, sectionType byte, data []byte) []byte {
+	return appendKRLString(append(out, sectionType), data)
+}
+
+func appendKRLString(out []byte, s []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(s)))
+	return append(out, s...)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type krlSection struct {
+	Type byte
+	Data []byte
+}
+
+// readKRLSections checks the KRL header and splits the rest into sections
+func readKRLSections(t *testing.T, data []byte) []krlSection {
+	var header struct {
+		Magic         uint64
+		FormatVersion uint32
+		Version       uint64
+		Generated     uint64
+		Flags         uint64
+		Reserved      string
+		Comment       string
+		Rest          []byte `ssh:"rest"`
+	}
+	require.NoError(t, ssh.Unmarshal(data, &header))
+	require.Equal(t, krlMagic, header.Magic)
+	require.Equal(t, krlFormatVersion, header.FormatVersion)
+	return splitKRLSections(t, header.Rest)
+}
+
+func splitKRLSections(t *testing.T, data []byte) []krlSection {
+	var sections []krlSection
+	for rest := data; len(rest) > 0; {
+		var section struct {
+			Type byte
+			Data []byte
+			Rest []byte `ssh:"rest"`
+		}
+		require.NoError(t, ssh.Unmarshal(rest, &section))
+		sections = append(sections, krlSection{Type: section.Type, Data: section.Data})
+		rest = section.Rest
+	}
+	return sections
+}
+
+func readKRLStrings(t *testing.T, data []byte) []string {
+	var strs []string
+	for len(data) > 0 {
+		var s struct {
+			S    string
+			Rest []byte `ssh:"rest"`
+		}
+		require.NoError(t, ssh.Unmarshal(data, &s))
+		strs = append(strs, s.S)
+		data = s.Rest
+	}
+	return strs
+}
+
+func TestKRL(t *testing.T) {
+	t.Parallel()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewPublicKey(&caKey.PublicKey)
+	require.NoError(t, err)
+	userKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	user, err := ssh.NewPublicKey(&userKey.PublicKey)
+	require.NoError(t, err)
+
+	list := &verifier.RevocationList{Revoked: []verifier.RevocationEntry{
+		{Issuer: "https://accounts.google.com", Subject: "bob"},
+		{Issuer: "https://accounts.google.com", Subject: "alice"},
+		{Issuer: "https://accounts.google.com", Subject: "alice"},
+		{Issuer: "https://accounts.google.com", Subject: "carol", JTI: "1234"},
+		{Issuer: "https://accounts.google.com", JTI: "5678"},
+		{Hash: "abcd"},
+	}}
+	krl, skipped := NewKRL(ca, list)
+	require.Equal(t, list.Revoked[3:], skipped)
+	krl.Serials = []uint64{7, 3, 7}
+	krl.Keys = []ssh.PublicKey{user}
+	krl.Version = 2
+	krl.Generated = time.Now()
+	krl.Comment = "test"
+
+	sections := readKRLSections(t, krl.Marshal())
+	require.Len(t, sections, 2)
+
+	require.Equal(t, krlSectionCertificates, sections[0].Type)
+	var certs struct {
+		CA       []byte
+		Reserved string
+		Rest     []byte `ssh:"rest"`
+	}
+	require.NoError(t, ssh.Unmarshal(sections[0].Data, &certs))
+	require.Equal(t, ca.Marshal(), certs.CA)
+	certSections := splitKRLSections(t, certs.Rest)
+	require.Len(t, certSections, 2)
+	require.Equal(t, krlSectionCertSerialList, certSections[0].Type)
+	require.Equal(t, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 3), 7), certSections[0].Data)
+	require.Equal(t, krlSectionCertKeyID, certSections[1].Type)
+	require.Equal(t, []string{"alice", "bob"}, readKRLStrings(t, certSections[1].Data))
+
+	require.Equal(t, krlSectionFingerprintSHA256, sections[1].Type)
+	fingerprint := sha256.Sum256(user.Marshal())
+	require.Equal(t, []string{string(fingerprint[:])}, readKRLStrings(t, sections[1].Data))
+
+	// Without a CA the certificate section applies to any CA
+	krl, _ = NewKRL(nil, list)
+	sections = readKRLSections(t, krl.Marshal())
+	require.Len(t, sections, 1)
+	require.NoError(t, ssh.Unmarshal(sections[0].Data, &certs))
+	require.Empty(t, certs.CA)
+
+	// An empty KRL revokes nothing
+	require.Empty(t, readKRLSections(t, (&KRL{}).Marshal()))
+}
@@ -0,0 +1,110 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The standard extensions of OpenSSH user certificates, see
+// PROTOCOL.certkeys in the OpenSSH sources
+const (
+	ExtPermitX11Forwarding   = "permit-X11-forwarding"
+	ExtPermitAgentForwarding = "permit-agent-forwarding"
+	ExtPermitPortForwarding  = "permit-port-forwarding"
+	ExtPermitPTY             = "permit-pty"
+	ExtPermitUserRC          = "permit-user-rc"
+	ExtNoTouchRequired       = "no-touch-required"
+)
+
+// DefaultUserExtensions are the permissions New grants, the same as
+// ssh-keygen does by default
+var DefaultUserExtensions = []string{
+	ExtPermitX11Forwarding,
+	ExtPermitAgentForwarding,
+	ExtPermitPortForwarding,
+	ExtPermitPTY,
+	ExtPermitUserRC,
+}
+
+// restrictOptions maps each standard extension to the authorized_keys
+// option that withholds the permission it grants. sshd only grants
+// no-touch-required if authorized_keys does too, so it has none.
+var restrictOptions = map[string]string{
+	ExtPermitX11Forwarding:   "no-X11-forwarding",
+	ExtPermitAgentForwarding: "no-agent-forwarding",
+	ExtPermitPortForwarding:  "no-port-forwarding",
+	ExtPermitPTY:             "no-pty",
+	ExtPermitUserRC:          "no-user-rc",
+	ExtNoTouchRequired:       "",
+}
+
+// RestrictOption returns the authorized_keys option with which sshd
+// ignores the standard extension ext in a certificate, if there is one
+func RestrictOption(ext string) (string, bool) {
+	option, ok := restrictOptions[ext]
+	return option, ok && option != ""
+}
+
+// SetExtension adds the extension name with value to a user cert. Standard
+// extensions have no value. Custom extensions must be named in the
+// name@domain form and can't use ExtensionPrefix, which is reserved for
+// the extensions OpenPubkey sets itself.
+func (s *SshCertSmuggler) SetExtension(name string, value string) error {
+	if err := s.checkExtensionName(name); err != nil {
+		return err
+	}
+	if _, ok := restrictOptions[name]; ok && value != "" {
+		return fmt.Errorf("standard extension %s can't have a value", name)
+	}
+	if s.SshCert.Permissions.Extensions == nil {
+		s.SshCert.Permissions.Extensions = map[string]string{}
+	}
+	s.SshCert.Permissions.Extensions[name] = value
+	return nil
+}
+
+// RemoveExtension removes the extension name from a user cert, e.g. one
+// of DefaultUserExtensions to withhold that permission
+func (s *SshCertSmuggler) RemoveExtension(name string) error {
+	if err := s.checkExtensionName(name); err != nil {
+		return err
+	}
+	delete(s.SshCert.Permissions.Extensions, name)
+	return nil
+}
+
+func (s *SshCertSmuggler) checkExtensionName(name string) error {
+	if s.SshCert.CertType != ssh.UserCert {
+		return fmt.Errorf("only user certificates have extensions")
+	}
+	if strings.HasPrefix(name, ExtensionPrefix) {
+		return fmt.Errorf("extension %s is reserved for OpenPubkey", name)
+	}
+	if _, ok := restrictOptions[name]; !ok && !isCustomExtension(name) {
+		return fmt.Errorf("unknown extension %s, custom extensions must be named name@domain", name)
+	}
+	return nil
+}
+
+func isCustomExtension(name string) bool {
+	local, domain, ok := strings.Cut(name, "@")
+	return ok && local != "" && domain != "" && !strings.ContainsAny(name, " \t\n,")
+}
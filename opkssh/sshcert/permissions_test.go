@@ -0,0 +1,58 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtensionPermissions(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	for _, ext := range DefaultUserExtensions {
+		require.Contains(t, cert.SshCert.Extensions, ext)
+	}
+
+	require.NoError(t, cert.RemoveExtension(ExtPermitPTY))
+	require.NotContains(t, cert.SshCert.Extensions, ExtPermitPTY)
+	require.NoError(t, cert.SetExtension(ExtNoTouchRequired, ""))
+	require.NoError(t, cert.SetExtension("login@example.com", "value"))
+	require.Equal(t, "value", cert.SshCert.Extensions["login@example.com"])
+
+	require.ErrorContains(t, cert.SetExtension(ExtPermitPTY, "yes"), "can't have a value")
+	require.ErrorContains(t, cert.SetExtension("permit-everything", ""), "unknown extension")
+	require.ErrorContains(t, cert.SetExtension("a,b@example.com", ""), "unknown extension")
+	require.ErrorContains(t, cert.RemoveExtension("openpubkey-pkt"), "reserved")
+	require.Contains(t, cert.SshCert.Extensions, "openpubkey-pkt")
+
+	hostCert, err := NewHost(pkt, []string{"example.com"})
+	require.NoError(t, err)
+	require.ErrorContains(t, hostCert.SetExtension(ExtPermitPTY, ""), "only user certificates")
+
+	option, ok := RestrictOption(ExtPermitPTY)
+	require.True(t, ok)
+	require.Equal(t, "no-pty", option)
+	_, ok = RestrictOption(ExtNoTouchRequired)
+	require.False(t, ok)
+	_, ok = RestrictOption("login@example.com")
+	require.False(t, ok)
+}
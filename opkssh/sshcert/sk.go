@@ -0,0 +1,171 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"golang.org/x/crypto/ssh"
+)
+
+// SKClaim is the CIC claim binding a FIDO security key to the PK Token. It
+// holds the base64 encoded SSH wire format of the security key's public
+// key, which includes its application string.
+const SKClaim = "ssh_sk"
+
+// DefaultSKApplication is the application string ssh-keygen uses for
+// security keys
+const DefaultSKApplication = "ssh:"
+
+// IsSKKey returns true if key is a FIDO security key
+func IsSKKey(key ssh.PublicKey) bool {
+	switch key.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// NewSKPublicKey returns the SSH public key of a FIDO security key, an
+// sk-ecdsa-sha2-nistp256@openssh.com key for a P-256 ECDSA key or an
+// sk-ssh-ed25519@openssh.com key for an Ed25519 key, registered for
+// application
+func NewSKPublicKey(pub crypto.PublicKey, application string) (ssh.PublicKey, error) {
+	var wire []byte
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("security keys only support ECDSA on P-256")
+		}
+		// The SSH wire format is the uncompressed point, see RFC 5656
+		// section 3.1
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		keyBytes := ecdhKey.Bytes()
+		wire = ssh.Marshal(struct {
+			Name        string
+			ID          string
+			Key         []byte
+			Application string
+		}{ssh.KeyAlgoSKECDSA256, "nistp256", keyBytes, application})
+	case ed25519.PublicKey:
+		wire = ssh.Marshal(struct {
+			Name        string
+			KeyBytes    []byte
+			Application string
+		}{ssh.KeyAlgoSKED25519, []byte(pub), application})
+	default:
+		return nil, fmt.Errorf("unsupported security key type %T", pub)
+	}
+	return ssh.ParsePublicKey(wire)
+}
+
+// SKAuthOpts binds skKey to the PK Token, pass it to client.OpkClient.Auth
+// before creating a certificate with NewSK
+func SKAuthOpts(skKey ssh.PublicKey) client.AuthOpts {
+	return client.WithExtraClaim(SKClaim, base64.StdEncoding.EncodeToString(skKey.Marshal()))
+}
+
+// NewSK returns a user certificate for the FIDO security key skKey, which
+// must be bound to the PK Token with SKAuthOpts. Security keys can't sign the
+// CIC, so the key in the PK Token only signs the certificate, as a single
+// use CA, and the user authenticates with the security key. Its private key
+// never leaves the hardware and the key in the PK Token can be discarded
+// once the certificate is signed.
+func NewSK(pkt *pktoken.PKToken, skKey ssh.PublicKey, principals []string) (*SshCertSmuggler, error) {
+	if !IsSKKey(skKey) {
+		return nil, fmt.Errorf("%s is not a security key", skKey.Type())
+	}
+	bound, err := skKeyFromPKT(pkt)
+	if err != nil {
+		return nil, err
+	}
+	if bound == nil || !bytes.Equal(bound.Marshal(), skKey.Marshal()) {
+		return nil, fmt.Errorf("security key is not bound to the PK Token")
+	}
+	cert, err := New(pkt, principals)
+	if err != nil {
+		return nil, err
+	}
+	cert.SshCert.Key = skKey
+	return cert, nil
+}
+
+// skKeyFromPKT returns the security key bound to the PK Token or nil if it
+// has none
+func skKeyFromPKT(pkt *pktoken.PKToken) (ssh.PublicKey, error) {
+	claim, ok := pkt.Cic.ProtectedHeaders().Get(SKClaim)
+	if !ok {
+		return nil, nil
+	}
+	claimStr, ok := claim.(string)
+	if !ok {
+		return nil, fmt.Errorf("malformed %s claim", SKClaim)
+	}
+	wire, err := base64.StdEncoding.DecodeString(claimStr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s claim: %w", SKClaim, err)
+	}
+	skKey, err := ssh.ParsePublicKey(wire)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s claim: %w", SKClaim, err)
+	}
+	if !IsSKKey(skKey) {
+		return nil, fmt.Errorf("%s claim holds a %s key, not a security key", SKClaim, skKey.Type())
+	}
+	return skKey, nil
+}
+
+// checkSKCertKey returns an error unless the cert is for the security key
+// bound to the PK Token and signed by the key in the PK Token, see NewSK
+func (s *SshCertSmuggler) checkSKCertKey(pkt *pktoken.PKToken) error {
+	skKey, err := skKeyFromPKT(pkt)
+	if err != nil {
+		return err
+	}
+	if skKey == nil || !bytes.Equal(skKey.Marshal(), s.SshCert.Key.Marshal()) {
+		return fmt.Errorf("security key in certificate is not bound to the PK Token")
+	}
+
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return err
+	}
+	signatureKey, ok := s.SshCert.SignatureKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported certificate signature key type %s", s.SshCert.SignatureKey.Type())
+	}
+	jwkSignatureKey, err := jwk.FromRaw(signatureKey.CryptoPublicKey())
+	if err != nil {
+		return err
+	}
+	if !jwk.Equal(jwkSignatureKey, cic.PublicKey()) {
+		return fmt.Errorf("certificate for a security key is not signed by the public key 'upk' in the PK Token")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sshcert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// skSign signs data the way a FIDO security key signs for SSH, see
+// PROTOCOL.u2f in OpenSSH
+func skSign(t *testing.T, sk *ecdsa.PrivateKey, application string, data []byte) *ssh.Signature {
+	const flags = 0x01 // user present
+	const counter = 7
+	appDigest := sha256.Sum256([]byte(application))
+	dataDigest := sha256.Sum256(data)
+	message := ssh.Marshal(struct {
+		ApplicationDigest []byte `ssh:"rest"`
+		Flags             byte
+		Counter           uint32
+		MessageDigest     []byte `ssh:"rest"`
+	}{appDigest[:], flags, counter, dataDigest[:]})
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, digest[:])
+	require.NoError(t, err)
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKECDSA256,
+		Blob:   ssh.Marshal(struct{ R, S *big.Int }{r, s}),
+		Rest: ssh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{flags, counter}),
+	}
+}
+
+func TestNewSKPublicKey(t *testing.T) {
+	t.Parallel()
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skKey, err := NewSKPublicKey(&sk.PublicKey, DefaultSKApplication)
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoSKECDSA256, skKey.Type())
+	require.True(t, IsSKKey(skKey))
+	// The application is part of the key, a signature for another
+	// application doesn't verify
+	msg := []byte("session")
+	require.NoError(t, skKey.Verify(msg, skSign(t, sk, DefaultSKApplication, msg)))
+	require.Error(t, skKey.Verify(msg, skSign(t, sk, "ssh:other", msg)))
+	otherApp, err := NewSKPublicKey(&sk.PublicKey, "ssh:other")
+	require.NoError(t, err)
+	require.NotEqual(t, skKey.Marshal(), otherApp.Marshal())
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKey, err := NewSKPublicKey(edPub, DefaultSKApplication)
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoSKED25519, edKey.Type())
+	require.Equal(t, edPub, edKey.(ssh.CryptoPublicKey).CryptoPublicKey())
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = NewSKPublicKey(&p384.PublicKey, DefaultSKApplication)
+	require.Error(t, err)
+
+	sshKey, err := ssh.NewPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	require.False(t, IsSKKey(sshKey))
+}
+
+func TestSKCert(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skKey, err := NewSKPublicKey(&sk.PublicKey, DefaultSKApplication)
+	require.NoError(t, err)
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+
+	// The security key has to be bound to the PK Token
+	unboundPkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	_, err = NewSK(unboundPkt, skKey, []string{"guest"})
+	require.ErrorContains(t, err, "not bound")
+
+	pkt, err := opkClient.Auth(ctx, SKAuthOpts(skKey))
+	require.NoError(t, err)
+	cert, err := NewSK(pkt, skKey, []string{"guest"})
+	require.NoError(t, err)
+	require.Equal(t, skKey.Marshal(), cert.SshCert.Key.Marshal())
+
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	require.NoError(t, err)
+	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+	sshCert, err := cert.SignCert(signerMas)
+	require.NoError(t, err)
+	require.NoError(t, (&ssh.CertChecker{}).CheckCert("guest", sshCert))
+
+	// Round trip through authorized_keys, as sshd passes it to verify
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(ssh.MarshalAuthorizedKey(sshCert))
+	require.NoError(t, err)
+	parsedCert := &SshCertSmuggler{SshCert: parsed.(*ssh.Certificate)}
+	require.Equal(t, ssh.CertAlgoSKECDSA256v01, parsedCert.SshCert.Type())
+	require.NoError(t, parsedCert.checkCertKey(pkt))
+
+	// A certificate for another security key
+	otherSK, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherSKKey, err := NewSKPublicKey(&otherSK.PublicKey, DefaultSKApplication)
+	require.NoError(t, err)
+	forged := &SshCertSmuggler{SshCert: &ssh.Certificate{Key: otherSKKey, SignatureKey: sshCert.SignatureKey}}
+	require.ErrorContains(t, forged.checkCertKey(pkt), "not bound")
+
+	// A certificate for the security key not signed by the key in the PK
+	// Token
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	otherSignatureKey, err := ssh.NewPublicKey(otherSigner.Public())
+	require.NoError(t, err)
+	forged = &SshCertSmuggler{SshCert: &ssh.Certificate{Key: skKey, SignatureKey: otherSignatureKey}}
+	require.ErrorContains(t, forged.checkCertKey(pkt), "not signed by")
+}
@@ -17,14 +17,20 @@
 package sshcert
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/clockskew"
+	"github.com/openpubkey/openpubkey/discover"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/verifier"
@@ -33,14 +39,50 @@ import (
 
 type SshCertSmuggler struct {
 	SshCert *ssh.Certificate
+	// ClockSkew is how far apart the OP's clock and ours may be when
+	// VerifySshPktCert checks whether the ID Token has expired
+	ClockSkew clockskew.Policy
+	// PublicKeyFinder, if set, is how VerifySshPktCert finds the OP's
+	// signing keys, e.g. one caching them on disk between runs of verify.
+	// The OP's discovery document and JWKS are only fetched through it. If
+	// nil, discover.DefaultPubkeyFinder is used.
+	PublicKeyFinder *discover.PublicKeyFinder
 }
 
+// New returns a user certificate for the key in the PK Token, allowing it to
+// log in as principals
 func New(pkt *pktoken.PKToken, principals []string) (*SshCertSmuggler, error) {
+	return newCert(pkt, ssh.UserCert, principals)
+}
+
+// NewHost returns a host certificate for the key in the PK Token, e.g. that
+// of a workload with an OIDC identity, valid for hostnames. SSH clients check
+// it with a HostCertChecker.
+func NewHost(pkt *pktoken.PKToken, hostnames []string) (*SshCertSmuggler, error) {
+	return newCert(pkt, ssh.HostCert, hostnames)
+}
+
+// Renew returns a user certificate like New for a PK Token from a fresh
+// login with existingKey, the key of an earlier certificate. Keeping the key
+// doesn't disturb ssh-agent or multiplexed connections that hold it.
+func Renew(pkt *pktoken.PKToken, existingKey ssh.PublicKey) (*SshCertSmuggler, error) {
+	cert, err := New(pkt, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cert.SshCert.Key.Marshal(), existingKey.Marshal()) {
+		return nil, fmt.Errorf("PK Token is not for the existing %s key", existingKey.Type())
+	}
+	return cert, nil
+}
 
+func newCert(pkt *pktoken.PKToken, certType uint32, principals []string) (*SshCertSmuggler, error) {
 	// TODO: assumes email exists in ID Token,
 	// this will break for OPs like Azure that do not have email as a claim
 	var claims struct {
-		Email string `json:"email"`
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
 	}
 	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
 		return nil, err
@@ -50,32 +92,82 @@ func New(pkt *pktoken.PKToken, principals []string) (*SshCertSmuggler, error) {
 	if err != nil {
 		return nil, err
 	}
-	pktCom, err := pkt.Compact()
+	opkExts := &Extensions{
+		PKT:    pkt,
+		Claims: map[string]any{"iss": claims.Issuer, "sub": claims.Subject},
+	}
+	if claims.Email != "" {
+		opkExts.Claims["email"] = claims.Email
+	}
+	extensions, err := opkExts.Encode()
 	if err != nil {
 		return nil, err
 	}
+	// Permissions only apply to users
+	if certType == ssh.UserCert {
+		for _, ext := range DefaultUserExtensions {
+			extensions[ext] = ""
+		}
+	}
+
 	sshSmuggler := SshCertSmuggler{
 		SshCert: &ssh.Certificate{
 			Key:             pubkeySsh,
-			CertType:        ssh.UserCert,
+			CertType:        certType,
 			KeyId:           claims.Email,
 			ValidPrincipals: principals,
 			ValidBefore:     ssh.CertTimeInfinity,
 			Permissions: ssh.Permissions{
-				Extensions: map[string]string{
-					"permit-X11-forwarding":   "",
-					"permit-agent-forwarding": "",
-					"permit-port-forwarding":  "",
-					"permit-pty":              "",
-					"permit-user-rc":          "",
-					"openpubkey-pkt":          string(pktCom),
-				},
+				Extensions: extensions,
 			},
 		},
 	}
 	return &sshSmuggler, nil
 }
 
+// ValidityBackdate is how far before it is issued a cert with a limited
+// validity period becomes valid, so that servers whose clocks are behind
+// the client's accept it straight away
+const ValidityBackdate = clockskew.DefaultTolerance
+
+// SetValidity limits the cert to being valid for d from now. A d of zero
+// makes the cert valid forever, it is then only accepted while the ID Token
+// in its PK Token is.
+func (s *SshCertSmuggler) SetValidity(now time.Time, d time.Duration) {
+	if d <= 0 {
+		s.SshCert.ValidAfter = 0
+		s.SshCert.ValidBefore = ssh.CertTimeInfinity
+		return
+	}
+	s.SshCert.ValidAfter = uint64(now.Add(-ValidityBackdate).Unix())
+	s.SshCert.ValidBefore = uint64(now.Add(d).Unix())
+}
+
+// CheckValidity returns an error if the cert is not valid at now, allowing
+// for s.ClockSkew, or if it is valid for longer than maxValidity, not
+// counting ValidityBackdate. A maxValidity of zero allows certs that are
+// valid forever.
+func (s *SshCertSmuggler) CheckValidity(now time.Time, maxValidity time.Duration) error {
+	validAfter := time.Unix(int64(s.SshCert.ValidAfter), 0)
+	if s.ClockSkew.NotYetValid(validAfter, now) {
+		return fmt.Errorf("SSH certificate is not valid until %s", validAfter.UTC().Format(time.RFC3339))
+	}
+	if s.SshCert.ValidBefore == ssh.CertTimeInfinity {
+		if maxValidity > 0 {
+			return fmt.Errorf("SSH certificate never expires but the maximum validity is %s", maxValidity)
+		}
+		return nil
+	}
+	validBefore := time.Unix(int64(s.SshCert.ValidBefore), 0)
+	if s.ClockSkew.Expired(validBefore, now) {
+		return fmt.Errorf("SSH certificate expired at %s", validBefore.UTC().Format(time.RFC3339))
+	}
+	if validity := validBefore.Sub(validAfter) - ValidityBackdate; maxValidity > 0 && validity > maxValidity {
+		return fmt.Errorf("SSH certificate is valid for %s, longer than the maximum of %s", validity, maxValidity)
+	}
+	return nil
+}
+
 func NewFromAuthorizedKey(certType string, certB64 string) (*SshCertSmuggler, error) {
 	if certPubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certType + " " + certB64)); err != nil {
 		return nil, err
@@ -91,6 +183,25 @@ func NewFromAuthorizedKey(certType string, certB64 string) (*SshCertSmuggler, er
 	}
 }
 
+// NewSigner returns an SSH signer for signing certs with signer, which may
+// be an ECDSA, Ed25519 or RSA key. RSA keys sign with SHA-256, as OpenSSH
+// rejects SHA-1 signatures.
+func NewSigner(signer crypto.Signer) (ssh.MultiAlgorithmSigner, error) {
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, err
+	}
+	algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %s", sshSigner.PublicKey().Type())
+	}
+	algorithm := sshSigner.PublicKey().Type()
+	if algorithm == ssh.KeyAlgoRSA {
+		algorithm = ssh.KeyAlgoRSASHA256
+	}
+	return ssh.NewSignerWithAlgorithms(algorithmSigner, []string{algorithm})
+}
+
 func (s *SshCertSmuggler) SignCert(signerMas ssh.MultiAlgorithmSigner) (*ssh.Certificate, error) {
 	if err := s.SshCert.SignCert(rand.Reader, signerMas); err != nil {
 		return nil, err
@@ -106,98 +217,186 @@ func (s *SshCertSmuggler) VerifyCaSig(caPubkey ssh.PublicKey) error {
 	return caPubkey.Verify(certBytes, s.SshCert.Signature)
 }
 
-func (s *SshCertSmuggler) GetPKToken() (*pktoken.PKToken, error) {
-	pktCom, ok := s.SshCert.Extensions["openpubkey-pkt"]
-	if !ok {
-		return nil, fmt.Errorf("cert is missing required openpubkey-pkt extension")
+// Extensions decodes and validates the OpenPubkey extensions of the cert, see
+// ParseExtensions
+func (s *SshCertSmuggler) Extensions() (*Extensions, error) {
+	return ParseExtensions(s.SshCert.Extensions)
+}
+
+// CompressPKT stores the PK Token in the cert compressed, see
+// Extensions.Compress, to keep certs with large PK Tokens, e.g. with GQ
+// signatures, within sshd's limits. Call it before signing the cert.
+func (s *SshCertSmuggler) CompressPKT() error {
+	return s.updateExtensions(func(exts *Extensions) { exts.Compress = true })
+}
+
+// ChunkPKT splits the PK Token in the cert across extensions of at most
+// chunkSize bytes, see Extensions.ChunkSize, for PK Tokens that are too
+// large for a single extension even compressed. Call it before signing the
+// cert.
+func (s *SshCertSmuggler) ChunkPKT(chunkSize int) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("chunk size must be positive, got %d", chunkSize)
 	}
-	pkt, err := pktoken.NewFromCompact([]byte(pktCom))
+	return s.updateExtensions(func(exts *Extensions) { exts.ChunkSize = chunkSize })
+}
+
+// updateExtensions replaces the OpenPubkey extensions of the cert after
+// applying update to them
+func (s *SshCertSmuggler) updateExtensions(update func(*Extensions)) error {
+	exts, err := s.Extensions()
 	if err != nil {
-		return nil, fmt.Errorf("openpubkey-pkt extension in cert failed deserialization: %w", err)
+		return err
 	}
-	return pkt, nil
+	update(exts)
+	opkExts, err := exts.Encode()
+	if err != nil {
+		return err
+	}
+	for name := range s.SshCert.Extensions {
+		if strings.HasPrefix(name, ExtensionPrefix) {
+			delete(s.SshCert.Extensions, name)
+		}
+	}
+	for name, value := range opkExts {
+		s.SshCert.Extensions[name] = value
+	}
+	return nil
+}
+
+func (s *SshCertSmuggler) GetPKToken() (*pktoken.PKToken, error) {
+	exts, err := s.Extensions()
+	if err != nil {
+		return nil, err
+	}
+	return exts.PKT, nil
 }
 
 func (s *SshCertSmuggler) VerifySshPktCert(ctx context.Context, opConfig providers.Config) (*pktoken.PKToken, error) {
 	pkt, err := s.GetPKToken()
 	if err != nil {
-		return nil, fmt.Errorf("openpubkey-pkt extension in cert failed deserialization: %w", err)
+		return nil, err
 	}
 
-	err = verifyPKToken(ctx, opConfig, pkt)
+	finder := s.PublicKeyFinder
+	if finder == nil {
+		finder = discover.DefaultPubkeyFinder()
+	}
+	err = verifyPKToken(ctx, opConfig, pkt, s.ClockSkew, finder)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := s.checkCertKey(pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// checkCertKey returns an error unless the cert is for the public key in
+// the PK Token or, see NewSK, a security key bound to it
+func (s *SshCertSmuggler) checkCertKey(pkt *pktoken.PKToken) error {
+	if IsSKKey(s.SshCert.Key) {
+		return s.checkSKCertKey(pkt)
+	}
 	cic, err := pkt.GetCicValues()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	upk := cic.PublicKey()
 
-	cryptoCertKey := (s.SshCert.Key.(ssh.CryptoPublicKey)).CryptoPublicKey()
-	jwkCertKey, err := jwk.FromRaw(cryptoCertKey)
+	cryptoCertKey, ok := s.SshCert.Key.(ssh.CryptoPublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported certificate key type %s", s.SshCert.Key.Type())
+	}
+	jwkCertKey, err := jwk.FromRaw(cryptoCertKey.CryptoPublicKey())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if jwk.Equal(jwkCertKey, upk) {
-		return pkt, nil
-	} else {
-		return nil, fmt.Errorf("public key 'upk' in PK Token does not match public key in certificate")
+	if !jwk.Equal(jwkCertKey, upk) {
+		return fmt.Errorf("public key 'upk' in PK Token does not match public key in certificate")
 	}
+	return nil
 }
 
-func verifyPKToken(ctx context.Context, opConfig providers.Config, pkt *pktoken.PKToken) error {
+func verifyPKToken(ctx context.Context, opConfig providers.Config, pkt *pktoken.PKToken, skew clockskew.Policy, finder *discover.PublicKeyFinder) error {
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	provider, err := oidc.NewProvider(ctxWithTimeout, opConfig.Issuer())
-	if err != nil {
-		return err
-	}
+	keySet := &finderKeySet{finder: finder, issuer: opConfig.Issuer()}
 
 	idt := pkt.OpToken
 
 	// Verify ID token
-	idtVerifier := provider.Verifier(&oidc.Config{
+	idtVerifier := oidc.NewVerifier(opConfig.Issuer(), keySet, &oidc.Config{
 		ClientID:        opConfig.ClientID(),
 		SkipExpiryCheck: true,
 	})
-	idToken, err := idtVerifier.Verify(ctx, string(idt))
+	idToken, err := idtVerifier.Verify(ctxWithTimeout, string(idt))
 	if err != nil {
 		return fmt.Errorf("failed to verify ID token: %w", err)
 	}
 
 	// If the id token is expired, verify against the refreshed id token
-	if time.Now().After(idToken.Expiry) {
+	if skew.Expired(idToken.Expiry, time.Now()) {
 		refreshedIdToken := pkt.FreshIDToken
 		if refreshedIdToken == nil {
 			return fmt.Errorf("ID token is expired and no refresh token found")
 		}
 
 		// TODO: Use a provider verifier with expiration policy
-		idtExpVerifier := provider.Verifier(&oidc.Config{ClientID: opConfig.ClientID()})
-		if _, err = idtExpVerifier.Verify(ctx, string(refreshedIdToken)); err != nil {
+		idtExpVerifier := oidc.NewVerifier(opConfig.Issuer(), keySet, &oidc.Config{
+			ClientID: opConfig.ClientID(),
+			// go-oidc checks expiration against Now, so setting it back
+			// tolerates our clock being ahead of the OP's
+			Now: func() time.Time { return time.Now().Add(-skew.Tolerance) },
+		})
+		if _, err = idtExpVerifier.Verify(ctxWithTimeout, string(refreshedIdToken)); err != nil {
 			return err
 		}
 	}
 
-	op := providers.NewGoogleOpWithOptions(
-		&providers.GoogleOptions{
-			Issuer:   opConfig.Issuer(),
-			ClientID: opConfig.ClientID(),
-		},
-	)
-	ver, err := verifier.New(op)
+	// Users log in once a day rather than every time the ID token expires
+	expirationPolicy := providers.ExpirationPolicies.MAX_AGE_24HOURS.WithClockSkewPolicy(skew)
+	pv := providers.NewProviderVerifier(opConfig.Issuer(), providers.ProviderVerifierOpts{
+		CommitType:        providers.Commitments.CommitType(opConfig.Issuer(), providers.CommitTypesEnum.NONCE_CLAIM),
+		ClientID:          opConfig.ClientID(),
+		DiscoverPublicKey: finder,
+		ExpirationPolicy:  &expirationPolicy,
+	})
+	ver, err := verifier.New(pv)
 	if err != nil {
 		return err
 	}
-	if err := ver.VerifyPKToken(ctx, pkt); err != nil {
+	if err := ver.VerifyPKToken(ctxWithTimeout, pkt); err != nil {
 		return fmt.Errorf("failed to verify PK token: %w", err)
 	}
 	return nil
 }
 
+// finderKeySet verifies ID token signatures for go-oidc with the keys a
+// PublicKeyFinder finds, so both verifications share its fetches and cache
+type finderKeySet struct {
+	finder *discover.PublicKeyFinder
+	issuer string
+}
+
+func (k *finderKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	record, err := k.finder.ByToken(ctx, k.issuer, []byte(jwt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get OP public key: %w", err)
+	}
+	message, err := jws.Parse([]byte(jwt), jws.WithCompact())
+	if err != nil {
+		return nil, err
+	}
+	if len(message.Signatures()) != 1 {
+		return nil, fmt.Errorf("expected one signature on ID token, received %d", len(message.Signatures()))
+	}
+	alg := message.Signatures()[0].ProtectedHeaders().Algorithm()
+	return jws.Verify([]byte(jwt), jws.WithKey(alg, record.PublicKey))
+}
+
 func sshPubkeyFromPKT(pkt *pktoken.PKToken) (ssh.PublicKey, error) {
 	cic, err := pkt.GetCicValues()
 	if err != nil {
@@ -20,14 +20,20 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/discover"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 )
@@ -169,3 +175,178 @@ func TestSshCertCreation(t *testing.T) {
 		t.Error(fmt.Errorf("expected upk to be equal to the value in sshCert.Key"))
 	}
 }
+
+func TestVerifySshPktCert(t *testing.T) {
+	t.Parallel()
+
+	op, backend, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+
+	// The OP's keys are only looked up with the finder
+	fetches := 0
+	cert.PublicKeyFinder = &discover.PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			fetches++
+			return backend.PublicKeyFinder.JwksFunc(ctx, issuer)
+		},
+	}
+	verifiedPkt, err := cert.VerifySshPktCert(context.Background(), op)
+	require.NoError(t, err)
+	require.Equal(t, pkt.OpToken, verifiedPkt.OpToken)
+	require.NotZero(t, fetches)
+
+	otherOp, otherBackend, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	cert.PublicKeyFinder = &otherBackend.PublicKeyFinder
+	_, err = cert.VerifySshPktCert(context.Background(), otherOp)
+	require.ErrorContains(t, err, "failed to verify ID token")
+}
+
+func TestCertValidity(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+	now := time.Now()
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	require.NoError(t, cert.CheckValidity(now, 0))
+	require.ErrorContains(t, cert.CheckValidity(now, 8*time.Hour), "never expires")
+
+	cert.SetValidity(now, 8*time.Hour)
+	require.NoError(t, cert.CheckValidity(now, 0))
+	require.NoError(t, cert.CheckValidity(now, 8*time.Hour))
+	require.ErrorContains(t, cert.CheckValidity(now, time.Hour), "longer than the maximum")
+	require.ErrorContains(t, cert.CheckValidity(now.Add(9*time.Hour), 0), "expired")
+	require.ErrorContains(t, cert.CheckValidity(now.Add(-time.Hour), 0), "not valid until")
+
+	// Servers whose clock is slightly behind accept a new cert
+	require.NoError(t, cert.CheckValidity(now.Add(-30*time.Second), 0))
+}
+
+func TestEd25519Cert(t *testing.T) {
+	t.Parallel()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.EdDSA)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.EdDSA))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoED25519, cert.SshCert.Key.Type())
+	require.NoError(t, cert.checkCertKey(pkt))
+
+	sshSigner, err := NewSigner(signer)
+	require.NoError(t, err)
+	sshCert, err := cert.SignCert(sshSigner)
+	require.NoError(t, err)
+	require.Equal(t, ssh.KeyAlgoED25519, sshCert.Signature.Format)
+	require.NoError(t, cert.VerifyCaSig(sshCert.Key))
+
+	checker := ssh.CertChecker{}
+	require.NoError(t, checker.CheckCert("guest", sshCert))
+
+	pktExt, err := NewFromAuthorizedKey(sshCert.Type(), base64.StdEncoding.EncodeToString(sshCert.Marshal()))
+	require.NoError(t, err)
+	smuggled, err := pktExt.GetPKToken()
+	require.NoError(t, err)
+	pktVerifier, err := verifier.New(op)
+	require.NoError(t, err)
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), smuggled))
+}
+
+func TestRenew(t *testing.T) {
+	t.Parallel()
+	pkt := newTestPKT(t)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	renewed, err := Renew(pkt, cert.SshCert.Key)
+	require.NoError(t, err)
+	require.Equal(t, cert.SshCert.Key.Marshal(), renewed.SshCert.Key.Marshal())
+	require.Equal(t, cert.SshCert.Extensions, renewed.SshCert.Extensions)
+
+	otherCert, err := New(newTestPKT(t), []string{"guest"})
+	require.NoError(t, err)
+	_, err = Renew(pkt, otherCert.SshCert.Key)
+	require.ErrorContains(t, err, "not for the existing")
+}
+
+func TestCompressPKT(t *testing.T) {
+	t.Parallel()
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	uncompressedSize := len(cert.SshCert.Extensions[ExtPKT.Name])
+	require.NoError(t, cert.CompressPKT())
+	require.NotContains(t, cert.SshCert.Extensions, ExtPKT.Name)
+	require.Less(t, len(cert.SshCert.Extensions[ExtPKTCompressed.Name]), uncompressedSize)
+	require.Contains(t, cert.SshCert.Extensions, "permit-pty")
+	require.Contains(t, cert.SshCert.Extensions, ExtClaims.Name)
+
+	sshSigner, err := NewSigner(signer)
+	require.NoError(t, err)
+	sshCert, err := cert.SignCert(sshSigner)
+	require.NoError(t, err)
+
+	parsed, err := NewFromAuthorizedKey(sshCert.Type(), base64.StdEncoding.EncodeToString(sshCert.Marshal()))
+	require.NoError(t, err)
+	parsedPkt, err := parsed.GetPKToken()
+	require.NoError(t, err)
+	require.Equal(t, pkt.Payload, parsedPkt.Payload)
+	require.NoError(t, parsed.checkCertKey(parsedPkt))
+}
+
+func TestChunkPKT(t *testing.T) {
+	t.Parallel()
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, jwa.ES256))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := New(pkt, []string{"guest"})
+	require.NoError(t, err)
+	require.ErrorContains(t, cert.ChunkPKT(0), "must be positive")
+	require.NoError(t, cert.CompressPKT())
+	require.NoError(t, cert.ChunkPKT(256))
+	require.Contains(t, cert.SshCert.Extensions, ExtPKTChunked.Name)
+	require.NotContains(t, cert.SshCert.Extensions, ExtPKTCompressed.Name)
+
+	sshSigner, err := NewSigner(signer)
+	require.NoError(t, err)
+	sshCert, err := cert.SignCert(sshSigner)
+	require.NoError(t, err)
+
+	parsed, err := NewFromAuthorizedKey(sshCert.Type(), base64.StdEncoding.EncodeToString(sshCert.Marshal()))
+	require.NoError(t, err)
+	exts, err := parsed.Extensions()
+	require.NoError(t, err)
+	require.True(t, exts.Compress)
+	require.Equal(t, pkt.Payload, exts.PKT.Payload)
+	require.NoError(t, parsed.checkCertKey(exts.PKT))
+	pktVerifier, err := verifier.New(op)
+	require.NoError(t, err)
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), exts.PKT))
+}
@@ -29,6 +29,10 @@ import (
 	"github.com/openpubkey/openpubkey/util"
 )
 
+// MaxUsesClaim is the CIC claim limiting how many times a verifier
+// configured with a use counter accepts the PK Token, 1 makes it one-shot
+const MaxUsesClaim = "max_uses"
+
 // Client Instance Claims, referred also as "cic" in the OpenPubKey paper
 type Claims struct {
 	publicKey jwk.Key
@@ -105,6 +109,32 @@ func (c *Claims) KeyAlgorithm() jwa.KeyAlgorithm {
 	return c.publicKey.Algorithm()
 }
 
+// MaxUses returns the max_uses claim and false if the PK Token isn't
+// limited-use
+func (c *Claims) MaxUses() (int, bool, error) {
+	maxUses, ok := c.protected[MaxUsesClaim]
+	if !ok {
+		return 0, false, nil
+	}
+	// Claims parsed from JSON are float64, claims set by the client are int
+	var n int
+	switch v := maxUses.(type) {
+	case int:
+		n = v
+	case float64:
+		if v != float64(int(v)) {
+			return 0, false, fmt.Errorf("%s claim must be an integer, got %v", MaxUsesClaim, v)
+		}
+		n = int(v)
+	default:
+		return 0, false, fmt.Errorf("%s claim must be an integer, got %T", MaxUsesClaim, maxUses)
+	}
+	if n < 1 {
+		return 0, false, fmt.Errorf("%s claim must be at least 1, got %d", MaxUsesClaim, n)
+	}
+	return n, true, nil
+}
+
 // Returns a hash of all client instance claims which includes a random value
 func (c *Claims) Hash() ([]byte, error) {
 	buf, err := json.Marshal(c.protected)
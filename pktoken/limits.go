@@ -0,0 +1,204 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// Errors returned when a PK Token exceeds its Limits. They are wrapped with
+// details, use errors.Is to check for them.
+var (
+	ErrTooLarge          = errors.New("PK Token exceeds maximum size")
+	ErrTooDeep           = errors.New("PK Token exceeds maximum JSON nesting depth")
+	ErrTooManySignatures = errors.New("PK Token exceeds maximum number of signatures")
+)
+
+// Limits bound the resources spent parsing an untrusted PK Token. They are
+// checked by streaming over the input before it is decoded, so a PK Token
+// crafted to exhaust memory or the stack is rejected early.
+type Limits struct {
+	// MaxSize is the maximum size in bytes of the serialized PK Token
+	MaxSize int
+	// MaxDepth is the maximum nesting depth of the JSON of the PK Token and
+	// of its payload and protected headers
+	MaxDepth int
+	// MaxSignatures is the maximum number of signatures
+	MaxSignatures int
+}
+
+// DefaultLimits are enforced by NewFromCompact, NewFromMediaType and
+// json.Unmarshal. A PK Token has one signature each from the OP, the client
+// and optionally a cosigner.
+var DefaultLimits = Limits{
+	MaxSize:       256 << 10,
+	MaxDepth:      32,
+	MaxSignatures: 3,
+}
+
+// NewFromCompactWithLimits is NewFromCompact with limits instead of
+// DefaultLimits
+func NewFromCompactWithLimits(pktCom []byte, limits Limits) (*PKToken, error) {
+	if len(pktCom) > limits.MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes, maximum is %d", ErrTooLarge, len(pktCom), limits.MaxSize)
+	}
+	tokensBytes, _, _ := bytes.Cut(pktCom, []byte("."))
+	// Each signature adds a protected header and a signature segment
+	if n := bytes.Count(tokensBytes, []byte(":")) / 2; n > limits.MaxSignatures {
+		return nil, fmt.Errorf("%w: %d signatures, maximum is %d", ErrTooManySignatures, n, limits.MaxSignatures)
+	}
+
+	tokens, freshIDToken, err := SplitCompactPKToken(pktCom)
+	if err != nil {
+		return nil, err
+	}
+	if freshIDToken != nil {
+		tokens = append(tokens, freshIDToken)
+	}
+	for _, token := range tokens {
+		protected, payload, _, err := oidc.SplitCompact(token)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range [][]byte{protected, payload} {
+			decoded, err := util.Base64DecodeForJWT(segment)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkJSON(bytes.NewReader(decoded), limits.MaxDepth, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newFromCompact(pktCom)
+}
+
+// NewFromJSONWithLimits reads a PK Token in the JWS JSON serialization from r,
+// reading at most one byte more than limits.MaxSize
+func NewFromJSONWithLimits(r io.Reader, limits Limits) (*PKToken, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limits.MaxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPKTJSON(data, limits); err != nil {
+		return nil, err
+	}
+	pkt := &PKToken{}
+	if err := pkt.unmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// checkPKTJSON checks the JWS JSON serialization of a PK Token, including
+// the payload and protected headers it contains, against limits
+func checkPKTJSON(data []byte, limits Limits) error {
+	if len(data) > limits.MaxSize {
+		return fmt.Errorf("%w: %d bytes, maximum is %d", ErrTooLarge, len(data), limits.MaxSize)
+	}
+	var encoded [][]byte
+	signatures := 0
+	err := checkJSON(bytes.NewReader(data), limits.MaxDepth, func(path []string, value any) error {
+		switch {
+		case len(path) == 1 && path[0] == "payload":
+		case len(path) == 3 && path[0] == "signatures" && path[2] == "protected":
+		case len(path) == 2 && path[0] == "signatures" && value == json.Delim('{'):
+			signatures++
+			if signatures > limits.MaxSignatures {
+				return fmt.Errorf("%w: maximum is %d", ErrTooManySignatures, limits.MaxSignatures)
+			}
+			return nil
+		default:
+			return nil
+		}
+		if s, ok := value.(string); ok {
+			encoded = append(encoded, []byte(s))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, segment := range encoded {
+		decoded, err := util.Base64DecodeForJWT(segment)
+		if err != nil {
+			return err
+		}
+		if err := checkJSON(bytes.NewReader(decoded), limits.MaxDepth, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkJSON streams over the JSON value in r and returns ErrTooDeep if it is
+// nested deeper than maxDepth. If visit is set it is called with the path
+// to, and value of, every token. Array elements have the path element "".
+func checkJSON(r io.Reader, maxDepth int, visit func(path []string, value any) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	// path holds the object key or "" for each enclosing object or array,
+	// inObject whether that container is an object
+	var path []string
+	var inObject []bool
+	expectKey := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("malformed JSON in PK Token: %w", err)
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			path = path[:len(path)-1]
+			inObject = inObject[:len(inObject)-1]
+			expectKey = len(inObject) > 0 && inObject[len(inObject)-1]
+			continue
+		}
+		if expectKey {
+			// Object keys are always strings
+			path[len(path)-1] = tok.(string)
+			expectKey = false
+			continue
+		}
+
+		if visit != nil {
+			if err := visit(path, tok); err != nil {
+				return err
+			}
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			if len(path) >= maxDepth {
+				return fmt.Errorf("%w of %d", ErrTooDeep, maxDepth)
+			}
+			path = append(path, "")
+			inObject = append(inObject, delim == '{')
+			expectKey = delim == '{'
+			continue
+		}
+		expectKey = len(inObject) > 0 && inObject[len(inObject)-1]
+	}
+}
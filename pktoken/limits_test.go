@@ -0,0 +1,109 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	signingKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := mocks.GenerateMockPKToken(t, signingKey, jwa.ES256)
+	require.NoError(t, err)
+	pktCom, err := pkt.Compact()
+	require.NoError(t, err)
+	pktJSON, err := json.Marshal(pkt)
+	require.NoError(t, err)
+
+	deepPayload := util.Base64EncodeForJWT([]byte(strings.Repeat("[", 100) + strings.Repeat("]", 100)))
+	parts := bytes.Split(pktCom, []byte(":"))
+	deepCom := bytes.Join(append([][]byte{deepPayload}, parts[1:]...), []byte(":"))
+
+	// Repeat the last signature of the compact PK Token
+	manySigsCom := append(pktCom, bytes.Repeat(append([]byte(":"), bytes.Join(parts[len(parts)-2:], []byte(":"))...), 3)...)
+
+	var rawJws struct {
+		Payload    string            `json:"payload"`
+		Signatures []json.RawMessage `json:"signatures"`
+	}
+	require.NoError(t, json.Unmarshal(pktJSON, &rawJws))
+	rawJws.Signatures = append(rawJws.Signatures, rawJws.Signatures...)
+	manySigsJSON, err := json.Marshal(rawJws)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		parse   func() error
+		wantErr error
+	}{
+		{name: "compact ok", parse: func() error {
+			_, err := pktoken.NewFromCompact(pktCom)
+			return err
+		}},
+		{name: "json ok", parse: func() error {
+			_, err := pktoken.NewFromJSONWithLimits(bytes.NewReader(pktJSON), pktoken.DefaultLimits)
+			return err
+		}},
+		{name: "compact too large", wantErr: pktoken.ErrTooLarge, parse: func() error {
+			_, err := pktoken.NewFromCompactWithLimits(pktCom, pktoken.Limits{MaxSize: len(pktCom) - 1, MaxDepth: 32, MaxSignatures: 3})
+			return err
+		}},
+		{name: "json too large", wantErr: pktoken.ErrTooLarge, parse: func() error {
+			_, err := pktoken.NewFromJSONWithLimits(bytes.NewReader(pktJSON), pktoken.Limits{MaxSize: 100, MaxDepth: 32, MaxSignatures: 3})
+			return err
+		}},
+		{name: "compact too deep", wantErr: pktoken.ErrTooDeep, parse: func() error {
+			_, err := pktoken.NewFromCompact(deepCom)
+			return err
+		}},
+		{name: "json too deep", wantErr: pktoken.ErrTooDeep, parse: func() error {
+			deep := []byte(`{"payload":"x","signatures":[],"header":` + strings.Repeat(`{"a":`, 100) + "1" + strings.Repeat("}", 100) + "}")
+			return json.Unmarshal(deep, &pktoken.PKToken{})
+		}},
+		{name: "json payload too deep", wantErr: pktoken.ErrTooDeep, parse: func() error {
+			deep := []byte(`{"payload":"` + string(deepPayload) + `","signatures":[]}`)
+			return json.Unmarshal(deep, &pktoken.PKToken{})
+		}},
+		{name: "compact too many signatures", wantErr: pktoken.ErrTooManySignatures, parse: func() error {
+			_, err := pktoken.NewFromCompact(manySigsCom)
+			return err
+		}},
+		{name: "json too many signatures", wantErr: pktoken.ErrTooManySignatures, parse: func() error {
+			return json.Unmarshal(manySigsJSON, &pktoken.PKToken{})
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.parse()
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaTypeJSON is the media type of the JSON (JWS JSON serialization)
+	// representation of a PK Token
+	MediaTypeJSON = "application/pkt+json"
+	// MediaTypeCompact is the media type of the compact representation of
+	// a PK Token, see CompactPKToken
+	MediaTypeCompact = "application/pkt+compact"
+)
+
+// SupportedMediaTypes lists the PK Token media types in order of preference
+var SupportedMediaTypes = []string{MediaTypeJSON, MediaTypeCompact}
+
+// MaxRequestSize is the maximum size of a PK Token read by ReadRequest
+const MaxRequestSize = 1 << 20
+
+// ParseMediaType returns the PK Token media type named in the Content-Type
+// value. Parameters such as charset are ignored. As clients predating the
+// PK Token media types send "application/json", it is treated as
+// MediaTypeJSON. Any other media type is an error.
+func ParseMediaType(contentType string) (string, error) {
+	if contentType == "" {
+		return "", fmt.Errorf("missing PK Token media type")
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("malformed media type (%s): %w", contentType, err)
+	}
+	switch mediaType {
+	case MediaTypeJSON, "application/json":
+		return MediaTypeJSON, nil
+	case MediaTypeCompact:
+		return MediaTypeCompact, nil
+	default:
+		return "", fmt.Errorf("unsupported PK Token media type (%s)", mediaType)
+	}
+}
+
+// NegotiateMediaType picks the PK Token media type to respond with given the
+// value of an Accept header. The media type with the highest quality value
+// is chosen, ties are broken by the order of SupportedMediaTypes. An empty
+// Accept header accepts any media type and so gets MediaTypeJSON.
+func NegotiateMediaType(accept string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return SupportedMediaTypes[0], nil
+	}
+
+	quality := map[string]float64{}
+	specificity := map[string]int{}
+	for _, rangeStr := range strings.Split(accept, ",") {
+		if strings.TrimSpace(rangeStr) == "" {
+			continue
+		}
+		mediaRange, params, err := mime.ParseMediaType(rangeStr)
+		if err != nil {
+			return "", fmt.Errorf("malformed Accept header (%s): %w", accept, err)
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil || q < 0 || q > 1 {
+				return "", fmt.Errorf("malformed quality value (%s) in Accept header", qStr)
+			}
+		}
+		if mediaRange == "application/json" {
+			mediaRange = MediaTypeJSON
+		}
+
+		// The most specific media range matching a media type sets its quality
+		for _, mediaType := range SupportedMediaTypes {
+			s := matchMediaRange(mediaRange, mediaType)
+			if s > specificity[mediaType] {
+				specificity[mediaType] = s
+				quality[mediaType] = q
+			}
+		}
+	}
+
+	acceptable := []string{}
+	for _, mediaType := range SupportedMediaTypes {
+		if quality[mediaType] > 0 {
+			acceptable = append(acceptable, mediaType)
+		}
+	}
+	if len(acceptable) == 0 {
+		return "", fmt.Errorf("none of the PK Token media types %v are acceptable (%s)", SupportedMediaTypes, accept)
+	}
+	sort.SliceStable(acceptable, func(i, j int) bool {
+		return quality[acceptable[i]] > quality[acceptable[j]]
+	})
+	return acceptable[0], nil
+}
+
+// matchMediaRange returns how specifically the media range matches the
+// media type: 3 for an exact match, 2 for type/*, 1 for */* and 0 if the
+// range doesn't match
+func matchMediaRange(mediaRange string, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") &&
+		strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// MarshalMediaType serializes the PK Token into the representation of the
+// media type
+func (p *PKToken) MarshalMediaType(mediaType string) ([]byte, error) {
+	switch mediaType {
+	case MediaTypeJSON:
+		return json.Marshal(p)
+	case MediaTypeCompact:
+		return p.Compact()
+	default:
+		return nil, fmt.Errorf("unsupported PK Token media type (%s)", mediaType)
+	}
+}
+
+// NewFromMediaType parses a PK Token in the representation of the media
+// type. Parsing is strict: a compact PK Token labeled as JSON, or the
+// reverse, is rejected rather than guessed at.
+func NewFromMediaType(data []byte, mediaType string) (*PKToken, error) {
+	trimmed := bytes.TrimSpace(data)
+	isJSON := len(trimmed) > 0 && trimmed[0] == '{'
+
+	switch mediaType {
+	case MediaTypeJSON:
+		if !isJSON {
+			return nil, fmt.Errorf("PK Token is not a JSON object but media type is %s", mediaType)
+		}
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		pkt := &PKToken{}
+		if err := dec.Decode(pkt); err != nil {
+			return nil, fmt.Errorf("malformed JSON PK Token: %w", err)
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("unexpected data after JSON PK Token")
+		}
+		return pkt, nil
+	case MediaTypeCompact:
+		if isJSON || !bytes.Equal(trimmed, data) {
+			return nil, fmt.Errorf("PK Token is not in compact form but media type is %s", mediaType)
+		}
+		pkt, err := NewFromCompact(data)
+		if err != nil {
+			return nil, fmt.Errorf("malformed compact PK Token: %w", err)
+		}
+		return pkt, nil
+	default:
+		return nil, fmt.Errorf("unsupported PK Token media type (%s)", mediaType)
+	}
+}
+
+// ReadRequest reads a PK Token from the body of the request in the
+// representation named by the request's Content-Type
+func ReadRequest(r *http.Request) (*PKToken, error) {
+	mediaType, err := ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, MaxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxRequestSize {
+		return nil, fmt.Errorf("PK Token exceeds maximum size of %d bytes", MaxRequestSize)
+	}
+	return NewFromMediaType(data, mediaType)
+}
+
+// WriteResponse writes the PK Token in the representation negotiated from
+// the request's Accept header. If no PK Token media type is acceptable it
+// responds with 406 Not Acceptable and returns the error.
+func WriteResponse(w http.ResponseWriter, r *http.Request, pkt *PKToken) error {
+	mediaType, err := NegotiateMediaType(r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return err
+	}
+	data, err := pkt.MarshalMediaType(mediaType)
+	if err != nil {
+		http.Error(w, "failed to serialize PK Token", http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
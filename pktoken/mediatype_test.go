@@ -0,0 +1,150 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/mocks"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+func TestNegotiateMediaType(t *testing.T) {
+	testCases := []struct {
+		name      string
+		accept    string
+		expected  string
+		expectErr bool
+	}{
+		{name: "no accept header", accept: "", expected: pktoken.MediaTypeJSON},
+		{name: "any", accept: "*/*", expected: pktoken.MediaTypeJSON},
+		{name: "json", accept: pktoken.MediaTypeJSON, expected: pktoken.MediaTypeJSON},
+		{name: "compact", accept: pktoken.MediaTypeCompact, expected: pktoken.MediaTypeCompact},
+		{name: "legacy json", accept: "application/json", expected: pktoken.MediaTypeJSON},
+		{name: "quality prefers compact", accept: "application/pkt+json;q=0.5, application/pkt+compact", expected: pktoken.MediaTypeCompact},
+		{name: "tie uses server preference", accept: "application/pkt+compact, application/pkt+json", expected: pktoken.MediaTypeJSON},
+		{name: "specific range overrides wildcard", accept: "application/*, application/pkt+json;q=0", expected: pktoken.MediaTypeCompact},
+		{name: "nothing acceptable", accept: "text/html", expectErr: true},
+		{name: "explicitly refused", accept: "*/*;q=0", expectErr: true},
+		{name: "malformed quality", accept: "application/pkt+json;q=high", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mediaType, err := pktoken.NegotiateMediaType(tc.accept)
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, mediaType)
+			}
+		})
+	}
+}
+
+func TestParseMediaType(t *testing.T) {
+	mediaType, err := pktoken.ParseMediaType("application/pkt+compact; charset=utf-8")
+	require.NoError(t, err)
+	require.Equal(t, pktoken.MediaTypeCompact, mediaType)
+
+	mediaType, err = pktoken.ParseMediaType("application/json")
+	require.NoError(t, err)
+	require.Equal(t, pktoken.MediaTypeJSON, mediaType)
+
+	_, err = pktoken.ParseMediaType("")
+	require.Error(t, err)
+	_, err = pktoken.ParseMediaType("application/jwt")
+	require.ErrorContains(t, err, "unsupported PK Token media type")
+}
+
+func TestMediaTypeSerialization(t *testing.T) {
+	signingKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := mocks.GenerateMockPKToken(t, signingKey, jwa.ES256)
+	require.NoError(t, err)
+
+	jsonPkt, err := pkt.MarshalMediaType(pktoken.MediaTypeJSON)
+	require.NoError(t, err)
+	compactPkt, err := pkt.MarshalMediaType(pktoken.MediaTypeCompact)
+	require.NoError(t, err)
+
+	for mediaType, data := range map[string][]byte{
+		pktoken.MediaTypeJSON:    jsonPkt,
+		pktoken.MediaTypeCompact: compactPkt,
+	} {
+		parsed, err := pktoken.NewFromMediaType(data, mediaType)
+		require.NoError(t, err)
+		require.Equal(t, pkt.OpToken, parsed.OpToken)
+		require.Equal(t, pkt.CicToken, parsed.CicToken)
+	}
+
+	// Mislabeled representations are rejected rather than guessed at
+	_, err = pktoken.NewFromMediaType(compactPkt, pktoken.MediaTypeJSON)
+	require.ErrorContains(t, err, "not a JSON object")
+	_, err = pktoken.NewFromMediaType(jsonPkt, pktoken.MediaTypeCompact)
+	require.ErrorContains(t, err, "not in compact form")
+	_, err = pktoken.NewFromMediaType(append(jsonPkt, []byte("{}")...), pktoken.MediaTypeJSON)
+	require.Error(t, err)
+	_, err = pkt.MarshalMediaType("application/jwt")
+	require.Error(t, err)
+}
+
+func TestMediaTypeHTTP(t *testing.T) {
+	signingKey, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	pkt, err := mocks.GenerateMockPKToken(t, signingKey, jwa.ES256)
+	require.NoError(t, err)
+
+	compactPkt, err := pkt.Compact()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/verify", bytes.NewReader(compactPkt))
+	req.Header.Set("Content-Type", pktoken.MediaTypeCompact)
+	req.Header.Set("Accept", pktoken.MediaTypeJSON)
+
+	readPkt, err := pktoken.ReadRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, pkt.OpToken, readPkt.OpToken)
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, pktoken.WriteResponse(rec, req, readPkt))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, pktoken.MediaTypeJSON, rec.Header().Get("Content-Type"))
+
+	respPkt, err := pktoken.NewFromMediaType(rec.Body.Bytes(), pktoken.MediaTypeJSON)
+	require.NoError(t, err)
+	require.Equal(t, pkt.CicToken, respPkt.CicToken)
+
+	// Body labeled with the wrong media type
+	req = httptest.NewRequest(http.MethodPost, "/verify", bytes.NewReader(compactPkt))
+	req.Header.Set("Content-Type", pktoken.MediaTypeJSON)
+	_, err = pktoken.ReadRequest(req)
+	require.Error(t, err)
+
+	// Client accepts no PK Token media type
+	req.Header.Set("Accept", "text/html")
+	rec = httptest.NewRecorder()
+	require.Error(t, pktoken.WriteResponse(rec, req, pkt))
+	require.Equal(t, http.StatusNotAcceptable, rec.Code)
+}
@@ -28,6 +28,10 @@ import (
 // JWS (JSON Web Signature). OSMs commit to the PK Token which was used
 // to generate the OSM.
 func (p *PKToken) NewSignedMessage(content []byte, signer crypto.Signer) ([]byte, error) {
+	return p.newSignedMessage(content, signer, "osm")
+}
+
+func (p *PKToken) newSignedMessage(content []byte, signer crypto.Signer, typ string) ([]byte, error) {
 	cic, err := p.GetCicValues()
 	if err != nil {
 		return nil, err
@@ -46,7 +50,7 @@ func (p *PKToken) NewSignedMessage(content []byte, signer crypto.Signer) ([]byte
 	if err := protected.Set("kid", pktHash); err != nil {
 		return nil, err
 	}
-	if err := protected.Set("typ", "osm"); err != nil {
+	if err := protected.Set("typ", typ); err != nil {
 		return nil, err
 	}
 
@@ -69,6 +73,10 @@ func (p *PKToken) NewSignedMessage(content []byte, signer crypto.Signer) ([]byte
 // The PK Token should always be verified first before calling
 // VerifySignedMessage
 func (p *PKToken) VerifySignedMessage(osm []byte) ([]byte, error) {
+	return p.verifySignedMessage(osm, "osm")
+}
+
+func (p *PKToken) verifySignedMessage(osm []byte, expectedTyp string) ([]byte, error) {
 	cic, err := p.GetCicValues()
 	if err != nil {
 		return nil, err
@@ -85,13 +93,13 @@ func (p *PKToken) VerifySignedMessage(osm []byte) ([]byte, error) {
 	}
 	protected := message.Signatures()[0].ProtectedHeaders()
 
-	// Verify typ header matches expected "osm" value
+	// Verify typ header matches expected value
 	typ, ok := protected.Get("typ")
 	if !ok {
 		return nil, fmt.Errorf("missing required header `typ`")
 	}
-	if typ != "osm" {
-		return nil, fmt.Errorf(`incorrect "typ" header, expected "osm" but received %s`, typ)
+	if typ != expectedTyp {
+		return nil, fmt.Errorf(`incorrect "typ" header, expected %q but received %s`, expectedTyp, typ)
 	}
 
 	// Verify key algorithm header matches cic
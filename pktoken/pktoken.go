@@ -79,8 +79,14 @@ func New(idToken []byte, cicToken []byte) (*PKToken, error) {
 	return pkt, nil
 }
 
-// NewFromCompact creates a PK Token from a compact representation
+// NewFromCompact creates a PK Token from a compact representation. The
+// compact representation is checked against DefaultLimits before it is
+// parsed.
 func NewFromCompact(pktCom []byte) (*PKToken, error) {
+	return NewFromCompactWithLimits(pktCom, DefaultLimits)
+}
+
+func newFromCompact(pktCom []byte) (*PKToken, error) {
 	tokens, freshIDToken, err := SplitCompactPKToken(pktCom)
 	if err != nil {
 		return nil, err
@@ -125,6 +131,28 @@ func (p *PKToken) Issuer() (string, error) {
 	return claims.Issuer, nil
 }
 
+// EmailVerified returns the email claim of the ID Token in the PKToken and
+// whether the OP asserts, with the email_verified claim, that the user
+// controls it. Some OPs, e.g. AWS Cognito, set email_verified to the
+// string "true" rather than the boolean, both are accepted.
+func (p *PKToken) EmailVerified() (string, bool, error) {
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"`
+	}
+	if err := json.Unmarshal(p.Payload, &claims); err != nil {
+		return "", false, fmt.Errorf("malformatted PK token claims: %w", err)
+	}
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		return claims.Email, verified, nil
+	case string:
+		return claims.Email, verified == "true", nil
+	default:
+		return claims.Email, false, nil
+	}
+}
+
 // Signs PK Token and then returns only the payload, header and signature as a JWT
 func (p *PKToken) SignToken(
 	signer crypto.Signer,
@@ -281,7 +309,16 @@ func (p *PKToken) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rawJws)
 }
 
+// UnmarshalJSON parses the JWS JSON serialization of a PK Token after
+// checking it against DefaultLimits
 func (p *PKToken) UnmarshalJSON(data []byte) error {
+	if err := checkPKTJSON(data, DefaultLimits); err != nil {
+		return err
+	}
+	return p.unmarshalJSON(data)
+}
+
+func (p *PKToken) unmarshalJSON(data []byte) error {
 	var rawJws oidc.Jws
 	if err := json.Unmarshal(data, &rawJws); err != nil {
 		return err
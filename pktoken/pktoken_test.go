@@ -45,6 +45,8 @@ func TestPkToken(t *testing.T) {
 	require.NoError(t, err)
 
 	testPkTokenMessageSigning(t, pkt, signingKey)
+	testPkTokenScopedAssertion(t, pkt, signingKey)
+	testPkTokenRequestSignature(t, pkt, signingKey)
 	testPkTokenSerialization(t, pkt)
 
 	actualIssuer, err := pkt.Issuer()
@@ -70,6 +72,63 @@ func testPkTokenMessageSigning(t *testing.T, pkt *pktoken.PKToken, signingKey cr
 	require.Equal(t, msg, string(payload), "OSM payload did not match what we initially wrapped")
 }
 
+func testPkTokenScopedAssertion(t *testing.T, pkt *pktoken.PKToken, signingKey crypto.Signer) {
+	scope := pktoken.ScopeClaims{
+		Audience:   "https://verifier.example.com",
+		Action:     "deploy",
+		IssuedAt:   1700000000,
+		Expiration: 1700000300,
+	}
+	assertion, err := pkt.NewScopedAssertion(scope, signingKey)
+	require.NoError(t, err)
+
+	scopeClaims, err := pkt.VerifyScopedAssertion(assertion)
+	require.NoError(t, err)
+	require.Equal(t, scope, *scopeClaims)
+
+	// A scoped assertion must not be accepted as an OSM and vice versa
+	_, err = pkt.VerifySignedMessage(assertion)
+	require.ErrorContains(t, err, `incorrect "typ" header`)
+
+	osm, err := pkt.NewSignedMessage([]byte(`{"aud":"https://verifier.example.com","exp":1700000300}`), signingKey)
+	require.NoError(t, err)
+	_, err = pkt.VerifyScopedAssertion(osm)
+	require.ErrorContains(t, err, `incorrect "typ" header`)
+
+	_, err = pkt.NewScopedAssertion(pktoken.ScopeClaims{Expiration: 1700000300}, signingKey)
+	require.EqualError(t, err, "scoped assertion requires an audience")
+}
+
+func testPkTokenRequestSignature(t *testing.T, pkt *pktoken.PKToken, signingKey crypto.Signer) {
+	claims := pktoken.RequestClaims{
+		Method:   "POST",
+		Host:     "api.example.com",
+		Path:     "/deploy?env=prod",
+		BodyHash: "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU",
+		IssuedAt: 1700000000,
+		Nonce:    "n-0S6_WzA2Mj",
+	}
+	sig, err := pkt.NewRequestSignature(claims, signingKey)
+	require.NoError(t, err)
+
+	requestClaims, err := pkt.VerifyRequestSignature(sig)
+	require.NoError(t, err)
+	require.Equal(t, claims, *requestClaims)
+
+	// A request signature must not be accepted as another signed message
+	_, err = pkt.VerifySignedMessage(sig)
+	require.ErrorContains(t, err, `incorrect "typ" header`)
+	_, err = pkt.VerifyScopedAssertion(sig)
+	require.ErrorContains(t, err, `incorrect "typ" header`)
+
+	// Every request signature needs a nonce for replays to be detected
+	claims.Nonce = ""
+	sig, err = pkt.NewRequestSignature(claims, signingKey)
+	require.NoError(t, err)
+	_, err = pkt.VerifyRequestSignature(sig)
+	require.EqualError(t, err, "request signature is missing a nonce")
+}
+
 func testPkTokenSerialization(t *testing.T, pkt *pktoken.PKToken) {
 	// Test json serialization/deserialization
 	pktJson, err := json.Marshal(pkt)
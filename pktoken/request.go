@@ -0,0 +1,84 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+// RequestClaims bind a request signature to a single HTTP request or
+// RPC, so a PK Token sent with the request proves possession of its client
+// key for that request only
+type RequestClaims struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	// Path is the path and query of the request
+	Path string `json:"path"`
+	// BodyHash is the base64url encoded SHA-256 hash of the request body
+	BodyHash string `json:"body_hash"`
+	IssuedAt int64  `json:"iat"`
+	// Nonce makes every signature unique so that verifiers can reject
+	// replays
+	Nonce string `json:"nonce"`
+	// ChannelBinding is the base64url encoded TLS exporter keying material
+	// of the connection the request was sent on, if it binds the signature
+	// to that connection
+	ChannelBinding string `json:"cb,omitempty"`
+}
+
+// NewRequestSignature signs the request claims with the signer provided.
+// Like an OSM it commits to the PK Token, but it has the typ "req" so that
+// it can not be confused with other signed messages.
+func (p *PKToken) NewRequestSignature(claims RequestClaims, signer crypto.Signer) ([]byte, error) {
+	content, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	return p.newSignedMessage(content, signer, "req")
+}
+
+// VerifyRequestSignature verifies a request signature using the public key
+// in this PK Token and returns its claims. It does not check the claims
+// match the request, that is left to the caller. Only the compact
+// serialization is accepted and the claims must have a nonce, but as
+// signatures can be re-encoded callers should detect replays by the
+// nonce rather than by the signature bytes.
+//
+// Note: As with VerifySignedMessage, the PK Token should always be
+// verified first before calling VerifyRequestSignature
+func (p *PKToken) VerifyRequestSignature(sig []byte) (*RequestClaims, error) {
+	if _, err := jws.Parse(sig, jws.WithCompact()); err != nil {
+		return nil, fmt.Errorf("request signature must use the compact serialization: %w", err)
+	}
+	content, err := p.verifySignedMessage(sig, "req")
+	if err != nil {
+		return nil, err
+	}
+
+	var claims RequestClaims
+	if err := json.Unmarshal(content, &claims); err != nil {
+		return nil, fmt.Errorf("malformed request signature: %w", err)
+	}
+	if claims.Nonce == "" {
+		return nil, fmt.Errorf("request signature is missing a nonce")
+	}
+	return &claims, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pktoken
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+)
+
+// ScopeClaims restrict where the PK Token accompanying a scoped assertion
+// may be used. A verifier which receives a PK Token together with a scoped
+// assertion should reject it unless it is the intended audience, the
+// requested action matches and the assertion has not expired.
+type ScopeClaims struct {
+	Audience   string `json:"aud"`
+	Action     string `json:"act,omitempty"`
+	IssuedAt   int64  `json:"iat"`
+	Expiration int64  `json:"exp"`
+}
+
+// NewScopedAssertion signs the scope claims with the signer provided. Like
+// an OSM, the assertion is a JWS which commits to the PK Token used to
+// generate it, but it has the typ "scope" so that it can not be confused
+// with an arbitrary signed message.
+func (p *PKToken) NewScopedAssertion(scope ScopeClaims, signer crypto.Signer) ([]byte, error) {
+	if scope.Audience == "" {
+		return nil, fmt.Errorf("scoped assertion requires an audience")
+	}
+	if scope.Expiration == 0 {
+		return nil, fmt.Errorf("scoped assertion requires an expiration")
+	}
+	content, err := json.Marshal(scope)
+	if err != nil {
+		return nil, err
+	}
+	return p.newSignedMessage(content, signer, "scope")
+}
+
+// VerifyScopedAssertion verifies a scoped assertion using the public key
+// in this PK Token and returns its scope claims. It does not check the
+// claims themselves, that is left to the caller.
+//
+// Note: As with VerifySignedMessage, the PK Token should always be
+// verified first before calling VerifyScopedAssertion
+func (p *PKToken) VerifyScopedAssertion(assertion []byte) (*ScopeClaims, error) {
+	content, err := p.verifySignedMessage(assertion, "scope")
+	if err != nil {
+		return nil, err
+	}
+
+	var scope ScopeClaims
+	if err := json.Unmarshal(content, &scope); err != nil {
+		return nil, fmt.Errorf("malformed scoped assertion: %w", err)
+	}
+	return &scope, nil
+}
@@ -18,11 +18,15 @@ package providers
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
-	"time"
 
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/i18n"
+	"github.com/openpubkey/openpubkey/relay"
+	"github.com/openpubkey/openpubkey/retry"
 )
 
 // AzureOptions is an options struct that configures how providers.AzureOp
@@ -32,6 +36,9 @@ type AzureOptions struct {
 	// ClientID is the client ID of the OIDC application. It should be the
 	// expected "aud" claim in received ID tokens from the OP.
 	ClientID string
+	// AcceptedClientIDs lists further client IDs whose ID tokens are
+	// accepted when verifying, see ProviderVerifierOpts.AcceptedClientIDs
+	AcceptedClientIDs []string
 	// Issuer is the OP's issuer URI for performing OIDC authorization and
 	// discovery.
 	Issuer string
@@ -43,6 +50,12 @@ type AzureOptions struct {
 	// flow exchange. Ensure that your OIDC application is configured to accept
 	// these URIs otherwise an error may occur.
 	RedirectURIs []string
+	// RedirectPorts says which other ports the callback server may listen
+	// on when those of RedirectURIs are in use, and on which address
+	RedirectPorts RedirectPorts
+	// CallbackListener, if set, opens the listener of the callback server
+	// instead of RedirectPorts, e.g. under js/wasm
+	CallbackListener CallbackListener
 	// GQSign denotes if the received ID token should be upgraded to a GQ token
 	// using GQ signatures.
 	GQSign bool
@@ -52,13 +65,21 @@ type AzureOptions struct {
 	// automation (e.g. integration tests) where you don't want the browser to
 	// open.
 	OpenBrowser bool
+	// BrowserOpener, if set, opens the browser instead of util.OpenUrl
+	BrowserOpener BrowserOpener
 	// HttpClient is the http.Client to use when making queries to the OP (OIDC
 	// code exchange, refresh, verification of ID token, fetch of JWKS endpoint,
 	// etc.). If nil, then http.DefaultClient is used.
 	HttpClient *http.Client
-	// IssuedAtOffset configures the offset to add when validating the "iss" and
-	// "exp" claims of received ID tokens from the OP.
-	IssuedAtOffset time.Duration
+	// TLSConfig, if set, is used for the HTTPS connections to the OP, e.g.
+	// to trust the private CA of an internal OP, see discover.TLSClient
+	TLSConfig *tls.Config
+	// ClockSkew is how far apart the OP's clock and ours may be when
+	// validating the "iat" and "exp" claims of received ID tokens
+	ClockSkew clockskew.Policy
+	// Retry is how token requests, refreshes and JWKS fetches are retried
+	// when they fail with a transient error
+	Retry retry.Policy
 	// TenantID is the GUID  of the Azure tenant/organization. Azure has a
 	// different issuer URI for each tenant. Users that are not part of Azure
 	// organization, which microsoft nicknames consumers have a default
@@ -66,6 +87,21 @@ type AzureOptions struct {
 	// More details can be found at
 	// https://learn.microsoft.com/en-us/entra/identity-platform/access-tokens
 	TenantID string
+	// Relay, if set, has the user log in on another device, e.g. by
+	// scanning a QR code with their phone, instead of in a browser on this
+	// machine. The OIDC application must accept the relay's callback URL as
+	// a redirect URI.
+	Relay *relay.Client
+	// Localizer localizes the page shown in the browser after login and the
+	// messages printed while waiting for the user to log in. If nil, English
+	// is used.
+	Localizer *i18n.Localizer
+	// LoginSuccessURL and LoginFailureURL, if set, are where the browser is
+	// redirected once the login succeeds or fails, instead of showing the
+	// status page. Pages can also be replaced with templates, see
+	// i18n.LoginSuccessPage.
+	LoginSuccessURL string
+	LoginFailureURL string
 }
 
 func GetDefaultAzureOpOptions() *AzureOptions {
@@ -80,10 +116,11 @@ func GetDefaultAzureOpOptions() *AzureOptions {
 			"http://localhost:10001/login-callback",
 			"http://localhost:11110/login-callback",
 		},
-		GQSign:         false,
-		OpenBrowser:    true,
-		HttpClient:     nil,
-		IssuedAtOffset: 1 * time.Minute,
+		GQSign:      false,
+		OpenBrowser: true,
+		HttpClient:  nil,
+		ClockSkew:   clockskew.Default,
+		Retry:       retry.Default,
 	}
 }
 
@@ -99,22 +136,37 @@ func NewAzureOp() BrowserOpenIdProvider {
 // using an options struct. This is useful if you want to use your own OIDC
 // Client or override the configuration.
 func NewAzureOpWithOptions(opts *AzureOptions) BrowserOpenIdProvider {
-	return &StandardOp{
+	op := &StandardOp{
 		clientID:                  opts.ClientID,
+		AcceptedClientIDs:         opts.AcceptedClientIDs,
 		Scopes:                    opts.Scopes,
 		RedirectURIs:              opts.RedirectURIs,
+		RedirectPorts:             opts.RedirectPorts,
+		CallbackListener:          opts.CallbackListener,
 		GQSign:                    opts.GQSign,
 		OpenBrowser:               opts.OpenBrowser,
+		BrowserOpener:             opts.BrowserOpener,
 		HttpClient:                opts.HttpClient,
-		IssuedAtOffset:            opts.IssuedAtOffset,
+		TLSConfig:                 opts.TLSConfig,
+		ClockSkew:                 opts.ClockSkew,
+		Retry:                     opts.Retry,
+		Relay:                     opts.Relay,
+		Localizer:                 opts.Localizer,
+		LoginSuccessURL:           opts.LoginSuccessURL,
+		LoginFailureURL:           opts.LoginFailureURL,
 		issuer:                    opts.Issuer,
 		requestTokensOverrideFunc: nil,
-		publicKeyFinder: discover.PublicKeyFinder{
-			JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
-				return discover.GetJwksByIssuer(ctx, issuer, opts.HttpClient)
-			},
+	}
+	op.publicKeyFinder = discover.PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			httpClient, err := op.httpClient()
+			if err != nil {
+				return nil, err
+			}
+			return discover.GetJwksByIssuer(ctx, issuer, httpClient)
 		},
 	}
+	return op
 }
 
 type AzureOp = StandardOp
@@ -0,0 +1,146 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// CommitmentScheme describes how the commitment to the client instance
+// claims (CIC) is bound to the ID Token. The ProviderVerifier checks that
+// the commitment extracted from the ID Token equals the commitment expected
+// for the CIC.
+//
+// Implement this to support bindings other than ClaimCommitment and
+// GQCommitment, e.g. a commitment split across several claims or hashed
+// into a custom claim.
+type CommitmentScheme interface {
+	// ExtractCommitment returns the commitment found in the ID Token
+	ExtractCommitment(idt *oidc.Jwt) (string, error)
+	// ExpectedCommitment returns the commitment the ID Token must contain
+	// for it to be bound to the CIC
+	ExpectedCommitment(cic *clientinstance.Claims) (string, error)
+}
+
+// ClaimCommitment is the CommitmentScheme where the hash of the CIC is
+// set as the value of a payload claim of the ID Token such as nonce or aud.
+type ClaimCommitment struct {
+	Claim string
+}
+
+var _ CommitmentScheme = ClaimCommitment{}
+
+func (c ClaimCommitment) ExtractCommitment(idt *oidc.Jwt) (string, error) {
+	if c.Claim == "" {
+		return "", fmt.Errorf("verifier configured with empty commitment claim")
+	}
+
+	claims, err := payloadClaims(idt)
+	if err != nil {
+		return "", err
+	}
+
+	commitment, ok := claims[c.Claim]
+	if !ok {
+		return "", fmt.Errorf("missing commitment claim %s", c.Claim)
+	}
+	commitmentStr, ok := commitment.(string)
+	if !ok {
+		return "", fmt.Errorf("commitment claim %s is not a string", c.Claim)
+	}
+	return commitmentStr, nil
+}
+
+func (c ClaimCommitment) ExpectedCommitment(cic *clientinstance.Claims) (string, error) {
+	return cicHash(cic)
+}
+
+// GQCommitment is the CommitmentScheme where the hash of the CIC is set as
+// the "cic" claim in the protected header of the GQ signature. This allows
+// the commitment to be bound to ID Tokens from OPs which don't let the
+// client choose any of the claims.
+type GQCommitment struct{}
+
+var _ CommitmentScheme = GQCommitment{}
+
+func (GQCommitment) ExtractCommitment(idt *oidc.Jwt) (string, error) {
+	claims, err := payloadClaims(idt)
+	if err != nil {
+		return "", err
+	}
+	aud, ok := claims["aud"].(string)
+	if !ok {
+		return "", fmt.Errorf("require audience claim prefix missing in PK Token's GQCommitment")
+	}
+
+	// To prevent attacks where a attacker takes someone else's ID Token
+	// and turns it into a PK Token using a GQCommitment, we require that
+	// all GQ commitments explicitly signal they want to be used as
+	// PK Tokens. To signal this, they prefix the audience (aud)
+	// claim with the string "OPENPUBKEY-PKTOKEN:".
+	// We reject all GQ commitment PK Tokens that don't have this prefix
+	// in the aud claim.
+	if !strings.HasPrefix(aud, AudPrefixForGQCommitment) {
+		return "", fmt.Errorf("audience claim in PK Token's GQCommitment must be prefixed by (%s), got (%s) instead",
+			AudPrefixForGQCommitment, aud)
+	}
+
+	// Get the commitment from the GQ signed protected header claim "cic" in the ID Token
+	commitment := idt.GetSignature().GetProtectedClaims().CIC
+	if commitment == "" {
+		return "", fmt.Errorf("missing GQ commitment")
+	}
+	return commitment, nil
+}
+
+func (GQCommitment) ExpectedCommitment(cic *clientinstance.Claims) (string, error) {
+	return cicHash(cic)
+}
+
+// Scheme returns the CommitmentScheme for the CommitType
+func (c CommitType) Scheme() CommitmentScheme {
+	if c.GQCommitment {
+		return GQCommitment{}
+	}
+	return ClaimCommitment{Claim: c.Claim}
+}
+
+func cicHash(cic *clientinstance.Claims) (string, error) {
+	hash, err := cic.Hash()
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func payloadClaims(idt *oidc.Jwt) (map[string]any, error) {
+	var claims map[string]any
+	payload, err := util.Base64DecodeForJWT([]byte(idt.GetPayload()))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CommitmentRegistry records how the ID Tokens of each OP commit to the
+// client instance claims (CIC): in the nonce claim, in the aud claim or
+// bound by the GQ signature. The providers consult it when requesting and
+// verifying ID Tokens and the verifier consults it to catch provider
+// verifiers configured with the wrong CommitType, so adding or changing
+// an OP only means registering its issuer here.
+type CommitmentRegistry struct {
+	mu       sync.RWMutex
+	issuers  map[string]CommitType
+	resolves []func(issuer string) (CommitType, bool)
+}
+
+// Commitments is the registry consulted by the providers and verifiers of
+// this module. It knows the issuers with a fixed CommitType, other OIDC
+// issuers fall back to the CommitType of their provider, which for a
+// StandardOp is the nonce claim.
+var Commitments = NewCommitmentRegistry()
+
+func init() {
+	Commitments.issuers[githubIssuer] = CommitTypesEnum.AUD_CLAIM
+	Commitments.issuers[gitlabIssuer] = CommitTypesEnum.GQ_BOUND
+}
+
+// NewCommitmentRegistry returns an empty CommitmentRegistry
+func NewCommitmentRegistry() *CommitmentRegistry {
+	return &CommitmentRegistry{issuers: map[string]CommitType{}}
+}
+
+// Register sets the CommitType of issuer, overriding the CommitType
+// registered before and the default of the issuer's provider
+func (r *CommitmentRegistry) Register(issuer string, commitType CommitType) error {
+	if issuer == "" {
+		return fmt.Errorf("cannot register a CommitType for an empty issuer")
+	}
+	if err := commitType.Validate(); err != nil {
+		return fmt.Errorf("invalid CommitType for issuer (%s): %w", issuer, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.issuers[issuer] = commitType
+	return nil
+}
+
+// RegisterFunc adds a hook consulted for issuers that weren't registered
+// with Register, e.g. to match every self-hosted GitLab instance of an
+// organization. Hooks are consulted in the order they were added and the
+// first one returning true decides the CommitType.
+func (r *CommitmentRegistry) RegisterFunc(resolve func(issuer string) (CommitType, bool)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolves = append(r.resolves, resolve)
+}
+
+// Lookup returns the CommitType registered for issuer and whether one was
+func (r *CommitmentRegistry) Lookup(issuer string) (CommitType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if commitType, ok := r.issuers[issuer]; ok {
+		return commitType, true
+	}
+	for _, resolve := range r.resolves {
+		if commitType, ok := resolve(issuer); ok {
+			return commitType, true
+		}
+	}
+	return CommitType{}, false
+}
+
+// CommitType returns the CommitType registered for issuer, fallback if
+// none was
+func (r *CommitmentRegistry) CommitType(issuer string, fallback CommitType) CommitType {
+	if commitType, ok := r.Lookup(issuer); ok {
+		return commitType
+	}
+	return fallback
+}
+
+// Check returns an error if a CommitType other than commitType is
+// registered for issuer
+func (r *CommitmentRegistry) Check(issuer string, commitType CommitType) error {
+	registered, ok := r.Lookup(issuer)
+	if !ok || registered == commitType {
+		return nil
+	}
+	return fmt.Errorf("provider verifier for issuer (%s) expects the CIC commitment %s but the issuer is registered with the commitment %s",
+		issuer, commitType, registered)
+}
+
+// Validate returns an error if the CommitType names both or neither of a
+// commitment claim and the GQ commitment
+func (c CommitType) Validate() error {
+	if c.GQCommitment && c.Claim != "" {
+		return fmt.Errorf("GQCommitment requires that commitmentClaim is empty but commitmentClaim is (%s)", c.Claim)
+	}
+	if !c.GQCommitment && c.Claim == "" {
+		return fmt.Errorf("commitment claim is empty and GQCommitment is not set")
+	}
+	return nil
+}
+
+func (c CommitType) String() string {
+	if c.GQCommitment {
+		return "bound by the GQ signature"
+	}
+	return fmt.Sprintf("in the %q claim", c.Claim)
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitmentRegistry(t *testing.T) {
+	registry := NewCommitmentRegistry()
+
+	_, ok := registry.Lookup("https://example.com")
+	require.False(t, ok)
+	require.Equal(t, CommitTypesEnum.NONCE_CLAIM, registry.CommitType("https://example.com", CommitTypesEnum.NONCE_CLAIM))
+	require.NoError(t, registry.Check("https://example.com", CommitTypesEnum.AUD_CLAIM))
+
+	require.NoError(t, registry.Register("https://example.com", CommitTypesEnum.AUD_CLAIM))
+	require.Equal(t, CommitTypesEnum.AUD_CLAIM, registry.CommitType("https://example.com", CommitTypesEnum.NONCE_CLAIM))
+	require.NoError(t, registry.Check("https://example.com", CommitTypesEnum.AUD_CLAIM))
+	require.ErrorContains(t, registry.Check("https://example.com", CommitTypesEnum.NONCE_CLAIM),
+		`expects the CIC commitment in the "nonce" claim but the issuer is registered with the commitment in the "aud" claim`)
+
+	registry.RegisterFunc(func(issuer string) (CommitType, bool) {
+		return CommitTypesEnum.GQ_BOUND, strings.HasPrefix(issuer, "https://gitlab.")
+	})
+	commitType, ok := registry.Lookup("https://gitlab.example.com")
+	require.True(t, ok)
+	require.Equal(t, CommitTypesEnum.GQ_BOUND, commitType)
+	// Exact registrations take precedence over hooks
+	require.NoError(t, registry.Register("https://gitlab.example.com", CommitTypesEnum.NONCE_CLAIM))
+	require.Equal(t, CommitTypesEnum.NONCE_CLAIM, registry.CommitType("https://gitlab.example.com", CommitTypesEnum.GQ_BOUND))
+
+	require.ErrorContains(t, registry.Register("", CommitTypesEnum.NONCE_CLAIM), "empty issuer")
+	require.ErrorContains(t, registry.Register("https://example.com", CommitType{}), "commitment claim is empty")
+	require.ErrorContains(t, registry.Register("https://example.com", CommitType{Claim: "nonce", GQCommitment: true}), "GQCommitment requires")
+}
+
+func TestCommitmentsDefaults(t *testing.T) {
+	require.Equal(t, CommitTypesEnum.AUD_CLAIM, NewGithubOp("", "").CommitType())
+	require.Equal(t, CommitTypesEnum.GQ_BOUND, NewGitlabOp(gitlabIssuer, "").CommitType())
+	require.Equal(t, CommitTypesEnum.GQ_BOUND, NewGitlabOp("https://gitlab.example.com", "").CommitType())
+	// Unregistered issuers get no default, so verifying reports the
+	// misconfiguration
+	require.Equal(t, CommitType{}, NewProviderVerifier("https://accounts.example.com", ProviderVerifierOpts{}).CommitType())
+	require.Equal(t, CommitTypesEnum.GQ_BOUND, NewProviderVerifier(gitlabIssuer, ProviderVerifierOpts{}).CommitType())
+	require.Equal(t, CommitType{}, NewProviderVerifier(gitlabIssuer, ProviderVerifierOpts{CommitmentScheme: ClaimCommitment{Claim: "nonce"}}).CommitType())
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+// hashedClaimCommitment commits to the CIC by placing the hex encoded
+// SHA256 of the CIC hash in a custom claim
+type hashedClaimCommitment struct {
+	claim string
+}
+
+func (h hashedClaimCommitment) ExtractCommitment(idt *oidc.Jwt) (string, error) {
+	claims, err := payloadClaims(idt)
+	if err != nil {
+		return "", err
+	}
+	commitment, ok := claims[h.claim].(string)
+	if !ok {
+		return "", fmt.Errorf("missing commitment claim %s", h.claim)
+	}
+	return commitment, nil
+}
+
+func (h hashedClaimCommitment) ExpectedCommitment(cic *clientinstance.Claims) (string, error) {
+	hash, err := cic.Hash()
+	if err != nil {
+		return "", err
+	}
+	return hashedCommit(string(hash)), nil
+}
+
+func hashedCommit(cicHash string) string {
+	digest := sha256.Sum256([]byte(cicHash))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestCustomCommitmentScheme(t *testing.T) {
+	testCases := []struct {
+		name     string
+		scheme   CommitmentScheme
+		expError string
+	}{
+		{name: "custom scheme", scheme: hashedClaimCommitment{claim: "opk_commit"}},
+		{name: "custom scheme wrong claim", scheme: hashedClaimCommitment{claim: "other"},
+			expError: "missing commitment claim other"},
+		{name: "nonce scheme doesn't match custom commitment", scheme: ClaimCommitment{Claim: "nonce"},
+			expError: "commitment claim doesn't match"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerOpts := DefaultMockProviderOpts()
+			op, backendMock, idtTemplate, err := NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			idtTemplate.CommitFunc = func(idtTemp *mocks.IDTokenTemplate, cicHash string) {
+				idtTemp.ExtraClaims = map[string]any{"opk_commit": hashedCommit(cicHash)}
+			}
+
+			cic := GenCICExtra(t, map[string]any{})
+			tokens, err := op.RequestTokens(context.Background(), cic)
+			require.NoError(t, err)
+
+			pv := NewProviderVerifier(op.Issuer(), ProviderVerifierOpts{
+				ClientID:          providerOpts.ClientID,
+				CommitmentScheme:  tc.scheme,
+				DiscoverPublicKey: backendMock.GetPublicKeyFinder(),
+			})
+			err = pv.VerifyIDToken(context.Background(), tokens.IDToken, cic)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by ID Token verification can be matched against these
+// with errors.Is to tell why verification failed.
+var (
+	ErrTokenExpired       = errors.New("token expired")
+	ErrTokenNotYetValid   = errors.New("token not yet valid")
+	ErrAudienceMismatch   = errors.New("audience mismatch")
+	ErrInvalidSignature   = errors.New("invalid provider signature")
+	ErrCommitmentMismatch = errors.New("commitment mismatch")
+)
+
+// kindError marks err as being of the kind of one of the errors above
+// without changing its message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+func withKind(kind error, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// ErrTimeout is matched, with errors.Is, by errors returned when the
+// caller's context deadline expires during authentication, e.g. because the
+// user never completed the login in the browser. These errors match
+// context.DeadlineExceeded as well.
+var ErrTimeout = errors.New("authentication timed out")
+
+// MarkTimeout marks err as ErrTimeout if it was returned after ctx's
+// deadline expired, otherwise err is returned unchanged.
+func MarkTimeout(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		// The operation noticed the deadline through some other error,
+		// e.g. a closed connection
+		err = fmt.Errorf("%w (%w)", err, ctx.Err())
+	}
+	return fmt.Errorf("%w: %w", ErrTimeout, err)
+}
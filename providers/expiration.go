@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/oidc"
 )
 
@@ -27,6 +28,8 @@ type ExpirationPolicy struct {
 	maxAge        time.Duration
 	checkMaxAge   bool
 	checkExpClaim bool
+	checkNbfClaim bool
+	clockSkew     clockskew.Policy
 }
 
 var ExpirationPolicies = struct {
@@ -43,15 +46,50 @@ var ExpirationPolicies = struct {
 	NEVER_EXPIRE:    ExpirationPolicy{maxAge: 0, checkMaxAge: false, checkExpClaim: false},
 }
 
+// WithClockSkew returns a copy of the policy which tolerates the
+// verifier's clock being up to skew behind or ahead of the OP's clock.
+// Negative values are treated as zero.
+func (ep ExpirationPolicy) WithClockSkew(skew time.Duration) ExpirationPolicy {
+	return ep.WithClockSkewPolicy(clockskew.New(skew))
+}
+
+// WithClockSkewPolicy is WithClockSkew for a clockskew.Policy shared with
+// the rest of the deployment
+func (ep ExpirationPolicy) WithClockSkewPolicy(skew clockskew.Policy) ExpirationPolicy {
+	ep.clockSkew = skew
+	return ep
+}
+
+// WithMaxAge returns a copy of the policy which additionally rejects ID
+// Tokens issued (iat) more than maxAge ago.
+func (ep ExpirationPolicy) WithMaxAge(maxAge time.Duration) ExpirationPolicy {
+	ep.maxAge = maxAge
+	ep.checkMaxAge = true
+	return ep
+}
+
+// WithRequireNotBefore returns a copy of the policy which requires the ID
+// Token to have a not before (nbf) claim and rejects it before that time.
+func (ep ExpirationPolicy) WithRequireNotBefore() ExpirationPolicy {
+	ep.checkNbfClaim = true
+	return ep
+}
+
 func (ep ExpirationPolicy) CheckExpiration(claims oidc.OidcClaims) error {
 	if ep.checkExpClaim {
-		err := verifyNotExpired(claims.Expiration)
+		err := verifyNotExpired(claims.Expiration, ep.clockSkew)
 		if err != nil {
 			return err
 		}
 	}
 	if ep.checkMaxAge {
-		err := checkMaxAge(claims.IssuedAt, int64(ep.maxAge.Seconds()))
+		err := checkMaxAge(claims.IssuedAt, int64(ep.maxAge.Seconds()), ep.clockSkew)
+		if err != nil {
+			return err
+		}
+	}
+	if ep.checkNbfClaim {
+		err := verifyNotBefore(claims.NotBefore, ep.clockSkew)
 		if err != nil {
 			return err
 		}
@@ -59,7 +97,13 @@ func (ep ExpirationPolicy) CheckExpiration(claims oidc.OidcClaims) error {
 	return nil
 }
 
-func verifyNotExpired(expiration int64) error {
+// checksExpiration returns true if the policy rejects tokens based on
+// their age or exp claim.
+func (ep ExpirationPolicy) checksExpiration() bool {
+	return ep.checkExpClaim || ep.checkMaxAge
+}
+
+func verifyNotExpired(expiration int64, skew clockskew.Policy) error {
 	if expiration == 0 {
 		return fmt.Errorf("missing expiration claim")
 	}
@@ -70,13 +114,13 @@ func verifyNotExpired(expiration int64) error {
 	// JWT expiration is "Seconds Since the Epoch"
 	// RFC-7519 -Section 2 https://www.rfc-editor.org/rfc/rfc7519#section-2
 	expirationTime := time.Unix(expiration, 0)
-	if !time.Now().Before(expirationTime) {
-		return fmt.Errorf("the ID token has expired (exp = %v)", expiration)
+	if skew.Expired(expirationTime, time.Now()) {
+		return withKind(ErrTokenExpired, fmt.Errorf("the ID token has expired (exp = %v)", expiration))
 	}
 	return nil
 }
 
-func checkMaxAge(issuedAt int64, maxAge int64) error {
+func checkMaxAge(issuedAt int64, maxAge int64, skew clockskew.Policy) error {
 	if issuedAt == 0 {
 		return fmt.Errorf("missing issuedAt claim")
 	}
@@ -91,8 +135,21 @@ func checkMaxAge(issuedAt int64, maxAge int64) error {
 		return fmt.Errorf("invalid values (issuedAt = %v, maxAge = %v)", issuedAt, maxAge)
 	}
 	expirationTime := time.Unix(issuedAt+maxAge, 0)
-	if !time.Now().Before(expirationTime) {
-		return fmt.Errorf("the PK token has expired based on maxAge (issuedAt = %v, maxAge = %v, expiratedAt = %v)", issuedAt, maxAge, expirationTime)
+	if skew.Expired(expirationTime, time.Now()) {
+		return withKind(ErrTokenExpired, fmt.Errorf("the PK token has expired based on maxAge (issuedAt = %v, maxAge = %v, expiratedAt = %v)", issuedAt, maxAge, expirationTime))
+	}
+	return nil
+}
+
+func verifyNotBefore(notBefore int64, skew clockskew.Policy) error {
+	if notBefore == 0 {
+		return fmt.Errorf("missing not before claim")
+	}
+	if notBefore < 0 {
+		return fmt.Errorf("not before must be greater than zero (nbf = %v)", notBefore)
+	}
+	if skew.NotYetValid(time.Unix(notBefore, 0), time.Now()) {
+		return withKind(ErrTokenNotYetValid, fmt.Errorf("the ID token is not yet valid (nbf = %v)", notBefore))
 	}
 	return nil
 }
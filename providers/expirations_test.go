@@ -21,6 +21,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/oidc"
 	"github.com/stretchr/testify/require"
 )
@@ -119,39 +120,115 @@ func TestExpirationPolicy(t *testing.T) {
 
 func TestIDTokenExpiration(t *testing.T) {
 	oneHourFromNow := time.Now().Add(1 * time.Hour)
-	err := verifyNotExpired(oneHourFromNow.Unix())
+	err := verifyNotExpired(oneHourFromNow.Unix(), clockskew.None)
 	require.NoError(t, err)
 
 	oneHourAgo := time.Now().Add(-1 * time.Hour)
-	err = verifyNotExpired(oneHourAgo.Unix())
+	err = verifyNotExpired(oneHourAgo.Unix(), clockskew.None)
 	require.ErrorContains(t, err, "the ID token has expired")
 
-	err = verifyNotExpired(0)
+	err = verifyNotExpired(0, clockskew.None)
 	require.ErrorContains(t, err, "missing expiration claim")
 
-	err = verifyNotExpired(-1)
+	err = verifyNotExpired(-1, clockskew.None)
 	require.ErrorContains(t, err, "expiration must be must be greater than zero")
 }
 
 func TestMaxAgeExpiration(t *testing.T) {
 	twoHoursAgo := time.Now().Add(-2 * time.Hour)
 	maxAgeThreeHours := int64(3 * 60 * 60) // 3 hours in seconds
-	err := checkMaxAge(twoHoursAgo.Unix(), maxAgeThreeHours)
+	err := checkMaxAge(twoHoursAgo.Unix(), maxAgeThreeHours, clockskew.None)
 	require.NoError(t, err)
 
 	maxAgeOneHour := int64(1 * 60 * 60) // 3 hours in seconds
-	err = checkMaxAge(twoHoursAgo.Unix(), maxAgeOneHour)
+	err = checkMaxAge(twoHoursAgo.Unix(), maxAgeOneHour, clockskew.None)
 	require.ErrorContains(t, err, "the PK token has expired based on maxAge")
 
-	err = checkMaxAge(0, 1)
+	err = checkMaxAge(0, 1, clockskew.None)
 	require.ErrorContains(t, err, "missing issuedAt claim")
 
-	err = checkMaxAge(-1, 1)
+	err = checkMaxAge(-1, 1, clockskew.None)
 	require.ErrorContains(t, err, "issuedAt must be must be greater than zero")
 
-	err = checkMaxAge(twoHoursAgo.Unix(), 0)
+	err = checkMaxAge(twoHoursAgo.Unix(), 0, clockskew.None)
 	require.ErrorContains(t, err, "maxAge configuration must be greater than zero")
 
-	err = checkMaxAge(math.MaxInt64, math.MaxInt64)
+	err = checkMaxAge(math.MaxInt64, math.MaxInt64, clockskew.None)
 	require.ErrorContains(t, err, "invalid values")
 }
+
+func TestExpirationPolicyOptions(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name     string
+		policy   ExpirationPolicy
+		claims   oidc.OidcClaims
+		expError string
+	}{
+		{name: "expired within clock skew",
+			policy:   ExpirationPolicies.OIDC.WithClockSkew(2 * time.Minute),
+			claims:   oidc.OidcClaims{Expiration: now.Add(-1 * time.Minute).Unix()},
+			expError: ""},
+		{name: "expired beyond clock skew",
+			policy:   ExpirationPolicies.OIDC.WithClockSkew(2 * time.Minute),
+			claims:   oidc.OidcClaims{Expiration: now.Add(-3 * time.Minute).Unix()},
+			expError: "the ID token has expired"},
+		{name: "negative clock skew treated as zero",
+			policy:   ExpirationPolicies.OIDC.WithClockSkew(-time.Hour),
+			claims:   oidc.OidcClaims{Expiration: now.Add(time.Minute).Unix()},
+			expError: ""},
+		{name: "max age added to OIDC policy",
+			policy:   ExpirationPolicies.OIDC.WithMaxAge(time.Hour),
+			claims:   oidc.OidcClaims{Expiration: now.Add(time.Hour).Unix(), IssuedAt: now.Add(-2 * time.Hour).Unix()},
+			expError: "the PK token has expired based on maxAge"},
+		{name: "max age within clock skew",
+			policy:   ExpirationPolicies.NEVER_EXPIRE.WithMaxAge(time.Hour).WithClockSkew(5 * time.Minute),
+			claims:   oidc.OidcClaims{IssuedAt: now.Add(-62 * time.Minute).Unix()},
+			expError: ""},
+		{name: "nbf required but missing",
+			policy:   ExpirationPolicies.NEVER_EXPIRE.WithRequireNotBefore(),
+			claims:   oidc.OidcClaims{},
+			expError: "missing not before claim"},
+		{name: "nbf in the past",
+			policy:   ExpirationPolicies.NEVER_EXPIRE.WithRequireNotBefore(),
+			claims:   oidc.OidcClaims{NotBefore: now.Add(-time.Minute).Unix()},
+			expError: ""},
+		{name: "nbf in the future",
+			policy:   ExpirationPolicies.NEVER_EXPIRE.WithRequireNotBefore(),
+			claims:   oidc.OidcClaims{NotBefore: now.Add(time.Minute).Unix()},
+			expError: "the ID token is not yet valid"},
+		{name: "nbf in the future within clock skew",
+			policy:   ExpirationPolicies.NEVER_EXPIRE.WithRequireNotBefore().WithClockSkew(2 * time.Minute),
+			claims:   oidc.OidcClaims{NotBefore: now.Add(time.Minute).Unix()},
+			expError: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.CheckExpiration(tc.claims)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	// Options return a copy and don't modify the predefined policies
+	_ = ExpirationPolicies.OIDC.WithMaxAge(time.Minute).WithRequireNotBefore()
+	require.NoError(t, ExpirationPolicies.OIDC.CheckExpiration(oidc.OidcClaims{Expiration: now.Add(time.Hour).Unix()}))
+}
+
+func TestExpirationErrorKinds(t *testing.T) {
+	now := time.Now()
+
+	err := ExpirationPolicies.OIDC.CheckExpiration(oidc.OidcClaims{Expiration: now.Add(-time.Hour).Unix()})
+	require.ErrorIs(t, err, ErrTokenExpired)
+	require.ErrorContains(t, err, "the ID token has expired")
+
+	err = ExpirationPolicies.MAX_AGE_24HOURS.CheckExpiration(oidc.OidcClaims{IssuedAt: now.Add(-48 * time.Hour).Unix()})
+	require.ErrorIs(t, err, ErrTokenExpired)
+
+	err = ExpirationPolicies.NEVER_EXPIRE.WithRequireNotBefore().CheckExpiration(oidc.OidcClaims{NotBefore: now.Add(time.Hour).Unix()})
+	require.ErrorIs(t, err, ErrTokenNotYetValid)
+	require.NotErrorIs(t, err, ErrTokenExpired)
+}
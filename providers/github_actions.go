@@ -23,10 +23,11 @@ import (
 	"net/http"
 	"net/url"
 
-	"github.com/awnumar/memguard"
 	"github.com/openpubkey/openpubkey/discover"
 	simpleoidc "github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/retry"
+	"github.com/openpubkey/openpubkey/util"
 )
 
 const githubIssuer = "https://token.actions.githubusercontent.com"
@@ -37,6 +38,9 @@ type GithubOp struct {
 	tokenRequestAuthToken     string
 	publicKeyFinder           discover.PublicKeyFinder
 	requestTokensOverrideFunc func(string) (*simpleoidc.Tokens, error)
+	// Retry is how the token request is retried when it fails with a
+	// transient error
+	Retry retry.Policy
 }
 
 var _ OpenIdProvider = (*GithubOp)(nil)
@@ -61,6 +65,7 @@ func NewGithubOp(tokenURL string, token string) *GithubOp {
 		tokenRequestAuthToken:     token,
 		publicKeyFinder:           *discover.DefaultPubkeyFinder(),
 		requestTokensOverrideFunc: nil,
+		Retry:                     retry.Default,
 	}
 	return op
 }
@@ -89,13 +94,13 @@ func (g *GithubOp) PublicKeyByKeyId(ctx context.Context, keyID string) (*discove
 	return g.publicKeyFinder.ByKeyID(ctx, g.issuer, keyID)
 }
 
-func (g *GithubOp) requestTokens(ctx context.Context, cicHash string) (*memguard.LockedBuffer, error) {
+func (g *GithubOp) requestTokens(ctx context.Context, cicHash string) (*util.LockedBuffer, error) {
 	if g.requestTokensOverrideFunc != nil {
 		tokens, err := g.requestTokensOverrideFunc(cicHash)
 		if err != nil {
-			return nil, fmt.Errorf("error requesting ID Token: %w", err)
+			return nil, MarkTimeout(ctx, fmt.Errorf("error requesting ID Token: %w", err))
 		}
-		return memguard.NewBufferFromBytes(tokens.IDToken), nil
+		return util.NewLockedBuffer(tokens.IDToken), nil
 	}
 
 	tokenURL, err := buildTokenURL(g.rawTokenRequestURL, cicHash)
@@ -110,7 +115,7 @@ func (g *GithubOp) requestTokens(ctx context.Context, cicHash string) (*memguard
 
 	request.Header.Set("Authorization", "Bearer "+g.tokenRequestAuthToken)
 
-	var httpClient http.Client
+	httpClient := g.Retry.Client(http.DefaultClient)
 	response, err := httpClient.Do(request)
 	if err != nil {
 		return nil, err
@@ -121,7 +126,7 @@ func (g *GithubOp) requestTokens(ctx context.Context, cicHash string) (*memguard
 		return nil, fmt.Errorf("received non-200 from jwt api: %s", http.StatusText(response.StatusCode))
 	}
 
-	rawBody, err := memguard.NewBufferFromEntireReader(response.Body)
+	rawBody, err := util.NewLockedBufferFromReader(response.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -134,10 +139,10 @@ func (g *GithubOp) requestTokens(ctx context.Context, cicHash string) (*memguard
 	if err != nil {
 		return nil, err
 	}
-	defer memguard.WipeBytes([]byte(jwt.Value))
+	defer util.WipeBytes([]byte(jwt.Value))
 
 	// json.RawMessage leaves the " (quotes) on the string. We need to remove the quotes
-	return memguard.NewBufferFromBytes(jwt.Value[1 : len(jwt.Value)-1]), nil
+	return util.NewLockedBuffer(jwt.Value[1 : len(jwt.Value)-1]), nil
 }
 
 func (g *GithubOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*simpleoidc.Tokens, error) {
@@ -149,12 +154,12 @@ func (g *GithubOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims
 
 	// Use the commitment nonce to complete the OIDC flow and get an ID token from the provider
 	idTokenLB, err := g.requestTokens(ctx, string(commitment))
-	// idTokenLB is the ID Token in a memguard LockedBuffer, this is done
+	// idTokenLB is the ID Token in a util.LockedBuffer, this is done
 	// because the ID Token contains the OPs RSA signature which is a secret
 	// in GQ signatures. For non-GQ signatures OPs RSA signature is considered
 	// a public value.
 	if err != nil {
-		return nil, fmt.Errorf("error requesting ID Token: %w", err)
+		return nil, MarkTimeout(ctx, fmt.Errorf("error requesting ID Token: %w", err))
 	}
 	defer idTokenLB.Destroy()
 	gqToken, err := CreateGQToken(ctx, idTokenLB.Bytes(), g)
@@ -166,7 +171,13 @@ func (g *GithubOp) Issuer() string {
 	return g.issuer
 }
 
+// CommitType returns the CommitType registered for the issuer in
+// Commitments, the aud claim if none is registered
+func (g *GithubOp) CommitType() CommitType {
+	return Commitments.CommitType(g.issuer, CommitTypesEnum.AUD_CLAIM)
+}
+
 func (g *GithubOp) VerifyIDToken(ctx context.Context, idt []byte, cic *clientinstance.Claims) error {
-	vp := NewProviderVerifier(g.issuer, ProviderVerifierOpts{CommitType: CommitTypesEnum.AUD_CLAIM, GQOnly: true, SkipClientIDCheck: true, ExpirationPolicy: &ExpirationPolicies.OIDC})
+	vp := NewProviderVerifier(g.issuer, ProviderVerifierOpts{CommitType: g.CommitType(), GQOnly: true, SkipClientIDCheck: true, ExpirationPolicy: &ExpirationPolicies.OIDC})
 	return vp.VerifyIDToken(ctx, idt, cic)
 }
@@ -20,10 +20,10 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/awnumar/memguard"
 	"github.com/openpubkey/openpubkey/discover"
 	simpleoidc "github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/util"
 )
 
 const gitlabIssuer = "https://gitlab.com"
@@ -83,11 +83,11 @@ func (g *GitlabOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims
 		}
 		idToken = []byte(idTokenStr)
 	}
-	// idTokenLB is the ID Token in a memguard LockedBuffer, this is done
+	// idTokenLB is the ID Token in a util.LockedBuffer, this is done
 	// because the ID Token contains the OPs RSA signature which is a secret
 	// in GQ signatures. For non-GQ signatures OPs RSA signature is considered
 	// a public value.
-	idTokenLB := memguard.NewBufferFromBytes([]byte(idToken))
+	idTokenLB := util.NewLockedBuffer([]byte(idToken))
 	defer idTokenLB.Destroy()
 	gqToken, err := CreateGQBoundToken(ctx, idTokenLB.Bytes(), g, string(cicHash))
 	if err != nil {
@@ -100,9 +100,15 @@ func (g *GitlabOp) Issuer() string {
 	return g.issuer
 }
 
+// CommitType returns the CommitType registered for the issuer in
+// Commitments, the GQ bound commitment if none is registered
+func (g *GitlabOp) CommitType() CommitType {
+	return Commitments.CommitType(g.issuer, CommitTypesEnum.GQ_BOUND)
+}
+
 func (g *GitlabOp) VerifyIDToken(ctx context.Context, idt []byte, cic *clientinstance.Claims) error {
 	vp := NewProviderVerifier(g.issuer,
-		ProviderVerifierOpts{CommitType: CommitTypesEnum.GQ_BOUND, GQOnly: true, SkipClientIDCheck: true, ExpirationPolicy: &ExpirationPolicies.OIDC},
+		ProviderVerifierOpts{CommitType: g.CommitType(), GQOnly: true, SkipClientIDCheck: true, ExpirationPolicy: &ExpirationPolicies.OIDC},
 	)
 	return vp.VerifyIDToken(ctx, idt, cic)
 }
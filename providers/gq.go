@@ -26,6 +26,7 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/telemetry"
 	"github.com/openpubkey/openpubkey/util"
 )
 
@@ -37,7 +38,10 @@ func CreateGQBoundToken(ctx context.Context, idToken []byte, op OpenIdProvider,
 	return createGQTokenAllParams(ctx, idToken, op, cicHash, true)
 }
 
-func createGQTokenAllParams(ctx context.Context, idToken []byte, op OpenIdProvider, cicHash string, gqCommitment bool) ([]byte, error) {
+func createGQTokenAllParams(ctx context.Context, idToken []byte, op OpenIdProvider, cicHash string, gqCommitment bool) (_ []byte, err error) {
+	ctx, end := telemetry.Start(ctx, telemetry.OpGQSign, telemetry.IssuerKey.String(op.Issuer()))
+	defer end(&err)
+
 	if cicHash != "" && !gqCommitment {
 		// If gqCommitment is false, we will ignore the cicHash. This is a
 		// misconfiguration, and we should fail because the caller is likely
@@ -60,7 +64,7 @@ func createGQTokenAllParams(ctx context.Context, idToken []byte, op OpenIdProvid
 		return nil, fmt.Errorf("error unmarshalling ID Token headers: %w", err)
 	}
 
-	if headers.Algorithm() != "RS256" {
+	if headers.Algorithm() != "RS256" && headers.Algorithm() != "PS256" {
 		return nil, fmt.Errorf("gq signatures require ID Token have signed with an RSA key, ID Token alg was (%s)", headers.Algorithm())
 	}
 
@@ -69,7 +73,7 @@ func createGQTokenAllParams(ctx context.Context, idToken []byte, op OpenIdProvid
 		return nil, err
 	}
 
-	if opKey.Alg != "RS256" {
+	if opKey.Alg != "RS256" && opKey.Alg != "PS256" {
 		return nil, fmt.Errorf("gq signatures require original provider to have signed with an RSA key, jWK.alg was (%s)", opKey.Alg)
 	}
 
@@ -83,9 +87,9 @@ func createGQTokenAllParams(ctx context.Context, idToken []byte, op OpenIdProvid
 	}
 
 	if cicHash == "" {
-		return gq.GQ256SignJWT(rsaKey, idToken, gq.WithExtraClaim("jkt", jktB64))
+		return gq.GQ256SignJWTContext(ctx, rsaKey, idToken, gq.WithExtraClaim("jkt", jktB64))
 	} else {
-		return gq.GQ256SignJWT(rsaKey, idToken, gq.WithExtraClaim("jkt", jktB64), gq.WithExtraClaim("cic", cicHash))
+		return gq.GQ256SignJWTContext(ctx, rsaKey, idToken, gq.WithExtraClaim("jkt", jktB64), gq.WithExtraClaim("cic", cicHash))
 	}
 }
 
@@ -35,6 +35,7 @@ func TestGQ(t *testing.T) {
 		tokenCommitType CommitType
 		gqCommitment    bool
 		cicHash         string
+		alg             string
 		wrongAlg        bool
 		wrongKid        bool
 		expError        string
@@ -47,6 +48,12 @@ func TestGQ(t *testing.T) {
 			gqCommitment:    true,
 			cicHash:         "fake-cic-hash",
 		},
+		{name: "happy case (PS256 ID Token)",
+			tokenCommitType: CommitTypesEnum.GQ_BOUND,
+			gqCommitment:    true,
+			cicHash:         "fake-cic-hash",
+			alg:             "PS256",
+		},
 		{name: "change alg to ES256, should fail",
 			tokenCommitType: CommitTypesEnum.GQ_BOUND,
 			wrongAlg:        true,
@@ -73,6 +80,9 @@ func TestGQ(t *testing.T) {
 
 			op, backend, idtTemplate, err := NewMockProvider(providerOpts)
 			require.NoError(t, err)
+			if tc.alg != "" {
+				idtTemplate.Alg = tc.alg
+			}
 
 			expPublicKey := maps.Values(backend.GetProviderPublicKeySet())[0].PublicKey
 
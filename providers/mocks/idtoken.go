@@ -21,7 +21,6 @@ import (
 	"encoding/json"
 	"time"
 
-	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/oidc"
 )
@@ -34,6 +33,7 @@ type CommitmentType struct {
 type IDTokenTemplate struct {
 	CommitFunc           func(*IDTokenTemplate, string)
 	Issuer               string
+	Subject              string // Defaults to "me" if empty
 	Nonce                string
 	NoNonce              bool
 	Aud                  string
@@ -44,6 +44,8 @@ type IDTokenTemplate struct {
 	ExtraClaims          map[string]any
 	ExtraProtectedClaims map[string]any
 	SigningKey           crypto.Signer // The key we will use to sign the ID Token
+	RemoveClaims         []string      // Claims left out of the payload, e.g. "exp"
+	SignatureMode        SignatureMode // How the ID Token is signed, defaults to a valid signature
 }
 
 func DefaultIDTokenTemplate() IDTokenTemplate {
@@ -92,8 +94,12 @@ func (t *IDTokenTemplate) IssueToken() (*oidc.Tokens, error) {
 		}
 	}
 
+	subject := t.Subject
+	if subject == "" {
+		subject = "me"
+	}
 	payloadMap := map[string]any{
-		"sub": "me",
+		"sub": subject,
 		"aud": t.Aud,
 		"iss": t.Issuer,
 		"iat": time.Now().Unix(),
@@ -110,19 +116,16 @@ func (t *IDTokenTemplate) IssueToken() (*oidc.Tokens, error) {
 		}
 	}
 
+	for _, k := range t.RemoveClaims {
+		delete(payloadMap, k)
+	}
+
 	payloadBytes, err := json.Marshal(payloadMap)
 	if err != nil {
 		return nil, err
 	}
 
-	idToken, err := jws.Sign(
-		payloadBytes,
-		jws.WithKey(
-			jwa.KeyAlgorithmFrom(t.Alg),
-			t.SigningKey,
-			jws.WithProtectedHeaders(headers),
-		),
-	)
+	idToken, err := t.sign(payloadBytes, headers)
 	if err != nil {
 		return nil, err
 	}
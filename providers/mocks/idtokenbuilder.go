@@ -0,0 +1,248 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// SignatureMode controls how an IDTokenTemplate signs the ID Token so tests
+// can check that verifiers reject badly signed ID Tokens
+type SignatureMode int
+
+const (
+	// SignValid signs the ID Token with the template's signing key
+	SignValid SignatureMode = iota
+	// SignWithWrongKey signs the ID Token with a freshly generated key of the
+	// same type as the signing key, while keeping the template's kid
+	SignWithWrongKey
+	// SignCorrupted signs the ID Token with the signing key and then flips
+	// the bits of the first byte of the signature
+	SignCorrupted
+	// SignUnsigned sets alg to "none" and leaves the signature empty
+	SignUnsigned
+	// SignAlgConfusion signs the ID Token with HS256 using the PEM encoded
+	// public key of the signing key as the HMAC secret, the classic RS256 to
+	// HS256 algorithm confusion attack
+	SignAlgConfusion
+)
+
+// NewIDTokenTemplate returns the default template which can then be changed
+// with the With methods, for instance:
+//
+//	mocks.NewIDTokenTemplate().WithSigningKey(key, kid).WithClaim("email", "alice@example.com").Expired()
+func NewIDTokenTemplate() *IDTokenTemplate {
+	t := DefaultIDTokenTemplate()
+	t.ExtraClaims = map[string]any{}
+	t.ExtraProtectedClaims = map[string]any{}
+	return &t
+}
+
+func (t *IDTokenTemplate) WithIssuer(issuer string) *IDTokenTemplate {
+	t.Issuer = issuer
+	return t
+}
+
+func (t *IDTokenTemplate) WithSubject(subject string) *IDTokenTemplate {
+	t.Subject = subject
+	return t
+}
+
+func (t *IDTokenTemplate) WithAud(aud string) *IDTokenTemplate {
+	t.Aud = aud
+	return t
+}
+
+func (t *IDTokenTemplate) WithNonce(nonce string) *IDTokenTemplate {
+	t.Nonce = nonce
+	t.NoNonce = false
+	return t
+}
+
+func (t *IDTokenTemplate) WithoutNonce() *IDTokenTemplate {
+	t.NoNonce = true
+	return t
+}
+
+func (t *IDTokenTemplate) WithSigningKey(signingKey crypto.Signer, keyID string) *IDTokenTemplate {
+	t.SigningKey = signingKey
+	t.KeyID = keyID
+	return t
+}
+
+func (t *IDTokenTemplate) WithAlg(alg string) *IDTokenTemplate {
+	t.Alg = alg
+	t.NoAlg = false
+	return t
+}
+
+// WithoutAlg leaves the alg header out of the ID Token, it is still signed
+// using the template's Alg
+func (t *IDTokenTemplate) WithoutAlg() *IDTokenTemplate {
+	t.NoAlg = true
+	return t
+}
+
+func (t *IDTokenTemplate) WithoutKeyID() *IDTokenTemplate {
+	t.NoKeyID = true
+	return t
+}
+
+func (t *IDTokenTemplate) WithCommitFunc(commitFunc func(*IDTokenTemplate, string)) *IDTokenTemplate {
+	t.CommitFunc = commitFunc
+	return t
+}
+
+// WithClaim sets a payload claim, overriding the default value of claims
+// such as sub, iat and exp
+func (t *IDTokenTemplate) WithClaim(name string, value any) *IDTokenTemplate {
+	if t.ExtraClaims == nil {
+		t.ExtraClaims = map[string]any{}
+	}
+	t.ExtraClaims[name] = value
+	return t
+}
+
+// WithoutClaim leaves a payload claim out of the ID Token
+func (t *IDTokenTemplate) WithoutClaim(name string) *IDTokenTemplate {
+	t.RemoveClaims = append(t.RemoveClaims, name)
+	return t
+}
+
+func (t *IDTokenTemplate) WithProtectedClaim(name string, value any) *IDTokenTemplate {
+	if t.ExtraProtectedClaims == nil {
+		t.ExtraProtectedClaims = map[string]any{}
+	}
+	t.ExtraProtectedClaims[name] = value
+	return t
+}
+
+func (t *IDTokenTemplate) IssuedAt(iat time.Time) *IDTokenTemplate {
+	return t.WithClaim("iat", iat.Unix())
+}
+
+func (t *IDTokenTemplate) ExpiresAt(exp time.Time) *IDTokenTemplate {
+	return t.WithClaim("exp", exp.Unix())
+}
+
+func (t *IDTokenTemplate) NotBefore(nbf time.Time) *IDTokenTemplate {
+	return t.WithClaim("nbf", nbf.Unix())
+}
+
+// Expired issues ID Tokens which were issued 3 hours ago and expired an
+// hour ago
+func (t *IDTokenTemplate) Expired() *IDTokenTemplate {
+	return t.IssuedAt(time.Now().Add(-3 * time.Hour)).ExpiresAt(time.Now().Add(-time.Hour))
+}
+
+// NotYetValid issues ID Tokens which only become valid (nbf) in an hour
+func (t *IDTokenTemplate) NotYetValid() *IDTokenTemplate {
+	return t.NotBefore(time.Now().Add(time.Hour))
+}
+
+// WithWrongCommitment makes the commit function commit to a value other
+// than the CIC hash, so the ID Token doesn't commit to the client's key
+func (t *IDTokenTemplate) WithWrongCommitment() *IDTokenTemplate {
+	commitFunc := t.CommitFunc
+	t.CommitFunc = func(idtTemp *IDTokenTemplate, cicHash string) {
+		commitFunc(idtTemp, "wrong-"+cicHash)
+	}
+	return t
+}
+
+func (t *IDTokenTemplate) WithSignatureMode(mode SignatureMode) *IDTokenTemplate {
+	t.SignatureMode = mode
+	return t
+}
+
+func (t *IDTokenTemplate) sign(payload []byte, headers jws.Headers) ([]byte, error) {
+	switch t.SignatureMode {
+	case SignValid:
+		return jws.Sign(payload, jws.WithKey(jwa.KeyAlgorithmFrom(t.Alg), t.SigningKey, jws.WithProtectedHeaders(headers)))
+	case SignWithWrongKey:
+		wrongKey, err := newKeyLike(t.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		return jws.Sign(payload, jws.WithKey(jwa.KeyAlgorithmFrom(t.Alg), wrongKey, jws.WithProtectedHeaders(headers)))
+	case SignCorrupted:
+		idToken, err := jws.Sign(payload, jws.WithKey(jwa.KeyAlgorithmFrom(t.Alg), t.SigningKey, jws.WithProtectedHeaders(headers)))
+		if err != nil {
+			return nil, err
+		}
+		headersB64, payloadB64, sigB64, err := jws.SplitCompact(idToken)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := util.Base64DecodeForJWT(sigB64)
+		if err != nil {
+			return nil, err
+		}
+		sig[0] ^= 0xff
+		return joinCompact(headersB64, payloadB64, util.Base64EncodeForJWT(sig)), nil
+	case SignUnsigned:
+		if err := headers.Set(jws.AlgorithmKey, jwa.NoSignature); err != nil {
+			return nil, err
+		}
+		headersJson, err := json.Marshal(headers)
+		if err != nil {
+			return nil, err
+		}
+		return joinCompact(util.Base64EncodeForJWT(headersJson), util.Base64EncodeForJWT(payload), nil), nil
+	case SignAlgConfusion:
+		pubKeyBytes, err := x509.MarshalPKIXPublicKey(t.SigningKey.Public())
+		if err != nil {
+			return nil, err
+		}
+		secret := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes})
+		return jws.Sign(payload, jws.WithKey(jwa.HS256, secret, jws.WithProtectedHeaders(headers)))
+	default:
+		return nil, fmt.Errorf("unknown signature mode: %d", t.SignatureMode)
+	}
+}
+
+func joinCompact(headersB64, payloadB64, sigB64 []byte) []byte {
+	compact := append([]byte{}, headersB64...)
+	compact = append(compact, '.')
+	compact = append(compact, payloadB64...)
+	compact = append(compact, '.')
+	return append(compact, sigB64...)
+}
+
+// newKeyLike generates a new key of the same type as signingKey
+func newKeyLike(signingKey crypto.Signer) (crypto.Signer, error) {
+	switch key := signingKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(rand.Reader, key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(key.Curve, rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type: %T", signingKey)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDTokenTemplateBuilder(t *testing.T) {
+	issuer := "https://accounts.example.com/"
+	mockBackend, err := NewMockProviderBackend(issuer, 1)
+	require.NoError(t, err)
+	signingKey, keyID, record := mockBackend.RandomSigningKey()
+
+	newTemplate := func() *IDTokenTemplate {
+		return NewIDTokenTemplate().
+			WithIssuer(issuer).
+			WithSigningKey(signingKey, keyID).
+			WithSubject("alice").
+			WithClaim("email", "alice@example.com").
+			WithoutClaim("nonce").
+			Expired()
+	}
+
+	tokens, err := newTemplate().IssueToken()
+	require.NoError(t, err)
+	payload, err := jws.Verify(tokens.IDToken, jws.WithKey(jwa.KeyAlgorithmFrom(record.Alg), record.PublicKey))
+	require.NoError(t, err)
+
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	require.Equal(t, issuer, claims["iss"])
+	require.Equal(t, "alice", claims["sub"])
+	require.Equal(t, "alice@example.com", claims["email"])
+	require.NotContains(t, claims, "nonce")
+	require.Less(t, int64(claims["exp"].(float64)), time.Now().Unix())
+
+	testCases := []struct {
+		name   string
+		mode   SignatureMode
+		expAlg jwa.SignatureAlgorithm
+	}{
+		{name: "wrong key", mode: SignWithWrongKey, expAlg: jwa.RS256},
+		{name: "corrupted", mode: SignCorrupted, expAlg: jwa.RS256},
+		{name: "unsigned", mode: SignUnsigned, expAlg: jwa.NoSignature},
+		{name: "alg confusion", mode: SignAlgConfusion, expAlg: jwa.HS256},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := newTemplate().WithSignatureMode(tc.mode).IssueToken()
+			require.NoError(t, err)
+
+			msg, err := jws.Parse(tokens.IDToken)
+			require.NoError(t, err)
+			require.Equal(t, tc.expAlg, msg.Signatures()[0].ProtectedHeaders().Algorithm())
+			require.Equal(t, keyID, msg.Signatures()[0].ProtectedHeaders().KeyID())
+
+			_, err = jws.Verify(tokens.IDToken, jws.WithKey(jwa.KeyAlgorithmFrom(record.Alg), record.PublicKey))
+			require.Error(t, err)
+		})
+	}
+
+	commitTemplate := NewIDTokenTemplate().WithCommitFunc(AddNonceCommit).WithWrongCommitment()
+	commitTemplate.AddCommit("cicHash")
+	require.Equal(t, "wrong-cicHash", commitTemplate.Nonce)
+}
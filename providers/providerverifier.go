@@ -21,6 +21,7 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -45,9 +46,20 @@ type ProviderVerifierOpts struct {
 	// If ClientID is specified, then verification will require that the ClientID
 	// be present in the audience ("aud") claim of the PK token payload
 	ClientID string
+	// AcceptedClientIDs lists further client IDs accepted in place of
+	// ClientID, e.g. the other registered clients of the same app family.
+	// When the audience claim has several values, the authorized party
+	// ("azp") claim must name ClientID or one of these
+	AcceptedClientIDs []string
 	// Describes the place where the cicHash is committed to in the the ID token.
-	// For instance the nonce payload claim name where the cicHash was stored during issuance
+	// For instance the nonce payload claim name where the cicHash was stored during issuance.
+	// If neither CommitType nor CommitmentScheme is set, the CommitType
+	// registered for the issuer in Commitments is used. Verifying fails if
+	// none is registered
 	CommitType CommitType
+	// CommitmentScheme, if set, is used instead of CommitType to extract the
+	// commitment from the ID token and check it against the CIC
+	CommitmentScheme CommitmentScheme
 	// Specifies whether to skip the Client ID check, defaults to false
 	SkipClientIDCheck bool
 	// Custom function for discovering public key of Provider
@@ -60,6 +72,15 @@ type ProviderVerifierOpts struct {
 	// Only allows GQ signatures, a provider signature under any other algorithm
 	// is seen as an error
 	GQOnly bool
+	// HistoricKeyStore is consulted for the OP's public key when it is no
+	// longer in the OP's JWKS. It is only used when the ExpirationPolicy
+	// doesn't check expiration, as otherwise a token signed by a rotated key
+	// would have expired anyway.
+	HistoricKeyStore discover.HistoricKeyStore
+	// HistoricKeyTolerance is how far outside the time a historic key was
+	// seen in the JWKS the ID Token may have been issued, defaults to
+	// discover.DefaultHistoricKeyTolerance
+	HistoricKeyTolerance time.Duration
 }
 
 // Creates a new ProviderVerifier with required fields
@@ -73,6 +94,12 @@ func NewProviderVerifier(issuer string, options ProviderVerifierOpts) *DefaultPr
 		options:    options,
 	}
 
+	if v.commitType == (CommitType{}) && v.options.CommitmentScheme == nil {
+		if commitType, ok := Commitments.Lookup(issuer); ok {
+			v.commitType = commitType
+		}
+	}
+
 	// If no custom DiscoverPublicKey function is set, set default
 	if v.options.DiscoverPublicKey == nil {
 		v.options.DiscoverPublicKey = discover.DefaultPubkeyFinder()
@@ -90,11 +117,20 @@ func (v *DefaultProviderVerifier) Issuer() string {
 	return v.issuer
 }
 
+// CommitType returns the CommitType the verifier checks the CIC commitment
+// with, the zero CommitType if it uses a custom CommitmentScheme
+func (v *DefaultProviderVerifier) CommitType() CommitType {
+	if v.options.CommitmentScheme != nil {
+		return CommitType{}
+	}
+	return v.commitType
+}
+
 func (v *DefaultProviderVerifier) VerifyIDToken(ctx context.Context, idToken []byte, cic *clientinstance.Claims) error {
 	// Sanity check that if GQCommitment is enabled then the other options
 	// are set correctly for doing GQ commitment verification. The intention is
 	// to catch misconfigurations early and provide meaningful error messages.
-	if v.options.CommitType.GQCommitment {
+	if v.commitType.GQCommitment && v.options.CommitmentScheme == nil {
 		if !v.options.GQOnly {
 			return fmt.Errorf("GQCommitment requires that GQOnly is true, but GQOnly is (%t)", v.options.GQOnly)
 		}
@@ -121,8 +157,8 @@ func (v *DefaultProviderVerifier) VerifyIDToken(ctx context.Context, idToken []b
 
 	// Check whether Audience claim matches provided Client ID
 	// No error is thrown if option is set to skip client ID check
-	if err := verifyAudience(idt, v.options.ClientID); err != nil && !v.options.SkipClientIDCheck {
-		return err
+	if err := verifyAudience(idt, v.clientIDs()); err != nil && !v.options.SkipClientIDCheck {
+		return withKind(ErrAudienceMismatch, err)
 	}
 
 	algStr := idt.GetSignature().GetProtectedClaims().Alg
@@ -139,7 +175,7 @@ func (v *DefaultProviderVerifier) VerifyIDToken(ctx context.Context, idToken []b
 		if err := v.verifyGQSig(ctx, idt); err != nil {
 			return fmt.Errorf("error verifying OP GQ signature on PK Token: %w", err)
 		}
-	case jwa.RS256:
+	case jwa.RS256, jwa.PS256:
 		pubKeyRecord, err := v.providerPublicKey(ctx, idToken)
 		if err != nil {
 			return fmt.Errorf("failed to get OP public key: %w", err)
@@ -152,76 +188,63 @@ func (v *DefaultProviderVerifier) VerifyIDToken(ctx context.Context, idToken []b
 		}
 
 		if _, err := jws.Verify(idToken, jws.WithKey(alg, pubKeyRecord.PublicKey)); err != nil {
-			return err
+			return withKind(ErrInvalidSignature, err)
 		}
+	default:
+		// Without this, ID Tokens using alg "none" or an HMAC algorithm
+		// would skip signature verification entirely
+		return withKind(ErrInvalidSignature, fmt.Errorf("unsupported provider algorithm: %s", alg))
 	}
 
 	if err := v.verifyCommitment(idt, cic); err != nil {
-		return err
+		return withKind(ErrCommitmentMismatch, err)
 	}
 
 	return nil
 }
 
+// PublicKeyByToken returns the OP public key the ID Token is signed with
+func (v *DefaultProviderVerifier) PublicKeyByToken(ctx context.Context, idToken []byte) (*discover.PublicKeyRecord, error) {
+	return v.providerPublicKey(ctx, idToken)
+}
+
 // This function takes in an OIDC Provider created ID token or GQ-signed modification of one and returns
 // the associated public key
 func (v *DefaultProviderVerifier) providerPublicKey(ctx context.Context, idToken []byte) (*discover.PublicKeyRecord, error) {
-	return v.options.DiscoverPublicKey.ByToken(ctx, v.Issuer(), idToken)
+	publicKeyRecord, err := v.options.DiscoverPublicKey.ByToken(ctx, v.Issuer(), idToken)
+	if err == nil || v.options.HistoricKeyStore == nil || v.options.ExpirationPolicy.checksExpiration() {
+		return publicKeyRecord, err
+	}
+
+	// The OP may have rotated the key out of its JWKS, check the historic key log
+	tolerance := v.options.HistoricKeyTolerance
+	if tolerance == 0 {
+		tolerance = discover.DefaultHistoricKeyTolerance
+	}
+	historicRecord, histErr := discover.HistoricKeyByToken(ctx, v.options.HistoricKeyStore, v.Issuer(), idToken, tolerance)
+	if histErr != nil {
+		return nil, fmt.Errorf("%w (historic key lookup: %w)", err, histErr)
+	}
+	return historicRecord, nil
 }
 
 func (v *DefaultProviderVerifier) verifyCommitment(idt *oidc.Jwt, cic *clientinstance.Claims) error {
-	var claims map[string]any
-	payload, err := util.Base64DecodeForJWT([]byte(idt.GetPayload()))
-	if err != nil {
-		return err
-	}
-	if err := json.Unmarshal(payload, &claims); err != nil {
-		return err
+	scheme := v.options.CommitmentScheme
+	if scheme == nil {
+		scheme = v.commitType.Scheme()
 	}
 
-	expectedCommitment, err := cic.Hash()
+	commitment, err := scheme.ExtractCommitment(idt)
 	if err != nil {
 		return err
 	}
-
-	var commitment any
-	var commitmentFound bool
-	if v.options.CommitType.GQCommitment {
-		aud, ok := claims["aud"]
-		if !ok {
-			return fmt.Errorf("require audience claim prefix missing in PK Token's GQCommitment")
-		}
-
-		// To prevent attacks where a attacker takes someone else's ID Token
-		// and turns it into a PK Token using a GQCommitment, we require that
-		// all GQ commitments explicitly signal they want to be used as
-		// PK Tokens. To signal this, they prefix the audience (aud)
-		// claim with the string "OPENPUBKEY-PKTOKEN:".
-		// We reject all GQ commitment PK Tokens that don't have this prefix
-		// in the aud claim.
-		if _, ok := strings.CutPrefix(aud.(string), AudPrefixForGQCommitment); !ok {
-			return fmt.Errorf("audience claim in PK Token's GQCommitment must be prefixed by (%s), got (%s) instead",
-				AudPrefixForGQCommitment, aud.(string))
-		}
-
-		// Get the commitment from the GQ signed protected header claim "cic" in the ID Token
-		commitment = idt.GetSignature().GetProtectedClaims().CIC
-		if commitment == "" {
-			return fmt.Errorf("missing GQ commitment")
-		}
-	} else {
-		if v.commitType.Claim == "" {
-			return fmt.Errorf("verifier configured with empty commitment claim")
-		}
-
-		commitment, commitmentFound = claims[v.commitType.Claim]
-		if !commitmentFound {
-			return fmt.Errorf("missing commitment claim %s", v.commitType.Claim)
-		}
+	expectedCommitment, err := scheme.ExpectedCommitment(cic)
+	if err != nil {
+		return err
 	}
 
-	if commitment != string(expectedCommitment) {
-		return fmt.Errorf("commitment claim doesn't match, got %q, expected %s", commitment, string(expectedCommitment))
+	if commitment != expectedCommitment {
+		return fmt.Errorf("commitment claim doesn't match, got %q, expected %s", commitment, expectedCommitment)
 	}
 	return nil
 }
@@ -244,8 +267,8 @@ func (v *DefaultProviderVerifier) verifyGQSig(ctx context.Context, idt *oidc.Jwt
 	}
 
 	origAlg := origHeaders.Algorithm()
-	if origAlg != jwa.RS256 {
-		return fmt.Errorf("expected original headers to contain RS256 alg, got %s", origAlg)
+	if origAlg != jwa.RS256 && origAlg != jwa.PS256 {
+		return fmt.Errorf("expected original headers to contain RS256 or PS256 alg, got %s", origAlg)
 	}
 
 	if idt.GetClaims().Issuer == "" {
@@ -255,7 +278,7 @@ func (v *DefaultProviderVerifier) verifyGQSig(ctx context.Context, idt *oidc.Jwt
 		return fmt.Errorf("issuer of ID Token (%s) doesn't match expected issuer (%s)", idt.GetClaims().Issuer, v.issuer)
 	}
 
-	publicKeyRecord, err := v.options.DiscoverPublicKey.ByToken(ctx, v.Issuer(), idt.GetRaw())
+	publicKeyRecord, err := v.providerPublicKey(ctx, idt.GetRaw())
 	if err != nil {
 		return fmt.Errorf("failed to get provider public key: %w", err)
 	}
@@ -266,10 +289,10 @@ func (v *DefaultProviderVerifier) verifyGQSig(ctx context.Context, idt *oidc.Jwt
 	}
 	ok, err = gq.GQ256VerifyJWT(rsaKey, idt.GetRaw())
 	if err != nil {
-		return err
+		return withKind(ErrInvalidSignature, err)
 	}
 	if !ok {
-		return fmt.Errorf("error verifying OP GQ signature on PK Token (ID Token invalid)")
+		return withKind(ErrInvalidSignature, fmt.Errorf("error verifying OP GQ signature on PK Token (ID Token invalid)"))
 	}
 	return nil
 }
@@ -294,16 +317,38 @@ func originalTokenHeaders(token []byte) (jws.Headers, error) {
 	return headers, nil
 }
 
-func verifyAudience(idt *oidc.Jwt, clientID string) error {
+// clientIDs returns ClientID followed by the AcceptedClientIDs
+func (v *DefaultProviderVerifier) clientIDs() []string {
+	var clientIDs []string
+	if v.options.ClientID != "" {
+		clientIDs = append(clientIDs, v.options.ClientID)
+	}
+	return append(clientIDs, v.options.AcceptedClientIDs...)
+}
 
-	if idt.GetClaims().Audience == "" {
+// verifyAudience checks that the audience claim contains one of clientIDs. As
+// OpenID Connect Core 1.0 section 3.1.3.7 recommends, ID Tokens with several
+// audiences must also have an authorized party (azp) claim naming one of
+// clientIDs, otherwise a token issued to another client could be replayed
+func verifyAudience(idt *oidc.Jwt, clientIDs []string) error {
+	claims := idt.GetClaims()
+	if claims.Audience == "" {
 		return fmt.Errorf("missing audience claim")
 	}
 
-	for _, audience := range strings.Split(idt.GetClaims().Audience, ",") {
-		if audience == clientID {
+	audiences := strings.Split(claims.Audience, ",")
+	if len(audiences) > 1 {
+		if claims.AuthorizedParty == "" {
+			return fmt.Errorf("audience has multiple values but authorized party (azp) claim is missing, aud = %v", claims.Audience)
+		}
+		if !slices.Contains(clientIDs, claims.AuthorizedParty) {
+			return fmt.Errorf("authorized party (azp) %s is not an accepted client ID", claims.AuthorizedParty)
+		}
+	}
+	for _, audience := range audiences {
+		if slices.Contains(clientIDs, audience) {
 			return nil
 		}
 	}
-	return fmt.Errorf("audience does not contain clientID %s, aud = %v", clientID, idt.GetClaims().Audience)
+	return fmt.Errorf("audience does not contain clientID %s, aud = %v", strings.Join(clientIDs, " or "), claims.Audience)
 }
@@ -18,11 +18,16 @@ package providers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/openpubkey/openpubkey/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -234,3 +239,210 @@ func TestProviderVerifier(t *testing.T) {
 		})
 	}
 }
+
+func TestProviderVerifierHistoricKeys(t *testing.T) {
+	providerOpts := DefaultMockProviderOpts()
+	op, backendMock, _, err := NewMockProvider(providerOpts)
+	require.NoError(t, err)
+
+	cic := GenCICExtra(t, map[string]any{})
+	tokens, err := op.RequestTokens(context.Background(), cic)
+	require.NoError(t, err)
+	idToken := tokens.IDToken
+
+	// Archive the OP's JWKS before it rotates its keys
+	store := discover.NewMemoryHistoricKeyStore()
+	recorder := discover.NewJwksRecorder(store, backendMock.PublicKeyFinder.JwksFunc)
+	require.NoError(t, recorder.Snapshot(context.Background(), op.Issuer()))
+
+	rotated := &discover.PublicKeyFinder{
+		JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+			return []byte(`{"keys": []}`), nil
+		},
+	}
+
+	testCases := []struct {
+		name             string
+		expirationPolicy *ExpirationPolicy
+		historicKeyStore discover.HistoricKeyStore
+		expError         string
+	}{
+		{name: "historic key used when expiration not checked",
+			expirationPolicy: &ExpirationPolicies.NEVER_EXPIRE,
+			historicKeyStore: store,
+		},
+		{name: "historic key not used when expiration checked",
+			expirationPolicy: &ExpirationPolicies.OIDC,
+			historicKeyStore: store,
+			expError:         "no matching public key found",
+		},
+		{name: "no historic key store",
+			expirationPolicy: &ExpirationPolicies.NEVER_EXPIRE,
+			expError:         "no matching public key found",
+		},
+		{name: "key missing from historic key store",
+			expirationPolicy: &ExpirationPolicies.NEVER_EXPIRE,
+			historicKeyStore: discover.NewMemoryHistoricKeyStore(),
+			expError:         "no historic public key found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pv := NewProviderVerifier(op.Issuer(), ProviderVerifierOpts{
+				CommitType:        providerOpts.VerifierOpts.CommitType,
+				ClientID:          providerOpts.ClientID,
+				DiscoverPublicKey: rotated,
+				ExpirationPolicy:  tc.expirationPolicy,
+				HistoricKeyStore:  tc.historicKeyStore,
+			})
+			err := pv.VerifyIDToken(context.Background(), idToken, cic)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProviderVerifierWithoutKeyID(t *testing.T) {
+	testCases := []struct {
+		name   string
+		gqSign bool
+	}{
+		{name: "no kid (match by signature)", gqSign: false},
+		{name: "no kid GQ (match by jkt)", gqSign: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerOpts := DefaultMockProviderOpts()
+			providerOpts.NumKeys = 3
+			providerOpts.GQSign = tc.gqSign
+			op, backendMock, idtTemplate, err := NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			idtTemplate.NoKeyID = true
+
+			cic := GenCICExtra(t, map[string]any{})
+			tokens, err := op.RequestTokens(context.Background(), cic)
+			require.NoError(t, err)
+
+			// The OP's JWKS has several keys, none of which have a kid
+			noKidFinder := &discover.PublicKeyFinder{
+				JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+					keySet := jwk.NewSet()
+					for _, record := range backendMock.GetProviderPublicKeySet() {
+						jwkKey, err := jwk.PublicKeyOf(record.PublicKey)
+						if err != nil {
+							return nil, err
+						}
+						if err := jwkKey.Set(jwk.AlgorithmKey, record.Alg); err != nil {
+							return nil, err
+						}
+						if err := keySet.AddKey(jwkKey); err != nil {
+							return nil, err
+						}
+					}
+					return json.Marshal(keySet)
+				},
+			}
+
+			pv := NewProviderVerifier(op.Issuer(), ProviderVerifierOpts{
+				CommitType:        providerOpts.VerifierOpts.CommitType,
+				ClientID:          providerOpts.ClientID,
+				DiscoverPublicKey: noKidFinder,
+			})
+			err = pv.VerifyIDToken(context.Background(), tokens.IDToken, cic)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestProviderVerifierNegativePaths(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modify   func(*mocks.IDTokenTemplate)
+		expError error
+	}{
+		{name: "happy case", modify: func(*mocks.IDTokenTemplate) {}},
+		{name: "expired", modify: func(idt *mocks.IDTokenTemplate) { idt.Expired() },
+			expError: ErrTokenExpired},
+		{name: "wrong audience", modify: func(idt *mocks.IDTokenTemplate) { idt.WithAud("wrong-client-id") },
+			expError: ErrAudienceMismatch},
+		{name: "wrong nonce", modify: func(idt *mocks.IDTokenTemplate) { idt.WithWrongCommitment() },
+			expError: ErrCommitmentMismatch},
+		{name: "wrong signing key", modify: func(idt *mocks.IDTokenTemplate) { idt.WithSignatureMode(mocks.SignWithWrongKey) },
+			expError: ErrInvalidSignature},
+		{name: "corrupted signature", modify: func(idt *mocks.IDTokenTemplate) { idt.WithSignatureMode(mocks.SignCorrupted) },
+			expError: ErrInvalidSignature},
+		{name: "unsigned", modify: func(idt *mocks.IDTokenTemplate) { idt.WithSignatureMode(mocks.SignUnsigned) },
+			expError: ErrInvalidSignature},
+		{name: "alg confusion", modify: func(idt *mocks.IDTokenTemplate) { idt.WithSignatureMode(mocks.SignAlgConfusion) },
+			expError: ErrInvalidSignature},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerOpts := DefaultMockProviderOpts()
+			op, backendMock, idtTemplate, err := NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			tc.modify(idtTemplate)
+
+			cic := GenCICExtra(t, map[string]any{})
+			tokens, err := op.RequestTokens(context.Background(), cic)
+			require.NoError(t, err)
+
+			pv := NewProviderVerifier(op.Issuer(), ProviderVerifierOpts{
+				CommitType:        providerOpts.VerifierOpts.CommitType,
+				ClientID:          providerOpts.ClientID,
+				DiscoverPublicKey: &backendMock.PublicKeyFinder,
+			})
+			err = pv.VerifyIDToken(context.Background(), tokens.IDToken, cic)
+			if tc.expError != nil {
+				require.ErrorIs(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifyAudience(t *testing.T) {
+	clientIDs := []string{"web-client", "cli-client"}
+	testCases := []struct {
+		name     string
+		claims   map[string]any
+		expError string
+	}{
+		{name: "single audience", claims: map[string]any{"aud": "web-client"}},
+		{name: "single accepted client ID", claims: map[string]any{"aud": "cli-client"}},
+		{name: "single audience, other azp", claims: map[string]any{"aud": "web-client", "azp": "android-client"}},
+		{name: "multiple audiences with azp", claims: map[string]any{"aud": []string{"web-client", "api"}, "azp": "web-client"}},
+		{name: "multiple audiences with accepted azp", claims: map[string]any{"aud": []string{"api", "cli-client"}, "azp": "cli-client"}},
+		{name: "multiple audiences without azp", claims: map[string]any{"aud": []string{"web-client", "api"}},
+			expError: "authorized party (azp) claim is missing"},
+		{name: "multiple audiences, azp not accepted", claims: map[string]any{"aud": []string{"web-client", "api"}, "azp": "api"},
+			expError: "authorized party (azp) api is not an accepted client ID"},
+		{name: "wrong audience", claims: map[string]any{"aud": "api"},
+			expError: "audience does not contain clientID web-client or cli-client"},
+		{name: "missing audience", claims: map[string]any{},
+			expError: "missing audience claim"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := json.Marshal(tc.claims)
+			require.NoError(t, err)
+			token := util.Base64EncodeForJWT([]byte(`{"alg":"RS256"}`))
+			token = append(token, '.')
+			token = append(token, util.Base64EncodeForJWT(payload)...)
+			token = append(token, []byte(".c2ln")...)
+			idt, err := oidc.NewJwt(token)
+			require.NoError(t, err)
+
+			err = verifyAudience(idt, clientIDs)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -18,15 +18,24 @@ package providers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-
-	"time"
+	"os"
+	"sync"
 
 	"github.com/google/uuid"
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/i18n"
 	simpleoidc "github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/relay"
+	"github.com/openpubkey/openpubkey/retry"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/sirupsen/logrus"
 	"github.com/zitadel/oidc/v3/pkg/client/rp"
@@ -36,12 +45,22 @@ import (
 type StandardOp struct {
 	clientID                  string
 	clientSecret              string
+	AcceptedClientIDs         []string
 	Scopes                    []string
 	RedirectURIs              []string
+	RedirectPorts             RedirectPorts
+	CallbackListener          CallbackListener
 	GQSign                    bool
 	OpenBrowser               bool
+	BrowserOpener             BrowserOpener
 	HttpClient                *http.Client
-	IssuedAtOffset            time.Duration
+	TLSConfig                 *tls.Config
+	ClockSkew                 clockskew.Policy
+	Retry                     retry.Policy
+	Relay                     *relay.Client
+	Localizer                 *i18n.Localizer
+	LoginSuccessURL           string
+	LoginFailureURL           string
 	issuer                    string
 	server                    *http.Server
 	publicKeyFinder           discover.PublicKeyFinder
@@ -54,34 +73,91 @@ var _ OpenIdProvider = (*StandardOp)(nil)
 var _ BrowserOpenIdProvider = (*StandardOp)(nil)
 var _ RefreshableOpenIdProvider = (*StandardOp)(nil)
 
+// httpClient returns the client making queries to the OP, retrying
+// transient failures under s.Retry
+func (s *StandardOp) httpClient() (*http.Client, error) {
+	httpClient := s.HttpClient
+	if s.TLSConfig != nil {
+		var err error
+		if httpClient, err = discover.TLSClient(httpClient, s.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+	return s.Retry.Client(httpClient), nil
+}
+
 func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simpleoidc.Tokens, error) {
 	if s.requestTokensOverrideFunc != nil {
 		return s.requestTokensOverrideFunc(cicHash)
 	}
+	if s.Relay != nil {
+		return s.requestTokensRelay(ctx, cicHash)
+	}
 
-	redirectURI, ln, err := FindAvailablePort(s.RedirectURIs)
+	var listener CallbackListener = s.RedirectPorts
+	if s.CallbackListener != nil {
+		listener = s.CallbackListener
+	}
+	redirectURI, ln, err := listener.Listen(s.RedirectURIs)
 	if err != nil {
 		return nil, err
 	}
-	logrus.Infof("listening on http://%s/", ln.Addr().String())
-	logrus.Info("press ctrl+c to stop")
+	// Until the server takes ownership of the listener we must close it
+	// ourselves, otherwise an error or cancellation leaves the port bound
+	serving := false
+	defer func() {
+		if !serving {
+			if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("Failed to close listener: %v", err)
+			}
+		}
+	}()
+	logrus.Info(s.Localizer.Sprintf(i18n.CLIListening, fmt.Sprintf("http://%s/", ln.Addr().String())))
+	logrus.Info(s.Localizer.Message(i18n.CLIPressCtrlC))
 
 	mux := http.NewServeMux()
-	s.server = &http.Server{Handler: mux}
+	s.server = &http.Server{
+		Handler: mux,
+		// Requests to the callback server, and so the code exchange with
+		// the OP, are cancelled along with the flow
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
 
 	cookieHandler, err := configCookieHandler()
 	if err != nil {
 		return nil, err
 	}
+	chTokens := make(chan *oidc.Tokens[*oidc.IDTokenClaims], 1)
+	chErr := make(chan error, 1)
+	// loginFailed shows the user that the login failed and ends the flow,
+	// only the first result is used so don't block on later callbacks
+	loginFailed := func(w http.ResponseWriter, r *http.Request, err error) {
+		s.renderLoginStatus(w, r, err)
+		select {
+		case chErr <- err:
+		default:
+		}
+	}
+
 	options := []rp.Option{
 		rp.WithCookieHandler(cookieHandler),
 		rp.WithVerifierOpts(
-			rp.WithIssuedAtOffset(s.IssuedAtOffset), rp.WithNonce(
+			rp.WithIssuedAtOffset(s.ClockSkew.Tolerance), rp.WithNonce(
 				func(ctx context.Context) string { return cicHash })),
+		rp.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, errorType string, errorDesc string, state string) {
+			loginFailed(w, r, fmt.Errorf("OP returned error: %s: %s", errorType, errorDesc))
+		}),
+		rp.WithUnauthorizedHandler(func(w http.ResponseWriter, r *http.Request, desc string, state string) {
+			loginFailed(w, r, errors.New(desc))
+		}),
 	}
 	options = append(options, rp.WithPKCE(cookieHandler))
-	if s.HttpClient != nil {
-		options = append(options, rp.WithHTTPClient(s.HttpClient))
+	httpClient, err := s.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		options = append(options, rp.WithHTTPClient(httpClient))
 	}
 
 	// The reason we don't set the relyingParty on the struct and reuse it,
@@ -100,15 +176,16 @@ func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simple
 		return uuid.New().String()
 	}
 
+	server := s.server
+	var shutdownOnce sync.Once
 	shutdownServer := func() {
-		if err := s.server.Shutdown(ctx); err != nil {
-			logrus.Errorf("Failed to shutdown http server: %v", err)
-		}
+		shutdownOnce.Do(func() {
+			if err := util.ShutdownServer(server); err != nil {
+				logrus.Errorf("Failed to shutdown http server: %v", err)
+			}
+		})
 	}
 
-	chTokens := make(chan *oidc.Tokens[*oidc.IDTokenClaims], 1)
-	chErr := make(chan error, 1)
-
 	mux.Handle("/login", rp.AuthURLHandler(state, relyingParty,
 		rp.WithURLParam("nonce", cicHash),
 		// Select account requires that the user click the account they want to use.
@@ -121,31 +198,34 @@ func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simple
 
 	marshalToken := func(w http.ResponseWriter, r *http.Request, retTokens *oidc.Tokens[*oidc.IDTokenClaims], state string, rp rp.RelyingParty) {
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			chErr <- err
+			loginFailed(w, r, err)
 			return
 		}
 
-		chTokens <- retTokens
+		select {
+		case chTokens <- retTokens:
+		default:
+		}
 
 		// If defined the OIDC client hands over control of the HTTP server session to the OpenPubkey client.
 		// Useful for redirecting the user's browser window that just finished OIDC Auth flow to the
 		// MFA Cosigner Auth URI.
 		if s.httpSessionHook != nil {
 			s.httpSessionHook(w, r)
-			defer shutdownServer() // If no http session hook is set, we do server shutdown in RequestTokens
+			// If no http session hook is set, we do server shutdown in RequestTokens.
+			// Shutdown waits for this handler to return, so don't block on it.
+			defer func() { go shutdownServer() }()
 		} else {
-			if _, err := w.Write([]byte("You may now close this window")); err != nil {
-				logrus.Error(err)
-			}
+			s.renderLoginStatus(w, r, nil)
 		}
 	}
 
 	callbackPath := redirectURI.Path
 	mux.Handle(callbackPath, rp.CodeExchangeHandler(marshalToken, relyingParty))
 
+	serving = true
 	go func() {
-		err := s.server.Serve(ln)
+		err := server.Serve(ln)
 		if err != nil && err != http.ErrServerClosed {
 			logrus.Error(err)
 		}
@@ -156,10 +236,19 @@ func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simple
 	// If reuseBrowserWindowHook is set, don't open a new browser window
 	// instead redirect the user's existing browser window
 	if s.reuseBrowserWindowHook != nil {
-		s.reuseBrowserWindowHook <- loginURI
+		select {
+		case s.reuseBrowserWindowHook <- loginURI:
+		case <-ctx.Done():
+			shutdownServer()
+			return nil, ctx.Err()
+		}
 	} else if s.OpenBrowser {
-		logrus.Infof("Opening browser to on http://%s/", loginURI)
-		if err := util.OpenUrl(loginURI); err != nil {
+		logrus.Info(s.Localizer.Sprintf(i18n.CLIOpenBrowser, loginURI))
+		var opener BrowserOpener = BrowserOpenerFunc(util.OpenUrl)
+		if s.BrowserOpener != nil {
+			opener = s.BrowserOpener
+		}
+		if err := opener.OpenURL(loginURI); err != nil {
 			logrus.Errorf("Failed to open url: %v", err)
 		}
 	}
@@ -175,11 +264,19 @@ func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simple
 	}
 	select {
 	case <-ctx.Done():
+		if s.httpSessionHook != nil {
+			// The hook will never run so we have to shut the server down
+			defer shutdownServer()
+		}
 		return nil, ctx.Err()
 	case err := <-chErr:
 		if s.httpSessionHook != nil {
 			defer shutdownServer()
 		}
+		if ctx.Err() != nil {
+			// The code exchange failed because the flow was cancelled
+			return nil, ctx.Err()
+		}
 		return nil, err
 	case retTokens := <-chTokens:
 		// retTokens is a zitadel/oidc struct. We turn it into our simpler token struct
@@ -190,6 +287,85 @@ func (s *StandardOp) requestTokens(ctx context.Context, cicHash string) (*simple
 	}
 }
 
+// renderLoginStatus shows the user whether the login succeeded, by
+// redirecting to LoginSuccessURL or LoginFailureURL if set
+func (s *StandardOp) renderLoginStatus(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil && s.LoginSuccessURL != "":
+		http.Redirect(w, r, s.LoginSuccessURL, http.StatusFound)
+	case err == nil:
+		s.Localizer.RenderStatusPage(w, r, i18n.LoginSuccessPage, i18n.LoginComplete, "")
+	case s.LoginFailureURL != "":
+		http.Redirect(w, r, s.LoginFailureURL, http.StatusFound)
+	default:
+		s.Localizer.RenderStatusPage(w, r, i18n.LoginFailurePage, i18n.LoginFailed, err.Error())
+	}
+}
+
+// requestTokensRelay runs the authorization code flow with the user
+// logging in on another device through the relay. The authorization code
+// is redeemed here with the PKCE verifier, the relay never sees it.
+func (s *StandardOp) requestTokensRelay(ctx context.Context, cicHash string) (*simpleoidc.Tokens, error) {
+	options := []rp.Option{
+		rp.WithVerifierOpts(
+			rp.WithIssuedAtOffset(s.ClockSkew.Tolerance), rp.WithNonce(
+				func(ctx context.Context) string { return cicHash })),
+	}
+	httpClient, err := s.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		options = append(options, rp.WithHTTPClient(httpClient))
+	}
+	relyingParty, err := rp.NewRelyingPartyOIDC(ctx,
+		s.issuer, s.clientID, s.clientSecret, s.Relay.CallbackURL(),
+		s.Scopes, options...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating provider: %w", err)
+	}
+
+	codeVerifier := make([]byte, 32)
+	if _, err := rand.Read(codeVerifier); err != nil {
+		return nil, err
+	}
+	pkceVerifier := base64.RawURLEncoding.EncodeToString(codeVerifier)
+	state := uuid.New().String()
+	authURL := rp.AuthURL(state, relyingParty,
+		rp.WithCodeChallenge(oidc.NewSHACodeChallenge(pkceVerifier)),
+		rp.AuthURLOpt(rp.WithURLParam("nonce", cicHash)),
+		rp.AuthURLOpt(rp.WithPromptURLParam("consent")),
+		rp.AuthURLOpt(rp.WithURLParam("access_type", "offline")))
+
+	start, err := s.Relay.Start(ctx, authURL, state)
+	if err != nil {
+		return nil, fmt.Errorf("error starting login session at relay: %w", err)
+	}
+	prompt := s.Relay.Prompt
+	if prompt == nil {
+		prompt = os.Stderr
+	}
+	if err := relay.WritePrompt(prompt, start); err != nil {
+		return nil, err
+	}
+
+	res, err := s.Relay.Wait(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	if res.State != state {
+		return nil, fmt.Errorf("relay returned the authorization response of another login")
+	}
+	retTokens, err := rp.CodeExchange[*oidc.IDTokenClaims](ctx, res.Code, relyingParty, rp.WithCodeVerifier(pkceVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %w", err)
+	}
+	return &simpleoidc.Tokens{
+		IDToken:      []byte(retTokens.IDToken),
+		RefreshToken: []byte(retTokens.RefreshToken),
+		AccessToken:  []byte(retTokens.AccessToken)}, nil
+}
+
 func (s *StandardOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*simpleoidc.Tokens, error) {
 	// Define our commitment as the hash of the client instance claims
 	cicHash, err := cic.Hash()
@@ -198,7 +374,7 @@ func (s *StandardOp) RequestTokens(ctx context.Context, cic *clientinstance.Clai
 	}
 	tokens, err := s.requestTokens(ctx, string(cicHash))
 	if err != nil {
-		return nil, err
+		return nil, MarkTimeout(ctx, err)
 	}
 	if s.GQSign {
 		idToken := tokens.IDToken
@@ -220,13 +396,17 @@ func (s *StandardOp) RefreshTokens(ctx context.Context, refreshToken []byte) (*s
 	options := []rp.Option{
 		rp.WithCookieHandler(cookieHandler),
 		rp.WithVerifierOpts(
-			rp.WithIssuedAtOffset(s.IssuedAtOffset),
+			rp.WithIssuedAtOffset(s.ClockSkew.Tolerance),
 			rp.WithNonce(nil), // disable nonce check
 		),
 	}
 	options = append(options, rp.WithPKCE(cookieHandler))
-	if s.HttpClient != nil {
-		options = append(options, rp.WithHTTPClient(s.HttpClient))
+	httpClient, err := s.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		options = append(options, rp.WithHTTPClient(httpClient))
 	}
 
 	// The redirect URI is not sent in the refresh request so we set it to an empty string.
@@ -237,11 +417,11 @@ func (s *StandardOp) RefreshTokens(ctx context.Context, refreshToken []byte) (*s
 	relyingParty, err := rp.NewRelyingPartyOIDC(ctx, s.issuer, s.clientID,
 		s.clientSecret, redirectURI, s.Scopes, options...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create RP to verify token: %w", err)
+		return nil, MarkTimeout(ctx, fmt.Errorf("failed to create RP to verify token: %w", err))
 	}
 	retTokens, err := rp.RefreshTokens[*oidc.IDTokenClaims](ctx, relyingParty, string(refreshToken), "", "")
 	if err != nil {
-		return nil, err
+		return nil, MarkTimeout(ctx, err)
 	}
 
 	if retTokens.RefreshToken == "" {
@@ -273,17 +453,25 @@ func (s *StandardOp) ClientID() string {
 	return s.clientID
 }
 
+// CommitType returns the CommitType registered for the issuer in
+// Commitments, the nonce claim if none is registered
+func (s *StandardOp) CommitType() CommitType {
+	return Commitments.CommitType(s.issuer, CommitTypesEnum.NONCE_CLAIM)
+}
+
 func (s *StandardOp) VerifyIDToken(ctx context.Context, idt []byte, cic *clientinstance.Claims) error {
+	// For user access we override the ID Token expiration claim
+	// and instead have tokens expire after 24 hours so that
+	// users don't have log back in every hour.
+	expirationPolicy := ExpirationPolicies.MAX_AGE_24HOURS.WithClockSkewPolicy(s.ClockSkew)
 	vp := NewProviderVerifier(
 		s.issuer,
 		ProviderVerifierOpts{
-			CommitType:        CommitTypesEnum.NONCE_CLAIM,
+			CommitType:        s.CommitType(),
 			ClientID:          s.clientID,
+			AcceptedClientIDs: s.AcceptedClientIDs,
 			DiscoverPublicKey: &s.publicKeyFinder,
-			// For user access we override the ID Token expiration claim
-			// and instead have tokens expire after 24 hours so that
-			// users don't have log back in every hour.
-			ExpirationPolicy: &ExpirationPolicies.MAX_AGE_24HOURS,
+			ExpirationPolicy:  &expirationPolicy,
 		})
 	return vp.VerifyIDToken(ctx, idt, cic)
 }
@@ -297,8 +485,12 @@ func (s *StandardOp) VerifyRefreshedIDToken(ctx context.Context, origIdt []byte,
 	}
 
 	options := []rp.Option{}
-	if s.HttpClient != nil {
-		options = append(options, rp.WithHTTPClient(s.HttpClient))
+	httpClient, err := s.httpClient()
+	if err != nil {
+		return err
+	}
+	if httpClient != nil {
+		options = append(options, rp.WithHTTPClient(httpClient))
 	}
 	redirectURI := ""
 	relyingParty, err := rp.NewRelyingPartyOIDC(ctx, s.issuer, s.clientID,
@@ -0,0 +1,139 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandardOpRequestTokensCancel(t *testing.T) {
+	// Serve just enough of an OP for the relying party to be created
+	var issuer string
+	opServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	}))
+	defer opServer.Close()
+	issuer = opServer.URL
+
+	testCases := []struct {
+		name string
+		// stage cancels the context at a particular point of the flow
+		stage     string
+		reuseHook bool
+		expErr    error
+	}{
+		{name: "cancelled before start", stage: "before", expErr: context.Canceled},
+		{name: "cancelled waiting for callback", stage: "callback", expErr: context.Canceled},
+		{name: "cancelled waiting for browser window hook", stage: "callback", reuseHook: true, expErr: context.Canceled},
+		{name: "deadline waiting for callback", stage: "deadline", expErr: context.DeadlineExceeded},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			port := freePort(t)
+			op := &StandardOp{
+				issuer:       issuer,
+				clientID:     "test-client-id",
+				Scopes:       []string{"openid"},
+				RedirectURIs: []string{fmt.Sprintf("http://localhost:%d/login-callback", port)},
+				OpenBrowser:  false,
+			}
+			if tc.reuseHook {
+				// Nobody reads from this hook, so the flow blocks sending to it
+				op.ReuseBrowserWindowHook(make(chan string))
+			}
+
+			var ctx context.Context
+			var cancel context.CancelFunc
+			switch tc.stage {
+			case "before":
+				ctx, cancel = context.WithCancel(context.Background())
+				cancel()
+			case "callback":
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(200*time.Millisecond, cancel)
+			case "deadline":
+				ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+			}
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := op.requestTokens(ctx, "cicHash")
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				require.ErrorIs(t, err, tc.expErr)
+			case <-time.After(10 * time.Second):
+				t.Fatal("requestTokens did not return after the context was cancelled")
+			}
+
+			// The callback port must have been released
+			ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+			require.NoError(t, err, "callback listener was not closed")
+			require.NoError(t, ln.Close())
+		})
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+	return port
+}
+
+func TestMarkTimeout(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-expired.Done()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := MarkTimeout(expired, expired.Err())
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, err, MarkTimeout(expired, err))
+
+	// Errors caused by the deadline are marked even if they don't wrap it
+	err = MarkTimeout(expired, errors.New("connection closed"))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "connection closed")
+
+	require.NotErrorIs(t, MarkTimeout(cancelled, cancelled.Err()), ErrTimeout)
+	require.NotErrorIs(t, MarkTimeout(context.Background(), context.DeadlineExceeded), ErrTimeout)
+	require.NoError(t, MarkTimeout(expired, nil))
+}
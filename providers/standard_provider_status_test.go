@@ -0,0 +1,222 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/i18n"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandardOpLoginFailedPage(t *testing.T) {
+	var issuer string
+	opServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	}))
+	defer opServer.Close()
+	issuer = opServer.URL
+
+	testCases := []struct {
+		name            string
+		loginFailureURL string
+		expLocation     string
+		expBody         string
+	}{
+		{name: "custom template", expBody: "<h1>Acme</h1><p>Login failed: OP returned error: access_denied: user declined</p>"},
+		{name: "redirect", loginFailureURL: "https://example.com/failed", expLocation: "https://example.com/failed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			port := freePort(t)
+			op := &StandardOp{
+				issuer:          issuer,
+				clientID:        "test-client-id",
+				Scopes:          []string{"openid"},
+				RedirectURIs:    []string{fmt.Sprintf("http://localhost:%d/login-callback", port)},
+				LoginFailureURL: tc.loginFailureURL,
+				Localizer: &i18n.Localizer{Templates: map[string]*template.Template{
+					i18n.LoginFailurePage: template.Must(template.New("").Parse(`<h1>Acme</h1><p>{{.T .Data.Message}}: {{.Data.Detail}}</p>`)),
+				}},
+			}
+			loginURIs := make(chan string, 1)
+			op.ReuseBrowserWindowHook(loginURIs)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				_, err := op.requestTokens(ctx, "cicHash")
+				done <- err
+			}()
+
+			// Follow the login page to the OP, which sends the user back
+			// with an error
+			jar, err := cookiejar.New(nil)
+			require.NoError(t, err)
+			browser := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			res, err := browser.Get(<-loginURIs)
+			require.NoError(t, err)
+			res.Body.Close()
+			authURL, err := url.Parse(res.Header.Get("Location"))
+			require.NoError(t, err)
+			callback := op.RedirectURIs[0] + "?" + url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"user declined"},
+				"state":             {authURL.Query().Get("state")},
+			}.Encode()
+			res, err = browser.Get(callback)
+			require.NoError(t, err)
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			res.Body.Close()
+
+			if tc.expLocation != "" {
+				require.Equal(t, http.StatusFound, res.StatusCode)
+				require.Equal(t, tc.expLocation, res.Header.Get("Location"))
+			} else {
+				require.Equal(t, tc.expBody, string(body))
+			}
+			require.ErrorContains(t, <-done, "access_denied")
+		})
+	}
+}
+
+// pipeListener is a net.Listener without sockets, like one a browser
+// extension would serve the callback over under js/wasm
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Listen(redirectURIs []string) (*url.URL, net.Listener, error) {
+	u, err := url.Parse(redirectURIs[0])
+	return u, l, err
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func (l *pipeListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestStandardOpCallbackListenerAndBrowserOpener(t *testing.T) {
+	var issuer string
+	opServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	}))
+	defer opServer.Close()
+	issuer = opServer.URL
+
+	listener := &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	loginURIs := make(chan string, 1)
+	op := &StandardOp{
+		issuer:           issuer,
+		clientID:         "test-client-id",
+		Scopes:           []string{"openid"},
+		RedirectURIs:     []string{"http://localhost:1/login-callback"},
+		CallbackListener: listener,
+		OpenBrowser:      true,
+		BrowserOpener: BrowserOpenerFunc(func(url string) error {
+			loginURIs <- url
+			return nil
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := op.requestTokens(ctx, "cicHash")
+		done <- err
+	}()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	browser := &http.Client{
+		Jar:       jar,
+		Transport: &http.Transport{DialContext: listener.dial},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	loginURI := <-loginURIs
+	require.Equal(t, "http://localhost:1/login", loginURI)
+	res, err := browser.Get(loginURI)
+	require.NoError(t, err)
+	res.Body.Close()
+	authURL, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, op.RedirectURIs[0], authURL.Query().Get("redirect_uri"))
+
+	res, err = browser.Get(op.RedirectURIs[0] + "?" + url.Values{
+		"error": {"access_denied"},
+		"state": {authURL.Query().Get("state")},
+	}.Encode())
+	require.NoError(t, err)
+	res.Body.Close()
+	require.ErrorContains(t, <-done, "access_denied")
+}
@@ -18,11 +18,17 @@ package providers
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/discover"
 	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/openpubkey/openpubkey/retry"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/stretchr/testify/require"
 )
@@ -88,3 +94,43 @@ func TestGoogleSimpleRequest(t *testing.T) {
 	require.Equal(t, "mock-refresh-token", string(tokens.RefreshToken))
 	require.Equal(t, "mock-access-token", string(tokens.AccessToken))
 }
+
+func TestStandardOpTLSConfig(t *testing.T) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	jwksFunc, err := discover.MockGetJwksByIssuerOneKey(signer.Public(), "kid-1", "ES256")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwks, _ := jwksFunc(r.Context(), server.URL)
+		_, _ = w.Write(jwks)
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	opts := GetDefaultGoogleOpOptions()
+	opts.Issuer = server.URL
+	opts.Retry = retry.Policy{}
+	op := NewGoogleOpWithOptions(opts)
+	_, err = op.PublicKeyByKeyId(context.Background(), "kid-1")
+	require.ErrorContains(t, err, "certificate")
+
+	opts.TLSConfig = discover.RootCAsTLSConfig(roots)
+	op = NewGoogleOpWithOptions(opts)
+	record, err := op.PublicKeyByKeyId(context.Background(), "kid-1")
+	require.NoError(t, err)
+	require.Equal(t, signer.Public(), record.PublicKey)
+
+	// A TLS config that can't be applied to the HttpClient fails rather
+	// than falling back to the system trust store
+	opts.HttpClient = retry.Default.Client(nil)
+	op = NewGoogleOpWithOptions(opts)
+	_, err = op.PublicKeyByKeyId(context.Background(), "kid-1")
+	require.ErrorContains(t, err, "can't apply TLS config")
+}
@@ -22,15 +22,71 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 
 	httphelper "github.com/zitadel/oidc/v3/pkg/http"
 )
 
+// CallbackListener opens the listener the local callback server of the
+// browser login serves on and returns the redirect URI to send to the OP.
+// RedirectPorts listens on a local TCP port. Where there are no sockets,
+// e.g. under js/wasm, a browser extension can intercept the redirect and
+// serve it over its own net.Listener.
+type CallbackListener interface {
+	Listen(redirectURIs []string) (*url.URL, net.Listener, error)
+}
+
+// BrowserOpener opens the login page in the user's browser
+type BrowserOpener interface {
+	OpenURL(url string) error
+}
+
+// BrowserOpenerFunc lets an ordinary function be used as a BrowserOpener
+type BrowserOpenerFunc func(url string) error
+
+func (f BrowserOpenerFunc) OpenURL(url string) error {
+	return f(url)
+}
+
+// RedirectPorts says where the local callback server the OP redirects the
+// browser to may listen, beyond the ports of the redirect URIs
+type RedirectPorts struct {
+	// BindAddress is the address the callback server listens on, localhost
+	// if empty. Set it to e.g. 0.0.0.0 only when the browser can't reach
+	// this machine's loopback interface, such as from outside a container.
+	BindAddress string
+	// FirstPort and LastPort, if set, are an inclusive range of ports tried
+	// after those of the redirect URIs. The first redirect URI with the
+	// port replaced is sent to the OP, which must accept all of them.
+	FirstPort int
+	LastPort  int
+	// Ephemeral has the operating system pick a free port if all others are
+	// in use. Only use it with OPs that accept any port in loopback redirect
+	// URIs as RFC 8252 section 7.3 requires.
+	Ephemeral bool
+}
+
 // FindAvailablePort attempts to open a listener on localhost until it finds one or runs out of redirectURIs to try
 func FindAvailablePort(redirectURIs []string) (*url.URL, net.Listener, error) {
+	return RedirectPorts{}.Listen(redirectURIs)
+}
+
+// Listen opens a listener for the callback server on the port of the first
+// redirect URI that is free, then on the range of ports and then on an
+// ephemeral port, and returns the redirect URI to send to the OP
+func (p RedirectPorts) Listen(redirectURIs []string) (*url.URL, net.Listener, error) {
+	if p.FirstPort < 0 || p.LastPort > 65535 || p.FirstPort > p.LastPort {
+		return nil, nil, fmt.Errorf("invalid redirect port range %d-%d", p.FirstPort, p.LastPort)
+	}
+	bindAddress := p.BindAddress
+	if bindAddress == "" {
+		bindAddress = "localhost"
+	}
+
 	var ln net.Listener
 	var lnErr error
+	var template *url.URL
 	for _, v := range redirectURIs {
 		redirectURI, err := url.Parse(v)
 		if err != nil {
@@ -43,16 +99,46 @@ func FindAvailablePort(redirectURIs []string) (*url.URL, net.Listener, error) {
 			strings.HasPrefix(redirectURI.Host, "::1")) {
 			return nil, nil, fmt.Errorf("redirectURI must be localhost, redirectURI was  %s", redirectURI.Host)
 		}
+		if template == nil {
+			template = redirectURI
+		}
 
-		lnStr := fmt.Sprintf("localhost:%s", redirectURI.Port())
-		ln, lnErr = net.Listen("tcp", lnStr)
+		ln, lnErr = net.Listen("tcp", net.JoinHostPort(bindAddress, redirectURI.Port()))
 		if lnErr == nil {
 			return redirectURI, ln, nil
 		}
 	}
+
+	if p.LastPort == 0 && !p.Ephemeral {
+		return nil, nil, fmt.Errorf("failed to start a listener for the callback from the OP, got %w", lnErr)
+	}
+	if template == nil {
+		return nil, nil, fmt.Errorf("a redirectURI is required to listen on other ports")
+	}
+	if p.LastPort != 0 {
+		for port := p.FirstPort; port <= p.LastPort; port++ {
+			ln, lnErr = net.Listen("tcp", net.JoinHostPort(bindAddress, strconv.Itoa(port)))
+			if lnErr == nil {
+				return withPort(template, port), ln, nil
+			}
+		}
+	}
+	if p.Ephemeral {
+		ln, lnErr = net.Listen("tcp", net.JoinHostPort(bindAddress, "0"))
+		if lnErr == nil {
+			return withPort(template, ln.Addr().(*net.TCPAddr).Port), ln, nil
+		}
+	}
 	return nil, nil, fmt.Errorf("failed to start a listener for the callback from the OP, got %w", lnErr)
 }
 
+// withPort returns a copy of the redirect URI with the port replaced
+func withPort(redirectURI *url.URL, port int) *url.URL {
+	u := *redirectURI
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	return &u
+}
+
 func configCookieHandler() (*httphelper.CookieHandler, error) {
 	// I've been unable to determine a scenario in which setting a hashKey and blockKey
 	// on the cookie provide protection in the localhost redirect URI case. However I
@@ -83,6 +83,33 @@ func TestFindAvailablePort(t *testing.T) {
 	}
 }
 
+func TestRedirectPorts(t *testing.T) {
+	redirects := []string{"http://localhost:21111/login-callback"}
+	blocked, err := net.Listen("tcp", "localhost:21111")
+	require.NoError(t, err)
+	defer blocked.Close()
+
+	_, _, err = RedirectPorts{}.Listen(redirects)
+	require.ErrorContains(t, err, "failed to start a listener for the callback")
+
+	foundURI, ln, err := RedirectPorts{FirstPort: 21111, LastPort: 21113}.Listen(redirects)
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:21112/login-callback", foundURI.String())
+	require.NoError(t, ln.Close())
+
+	foundURI, ln, err = RedirectPorts{BindAddress: "127.0.0.1", Ephemeral: true}.Listen(redirects)
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.Equal(t, fmt.Sprintf("http://localhost:%d/login-callback", port), foundURI.String())
+	require.Equal(t, "127.0.0.1", ln.Addr().(*net.TCPAddr).IP.String())
+	require.NoError(t, ln.Close())
+
+	_, _, err = RedirectPorts{Ephemeral: true}.Listen(nil)
+	require.ErrorContains(t, err, "redirectURI is required")
+	_, _, err = RedirectPorts{FirstPort: 21113, LastPort: 21111}.Listen(redirects)
+	require.ErrorContains(t, err, "invalid redirect port range")
+}
+
 func TestConfigCookieHandler(t *testing.T) {
 	cookieHandler, err := configCookieHandler()
 	require.NoError(t, err)
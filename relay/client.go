@@ -0,0 +1,125 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client starts sessions at a relay served by NewHandler and waits for the
+// user to log in
+type Client struct {
+	// URL is the relay's URL
+	URL string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Prompt is where the QR code, login URL and binding code are written
+	// for the user, defaults to os.Stderr
+	Prompt io.Writer
+}
+
+// CallbackURL is the redirect URI to request authorization with
+func (c *Client) CallbackURL() string {
+	return strings.TrimSuffix(c.URL, "/") + CallbackPath
+}
+
+// Start starts a session which sends the user to authURL, which must
+// redirect to CallbackURL with state
+func (c *Client) Start(ctx context.Context, authURL string, state string) (*StartResponse, error) {
+	var start StartResponse
+	if status, err := c.post(ctx, SessionsPath, url.Values{"auth_url": {authURL}, "state": {state}}, &start); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, fmt.Errorf("relay returned error status: %d", status)
+	}
+	return &start, nil
+}
+
+// Wait polls the session until the user has logged in and returns the OP's
+// authorization response
+func (c *Client) Wait(ctx context.Context, start *StartResponse) (*PollResponse, error) {
+	interval := time.Duration(start.Interval) * time.Second
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		var res PollResponse
+		status, err := c.post(ctx, PollPath, url.Values{"session_id": {start.SessionID}}, &res)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case status == http.StatusOK:
+			return &res, nil
+		case res.Error == ErrAuthorizationPending:
+			continue
+		case res.Error == ErrExpiredToken:
+			return nil, fmt.Errorf("login session expired before the user logged in")
+		case res.ErrorDescription != "":
+			return nil, fmt.Errorf("login failed: %s: %s", res.Error, res.ErrorDescription)
+		default:
+			return nil, fmt.Errorf("login failed: %s", res.Error)
+		}
+	}
+}
+
+// post sends the form to the relay and decodes the JSON response into v,
+// returning the response status
+func (c *Client) post(ctx context.Context, path string, form url.Values, v any) (int, error) {
+	uri, err := url.JoinPath(c.URL, path)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error contacting relay: %w", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "application/json" {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return 0, fmt.Errorf("relay returned error status: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return 0, fmt.Errorf("malformed response from relay: %w", err)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package relay
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// quietZone is the light border QR codes need around them to be scanned
+const quietZone = 4
+
+// WritePrompt writes the instructions for the user to log in on another
+// device: the login URL as a QR code and as text, and the binding code
+func WritePrompt(w io.Writer, start *StartResponse) error {
+	code, err := qr.Encode(start.LoginURL, qr.M)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "To log in, scan this QR code or open %s on another device\n%s"+
+		"and enter the code %s\n", start.LoginURL, renderQR(code), start.BindingCode)
+	return err
+}
+
+// renderQR draws the QR code with half block characters, two modules per
+// line. Light modules are drawn, so dark terminal backgrounds show through
+// as the dark modules.
+func renderQR(code *qr.Code) string {
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	var b strings.Builder
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,444 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package relay lets a user log in to an OpenID Provider on another device,
+// such as their phone, for a machine without a browser, such as a headless
+// server. It complements the device authorization grant (RFC 8628) for OPs
+// that don't support it.
+//
+// The requesting machine starts a session at the relay with the OP's
+// authorization URL, whose redirect URI is the relay's callback, and shows
+// the session's login URL as a QR code along with a binding code. The user
+// opens the login URL on their phone and has to enter the binding code
+// shown by the machine before the relay sends them on to the OP. This
+// keeps someone else from getting the user to complete a login for their
+// machine by sending them a link. The OP redirects the user back to the
+// relay, which holds the authorization code for the machine polling the
+// session. The machine redeems the code with its PKCE verifier, so the
+// relay never sees the tokens, and the ID Token's nonce commits to the
+// machine's CIC just as in the local browser flow.
+//
+// The relay's CallbackURL must be registered as a redirect URI of the OIDC
+// client at the OP. See providers.StandardOp.Relay for the machine's side.
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionsPath is where machines start sessions
+	SessionsPath = "/sessions"
+	// PollPath is where machines poll their session for the authorization
+	// code
+	PollPath = "/sessions/poll"
+	// LoginPath is the page the user opens, LoginURL of a session
+	LoginPath = "/login"
+	// CallbackPath is where the OP redirects the user after logging in
+	CallbackPath = "/callback"
+
+	// DefaultSessionLifetime is how long the user has to log in after the
+	// machine starts a session
+	DefaultSessionLifetime = 10 * time.Minute
+	// DefaultPollInterval is how long machines wait between polls
+	DefaultPollInterval = 2 * time.Second
+
+	// maxBindingAttempts is how often a wrong binding code may be entered
+	// before the session fails, a binding code has a million values
+	maxBindingAttempts = 5
+	bindingCodeDigits  = 6
+	loginCodeLength    = 8
+	// loginCodeAlphabet has no vowels so that login codes don't spell words
+	loginCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// Poll error codes, named after those of RFC 8628 section 3.5
+const (
+	ErrAuthorizationPending = "authorization_pending"
+	ErrAccessDenied         = "access_denied"
+	ErrExpiredToken         = "expired_token"
+)
+
+// StartResponse is the relay's response to starting a session
+type StartResponse struct {
+	// SessionID is the secret the machine polls the session with
+	SessionID string `json:"session_id"`
+	// LoginURL is the page the user opens, e.g. by scanning a QR code
+	LoginURL string `json:"login_url"`
+	// BindingCode is shown by the machine and entered by the user on the
+	// login page
+	BindingCode string `json:"binding_code"`
+	ExpiresIn   int    `json:"expires_in"`
+	Interval    int    `json:"interval"`
+}
+
+// PollResponse is the relay's response to polling a session. Once the user
+// has logged in it carries the OP's authorization response, otherwise
+// Error says why not.
+type PollResponse struct {
+	Code  string `json:"code,omitempty"`
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+	// ErrorDescription is the OP's description of why the login failed
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type session struct {
+	id          string
+	loginCode   string
+	bindingCode string
+	authURL     string
+	state       string
+	expiresAt   time.Time
+	attempts    int
+	confirmed   bool
+	result      *PollResponse
+}
+
+// Relay holds the sessions of logins in progress in memory
+type Relay struct {
+	// URL is the external URL the relay is served at
+	URL string
+	// AllowedAuthHosts are the hosts of the OPs machines may send users to.
+	// If empty, any https URL is allowed, which makes the login page an
+	// open redirect for anyone who knows the binding code.
+	AllowedAuthHosts []string
+	// SessionLifetime defaults to DefaultSessionLifetime
+	SessionLifetime time.Duration
+
+	lock       sync.Mutex
+	sessions   map[string]*session
+	loginCodes map[string]*session
+	states     map[string]*session
+	now        func() time.Time
+}
+
+// New returns a relay served at relayURL, e.g. https://relay.example.com
+func New(relayURL string) *Relay {
+	return &Relay{
+		URL:             strings.TrimSuffix(relayURL, "/"),
+		SessionLifetime: DefaultSessionLifetime,
+		sessions:        map[string]*session{},
+		loginCodes:      map[string]*session{},
+		states:          map[string]*session{},
+		now:             time.Now,
+	}
+}
+
+// CallbackURL is the redirect URI to register with the OP
+func (r *Relay) CallbackURL() string {
+	return r.URL + CallbackPath
+}
+
+// NewHandler serves the relay. Machines start a session with
+//
+//	POST /sessions
+//	Content-Type: application/x-www-form-urlencoded
+//
+//	auth_url=<OP authorization URL>&state=<state of the authorization URL>
+//
+// and get back the JSON StartResponse. They then poll with
+//
+//	POST /sessions/poll
+//	Content-Type: application/x-www-form-urlencoded
+//
+//	session_id=<session ID>
+//
+// getting back 200 OK with the JSON PollResponse once the user logged in,
+// or 400 Bad Request with the PollResponse error. Client sends these
+// requests.
+func NewHandler(r *Relay) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(SessionsPath, r.start)
+	mux.HandleFunc(PollPath, r.poll)
+	mux.HandleFunc(LoginPath, r.login)
+	mux.HandleFunc(CallbackPath, r.callback)
+	return mux
+}
+
+func (r *Relay) start(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authURL, state := req.PostFormValue("auth_url"), req.PostFormValue("state")
+	if state == "" {
+		http.Error(w, "missing state", http.StatusBadRequest)
+		return
+	}
+	if err := r.checkAuthURL(authURL, state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, err := r.add(authURL, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, StartResponse{
+		SessionID:   s.id,
+		LoginURL:    fmt.Sprintf("%s%s?c=%s", r.URL, LoginPath, s.loginCode),
+		BindingCode: formatBindingCode(s.bindingCode),
+		ExpiresIn:   int(r.SessionLifetime / time.Second),
+		Interval:    int(DefaultPollInterval / time.Second),
+	})
+}
+
+// checkAuthURL checks that the authorization URL goes to an allowed OP and
+// redirects back to the relay with the session's state
+func (r *Relay) checkAuthURL(authURL string, state string) error {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return fmt.Errorf("malformed auth_url: %w", err)
+	}
+	if len(r.AllowedAuthHosts) == 0 {
+		if u.Scheme != "https" {
+			return fmt.Errorf("auth_url must be https")
+		}
+	} else if !slices.Contains(r.AllowedAuthHosts, u.Host) {
+		return fmt.Errorf("auth_url host %s is not allowed", u.Host)
+	}
+	if u.Query().Get("redirect_uri") != r.CallbackURL() {
+		return fmt.Errorf("auth_url must redirect to %s", r.CallbackURL())
+	}
+	if u.Query().Get("state") != state {
+		return fmt.Errorf("auth_url state doesn't match")
+	}
+	return nil
+}
+
+func (r *Relay) add(authURL string, state string) (*session, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	bindingCode, err := randomString("0123456789", bindingCodeDigits)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reap()
+	if _, ok := r.states[state]; ok {
+		return nil, fmt.Errorf("a session with this state already exists")
+	}
+	var loginCode string
+	for loginCode == "" || r.loginCodes[loginCode] != nil {
+		if loginCode, err = randomString(loginCodeAlphabet, loginCodeLength); err != nil {
+			return nil, err
+		}
+	}
+	s := &session{
+		id:          base64.RawURLEncoding.EncodeToString(id),
+		loginCode:   loginCode,
+		bindingCode: bindingCode,
+		authURL:     authURL,
+		state:       state,
+		expiresAt:   r.now().Add(r.SessionLifetime),
+	}
+	r.sessions[s.id] = s
+	r.loginCodes[s.loginCode] = s
+	r.states[s.state] = s
+	return s, nil
+}
+
+// reap removes expired sessions, the lock must be held
+func (r *Relay) reap() {
+	for id, s := range r.sessions {
+		if !r.now().Before(s.expiresAt) {
+			r.remove(id, s)
+		}
+	}
+}
+
+func (r *Relay) remove(id string, s *session) {
+	delete(r.sessions, id)
+	delete(r.loginCodes, s.loginCode)
+	delete(r.states, s.state)
+}
+
+func (r *Relay) poll(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := req.PostFormValue("session_id")
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.sessions[id]
+	switch {
+	case !ok || !r.now().Before(s.expiresAt):
+		writeJSON(w, http.StatusBadRequest, PollResponse{Error: ErrExpiredToken})
+	case s.result == nil:
+		writeJSON(w, http.StatusBadRequest, PollResponse{Error: ErrAuthorizationPending})
+	case s.result.Error != "":
+		r.remove(id, s)
+		writeJSON(w, http.StatusBadRequest, s.result)
+	default:
+		r.remove(id, s)
+		writeJSON(w, http.StatusOK, s.result)
+	}
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log in</title><meta name="viewport" content="width=device-width, initial-scale=1"></head>
+<body>
+<form method="post">
+<p>Enter the code shown on the device you are logging in on. Only continue if you started this login yourself.</p>
+{{if .}}<p>{{.}}</p>{{end}}
+<input name="binding_code" inputmode="numeric" autocomplete="off" autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// login is the page the user opens. Once they have entered the binding
+// code the browser is sent to the OP.
+func (r *Relay) login(w http.ResponseWriter, req *http.Request) {
+	loginCode := req.URL.Query().Get("c")
+	if req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, "")
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authURL, message := r.confirm(loginCode, req.PostFormValue("binding_code"))
+	if authURL == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		loginPage.Execute(w, message)
+		return
+	}
+	w.Header().Set("Location", authURL)
+	w.WriteHeader(http.StatusFound)
+}
+
+// confirm checks the binding code the user entered and returns the OP's
+// authorization URL if it is right, otherwise why not
+func (r *Relay) confirm(loginCode string, bindingCode string) (string, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.loginCodes[loginCode]
+	if !ok || !r.now().Before(s.expiresAt) || s.result != nil {
+		return "", "This login has expired, start again on your device."
+	}
+	if subtle.ConstantTimeCompare([]byte(normalizeBindingCode(bindingCode)), []byte(s.bindingCode)) != 1 {
+		s.attempts++
+		if s.attempts >= maxBindingAttempts {
+			s.result = &PollResponse{Error: ErrAccessDenied, ErrorDescription: "too many wrong binding codes"}
+			return "", "Too many wrong codes, start again on your device."
+		}
+		return "", "That code is wrong."
+	}
+	s.confirmed = true
+	return s.authURL, ""
+}
+
+// callback receives the OP's authorization response and holds it for the
+// machine's next poll
+func (r *Relay) callback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	r.lock.Lock()
+	s, ok := r.states[query.Get("state")]
+	if ok && r.now().Before(s.expiresAt) && s.confirmed && s.result == nil {
+		if query.Get("error") != "" {
+			s.result = &PollResponse{Error: ErrAccessDenied, ErrorDescription: query.Get("error") + ": " + query.Get("error_description")}
+		} else {
+			s.result = &PollResponse{Code: query.Get("code"), State: query.Get("state")}
+		}
+	} else {
+		ok = false
+	}
+	r.lock.Unlock()
+	if !ok {
+		http.Error(w, "login session not found or already completed", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if query.Get("error") != "" {
+		w.Write([]byte("Login failed, you can close this page."))
+		return
+	}
+	w.Write([]byte("You are logged in, you can close this page and return to your device."))
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatBindingCode splits the binding code in two to make it easier to
+// read
+func formatBindingCode(bindingCode string) string {
+	return bindingCode[:bindingCodeDigits/2] + " " + bindingCode[bindingCodeDigits/2:]
+}
+
+// normalizeBindingCode undoes formatBindingCode and forgives the user
+// typing the code with dashes
+func normalizeBindingCode(bindingCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, bindingCode)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package relay
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRelay(t *testing.T) (*Relay, *Client) {
+	var r *Relay
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		NewHandler(r).ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	r = New(server.URL)
+	r.AllowedAuthHosts = []string{"op.example.com"}
+	return r, &Client{URL: server.URL}
+}
+
+func testAuthURL(callbackURL string, state string) string {
+	return "https://op.example.com/authorize?" + url.Values{
+		"redirect_uri": {callbackURL},
+		"state":        {state},
+	}.Encode()
+}
+
+// enterBindingCode submits the binding code on the login page and returns
+// the response without following the redirect to the OP
+func enterBindingCode(t *testing.T, loginURL string, bindingCode string) *http.Response {
+	httpClient := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := httpClient.PostForm(loginURL, url.Values{"binding_code": {bindingCode}})
+	require.NoError(t, err)
+	res.Body.Close()
+	return res
+}
+
+func wrongBindingCode(start *StartResponse) string {
+	if start.BindingCode == "000 000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestRelayLogin(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRelay(t)
+	authURL := testAuthURL(c.CallbackURL(), "state-1")
+
+	_, err := c.Start(ctx, authURL, "other-state")
+	require.Error(t, err)
+	_, err = c.Start(ctx, testAuthURL("https://evil.example.com/callback", "state-1"), "state-1")
+	require.Error(t, err)
+	_, err = c.Start(ctx, strings.Replace(authURL, "op.example.com", "evil.example.com", 1), "state-1")
+	require.Error(t, err)
+
+	start, err := c.Start(ctx, authURL, "state-1")
+	require.NoError(t, err)
+	require.Len(t, start.BindingCode, 7)
+
+	var prompt bytes.Buffer
+	require.NoError(t, WritePrompt(&prompt, start))
+	require.Contains(t, prompt.String(), start.LoginURL)
+	require.Contains(t, prompt.String(), start.BindingCode)
+
+	res, err := http.Get(start.LoginURL)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// The OP only accepts the redirect once the user has confirmed the
+	// binding code
+	res, err = http.Get(c.CallbackURL() + "?code=code-1&state=state-1")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = enterBindingCode(t, start.LoginURL, wrongBindingCode(start))
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = enterBindingCode(t, start.LoginURL, start.BindingCode)
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	require.Equal(t, authURL, res.Header.Get("Location"))
+
+	res, err = http.Get(c.CallbackURL() + "?code=code-1&state=state-1")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	result, err := c.Wait(ctx, start)
+	require.NoError(t, err)
+	require.Equal(t, "code-1", result.Code)
+	require.Equal(t, "state-1", result.State)
+
+	// The authorization code is handed out only once
+	_, err = c.Wait(ctx, start)
+	require.ErrorContains(t, err, "expired")
+}
+
+func TestRelayBindingAttempts(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRelay(t)
+
+	start, err := c.Start(ctx, testAuthURL(c.CallbackURL(), "state-1"), "state-1")
+	require.NoError(t, err)
+	for range maxBindingAttempts {
+		require.Equal(t, http.StatusBadRequest, enterBindingCode(t, start.LoginURL, wrongBindingCode(start)).StatusCode)
+	}
+	require.Equal(t, http.StatusBadRequest, enterBindingCode(t, start.LoginURL, start.BindingCode).StatusCode)
+
+	_, err = c.Wait(ctx, start)
+	require.ErrorContains(t, err, "too many wrong binding codes")
+}
+
+func TestRelayLoginDenied(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestRelay(t)
+
+	start, err := c.Start(ctx, testAuthURL(c.CallbackURL(), "state-1"), "state-1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusFound, enterBindingCode(t, start.LoginURL, start.BindingCode).StatusCode)
+	res, err := http.Get(c.CallbackURL() + "?error=access_denied&error_description=user+declined&state=state-1")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, err = c.Wait(ctx, start)
+	require.ErrorContains(t, err, "user declined")
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package retry retries the network operations of OpenID Providers, such
+// as token requests, refreshes and JWKS fetches, when they fail with a
+// transient error: a network error or a 429 Too Many Requests or 5xx
+// response. The providers and discover packages take a Policy and apply
+// it to every request they make to the OP through Policy.Client.
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Policy tries an operation up to MaxAttempts times, waiting a jittered,
+// exponentially growing backoff between attempts. The zero Policy doesn't
+// retry.
+type Policy struct {
+	// MaxAttempts is how many times an operation is tried, including the
+	// first attempt. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff bounds the wait before the first retry, the bound
+	// doubles for each further retry up to MaxBackoff. The wait is drawn
+	// at random below the bound, so clients don't retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Default is the Policy used unless configured otherwise
+var Default = Policy{
+	MaxAttempts:    3,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// None is the Policy which doesn't retry
+var None = Policy{}
+
+// Client returns a copy of client, or of http.DefaultClient if client is
+// nil, whose requests are retried under the policy. If the policy doesn't
+// retry client is returned as is.
+func (p Policy) Client(client *http.Client) *http.Client {
+	if p.MaxAttempts < 2 {
+		return client
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	retrying := *client
+	retrying.Transport = p.Transport(client.Transport)
+	return &retrying
+}
+
+// Transport returns a RoundTripper retrying requests sent with base, or
+// http.DefaultTransport if base is nil, under the policy. Requests with a
+// body are only retried if the body can be replayed, i.e. GetBody is set,
+// as it is by http.NewRequest for in-memory bodies. Retries stop when the
+// request's context is done.
+func (p Policy) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{policy: p, base: base}
+}
+
+type transport struct {
+	policy Policy
+	base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			attemptReq = req.Clone(ctx)
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		canRetry := attempt < t.policy.MaxAttempts && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+		if !canRetry || !retryable(ctx, resp, err) {
+			return resp, err
+		}
+
+		wait := t.policy.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > t.policy.MaxBackoff {
+					// The OP asks us to wait longer than we are willing to
+					return resp, nil
+				}
+				wait = max(wait, retryAfter)
+			}
+			// Drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable returns true if the attempt failed with a transient error
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		// The server's certificate won't become valid by trying again
+		var certErr *tls.CertificateVerificationError
+		return !errors.As(err, &certErr)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns the wait before retrying after the attempt, with full
+// jitter
+func (p Policy) backoff(attempt int) time.Duration {
+	bound := p.InitialBackoff
+	for i := 1; i < attempt && bound < p.MaxBackoff; i++ {
+		bound *= 2
+	}
+	if p.MaxBackoff > 0 {
+		bound = min(bound, p.MaxBackoff)
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return rand.N(bound)
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
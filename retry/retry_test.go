@@ -0,0 +1,159 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package retry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var fast = Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+// failingServer fails the first failures requests with status and echoes
+// the request body afterwards
+func failingServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+func TestClient(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       Policy
+		failures     int32
+		status       int
+		header       http.Header
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{name: "success", policy: fast, wantStatus: http.StatusOK, wantAttempts: 1},
+		{name: "retries 503", policy: fast, failures: 2, status: http.StatusServiceUnavailable, wantStatus: http.StatusOK, wantAttempts: 3},
+		{name: "retries 429", policy: fast, failures: 1, status: http.StatusTooManyRequests, wantStatus: http.StatusOK, wantAttempts: 2},
+		{name: "gives up", policy: fast, failures: 3, status: http.StatusBadGateway, wantStatus: http.StatusBadGateway, wantAttempts: 3},
+		{name: "doesn't retry 400", policy: fast, failures: 1, status: http.StatusBadRequest, wantStatus: http.StatusBadRequest, wantAttempts: 1},
+		{name: "none", policy: None, failures: 1, status: http.StatusServiceUnavailable, wantStatus: http.StatusServiceUnavailable, wantAttempts: 1},
+		{name: "honors Retry-After", policy: fast, failures: 1, status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"0"}}, wantStatus: http.StatusOK, wantAttempts: 2},
+		{name: "Retry-After beyond MaxBackoff", policy: fast, failures: 1, status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"60"}}, wantStatus: http.StatusTooManyRequests, wantAttempts: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, attempts := failingServer(t, tc.failures, tc.status, tc.header)
+			client := tc.policy.Client(server.Client())
+
+			// The body must be replayed on every attempt
+			resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Equal(t, tc.wantAttempts, attempts.Load())
+			if resp.StatusCode == http.StatusOK {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, "payload", string(body))
+			}
+		})
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	server, attempts := failingServer(t, 0, 0, nil)
+	var dials atomic.Int32
+	base := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if dials.Add(1) == 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	resp, err := (&http.Client{Transport: fast.Transport(base)}).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), dials.Load())
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestContextCancellation(t *testing.T) {
+	server, attempts := failingServer(t, 100, http.StatusServiceUnavailable, nil)
+	slow := Policy{MaxAttempts: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = slow.Client(server.Client()).Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		bound := min(100*time.Millisecond<<(attempt-1), time.Second)
+		for i := 0; i < 20; i++ {
+			wait := p.backoff(attempt)
+			require.GreaterOrEqual(t, wait, time.Duration(0))
+			require.Less(t, wait, bound)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("7", now)
+	require.True(t, ok)
+	require.Equal(t, 7*time.Second, wait)
+
+	wait, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, wait)
+
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,230 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sigstore signs artifacts with the key in a PK Token in the
+// formats of sigstore, so that workloads logged in with OpenPubkey, e.g. CI
+// jobs using the GitHub Actions or GitLab CI providers, can sign the blobs
+// and container images they build. Signatures carry a code signing
+// certificate for the PK Token's key with the PK Token embedded, see
+// cert.CreateX509Cert, and are checked by fully verifying that PK Token.
+//
+// Signatures aren't logged to a transparency log, so sigstore clients
+// such as cosign only accept them when told to skip the log.
+package sigstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/openpubkey/openpubkey/cert"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+const (
+	// BundleMediaType is the media type of bundles, version 0.3 of the
+	// sigstore bundle format
+	BundleMediaType = "application/vnd.dev.sigstore.bundle.v0.3+json"
+	// bundleMediaTypeAlt is how clients also write the media type
+	bundleMediaTypeAlt = "application/vnd.dev.sigstore.bundle+json;version=0.3"
+	digestSHA256       = "SHA2_256"
+)
+
+// Bundle is a sigstore bundle in its protobuf JSON encoding, which encodes
+// bytes as base64 as encoding/json does
+type Bundle struct {
+	MediaType            string               `json:"mediaType"`
+	VerificationMaterial VerificationMaterial `json:"verificationMaterial"`
+	MessageSignature     *MessageSignature    `json:"messageSignature,omitempty"`
+}
+
+type VerificationMaterial struct {
+	Certificate *X509Certificate `json:"certificate,omitempty"`
+}
+
+type X509Certificate struct {
+	// RawBytes is the DER encoded certificate
+	RawBytes []byte `json:"rawBytes"`
+}
+
+type MessageSignature struct {
+	MessageDigest MessageDigest `json:"messageDigest"`
+	Signature     []byte        `json:"signature"`
+}
+
+type MessageDigest struct {
+	Algorithm string `json:"algorithm"`
+	Digest    []byte `json:"digest"`
+}
+
+// Signer signs artifacts with the key in a PK Token
+type Signer struct {
+	signer crypto.Signer
+	leaf   *x509.Certificate
+}
+
+// NewSigner returns a Signer for the key in the PK Token, which signer must
+// hold, e.g. the OpkClient's signer. chainPEM is the certificate put in
+// signatures, e.g. issued by a cert.Issuer, optionally followed by its
+// issuers. If nil a self-signed certificate is created for the PK Token.
+func NewSigner(pkt *pktoken.PKToken, signer crypto.Signer, chainPEM []byte) (*Signer, error) {
+	if chainPEM == nil {
+		var err error
+		if chainPEM, err = cert.CreateX509Cert(pkt, signer); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(chainPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in chain")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	leafKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(signer.Public()) {
+		return nil, fmt.Errorf("certificate is not for the signer's public key")
+	}
+	return &Signer{signer: signer, leaf: leaf}, nil
+}
+
+// CertificatePEM returns the certificate put in signatures
+func (s *Signer) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.leaf.Raw})
+}
+
+// SignBlob signs the blob, as cosign sign-blob does
+func (s *Signer) SignBlob(blob []byte) (*Bundle, error) {
+	digest := sha256Sum(blob)
+	var sig []byte
+	var err error
+	if _, ok := s.signer.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs the message itself
+		sig, err = s.signer.Sign(rand.Reader, blob, crypto.Hash(0))
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %w", err)
+	}
+	return &Bundle{
+		MediaType: BundleMediaType,
+		VerificationMaterial: VerificationMaterial{
+			Certificate: &X509Certificate{RawBytes: s.leaf.Raw},
+		},
+		MessageSignature: &MessageSignature{
+			MessageDigest: MessageDigest{Algorithm: digestSHA256, Digest: digest},
+			Signature:     sig,
+		},
+	}, nil
+}
+
+// Verifier checks signatures made by a Signer
+type Verifier struct {
+	// Verifier fully verifies the PK Token in the signing certificate.
+	// Signatures are usually checked long after the ID Token expired, so
+	// configure it with an ExpirationPolicy that allows for that, e.g.
+	// providers.ExpirationPolicies.NEVER_EXPIRE.
+	Verifier *verifier.Verifier
+	// Roots, if set, are the CAs, including intermediate CAs, one of which
+	// must have issued the signing certificate. Otherwise self-signed
+	// certificates are accepted, as the PK Token vouches for their key.
+	Roots *x509.CertPool
+}
+
+// VerifyBlob checks the bundle is a signature of the blob and returns the
+// verified PK Token of the signer, whose claims say who signed it
+func (v *Verifier) VerifyBlob(ctx context.Context, bundle *Bundle, blob []byte) (*pktoken.PKToken, error) {
+	if bundle.MediaType != BundleMediaType && bundle.MediaType != bundleMediaTypeAlt {
+		return nil, fmt.Errorf("unsupported bundle media type %q", bundle.MediaType)
+	}
+	if bundle.VerificationMaterial.Certificate == nil {
+		return nil, fmt.Errorf("bundle has no certificate")
+	}
+	sig := bundle.MessageSignature
+	if sig == nil {
+		return nil, fmt.Errorf("bundle has no message signature")
+	}
+	digest := sha256Sum(blob)
+	if sig.MessageDigest.Algorithm != digestSHA256 || !bytes.Equal(sig.MessageDigest.Digest, digest) {
+		return nil, fmt.Errorf("bundle is not for this blob")
+	}
+
+	leaf, pkt, err := v.verifyCertificate(ctx, bundle.VerificationMaterial.Certificate.RawBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(leaf.PublicKey, blob, digest, sig.Signature); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// verifyCertificate verifies the signing certificate and the PK Token in it
+func (v *Verifier) verifyCertificate(ctx context.Context, certDER []byte) (*x509.Certificate, *pktoken.PKToken, error) {
+	roots := v.Roots
+	if roots == nil {
+		leaf, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		roots = x509.NewCertPool()
+		roots.AddCert(leaf)
+	}
+	leaf, pkt, err := cert.VerifyChain(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), roots)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := v.Verifier.VerifyPKToken(ctx, pkt); err != nil {
+		return nil, nil, fmt.Errorf("failed to verify PK Token in certificate: %w", err)
+	}
+	return leaf, pkt, nil
+}
+
+func sha256Sum(message []byte) []byte {
+	digest := sha256.Sum256(message)
+	return digest[:]
+}
+
+func verifySignature(pub crypto.PublicKey, message []byte, digest []byte, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, digest, sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, message, sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return fmt.Errorf("invalid signature")
+}
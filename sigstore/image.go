@@ -0,0 +1,151 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sigstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// The media type and annotations of the layer cosign stores an image
+// signature in
+const (
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	SignatureAnnotation    = "dev.cosignproject.cosign/signature"
+	CertificateAnnotation  = "dev.sigstore.cosign/certificate"
+
+	simpleSigningType = "cosign container image signature"
+)
+
+// simpleSigning is the payload cosign signs for an image
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// ImageSignature is a signature of a container image. Registries store it
+// as cosign does, as a layer of SimpleSigningMediaType with the Payload as
+// content and the Annotations, in an image tagged SignatureTag in the
+// image's repository. Bundle has the same signature in the bundle format,
+// e.g. to attach it to the image as an OCI referrer.
+type ImageSignature struct {
+	Payload []byte
+	Bundle  *Bundle
+}
+
+// SignImage signs the container image with the manifest digest, e.g.
+// "sha256:4f8a...", pushed to the repository ref, e.g. "ghcr.io/acme/app",
+// as cosign sign does
+func (s *Signer) SignImage(ref string, digest string) (*ImageSignature, error) {
+	if _, _, ok := strings.Cut(digest, ":"); !ok {
+		return nil, fmt.Errorf("malformed image digest %q", digest)
+	}
+	var payload simpleSigning
+	payload.Critical.Identity.DockerReference = ref
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = simpleSigningType
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := s.SignBlob(payloadJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageSignature{Payload: payloadJSON, Bundle: bundle}, nil
+}
+
+// SignatureTag returns the tag cosign looks the signatures of the image
+// with the manifest digest up by, e.g. "sha256-4f8a....sig"
+func SignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// Annotations returns the annotations of the signature's layer
+func (s *ImageSignature) Annotations() map[string]string {
+	return map[string]string{
+		SignatureAnnotation: base64.StdEncoding.EncodeToString(s.Bundle.MessageSignature.Signature),
+		CertificateAnnotation: string(pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: s.Bundle.VerificationMaterial.Certificate.RawBytes,
+		})),
+	}
+}
+
+// ParseImageSignature reads a signature from the content and annotations
+// of its layer, as fetched from the registry
+func ParseImageSignature(payload []byte, annotations map[string]string) (*ImageSignature, error) {
+	sig, err := base64.StdEncoding.DecodeString(annotations[SignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return nil, fmt.Errorf("layer has no signature annotation")
+	}
+	block, _ := pem.Decode([]byte(annotations[CertificateAnnotation]))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("layer has no certificate annotation")
+	}
+	digest := sha256Sum(payload)
+	return &ImageSignature{
+		Payload: payload,
+		Bundle: &Bundle{
+			MediaType: BundleMediaType,
+			VerificationMaterial: VerificationMaterial{
+				Certificate: &X509Certificate{RawBytes: block.Bytes},
+			},
+			MessageSignature: &MessageSignature{
+				MessageDigest: MessageDigest{Algorithm: digestSHA256, Digest: digest},
+				Signature:     sig,
+			},
+		},
+	}, nil
+}
+
+// VerifyImage checks the signature is of the container image with the
+// manifest digest in the repository ref and returns the verified PK Token
+// of the signer
+func (v *Verifier) VerifyImage(ctx context.Context, sig *ImageSignature, ref string, digest string) (*pktoken.PKToken, error) {
+	pkt, err := v.VerifyBlob(ctx, sig.Bundle, sig.Payload)
+	if err != nil {
+		return nil, err
+	}
+	var payload simpleSigning
+	if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("malformed signature payload: %w", err)
+	}
+	if payload.Critical.Type != simpleSigningType {
+		return nil, fmt.Errorf("signature payload has unexpected type %q", payload.Critical.Type)
+	}
+	if payload.Critical.Image.DockerManifestDigest != digest {
+		return nil, fmt.Errorf("signature is for image %s, not %s", payload.Critical.Image.DockerManifestDigest, digest)
+	}
+	if payload.Critical.Identity.DockerReference != ref {
+		return nil, fmt.Errorf("signature is for repository %s, not %s", payload.Critical.Identity.DockerReference, ref)
+	}
+	return pkt, nil
+}
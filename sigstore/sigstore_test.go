@@ -0,0 +1,141 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sigstore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/cert"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignBlob(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op, verifier.WithExpirationPolicy(providers.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+
+	s, err := NewSigner(pkt, signer, nil)
+	require.NoError(t, err)
+	blob := []byte("release.tar.gz")
+	bundle, err := s.SignBlob(blob)
+	require.NoError(t, err)
+
+	// Bundles survive a round trip through their JSON encoding
+	bundleJSON, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	var parsed Bundle
+	require.NoError(t, json.Unmarshal(bundleJSON, &parsed))
+
+	sv := &Verifier{Verifier: v}
+	verified, err := sv.VerifyBlob(ctx, &parsed, blob)
+	require.NoError(t, err)
+	require.Equal(t, pkt.OpToken, verified.OpToken)
+
+	_, err = sv.VerifyBlob(ctx, &parsed, []byte("other.tar.gz"))
+	require.ErrorContains(t, err, "not for this blob")
+	parsed.MessageSignature.Signature[len(parsed.MessageSignature.Signature)-1] ^= 1
+	_, err = sv.VerifyBlob(ctx, &parsed, blob)
+	require.Error(t, err)
+
+	// Self-signed certificates aren't accepted once Roots are configured
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caCert, err := cert.CreateCACert(pkix.Name{CommonName: "test CA"}, &caKey.PublicKey, nil, caKey, time.Hour)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err = (&Verifier{Verifier: v, Roots: roots}).VerifyBlob(ctx, bundle, blob)
+	require.ErrorContains(t, err, "failed to verify certificate chain")
+
+	// but those issued by one of the roots are
+	issuer := &cert.Issuer{Verifier: v, CACert: caCert, Signer: caKey, Validity: time.Hour}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+	require.NoError(t, err)
+	chainPEM, err := issuer.Issue(ctx, csr, pkt)
+	require.NoError(t, err)
+	s, err = NewSigner(pkt, signer, chainPEM)
+	require.NoError(t, err)
+	bundle, err = s.SignBlob(blob)
+	require.NoError(t, err)
+	_, err = (&Verifier{Verifier: v, Roots: roots}).VerifyBlob(ctx, bundle, blob)
+	require.NoError(t, err)
+
+	// The certificate must be for the signer's key
+	otherKey, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	_, err = NewSigner(pkt, otherKey, chainPEM)
+	require.ErrorContains(t, err, "not for the signer's public key")
+}
+
+func TestSignImage(t *testing.T) {
+	ctx := context.Background()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+	v, err := verifier.New(op)
+	require.NoError(t, err)
+	sv := &Verifier{Verifier: v}
+
+	s, err := NewSigner(pkt, signer, nil)
+	require.NoError(t, err)
+	ref := "ghcr.io/acme/app"
+	digest := "sha256:4f8a5a7c6a1b2e0d9f3c8b7a6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d"
+	sig, err := s.SignImage(ref, digest)
+	require.NoError(t, err)
+	require.Equal(t, "sha256-4f8a5a7c6a1b2e0d9f3c8b7a6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d.sig", SignatureTag(digest))
+
+	// Read the signature back as it is stored in the registry
+	parsed, err := ParseImageSignature(sig.Payload, sig.Annotations())
+	require.NoError(t, err)
+	_, err = sv.VerifyImage(ctx, parsed, ref, digest)
+	require.NoError(t, err)
+
+	_, err = sv.VerifyImage(ctx, parsed, "ghcr.io/acme/other", digest)
+	require.ErrorContains(t, err, "not ghcr.io/acme/other")
+	_, err = sv.VerifyImage(ctx, parsed, ref, "sha256:00")
+	require.ErrorContains(t, err, "not sha256:00")
+	_, err = ParseImageSignature(sig.Payload, map[string]string{})
+	require.ErrorContains(t, err, "no signature annotation")
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package telemetry instruments OpenPubkey operations with OpenTelemetry
+// spans and failure counters: authentication, token requests, GQ signing,
+// JWKS fetches and each step of PK Token verification.
+//
+// Instrumentation is off unless a Telemetry is given to the client with
+// client.WithTelemetry or to the verifier with verifier.WithTelemetry. The
+// Telemetry is then carried in the context to the providers and discover
+// packages, so operations they run on behalf of the client or verifier are
+// recorded as child spans.
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope of the tracer and meter
+const ScopeName = "github.com/openpubkey/openpubkey"
+
+// Operations are the names of the spans recorded, and the value of the
+// OperationKey attribute of the failure counter
+const (
+	OpAuth          = "openpubkey.client.auth"
+	OpRefresh       = "openpubkey.client.refresh"
+	OpRequestTokens = "openpubkey.provider.request_tokens"
+	OpGQSign        = "openpubkey.gq.sign"
+	OpFetchJwks     = "openpubkey.discover.fetch_jwks"
+	OpVerify        = "openpubkey.verifier.verify"
+	// OpVerifyCheck is the prefix of the spans of each verification step,
+	// followed by the verifier.CheckName, e.g. openpubkey.verifier.check.id_token
+	OpVerifyCheck = "openpubkey.verifier.check."
+)
+
+// FailuresMetric counts failed operations by OperationKey
+const FailuresMetric = "openpubkey.operation.failures"
+
+var (
+	OperationKey = attribute.Key("openpubkey.operation")
+	IssuerKey    = attribute.Key("openpubkey.issuer")
+)
+
+// Telemetry records spans and failure counts
+type Telemetry struct {
+	tracer   trace.Tracer
+	failures metric.Int64Counter
+}
+
+// New returns a Telemetry recording spans with tp and metrics with mp. If
+// either is nil the global provider registered with otel is used.
+func New(tp trace.TracerProvider, mp metric.MeterProvider) (*Telemetry, error) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	failures, err := mp.Meter(ScopeName).Int64Counter(FailuresMetric,
+		metric.WithDescription("Failed OpenPubkey operations by operation."),
+		metric.WithUnit("{failure}"))
+	if err != nil {
+		return nil, err
+	}
+	return &Telemetry{
+		tracer:   tp.Tracer(ScopeName),
+		failures: failures,
+	}, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t, so that operations run with
+// it are recorded. If t is nil ctx is returned as is.
+func NewContext(ctx context.Context, t *Telemetry) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the Telemetry carried by ctx, nil if there is none
+func FromContext(ctx context.Context) *Telemetry {
+	t, _ := ctx.Value(contextKey{}).(*Telemetry)
+	return t
+}
+
+// Start starts a span for the operation if ctx carries a Telemetry. It
+// returns the context to run the operation with and a function to call
+// with a pointer to the operation's error once it is done, typically
+// deferred with a named error result:
+//
+//	ctx, end := telemetry.Start(ctx, telemetry.OpFetchJwks)
+//	defer end(&err)
+func Start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(*error)) {
+	t := FromContext(ctx)
+	if t == nil {
+		return ctx, func(*error) {}
+	}
+
+	ctx, span := t.tracer.Start(ctx, operation, trace.WithAttributes(attrs...))
+	return ctx, func(errp *error) {
+		if errp != nil && *errp != nil {
+			span.RecordError(*errp)
+			span.SetStatus(codes.Error, (*errp).Error())
+			t.failures.Add(ctx, 1, metric.WithAttributes(OperationKey.String(operation)))
+		}
+		span.End()
+	}
+}
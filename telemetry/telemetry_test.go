@@ -0,0 +1,136 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/telemetry"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTelemetry(t *testing.T) (*telemetry.Telemetry, *tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	spans := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	tel, err := telemetry.New(
+		sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)),
+		sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+	return tel, spans, reader
+}
+
+func spanNames(spans *tracetest.SpanRecorder) []string {
+	names := []string{}
+	for _, span := range spans.Ended() {
+		names = append(names, span.Name())
+	}
+	return names
+}
+
+// failures returns the failure count of each operation
+func failures(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	counts := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != telemetry.FailuresMetric {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				operation, _ := point.Attributes.Value(telemetry.OperationKey)
+				counts[operation.AsString()] += point.Value
+			}
+		}
+	}
+	return counts
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+
+	// Without a Telemetry in the context nothing is recorded
+	_, end := telemetry.Start(ctx, telemetry.OpFetchJwks)
+	end(nil)
+
+	tel, spans, reader := newTelemetry(t)
+	ctx = telemetry.NewContext(ctx, tel)
+	require.Equal(t, tel, telemetry.FromContext(ctx))
+
+	parentCtx, endParent := telemetry.Start(ctx, telemetry.OpAuth)
+	_, endChild := telemetry.Start(parentCtx, telemetry.OpFetchJwks, telemetry.IssuerKey.String("issuer"))
+	err := errors.New("fetch failed")
+	endChild(&err)
+	endParent(nil)
+
+	ended := spans.Ended()
+	require.Equal(t, []string{telemetry.OpFetchJwks, telemetry.OpAuth}, spanNames(spans))
+	require.Equal(t, ended[1].SpanContext().SpanID(), ended[0].Parent().SpanID())
+	require.Equal(t, codes.Error, ended[0].Status().Code)
+	require.Equal(t, codes.Unset, ended[1].Status().Code)
+	require.Equal(t, map[string]int64{telemetry.OpFetchJwks: 1}, failures(t, reader))
+}
+
+func TestClientAndVerifier(t *testing.T) {
+	ctx := context.Background()
+	providerOpts := providers.DefaultMockProviderOpts()
+	providerOpts.GQSign = true
+	op, _, _, err := providers.NewMockProvider(providerOpts)
+	require.NoError(t, err)
+
+	tel, spans, reader := newTelemetry(t)
+	opkClient, err := client.New(op, client.WithTelemetry(tel))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(ctx)
+	require.NoError(t, err)
+
+	names := spanNames(spans)
+	require.Contains(t, names, telemetry.OpAuth)
+	require.Contains(t, names, telemetry.OpRequestTokens)
+	require.Contains(t, names, telemetry.OpGQSign)
+	// The client verifies the PK Token it creates
+	require.Contains(t, names, telemetry.OpVerify)
+
+	tel, spans, reader = newTelemetry(t)
+	v, err := verifier.New(op, verifier.WithTelemetry(tel))
+	require.NoError(t, err)
+	require.NoError(t, v.VerifyPKToken(ctx, pkt))
+	names = spanNames(spans)
+	require.Contains(t, names, telemetry.OpVerify)
+	require.Contains(t, names, telemetry.OpVerifyCheck+string(verifier.CheckClientSignature))
+	require.Contains(t, names, telemetry.OpVerifyCheck+string(verifier.CheckIDToken))
+	require.Empty(t, failures(t, reader))
+
+	// A failed check is counted as a failure of the check and of the
+	// verification
+	pkt.Payload = []byte(`{"iss":"https://unknown.example.com"}`)
+	require.Error(t, v.VerifyPKToken(ctx, pkt))
+	require.Equal(t, map[string]int64{
+		telemetry.OpVerify: 1,
+		telemetry.OpVerifyCheck + string(verifier.CheckIssuer): 1,
+	}, failures(t, reader))
+}
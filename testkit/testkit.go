@@ -0,0 +1,401 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package testkit generates adversarial PK Tokens for the test suites of
+// services that verify PK Tokens. A Kit runs a mock OpenID Provider and
+// cosigner, mints valid PK Tokens from them and then breaks them in the ways
+// attackers do, e.g. grafting their own key onto a stolen ID Token. Tests
+// configure their verification with the Kit's provider and cosigner, pass
+// their parse and verify pipeline to Kit.Check and fail if any of the
+// attacks is accepted:
+//
+//	kit, err := testkit.New()
+//	...
+//	v, err := verifier.New(kit.Provider(), verifier.WithCosignerVerifiers(kit.CosignerVerifier()))
+//	...
+//	err = kit.Check(ctx, func(ctx context.Context, pktCom []byte) error {
+//		pkt, err := pktoken.NewFromCompact(pktCom)
+//		if err != nil {
+//			return err
+//		}
+//		return v.VerifyPKToken(ctx, pkt)
+//	})
+//
+// A Kit is not safe for concurrent use.
+package testkit
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/providers/mocks"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+const (
+	// CosignerIssuer is the issuer of the Kit's cosigner
+	CosignerIssuer = "https://cosigner.testkit.example.com"
+	cosignerKeyID  = "testkit-cosigner"
+)
+
+// Attack names a way of breaking a PK Token
+type Attack string
+
+const (
+	// StrippedCosigner removes the cosigner signature from a cosigned PK
+	// Token. Rejected by verifiers requiring the cosigner.
+	StrippedCosigner Attack = "stripped-cosigner"
+	// SwappedCIC replaces the client instance claims of a stolen ID Token
+	// with the attacker's own, so the ID Token's nonce doesn't commit to
+	// them.
+	SwappedCIC Attack = "swapped-cic"
+	// ReplayedNonce replays the victim's client instance claims, which the
+	// ID Token's nonce commits to, but signs them with the attacker's key
+	// instead of the victim's.
+	ReplayedNonce Attack = "replayed-nonce"
+	// AlgConfusionGQ relabels an RS256 signed ID Token as GQ256.
+	AlgConfusionGQ Attack = "alg-confusion-gq"
+	// AlgConfusionRS256 relabels a GQ256 signed ID Token as RS256.
+	AlgConfusionRS256 Attack = "alg-confusion-rs256"
+	// OversizedField is an otherwise valid PK Token whose ID Token has a
+	// claim larger than pktoken.DefaultLimits allow for the whole PK
+	// Token. Rejected by parsers enforcing size limits.
+	OversizedField Attack = "oversized-field"
+)
+
+// Attacks lists every Attack a Kit generates
+var Attacks = []Attack{
+	StrippedCosigner,
+	SwappedCIC,
+	ReplayedNonce,
+	AlgConfusionGQ,
+	AlgConfusionRS256,
+	OversizedField,
+}
+
+// Kit mints valid and adversarial PK Tokens from a mock OpenID Provider and
+// cosigner
+type Kit struct {
+	op          *providers.MockProvider
+	idtTemplate *mocks.IDTokenTemplate
+	cosigner    cosigner.Cosigner
+	cosJwks     []byte
+}
+
+// New returns a Kit with a fresh mock OpenID Provider and cosigner
+func New() (*Kit, error) {
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	if err != nil {
+		return nil, err
+	}
+	idtTemplate.ExtraClaims = map[string]any{"email": "victim@example.com"}
+
+	cosAlg := jwa.ES256
+	cosSigner, err := util.GenKeyPair(cosAlg)
+	if err != nil {
+		return nil, err
+	}
+	cosKey, err := jwk.PublicKeyOf(cosSigner)
+	if err != nil {
+		return nil, err
+	}
+	if err := cosKey.Set(jwk.AlgorithmKey, cosAlg); err != nil {
+		return nil, err
+	}
+	if err := cosKey.Set(jwk.KeyIDKey, cosignerKeyID); err != nil {
+		return nil, err
+	}
+	jwks := jwk.NewSet()
+	if err := jwks.AddKey(cosKey); err != nil {
+		return nil, err
+	}
+	cosJwks, err := json.Marshal(jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Kit{
+		op:          op,
+		idtTemplate: idtTemplate,
+		cosigner:    cosigner.Cosigner{Alg: cosAlg, Signer: cosSigner},
+		cosJwks:     cosJwks,
+	}, nil
+}
+
+// Provider returns the Kit's mock OpenID Provider, e.g. for verifier.New
+func (k *Kit) Provider() *providers.MockProvider {
+	return k.op
+}
+
+// CosignerVerifier returns a verifier which requires PK Tokens to be
+// cosigned by the Kit's cosigner
+func (k *Kit) CosignerVerifier() *cosigner.DefaultCosignerVerifier {
+	return cosigner.NewCosignerVerifier(CosignerIssuer, cosigner.CosignerVerifierOpts{
+		DiscoverPublicKey: &discover.PublicKeyFinder{
+			JwksFunc: func(ctx context.Context, issuer string) ([]byte, error) {
+				if issuer != CosignerIssuer {
+					return nil, fmt.Errorf("unknown cosigner %s", issuer)
+				}
+				return k.cosJwks, nil
+			},
+		},
+	})
+}
+
+// Valid returns a PK Token issued by the Kit's provider, cosigned by its
+// cosigner, and the client's signer
+func (k *Kit) Valid(ctx context.Context) (*pktoken.PKToken, crypto.Signer, error) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	if err != nil {
+		return nil, nil, err
+	}
+	opkClient, err := client.New(k.op, client.WithSigner(signer, jwa.ES256))
+	if err != nil {
+		return nil, nil, err
+	}
+	pkt, err := opkClient.Auth(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := k.cosign(pkt); err != nil {
+		return nil, nil, err
+	}
+	return pkt, signer, nil
+}
+
+func (k *Kit) cosign(pkt *pktoken.PKToken) error {
+	now := time.Now()
+	cosToken, err := k.cosigner.Cosign(pkt, pktoken.CosignerClaims{
+		Issuer:      CosignerIssuer,
+		KeyID:       cosignerKeyID,
+		Algorithm:   k.cosigner.Alg.String(),
+		AuthID:      "testkit",
+		AuthTime:    now.Unix(),
+		IssuedAt:    now.Unix(),
+		Expiration:  now.Add(time.Hour).Unix(),
+		RedirectURI: "http://localhost:3000/mfaredirect",
+		Nonce:       "testkit",
+		Typ:         string(pktoken.COS),
+	})
+	if err != nil {
+		return err
+	}
+	return pkt.AddSignature(cosToken, pktoken.COS)
+}
+
+// Generate returns a PK Token in compact form broken by attack. It isn't
+// parsed by Generate, as rejecting it while parsing is part of the defense
+// against some attacks.
+func (k *Kit) Generate(ctx context.Context, attack Attack) ([]byte, error) {
+	switch attack {
+	case StrippedCosigner:
+		pkt, _, err := k.Valid(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pkt.Cos = nil
+		pkt.CosToken = nil
+		return pkt.Compact()
+	case SwappedCIC:
+		pkt, _, err := k.Valid(ctx)
+		if err != nil {
+			return nil, err
+		}
+		attacker, attackerJwk, err := newClientKey()
+		if err != nil {
+			return nil, err
+		}
+		cic, err := clientinstance.NewClaims(attackerJwk, map[string]any{})
+		if err != nil {
+			return nil, err
+		}
+		return k.replaceCIC(pkt, cic, attacker)
+	case ReplayedNonce:
+		pkt, _, err := k.Valid(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cic, err := pkt.GetCicValues()
+		if err != nil {
+			return nil, err
+		}
+		attacker, _, err := newClientKey()
+		if err != nil {
+			return nil, err
+		}
+		return k.replaceCIC(pkt, cic, attacker)
+	case AlgConfusionGQ:
+		pkt, _, err := k.Valid(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return k.relabelOpToken(pkt, pkt.OpToken, "GQ256")
+	case AlgConfusionRS256:
+		pkt, _, err := k.Valid(ctx)
+		if err != nil {
+			return nil, err
+		}
+		gqToken, err := providers.CreateGQToken(ctx, pkt.OpToken, k.op)
+		if err != nil {
+			return nil, err
+		}
+		return k.relabelOpToken(pkt, gqToken, "RS256")
+	case OversizedField:
+		// The client refuses to parse the PK Token, so the ID Token is
+		// issued from the template directly
+		signer, key, err := newClientKey()
+		if err != nil {
+			return nil, err
+		}
+		cic, err := clientinstance.NewClaims(key, map[string]any{})
+		if err != nil {
+			return nil, err
+		}
+		cicHash, err := cic.Hash()
+		if err != nil {
+			return nil, err
+		}
+		k.idtTemplate.AddCommit(string(cicHash))
+		k.idtTemplate.ExtraClaims["padding"] = strings.Repeat("A", pktoken.DefaultLimits.MaxSize)
+		defer delete(k.idtTemplate.ExtraClaims, "padding")
+		tokens, err := k.idtTemplate.IssueToken()
+		if err != nil {
+			return nil, err
+		}
+		cicToken, err := cic.Sign(signer, jwa.ES256, tokens.IDToken)
+		if err != nil {
+			return nil, err
+		}
+		pkt, err := pktoken.New(tokens.IDToken, cicToken)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.cosign(pkt); err != nil {
+			return nil, err
+		}
+		return pkt.Compact()
+	default:
+		return nil, fmt.Errorf("unknown attack %s", attack)
+	}
+}
+
+// replaceCIC signs cic for the ID Token of pkt with signer and cosigns the
+// result, so only the CIC is wrong
+func (k *Kit) replaceCIC(pkt *pktoken.PKToken, cic *clientinstance.Claims, signer crypto.Signer) ([]byte, error) {
+	cicToken, err := cic.Sign(signer, jwa.ES256, pkt.OpToken)
+	if err != nil {
+		return nil, err
+	}
+	forged, err := pktoken.New(pkt.OpToken, cicToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.cosign(forged); err != nil {
+		return nil, err
+	}
+	return forged.Compact()
+}
+
+// relabelOpToken replaces the OP signature of pkt with opToken with its alg
+// header set to alg, keeping the signature
+func (k *Kit) relabelOpToken(pkt *pktoken.PKToken, opToken []byte, alg string) ([]byte, error) {
+	protected, payload, signature, err := jws.SplitCompact(opToken)
+	if err != nil {
+		return nil, err
+	}
+	headerJSON, err := util.Base64DecodeForJWT(protected)
+	if err != nil {
+		return nil, err
+	}
+	var header map[string]any
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+	header["alg"] = alg
+	headerJSON, err = json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	relabeled := []byte(string(util.Base64EncodeForJWT(headerJSON)) + "." + string(payload) + "." + string(signature))
+
+	tokens := [][]byte{relabeled, pkt.CicToken}
+	if pkt.CosToken != nil {
+		tokens = append(tokens, pkt.CosToken)
+	}
+	return pktoken.CompactPKToken(tokens, nil)
+}
+
+func newClientKey() (crypto.Signer, jwk.Key, error) {
+	signer, err := util.GenKeyPair(jwa.ES256)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := jwk.PublicKeyOf(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwa.ES256); err != nil {
+		return nil, nil, err
+	}
+	return signer, key, nil
+}
+
+// VerifyFunc parses and verifies a PK Token in compact form the way the
+// service under test does
+type VerifyFunc func(ctx context.Context, pktCom []byte) error
+
+// Check runs verify on a valid PK Token, which it must accept, and on a PK
+// Token broken by each of Attacks, which it must reject. The returned error
+// lists every attack that was accepted.
+func (k *Kit) Check(ctx context.Context, verify VerifyFunc) error {
+	pkt, _, err := k.Valid(ctx)
+	if err != nil {
+		return err
+	}
+	pktCom, err := pkt.Compact()
+	if err != nil {
+		return err
+	}
+	if err := verify(ctx, pktCom); err != nil {
+		return fmt.Errorf("valid PK Token was rejected, check the verifier is configured with the Kit's provider and cosigner: %w", err)
+	}
+
+	var errs []error
+	for _, attack := range Attacks {
+		pktCom, err := k.Generate(ctx, attack)
+		if err != nil {
+			return fmt.Errorf("failed to generate %s PK Token: %w", attack, err)
+		}
+		if err := verify(ctx, pktCom); err == nil {
+			errs = append(errs, fmt.Errorf("%s PK Token was accepted", attack))
+		}
+	}
+	return errors.Join(errs...)
+}
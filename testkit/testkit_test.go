@@ -0,0 +1,68 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package testkit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKit(t *testing.T) {
+	ctx := context.Background()
+	kit, err := New()
+	require.NoError(t, err)
+
+	v, err := verifier.New(kit.Provider(), verifier.WithCosignerVerifiers(kit.CosignerVerifier()))
+	require.NoError(t, err)
+	verify := func(ctx context.Context, pktCom []byte) error {
+		pkt, err := pktoken.NewFromCompact(pktCom)
+		if err != nil {
+			return err
+		}
+		return v.VerifyPKToken(ctx, pkt)
+	}
+
+	for _, attack := range Attacks {
+		t.Run(string(attack), func(t *testing.T) {
+			pktCom, err := kit.Generate(ctx, attack)
+			require.NoError(t, err)
+			require.Error(t, verify(ctx, pktCom))
+		})
+	}
+	require.NoError(t, kit.Check(ctx, verify))
+
+	// A verifier that doesn't require the cosigner lets the stripped token
+	// through, which Check reports
+	lax, err := verifier.New(kit.Provider())
+	require.NoError(t, err)
+	err = kit.Check(ctx, func(ctx context.Context, pktCom []byte) error {
+		pkt, err := pktoken.NewFromCompact(pktCom)
+		if err != nil {
+			return err
+		}
+		return lax.VerifyPKToken(ctx, pkt)
+	})
+	require.ErrorContains(t, err, string(StrippedCosigner))
+	require.NotContains(t, err.Error(), string(SwappedCIC))
+
+	_, err = kit.Generate(ctx, Attack("unknown"))
+	require.Error(t, err)
+}
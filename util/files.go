@@ -19,6 +19,7 @@ package util
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -54,6 +55,9 @@ func ReadSKFile(fpath string) (*ecdsa.PrivateKey, error) {
 		return nil, err
 	}
 	block, _ := pem.Decode([]byte(pemBytes))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", fpath)
+	}
 	return x509.ParseECPrivateKey(block.Bytes)
 }
 
@@ -61,6 +65,14 @@ func GenKeyPair(alg jwa.KeyAlgorithm) (crypto.Signer, error) {
 	switch alg {
 	case jwa.ES256:
 		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwa.ES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jwa.EdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
 	case jwa.RS256: // RSASSA-PKCS-v1.5 using SHA-256
 		return rsa.GenerateKey(rand.Reader, 2048)
 	default:
@@ -0,0 +1,44 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ShutdownTimeout is how long ShutdownServer waits for in-flight requests
+// to finish before closing their connections.
+const ShutdownTimeout = 5 * time.Second
+
+// ShutdownServer gracefully shuts down the server, forcibly closing any
+// connections still open after ShutdownTimeout. It deliberately doesn't
+// take a context, as shutdown is often triggered by the caller's context
+// being cancelled and http.Server.Shutdown returns immediately, leaving
+// connections open, when passed a context that is already done.
+func ShutdownServer(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return server.Close()
+	}
+	return err
+}
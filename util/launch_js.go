@@ -0,0 +1,35 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build js
+
+package util
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// OpenUrl opens the specified URL in a new browser tab with window.open.
+// Browser extension service workers have no window, they should open
+// the URL with their own providers.BrowserOpener, e.g. chrome.tabs.create.
+func OpenUrl(url string) error {
+	if js.Global().Get("open").Type() != js.TypeFunction {
+		return fmt.Errorf("window.open is not available")
+	}
+	js.Global().Call("open", url, "_blank")
+	return nil
+}
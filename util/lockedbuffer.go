@@ -0,0 +1,52 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !js
+
+package util
+
+import (
+	"io"
+
+	"github.com/awnumar/memguard"
+)
+
+// LockedBuffer holds secrets, such as ID Tokens and GQ private numbers, in
+// memory that is locked against swapping and wiped when destroyed. On
+// js/wasm memory can't be locked, see lockedbuffer_js.go.
+type LockedBuffer struct {
+	*memguard.LockedBuffer
+}
+
+// NewLockedBuffer moves b into a LockedBuffer, wiping b
+func NewLockedBuffer(b []byte) *LockedBuffer {
+	return &LockedBuffer{memguard.NewBufferFromBytes(b)}
+}
+
+// NewLockedBufferFromReader reads r until EOF into a LockedBuffer
+func NewLockedBufferFromReader(r io.Reader) (*LockedBuffer, error) {
+	buf, err := memguard.NewBufferFromEntireReader(r)
+	if err != nil {
+		buf.Destroy()
+		return nil, err
+	}
+	return &LockedBuffer{buf}, nil
+}
+
+// WipeBytes overwrites b with zeros
+func WipeBytes(b []byte) {
+	memguard.WipeBytes(b)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build js
+
+package util
+
+import (
+	"bytes"
+	"io"
+)
+
+// LockedBuffer holds secrets, such as ID Tokens and GQ private numbers.
+// WebAssembly memory can't be locked against swapping, so on js/wasm the
+// secret is only wiped when destroyed.
+type LockedBuffer struct {
+	b []byte
+}
+
+// NewLockedBuffer moves b into a LockedBuffer, wiping b
+func NewLockedBuffer(b []byte) *LockedBuffer {
+	buf := &LockedBuffer{b: bytes.Clone(b)}
+	WipeBytes(b)
+	return buf
+}
+
+// NewLockedBufferFromReader reads r until EOF into a LockedBuffer
+func NewLockedBufferFromReader(r io.Reader) (*LockedBuffer, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		WipeBytes(b)
+		return nil, err
+	}
+	return &LockedBuffer{b: b}, nil
+}
+
+func (l *LockedBuffer) Bytes() []byte {
+	return l.b
+}
+
+// Destroy wipes the secret
+func (l *LockedBuffer) Destroy() {
+	WipeBytes(l.b)
+	l.b = nil
+}
+
+// WipeBytes overwrites b with zeros
+func WipeBytes(b []byte) {
+	clear(b)
+}
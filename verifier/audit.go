@@ -0,0 +1,102 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+// AuditEvent records a single PK Token verification attempt. Claims are
+// taken from the PK Token as presented, so on a failed verification they
+// are unverified and may have been chosen by an attacker.
+type AuditEvent struct {
+	Time            time.Time `json:"time"`
+	Issuer          string    `json:"iss,omitempty"`
+	Subject         string    `json:"sub,omitempty"`
+	Audience        string    `json:"aud,omitempty"`
+	Algorithm       string    `json:"alg,omitempty"` // Provider signature algorithm
+	GQ              bool      `json:"gq"`
+	CosignerPresent bool      `json:"cosigner_present"`
+	CosignerIssuer  string    `json:"cosigner_iss,omitempty"`
+	Success         bool      `json:"success"`
+	FailureReason   string    `json:"failure_reason,omitempty"`
+	// Reason classifies the failure, see VerificationReport.Reason
+	Reason   FailureReason `json:"reason,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// AuditSink receives an AuditEvent for every call to VerifyPKToken, e.g. to
+// write an audit trail on an SSH bastion. Audit is called synchronously
+// after verification completes and must not block for long.
+type AuditSink interface {
+	Audit(ctx context.Context, event AuditEvent)
+}
+
+// AuditSinkFunc adapts a function to an AuditSink
+type AuditSinkFunc func(ctx context.Context, event AuditEvent)
+
+func (f AuditSinkFunc) Audit(ctx context.Context, event AuditEvent) {
+	f(ctx, event)
+}
+
+// WithAuditSink sends an AuditEvent to the sink for every verification
+// attempt
+func WithAuditSink(sink AuditSink) VerifierOpts {
+	return func(v *Verifier) error {
+		v.auditSinks = append(v.auditSinks, sink)
+		return nil
+	}
+}
+
+func newAuditEvent(pkt *pktoken.PKToken, report *VerificationReport, duration time.Duration) AuditEvent {
+	event := AuditEvent{
+		Time:     time.Now(),
+		Success:  report.Err == nil,
+		Reason:   report.Reason,
+		Duration: duration,
+	}
+	if report.Err != nil {
+		event.FailureReason = report.Err.Error()
+	}
+	if pkt == nil {
+		return event
+	}
+
+	var claims oidc.OidcClaims
+	if err := json.Unmarshal(pkt.Payload, &claims); err == nil {
+		event.Issuer = claims.Issuer
+		event.Subject = claims.Subject
+		event.Audience = claims.Audience
+	}
+	if alg, ok := pkt.ProviderAlgorithm(); ok {
+		event.Algorithm = alg.String()
+		event.GQ = alg == gq.GQ256
+	}
+	if pkt.Cos != nil {
+		event.CosignerPresent = true
+		if cosClaims, err := pkt.ParseCosignerClaims(); err == nil {
+			event.CosignerIssuer = cosClaims.Issuer
+		}
+	}
+	return event
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditSink(t *testing.T) {
+	clientID := "verifier"
+	provider, _, err := NewMockOpenIdProvider(true, "issuer-provider", clientID, map[string]any{
+		"aud": clientID,
+		"sub": "alice",
+	})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	otherProvider, _, err := NewMockOpenIdProvider(false, "other-provider", clientID, map[string]any{
+		"aud": clientID,
+	})
+	require.NoError(t, err)
+
+	events := []verifier.AuditEvent{}
+	sink := verifier.AuditSinkFunc(func(_ context.Context, event verifier.AuditEvent) {
+		events = append(events, event)
+	})
+
+	pktVerifier, err := verifier.New(provider, verifier.WithAuditSink(sink))
+	require.NoError(t, err)
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), pkt))
+
+	otherVerifier, err := verifier.New(otherProvider, verifier.WithAuditSink(sink))
+	require.NoError(t, err)
+	require.Error(t, otherVerifier.VerifyPKToken(context.Background(), pkt))
+
+	require.Len(t, events, 2)
+
+	success := events[0]
+	require.True(t, success.Success)
+	require.Empty(t, success.FailureReason)
+	require.Equal(t, "issuer-provider", success.Issuer)
+	require.Equal(t, "alice", success.Subject)
+	require.Equal(t, clientID, success.Audience)
+	require.Equal(t, "GQ256", success.Algorithm)
+	require.True(t, success.GQ)
+	require.False(t, success.CosignerPresent)
+	require.False(t, success.Time.IsZero())
+
+	failure := events[1]
+	require.False(t, failure.Success)
+	require.Contains(t, failure.FailureReason, "unrecognized issuer: issuer-provider")
+	require.Equal(t, verifier.ReasonUnknownIssuer, failure.Reason)
+	require.Equal(t, "issuer-provider", failure.Issuer)
+}
@@ -0,0 +1,236 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/cosigner"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// BundleTyp is the typ of a signed verification bundle
+const BundleTyp = "OPK-BUNDLE"
+
+// BundleIssuer is the configuration of an OpenID provider captured in a
+// verification bundle along with a snapshot of its JWKS
+type BundleIssuer struct {
+	Issuer string `json:"iss"`
+	// ClientID is checked against the audience of the ID Token unless
+	// SkipClientIDCheck is set
+	ClientID          string `json:"client_id,omitempty"`
+	SkipClientIDCheck bool   `json:"skip_client_id_check,omitempty"`
+	// CommitClaim and GQCommitment say how the ID Token commits to the CIC,
+	// if neither is set the CommitType registered for the issuer in
+	// providers.Commitments is used
+	CommitClaim  string          `json:"commit_claim,omitempty"`
+	GQCommitment bool            `json:"gq_commitment,omitempty"`
+	GQOnly       bool            `json:"gq_only,omitempty"`
+	Jwks         json.RawMessage `json:"jwks,omitempty"`
+}
+
+// BundleCosigner is a cosigner captured in a verification bundle along
+// with a snapshot of its JWKS
+type BundleCosigner struct {
+	Issuer string          `json:"iss"`
+	Strict bool            `json:"strict"`
+	Jwks   json.RawMessage `json:"jwks,omitempty"`
+}
+
+// VerificationBundle pins the JWKS of OpenID providers and cosigners so
+// that PK Tokens can be verified without network access, e.g. in an
+// air-gapped environment. It is only valid between NotBefore and
+// Expiration.
+type VerificationBundle struct {
+	IssuedAt   int64            `json:"iat"`
+	NotBefore  int64            `json:"nbf"`
+	Expiration int64            `json:"exp"`
+	Issuers    []BundleIssuer   `json:"issuers"`
+	Cosigners  []BundleCosigner `json:"cosigners,omitempty"`
+}
+
+// ExportBundle snapshots the JWKS of the issuers and cosigners using
+// finder, or discover.DefaultPubkeyFinder if nil, into a bundle valid for
+// validity from now. The bundle is signed by the exporter's signer so
+// that the verifier importing it only needs to trust the exporter's
+// public key. The Jwks of the issuers and cosigners passed in is ignored.
+func ExportBundle(
+	ctx context.Context,
+	finder *discover.PublicKeyFinder,
+	issuers []BundleIssuer,
+	cosigners []BundleCosigner,
+	validity time.Duration,
+	signer crypto.Signer,
+	alg jwa.SignatureAlgorithm,
+) ([]byte, error) {
+	if finder == nil {
+		finder = discover.DefaultPubkeyFinder()
+	}
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("verification bundle requires at least one issuer")
+	}
+
+	now := time.Now()
+	bundle := VerificationBundle{
+		IssuedAt:   now.Unix(),
+		NotBefore:  now.Unix(),
+		Expiration: now.Add(validity).Unix(),
+		Issuers:    []BundleIssuer{},
+		Cosigners:  []BundleCosigner{},
+	}
+	for _, issuer := range issuers {
+		jwks, err := finder.JwksFunc(ctx, issuer.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS of issuer (%s): %w", issuer.Issuer, err)
+		}
+		issuer.Jwks = jwks
+		bundle.Issuers = append(bundle.Issuers, issuer)
+	}
+	for _, cos := range cosigners {
+		jwks, err := finder.JwksFunc(ctx, cos.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS of cosigner (%s): %w", cos.Issuer, err)
+		}
+		cos.Jwks = jwks
+		bundle.Cosigners = append(bundle.Cosigners, cos)
+	}
+
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, BundleTyp); err != nil {
+		return nil, err
+	}
+	return jws.Sign(payload, jws.WithKey(alg, signer, jws.WithProtectedHeaders(headers)))
+}
+
+// ParseBundle verifies that the bundle was signed by the exporter's public
+// key and that it is currently valid.
+func ParseBundle(signedBundle []byte, exporterKey crypto.PublicKey, alg jwa.SignatureAlgorithm) (*VerificationBundle, error) {
+	msg, err := jws.Parse(signedBundle)
+	if err != nil {
+		return nil, fmt.Errorf("malformed verification bundle: %w", err)
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, fmt.Errorf("verification bundle must have exactly one signature, got %d", len(msg.Signatures()))
+	}
+	if typ := msg.Signatures()[0].ProtectedHeaders().Type(); typ != BundleTyp {
+		return nil, fmt.Errorf("expected typ (%s) for verification bundle, got (%s)", BundleTyp, typ)
+	}
+	payload, err := jws.Verify(signedBundle, jws.WithKey(alg, exporterKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify verification bundle signature: %w", err)
+	}
+
+	var bundle VerificationBundle
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return nil, fmt.Errorf("malformed verification bundle: %w", err)
+	}
+	if err := bundle.checkValidity(); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+func (b *VerificationBundle) checkValidity() error {
+	now := time.Now().Unix()
+	if now < b.NotBefore {
+		return fmt.Errorf("verification bundle is not yet valid (nbf = %v)", b.NotBefore)
+	}
+	if now >= b.Expiration {
+		return fmt.Errorf("verification bundle has expired (exp = %v)", b.Expiration)
+	}
+	return nil
+}
+
+// PublicKeyFinder returns a PublicKeyFinder which looks up keys only in
+// the JWKS pinned in the bundle and never makes network requests. It
+// fails once the bundle is no longer valid.
+func (b *VerificationBundle) PublicKeyFinder() *discover.PublicKeyFinder {
+	jwksByIssuer := map[string][]byte{}
+	for _, issuer := range b.Issuers {
+		jwksByIssuer[issuer.Issuer] = issuer.Jwks
+	}
+	for _, cos := range b.Cosigners {
+		jwksByIssuer[cos.Issuer] = cos.Jwks
+	}
+	return &discover.PublicKeyFinder{
+		JwksFunc: func(_ context.Context, issuer string) ([]byte, error) {
+			if err := b.checkValidity(); err != nil {
+				return nil, err
+			}
+			jwks, ok := jwksByIssuer[issuer]
+			if !ok {
+				return nil, fmt.Errorf("issuer (%s) is not in the verification bundle", issuer)
+			}
+			return jwks, nil
+		},
+	}
+}
+
+// NewFromBundle creates a verifier which verifies PK Tokens from the
+// bundle's issuers, and requires the bundle's cosigners, using only the
+// keys pinned in the bundle. If expirationPolicy is nil the ID Token's exp
+// claim is enforced, air-gapped verification of older artifacts will
+// typically want providers.ExpirationPolicies.NEVER_EXPIRE instead.
+func NewFromBundle(bundle *VerificationBundle, expirationPolicy *providers.ExpirationPolicy, options ...VerifierOpts) (*Verifier, error) {
+	if len(bundle.Issuers) == 0 {
+		return nil, fmt.Errorf("verification bundle has no issuers")
+	}
+	finder := bundle.PublicKeyFinder()
+
+	providerVerifiers := []ProviderVerifier{}
+	for _, issuer := range bundle.Issuers {
+		providerVerifiers = append(providerVerifiers, providers.NewProviderVerifier(issuer.Issuer, providers.ProviderVerifierOpts{
+			ClientID:          issuer.ClientID,
+			SkipClientIDCheck: issuer.SkipClientIDCheck,
+			CommitType: providers.CommitType{
+				Claim:        issuer.CommitClaim,
+				GQCommitment: issuer.GQCommitment,
+			},
+			GQOnly:            issuer.GQOnly,
+			DiscoverPublicKey: finder,
+			ExpirationPolicy:  expirationPolicy,
+		}))
+	}
+
+	bundleOpts := []VerifierOpts{}
+	if len(providerVerifiers) > 1 {
+		bundleOpts = append(bundleOpts, AddProviderVerifiers(providerVerifiers[1:]...))
+	}
+	if len(bundle.Cosigners) > 0 {
+		cosignerVerifiers := []*cosigner.DefaultCosignerVerifier{}
+		for _, cos := range bundle.Cosigners {
+			strict := cos.Strict
+			cosignerVerifiers = append(cosignerVerifiers, cosigner.NewCosignerVerifier(cos.Issuer, cosigner.CosignerVerifierOpts{
+				Strict:            &strict,
+				DiscoverPublicKey: finder,
+			}))
+		}
+		bundleOpts = append(bundleOpts, WithCosignerVerifiers(cosignerVerifiers...))
+	}
+	return New(providerVerifiers[0], append(bundleOpts, options...)...)
+}
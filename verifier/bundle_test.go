@@ -0,0 +1,103 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationBundle(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, backend, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{
+		"aud": clientID,
+	})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	exporterSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+
+	bundleIssuers := []verifier.BundleIssuer{{
+		Issuer:      issuer,
+		ClientID:    clientID,
+		CommitClaim: providers.CommitTypesEnum.NONCE_CLAIM.Claim,
+	}}
+	signedBundle, err := verifier.ExportBundle(context.Background(), backend.GetPublicKeyFinder(),
+		bundleIssuers, nil, time.Hour, exporterSigner, jwa.ES256)
+	require.NoError(t, err)
+
+	bundle, err := verifier.ParseBundle(signedBundle, exporterSigner.Public(), jwa.ES256)
+	require.NoError(t, err)
+	require.Len(t, bundle.Issuers, 1)
+	require.NotEmpty(t, bundle.Issuers[0].Jwks)
+
+	t.Run("verifies offline", func(t *testing.T) {
+		offlineVerifier, err := verifier.NewFromBundle(bundle, nil)
+		require.NoError(t, err)
+		require.NoError(t, offlineVerifier.VerifyPKToken(context.Background(), pkt))
+	})
+
+	t.Run("issuer not in bundle", func(t *testing.T) {
+		_, err := bundle.PublicKeyFinder().ByToken(context.Background(), "https://accounts.google.com", pkt.OpToken)
+		require.ErrorContains(t, err, "is not in the verification bundle")
+	})
+
+	t.Run("untrusted exporter", func(t *testing.T) {
+		otherSigner, err := util.GenKeyPair(jwa.ES256)
+		require.NoError(t, err)
+		_, err = verifier.ParseBundle(signedBundle, otherSigner.Public(), jwa.ES256)
+		require.ErrorContains(t, err, "failed to verify verification bundle signature")
+	})
+
+	t.Run("expired bundle", func(t *testing.T) {
+		expiredBundle, err := verifier.ExportBundle(context.Background(), backend.GetPublicKeyFinder(),
+			bundleIssuers, nil, -time.Minute, exporterSigner, jwa.ES256)
+		require.NoError(t, err)
+		_, err = verifier.ParseBundle(expiredBundle, exporterSigner.Public(), jwa.ES256)
+		require.ErrorContains(t, err, "verification bundle has expired")
+	})
+
+	t.Run("no network fallback", func(t *testing.T) {
+		// A bundle whose JWKS doesn't contain the OP's keys must not fall
+		// back to fetching them
+		_, otherBackend, err := NewMockOpenIdProvider(false, issuer, clientID, nil)
+		require.NoError(t, err)
+		otherBundle, err := verifier.ExportBundle(context.Background(), otherBackend.GetPublicKeyFinder(),
+			bundleIssuers, nil, time.Hour, exporterSigner, jwa.ES256)
+		require.NoError(t, err)
+		parsed, err := verifier.ParseBundle(otherBundle, exporterSigner.Public(), jwa.ES256)
+		require.NoError(t, err)
+
+		offlineVerifier, err := verifier.NewFromBundle(parsed, nil)
+		require.NoError(t, err)
+		require.Error(t, offlineVerifier.VerifyPKToken(context.Background(), pkt))
+	})
+}
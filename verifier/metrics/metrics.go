@@ -0,0 +1,120 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics records PK Token verification metrics: outcomes per
+// issuer, failures per reason, verification latency and the JWKS cache hit
+// rate.
+//
+// Metrics are created through a Registry. NewTextRegistry serves them in the
+// Prometheus text format without further dependencies. To register them
+// with a Prometheus client registry instead, implement Registry with
+// prometheus.NewCounterVec and prometheus.NewHistogramVec, whose
+// WithLabelValues methods already satisfy Counter and Observer.
+package metrics
+
+import (
+	"context"
+
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+type Counter interface {
+	Inc()
+}
+
+type Observer interface {
+	Observe(value float64)
+}
+
+type CounterVec interface {
+	WithLabelValues(labelValues ...string) Counter
+}
+
+type HistogramVec interface {
+	WithLabelValues(labelValues ...string) Observer
+}
+
+// Registry creates metrics. It is the hook for exposing the verifier
+// metrics through a metrics system.
+type Registry interface {
+	NewCounterVec(name string, help string, labels []string) CounterVec
+	NewHistogramVec(name string, help string, buckets []float64, labels []string) HistogramVec
+}
+
+// DefaultLatencyBuckets are the verification latency histogram buckets in
+// seconds. Verification is usually fast unless the JWKS has to be fetched.
+var DefaultLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// UnknownIssuer is the issuer label of PK Tokens from issuers the verifier
+// doesn't recognize. Using the claimed issuer would let anyone create
+// arbitrarily many time series.
+const UnknownIssuer = "unknown"
+
+// VerifierMetrics records verification metrics. Register it with a
+// verifier using verifier.WithAuditSink and record JWKS lookups by passing
+// JwksLookup to discover.NewCachingPubkeyFinder.
+type VerifierMetrics struct {
+	verifications CounterVec
+	failures      CounterVec
+	latency       HistogramVec
+	jwksLookups   CounterVec
+}
+
+var _ verifier.AuditSink = (*VerifierMetrics)(nil)
+var _ discover.JwksLookupFunc = (*VerifierMetrics)(nil).JwksLookup
+
+func New(registry Registry) *VerifierMetrics {
+	return &VerifierMetrics{
+		verifications: registry.NewCounterVec("openpubkey_verifications_total",
+			"PK Token verifications by issuer and result.", []string{"issuer", "result"}),
+		failures: registry.NewCounterVec("openpubkey_verification_failures_total",
+			"Failed PK Token verifications by issuer and failure reason.", []string{"issuer", "reason"}),
+		latency: registry.NewHistogramVec("openpubkey_verification_duration_seconds",
+			"PK Token verification latency.", DefaultLatencyBuckets, []string{"issuer"}),
+		jwksLookups: registry.NewCounterVec("openpubkey_jwks_lookups_total",
+			"JWKS lookups by issuer and whether they were served from the cache.", []string{"issuer", "cache"}),
+	}
+}
+
+// Audit records the outcome of a verification
+func (m *VerifierMetrics) Audit(_ context.Context, event verifier.AuditEvent) {
+	issuer := event.Issuer
+	if issuer == "" || event.Reason == verifier.ReasonUnknownIssuer {
+		issuer = UnknownIssuer
+	}
+
+	if event.Success {
+		m.verifications.WithLabelValues(issuer, "success").Inc()
+	} else {
+		m.verifications.WithLabelValues(issuer, "failure").Inc()
+		reason := string(event.Reason)
+		if reason == "" {
+			reason = string(verifier.ReasonOther)
+		}
+		m.failures.WithLabelValues(issuer, reason).Inc()
+	}
+	m.latency.WithLabelValues(issuer).Observe(event.Duration.Seconds())
+}
+
+// JwksLookup records a JWKS lookup, see discover.NewCachingPubkeyFinder
+func (m *VerifierMetrics) JwksLookup(issuer string, hit bool) {
+	cache := "miss"
+	if hit {
+		cache = "hit"
+	}
+	m.jwksLookups.WithLabelValues(issuer, cache).Inc()
+}
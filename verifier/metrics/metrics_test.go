@@ -0,0 +1,99 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/openpubkey/openpubkey/verifier/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifierMetrics(t *testing.T) {
+	issuer := "issuer-provider"
+	providerOpts := providers.DefaultMockProviderOpts()
+	providerOpts.Issuer = issuer
+	provider, _, _, err := providers.NewMockProvider(providerOpts)
+	require.NoError(t, err)
+
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	registry := metrics.NewTextRegistry()
+	verifierMetrics := metrics.New(registry)
+
+	pktVerifier, err := verifier.New(provider, verifier.WithAuditSink(verifierMetrics))
+	require.NoError(t, err)
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), pkt))
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), pkt))
+
+	otherOpts := providers.DefaultMockProviderOpts()
+	otherOpts.Issuer = "other-issuer"
+	otherProvider, _, _, err := providers.NewMockProvider(otherOpts)
+	require.NoError(t, err)
+	otherVerifier, err := verifier.New(otherProvider, verifier.WithAuditSink(verifierMetrics))
+	require.NoError(t, err)
+	require.Error(t, otherVerifier.VerifyPKToken(context.Background(), pkt))
+
+	verifierMetrics.JwksLookup(issuer, false)
+	verifierMetrics.JwksLookup(issuer, true)
+	verifierMetrics.JwksLookup(issuer, true)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	exposition := string(body)
+
+	require.Contains(t, exposition, "# TYPE openpubkey_verifications_total counter\n")
+	require.Contains(t, exposition, `openpubkey_verifications_total{issuer="issuer-provider",result="success"} 2`)
+	// The claimed issuer of an unrecognized PK Token isn't used as a label
+	require.Contains(t, exposition, `openpubkey_verifications_total{issuer="unknown",result="failure"} 1`)
+	require.Contains(t, exposition, `openpubkey_verification_failures_total{issuer="unknown",reason="unknown_issuer"} 1`)
+	require.Contains(t, exposition, `openpubkey_verification_duration_seconds_bucket{issuer="issuer-provider",le="+Inf"} 2`)
+	require.Contains(t, exposition, `openpubkey_verification_duration_seconds_count{issuer="issuer-provider"} 2`)
+	require.Contains(t, exposition, `openpubkey_jwks_lookups_total{issuer="issuer-provider",cache="hit"} 2`)
+	require.Contains(t, exposition, `openpubkey_jwks_lookups_total{issuer="issuer-provider",cache="miss"} 1`)
+}
+
+func TestTextRegistryHistogram(t *testing.T) {
+	registry := metrics.NewTextRegistry()
+	histogram := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, []string{"path"})
+	histogram.WithLabelValues(`a"b`).Observe(0.05)
+	histogram.WithLabelValues(`a"b`).Observe(0.5)
+	histogram.WithLabelValues(`a"b`).Observe(5)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="a\"b",le="0.1"} 1
+latency_seconds_bucket{path="a\"b",le="1"} 2
+latency_seconds_bucket{path="a\"b",le="+Inf"} 3
+latency_seconds_sum{path="a\"b"} 5.55
+latency_seconds_count{path="a\"b"} 3
+`, rec.Body.String())
+}
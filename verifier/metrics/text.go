@@ -0,0 +1,221 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TextRegistry is a Registry which keeps metrics in memory and serves them
+// over HTTP in the Prometheus text exposition format.
+type TextRegistry struct {
+	mu         sync.Mutex
+	counters   []*textCounterVec
+	histograms []*textHistogramVec
+}
+
+var _ Registry = (*TextRegistry)(nil)
+var _ http.Handler = (*TextRegistry)(nil)
+
+func NewTextRegistry() *TextRegistry {
+	return &TextRegistry{}
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+type textCounterVec struct {
+	metricDesc
+	registry *TextRegistry
+	values   map[string]float64 // by encoded label values
+}
+
+type textCounter struct {
+	vec *textCounterVec
+	key string
+}
+
+type textHistogramVec struct {
+	metricDesc
+	registry *TextRegistry
+	buckets  []float64
+	values   map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type textObserver struct {
+	vec *textHistogramVec
+	key string
+}
+
+func (r *TextRegistry) NewCounterVec(name string, help string, labels []string) CounterVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vec := &textCounterVec{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		registry:   r,
+		values:     map[string]float64{},
+	}
+	r.counters = append(r.counters, vec)
+	return vec
+}
+
+func (r *TextRegistry) NewHistogramVec(name string, help string, buckets []float64, labels []string) HistogramVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The +Inf bucket is always written so isn't kept with the others
+	sorted := []float64{}
+	for _, upperBound := range buckets {
+		if !math.IsInf(upperBound, +1) {
+			sorted = append(sorted, upperBound)
+		}
+	}
+	sort.Float64s(sorted)
+	vec := &textHistogramVec{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		registry:   r,
+		buckets:    sorted,
+		values:     map[string]*histogramValue{},
+	}
+	r.histograms = append(r.histograms, vec)
+	return vec
+}
+
+func (v *textCounterVec) WithLabelValues(labelValues ...string) Counter {
+	return &textCounter{vec: v, key: v.key(labelValues)}
+}
+
+func (c *textCounter) Inc() {
+	c.vec.registry.mu.Lock()
+	defer c.vec.registry.mu.Unlock()
+	c.vec.values[c.key]++
+}
+
+func (v *textHistogramVec) WithLabelValues(labelValues ...string) Observer {
+	return &textObserver{vec: v, key: v.key(labelValues)}
+}
+
+func (o *textObserver) Observe(value float64) {
+	o.vec.registry.mu.Lock()
+	defer o.vec.registry.mu.Unlock()
+	h, ok := o.vec.values[o.key]
+	if !ok {
+		h = &histogramValue{counts: make([]uint64, len(o.vec.buckets))}
+		o.vec.values[o.key] = h
+	}
+	for i, upperBound := range o.vec.buckets {
+		if value <= upperBound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// key encodes the label values as the label set of the text format
+func (d metricDesc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values", d.name, len(d.labels), len(labelValues)))
+	}
+	pairs := []string{}
+	for i, label := range d.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(labelValues[i])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// withLabel appends a label to an encoded label set
+func withLabel(key string, label string, value string) string {
+	pair := fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(value))
+	if key == "" {
+		return pair
+	}
+	return key + "," + pair
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (r *TextRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, vec := range r.counters {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", vec.name, vec.help, vec.name)
+		for _, key := range sortedKeys(vec.values) {
+			fmt.Fprintf(&b, "%s{%s} %s\n", vec.name, key, formatFloat(vec.values[key]))
+		}
+	}
+	for _, vec := range r.histograms {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", vec.name, vec.help, vec.name)
+		for _, key := range sortedKeys(vec.values) {
+			h := vec.values[key]
+			var cumulative uint64
+			for i, upperBound := range vec.buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&b, "%s_bucket{%s} %d\n", vec.name, withLabel(key, "le", formatFloat(upperBound)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s} %d\n", vec.name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(&b, "%s_sum{%s} %s\n", vec.name, key, formatFloat(h.sum))
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", vec.name, key, h.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for scraping by Prometheus
+func (r *TextRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := r.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
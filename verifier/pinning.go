@@ -0,0 +1,93 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"slices"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// ProviderKeyFinder is implemented by provider verifiers which can look up
+// the OP public key an ID Token is signed with, as the OpenIdProviders and
+// providers.DefaultProviderVerifier do. Pinning provider keys requires it.
+type ProviderKeyFinder interface {
+	PublicKeyByToken(ctx context.Context, token []byte) (*discover.PublicKeyRecord, error)
+}
+
+// WithPinnedProviderKeys only accepts PK Tokens from the issuer whose ID
+// Token is signed by an OP key with one of the jkts, the base64url encoded
+// RFC 7638 SHA-256 JWK thumbprints, even if other keys are in the OP's live
+// JWKS. This defends high-security deployments against a compromised JWKS
+// endpoint, at the cost of updating the pins when the OP rotates its keys.
+// Pinning an issuer again adds to its pinned keys.
+func WithPinnedProviderKeys(issuer string, jkts ...string) VerifierOpts {
+	return func(v *Verifier) error {
+		if len(jkts) == 0 {
+			return fmt.Errorf("no provider keys to pin for issuer %s", issuer)
+		}
+		if v.pinnedProviderKeys == nil {
+			v.pinnedProviderKeys = map[string][]string{}
+		}
+		v.pinnedProviderKeys[issuer] = append(v.pinnedProviderKeys[issuer], jkts...)
+		return nil
+	}
+}
+
+// checkPinnedProviderKeys returns an error if an issuer has pinned keys but
+// its provider verifier can't look up which key signed an ID Token
+func (v *Verifier) checkPinnedProviderKeys() error {
+	for issuer := range v.pinnedProviderKeys {
+		provider, ok := v.providers[issuer]
+		if !ok {
+			return fmt.Errorf("provider keys pinned for issuer %s which has no provider verifier", issuer)
+		}
+		if _, ok := provider.(ProviderKeyFinder); !ok {
+			return fmt.Errorf("provider keys pinned for issuer %s but its provider verifier can't look up public keys", issuer)
+		}
+	}
+	return nil
+}
+
+// verifyPinnedProviderKey checks that the ID Token of the PK Token, already
+// verified by the provider verifier, is signed by one of the issuer's
+// pinned keys
+func verifyPinnedProviderKey(ctx context.Context, provider ProviderKeyFinder, pkt *pktoken.PKToken, jkts []string) error {
+	record, err := provider.PublicKeyByToken(ctx, pkt.OpToken)
+	if err != nil {
+		return fmt.Errorf("failed to look up OP public key: %w", err)
+	}
+	key, err := jwk.PublicKeyOf(record.PublicKey)
+	if err != nil {
+		return err
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	jkt := string(util.Base64EncodeForJWT(thumbprint))
+	if !slices.Contains(jkts, jkt) {
+		return fmt.Errorf("OP public key (jkt %s) is not one of the keys pinned for issuer %s", jkt, record.Issuer)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"crypto"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func jktOf(t *testing.T, publicKey crypto.PublicKey) string {
+	key, err := jwk.PublicKeyOf(publicKey)
+	require.NoError(t, err)
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	return string(util.Base64EncodeForJWT(thumbprint))
+}
+
+func TestPinnedProviderKeys(t *testing.T) {
+	ctx := context.Background()
+	issuer := "https://accounts.example.com"
+
+	for _, gqSign := range []bool{false, true} {
+		provider, backend, err := NewMockOpenIdProvider(gqSign, issuer, "test_client_id", map[string]any{})
+		require.NoError(t, err)
+		opkClient, err := client.New(provider)
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(ctx)
+		require.NoError(t, err)
+
+		record, err := provider.PublicKeyByToken(ctx, pkt.OpToken)
+		require.NoError(t, err)
+		jkt := jktOf(t, record.PublicKey)
+		otherSigner, err := util.GenKeyPair(jwa.ES256)
+		require.NoError(t, err)
+		otherJkt := jktOf(t, otherSigner.Public())
+
+		pktVerifier, err := verifier.New(provider, verifier.WithPinnedProviderKeys(issuer, otherJkt, jkt))
+		require.NoError(t, err)
+		report := pktVerifier.VerifyPKTokenReport(ctx, pkt)
+		require.NoError(t, report.Err)
+		check, ok := report.Check(verifier.CheckProviderKey)
+		require.True(t, ok)
+		require.Equal(t, verifier.CheckPassed, check.Status)
+
+		// The key signing the ID Token is in the JWKS but isn't pinned
+		pktVerifier, err = verifier.New(provider, verifier.WithPinnedProviderKeys(issuer, otherJkt))
+		require.NoError(t, err)
+		report = pktVerifier.VerifyPKTokenReport(ctx, pkt)
+		require.ErrorContains(t, report.Err, "is not one of the keys pinned for issuer https://accounts.example.com")
+		require.Equal(t, verifier.ReasonBadSignature, report.Reason)
+
+		// Pins of other issuers don't apply
+		other, _, err := NewMockOpenIdProvider(gqSign, "https://other.example.com", "test_client_id", map[string]any{})
+		require.NoError(t, err)
+		pktVerifier, err = verifier.New(provider,
+			verifier.AddProviderVerifiers(other),
+			verifier.WithPinnedProviderKeys("https://other.example.com", otherJkt))
+		require.NoError(t, err)
+		report = pktVerifier.VerifyPKTokenReport(ctx, pkt)
+		require.NoError(t, report.Err)
+		check, _ = report.Check(verifier.CheckProviderKey)
+		require.Equal(t, verifier.CheckSkipped, check.Status)
+
+		// Provider verifiers that can look up keys are supported
+		pktVerifier, err = verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+			CommitType:        providers.CommitTypesEnum.NONCE_CLAIM,
+			ClientID:          "test_client_id",
+			DiscoverPublicKey: backend.GetPublicKeyFinder(),
+		}), verifier.WithPinnedProviderKeys(issuer, jkt))
+		require.NoError(t, err)
+		require.NoError(t, pktVerifier.VerifyPKToken(ctx, pkt))
+	}
+
+	_, err := verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{}),
+		verifier.WithPinnedProviderKeys("https://unknown.example.com", "jkt"))
+	require.ErrorContains(t, err, "has no provider verifier")
+	_, err = verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{}),
+		verifier.WithPinnedProviderKeys(issuer))
+	require.ErrorContains(t, err, "no provider keys to pin")
+}
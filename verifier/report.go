@@ -0,0 +1,489 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/telemetry"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// CheckName names a step of PK Token verification
+type CheckName string
+
+const (
+	CheckClientSignature  CheckName = "client_signature"
+	CheckIssuer           CheckName = "issuer"
+	CheckIDToken          CheckName = "id_token"
+	CheckProviderKey      CheckName = "provider_key"
+	CheckExpiration       CheckName = "expiration"
+	CheckEmailVerified    CheckName = "email_verified"
+	CheckRevocation       CheckName = "revocation"
+	CheckRefreshedIDToken CheckName = "refreshed_id_token"
+	CheckCosigner         CheckName = "cosigner"
+	CheckSignatures       CheckName = "signatures"
+	CheckExtra            CheckName = "extra_checks"
+	CheckUses             CheckName = "uses"
+)
+
+type CheckStatus string
+
+const (
+	CheckPassed  CheckStatus = "passed"
+	CheckFailed  CheckStatus = "failed"
+	CheckSkipped CheckStatus = "skipped" // The check isn't configured for this verifier
+)
+
+type CheckResult struct {
+	Name   CheckName
+	Status CheckStatus
+	Err    error
+}
+
+// FailureReason classifies why verification failed
+type FailureReason string
+
+const (
+	ReasonNone               FailureReason = ""
+	ReasonExpired            FailureReason = "expired"
+	ReasonNotYetValid        FailureReason = "not_yet_valid"
+	ReasonBadSignature       FailureReason = "bad_signature"
+	ReasonWrongAudience      FailureReason = "wrong_audience"
+	ReasonCommitmentMismatch FailureReason = "commitment_mismatch"
+	ReasonUnknownIssuer      FailureReason = "unknown_issuer"
+	ReasonRevoked            FailureReason = "revoked"
+	ReasonCosigner           FailureReason = "cosigner"
+	ReasonUsesExhausted      FailureReason = "uses_exhausted"
+	ReasonOther              FailureReason = "other"
+)
+
+// Identity is the identity the PK Token was issued to
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Audience string
+	Email    string
+	Username string
+}
+
+// CosignerIdentity identifies the cosigner signature on the PK Token
+type CosignerIdentity struct {
+	Issuer    string
+	KeyID     string
+	Algorithm string
+	AuthID    string
+}
+
+// KeyInfo describes the keys the PK Token is signed with
+type KeyInfo struct {
+	// ProviderKeyID is the kid of the OP's signing key. For GQ signed ID
+	// Tokens it is the kid of the original RSA signature.
+	ProviderKeyID string
+	ProviderAlg   string
+	GQ            bool
+	// UserKeyThumbprint is the JWK thumbprint of the user's public key in
+	// the CIC
+	UserKeyThumbprint string
+}
+
+// VerificationReport is the outcome of VerifyPKTokenReport. Checks lists,
+// in order, each check run until the first failure, along with the checks
+// skipped because they aren't configured. The identities and keys are
+// read from the PK Token as presented and are only verified if Valid.
+type VerificationReport struct {
+	Valid    bool
+	Err      error
+	Reason   FailureReason
+	Checks   []CheckResult
+	Identity Identity
+	Cosigner *CosignerIdentity
+	Key      KeyInfo
+}
+
+// Check returns the result of the named check and false if it wasn't run
+func (r *VerificationReport) Check(name CheckName) (CheckResult, bool) {
+	for _, check := range r.Checks {
+		if check.Name == name {
+			return check, true
+		}
+	}
+	return CheckResult{}, false
+}
+
+func (r *VerificationReport) run(ctx context.Context, name CheckName, reason FailureReason, check func(context.Context) error) bool {
+	ctx, end := telemetry.Start(ctx, telemetry.OpVerifyCheck+string(name))
+	err := check(ctx)
+	end(&err)
+	if err != nil {
+		r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckFailed, Err: err})
+		r.Err = err
+		r.Reason = failureReason(err, reason)
+		return false
+	}
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckPassed})
+	return true
+}
+
+func (r *VerificationReport) skip(name CheckName) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckSkipped})
+}
+
+// failureReason classifies err using the kinds of errors returned by the
+// provider verifiers, falling back to the reason of the check
+func failureReason(err error, fallback FailureReason) FailureReason {
+	switch {
+	case errors.Is(err, providers.ErrTokenExpired):
+		return ReasonExpired
+	case errors.Is(err, providers.ErrTokenNotYetValid):
+		return ReasonNotYetValid
+	case errors.Is(err, providers.ErrInvalidSignature):
+		return ReasonBadSignature
+	case errors.Is(err, providers.ErrAudienceMismatch):
+		return ReasonWrongAudience
+	case errors.Is(err, providers.ErrCommitmentMismatch):
+		return ReasonCommitmentMismatch
+	default:
+		return fallback
+	}
+}
+
+// VerifyPKTokenReport verifies the PK Token like VerifyPKToken but returns
+// a report of which checks passed, why verification failed and who the PK
+// Token identifies, for use by policy engines and UIs.
+func (v *Verifier) VerifyPKTokenReport(
+	ctx context.Context,
+	pkt *pktoken.PKToken,
+	extraChecks ...Check,
+) *VerificationReport {
+	start := time.Now()
+	ctx, end := telemetry.Start(telemetry.NewContext(ctx, v.telemetry), telemetry.OpVerify)
+	report := v.verifyPKToken(ctx, pkt, extraChecks...)
+	if report.Err == nil {
+		report.Valid = true
+	}
+	end(&report.Err)
+	if len(v.auditSinks) > 0 {
+		event := newAuditEvent(pkt, report, time.Since(start))
+		for _, sink := range v.auditSinks {
+			sink.Audit(ctx, event)
+		}
+	}
+	return report
+}
+
+func (v *Verifier) verifyPKToken(
+	ctx context.Context,
+	pkt *pktoken.PKToken,
+	extraChecks ...Check,
+) *VerificationReport {
+	report := &VerificationReport{}
+	report.describe(pkt)
+
+	// Don't even bother doing anything if the user's isn't valid
+	if !report.run(ctx, CheckClientSignature, ReasonBadSignature, func(ctx context.Context) error {
+		if err := verifyCicSignature(pkt); err != nil {
+			return fmt.Errorf("error verifying client signature on PK Token: %w", err)
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	var providerVerifier ProviderVerifier
+	var issuer string
+	if !report.run(ctx, CheckIssuer, ReasonUnknownIssuer, func(ctx context.Context) error {
+		var err error
+		issuer, err = pkt.Issuer()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		providerVerifier, ok = v.providers[issuer]
+		if !ok {
+			return fmt.Errorf("unrecognized issuer: %s", issuer)
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	if !report.run(ctx, CheckIDToken, ReasonOther, func(ctx context.Context) error {
+		cic, err := pkt.GetCicValues()
+		if err != nil {
+			return err
+		}
+		return providerVerifier.VerifyIDToken(ctx, pkt.OpToken, cic)
+	}) {
+		return report
+	}
+
+	if jkts, ok := v.pinnedProviderKeys[issuer]; !ok {
+		report.skip(CheckProviderKey)
+	} else if !report.run(ctx, CheckProviderKey, ReasonBadSignature, func(ctx context.Context) error {
+		return verifyPinnedProviderKey(ctx, providerVerifier.(ProviderKeyFinder), pkt, jkts)
+	}) {
+		return report
+	}
+
+	if v.expirationPolicy == nil {
+		report.skip(CheckExpiration)
+	} else if !report.run(ctx, CheckExpiration, ReasonOther, func(ctx context.Context) error {
+		var claims oidc.OidcClaims
+		if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+			return fmt.Errorf("malformed PK Token payload: %w", err)
+		}
+		policy := *v.expirationPolicy
+		if v.clockSkew != nil {
+			policy = policy.WithClockSkewPolicy(*v.clockSkew)
+		}
+		return policy.CheckExpiration(claims)
+	}) {
+		return report
+	}
+
+	if !v.requireEmailVerified {
+		report.skip(CheckEmailVerified)
+	} else if !report.run(ctx, CheckEmailVerified, ReasonOther, func(ctx context.Context) error {
+		email, verified, err := pkt.EmailVerified()
+		if err != nil {
+			return err
+		}
+		if email != "" && !verified {
+			return fmt.Errorf("email %s is not verified by the OP (email_verified is not true)", email)
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	if len(v.revocationCheckers) == 0 {
+		report.skip(CheckRevocation)
+	} else if !report.run(ctx, CheckRevocation, ReasonRevoked, func(ctx context.Context) error {
+		for _, checker := range v.revocationCheckers {
+			revoked, err := checker.IsRevoked(ctx, pkt)
+			if err != nil {
+				return fmt.Errorf("error checking PK Token revocation: %w", err)
+			}
+			if revoked {
+				return fmt.Errorf("PK Token has been revoked")
+			}
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	if !v.requireRefreshedIDToken {
+		report.skip(CheckRefreshedIDToken)
+	} else if !report.run(ctx, CheckRefreshedIDToken, ReasonOther, func(ctx context.Context) error {
+		reProviderVerifier, ok := providerVerifier.(RefreshableProviderVerifier)
+		if !ok {
+			return fmt.Errorf("refreshed ID Token verification required but provider verifier (issuer=%s) does not support it", issuer)
+		}
+		if pkt.FreshIDToken == nil {
+			return fmt.Errorf("no refreshed ID Token set")
+		}
+		return reProviderVerifier.VerifyRefreshedIDToken(ctx, pkt.OpToken, pkt.FreshIDToken)
+	}) {
+		return report
+	}
+
+	if len(v.cosigners) == 0 {
+		report.skip(CheckCosigner)
+	} else if !report.run(ctx, CheckCosigner, ReasonCosigner, func(ctx context.Context) error {
+		return v.verifyCosigners(ctx, pkt)
+	}) {
+		return report
+	}
+
+	if len(v.signatureVerifierOrder) == 0 {
+		report.skip(CheckSignatures)
+	} else if !report.run(ctx, CheckSignatures, ReasonOther, func(ctx context.Context) error {
+		// Run registered external signature verifiers in the order they were added
+		for _, sigType := range v.signatureVerifierOrder {
+			if err := v.signatureVerifiers[sigType].VerifySignature(ctx, pkt); err != nil {
+				return fmt.Errorf("error verifying %s signature: %w", sigType, err)
+			}
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	if len(extraChecks) == 0 {
+		report.skip(CheckExtra)
+	} else if !report.run(ctx, CheckExtra, ReasonOther, func(ctx context.Context) error {
+		// Cycles through any provided additional checks and returns the first error, if any.
+		for _, check := range extraChecks {
+			if err := check(v, pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) {
+		return report
+	}
+
+	// Uses are counted last so that failed verifications don't use up a
+	// limited-use PK Token
+	maxUses, limited, err := maxUsesOf(pkt)
+	if err != nil {
+		report.run(ctx, CheckUses, ReasonOther, func(ctx context.Context) error { return err })
+		return report
+	}
+	if !limited {
+		report.skip(CheckUses)
+	} else {
+		report.run(ctx, CheckUses, ReasonUsesExhausted, func(ctx context.Context) error {
+			if v.useCounter == nil {
+				return fmt.Errorf("PK Token is limited-use but no use counter is configured")
+			}
+			uses, err := v.useCounter.Use(ctx, TokenHash(pkt))
+			if err != nil {
+				return fmt.Errorf("error counting PK Token uses: %w", err)
+			}
+			if uses > maxUses {
+				return fmt.Errorf("PK Token has been used %d times, exceeding its limit of %d", uses, maxUses)
+			}
+			return nil
+		})
+	}
+	return report
+}
+
+func maxUsesOf(pkt *pktoken.PKToken) (int, bool, error) {
+	cic, err := pkt.GetCicValues()
+	if err != nil {
+		return 0, false, err
+	}
+	return cic.MaxUses()
+}
+
+func (v *Verifier) verifyCosigners(ctx context.Context, pkt *pktoken.PKToken) error {
+	if pkt.Cos == nil {
+		// If there's no cosigner signature and any provided cosigner verifiers are strict, then return error
+		for _, cosignerVerifier := range v.cosigners {
+			if cosignerVerifier.Strict() {
+				return fmt.Errorf("missing required cosigner signature by %s", cosignerVerifier.Issuer())
+			}
+		}
+		return nil
+	}
+
+	cosignerClaims, err := pkt.ParseCosignerClaims()
+	if err != nil {
+		return err
+	}
+
+	cosignerVerifier, ok := v.cosigners[cosignerClaims.Issuer]
+	if !ok {
+		// If other cosigners are present, do we accept?
+		return fmt.Errorf("unrecognized cosigner %s", cosignerClaims.Issuer)
+	}
+
+	// Verify cosigner signature
+	if err := cosignerVerifier.VerifyCosigner(ctx, pkt); err != nil {
+		return err
+	}
+
+	// If any other cosigner verifiers are set to strict but aren't present, then return error
+	for _, cosignerVerifier := range v.cosigners {
+		if cosignerVerifier.Strict() && cosignerVerifier.Issuer() != cosignerClaims.Issuer {
+			return fmt.Errorf("missing required cosigner signature by %s", cosignerVerifier.Issuer())
+		}
+	}
+	return nil
+}
+
+// describe fills in the identities and keys of the report from the PK
+// Token. Parts of the PK Token which can't be parsed are left empty, the
+// checks report why.
+func (r *VerificationReport) describe(pkt *pktoken.PKToken) {
+	if pkt == nil {
+		return
+	}
+
+	var claims oidc.OidcClaims
+	if err := json.Unmarshal(pkt.Payload, &claims); err == nil {
+		r.Identity = Identity{
+			Issuer:   claims.Issuer,
+			Subject:  claims.Subject,
+			Audience: claims.Audience,
+			Email:    claims.Email,
+			Username: claims.Username,
+		}
+	}
+
+	if pkt.Op != nil {
+		headers := pkt.Op.ProtectedHeaders()
+		r.Key.ProviderAlg = headers.Algorithm().String()
+		r.Key.ProviderKeyID = headers.KeyID()
+		if headers.Algorithm() == gq.GQ256 {
+			r.Key.GQ = true
+			if origHeaders, err := originalTokenHeaders(pkt.OpToken); err == nil {
+				r.Key.ProviderKeyID = origHeaders.KeyID
+			}
+		}
+	}
+
+	if cic, err := pkt.GetCicValues(); err == nil {
+		if jkt, err := cic.PublicKey().Thumbprint(crypto.SHA256); err == nil {
+			r.Key.UserKeyThumbprint = string(util.Base64EncodeForJWT(jkt))
+		}
+	}
+
+	if pkt.Cos != nil {
+		if cosClaims, err := pkt.ParseCosignerClaims(); err == nil {
+			r.Cosigner = &CosignerIdentity{
+				Issuer:    cosClaims.Issuer,
+				KeyID:     cosClaims.KeyID,
+				Algorithm: cosClaims.Algorithm,
+				AuthID:    cosClaims.AuthID,
+			}
+		}
+	}
+}
+
+type tokenHeaders struct {
+	KeyID string `json:"kid"`
+}
+
+func originalTokenHeaders(token []byte) (*tokenHeaders, error) {
+	origHeadersB64, err := gq.OriginalJWTHeaders(token)
+	if err != nil {
+		return nil, err
+	}
+	origHeaders, err := util.Base64DecodeForJWT(origHeadersB64)
+	if err != nil {
+		return nil, err
+	}
+	var headers tokenHeaders
+	if err := json.Unmarshal(origHeaders, &headers); err != nil {
+		return nil, err
+	}
+	return &headers, nil
+}
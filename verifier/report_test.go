@@ -0,0 +1,120 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPKTokenReport(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	newPkt := func(t *testing.T, gqSign bool, extraClaims map[string]any) (*pktoken.PKToken, *verifier.Verifier, providers.OpenIdProvider) {
+		provider, _, err := NewMockOpenIdProvider(gqSign, issuer, clientID, extraClaims)
+		require.NoError(t, err)
+		opkClient, err := client.New(provider)
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+		pktVerifier, err := verifier.New(provider)
+		require.NoError(t, err)
+		return pkt, pktVerifier, provider
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		pkt, pktVerifier, _ := newPkt(t, true, map[string]any{"aud": clientID, "sub": "alice", "email": "alice@example.com"})
+
+		report := pktVerifier.VerifyPKTokenReport(context.Background(), pkt)
+		require.True(t, report.Valid)
+		require.NoError(t, report.Err)
+		require.Equal(t, verifier.ReasonNone, report.Reason)
+
+		require.Equal(t, issuer, report.Identity.Issuer)
+		require.Equal(t, "alice", report.Identity.Subject)
+		require.Equal(t, "alice@example.com", report.Identity.Email)
+		require.Equal(t, clientID, report.Identity.Audience)
+		require.Nil(t, report.Cosigner)
+
+		require.True(t, report.Key.GQ)
+		require.Equal(t, "GQ256", report.Key.ProviderAlg)
+		require.NotEmpty(t, report.Key.ProviderKeyID)
+		require.NotEmpty(t, report.Key.UserKeyThumbprint)
+
+		for _, name := range []verifier.CheckName{verifier.CheckClientSignature, verifier.CheckIssuer, verifier.CheckIDToken} {
+			check, ok := report.Check(name)
+			require.True(t, ok, name)
+			require.Equal(t, verifier.CheckPassed, check.Status, name)
+		}
+		check, ok := report.Check(verifier.CheckCosigner)
+		require.True(t, ok)
+		require.Equal(t, verifier.CheckSkipped, check.Status)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		pkt, _, provider := newPkt(t, false, map[string]any{"aud": clientID, "iat": time.Now().Add(-48 * time.Hour).Unix()})
+		pktVerifier, err := verifier.New(provider,
+			verifier.WithExpirationPolicy(providers.ExpirationPolicies.MAX_AGE_24HOURS))
+		require.NoError(t, err)
+
+		report := pktVerifier.VerifyPKTokenReport(context.Background(), pkt)
+		require.False(t, report.Valid)
+		require.Equal(t, verifier.ReasonExpired, report.Reason)
+		check, ok := report.Check(verifier.CheckExpiration)
+		require.True(t, ok)
+		require.Equal(t, verifier.CheckFailed, check.Status)
+		require.Equal(t, report.Err, check.Err)
+
+		// Checks after the failure aren't run
+		_, ok = report.Check(verifier.CheckCosigner)
+		require.False(t, ok)
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		pkt, _, _ := newPkt(t, false, map[string]any{"aud": clientID})
+		otherClientProvider, _, err := NewMockOpenIdProvider(false, issuer, "other-client", nil)
+		require.NoError(t, err)
+		pktVerifier, err := verifier.New(otherClientProvider)
+		require.NoError(t, err)
+
+		report := pktVerifier.VerifyPKTokenReport(context.Background(), pkt)
+		require.False(t, report.Valid)
+		require.Equal(t, verifier.ReasonWrongAudience, report.Reason)
+		require.Equal(t, report.Err, pktVerifier.VerifyPKToken(context.Background(), pkt))
+	})
+
+	t.Run("unknown issuer", func(t *testing.T) {
+		pkt, _, _ := newPkt(t, false, map[string]any{"aud": clientID})
+		otherProvider, _, err := NewMockOpenIdProvider(false, "other-provider", clientID, map[string]any{"aud": clientID})
+		require.NoError(t, err)
+		otherVerifier, err := verifier.New(otherProvider)
+		require.NoError(t, err)
+
+		report := otherVerifier.VerifyPKTokenReport(context.Background(), pkt)
+		require.False(t, report.Valid)
+		require.Equal(t, verifier.ReasonUnknownIssuer, report.Reason)
+		require.ErrorContains(t, report.Err, "unrecognized issuer")
+	})
+}
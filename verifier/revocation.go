@@ -0,0 +1,268 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// RevocationChecker is consulted by VerifyPKToken to reject PK Tokens that
+// have been revoked before they expired, e.g. when an employee is
+// offboarded. An error other than a revocation fails verification as well,
+// so that an unreachable revocation source doesn't let revoked tokens
+// through.
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, pkt *pktoken.PKToken) (bool, error)
+}
+
+// RevocationEntry identifies revoked PK Tokens. An entry with a Hash
+// revokes the single PK Token with that TokenHash. Otherwise the entry
+// revokes the PK Tokens of the Issuer, narrowed to a Subject and/or ID
+// Token JTI when set, so an entry with only iss and sub revokes every PK
+// Token issued to that user.
+type RevocationEntry struct {
+	Issuer  string `json:"iss,omitempty"`
+	Subject string `json:"sub,omitempty"`
+	JTI     string `json:"jti,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+}
+
+// RevocationList is the JSON document read by the file and HTTP backed
+// revocation checkers, e.g.
+//
+//	{"revoked": [{"iss": "https://accounts.google.com", "sub": "1234"}]}
+type RevocationList struct {
+	Revoked []RevocationEntry `json:"revoked"`
+}
+
+// TokenHash returns the hash a RevocationEntry uses to revoke a single PK
+// Token, and that uses are counted by. It is computed over the signing
+// input of the OP's ID Token, its protected header and payload, so that it
+// doesn't depend on whether the PK Token was serialized as JSON or in
+// compact form. As GQ signatures are randomized, the signature is left out
+// and the ID Token's original header is used for GQ signed ID Tokens, so
+// that every PK Token made from the same ID Token has the same hash.
+func TokenHash(pkt *pktoken.PKToken) string {
+	signingInput, err := idTokenSigningInput(pkt)
+	if err != nil {
+		// Such ID Tokens don't verify anyway
+		return string(util.B64SHA3_256(pkt.OpToken))
+	}
+	return string(util.B64SHA3_256(signingInput))
+}
+
+// idTokenSigningInput returns the protected header and payload the OP
+// signed, taking the header from the kid of GQ signed ID Tokens
+func idTokenSigningInput(pkt *pktoken.PKToken) ([]byte, error) {
+	protected, payload, _, err := jws.SplitCompact(pkt.OpToken)
+	if err != nil {
+		return nil, err
+	}
+	if alg, ok := pkt.ProviderAlgorithm(); ok && alg == gq.GQ256 {
+		if protected, err = gq.OriginalJWTHeaders(pkt.OpToken); err != nil {
+			return nil, err
+		}
+	}
+	return util.JoinJWTSegments(protected, payload), nil
+}
+
+type revocationClaims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	JTI     string `json:"jti"`
+}
+
+// IsRevoked returns true if any entry of the list revokes the PK Token
+func (l *RevocationList) IsRevoked(pkt *pktoken.PKToken) (bool, error) {
+	var claims revocationClaims
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return false, fmt.Errorf("malformed PK Token payload: %w", err)
+	}
+	hash := TokenHash(pkt)
+
+	for _, entry := range l.Revoked {
+		if entry.Hash != "" {
+			if entry.Hash == hash {
+				return true, nil
+			}
+			continue
+		}
+		if entry.Issuer == "" || entry.Issuer != claims.Issuer {
+			continue
+		}
+		if entry.Subject == "" && entry.JTI == "" {
+			// Revoking every token of an issuer is the job of the provider
+			// verifier configuration not the revocation list
+			continue
+		}
+		if entry.Subject != "" && entry.Subject != claims.Subject {
+			continue
+		}
+		if entry.JTI != "" && entry.JTI != claims.JTI {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func parseRevocationList(data []byte) (*RevocationList, error) {
+	var list RevocationList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("malformed revocation list: %w", err)
+	}
+	return &list, nil
+}
+
+// FileRevocationChecker checks PK Tokens against a RevocationList stored in
+// a JSON file. The file is reread whenever its modification time changes,
+// so entries can be added without restarting the verifier.
+type FileRevocationChecker struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	list    *RevocationList
+}
+
+var _ RevocationChecker = (*FileRevocationChecker)(nil)
+
+func NewFileRevocationChecker(path string) *FileRevocationChecker {
+	return &FileRevocationChecker{path: path}
+}
+
+func (f *FileRevocationChecker) IsRevoked(_ context.Context, pkt *pktoken.PKToken) (bool, error) {
+	list, err := f.load()
+	if err != nil {
+		return false, err
+	}
+	return list.IsRevoked(pkt)
+}
+
+func (f *FileRevocationChecker) load() (*RevocationList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	if f.list != nil && info.ModTime().Equal(f.modTime) {
+		return f.list, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	list, err := parseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	f.list = list
+	f.modTime = info.ModTime()
+	return list, nil
+}
+
+// DefaultRevocationListTTL is how long HTTPRevocationChecker caches the
+// revocation list
+const DefaultRevocationListTTL = 5 * time.Minute
+
+// HTTPRevocationChecker checks PK Tokens against a RevocationList served
+// over HTTP. The list is cached for TTL, a failed refresh fails the check
+// rather than falling back to the stale list.
+type HTTPRevocationChecker struct {
+	uri        string
+	httpClient *http.Client
+	ttl        time.Duration
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+	list      *RevocationList
+}
+
+var _ RevocationChecker = (*HTTPRevocationChecker)(nil)
+
+// NewHTTPRevocationChecker creates a checker for the revocation list at uri.
+// If httpClient is nil, http.DefaultClient is used. If ttl is 0,
+// DefaultRevocationListTTL is used.
+func NewHTTPRevocationChecker(uri string, httpClient *http.Client, ttl time.Duration) *HTTPRevocationChecker {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if ttl == 0 {
+		ttl = DefaultRevocationListTTL
+	}
+	return &HTTPRevocationChecker{
+		uri:        uri,
+		httpClient: httpClient,
+		ttl:        ttl,
+	}
+}
+
+func (h *HTTPRevocationChecker) IsRevoked(ctx context.Context, pkt *pktoken.PKToken) (bool, error) {
+	list, err := h.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	return list.IsRevoked(pkt)
+}
+
+func (h *HTTPRevocationChecker) load(ctx context.Context) (*RevocationList, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.list != nil && time.Since(h.fetchedAt) < h.ttl {
+		return h.list, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch revocation list: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch revocation list, got status %s", res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch revocation list: %w", err)
+	}
+	list, err := parseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	h.list = list
+	h.fetchedAt = time.Now()
+	return list, nil
+}
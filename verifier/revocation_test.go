@@ -0,0 +1,177 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationCheckers(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{
+		"aud": clientID,
+		"sub": "offboarded-user",
+		"jti": "token-1",
+	})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		entries []verifier.RevocationEntry
+		revoked bool
+	}{
+		{name: "empty list", entries: []verifier.RevocationEntry{}},
+		{name: "revoked user", revoked: true,
+			entries: []verifier.RevocationEntry{{Issuer: issuer, Subject: "offboarded-user"}}},
+		{name: "revoked jti", revoked: true,
+			entries: []verifier.RevocationEntry{{Issuer: issuer, JTI: "token-1"}}},
+		{name: "revoked hash", revoked: true,
+			entries: []verifier.RevocationEntry{{Hash: verifier.TokenHash(pkt)}}},
+		{name: "other user",
+			entries: []verifier.RevocationEntry{{Issuer: issuer, Subject: "someone-else"}}},
+		{name: "same subject other issuer",
+			entries: []verifier.RevocationEntry{{Issuer: "other-issuer", Subject: "offboarded-user"}}},
+		{name: "other jti of user",
+			entries: []verifier.RevocationEntry{{Issuer: issuer, Subject: "offboarded-user", JTI: "token-2"}}},
+		{name: "issuer only entry is ignored",
+			entries: []verifier.RevocationEntry{{Issuer: issuer}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listJson, err := json.Marshal(verifier.RevocationList{Revoked: tc.entries})
+			require.NoError(t, err)
+
+			listPath := filepath.Join(t.TempDir(), "revoked.json")
+			require.NoError(t, os.WriteFile(listPath, listJson, 0600))
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(listJson)
+			}))
+			defer server.Close()
+
+			checkers := map[string]verifier.RevocationChecker{
+				"file": verifier.NewFileRevocationChecker(listPath),
+				"http": verifier.NewHTTPRevocationChecker(server.URL, nil, 0),
+			}
+			for name, checker := range checkers {
+				pktVerifier, err := verifier.New(provider, verifier.WithRevocationCheckers(checker))
+				require.NoError(t, err)
+
+				err = pktVerifier.VerifyPKToken(context.Background(), pkt)
+				if tc.revoked {
+					require.ErrorContains(t, err, "PK Token has been revoked", name)
+				} else {
+					require.NoError(t, err, name)
+				}
+			}
+		})
+	}
+}
+
+func TestFileRevocationCheckerReload(t *testing.T) {
+	provider, _, err := NewMockOpenIdProvider(false, "issuer-provider", "verifier", map[string]any{
+		"aud": "verifier",
+	})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	listPath := filepath.Join(t.TempDir(), "revoked.json")
+	require.NoError(t, os.WriteFile(listPath, []byte(`{"revoked": []}`), 0600))
+
+	checker := verifier.NewFileRevocationChecker(listPath)
+	revoked, err := checker.IsRevoked(context.Background(), pkt)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	// Offboard the user while their PK Token is still valid
+	listJson, err := json.Marshal(verifier.RevocationList{
+		Revoked: []verifier.RevocationEntry{{Hash: verifier.TokenHash(pkt)}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(listPath, listJson, 0600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(listPath, later, later))
+
+	revoked, err = checker.IsRevoked(context.Background(), pkt)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// A missing revocation list fails closed
+	require.NoError(t, os.Remove(listPath))
+	_, err = checker.IsRevoked(context.Background(), pkt)
+	require.Error(t, err)
+}
+
+func TestHTTPRevocationCheckerCache(t *testing.T) {
+	provider, _, err := NewMockOpenIdProvider(false, "issuer-provider", "verifier", map[string]any{
+		"aud": "verifier",
+	})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"revoked": []}`))
+	}))
+	defer server.Close()
+
+	checker := verifier.NewHTTPRevocationChecker(server.URL, nil, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		revoked, err := checker.IsRevoked(context.Background(), pkt)
+		require.NoError(t, err)
+		require.False(t, revoked)
+	}
+	require.Equal(t, int32(1), fetches.Load())
+
+	// Once the cached list expires a failed refresh fails the check
+	failing.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	_, err = checker.IsRevoked(context.Background(), pkt)
+	require.ErrorContains(t, err, "failed to fetch revocation list")
+	require.Equal(t, int32(2), fetches.Load())
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultUseRetention is how long MemoryUseCounter remembers the uses of a
+// PK Token. It matches the longest built in expiration policy,
+// MAX_AGE_1WEEK, so a PK Token's uses are remembered for as long as it can
+// be valid.
+const DefaultUseRetention = 7 * 24 * time.Hour
+
+// UseCounter counts the uses of limited-use PK Tokens, those with a
+// max_uses CIC claim, so the verifier can reject them once the limit is
+// reached. Verifiers sharing a UseCounter share the limit.
+type UseCounter interface {
+	// Use records a use of the PK Token with the key and returns the number
+	// of times it has been used, including this use. Use must be atomic so
+	// concurrent verifications can't exceed the limit.
+	Use(ctx context.Context, key string) (int, error)
+}
+
+type useEntry struct {
+	uses       int
+	expiration time.Time
+}
+
+// MemoryUseCounter is a UseCounter kept in process memory, acting as a
+// replay cache for the PK Tokens verified by a single process
+type MemoryUseCounter struct {
+	Retention time.Duration
+
+	entries   map[string]useEntry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+var _ UseCounter = (*MemoryUseCounter)(nil)
+
+func NewMemoryUseCounter() *MemoryUseCounter {
+	return &MemoryUseCounter{
+		Retention: DefaultUseRetention,
+		entries:   map[string]useEntry{},
+	}
+}
+
+func (c *MemoryUseCounter) Use(_ context.Context, key string) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	// Drop PK Tokens we no longer need to remember at most once a minute
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, entry := range c.entries {
+			if now.After(entry.expiration) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expiration) {
+		entry = useEntry{expiration: now.Add(c.Retention)}
+	}
+	entry.uses++
+	c.entries[key] = entry
+	return entry.uses, nil
+}
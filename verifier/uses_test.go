@@ -0,0 +1,138 @@
+// Copyright 2024 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package verifier_test
+
+import (
+	"context"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedUsePKToken(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{"aud": clientID})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+
+	oneShotPkt, err := opkClient.Auth(context.Background(), client.OneShot())
+	require.NoError(t, err)
+	twoUsePkt, err := opkClient.Auth(context.Background(), client.WithMaxUses(2))
+	require.NoError(t, err)
+	unlimitedPkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	// Without a use counter the limit can't be enforced
+	noCounterVerifier, err := verifier.New(provider)
+	require.NoError(t, err)
+	report := noCounterVerifier.VerifyPKTokenReport(context.Background(), oneShotPkt)
+	require.ErrorContains(t, report.Err, "no use counter is configured")
+	require.Equal(t, verifier.ReasonUsesExhausted, report.Reason)
+	require.NoError(t, noCounterVerifier.VerifyPKToken(context.Background(), unlimitedPkt))
+
+	// Verifiers sharing a counter share the limit
+	counter := verifier.NewMemoryUseCounter()
+	verifier1, err := verifier.New(provider, verifier.WithUseCounter(counter))
+	require.NoError(t, err)
+	verifier2, err := verifier.New(provider, verifier.WithUseCounter(counter))
+	require.NoError(t, err)
+
+	report = verifier1.VerifyPKTokenReport(context.Background(), oneShotPkt)
+	require.NoError(t, report.Err)
+	check, ok := report.Check(verifier.CheckUses)
+	require.True(t, ok)
+	require.Equal(t, verifier.CheckPassed, check.Status)
+
+	report = verifier2.VerifyPKTokenReport(context.Background(), oneShotPkt)
+	require.ErrorContains(t, report.Err, "exceeding its limit of 1")
+	require.Equal(t, verifier.ReasonUsesExhausted, report.Reason)
+
+	require.NoError(t, verifier1.VerifyPKToken(context.Background(), twoUsePkt))
+	require.NoError(t, verifier2.VerifyPKToken(context.Background(), twoUsePkt))
+	require.Error(t, verifier1.VerifyPKToken(context.Background(), twoUsePkt))
+
+	for i := 0; i < 3; i++ {
+		report = verifier1.VerifyPKTokenReport(context.Background(), unlimitedPkt)
+		require.NoError(t, report.Err)
+		check, ok := report.Check(verifier.CheckUses)
+		require.True(t, ok)
+		require.Equal(t, verifier.CheckSkipped, check.Status)
+	}
+
+	// Failed verifications don't use up the PK Token
+	otherIssuerProvider, _, err := NewMockOpenIdProvider(false, "other-issuer", clientID, map[string]any{"aud": clientID})
+	require.NoError(t, err)
+	otherClient, err := client.New(otherIssuerProvider)
+	require.NoError(t, err)
+	otherPkt, err := otherClient.Auth(context.Background(), client.OneShot())
+	require.NoError(t, err)
+	require.Error(t, verifier1.VerifyPKToken(context.Background(), otherPkt))
+	otherVerifier, err := verifier.New(otherIssuerProvider, verifier.WithUseCounter(counter))
+	require.NoError(t, err)
+	require.NoError(t, otherVerifier.VerifyPKToken(context.Background(), otherPkt))
+}
+
+func TestLimitedUsePKTokenGQResigned(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{"aud": clientID})
+	require.NoError(t, err)
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	rsaPkt, err := opkClient.Auth(context.Background(), client.OneShot())
+	require.NoError(t, err)
+
+	// GQ signatures are randomized, so whoever holds the RSA signed ID
+	// Token can make any number of GQ signed PK Tokens from it
+	record, err := provider.PublicKeyByToken(context.Background(), rsaPkt.OpToken)
+	require.NoError(t, err)
+	sv, err := gq.New256SignerVerifier(record.PublicKey.(*rsa.PublicKey))
+	require.NoError(t, err)
+	gqPkt := func() *pktoken.PKToken {
+		gqToken, err := sv.SignJWT(rsaPkt.OpToken)
+		require.NoError(t, err)
+		pkt, err := pktoken.New(gqToken, rsaPkt.CicToken)
+		require.NoError(t, err)
+		return pkt
+	}
+	gqPkt1, gqPkt2 := gqPkt(), gqPkt()
+	require.NotEqual(t, gqPkt1.OpToken, gqPkt2.OpToken)
+	require.Equal(t, verifier.TokenHash(rsaPkt), verifier.TokenHash(gqPkt1))
+	require.Equal(t, verifier.TokenHash(rsaPkt), verifier.TokenHash(gqPkt2))
+
+	// but they all share the one use
+	v, err := verifier.New(provider, verifier.WithUseCounter(verifier.NewMemoryUseCounter()))
+	require.NoError(t, err)
+	require.NoError(t, v.VerifyPKToken(context.Background(), gqPkt1))
+	require.ErrorContains(t, v.VerifyPKToken(context.Background(), gqPkt2), "exceeding its limit of 1")
+	require.ErrorContains(t, v.VerifyPKToken(context.Background(), rsaPkt), "exceeding its limit of 1")
+
+	// and are revoked together
+	list := &verifier.RevocationList{Revoked: []verifier.RevocationEntry{{Hash: verifier.TokenHash(gqPkt1)}}}
+	revoked, err := list.IsRevoked(gqPkt2)
+	require.NoError(t, err)
+	require.True(t, revoked)
+}
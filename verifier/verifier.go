@@ -19,12 +19,16 @@ package verifier
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/cosigner"
 	"github.com/openpubkey/openpubkey/gq"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/telemetry"
 )
 
 type ProviderVerifier interface {
@@ -43,6 +47,17 @@ type CosignerVerifier interface {
 	VerifyCosigner(ctx context.Context, pkt *pktoken.PKToken) error
 }
 
+// SignatureVerifier is an extension point for verifying signatures beyond
+// the OP, CIC and COS signatures handled by the core verifier, such as
+// organization notary or timestamping authority signatures. Registered
+// signature verifiers are run after the core checks succeed.
+type SignatureVerifier interface {
+	// Type returns the signature type this verifier is responsible for.
+	// Only one signature verifier may be registered per type.
+	Type() pktoken.SignatureType
+	VerifySignature(ctx context.Context, pkt *pktoken.PKToken) error
+}
+
 type VerifierOpts func(*Verifier) error
 
 // RequireRefreshedIDToken instructs the verifier to check that
@@ -54,6 +69,60 @@ func RequireRefreshedIDToken() VerifierOpts {
 	}
 }
 
+// RequireEmailVerified rejects PK Tokens whose ID Token has an email claim
+// but not an email_verified claim that is true. Set it whenever decisions
+// are made by email, as OPs such as Google and Azure include emails the
+// user hasn't proven control of. PK Tokens without an email claim, e.g.
+// from workload OPs, are unaffected.
+func RequireEmailVerified() VerifierOpts {
+	return func(v *Verifier) error {
+		v.requireEmailVerified = true
+		return nil
+	}
+}
+
+// WithExpirationPolicy checks the ID Token in the PK Token against the
+// policy in addition to any checks performed by the provider verifiers.
+// This lets the verifier require, for instance, a clock skew allowance or
+// maximum age regardless of how each provider verifier is configured.
+func WithExpirationPolicy(policy providers.ExpirationPolicy) VerifierOpts {
+	return func(v *Verifier) error {
+		v.expirationPolicy = &policy
+		return nil
+	}
+}
+
+// WithClockSkew tolerates the clocks of the OPs, clients and cosigners
+// being up to the policy's tolerance behind or ahead of the verifier's. It
+// is applied to the expiration policy set with WithExpirationPolicy and to
+// the expiration of scoped assertions, replacing any skew the expiration
+// policy was configured with. Without it scoped assertions tolerate no skew.
+func WithClockSkew(skew clockskew.Policy) VerifierOpts {
+	return func(v *Verifier) error {
+		v.clockSkew = &skew
+		return nil
+	}
+}
+
+// WithRevocationCheckers rejects PK Tokens which any of the checkers reports
+// as revoked
+func WithRevocationCheckers(checkers ...RevocationChecker) VerifierOpts {
+	return func(v *Verifier) error {
+		v.revocationCheckers = append(v.revocationCheckers, checkers...)
+		return nil
+	}
+}
+
+// WithUseCounter enforces the max_uses claim of limited-use PK Tokens by
+// counting their uses with the counter. Without a use counter limited-use
+// PK Tokens are rejected, as their limit can't be enforced.
+func WithUseCounter(counter UseCounter) VerifierOpts {
+	return func(v *Verifier) error {
+		v.useCounter = counter
+		return nil
+	}
+}
+
 func WithCosignerVerifiers(verifiers ...*cosigner.DefaultCosignerVerifier) VerifierOpts {
 	return func(v *Verifier) error {
 		for _, verifier := range verifiers {
@@ -78,6 +147,24 @@ func AddProviderVerifiers(verifiers ...ProviderVerifier) VerifierOpts {
 	}
 }
 
+// WithSignatureVerifiers registers verifiers for external signature types.
+func WithSignatureVerifiers(verifiers ...SignatureVerifier) VerifierOpts {
+	return func(v *Verifier) error {
+		for _, verifier := range verifiers {
+			switch verifier.Type() {
+			case pktoken.OIDC, pktoken.CIC, pktoken.COS:
+				return fmt.Errorf("signature verifier cannot override built-in signature type: %s", verifier.Type())
+			}
+			if _, ok := v.signatureVerifiers[verifier.Type()]; ok {
+				return fmt.Errorf("signature verifier found with duplicate type: %s", verifier.Type())
+			}
+			v.signatureVerifiers[verifier.Type()] = verifier
+			v.signatureVerifierOrder = append(v.signatureVerifierOrder, verifier.Type())
+		}
+		return nil
+	}
+}
+
 type Check func(*Verifier, *pktoken.PKToken) error
 
 func GQOnly() Check {
@@ -94,10 +181,53 @@ func GQOnly() Check {
 	}
 }
 
+// RequireScope checks that the PK Token is accompanied by a scoped
+// assertion, signed by the PK Token's client key, which restricts its use
+// to the given audience. If action is not empty the assertion must also be
+// restricted to that action. Expired assertions are rejected.
+func RequireScope(assertion []byte, audience string, action string) Check {
+	return func(v *Verifier, pkt *pktoken.PKToken) error {
+		scope, err := pkt.VerifyScopedAssertion(assertion)
+		if err != nil {
+			return fmt.Errorf("error verifying scoped assertion: %w", err)
+		}
+		if scope.Audience != audience {
+			return fmt.Errorf("scoped assertion audience (%s) doesn't match expected audience (%s)", scope.Audience, audience)
+		}
+		if action != "" && scope.Action != action {
+			return fmt.Errorf("scoped assertion action (%s) doesn't match expected action (%s)", scope.Action, action)
+		}
+		if v.ClockSkew().Expired(time.Unix(scope.Expiration, 0), time.Now()) {
+			return fmt.Errorf("scoped assertion has expired")
+		}
+		return nil
+	}
+}
+
+// WithTelemetry records a span for each verification, with child spans
+// for each check and the JWKS fetches they make, and counts failures with t
+func WithTelemetry(t *telemetry.Telemetry) VerifierOpts {
+	return func(v *Verifier) error {
+		v.telemetry = t
+		return nil
+	}
+}
+
 type Verifier struct {
 	providers               map[string]ProviderVerifier
 	cosigners               map[string]CosignerVerifier
 	requireRefreshedIDToken bool
+	requireEmailVerified    bool
+	pinnedProviderKeys      map[string][]string
+	expirationPolicy        *providers.ExpirationPolicy
+	clockSkew               *clockskew.Policy
+	revocationCheckers      []RevocationChecker
+	useCounter              UseCounter
+	auditSinks              []AuditSink
+	telemetry               *telemetry.Telemetry
+
+	signatureVerifiers     map[pktoken.SignatureType]SignatureVerifier
+	signatureVerifierOrder []pktoken.SignatureType
 }
 
 func New(verifier ProviderVerifier, options ...VerifierOpts) (*Verifier, error) {
@@ -105,7 +235,8 @@ func New(verifier ProviderVerifier, options ...VerifierOpts) (*Verifier, error)
 		providers: map[string]ProviderVerifier{
 			verifier.Issuer(): verifier,
 		},
-		cosigners: map[string]CosignerVerifier{},
+		cosigners:          map[string]CosignerVerifier{},
+		signatureVerifiers: map[pktoken.SignatureType]SignatureVerifier{},
 	}
 
 	for _, option := range options {
@@ -114,9 +245,45 @@ func New(verifier ProviderVerifier, options ...VerifierOpts) (*Verifier, error)
 		}
 	}
 
+	for issuer, provider := range v.providers {
+		if err := checkCommitType(issuer, provider); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.checkPinnedProviderKeys(); err != nil {
+		return nil, err
+	}
+
 	return v, nil
 }
 
+// checkCommitType returns an error if the provider verifier checks the CIC
+// commitment with a CommitType other than the one registered for the
+// issuer in providers.Commitments, which would reject every PK Token
+func checkCommitType(issuer string, provider ProviderVerifier) error {
+	withCommitType, ok := provider.(interface{ CommitType() providers.CommitType })
+	if !ok {
+		return nil
+	}
+	commitType := withCommitType.CommitType()
+	if commitType == (providers.CommitType{}) {
+		return nil
+	}
+	if err := commitType.Validate(); err != nil {
+		return fmt.Errorf("provider verifier for issuer (%s) is misconfigured: %w", issuer, err)
+	}
+	return providers.Commitments.Check(issuer, commitType)
+}
+
+// ClockSkew returns the policy set with WithClockSkew, clockskew.None if it
+// wasn't set
+func (v *Verifier) ClockSkew() clockskew.Policy {
+	if v.clockSkew == nil {
+		return clockskew.None
+	}
+	return *v.clockSkew
+}
+
 // Verifies whether a PK token is valid and matches all expected claims.
 //
 // extraChecks: Allows for optional specification of additional checks
@@ -125,83 +292,7 @@ func (v *Verifier) VerifyPKToken(
 	pkt *pktoken.PKToken,
 	extraChecks ...Check,
 ) error {
-	// Don't even bother doing anything if the user's isn't valid
-	if err := verifyCicSignature(pkt); err != nil {
-		return fmt.Errorf("error verifying client signature on PK Token: %w", err)
-	}
-
-	issuer, err := pkt.Issuer()
-	if err != nil {
-		return err
-	}
-
-	providerVerifier, ok := v.providers[issuer]
-	if !ok {
-		return fmt.Errorf("unrecognized issuer: %s", issuer)
-	}
-
-	cic, err := pkt.GetCicValues()
-	if err != nil {
-		return err
-	}
-	if err := providerVerifier.VerifyIDToken(ctx, pkt.OpToken, cic); err != nil {
-		return err
-	}
-
-	if v.requireRefreshedIDToken {
-		if reProviderVerifier, ok := providerVerifier.(RefreshableProviderVerifier); !ok {
-			return fmt.Errorf("refreshed ID Token verification required but provider verifier (issuer=%s) does not support it", issuer)
-		} else {
-			if pkt.FreshIDToken == nil {
-				return fmt.Errorf("no refreshed ID Token set")
-			}
-			if err := reProviderVerifier.VerifyRefreshedIDToken(ctx, pkt.OpToken, pkt.FreshIDToken); err != nil {
-				return err
-			}
-		}
-	}
-
-	if len(v.cosigners) > 0 {
-		if pkt.Cos == nil {
-			// If there's no cosigner signature and any provided cosigner verifiers are strict, then return error
-			for _, cosignerVerifier := range v.cosigners {
-				if cosignerVerifier.Strict() {
-					return fmt.Errorf("missing required cosigner signature by %s", cosignerVerifier.Issuer())
-				}
-			}
-		} else {
-			cosignerClaims, err := pkt.ParseCosignerClaims()
-			if err != nil {
-				return err
-			}
-
-			cosignerVerifier, ok := v.cosigners[cosignerClaims.Issuer]
-			if !ok {
-				// If other cosigners are present, do we accept?
-				return fmt.Errorf("unrecognized cosigner %s", cosignerClaims.Issuer)
-			}
-
-			// Verify cosigner signature
-			if err := cosignerVerifier.VerifyCosigner(ctx, pkt); err != nil {
-				return err
-			}
-
-			// If any other cosigner verifiers are set to strict but aren't present, then return error
-			for _, cosignerVerifier := range v.cosigners {
-				if cosignerVerifier.Strict() && cosignerVerifier.Issuer() != cosignerClaims.Issuer {
-					return fmt.Errorf("missing required cosigner signature by %s", cosignerVerifier.Issuer())
-				}
-			}
-		}
-	}
-	// Cycles through any provided additional checks and returns the first error, if any.
-	for _, check := range extraChecks {
-		if err := check(v, pkt); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return v.VerifyPKTokenReport(ctx, pkt, extraChecks...).Err
 }
 
 func verifyCicSignature(pkt *pktoken.PKToken) error {
@@ -20,11 +20,15 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/clockskew"
 	"github.com/openpubkey/openpubkey/discover"
+	"github.com/openpubkey/openpubkey/pktoken"
 	pktoken_mocks "github.com/openpubkey/openpubkey/pktoken/mocks"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/providers/mocks"
@@ -234,6 +238,123 @@ func TestVerifierRefreshedIDToken(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestRequireScope(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{
+		"aud": clientID,
+	})
+	require.NoError(t, err)
+
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+
+	_, err = opkClient.Scope("https://service.example.com")
+	require.ErrorContains(t, err, "no PK Token set")
+
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	pktVerifier, err := verifier.New(provider)
+	require.NoError(t, err)
+
+	assertion, err := opkClient.Scope("https://service.example.com", client.WithScopeAction("deploy"))
+	require.NoError(t, err)
+
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(assertion, "https://service.example.com", "deploy"))
+	require.NoError(t, err)
+
+	// An empty action accepts any action the assertion was scoped to
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(assertion, "https://service.example.com", ""))
+	require.NoError(t, err)
+
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(assertion, "https://other.example.com", "deploy"))
+	require.ErrorContains(t, err, "doesn't match expected audience")
+
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(assertion, "https://service.example.com", "delete"))
+	require.ErrorContains(t, err, "doesn't match expected action")
+
+	expired, err := pkt.NewScopedAssertion(pktoken.ScopeClaims{
+		Audience:   "https://service.example.com",
+		IssuedAt:   time.Now().Add(-10 * time.Minute).Unix(),
+		Expiration: time.Now().Add(-5 * time.Minute).Unix(),
+	}, opkClient.GetSigner())
+	require.NoError(t, err)
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(expired, "https://service.example.com", ""))
+	require.ErrorContains(t, err, "scoped assertion has expired")
+
+	// Expiration is checked allowing for the clock skew
+	skewVerifier, err := verifier.New(provider, verifier.WithClockSkew(clockskew.New(10*time.Minute)))
+	require.NoError(t, err)
+	err = skewVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(expired, "https://service.example.com", ""))
+	require.NoError(t, err)
+
+	// An assertion signed by a different key must be rejected
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	forged, err := pkt.NewScopedAssertion(pktoken.ScopeClaims{
+		Audience:   "https://service.example.com",
+		IssuedAt:   time.Now().Unix(),
+		Expiration: time.Now().Add(time.Minute).Unix(),
+	}, otherSigner)
+	require.NoError(t, err)
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt, verifier.RequireScope(forged, "https://service.example.com", ""))
+	require.ErrorContains(t, err, "error verifying scoped assertion")
+
+	_, err = opkClient.Scope("https://service.example.com", client.WithScopeTTL(-time.Minute))
+	require.ErrorContains(t, err, "scope TTL must be positive")
+}
+
+type mockSignatureVerifier struct {
+	sigType pktoken.SignatureType
+	err     error
+	called  bool
+}
+
+func (m *mockSignatureVerifier) Type() pktoken.SignatureType {
+	return m.sigType
+}
+
+func (m *mockSignatureVerifier) VerifySignature(_ context.Context, _ *pktoken.PKToken) error {
+	m.called = true
+	return m.err
+}
+
+func TestSignatureVerifiers(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{
+		"aud": clientID,
+	})
+	require.NoError(t, err)
+
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	notary := &mockSignatureVerifier{sigType: "NOTARY"}
+	pktVerifier, err := verifier.New(provider, verifier.WithSignatureVerifiers(notary))
+	require.NoError(t, err)
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt)
+	require.NoError(t, err)
+	require.True(t, notary.called)
+
+	tsa := &mockSignatureVerifier{sigType: "TSA", err: fmt.Errorf("bad timestamp")}
+	pktVerifier, err = verifier.New(provider, verifier.WithSignatureVerifiers(notary, tsa))
+	require.NoError(t, err)
+	err = pktVerifier.VerifyPKToken(context.Background(), pkt)
+	require.ErrorContains(t, err, "error verifying TSA signature: bad timestamp")
+
+	_, err = verifier.New(provider, verifier.WithSignatureVerifiers(notary, notary))
+	require.ErrorContains(t, err, "duplicate type")
+
+	_, err = verifier.New(provider, verifier.WithSignatureVerifiers(&mockSignatureVerifier{sigType: pktoken.COS}))
+	require.ErrorContains(t, err, "cannot override built-in signature type")
+}
+
 func TestCICSignature(t *testing.T) {
 	clientID := "test_client_id"
 	alg := jwa.ES256
@@ -382,3 +503,104 @@ func TestGQCommitment(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifierExpirationPolicy(t *testing.T) {
+	issuer := "issuer-provider"
+	clientID := "verifier"
+
+	// The OP's clock is ahead of ours so the ID Token isn't valid yet
+	provider, _, err := NewMockOpenIdProvider(false, issuer, clientID, map[string]any{
+		"aud": clientID,
+		"nbf": time.Now().Add(5 * time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+
+	opkClient, err := client.New(provider)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		policy   providers.ExpirationPolicy
+		expError string
+	}{
+		{name: "nbf not required", policy: providers.ExpirationPolicies.OIDC},
+		{name: "nbf required", policy: providers.ExpirationPolicies.OIDC.WithRequireNotBefore(),
+			expError: "the ID token is not yet valid"},
+		{name: "nbf required with clock skew",
+			policy: providers.ExpirationPolicies.OIDC.WithRequireNotBefore().WithClockSkew(10 * time.Minute)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pktVerifier, err := verifier.New(provider, verifier.WithExpirationPolicy(tc.policy))
+			require.NoError(t, err)
+			err = pktVerifier.VerifyPKToken(context.Background(), pkt)
+			if tc.expError != "" {
+				require.ErrorContains(t, err, tc.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifierCommitType(t *testing.T) {
+	issuer := "https://registered.example.com"
+	require.NoError(t, providers.Commitments.Register(issuer, providers.CommitTypesEnum.AUD_CLAIM))
+
+	_, err := verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{SkipClientIDCheck: true}))
+	require.NoError(t, err)
+	_, err = verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+		CommitType: providers.CommitTypesEnum.AUD_CLAIM,
+	}))
+	require.NoError(t, err)
+
+	_, err = verifier.New(providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+		CommitType: providers.CommitTypesEnum.NONCE_CLAIM,
+	}))
+	require.ErrorContains(t, err, "is registered with the commitment in the \"aud\" claim")
+	_, err = verifier.New(providers.NewProviderVerifier("https://accounts.example.com", providers.ProviderVerifierOpts{
+		CommitType: providers.CommitType{Claim: "nonce", GQCommitment: true},
+	}))
+	require.ErrorContains(t, err, "provider verifier for issuer (https://accounts.example.com) is misconfigured")
+}
+
+func TestRequireEmailVerified(t *testing.T) {
+	testCases := []struct {
+		name        string
+		extraClaims map[string]any
+		expError    string
+	}{
+		{name: "verified", extraClaims: map[string]any{"email": "alice@example.com", "email_verified": true}},
+		{name: "no email", extraClaims: map[string]any{}},
+		{name: "unverified", extraClaims: map[string]any{"email": "alice@example.com", "email_verified": false},
+			expError: "email alice@example.com is not verified by the OP"},
+		{name: "no email_verified claim", extraClaims: map[string]any{"email": "alice@example.com"},
+			expError: "email alice@example.com is not verified by the OP"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, _, err := NewMockOpenIdProvider(false, "https://accounts.example.com", "test_client_id", tc.extraClaims)
+			require.NoError(t, err)
+			opkClient, err := client.New(provider)
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			pktVerifier, err := verifier.New(provider, verifier.RequireEmailVerified())
+			require.NoError(t, err)
+			report := pktVerifier.VerifyPKTokenReport(context.Background(), pkt)
+			check, ok := report.Check(verifier.CheckEmailVerified)
+			require.True(t, ok)
+			if tc.expError != "" {
+				require.ErrorContains(t, report.Err, tc.expError)
+				require.Equal(t, verifier.CheckFailed, check.Status)
+			} else {
+				require.NoError(t, report.Err)
+				require.Equal(t, verifier.CheckPassed, check.Status)
+			}
+		})
+	}
+}